@@ -0,0 +1,253 @@
+// Performance regression benchmarks
+//
+//   cargo bench --bench pipeline -- [FILTER] [--save FILE] [--compare FILE] [--threshold PCT]
+//
+// Each case runs in batches for about a second and reports the median time
+// per iteration. `--save` writes the results as JSON; `--compare` reads such
+// a file, prints the change for every case and exits with 1 if any got more
+// than `--threshold` percent (default 10) slower. `make bench-compare` runs
+// both against another branch. Numbers only compare on the same machine.
+
+use anyhow::{Context, Result, bail};
+use blazeremap::event::{AxisCode, ButtonCode, InputEvent};
+use blazeremap::mapping::{MappingEngine, format::ProfileFormat, profile::Profile};
+use std::collections::BTreeMap;
+use std::hint::black_box;
+use std::time::{Duration, Instant};
+
+const PROFILE: &str = include_str!("profile.toml");
+
+/// How long each case runs, after a quarter as long of warm-up
+const MEASURE_TIME: Duration = Duration::from_secs(1);
+/// Batches are sized to take about this long, so timer overhead disappears
+const BATCH_TIME: Duration = Duration::from_millis(5);
+
+const DEFAULT_THRESHOLD: f64 = 10.0;
+
+/// Run `f` repeatedly; median nanoseconds per call
+fn measure(mut f: impl FnMut()) -> f64 {
+    // Warm up, and find how many calls fill a batch
+    let start = Instant::now();
+    let mut calls = 0u64;
+    while start.elapsed() < MEASURE_TIME / 4 {
+        f();
+        calls += 1;
+    }
+    let per_call = start.elapsed().as_nanos() as f64 / calls as f64;
+    let batch = ((BATCH_TIME.as_nanos() as f64 / per_call) as u64).max(1);
+
+    let mut samples = Vec::new();
+    let start = Instant::now();
+    while start.elapsed() < MEASURE_TIME || samples.len() < 5 {
+        let batch_start = Instant::now();
+        for _ in 0..batch {
+            f();
+        }
+        samples.push(batch_start.elapsed().as_nanos() as f64 / batch as f64);
+    }
+    samples.sort_by(f64::total_cmp);
+    samples[samples.len() / 2]
+}
+
+/// Run `f` with standard output going nowhere
+///
+/// Enumeration reports every device it finds; thousands of runs of it would
+/// bury the results.
+#[cfg(target_os = "linux")]
+fn quiet<T>(f: impl FnOnce() -> T) -> T {
+    use std::io::Write;
+    use std::os::fd::AsRawFd;
+
+    let null = std::fs::OpenOptions::new().write(true).open("/dev/null").unwrap();
+    std::io::stdout().flush().unwrap();
+    // SAFETY: plain descriptor juggling; `saved` is ours and closed below
+    let saved = unsafe { libc::dup(libc::STDOUT_FILENO) };
+    unsafe { libc::dup2(null.as_raw_fd(), libc::STDOUT_FILENO) };
+    let result = f();
+    std::io::stdout().flush().unwrap();
+    unsafe {
+        libc::dup2(saved, libc::STDOUT_FILENO);
+        libc::close(saved);
+    }
+    result
+}
+
+#[cfg(not(target_os = "linux"))]
+fn quiet<T>(f: impl FnOnce() -> T) -> T {
+    f()
+}
+
+/// Events fed to the engine one per call, round and round
+fn translate(events: Vec<InputEvent>) -> impl FnMut() {
+    let mut engine =
+        MappingEngine::load_from_profile(&Profile::decode(PROFILE, ProfileFormat::Toml).unwrap())
+            .unwrap();
+    let mut out = Vec::new();
+    let mut next = events.into_iter().cycle();
+    move || {
+        out.clear();
+        engine.process_into(black_box(&next.next().unwrap()), &mut out).unwrap();
+        black_box(&out);
+    }
+}
+
+/// A named benchmark; each call is one iteration
+type Case = (&'static str, Box<dyn FnMut()>);
+
+fn cases() -> Vec<Case> {
+    let profile = Profile::decode(PROFILE, ProfileFormat::Toml).unwrap();
+    let buttons =
+        [ButtonCode::South, ButtonCode::East, ButtonCode::LeftShoulder, ButtonCode::Start]
+            .into_iter()
+            .flat_map(|code| {
+                [
+                    InputEvent::button_press(code),
+                    InputEvent::sync(),
+                    InputEvent::button_release(code),
+                    InputEvent::sync(),
+                ]
+            })
+            .collect();
+    // A stick sweeping back and forth, with the D-pad clicking in between
+    let sticks = (-32768..=32767i32)
+        .step_by(4096)
+        .flat_map(|value| {
+            [
+                InputEvent::axis_move(AxisCode::LeftX, value),
+                InputEvent::axis_move(AxisCode::LeftY, -value),
+                InputEvent::axis_move(AxisCode::DPadY, value.signum()),
+                InputEvent::sync(),
+            ]
+        })
+        .collect();
+    let script = [
+        InputEvent::axis_move(AxisCode::LeftY, -32768),
+        InputEvent::button_press(ButtonCode::LeftStick),
+        InputEvent::button_release(ButtonCode::LeftStick),
+        InputEvent::axis_move(AxisCode::LeftY, 0),
+        InputEvent::button_press(ButtonCode::LeftStick),
+        InputEvent::button_release(ButtonCode::LeftStick),
+    ]
+    .to_vec();
+
+    vec![
+        (
+            "enumerate",
+            Box::new(|| {
+                black_box(blazeremap::list_gamepads().ok());
+            }),
+        ),
+        (
+            "profile/decode",
+            Box::new(|| {
+                black_box(Profile::decode(black_box(PROFILE), ProfileFormat::Toml).unwrap());
+            }),
+        ),
+        (
+            "profile/compile",
+            Box::new(move || {
+                black_box(MappingEngine::load_from_profile(black_box(&profile)).unwrap());
+            }),
+        ),
+        ("translate/buttons", Box::new(translate(buttons))),
+        ("translate/sticks", Box::new(translate(sticks))),
+        ("translate/script", Box::new(translate(script))),
+    ]
+}
+
+struct Options {
+    filter: Option<String>,
+    save: Option<String>,
+    compare: Option<String>,
+    threshold: f64,
+}
+
+fn parse_args() -> Result<Options> {
+    let mut options =
+        Options { filter: None, save: None, compare: None, threshold: DEFAULT_THRESHOLD };
+    let mut args = std::env::args().skip(1);
+    while let Some(arg) = args.next() {
+        match arg.as_str() {
+            // Passed by `cargo bench`
+            "--bench" => {}
+            "--save" => options.save = Some(args.next().context("--save needs a file")?),
+            "--compare" => options.compare = Some(args.next().context("--compare needs a file")?),
+            "--threshold" => {
+                let value = args.next().context("--threshold needs a percentage")?;
+                options.threshold = value.parse::<f64>().context("Invalid --threshold")?;
+            }
+            other if other.starts_with('-') => bail!("Unknown option '{}'", other),
+            filter => options.filter = Some(filter.to_string()),
+        }
+    }
+    Ok(options)
+}
+
+/// Nanoseconds per iteration, readably
+fn format_time(ns: f64) -> String {
+    match ns {
+        ns if ns < 1_000.0 => format!("{:.1} ns", ns),
+        ns if ns < 1_000_000.0 => format!("{:.2} µs", ns / 1_000.0),
+        ns => format!("{:.2} ms", ns / 1_000_000.0),
+    }
+}
+
+fn main() -> Result<()> {
+    let options = parse_args()?;
+    let baseline: Option<BTreeMap<String, f64>> = match &options.compare {
+        Some(path) => {
+            let text = std::fs::read_to_string(path)
+                .with_context(|| format!("Failed to read {}", path))?;
+            Some(
+                serde_json::from_str(&text)
+                    .with_context(|| format!("Invalid baseline {}", path))?,
+            )
+        }
+        None => None,
+    };
+
+    let mut results = BTreeMap::new();
+    let mut regressions = 0;
+    for (name, mut f) in cases() {
+        if options.filter.as_ref().is_some_and(|filter| !name.contains(filter.as_str())) {
+            continue;
+        }
+        let ns = quiet(|| measure(&mut f));
+        results.insert(name.to_string(), ns);
+
+        match baseline.as_ref().map(|baseline| baseline.get(name)) {
+            None => println!("{:<20} {:>12}", name, format_time(ns)),
+            Some(None) => println!("{:<20} {:>12}   (new)", name, format_time(ns)),
+            Some(Some(&base)) => {
+                let change = (ns - base) / base * 100.0;
+                let verdict = if change > options.threshold {
+                    regressions += 1;
+                    "  REGRESSION"
+                } else {
+                    ""
+                };
+                println!(
+                    "{:<20} {:>12}   was {:>12}   {:>+7.1}%{}",
+                    name,
+                    format_time(ns),
+                    format_time(base),
+                    change,
+                    verdict
+                );
+            }
+        }
+    }
+
+    if let Some(path) = &options.save {
+        std::fs::write(path, serde_json::to_string_pretty(&results)? + "\n")
+            .with_context(|| format!("Failed to write {}", path))?;
+    }
+    if regressions > 0 {
+        eprintln!(
+            "{} benchmarks more than {}% slower than the baseline",
+            regressions, options.threshold
+        );
+        std::process::exit(1);
+    }
+    Ok(())
+}
@@ -0,0 +1,103 @@
+//! The mapping engine against arbitrary event sequences
+//!
+//! Every three bytes of input are one step: a button press or release, an
+//! axis move, a sync or a context switch, some milliseconds after the last.
+//! Whatever the order, once every button is released and every axis
+//! centered, no key or action may be left held.
+#![no_main]
+
+use blazeremap::event::{
+    AxisCode, ButtonCode, InputEvent, KeyboardCode, KeyboardEventType, OutputEvent,
+};
+use blazeremap::mapping::{
+    MappingEngine, context::MappingContext, format::ProfileFormat, profile::Profile,
+};
+use libfuzzer_sys::fuzz_target;
+use std::collections::HashSet;
+use std::time::{Duration, Instant};
+
+const PROFILE: &str = include_str!("../mapper_profile.toml");
+
+fuzz_target!(|data: &[u8]| {
+    let profile = Profile::decode(PROFILE, ProfileFormat::Toml).unwrap();
+    let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+    let mut held = Held::default();
+    let mut now = Instant::now();
+    let mut out = Vec::new();
+
+    for step in data.chunks_exact(3) {
+        let [kind, code, arg] = [step[0], step[1], step[2]];
+        now += Duration::from_millis(u64::from(arg % 64));
+        let event = match kind % 5 {
+            0 | 1 => InputEvent::Button {
+                code: ButtonCode::ALL[code as usize % ButtonCode::ALL.len()],
+                pressed: kind % 5 == 0,
+                timestamp: now,
+            },
+            2 => InputEvent::Axis {
+                code: AxisCode::ALL[code as usize % AxisCode::ALL.len()],
+                value: match arg % 4 {
+                    0 => 0,
+                    1 => -1,
+                    2 => 1,
+                    _ => i32::from(code as i8) * 258,
+                },
+                timestamp: now,
+            },
+            3 => InputEvent::Sync { timestamp: now },
+            _ => {
+                let context = MappingContext {
+                    window: (code % 2 == 0).then(|| "Docs — Firefox".to_string()),
+                    bluetooth: code & 4 != 0,
+                    battery: (code & 8 != 0).then_some(arg % 101),
+                };
+                engine.set_context(context, &mut out);
+                held.update(&mut engine, &mut out);
+                continue;
+            }
+        };
+        engine.process_into(&event, &mut out).unwrap();
+        held.update(&mut engine, &mut out);
+    }
+
+    // Let go of everything
+    now += Duration::from_secs(1);
+    for code in ButtonCode::ALL {
+        let event = InputEvent::Button { code, pressed: false, timestamp: now };
+        engine.process_into(&event, &mut out).unwrap();
+    }
+    for code in AxisCode::ALL {
+        engine
+            .process_into(&InputEvent::Axis { code, value: 0, timestamp: now }, &mut out)
+            .unwrap();
+    }
+    held.update(&mut engine, &mut out);
+    assert!(held.keys.is_empty(), "keys left held: {:?}", held.keys);
+    assert!(held.actions.is_empty(), "actions left held: {:?}", held.actions);
+});
+
+/// Keys and actions pressed and not yet released
+#[derive(Default)]
+struct Held {
+    keys: HashSet<KeyboardCode>,
+    actions: HashSet<(usize, String)>,
+}
+
+impl Held {
+    fn update(&mut self, engine: &mut MappingEngine, out: &mut Vec<OutputEvent>) {
+        for OutputEvent::Keyboard { code, event_type } in out.drain(..) {
+            match event_type {
+                KeyboardEventType::Press => self.keys.insert(code),
+                KeyboardEventType::Release => self.keys.remove(&code),
+                KeyboardEventType::Hold => continue,
+            };
+        }
+        for action in engine.drain_actions() {
+            let id = (action.action, action.source.to_string());
+            match action.pressed {
+                true => self.actions.insert(id),
+                false => self.actions.remove(&id),
+            };
+        }
+    }
+}
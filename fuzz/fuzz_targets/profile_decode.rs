@@ -0,0 +1,38 @@
+//! Profile decoding: malformed profiles must fail to load, never panic
+//!
+//! The input is tried as TOML, YAML and JSON, so any profile file seeds the
+//! corpus: `cargo +nightly fuzz run profile_decode ../tests/testdata/golden/*/`
+#![no_main]
+
+use blazeremap::mapping::{MappingEngine, format::ProfileFormat, lint, profile::Profile};
+use libfuzzer_sys::fuzz_target;
+
+const FORMATS: [ProfileFormat; 3] = [ProfileFormat::Toml, ProfileFormat::Yaml, ProfileFormat::Json];
+
+fuzz_target!(|data: &[u8]| {
+    let Ok(text) = std::str::from_utf8(data) else {
+        return;
+    };
+    for format in FORMATS {
+        lint::lint_text(text, format, None);
+        let Ok(profile) = Profile::decode(text, format) else {
+            continue;
+        };
+        // What loads may still have mappings that don't compile, but must not panic
+        let _ = MappingEngine::load_from_profile(&profile);
+
+        // Whatever loads converts to every format and back
+        for to in FORMATS {
+            let encoded = to.encode_profile(&profile).expect("a loaded profile encodes");
+            let decoded = Profile::decode(&encoded, to)
+                .unwrap_or_else(|e| panic!("{} written as {} doesn't load: {:#}", format, to, e));
+            assert_eq!(
+                to.encode_profile(&decoded).unwrap(),
+                encoded,
+                "{} written as {} changes on reload",
+                format,
+                to
+            );
+        }
+    }
+});
@@ -0,0 +1,44 @@
+#!/bin/bash
+# scripts/bench-compare.sh - benchmark this tree against another branch
+#
+# Usage: ./scripts/bench-compare.sh [BASE] [THRESHOLD]
+#   BASE       branch or commit to compare against (default: master)
+#   THRESHOLD  percent slower that counts as a regression (default: 10)
+
+set -e
+
+BASE="${1:-master}"
+THRESHOLD="${2:-10}"
+ROOT="$(git rev-parse --show-toplevel)"
+OUT="$ROOT/target/bench"
+WORKTREE="$OUT/base"
+
+echo "================================================"
+echo "BlazeRemap Benchmarks: $(git rev-parse --abbrev-ref HEAD) vs $BASE"
+echo "================================================"
+echo ""
+
+mkdir -p "$OUT"
+git worktree remove --force "$WORKTREE" 2>/dev/null || true
+git worktree add --quiet --detach "$WORKTREE" "$BASE"
+trap 'git worktree remove --force "$WORKTREE"' EXIT
+
+if [ ! -f "$WORKTREE/benches/pipeline.rs" ]; then
+    echo "❌ Error: $BASE has no benchmark suite"
+    exit 1
+fi
+
+echo "1. Benchmarking $BASE..."
+(cd "$WORKTREE" && CARGO_TARGET_DIR="$OUT/base-target" \
+    cargo bench --quiet --bench pipeline -- --save "$OUT/base.json")
+echo ""
+
+echo "2. Benchmarking working tree..."
+cargo bench --quiet --bench pipeline -- --compare "$OUT/base.json" --threshold "$THRESHOLD" || {
+    echo ""
+    echo "❌ Performance regressed; rerun on an idle machine to rule out noise"
+    exit 1
+}
+
+echo ""
+echo "✓ No benchmark more than $THRESHOLD% slower than $BASE"
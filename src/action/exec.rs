@@ -0,0 +1,296 @@
+// Exec actions: run a command when a control fires
+//
+// The command is an argv list started directly, never through a shell. It
+// learns what happened from the environment:
+//
+//   BLAZEREMAP_SOURCE     control name, e.g. "Mode" or "DPad Y"
+//   BLAZEREMAP_DIRECTION  "Positive"/"Negative" for axis sources
+//   BLAZEREMAP_EVENT      "press" or "release"
+//   BLAZEREMAP_VALUE      1/0 for buttons, the axis value for axes
+//
+// Runs are rate limited per mapping, and a mapping never has more than a few
+// copies of its command running, so mashing a button can't fork-bomb the box.
+//
+// Profiles get shared, so commands get little of the daemon: only programs
+// the ActionPolicy allowlists run, confined by the platform unless that's
+// turned off, with a timeout if it sets one and of the daemon's environment
+// only KEPT_ENV. Plugins start the same way (see plugin.rs).
+
+use anyhow::{Context, Result};
+use std::process::{Child, Command, Stdio};
+use std::thread::JoinHandle;
+use std::time::{Duration, Instant};
+
+use super::{ActionHandler, ActionPolicy};
+use crate::{
+    event::ActionEvent,
+    mapping::{Mapping, types::TriggerOn},
+    platform,
+};
+
+/// Minimum time between runs when a mapping doesn't set `rate_limit_ms`
+pub const DEFAULT_RATE_LIMIT: Duration = Duration::from_millis(250);
+
+/// Runs still in progress before new triggers are skipped
+const MAX_RUNNING: usize = 4;
+
+/// How often a run with a timeout is checked on
+const TIMEOUT_POLL: Duration = Duration::from_millis(50);
+
+/// The daemon's environment variables commands still see: enough to find
+/// programs and reach the desktop, but no tokens or keys it was started with
+const KEPT_ENV: &[&str] = &[
+    "PATH",
+    "HOME",
+    "USER",
+    "LOGNAME",
+    "LANG",
+    "LC_ALL",
+    "DISPLAY",
+    "WAYLAND_DISPLAY",
+    "XDG_RUNTIME_DIR",
+    "XDG_SESSION_TYPE",
+    "DBUS_SESSION_BUS_ADDRESS",
+];
+
+pub struct ExecAction {
+    argv: Vec<String>,
+    on: TriggerOn,
+    min_interval: Duration,
+    last_run: Option<Instant>,
+    timeout: Option<Duration>,
+    confine: Option<platform::Confine>,
+    // Threads waiting on the runs in progress
+    running: Vec<JoinHandle<()>>,
+}
+
+impl ExecAction {
+    pub fn new(mapping: &Mapping) -> Result<Self> {
+        if mapping.command.is_empty() {
+            anyhow::bail!("exec mapping for {} has no command", mapping.source_name);
+        }
+        Ok(Self {
+            argv: mapping.command.clone(),
+            on: mapping.on.unwrap_or_default(),
+            min_interval: mapping
+                .rate_limit_ms
+                .map_or(DEFAULT_RATE_LIMIT, |ms| Duration::from_millis(ms as u64)),
+            last_run: None,
+            timeout: None,
+            confine: None,
+            running: Vec::new(),
+        })
+    }
+
+    /// Run the command within `policy`'s timeout and confinement
+    ///
+    /// Fails where confinement is asked for but the platform has none.
+    pub fn with_policy(mut self, policy: &ActionPolicy) -> Result<Self> {
+        self.timeout = policy.exec_timeout;
+        self.confine = policy.confinement()?;
+        Ok(self)
+    }
+
+    pub fn program(&self) -> &str {
+        &self.argv[0]
+    }
+}
+
+impl ActionHandler for ExecAction {
+    fn handle(&mut self, event: &ActionEvent) -> Result<()> {
+        if !self.on.fires(event.pressed) {
+            return Ok(());
+        }
+
+        let now = Instant::now();
+        if self.last_run.is_some_and(|last| now.duration_since(last) < self.min_interval) {
+            tracing::debug!("Rate limited '{}' for {}", self.program(), event.source);
+            return Ok(());
+        }
+        self.running.retain(|run| !run.is_finished());
+        if self.running.len() >= MAX_RUNNING {
+            tracing::warn!("'{}' is still running {} times, skipped", self.program(), MAX_RUNNING);
+            return Ok(());
+        }
+
+        let mut command = limited_command(&self.argv[0], &self.argv[1..], self.confine.as_ref());
+        command
+            .stdin(Stdio::null())
+            .stdout(Stdio::null())
+            .env("BLAZEREMAP_SOURCE", event.source.name())
+            .env("BLAZEREMAP_EVENT", if event.pressed { "press" } else { "release" })
+            .env("BLAZEREMAP_VALUE", event.value.to_string());
+        if let Some(direction) = event.source.direction() {
+            command.env("BLAZEREMAP_DIRECTION", direction.to_string());
+        }
+
+        let child =
+            command.spawn().with_context(|| format!("Failed to run '{}'", self.program()))?;
+        self.running.push(wait(child, self.program().to_string(), self.timeout)?);
+        self.last_run = Some(now);
+        Ok(())
+    }
+}
+
+/// `program` with `args`, seeing only KEPT_ENV of the daemon's environment
+/// and started under `confine`
+pub(super) fn limited_command(
+    program: &str,
+    args: &[String],
+    confine: Option<&platform::Confine>,
+) -> Command {
+    let mut command = Command::new(program);
+    command
+        .args(args)
+        .env_clear()
+        .envs(KEPT_ENV.iter().filter_map(|&name| Some((name, std::env::var_os(name)?))));
+    if let Some(confine) = confine {
+        confine(&mut command);
+    }
+    command
+}
+
+/// Wait for `child` on a thread of its own, killing it after `timeout`
+fn wait(mut child: Child, program: String, timeout: Option<Duration>) -> Result<JoinHandle<()>> {
+    let deadline = timeout.map(|timeout| Instant::now() + timeout);
+    let thread =
+        std::thread::Builder::new().name("blazeremap-exec".to_string()).spawn(move || {
+            let status = match deadline {
+                None => child.wait(),
+                Some(deadline) => loop {
+                    match child.try_wait() {
+                        Ok(None) if Instant::now() >= deadline => {
+                            tracing::warn!("'{}' ran past its timeout, killed", program);
+                            let _ = child.kill();
+                            break child.wait();
+                        }
+                        Ok(None) => std::thread::sleep(TIMEOUT_POLL),
+                        Ok(Some(status)) => break Ok(status),
+                        Err(e) => break Err(e),
+                    }
+                },
+            };
+            match status {
+                Ok(status) if !status.success() => tracing::debug!("'{}' {}", program, status),
+                Ok(_) => {}
+                Err(e) => tracing::warn!("Failed to wait for '{}': {}", program, e),
+            }
+        })?;
+    Ok(thread)
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use crate::event::{ActionSource, AxisCode, AxisDirection, ButtonCode};
+    use crate::mapping::types::TargetType;
+
+    fn mapping(script: &str, on: Option<TriggerOn>, rate_limit_ms: Option<u32>) -> Mapping {
+        Mapping {
+            source_name: "Mode".to_string(),
+            target_type: TargetType::Exec,
+            command: vec!["sh".to_string(), "-c".to_string(), script.to_string()],
+            on,
+            rate_limit_ms,
+            ..Default::default()
+        }
+    }
+
+    fn press() -> ActionEvent {
+        ActionEvent {
+            action: 0,
+            source: ActionSource::Button(ButtonCode::Mode),
+            pressed: true,
+            value: 1,
+        }
+    }
+
+    fn wait_all(action: &mut ExecAction) {
+        for run in action.running.drain(..) {
+            run.join().unwrap();
+        }
+    }
+
+    #[test]
+    fn test_command_sees_event_environment() {
+        let out = std::env::temp_dir().join(format!("blazeremap-exec-{}", std::process::id()));
+        let script = format!(
+            "echo \"$BLAZEREMAP_SOURCE|$BLAZEREMAP_DIRECTION|$BLAZEREMAP_EVENT|$BLAZEREMAP_VALUE\" >> '{}'",
+            out.display()
+        );
+        let mut action =
+            ExecAction::new(&mapping(&script, Some(TriggerOn::Both), Some(0))).unwrap();
+
+        let source = ActionSource::Axis(AxisCode::DPadY, AxisDirection::Negative);
+        action.handle(&ActionEvent { action: 0, source, pressed: true, value: -1 }).unwrap();
+        wait_all(&mut action);
+        action.handle(&ActionEvent { action: 0, source, pressed: false, value: 0 }).unwrap();
+        wait_all(&mut action);
+
+        let lines = std::fs::read_to_string(&out).unwrap();
+        std::fs::remove_file(out).unwrap();
+        assert_eq!(lines, "DPad Y|Negative|press|-1\nDPad Y|Negative|release|0\n");
+    }
+
+    #[test]
+    fn test_edges_and_rate_limit() {
+        let press = press();
+        let release = ActionEvent { pressed: false, value: 0, ..press };
+
+        // Default: press only, then rate limited
+        let mut action = ExecAction::new(&mapping("true", None, Some(60_000))).unwrap();
+        action.handle(&release).unwrap();
+        assert!(action.last_run.is_none());
+        action.handle(&press).unwrap();
+        action.handle(&press).unwrap();
+        assert_eq!(action.running.len(), 1);
+        wait_all(&mut action);
+    }
+
+    #[test]
+    fn test_command_is_required() {
+        let mut mapping = mapping("true", None, None);
+        mapping.command.clear();
+        let err = ExecAction::new(&mapping).err().unwrap();
+        assert_eq!(err.to_string(), "exec mapping for Mode has no command");
+    }
+
+    #[test]
+    fn test_environment_is_limited() {
+        let out = std::env::temp_dir().join(format!("blazeremap-exec-env-{}", std::process::id()));
+        let script = format!("env > '{}'", out.display());
+        let mut action = ExecAction::new(&mapping(&script, None, None)).unwrap();
+        action.handle(&press()).unwrap();
+        wait_all(&mut action);
+
+        let env = std::fs::read_to_string(&out).unwrap();
+        std::fs::remove_file(out).unwrap();
+        for name in env.lines().filter_map(|line| line.split_once('=')).map(|(name, _)| name) {
+            // What the shell sets itself
+            let own = ["PWD", "OLDPWD", "SHLVL", "_"];
+            assert!(
+                KEPT_ENV.contains(&name) || name.starts_with("BLAZEREMAP_") || own.contains(&name),
+                "{} leaked",
+                name
+            );
+        }
+        assert!(env.contains("BLAZEREMAP_SOURCE=Mode\n"), "{}", env);
+    }
+
+    #[test]
+    fn test_timeout_kills_the_command() {
+        let policy = ActionPolicy {
+            exec_timeout: Some(Duration::from_millis(100)),
+            exec_confine: false,
+            ..Default::default()
+        };
+        let mut action = ExecAction::new(&mapping("sleep 10", None, None))
+            .unwrap()
+            .with_policy(&policy)
+            .unwrap();
+        let started = Instant::now();
+        action.handle(&press()).unwrap();
+        wait_all(&mut action);
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+}
@@ -0,0 +1,354 @@
+// Side-effect actions triggered by mappings
+//
+// Key targets go straight to the virtual keyboard; anything else a mapping
+// can trigger (plugin calls, commands, MQTT and OSC messages, recentering)
+// is an action. The mapper only queues them: a dispatcher thread runs the
+// handlers, so a slow script or network call never delays the next input
+// frame.
+
+pub mod exec;
+pub mod mqtt;
+pub mod osc;
+pub mod plugin;
+pub mod recenter;
+
+use anyhow::{Context, Result};
+use std::collections::HashMap;
+use std::sync::mpsc::{SyncSender, TrySendError, sync_channel};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use crate::{
+    event::ActionEvent,
+    input::calibration::Recenter,
+    mapping::{profile::Profile, types::TargetType},
+    platform,
+};
+use exec::ExecAction;
+use mqtt::{MqttAction, MqttClient};
+use osc::OscAction;
+use plugin::{Plugin, PluginAction};
+use recenter::RecenterAction;
+
+/// Triggered actions waiting for the dispatcher before new ones are dropped
+pub const ACTION_QUEUE_CAPACITY: usize = 256;
+
+/// Runs one action mapping's effect
+pub trait ActionHandler: Send {
+    fn handle(&mut self, event: &ActionEvent) -> Result<()>;
+}
+
+/// Limits the daemon puts on the programs a profile's exec actions and
+/// plugins run
+///
+/// Profiles get shared, so this comes from whoever runs the daemon rather
+/// than from the profile itself. By default no program may run, and those
+/// allowed start confined.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ActionPolicy {
+    /// Programs exec actions and plugins may run, compared with the
+    /// command's first word as written
+    pub exec_allowlist: Vec<String>,
+    /// Kill exec commands still running after this long, and plugins that
+    /// stop taking their input for this long
+    pub exec_timeout: Option<Duration>,
+    /// Start commands confined by the platform: see
+    /// platform/linux/confine.rs
+    pub exec_confine: bool,
+}
+
+impl Default for ActionPolicy {
+    fn default() -> Self {
+        Self { exec_allowlist: Vec::new(), exec_timeout: None, exec_confine: true }
+    }
+}
+
+/// Programs that run whatever command line they're given: shells,
+/// interpreters and wrappers. Allowlisting one lets profiles run anything,
+/// which is allowed but warned about.
+const RUNS_ANYTHING: &[&str] = &[
+    "sh", "bash", "dash", "zsh", "fish", "ksh", "mksh", "csh", "tcsh", "busybox", "env", "nohup",
+    "setsid", "timeout", "nice", "ionice", "xargs", "sudo", "doas", "python", "python3", "perl",
+    "ruby", "node", "awk", "gawk", "mawk", "lua", "php",
+];
+
+impl ActionPolicy {
+    /// Fail unless `program` is allowlisted
+    fn check_exec(&self, program: &str) -> Result<()> {
+        if !self.exec_allowlist.iter().any(|allowed| allowed == program) {
+            anyhow::bail!(
+                "'{}' is not allowed to run; allow it with --exec-allow {}",
+                program,
+                program
+            );
+        }
+        let name = std::path::Path::new(program).file_name().and_then(|name| name.to_str());
+        if name.is_some_and(|name| RUNS_ANYTHING.contains(&name)) {
+            tracing::warn!(
+                "'{}' is allowlisted, but runs whatever it's given, so profiles can run anything through it",
+                program
+            );
+        }
+        Ok(())
+    }
+
+    /// What confines the commands, unless confinement is turned off
+    ///
+    /// Fails where the platform can't confine them.
+    fn confinement(&self) -> Result<Option<platform::Confine>> {
+        if !self.exec_confine {
+            return Ok(None);
+        }
+        platform::exec_confinement()
+            .context("Failed to confine commands; --exec-unconfined runs them as they are")
+            .map(Some)
+    }
+}
+
+/// Queue in front of the thread running a profile's action handlers
+pub struct ActionDispatcher {
+    queue: SyncSender<ActionEvent>,
+}
+
+impl ActionDispatcher {
+    /// Dispatcher for `profile`'s action mappings; None if it has none
+    ///
+    /// Plugins and exec commands are checked against `policy` here and
+    /// plugins started, so problems fail the load instead of the first
+    /// button press.
+    pub fn for_profile(profile: &Profile, policy: &ActionPolicy) -> Result<Option<Self>> {
+        let handlers = handlers_for(profile, policy)?;
+        if handlers.is_empty() {
+            return Ok(None);
+        }
+        Self::spawn(handlers).map(Some)
+    }
+
+    /// Run `handlers` (indexed by `ActionEvent::action`) on their own thread
+    ///
+    /// The thread exits, dropping the handlers, once the dispatcher is dropped.
+    pub fn spawn(mut handlers: Vec<Box<dyn ActionHandler>>) -> Result<Self> {
+        let (queue, events) = sync_channel::<ActionEvent>(ACTION_QUEUE_CAPACITY);
+
+        std::thread::Builder::new().name("blazeremap-actions".to_string()).spawn(move || {
+            for event in events {
+                let Some(handler) = handlers.get_mut(event.action) else {
+                    tracing::warn!("No handler for action {}", event.action);
+                    continue;
+                };
+                if let Err(e) = handler.handle(&event) {
+                    tracing::warn!("Action for {} failed: {:#}", event.source, e);
+                }
+            }
+        })?;
+
+        Ok(Self { queue })
+    }
+
+    /// Queue `event` without blocking; dropped (with a warning) if the queue is full
+    pub fn dispatch(&self, event: ActionEvent) {
+        match self.queue.try_send(event) {
+            Ok(()) => {}
+            Err(TrySendError::Full(event)) => {
+                tracing::warn!("Action queue full, dropped action for {}", event.source)
+            }
+            Err(TrySendError::Disconnected(_)) => {
+                tracing::warn!("Action dispatcher is gone, dropped action")
+            }
+        }
+    }
+}
+
+/// One handler per action mapping, in `Profile::action_mappings` order
+fn handlers_for(profile: &Profile, policy: &ActionPolicy) -> Result<Vec<Box<dyn ActionHandler>>> {
+    // Mappings naming the same plugin share its process
+    let mut plugins: HashMap<&str, Arc<Mutex<Plugin>>> = HashMap::new();
+    // ... and MQTT mappings the broker connection
+    let mut mqtt: Option<Arc<Mutex<MqttClient>>> = None;
+    let mut handlers: Vec<Box<dyn ActionHandler>> = Vec::new();
+
+    for mapping in profile.action_mappings() {
+        match mapping.target_type {
+            TargetType::Plugin => {
+                let name = mapping.target_name.as_str();
+                let plugin = match plugins.get(name) {
+                    Some(plugin) => Arc::clone(plugin),
+                    None => {
+                        let Some(spec) = profile.plugins.iter().find(|p| p.name == name) else {
+                            anyhow::bail!(
+                                "mapping for {} uses plugin '{}', which the profile doesn't define",
+                                mapping.source_name,
+                                name
+                            );
+                        };
+                        policy
+                            .check_exec(&spec.command)
+                            .with_context(|| format!("Plugin '{}' can't start", spec.name))?;
+                        let plugin = Arc::new(Mutex::new(Plugin::spawn(spec, policy)?));
+                        plugins.insert(name, Arc::clone(&plugin));
+                        plugin
+                    }
+                };
+                handlers.push(Box::new(PluginAction::new(plugin, mapping.params.clone())));
+            }
+            TargetType::Exec => {
+                let action = ExecAction::new(mapping)?;
+                policy.check_exec(action.program())?;
+                handlers.push(Box::new(action.with_policy(policy)?));
+            }
+            TargetType::Mqtt => {
+                let Some(settings) = &profile.mqtt else {
+                    anyhow::bail!(
+                        "mapping for {} publishes to MQTT, but the profile has no [mqtt] broker",
+                        mapping.source_name
+                    );
+                };
+                let client = mqtt
+                    .get_or_insert_with(|| Arc::new(Mutex::new(MqttClient::new(settings.clone()))));
+                handlers.push(Box::new(MqttAction::new(Arc::clone(client), mapping)?));
+            }
+            TargetType::Osc => {
+                let default_to = profile.osc.as_ref().map(|osc| osc.to.as_str());
+                handlers.push(Box::new(OscAction::new(mapping, default_to)?));
+            }
+            TargetType::Recenter => {
+                handlers.push(Box::new(RecenterAction::new(mapping, Recenter::session())?));
+            }
+            other => unreachable!("{:?} is not an action target", other),
+        }
+    }
+    Ok(handlers)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ActionSource, ButtonCode};
+    use crate::mapping::Mapping;
+    use std::sync::mpsc::{Sender, channel};
+
+    struct Recorder(Sender<ActionEvent>);
+
+    impl ActionHandler for Recorder {
+        fn handle(&mut self, event: &ActionEvent) -> Result<()> {
+            self.0.send(*event)?;
+            Ok(())
+        }
+    }
+
+    fn event(action: usize) -> ActionEvent {
+        ActionEvent {
+            action,
+            source: ActionSource::Button(ButtonCode::South),
+            pressed: true,
+            value: 1,
+        }
+    }
+
+    #[test]
+    fn test_dispatch_routes_by_action_index() {
+        let (first_tx, first) = channel();
+        let (second_tx, second) = channel();
+        let dispatcher = ActionDispatcher::spawn(vec![
+            Box::new(Recorder(first_tx)),
+            Box::new(Recorder(second_tx)),
+        ])
+        .unwrap();
+
+        dispatcher.dispatch(event(1));
+        dispatcher.dispatch(event(7)); // no such handler: ignored
+        dispatcher.dispatch(event(0));
+        drop(dispatcher);
+
+        assert_eq!(first.iter().collect::<Vec<_>>(), [event(0)]);
+        assert_eq!(second.iter().collect::<Vec<_>>(), [event(1)]);
+    }
+
+    #[test]
+    fn test_profile_without_actions_needs_no_dispatcher() {
+        assert!(
+            ActionDispatcher::for_profile(&Profile::default_profile(), &ActionPolicy::default())
+                .unwrap()
+                .is_none()
+        );
+    }
+
+    #[test]
+    fn test_undefined_plugin_is_a_load_error() {
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "Mode".to_string(),
+            target_type: TargetType::Plugin,
+            target_name: "lights".to_string(),
+            ..Default::default()
+        });
+
+        let err = ActionDispatcher::for_profile(&profile, &ActionPolicy::default()).err().unwrap();
+        assert_eq!(
+            err.to_string(),
+            "mapping for Mode uses plugin 'lights', which the profile doesn't define"
+        );
+    }
+
+    #[test]
+    fn test_exec_allowlist() {
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "Mode".to_string(),
+            target_type: TargetType::Exec,
+            command: vec!["rm".to_string(), "-rf".to_string(), "/".to_string()],
+            ..Default::default()
+        });
+        let policy = ActionPolicy {
+            exec_allowlist: vec!["pactl".to_string()],
+            exec_confine: false,
+            ..Default::default()
+        };
+
+        let err = ActionDispatcher::for_profile(&profile, &policy).err().unwrap();
+        assert_eq!(err.to_string(), "'rm' is not allowed to run; allow it with --exec-allow rm");
+
+        profile.mappings.last_mut().unwrap().command = vec!["pactl".to_string()];
+        assert!(ActionDispatcher::for_profile(&profile, &policy).unwrap().is_some());
+    }
+
+    #[test]
+    fn test_nothing_runs_by_default() {
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "Mode".to_string(),
+            target_type: TargetType::Exec,
+            command: vec!["nohup".to_string(), "sh".to_string(), "-c".to_string()],
+            ..Default::default()
+        });
+
+        let err = ActionDispatcher::for_profile(&profile, &ActionPolicy::default()).err().unwrap();
+        assert_eq!(
+            err.to_string(),
+            "'nohup' is not allowed to run; allow it with --exec-allow nohup"
+        );
+    }
+
+    #[test]
+    fn test_plugins_need_allowing() {
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "Mode".to_string(),
+            target_type: TargetType::Plugin,
+            target_name: "lights".to_string(),
+            ..Default::default()
+        });
+        profile.plugins.push(crate::mapping::profile::PluginSpec {
+            name: "lights".to_string(),
+            command: "/usr/local/bin/hue-plugin".to_string(),
+            args: vec![],
+        });
+
+        let err = ActionDispatcher::for_profile(&profile, &ActionPolicy::default()).err().unwrap();
+        assert_eq!(
+            format!("{:#}", err),
+            "Plugin 'lights' can't start: '/usr/local/bin/hue-plugin' \
+             is not allowed to run; allow it with --exec-allow /usr/local/bin/hue-plugin"
+        );
+    }
+}
@@ -0,0 +1,289 @@
+// MQTT actions: publish controller events for home automation
+//
+// Just enough MQTT 3.1.1 to publish at QoS 0: CONNECT/CONNACK, PUBLISH and
+// DISCONNECT. The connection is opened on the first publish and reopened
+// after errors, so a broker that's down at startup doesn't stop remapping.
+// Keep-alive is off; a connection the broker or a NAT dropped shows up as a
+// write error and is retried once on a fresh connection.
+
+use anyhow::{Context, Result};
+use std::io::{Read, Write};
+use std::net::{TcpStream, ToSocketAddrs};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use super::ActionHandler;
+use crate::{
+    event::ActionEvent,
+    mapping::{Mapping, profile::MqttSettings, types::TriggerOn},
+};
+
+pub const DEFAULT_PORT: u16 = 1883;
+
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(3);
+/// Don't hammer a broker that's down
+const RECONNECT_BACKOFF: Duration = Duration::from_secs(5);
+
+/// A (lazily connected) broker connection shared by a profile's MQTT mappings
+pub struct MqttClient {
+    settings: MqttSettings,
+    stream: Option<TcpStream>,
+    last_attempt: Option<Instant>,
+}
+
+impl MqttClient {
+    pub fn new(settings: MqttSettings) -> Self {
+        Self { settings, stream: None, last_attempt: None }
+    }
+
+    pub fn publish(&mut self, topic: &str, payload: &[u8]) -> Result<()> {
+        let packet = publish_packet(topic, payload);
+        // A stale connection only shows up on write; retry once on a new one
+        for fresh in [false, true] {
+            if fresh {
+                self.stream = None;
+            }
+            let stream = self.connected()?;
+            if stream.write_all(&packet).is_ok() {
+                return Ok(());
+            }
+        }
+        self.stream = None;
+        anyhow::bail!("lost connection to MQTT broker {}", self.settings.broker)
+    }
+
+    fn connected(&mut self) -> Result<&mut TcpStream> {
+        if self.stream.is_none() {
+            let now = Instant::now();
+            if self.last_attempt.is_some_and(|last| now.duration_since(last) < RECONNECT_BACKOFF) {
+                anyhow::bail!("MQTT broker {} unavailable, retrying later", self.settings.broker);
+            }
+            self.last_attempt = Some(now);
+            self.stream = Some(self.connect()?);
+            tracing::info!("Connected to MQTT broker {}", self.settings.broker);
+        }
+        Ok(self.stream.as_mut().expect("just connected"))
+    }
+
+    fn connect(&self) -> Result<TcpStream> {
+        let broker = &self.settings.broker;
+        let addr = crate::cli::with_default_port(broker, DEFAULT_PORT)
+            .to_socket_addrs()
+            .with_context(|| format!("Invalid MQTT broker address '{}'", broker))?
+            .next()
+            .with_context(|| format!("MQTT broker '{}' did not resolve", broker))?;
+        let mut stream = TcpStream::connect_timeout(&addr, CONNECT_TIMEOUT)
+            .with_context(|| format!("Failed to connect to MQTT broker {}", broker))?;
+        stream.set_read_timeout(Some(CONNECT_TIMEOUT))?;
+        stream.set_write_timeout(Some(CONNECT_TIMEOUT))?;
+        stream.set_nodelay(true)?;
+
+        stream.write_all(&connect_packet(&self.settings))?;
+        let mut connack = [0u8; 4];
+        stream.read_exact(&mut connack).context("MQTT broker did not answer CONNECT")?;
+        match connack {
+            [0x20, 2, _, 0] => Ok(stream),
+            [0x20, 2, _, 4 | 5] => anyhow::bail!("MQTT broker {} refused our credentials", broker),
+            [0x20, 2, _, code] => {
+                anyhow::bail!("MQTT broker {} refused us (code {})", broker, code)
+            }
+            _ => anyhow::bail!("{} does not look like an MQTT broker", broker),
+        }
+    }
+}
+
+impl Drop for MqttClient {
+    fn drop(&mut self) {
+        if let Some(stream) = &mut self.stream {
+            let _ = stream.write_all(&[0xE0, 0]); // DISCONNECT
+        }
+    }
+}
+
+/// One mapping publishing to its topic
+pub struct MqttAction {
+    client: Arc<Mutex<MqttClient>>,
+    topic: String,
+    payload: Option<Vec<u8>>,
+    on: TriggerOn,
+}
+
+impl MqttAction {
+    pub fn new(client: Arc<Mutex<MqttClient>>, mapping: &Mapping) -> Result<Self> {
+        if mapping.target_name.is_empty() {
+            anyhow::bail!("MQTT mapping for {} has no topic", mapping.source_name);
+        }
+        // Strings are sent as written, anything else as JSON
+        let payload = mapping.params.as_ref().map(|params| match params {
+            serde_json::Value::String(text) => text.clone().into_bytes(),
+            other => other.to_string().into_bytes(),
+        });
+        Ok(Self {
+            client,
+            topic: mapping.target_name.clone(),
+            payload,
+            on: mapping.on.unwrap_or_default(),
+        })
+    }
+}
+
+impl ActionHandler for MqttAction {
+    fn handle(&mut self, event: &ActionEvent) -> Result<()> {
+        if !self.on.fires(event.pressed) {
+            return Ok(());
+        }
+        let payload = match &self.payload {
+            Some(payload) => payload.clone(),
+            None => event_payload(event),
+        };
+        self.client.lock().unwrap().publish(&self.topic, &payload)
+    }
+}
+
+/// Default payload: what fired, as JSON
+fn event_payload(event: &ActionEvent) -> Vec<u8> {
+    serde_json::json!({
+        "source": event.source.name(),
+        "direction": event.source.direction().map(|d| d.to_string()),
+        "event": if event.pressed { "press" } else { "release" },
+        "value": event.value,
+    })
+    .to_string()
+    .into_bytes()
+}
+
+fn connect_packet(settings: &MqttSettings) -> Vec<u8> {
+    let client_id =
+        settings.client_id.clone().unwrap_or_else(|| format!("blazeremap-{}", std::process::id()));
+
+    let mut flags = 0x02; // clean session
+    let mut body = Vec::new();
+    put_str(&mut body, "MQTT");
+    body.push(4); // protocol level 3.1.1
+    let flags_at = body.len();
+    body.push(0);
+    body.extend_from_slice(&0u16.to_be_bytes()); // keep-alive off
+    put_str(&mut body, &client_id);
+    if let Some(username) = &settings.username {
+        flags |= 0x80;
+        put_str(&mut body, username);
+        if let Some(password) = &settings.password {
+            flags |= 0x40;
+            put_str(&mut body, password);
+        }
+    }
+    body[flags_at] = flags;
+
+    packet(0x10, &body)
+}
+
+fn publish_packet(topic: &str, payload: &[u8]) -> Vec<u8> {
+    let mut body = Vec::with_capacity(2 + topic.len() + payload.len());
+    put_str(&mut body, topic);
+    body.extend_from_slice(payload);
+    packet(0x30, &body)
+}
+
+fn packet(header: u8, body: &[u8]) -> Vec<u8> {
+    let mut out = vec![header];
+    // Remaining length: 7 bits per byte, high bit = more follows
+    let mut len = body.len();
+    loop {
+        let byte = (len % 128) as u8;
+        len /= 128;
+        out.push(if len > 0 { byte | 0x80 } else { byte });
+        if len == 0 {
+            break;
+        }
+    }
+    out.extend_from_slice(body);
+    out
+}
+
+fn put_str(out: &mut Vec<u8>, s: &str) {
+    out.extend_from_slice(&(s.len() as u16).to_be_bytes());
+    out.extend_from_slice(s.as_bytes());
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ActionSource, ButtonCode};
+    use std::net::TcpListener;
+
+    fn settings(broker: String) -> MqttSettings {
+        MqttSettings {
+            broker,
+            client_id: Some("pad".to_string()),
+            username: Some("u".to_string()),
+            password: Some("p".to_string()),
+        }
+    }
+
+    #[test]
+    fn test_packet_encoding() {
+        assert_eq!(publish_packet("a/b", b"on"), [0x30, 7, 0, 3, b'a', b'/', b'b', b'o', b'n']);
+
+        // Remaining length uses a second byte past 127
+        let long = publish_packet("t", &[0; 200]);
+        assert_eq!(long[..3], [0x30, 0xCB, 0x01]); // 203 = 75 + 1 * 128
+
+        let connect = connect_packet(&settings("localhost".to_string()));
+        assert_eq!(connect[..4], [0x10, 21, 0, 4]);
+        assert_eq!(connect[8..12], [4, 0xC2, 0, 0]);
+    }
+
+    #[test]
+    fn test_publishes_to_broker() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let broker = std::thread::spawn(move || {
+            let (mut conn, _) = listener.accept().unwrap();
+            let mut connect = [0u8; 23];
+            conn.read_exact(&mut connect).unwrap();
+            conn.write_all(&[0x20, 2, 0, 0]).unwrap();
+
+            let mut header = [0u8; 2];
+            conn.read_exact(&mut header).unwrap();
+            let mut publish = vec![0u8; header[1] as usize];
+            conn.read_exact(&mut publish).unwrap();
+            publish
+        });
+
+        let client = Arc::new(Mutex::new(MqttClient::new(settings(addr))));
+        let mapping = Mapping {
+            source_name: "Mode".to_string(),
+            target_name: "home/lights".to_string(),
+            ..Default::default()
+        };
+        let mut action = MqttAction::new(client, &mapping).unwrap();
+        let press = ActionEvent {
+            action: 0,
+            source: ActionSource::Button(ButtonCode::Mode),
+            pressed: true,
+            value: 1,
+        };
+        action.handle(&press).unwrap();
+        // Release isn't published by default
+        action.handle(&ActionEvent { pressed: false, value: 0, ..press }).unwrap();
+
+        let publish = broker.join().unwrap();
+        assert_eq!(publish[..13], *b"\0\x0bhome/lights");
+        assert_eq!(
+            serde_json::from_slice::<serde_json::Value>(&publish[13..]).unwrap(),
+            serde_json::json!({ "source": "Mode", "direction": null, "event": "press", "value": 1 })
+        );
+    }
+
+    #[test]
+    fn test_unreachable_broker_backs_off() {
+        // Nothing listens on a port we just released
+        let addr = TcpListener::bind("127.0.0.1:0").unwrap().local_addr().unwrap().to_string();
+        let mut client = MqttClient::new(settings(addr));
+
+        assert!(
+            client.publish("t", b"x").unwrap_err().to_string().starts_with("Failed to connect")
+        );
+        assert!(client.publish("t", b"x").unwrap_err().to_string().ends_with("retrying later"));
+    }
+}
@@ -0,0 +1,194 @@
+// OSC actions: drive DAWs and visual software
+//
+// Each `Osc` mapping sends one Open Sound Control message per event over
+// UDP: the address comes from the mapping's template, the only argument is
+// the event value. Releases are sent too (value 0), so faders and toggles
+// follow the control. `params` may set:
+//
+//   to     "host:port", overriding the profile's [osc] destination
+//   range  [min, max] of the source, to send a 0.0–1.0 float instead of the
+//          raw integer
+//
+// Templates may use {source} ("left_x", "south") and {direction}
+// ("positive"/"negative", empty for other sources).
+
+use anyhow::{Context, Result};
+use serde::Deserialize;
+use std::net::{SocketAddr, ToSocketAddrs, UdpSocket};
+
+use super::ActionHandler;
+use crate::{event::ActionEvent, mapping::Mapping};
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct OscParams {
+    to: Option<String>,
+    range: Option<[i32; 2]>,
+}
+
+pub struct OscAction {
+    socket: UdpSocket,
+    destination: SocketAddr,
+    address: String,
+    range: Option<[i32; 2]>,
+}
+
+impl OscAction {
+    /// `default_to` is the profile's destination, if it has one
+    pub fn new(mapping: &Mapping, default_to: Option<&str>) -> Result<Self> {
+        let source = &mapping.source_name;
+        if !mapping.target_name.starts_with('/') {
+            anyhow::bail!("OSC address for {} must start with '/'", source);
+        }
+        let params: OscParams = match &mapping.params {
+            Some(params) => serde_json::from_value(params.clone())
+                .with_context(|| format!("Invalid OSC params for {}", source))?,
+            None => OscParams::default(),
+        };
+        if let Some([min, max]) = params.range
+            && min >= max
+        {
+            anyhow::bail!("OSC range for {} must be [min, max] with min < max", source);
+        }
+
+        let Some(to) = params.to.as_deref().or(default_to) else {
+            anyhow::bail!("OSC mapping for {} has no destination; set [osc] to", source);
+        };
+        let destination = to
+            .to_socket_addrs()
+            .with_context(|| format!("OSC destination '{}' must be host:port", to))?
+            .next()
+            .with_context(|| format!("OSC destination '{}' did not resolve", to))?;
+        let bind = if destination.is_ipv4() { "0.0.0.0:0" } else { "[::]:0" };
+        let socket = UdpSocket::bind(bind).context("Failed to open OSC socket")?;
+
+        Ok(Self { socket, destination, address: mapping.target_name.clone(), range: params.range })
+    }
+}
+
+impl ActionHandler for OscAction {
+    fn handle(&mut self, event: &ActionEvent) -> Result<()> {
+        let direction = event.source.direction().map(|d| d.to_string().to_lowercase());
+        let address = self
+            .address
+            .replace("{source}", &event.source.name().to_lowercase().replace(' ', "_"))
+            .replace("{direction}", direction.as_deref().unwrap_or(""));
+
+        let argument = match self.range {
+            Some([min, max]) => {
+                let t = (event.value - min) as f32 / (max - min) as f32;
+                OscArgument::Float(t.clamp(0.0, 1.0))
+            }
+            None => OscArgument::Int(event.value),
+        };
+        self.socket
+            .send_to(&message(&address, argument), self.destination)
+            .with_context(|| format!("Failed to send OSC to {}", self.destination))?;
+        Ok(())
+    }
+}
+
+#[derive(Debug, Clone, Copy)]
+enum OscArgument {
+    Int(i32),
+    Float(f32),
+}
+
+/// Encode a single-argument OSC message
+fn message(address: &str, argument: OscArgument) -> Vec<u8> {
+    let mut out = Vec::with_capacity(address.len() + 12);
+    put_padded(&mut out, address);
+    match argument {
+        OscArgument::Int(n) => {
+            put_padded(&mut out, ",i");
+            out.extend_from_slice(&n.to_be_bytes());
+        }
+        OscArgument::Float(x) => {
+            put_padded(&mut out, ",f");
+            out.extend_from_slice(&x.to_be_bytes());
+        }
+    }
+    out
+}
+
+/// OSC strings are NUL terminated and padded to a multiple of 4 bytes
+fn put_padded(out: &mut Vec<u8>, s: &str) {
+    out.extend_from_slice(s.as_bytes());
+    let padding = 4 - s.len() % 4;
+    out.extend(std::iter::repeat_n(0, padding));
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ActionSource, AxisCode, AxisDirection, ButtonCode};
+    use crate::mapping::types::TargetType;
+    use std::time::Duration;
+
+    fn mapping(address: &str, params: Option<serde_json::Value>) -> Mapping {
+        Mapping {
+            source_name: "Left X".to_string(),
+            target_type: TargetType::Osc,
+            target_name: address.to_string(),
+            params,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_message_encoding() {
+        assert_eq!(
+            message("/a", OscArgument::Int(1)),
+            [b'/', b'a', 0, 0, b',', b'i', 0, 0, 0, 0, 0, 1]
+        );
+        // A 4-byte address still gets a full word of padding
+        let float = message("/abc", OscArgument::Float(0.5));
+        assert_eq!(float[..12], *b"/abc\0\0\0\0,f\0\0");
+        assert_eq!(float[12..], 0.5f32.to_be_bytes());
+    }
+
+    #[test]
+    fn test_sends_to_destination() {
+        let receiver = UdpSocket::bind("127.0.0.1:0").unwrap();
+        receiver.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let to = receiver.local_addr().unwrap().to_string();
+
+        let params = serde_json::json!({ "range": [-100, 100] });
+        let mut action =
+            OscAction::new(&mapping("/pad/{source}", Some(params)), Some(&to)).unwrap();
+        let source = ActionSource::AxisValue(AxisCode::LeftX);
+        action.handle(&ActionEvent { action: 0, source, pressed: true, value: 50 }).unwrap();
+
+        let mut action = OscAction::new(&mapping("/dpad/{direction}", None), Some(&to)).unwrap();
+        let source = ActionSource::Axis(AxisCode::DPadY, AxisDirection::Negative);
+        action.handle(&ActionEvent { action: 0, source, pressed: true, value: -1 }).unwrap();
+
+        let mut buf = [0u8; 64];
+        let len = receiver.recv(&mut buf).unwrap();
+        assert_eq!(buf[..len], message("/pad/left_x", OscArgument::Float(0.75)));
+        let len = receiver.recv(&mut buf).unwrap();
+        assert_eq!(buf[..len], message("/dpad/negative", OscArgument::Int(-1)));
+    }
+
+    #[test]
+    fn test_invalid_mappings() {
+        let err = |m: &Mapping, to| OscAction::new(m, to).err().unwrap().to_string();
+
+        assert_eq!(
+            err(&mapping("fader", None), Some("127.0.0.1:9000")),
+            "OSC address for Left X must start with '/'"
+        );
+        assert_eq!(
+            err(&mapping("/fader", None), None),
+            "OSC mapping for Left X has no destination; set [osc] to"
+        );
+        let params = serde_json::json!({ "range": [5, 5] });
+        assert_eq!(
+            err(&mapping("/fader", Some(params)), Some("127.0.0.1:9000")),
+            "OSC range for Left X must be [min, max] with min < max"
+        );
+        let mut button = mapping("/fader", Some(serde_json::json!({ "port": 1 })));
+        button.source_name = ButtonCode::South.to_string();
+        assert_eq!(err(&button, Some("127.0.0.1:9000")), "Invalid OSC params for South");
+    }
+}
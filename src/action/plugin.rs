@@ -0,0 +1,292 @@
+// External action plugins
+//
+// A plugin is any executable named in the profile's `[[plugins]]`. It is
+// started once per session and talks JSON lines over stdio:
+//
+//   → {"type":"init","protocol":1,"plugin":"lights"}
+//   → {"type":"trigger","source":"Mode","direction":null,"pressed":true,"value":1,"params":{...}}
+//   ← {"type":"log","message":"..."}      (optional, logged at info)
+//   ← {"type":"error","message":"..."}    (optional, logged as a warning)
+//
+// Triggers are fire-and-forget; the plugin never blocks the daemon. When
+// stdin closes the plugin should exit; it is killed if it doesn't.
+//
+// Plugins come from profiles, so they start like exec commands (see
+// exec.rs): only if the ActionPolicy allowlists them, confined, and with
+// little of the daemon's environment. With a timeout, a plugin that stops
+// reading its input for that long is killed.
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::io::{BufRead, BufReader, Write};
+use std::process::{Child, Stdio};
+use std::sync::mpsc::{SyncSender, TrySendError, sync_channel};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use super::{ACTION_QUEUE_CAPACITY, ActionHandler, ActionPolicy, exec::limited_command};
+use crate::{event::ActionEvent, mapping::profile::PluginSpec};
+
+/// Version of the message format above; sent in `init`
+pub const PROTOCOL_VERSION: u32 = 1;
+
+/// How long a plugin gets to exit after its stdin is closed
+const EXIT_GRACE: Duration = Duration::from_millis(500);
+
+#[derive(Debug, Serialize)]
+#[serde(tag = "type", rename_all = "lowercase")]
+enum ToPlugin<'a> {
+    Init {
+        protocol: u32,
+        plugin: &'a str,
+    },
+    Trigger {
+        source: String,
+        direction: Option<String>,
+        pressed: bool,
+        value: i32,
+        params: &'a serde_json::Value,
+    },
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(tag = "type", rename_all = "lowercase")]
+enum FromPlugin {
+    Log { message: String },
+    Error { message: String },
+}
+
+/// A running plugin process
+pub struct Plugin {
+    name: String,
+    child: Child,
+    // Lines for the thread writing to the plugin; dropping it closes stdin
+    lines: Option<SyncSender<Vec<u8>>>,
+    // When the line being written started, while the plugin hasn't taken it
+    writing_since: Arc<Mutex<Option<Instant>>>,
+    timeout: Option<Duration>,
+}
+
+impl Plugin {
+    /// Start the plugin within `policy`'s confinement and timeout, and send
+    /// it `init`
+    ///
+    /// Whether `policy` allows the program is for the caller to check.
+    pub fn spawn(spec: &PluginSpec, policy: &ActionPolicy) -> Result<Self> {
+        let confine = policy.confinement()?;
+        let mut child = limited_command(&spec.command, &spec.args, confine.as_ref())
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::inherit())
+            .spawn()
+            .with_context(|| {
+                format!("Failed to start plugin '{}' ({})", spec.name, spec.command)
+            })?;
+
+        let stdout = child.stdout.take().expect("stdout is piped");
+        let name = spec.name.clone();
+        std::thread::Builder::new().name("blazeremap-plugin".to_string()).spawn(move || {
+            for line in BufReader::new(stdout).lines().map_while(Result::ok) {
+                match serde_json::from_str(&line) {
+                    Ok(FromPlugin::Log { message }) => tracing::info!("[{}] {}", name, message),
+                    Ok(FromPlugin::Error { message }) => tracing::warn!("[{}] {}", name, message),
+                    Err(_) => tracing::debug!("[{}] unrecognized output: {}", name, line),
+                }
+            }
+        })?;
+
+        // Written on a thread of its own, so a plugin that stops reading
+        // can't block the dispatcher
+        let mut stdin = child.stdin.take().expect("stdin is piped");
+        let (lines, queued) = sync_channel::<Vec<u8>>(ACTION_QUEUE_CAPACITY);
+        let writing_since = Arc::new(Mutex::new(None));
+        let since = Arc::clone(&writing_since);
+        let name = spec.name.clone();
+        std::thread::Builder::new().name("blazeremap-plugin-input".to_string()).spawn(
+            move || {
+                for line in queued {
+                    *since.lock().unwrap() = Some(Instant::now());
+                    let written = stdin.write_all(&line).and_then(|()| stdin.flush());
+                    *since.lock().unwrap() = None;
+                    if let Err(e) = written {
+                        tracing::warn!("Plugin '{}' is not accepting input: {}", name, e);
+                        break;
+                    }
+                }
+            },
+        )?;
+
+        let mut plugin = Self {
+            name: spec.name.clone(),
+            child,
+            lines: Some(lines),
+            writing_since,
+            timeout: policy.exec_timeout,
+        };
+        plugin.send(&ToPlugin::Init { protocol: PROTOCOL_VERSION, plugin: &spec.name })?;
+        tracing::info!("Started plugin '{}'", spec.name);
+        Ok(plugin)
+    }
+
+    fn send(&mut self, message: &ToPlugin) -> Result<()> {
+        let stuck = self.writing_since.lock().unwrap().map(|since| since.elapsed());
+        if let (Some(timeout), Some(stuck)) = (self.timeout, stuck)
+            && stuck >= timeout
+        {
+            let _ = self.child.kill();
+            anyhow::bail!(
+                "plugin '{}' took no input for {:.1}s, killed",
+                self.name,
+                stuck.as_secs_f64()
+            );
+        }
+        let lines = self.lines.as_ref().context("plugin input already closed")?;
+        let mut line = serde_json::to_vec(message)?;
+        line.push(b'\n');
+        match lines.try_send(line) {
+            Ok(()) => Ok(()),
+            Err(TrySendError::Full(_)) => {
+                anyhow::bail!("plugin '{}' is behind on its input, message dropped", self.name)
+            }
+            Err(TrySendError::Disconnected(_)) => {
+                anyhow::bail!("plugin '{}' is not accepting input", self.name)
+            }
+        }
+    }
+}
+
+impl Drop for Plugin {
+    fn drop(&mut self) {
+        // EOF on stdin, once what's queued is written, asks the plugin to exit
+        drop(self.lines.take());
+        let deadline = Instant::now() + EXIT_GRACE;
+        while Instant::now() < deadline {
+            if let Ok(Some(_)) = self.child.try_wait() {
+                return;
+            }
+            std::thread::sleep(Duration::from_millis(10));
+        }
+        tracing::warn!("Plugin '{}' did not exit, killing it", self.name);
+        let _ = self.child.kill();
+        let _ = self.child.wait();
+    }
+}
+
+/// One mapping's trigger into a (possibly shared) plugin
+pub struct PluginAction {
+    plugin: Arc<Mutex<Plugin>>,
+    params: serde_json::Value,
+}
+
+impl PluginAction {
+    pub fn new(plugin: Arc<Mutex<Plugin>>, params: Option<serde_json::Value>) -> Self {
+        Self { plugin, params: params.unwrap_or(serde_json::Value::Null) }
+    }
+}
+
+impl ActionHandler for PluginAction {
+    fn handle(&mut self, event: &ActionEvent) -> Result<()> {
+        self.plugin.lock().unwrap().send(&ToPlugin::Trigger {
+            source: event.source.name(),
+            direction: event.source.direction().map(|d| d.to_string()),
+            pressed: event.pressed,
+            value: event.value,
+            params: &self.params,
+        })
+    }
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use crate::event::{ActionSource, ButtonCode};
+
+    fn unconfined() -> ActionPolicy {
+        ActionPolicy { exec_confine: false, ..Default::default() }
+    }
+
+    #[test]
+    fn test_plugin_receives_init_and_triggers() {
+        let out = std::env::temp_dir().join(format!("blazeremap-plugin-{}", std::process::id()));
+        let spec = PluginSpec {
+            name: "recorder".to_string(),
+            command: "sh".to_string(),
+            args: vec!["-c".to_string(), format!("cat > '{}'", out.display())],
+        };
+
+        let plugin = Arc::new(Mutex::new(Plugin::spawn(&spec, &unconfined()).unwrap()));
+        let mut action =
+            PluginAction::new(Arc::clone(&plugin), Some(serde_json::json!({ "scene": "movie" })));
+        action
+            .handle(&ActionEvent {
+                action: 0,
+                source: ActionSource::Button(ButtonCode::Mode),
+                pressed: true,
+                value: 1,
+            })
+            .unwrap();
+        // Last reference: closes stdin, cat exits
+        drop(action);
+        drop(plugin);
+
+        let lines: Vec<serde_json::Value> = std::fs::read_to_string(&out)
+            .unwrap()
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+        std::fs::remove_file(out).unwrap();
+
+        assert_eq!(
+            lines[0],
+            serde_json::json!({ "type": "init", "protocol": 1, "plugin": "recorder" })
+        );
+        assert_eq!(
+            lines[1],
+            serde_json::json!({
+                "type": "trigger",
+                "source": "Mode",
+                "direction": null,
+                "pressed": true,
+                "value": 1,
+                "params": { "scene": "movie" },
+            })
+        );
+    }
+
+    #[test]
+    fn test_missing_executable_fails_spawn() {
+        let spec = PluginSpec {
+            name: "ghost".to_string(),
+            command: "/nonexistent/blazeremap-plugin".to_string(),
+            args: vec![],
+        };
+        let err = Plugin::spawn(&spec, &unconfined()).err().unwrap();
+        assert!(err.to_string().starts_with("Failed to start plugin 'ghost'"));
+    }
+
+    #[test]
+    fn test_plugin_not_reading_is_killed() {
+        let spec = PluginSpec {
+            name: "stuck".to_string(),
+            command: "sleep".to_string(),
+            args: vec!["30".to_string()],
+        };
+        let policy =
+            ActionPolicy { exec_timeout: Some(Duration::from_millis(100)), ..unconfined() };
+        let plugin = Arc::new(Mutex::new(Plugin::spawn(&spec, &policy).unwrap()));
+        // More than a pipe holds, so the writer is left waiting on it
+        let filler = serde_json::json!({ "filler": "x".repeat(1 << 17) });
+        let mut action = PluginAction::new(plugin, Some(filler));
+        let event = ActionEvent {
+            action: 0,
+            source: ActionSource::Button(ButtonCode::Mode),
+            pressed: true,
+            value: 1,
+        };
+        action.handle(&event).unwrap();
+        std::thread::sleep(Duration::from_millis(300));
+
+        let err = action.handle(&event).unwrap_err();
+        assert!(err.to_string().starts_with("plugin 'stuck' took no input for"), "{}", err);
+    }
+}
@@ -0,0 +1,87 @@
+// Recenter actions: a hotkey for sticks that drift
+//
+// A `Recenter` mapping asks the controller's reader to take where the sticks
+// rest now as their centers, like `blazeremap recenter`. `target_name` names
+// the axes, like "Left X, Left Y"; empty recenters both sticks. Only the
+// press recenters, so hold still while pressing it.
+
+use anyhow::{Context, Result};
+
+use super::ActionHandler;
+use crate::{
+    event::{ActionEvent, AxisCode},
+    input::calibration::{Recenter, parse_stick_axes},
+    mapping::Mapping,
+};
+
+pub struct RecenterAction {
+    recenter: Recenter,
+    axes: Vec<AxisCode>,
+}
+
+impl RecenterAction {
+    pub fn new(mapping: &Mapping, recenter: Recenter) -> Result<Self> {
+        let axes = parse_stick_axes(&mapping.target_name)
+            .with_context(|| format!("Invalid recenter mapping for {}", mapping.source_name))?;
+        Ok(Self { recenter, axes })
+    }
+}
+
+impl ActionHandler for RecenterAction {
+    fn handle(&mut self, event: &ActionEvent) -> Result<()> {
+        if event.pressed {
+            tracing::info!("Recentering {} from {}", describe(&self.axes), event.source);
+            self.recenter.request(&self.axes);
+        }
+        Ok(())
+    }
+}
+
+fn describe(axes: &[AxisCode]) -> String {
+    axes.iter().map(ToString::to_string).collect::<Vec<_>>().join(", ")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ActionSource, ButtonCode};
+    use crate::mapping::types::TargetType;
+
+    fn mapping(target_name: &str) -> Mapping {
+        Mapping {
+            source_name: "Left Stick".to_string(),
+            target_type: TargetType::Recenter,
+            target_name: target_name.to_string(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_press_requests_recentering() {
+        let recenter = Recenter::default();
+        let mut watch = recenter.watch();
+        let mut action = RecenterAction::new(&mapping("Right X, Right Y"), recenter).unwrap();
+        let mut event = ActionEvent {
+            action: 0,
+            source: ActionSource::Button(ButtonCode::LeftStick),
+            pressed: true,
+            value: 1,
+        };
+
+        action.handle(&event).unwrap();
+        assert_eq!(watch.take().collect::<Vec<_>>(), [AxisCode::RightX, AxisCode::RightY]);
+        event.pressed = false;
+        action.handle(&event).unwrap();
+        assert_eq!(watch.take().count(), 0);
+    }
+
+    #[test]
+    fn test_only_stick_axes() {
+        assert_eq!(RecenterAction::new(&mapping(""), Recenter::default()).unwrap().axes.len(), 4);
+        let err = RecenterAction::new(&mapping("Left Trigger"), Recenter::default()).err().unwrap();
+        assert_eq!(
+            format!("{:#}", err),
+            "Invalid recenter mapping for Left Stick: 'Left Trigger' is not a stick axis"
+        );
+    }
+}
@@ -0,0 +1,214 @@
+// Just enough HTTP/1.1 for a local JSON API
+//
+// One request per connection, always answered with `Connection: close`.
+// Bodies are JSON and must carry a Content-Length; chunked uploads are
+// rejected. That covers curl, fetch() and the usual dashboard clients.
+
+use std::io::{BufRead, Read, Write};
+
+/// Largest request body accepted (profiles and session specs are small)
+const MAX_BODY: usize = 64 * 1024;
+/// Upper bound on request line plus headers
+const MAX_HEAD: usize = 8 * 1024;
+
+#[derive(Debug)]
+pub struct Request {
+    pub method: String,
+    /// Path without the query string
+    pub path: String,
+    /// What followed the `?`, empty without one
+    pub query: String,
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+impl Request {
+    /// Header value by case-insensitive name
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.headers.iter().find(|(n, _)| n.eq_ignore_ascii_case(name)).map(|(_, v)| v.as_str())
+    }
+
+    /// Value of the query parameter `name`, as sent
+    pub fn query_param(&self, name: &str) -> Option<&str> {
+        self.query
+            .split('&')
+            .filter_map(|pair| pair.split_once('=').or(Some((pair, ""))))
+            .find(|(n, _)| *n == name)
+            .map(|(_, value)| value)
+    }
+
+    /// Path split into its non-empty segments
+    pub fn segments(&self) -> Vec<&str> {
+        self.path.split('/').filter(|s| !s.is_empty()).collect()
+    }
+
+    /// Whether the body is declared JSON, parameters like charset aside
+    pub fn is_json(&self) -> bool {
+        self.header("Content-Type")
+            .and_then(|value| value.split(';').next())
+            .is_some_and(|media| media.trim().eq_ignore_ascii_case("application/json"))
+    }
+}
+
+#[derive(Debug)]
+pub struct Response {
+    pub status: u16,
+    pub body: serde_json::Value,
+}
+
+impl Response {
+    pub fn ok(body: serde_json::Value) -> Self {
+        Self { status: 200, body }
+    }
+
+    pub fn created(body: serde_json::Value) -> Self {
+        Self { status: 201, body }
+    }
+
+    pub fn error(status: u16, message: impl std::fmt::Display) -> Self {
+        Self { status, body: serde_json::json!({ "error": message.to_string() }) }
+    }
+
+    pub fn not_found() -> Self {
+        Self::error(404, "not found")
+    }
+
+    pub fn method_not_allowed() -> Self {
+        Self::error(405, "method not allowed")
+    }
+
+    pub fn forbidden(message: impl std::fmt::Display) -> Self {
+        Self::error(403, message)
+    }
+}
+
+/// Read one request; errors mean the peer sent something we won't serve
+pub fn read_request<R: BufRead>(reader: &mut R) -> anyhow::Result<Request> {
+    let mut head = reader.take(MAX_HEAD as u64);
+
+    let mut line = String::new();
+    head.read_line(&mut line)?;
+    let mut parts = line.split_whitespace();
+    let (Some(method), Some(target), Some(version)) = (parts.next(), parts.next(), parts.next())
+    else {
+        anyhow::bail!("malformed request line");
+    };
+    if !version.starts_with("HTTP/1.") {
+        anyhow::bail!("unsupported protocol {}", version);
+    }
+    let method = method.to_string();
+    let (path, query) = target.split_once('?').unwrap_or((target, ""));
+    let (path, query) = (path.to_string(), query.to_string());
+
+    let mut headers = Vec::new();
+    loop {
+        line.clear();
+        if head.read_line(&mut line)? == 0 {
+            anyhow::bail!("connection closed inside headers");
+        }
+        let line = line.trim_end();
+        if line.is_empty() {
+            break;
+        }
+        let (name, value) = line.split_once(':').ok_or_else(|| anyhow::anyhow!("bad header"))?;
+        headers.push((name.trim().to_string(), value.trim().to_string()));
+    }
+
+    let mut request = Request { method, path, query, headers, body: Vec::new() };
+    if request.header("Transfer-Encoding").is_some() {
+        anyhow::bail!("chunked request bodies are not supported");
+    }
+    if let Some(length) = request.header("Content-Length") {
+        let length: usize = length.parse()?;
+        if length > MAX_BODY {
+            anyhow::bail!("request body too large ({} bytes)", length);
+        }
+        let mut body = vec![0; length];
+        head.into_inner().read_exact(&mut body)?;
+        request.body = body;
+    }
+    Ok(request)
+}
+
+pub fn write_response<W: Write>(writer: &mut W, response: &Response) -> std::io::Result<()> {
+    let body = serde_json::to_vec(&response.body)?;
+    write!(
+        writer,
+        "HTTP/1.1 {} {}\r\n\
+         Content-Type: application/json\r\n\
+         Content-Length: {}\r\n\
+         Connection: close\r\n\r\n",
+        response.status,
+        reason(response.status),
+        body.len()
+    )?;
+    writer.write_all(&body)?;
+    writer.flush()
+}
+
+fn reason(status: u16) -> &'static str {
+    match status {
+        200 => "OK",
+        201 => "Created",
+        400 => "Bad Request",
+        403 => "Forbidden",
+        404 => "Not Found",
+        405 => "Method Not Allowed",
+        409 => "Conflict",
+        415 => "Unsupported Media Type",
+        426 => "Upgrade Required",
+        500 => "Internal Server Error",
+        503 => "Service Unavailable",
+        _ => "",
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_read_request_with_body() {
+        let raw = "POST /api/sessions?verbose=1 HTTP/1.1\r\n\
+                   Host: localhost\r\n\
+                   content-length: 14\r\n\r\n\
+                   {\"devices\":[]}trailing";
+        let request = read_request(&mut raw.as_bytes()).unwrap();
+
+        assert_eq!(request.method, "POST");
+        assert_eq!(request.path, "/api/sessions");
+        assert_eq!(request.segments(), ["api", "sessions"]);
+        assert_eq!(request.query_param("verbose"), Some("1"));
+        assert_eq!(request.query_param("seconds"), None);
+        assert_eq!(request.header("Host"), Some("localhost"));
+        assert_eq!(request.body, b"{\"devices\":[]}");
+        assert!(!request.is_json());
+    }
+
+    #[test]
+    fn test_is_json() {
+        let raw = "POST / HTTP/1.1\r\nContent-Type: Application/JSON; charset=utf-8\r\n\r\n";
+        assert!(read_request(&mut raw.as_bytes()).unwrap().is_json());
+        let raw = "POST / HTTP/1.1\r\nContent-Type: text/plain\r\n\r\n";
+        assert!(!read_request(&mut raw.as_bytes()).unwrap().is_json());
+    }
+
+    #[test]
+    fn test_read_request_rejects_garbage() {
+        assert!(read_request(&mut "hello\r\n\r\n".as_bytes()).is_err());
+        assert!(read_request(&mut "GET / SPDY/3\r\n\r\n".as_bytes()).is_err());
+        let huge = format!("POST / HTTP/1.1\r\nContent-Length: {}\r\n\r\n", MAX_BODY + 1);
+        assert!(read_request(&mut huge.as_bytes()).is_err());
+    }
+
+    #[test]
+    fn test_write_response() {
+        let mut out = Vec::new();
+        write_response(&mut out, &Response::not_found()).unwrap();
+
+        let text = String::from_utf8(out).unwrap();
+        assert!(text.starts_with("HTTP/1.1 404 Not Found\r\n"));
+        assert!(text.contains("Content-Length: 21\r\n"));
+        assert!(text.ends_with("\r\n\r\n{\"error\":\"not found\"}"));
+    }
+}
@@ -0,0 +1,1000 @@
+// Local HTTP/JSON API (`blazeremap serve`)
+//
+//   GET    /api/devices          connected controllers
+//   GET    /api/profiles         built-in profiles plus those in the profile dir
+//   GET    /api/profiles/{id}    one profile with its mappings
+//   GET    /api/sessions         remap sessions started through the API
+//   POST   /api/sessions         start one: {"devices": [...], "profile": "id"}
+//   GET    /api/sessions/{id}    one session with its pipeline metrics
+//   DELETE /api/sessions/{id}    stop it
+//   GET    /api/sessions/{id}/events   WebSocket feed of input and mapped output
+//
+// There is no authentication: anyone who can connect can grab controllers
+// and type on the virtual keyboard, so the server is meant for loopback.
+// Web pages the user visits can connect too, so requests that name another
+// host (DNS rebinding) or come from a page that isn't on loopback are refused,
+// and sessions are only started from JSON bodies, which pages can't send
+// without the browser asking first.
+//
+// With a `SessionStore`, the sessions are saved as they start and stop, and
+// `restore` starts them again after a crash or reboot.
+
+pub mod http;
+pub mod pprof;
+pub mod state;
+pub mod websocket;
+
+use anyhow::Result;
+use serde::Deserialize;
+use serde_json::json;
+use std::collections::BTreeMap;
+use std::net::{IpAddr, TcpListener, TcpStream};
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicBool, AtomicU32, AtomicUsize, Ordering};
+use std::sync::mpsc::{Receiver, RecvTimeoutError};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use crate::{
+    audit::{self, AuditEvent},
+    event::{InputEvent, OutputEvent, Switch, TapEvent},
+    input::{InputDetectionResult, gamepad::capabilities_to_strings},
+    mapping::{
+        format::ProfileFormat,
+        integrity::IntegrityPolicy,
+        profile::{BUILTIN_PROFILES, Profile},
+    },
+    output::mouse::MouseEvent,
+    platform,
+    session::{self, Session, SessionConfig},
+};
+use http::{Request, Response};
+use state::{SavedDevice, SavedSession, SessionStore};
+
+pub const DEFAULT_PORT: u16 = 8680;
+
+/// Idle time after which an event stream pings the client (and notices it left)
+const STREAM_PING_INTERVAL: Duration = Duration::from_secs(5);
+/// Connections served at once, event streams included; more are turned away
+const MAX_CONNECTIONS: usize = 64;
+
+type DeviceLister = Box<dyn Fn() -> Result<InputDetectionResult> + Send + Sync>;
+type SessionStarter = Box<dyn Fn(SessionConfig) -> Result<Session> + Send + Sync>;
+
+/// Request body of `POST /api/sessions`
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct StartRequest {
+    #[serde(default)]
+    devices: Vec<String>,
+    profile: Option<String>,
+}
+
+struct ManagedSession {
+    session: Session,
+    profile: String,
+    saved: SavedSession,
+}
+
+/// Request router and the sessions it owns
+pub struct Api {
+    profile_dir: Option<PathBuf>,
+    integrity: IntegrityPolicy,
+    list_devices: DeviceLister,
+    start_session: SessionStarter,
+    sessions: Mutex<BTreeMap<u32, ManagedSession>>,
+    next_id: AtomicU32,
+    store: Option<SessionStore>,
+    // Restored sessions whose controllers weren't there, kept for next time
+    waiting: Mutex<Vec<SavedSession>>,
+}
+
+impl Api {
+    /// API backed by the platform's devices; profiles are also read from `profile_dir`
+    pub fn new(profile_dir: Option<PathBuf>) -> Self {
+        Self::with_backends(profile_dir, Box::new(session::list_gamepads), Box::new(Session::start))
+    }
+
+    fn with_backends(
+        profile_dir: Option<PathBuf>,
+        list_devices: DeviceLister,
+        start_session: SessionStarter,
+    ) -> Self {
+        Self {
+            profile_dir,
+            integrity: IntegrityPolicy::default(),
+            list_devices,
+            start_session,
+            sessions: Mutex::new(BTreeMap::new()),
+            next_id: AtomicU32::new(1),
+            store: None,
+            waiting: Mutex::new(Vec::new()),
+        }
+    }
+
+    /// Save the sessions to `store` as they start and stop
+    pub fn with_store(mut self, store: SessionStore) -> Self {
+        self.store = Some(store);
+        self
+    }
+
+    /// Start the sessions the store has saved; returns how many started
+    ///
+    /// Sessions whose controllers aren't connected stay saved for the next
+    /// restore; those that fail otherwise are dropped.
+    pub fn restore(&self) -> Result<usize> {
+        let Some(store) = &self.store else {
+            return Ok(0);
+        };
+        let saved = store.load()?;
+        if saved.is_empty() {
+            return Ok(0);
+        }
+        let gamepads = (self.list_devices)()?.gamepad_info;
+        let mut restored = 0;
+        for session in saved {
+            let found: Option<Vec<String>> =
+                session.devices.iter().map(|device| device.find(&gamepads)).collect();
+            let Some(devices) = found else {
+                let paths: Vec<_> =
+                    session.devices.iter().map(|device| device.path.as_str()).collect();
+                tracing::warn!(
+                    "Not restoring the '{}' session: not all of {} are connected",
+                    session.profile,
+                    paths.join(", ")
+                );
+                self.waiting.lock().unwrap().push(session);
+                continue;
+            };
+            match self.launch(devices, session.profile.clone()) {
+                Ok(response) if response.status == 201 => restored += 1,
+                Ok(response) => tracing::warn!(
+                    "Not restoring the '{}' session: {}",
+                    session.profile,
+                    response.body["error"]
+                ),
+                Err(e) => {
+                    tracing::warn!("Not restoring the '{}' session: {:#}", session.profile, e)
+                }
+            }
+        }
+        self.save_sessions();
+        Ok(restored)
+    }
+
+    /// Check the seals of profiles from the profile dir against `integrity`
+    pub fn with_integrity(mut self, integrity: IntegrityPolicy) -> Self {
+        self.integrity = integrity;
+        self
+    }
+
+    /// Answer one request
+    pub fn handle(&self, request: &Request) -> Response {
+        let result = match (request.method.as_str(), request.segments().as_slice()) {
+            ("GET", ["api", "devices"]) => self.devices(),
+            ("GET", ["api", "profiles"]) => self.profiles(),
+            ("GET", ["api", "profiles", id]) => self.profile(id),
+            ("GET", ["api", "sessions"]) => Ok(self.sessions()),
+            ("POST", ["api", "sessions"]) => self.start(request),
+            ("GET", ["api", "sessions", id]) => Ok(self.session(id)),
+            ("DELETE", ["api", "sessions", id]) => Ok(self.stop(id)),
+            (_, ["api", "devices" | "profiles" | "sessions"])
+            | (_, ["api", "profiles" | "sessions", _]) => Ok(Response::method_not_allowed()),
+            _ => Ok(Response::not_found()),
+        };
+        result.unwrap_or_else(|e| Response::error(500, format!("{:#}", e)))
+    }
+
+    fn devices(&self) -> Result<Response> {
+        let result = (self.list_devices)()?;
+        let devices: Vec<_> = result
+            .gamepad_info
+            .iter()
+            .map(|info| {
+                json!({
+                    "path": info.path,
+                    "name": info.name,
+                    "type": info.gamepad_type.to_string(),
+                    "vendor_id": info.vendor_id,
+                    "vendor_name": info.vendor_name,
+                    "product_id": info.product_id,
+                    "capabilities": capabilities_to_strings(&info.capabilities),
+                })
+            })
+            .collect();
+        let errors: Vec<_> = result.errors.iter().map(|e| e.to_string()).collect();
+        Ok(Response::ok(json!({ "devices": devices, "errors": errors })))
+    }
+
+    fn profiles(&self) -> Result<Response> {
+        let mut profiles: Vec<_> = BUILTIN_PROFILES
+            .iter()
+            .map(|id| {
+                let profile = Profile::builtin(id).unwrap();
+                json!({
+                    "id": id,
+                    "name": profile.name,
+                    "description": profile.description,
+                    "source": "builtin",
+                })
+            })
+            .collect();
+
+        for (id, path) in self.profile_files()? {
+            let entry = match Profile::load_verified(&path, &self.integrity) {
+                Ok(profile) => json!({
+                    "id": id,
+                    "name": profile.name,
+                    "description": profile.description,
+                    "source": path,
+                }),
+                // Still list it so a dashboard can show why it's unusable
+                Err(e) => json!({ "id": id, "source": path, "error": format!("{:#}", e) }),
+            };
+            profiles.push(entry);
+        }
+        Ok(Response::ok(json!({ "profiles": profiles })))
+    }
+
+    fn profile(&self, id: &str) -> Result<Response> {
+        match self.find_profile(id)? {
+            Some(profile) => Ok(Response::ok(serde_json::to_value(profile)?)),
+            None => Ok(Response::error(404, format!("no profile '{}'", id))),
+        }
+    }
+
+    fn sessions(&self) -> Response {
+        let sessions = self.sessions.lock().unwrap();
+        let list: Vec<_> =
+            sessions.iter().map(|(id, managed)| session_json(*id, managed)).collect();
+        Response::ok(json!({ "sessions": list }))
+    }
+
+    fn session(&self, id: &str) -> Response {
+        let sessions = self.sessions.lock().unwrap();
+        match id.parse().ok().and_then(|id| sessions.get(&id).map(|s| (id, s))) {
+            Some((id, managed)) => Response::ok(session_json(id, managed)),
+            None => Response::error(404, format!("no session '{}'", id)),
+        }
+    }
+
+    fn start(&self, request: &Request) -> Result<Response> {
+        // Pages can POST text/plain anywhere unasked, but not JSON
+        if !request.is_json() {
+            return Ok(Response::error(415, "session requests must be application/json"));
+        }
+        let body = &request.body;
+        let request: StartRequest = if body.is_empty() {
+            StartRequest::default()
+        } else {
+            match serde_json::from_slice(body) {
+                Ok(request) => request,
+                Err(e) => {
+                    return Ok(Response::error(400, format!("invalid session request: {}", e)));
+                }
+            }
+        };
+
+        let profile_id = request.profile.unwrap_or_else(|| "default".to_string());
+        self.launch(request.devices, profile_id)
+    }
+
+    /// Start remapping `devices` (the first controller if none) with the
+    /// profile `profile_id`
+    fn launch(&self, devices: Vec<String>, profile_id: String) -> Result<Response> {
+        let Some(profile) = self.find_profile(&profile_id)? else {
+            return Ok(Response::error(404, format!("no profile '{}'", profile_id)));
+        };
+
+        let name = profile.name.clone();
+        let session = (self.start_session)(SessionConfig {
+            devices,
+            profile: Some(profile),
+            ..Default::default()
+        })?;
+
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+        tracing::info!("Started session {} on {}", id, session.devices().join(", "));
+        audit::record(AuditEvent::ProfileLoaded { profile: name, file: None });
+        // Saved by what the controllers are, for when their nodes change
+        let gamepads = (self.list_devices)().map(|found| found.gamepad_info).unwrap_or_default();
+        let saved = SavedSession {
+            profile: profile_id.clone(),
+            devices: session
+                .devices()
+                .iter()
+                .map(|path| SavedDevice::of(path, &gamepads))
+                .collect(),
+        };
+        let managed = ManagedSession { session, profile: profile_id, saved };
+        let body = session_json(id, &managed);
+        self.sessions.lock().unwrap().insert(id, managed);
+        self.save_sessions();
+        Ok(Response::created(body))
+    }
+
+    /// Write the running sessions, and those waiting for their controllers,
+    /// to the store
+    fn save_sessions(&self) {
+        let Some(store) = &self.store else {
+            return;
+        };
+        let mut saved: Vec<SavedSession> = self.waiting.lock().unwrap().clone();
+        saved.extend(self.sessions.lock().unwrap().values().map(|managed| managed.saved.clone()));
+        if let Err(e) = store.save(&saved) {
+            tracing::warn!("Sessions not saved: {:#}", e);
+        }
+    }
+
+    fn stop(&self, id: &str) -> Response {
+        let removed = id.parse().ok().and_then(|id| self.sessions.lock().unwrap().remove(&id));
+        let Some(managed) = removed else {
+            return Response::error(404, format!("no session '{}'", id));
+        };
+        self.save_sessions();
+
+        // Joining can take a moment; the map is no longer locked
+        match managed.session.stop() {
+            Ok(()) => Response::ok(json!({ "id": id, "stopped": true })),
+            // The session already ended with an error; report it but it's gone either way
+            Err(e) => {
+                Response::ok(json!({ "id": id, "stopped": true, "error": format!("{:#}", e) }))
+            }
+        }
+    }
+
+    /// Live event feed of session `id`
+    fn subscribe(&self, id: &str) -> Option<Receiver<TapEvent>> {
+        let sessions = self.sessions.lock().unwrap();
+        id.parse().ok().and_then(|id| sessions.get(&id)).map(|managed| managed.session.subscribe())
+    }
+
+    /// `(id, path)` of every profile in the profile dir, sorted by id
+    ///
+    /// Of files sharing an id, the first in `ProfileFormat::EXTENSIONS` wins.
+    fn profile_files(&self) -> Result<Vec<(String, PathBuf)>> {
+        let Some(dir) = &self.profile_dir else {
+            return Ok(Vec::new());
+        };
+        let mut files = Vec::new();
+        for entry in std::fs::read_dir(dir)? {
+            let path = entry?.path();
+            if let Some(rank) = path
+                .extension()
+                .and_then(|ext| ProfileFormat::EXTENSIONS.iter().position(|known| ext == *known))
+                && let Some(id) = path.file_stem().and_then(|s| s.to_str())
+                && is_profile_id(id)
+            {
+                files.push((id.to_string(), rank, path));
+            }
+        }
+        files.sort();
+        files.dedup_by(|later, first| later.0 == first.0);
+        Ok(files.into_iter().map(|(id, _, path)| (id, path)).collect())
+    }
+
+    fn find_profile(&self, id: &str) -> Result<Option<Profile>> {
+        if let Some(profile) = Profile::builtin(id) {
+            return Ok(Some(profile));
+        }
+        let Some(dir) = &self.profile_dir else {
+            return Ok(None);
+        };
+        // Ids come from URLs; never let them walk out of the profile dir
+        if !is_profile_id(id) {
+            return Ok(None);
+        }
+        let path = ProfileFormat::EXTENSIONS
+            .iter()
+            .map(|extension| dir.join(format!("{}.{}", id, extension)))
+            .find(|path| path.is_file());
+        match path {
+            Some(path) => Profile::load_verified(&path, &self.integrity).map(Some),
+            None => Ok(None),
+        }
+    }
+}
+
+fn is_profile_id(id: &str) -> bool {
+    !id.is_empty()
+        && !id.starts_with('.')
+        && id.chars().all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'))
+}
+
+fn session_json(id: u32, managed: &ManagedSession) -> serde_json::Value {
+    json!({
+        "id": id,
+        "devices": managed.session.devices(),
+        "profile": managed.profile,
+        "running": !managed.session.is_finished(),
+        "metrics": managed.session.metrics(),
+    })
+}
+
+/// Refuse a request a web page sent, or one a page made through a name
+/// that resolves to us: the Host and any Origin must name this machine
+///
+/// `local` is the address the request came in on, so an API on a network
+/// address still answers requests for that address.
+fn refuse_cross_site(request: &Request, local: IpAddr) -> Option<Response> {
+    match request.header("Host") {
+        Some(host) if names_us(host, local) => {}
+        Some(host) => return Some(Response::forbidden(format!("host '{}' is not served", host))),
+        None => return Some(Response::error(400, "missing Host header")),
+    }
+    let origin = request.header("Origin")?;
+    let authority = origin.strip_prefix("http://").or_else(|| origin.strip_prefix("https://"));
+    match authority {
+        Some(authority) if names_us(authority, local) => None,
+        _ => Some(Response::forbidden(format!("requests from '{}' are not served", origin))),
+    }
+}
+
+/// Whether `authority` (host, optional port) is a loopback name or `local`
+fn names_us(authority: &str, local: IpAddr) -> bool {
+    let host = match authority.strip_prefix('[') {
+        Some(bracketed) => bracketed.split_once(']').map_or(bracketed, |(host, _)| host),
+        None => authority.rsplit_once(':').map_or(authority, |(host, _)| host),
+    };
+    host.eq_ignore_ascii_case("localhost")
+        || host.parse::<IpAddr>().is_ok_and(|ip| ip.is_loopback() || ip == local)
+}
+
+/// Gives back a connection's place under MAX_CONNECTIONS when it ends
+struct ConnectionSlot(Arc<AtomicUsize>);
+
+impl ConnectionSlot {
+    /// A place among the `open` connections, unless MAX_CONNECTIONS are
+    fn take(open: &Arc<AtomicUsize>) -> Option<Self> {
+        let already_open = open.fetch_add(1, Ordering::Relaxed);
+        let slot = Self(Arc::clone(open));
+        (already_open < MAX_CONNECTIONS).then_some(slot)
+    }
+}
+
+impl Drop for ConnectionSlot {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+/// Accept connections forever, one short-lived thread per request, up to
+/// MAX_CONNECTIONS at once
+pub fn serve(listener: TcpListener, api: std::sync::Arc<Api>) -> Result<()> {
+    let open = Arc::new(AtomicUsize::new(0));
+    for stream in listener.incoming() {
+        let stream = match stream {
+            Ok(stream) => stream,
+            Err(e) => {
+                tracing::warn!("API accept failed: {}", e);
+                continue;
+            }
+        };
+        let Some(slot) = ConnectionSlot::take(&open) else {
+            tracing::warn!("API connection refused: {} already open", MAX_CONNECTIONS);
+            let _ =
+                http::write_response(&mut &stream, &Response::error(503, "too many connections"));
+            continue;
+        };
+        let api = std::sync::Arc::clone(&api);
+        std::thread::Builder::new().name("blazeremap-api".to_string()).spawn(move || {
+            let _slot = slot;
+            if let Err(e) = serve_connection(stream, &api) {
+                tracing::debug!("API connection failed: {}", e);
+            }
+        })?;
+    }
+    Ok(())
+}
+
+fn serve_connection(stream: TcpStream, api: &Api) -> Result<()> {
+    // A silent client must not hold a thread forever
+    stream.set_read_timeout(Some(std::time::Duration::from_secs(5)))?;
+
+    let request = match http::read_request(&mut std::io::BufReader::new(&stream)) {
+        Ok(request) => request,
+        Err(e) => {
+            http::write_response(&mut &stream, &Response::error(400, format!("{:#}", e)))?;
+            return Ok(());
+        }
+    };
+    if let Some(response) = refuse_cross_site(&request, stream.local_addr()?.ip()) {
+        tracing::debug!("{} {} refused: {}", request.method, request.path, response.body);
+        http::write_response(&mut &stream, &response)?;
+        return Ok(());
+    }
+    if let ["api", "sessions", id, "events"] = request.segments().as_slice() {
+        return stream_events(stream, &request, api, id);
+    }
+
+    let response = api.handle(&request);
+    tracing::debug!("{} {} -> {}", request.method, request.path, response.status);
+    // Starting and stopping sessions changes what is remapped
+    if request.method != "GET" && response.status < 400 {
+        let peer = stream.peer_addr().ok();
+        // Who asked, when they asked from this machine
+        let owner = peer.and_then(|peer| platform::tcp_peer(stream.local_addr().ok()?, peer));
+        audit::record(AuditEvent::Requested {
+            command: format!("{} {}", request.method, request.path),
+            uid: owner.map(|(uid, _)| uid),
+            pid: owner.and_then(|(_, pid)| pid).map(|pid| pid as i32),
+            address: peer.map(|addr| addr.to_string()),
+        });
+    }
+    http::write_response(&mut &stream, &response)?;
+    Ok(())
+}
+
+/// Upgrade to a WebSocket and forward session events until either side ends
+fn stream_events(stream: TcpStream, request: &Request, api: &Api, id: &str) -> Result<()> {
+    let Some(key) = websocket::upgrade_key(request) else {
+        let response = Response::error(426, "this endpoint needs a WebSocket upgrade");
+        http::write_response(&mut &stream, &response)?;
+        return Ok(());
+    };
+    let Some(events) = api.subscribe(id) else {
+        http::write_response(&mut &stream, &Response::error(404, format!("no session '{}'", id)))?;
+        return Ok(());
+    };
+    // Pages can open WebSockets anywhere, so this relies on serve_connection
+    // having refused those from other sites, as it does every request
+    websocket::write_handshake(&mut &stream, key)?;
+    tracing::debug!("Streaming events of session {}", id);
+
+    // Client frames are handled on their own thread; writes share the mutex
+    stream.set_read_timeout(None)?;
+    let mut reader = stream.try_clone()?;
+    let writer = Arc::new(Mutex::new(stream));
+    let closed = Arc::new(AtomicBool::new(false));
+    {
+        let (writer, closed) = (Arc::clone(&writer), Arc::clone(&closed));
+        std::thread::Builder::new().name("blazeremap-api-ws".to_string()).spawn(move || {
+            loop {
+                match websocket::read_frame(&mut reader) {
+                    Ok(websocket::ClientFrame::Ping(payload)) => {
+                        let _ = websocket::write_pong(&mut *writer.lock().unwrap(), &payload);
+                    }
+                    Ok(websocket::ClientFrame::Other) => {}
+                    Ok(websocket::ClientFrame::Close) | Err(_) => break,
+                }
+            }
+            closed.store(true, Ordering::Relaxed);
+        })?;
+    }
+
+    while !closed.load(Ordering::Relaxed) {
+        match events.recv_timeout(STREAM_PING_INTERVAL) {
+            Ok(event) => {
+                let text = event_json(&event).to_string();
+                websocket::write_text(&mut *writer.lock().unwrap(), &text)?;
+            }
+            Err(RecvTimeoutError::Timeout) => websocket::write_ping(&mut *writer.lock().unwrap())?,
+            // Session stopped
+            Err(RecvTimeoutError::Disconnected) => break,
+        }
+    }
+    let stream = writer.lock().unwrap();
+    websocket::write_close(&mut &*stream)?;
+    // Also ends the client-frame thread blocked on its read
+    stream.shutdown(std::net::Shutdown::Both)?;
+    Ok(())
+}
+
+/// Wire format of one streamed event
+fn event_json(event: &TapEvent) -> serde_json::Value {
+    match event {
+        TapEvent::Input(InputEvent::Button { code, pressed, .. }) => {
+            json!({ "kind": "input", "type": "button", "code": code, "pressed": pressed })
+        }
+        TapEvent::Input(InputEvent::Axis { code, value, .. }) => {
+            json!({ "kind": "input", "type": "axis", "code": code, "value": value })
+        }
+        TapEvent::Input(InputEvent::Sync { .. }) => json!({ "kind": "input", "type": "sync" }),
+        TapEvent::Output(OutputEvent::Keyboard { code, event_type }) => json!({
+            "kind": "output",
+            "type": "key",
+            "code": code,
+            "action": format!("{:?}", event_type).to_lowercase(),
+        }),
+        TapEvent::Output(OutputEvent::Mouse(MouseEvent::Button { button, pressed })) => json!({
+            "kind": "output",
+            "type": "mouse_button",
+            "button": format!("{:?}", button).to_lowercase(),
+            "pressed": pressed,
+        }),
+        TapEvent::Output(OutputEvent::Mouse(MouseEvent::Scroll { vertical, horizontal })) => {
+            json!({
+                "kind": "output",
+                "type": "mouse_scroll",
+                "vertical": vertical,
+                "horizontal": horizontal,
+            })
+        }
+        TapEvent::Output(OutputEvent::Mouse(MouseEvent::Move { dx, dy })) => {
+            json!({ "kind": "output", "type": "mouse_move", "dx": dx, "dy": dy })
+        }
+        TapEvent::Output(OutputEvent::Mouse(MouseEvent::MoveTo { x, y })) => {
+            json!({ "kind": "output", "type": "mouse_move_to", "x": x, "y": y })
+        }
+        TapEvent::Output(OutputEvent::Gamepad { control, pressed }) => json!({
+            "kind": "output",
+            "type": "gamepad",
+            "control": control.to_string(),
+            "pressed": pressed,
+        }),
+        // The event as usual, with the custom device it went to
+        TapEvent::Output(OutputEvent::Routed { device, event }) => {
+            let mut routed = event_json(&TapEvent::Output((**event).clone()));
+            routed["device"] = json!(device.as_ref());
+            routed
+        }
+        TapEvent::Sticky(keys) => json!({ "kind": "sticky", "keys": keys }),
+        TapEvent::Switch(Switch::Layer { button, on }) => {
+            json!({ "kind": "switch", "type": "layer", "button": button, "on": on })
+        }
+        TapEvent::Switch(Switch::Context) => json!({ "kind": "switch", "type": "context" }),
+        TapEvent::Switch(Switch::Profile(name)) => {
+            json!({ "kind": "switch", "type": "profile", "name": name })
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{AxisCode, InputEvent};
+    use crate::input::InputManager;
+    use crate::input::gamepad::{GamepadInfo, GamepadType, MockGamepad};
+    use crate::input::manager::MockInputManager;
+    use crate::output::identity::VirtualDeviceIdentity;
+    use crate::output::keyboard::{MockVirtualKeyboard, VirtualKeyboard};
+    use std::io::{Read, Write};
+    use std::sync::Arc;
+
+    fn test_info() -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Test Gamepad".to_string(),
+            gamepad_type: GamepadType::XboxOne,
+            vendor_id: 0x045e,
+            vendor_name: "Microsoft".to_string(),
+            product_id: 0x02ea,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
+    /// Sessions read a mock controller that reports stick noise until stopped
+    fn mock_session(config: SessionConfig) -> Result<Session> {
+        let make_manager = || {
+            let mut manager = MockInputManager::new();
+            manager.expect_open_gamepad().returning(|_| {
+                let mut gamepad = MockGamepad::new();
+                gamepad.expect_get_info().returning(test_info);
+                let mut reads = 0u64;
+                gamepad.expect_read_event().returning(move || {
+                    reads += 1;
+                    if reads % 2 == 0 {
+                        return Ok(Some(InputEvent::sync()));
+                    }
+                    std::thread::sleep(std::time::Duration::from_millis(5));
+                    Ok(Some(InputEvent::axis_move(AxisCode::LeftX, 200)))
+                });
+                Ok(Box::new(gamepad))
+            });
+            Ok(Box::new(manager) as Box<dyn InputManager>)
+        };
+        let make_keyboard = |_: &VirtualDeviceIdentity| {
+            Ok(Box::new(MockVirtualKeyboard::new()) as Box<dyn VirtualKeyboard>)
+        };
+        Session::start_with(config, make_manager, make_keyboard)
+    }
+
+    fn test_api(profile_dir: Option<PathBuf>) -> Api {
+        Api::with_backends(
+            profile_dir,
+            Box::new(|| {
+                Ok(InputDetectionResult { gamepad_info: vec![test_info()], errors: vec![] })
+            }),
+            Box::new(mock_session),
+        )
+    }
+
+    fn request(method: &str, path: &str, body: &str) -> Request {
+        let json = ("Content-Type".to_string(), "application/json".to_string());
+        Request {
+            method: method.to_string(),
+            path: path.to_string(),
+            query: String::new(),
+            headers: if method == "POST" { vec![json] } else { vec![] },
+            body: body.as_bytes().to_vec(),
+        }
+    }
+
+    #[test]
+    fn test_devices() {
+        let response = test_api(None).handle(&request("GET", "/api/devices", ""));
+
+        assert_eq!(response.status, 200);
+        let device = &response.body["devices"][0];
+        assert_eq!(device["path"], "/dev/input/event3");
+        assert_eq!(device["type"], "Xbox One");
+        assert_eq!(device["vendor_id"], 0x045e);
+    }
+
+    #[test]
+    fn test_profiles_from_builtins_and_dir() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-api-test-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let mut racing = Profile::default_profile();
+        racing.name = "Racing".to_string();
+        racing.save_to_file(&dir.join("racing.toml")).unwrap();
+        std::fs::write(dir.join("racing.json"), "{}").unwrap();
+        racing.name = "Rally".to_string();
+        racing.save_to_file(&dir.join("rally.yaml")).unwrap();
+        std::fs::write(dir.join("broken.toml"), "not = [valid").unwrap();
+        std::fs::write(dir.join("notes.txt"), "ignored").unwrap();
+
+        let api = test_api(Some(dir.clone()));
+        let response = api.handle(&request("GET", "/api/profiles", ""));
+        let ids: Vec<_> = response.body["profiles"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|p| p["id"].as_str().unwrap().to_string())
+            .collect();
+        assert_eq!(
+            ids,
+            [
+                "default",
+                "steam-deck",
+                "one-handed-left",
+                "one-handed-right",
+                "southpaw",
+                "southpaw-dpad",
+                "desktop",
+                "broken",
+                "racing",
+                "rally"
+            ]
+        );
+        assert!(response.body["profiles"][7]["error"].is_string());
+
+        let response = api.handle(&request("GET", "/api/profiles/racing", ""));
+        assert_eq!(response.body["name"], "Racing");
+        let response = api.handle(&request("GET", "/api/profiles/rally", ""));
+        assert_eq!(response.body["name"], "Rally");
+        assert_eq!(api.handle(&request("GET", "/api/profiles/..", "")).status, 404);
+
+        std::fs::remove_dir_all(dir).unwrap();
+    }
+
+    #[test]
+    fn test_session_lifecycle() {
+        let api = test_api(None);
+
+        let response = api.handle(&request(
+            "POST",
+            "/api/sessions",
+            r#"{"devices": ["/dev/input/event3"], "profile": "steam-deck"}"#,
+        ));
+        assert_eq!(response.status, 201);
+        assert_eq!(response.body["id"], 1);
+        assert_eq!(response.body["profile"], "steam-deck");
+
+        let response = api.handle(&request("GET", "/api/sessions", ""));
+        assert_eq!(response.body["sessions"].as_array().unwrap().len(), 1);
+        let response = api.handle(&request("GET", "/api/sessions/1", ""));
+        assert_eq!(response.body["devices"][0], "/dev/input/event3");
+        assert_eq!(response.body["running"], true);
+
+        let response = api.handle(&request("DELETE", "/api/sessions/1", ""));
+        assert_eq!((response.status, &response.body["stopped"]), (200, &json!(true)));
+        assert_eq!(api.handle(&request("GET", "/api/sessions/1", "")).status, 404);
+    }
+
+    #[test]
+    fn test_sessions_restored_after_a_restart() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-api-state-{}", std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        let store = SessionStore::new(dir.join("sessions.json"));
+        let crashed = test_api(None).with_store(store.clone());
+        let body = r#"{"devices": ["/dev/input/event3"], "profile": "steam-deck"}"#;
+        assert_eq!(crashed.handle(&request("POST", "/api/sessions", body)).status, 201);
+
+        // Gone without a word, as in a crash
+        for (_, managed) in std::mem::take(&mut *crashed.sessions.lock().unwrap()) {
+            managed.session.stop().unwrap();
+        }
+        let saved = store.load().unwrap();
+        assert_eq!(saved[0].profile, "steam-deck");
+        assert_eq!(saved[0].devices[0].vendor_id, Some(0x045e));
+        // A controller that isn't connected keeps its session saved
+        let mut elsewhere = saved[0].clone();
+        elsewhere.devices[0].uniq = Some("a0:5a:5c:00:11:22".to_string());
+        store.save(&[saved[0].clone(), elsewhere.clone()]).unwrap();
+
+        let restarted = test_api(None).with_store(store.clone());
+        assert_eq!(restarted.restore().unwrap(), 1);
+        let response = restarted.handle(&request("GET", "/api/sessions/1", ""));
+        assert_eq!(response.body["devices"][0], "/dev/input/event3");
+        assert_eq!(response.body["profile"], "steam-deck");
+        assert_eq!(store.load().unwrap(), [elsewhere.clone(), saved[0].clone()]);
+
+        restarted.handle(&request("DELETE", "/api/sessions/1", ""));
+        assert_eq!(store.load().unwrap(), [elsewhere]);
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_client_errors() {
+        let api = test_api(None);
+
+        assert_eq!(api.handle(&request("POST", "/api/sessions", "{nope")).status, 400);
+        assert_eq!(api.handle(&request("POST", "/api/sessions", r#"{"x": 1}"#)).status, 400);
+        assert_eq!(
+            api.handle(&request("POST", "/api/sessions", r#"{"profile": "missing"}"#)).status,
+            404
+        );
+        assert_eq!(api.handle(&request("DELETE", "/api/devices", "")).status, 405);
+        assert_eq!(api.handle(&request("GET", "/api/nothing", "")).status, 404);
+
+        let mut form = request("POST", "/api/sessions", r#"{"profile": "default"}"#);
+        form.headers = vec![("Content-Type".to_string(), "text/plain".to_string())];
+        assert_eq!(api.handle(&form).status, 415);
+        assert!(api.sessions().body["sessions"].as_array().unwrap().is_empty());
+    }
+
+    #[test]
+    fn test_cross_site_requests_refused() {
+        let local = IpAddr::from([127, 0, 0, 1]);
+        let from = |host: Option<&str>, origin: Option<&str>| {
+            let mut request = request("POST", "/api/sessions", "");
+            request.headers.extend(host.map(|host| ("Host".to_string(), host.to_string())));
+            request.headers.extend(origin.map(|origin| ("Origin".to_string(), origin.to_string())));
+            refuse_cross_site(&request, local).map(|response| response.status)
+        };
+
+        assert_eq!(from(Some("localhost:8680"), None), None);
+        assert_eq!(from(Some("127.0.0.1:8680"), Some("http://localhost:3000")), None);
+        assert_eq!(from(Some("[::1]:8680"), Some("https://[::1]")), None);
+        // DNS rebinding: a page's own name pointed at 127.0.0.1
+        assert_eq!(from(Some("evil.example:8680"), None), Some(403));
+        assert_eq!(from(Some("localhost:8680"), Some("https://evil.example")), Some(403));
+        assert_eq!(from(Some("localhost:8680"), Some("null")), Some(403));
+        assert_eq!(from(None, None), Some(400));
+
+        // An API on a network address answers for that address alone
+        let lan = IpAddr::from([192, 168, 1, 20]);
+        let mut request = request("GET", "/api/devices", "");
+        request.headers.push(("Host".to_string(), "192.168.1.20:8680".to_string()));
+        assert!(refuse_cross_site(&request, lan).is_none());
+        request.headers[0].1 = "192.168.1.21:8680".to_string();
+        assert!(refuse_cross_site(&request, lan).is_some());
+    }
+
+    #[test]
+    fn test_serve_over_tcp() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let api = Arc::new(test_api(None));
+        std::thread::spawn(move || serve(listener, api));
+
+        let mut stream = TcpStream::connect(addr).unwrap();
+        stream.write_all(b"GET /api/devices HTTP/1.1\r\nHost: localhost\r\n\r\n").unwrap();
+        let mut reply = String::new();
+        stream.read_to_string(&mut reply).unwrap();
+
+        assert!(reply.starts_with("HTTP/1.1 200 OK\r\n"));
+        assert!(reply.contains("\"path\":\"/dev/input/event3\""));
+
+        let mut stream = TcpStream::connect(addr).unwrap();
+        stream
+            .write_all(
+                b"POST /api/sessions HTTP/1.1\r\n\
+                  Host: localhost\r\n\
+                  Origin: https://evil.example\r\n\
+                  Content-Type: application/json\r\n\
+                  Content-Length: 2\r\n\r\n{}",
+            )
+            .unwrap();
+        let mut reply = String::new();
+        stream.read_to_string(&mut reply).unwrap();
+        assert!(reply.starts_with("HTTP/1.1 403 Forbidden\r\n"));
+    }
+
+    #[test]
+    fn test_event_json() {
+        let event = TapEvent::Output(OutputEvent::Keyboard {
+            code: crate::event::KeyboardCode::Space,
+            event_type: crate::event::KeyboardEventType::Press,
+        });
+        assert_eq!(
+            event_json(&event),
+            json!({ "kind": "output", "type": "key", "code": "Space", "action": "press" })
+        );
+        let event = TapEvent::Sticky(vec![crate::event::KeyboardCode::LeftShift]);
+        assert_eq!(event_json(&event), json!({ "kind": "sticky", "keys": ["LeftShift"] }));
+        let event = TapEvent::Switch(Switch::Layer {
+            button: crate::event::ButtonCode::LeftShoulder,
+            on: true,
+        });
+        assert_eq!(
+            event_json(&event),
+            json!({ "kind": "switch", "type": "layer", "button": "LeftShoulder", "on": true })
+        );
+    }
+
+    #[test]
+    fn test_events_stream_over_websocket() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let api = Arc::new(test_api(None));
+        let body = r#"{"devices": ["/dev/input/event3"]}"#;
+        assert_eq!(api.handle(&request("POST", "/api/sessions", body)).status, 201);
+        std::thread::spawn({
+            let api = Arc::clone(&api);
+            move || serve(listener, api)
+        });
+
+        // Plain GET is refused
+        let mut stream = TcpStream::connect(addr).unwrap();
+        stream
+            .write_all(b"GET /api/sessions/1/events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+            .unwrap();
+        let mut reply = String::new();
+        stream.read_to_string(&mut reply).unwrap();
+        assert!(reply.starts_with("HTTP/1.1 426 Upgrade Required\r\n"));
+
+        // So is a page elsewhere listening in
+        let upgrade = "Upgrade: websocket\r\n\
+                       Connection: Upgrade\r\n\
+                       Sec-WebSocket-Version: 13\r\n\
+                       Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n";
+        let mut stream = TcpStream::connect(addr).unwrap();
+        let handshake = format!(
+            "GET /api/sessions/1/events HTTP/1.1\r\n\
+             Host: localhost\r\n\
+             Origin: https://evil.example\r\n{}",
+            upgrade
+        );
+        stream.write_all(handshake.as_bytes()).unwrap();
+        let mut reply = String::new();
+        stream.read_to_string(&mut reply).unwrap();
+        assert!(reply.starts_with("HTTP/1.1 403 Forbidden\r\n"));
+
+        // A dashboard served from loopback is let in
+        let mut stream = TcpStream::connect(addr).unwrap();
+        let handshake = format!(
+            "GET /api/sessions/1/events HTTP/1.1\r\n\
+             Host: localhost\r\n\
+             Origin: http://localhost:3000\r\n{}",
+            upgrade
+        );
+        stream.write_all(handshake.as_bytes()).unwrap();
+        let mut head = [0u8; 129];
+        stream.read_exact(&mut head).unwrap();
+        let head = String::from_utf8_lossy(&head);
+        assert!(head.starts_with("HTTP/1.1 101 Switching Protocols\r\n"));
+        assert!(head.contains("s3pPLMBiTxaQ9kYGzzhZRbK+xOo="));
+
+        // First frame: a text frame carrying the stick event
+        let mut frame = [0u8; 2];
+        stream.read_exact(&mut frame).unwrap();
+        assert_eq!(frame[0], 0x81);
+        let mut payload = vec![0u8; frame[1] as usize];
+        stream.read_exact(&mut payload).unwrap();
+        let event: serde_json::Value = serde_json::from_slice(&payload).unwrap();
+        assert_eq!(
+            event,
+            json!({ "kind": "input", "type": "axis", "code": "LeftX", "value": 200 })
+        );
+
+        // Stopping the session ends the stream with a close frame
+        assert_eq!(api.handle(&request("DELETE", "/api/sessions/1", "")).status, 200);
+        let mut rest = Vec::new();
+        stream.read_to_end(&mut rest).unwrap();
+        assert!(rest.ends_with(&[0x88, 2, 0x03, 0xE8]));
+    }
+}
@@ -0,0 +1,231 @@
+// Profiling endpoint for `run --pprof`, after Go's net/http/pprof
+//
+//   GET /debug/pprof/                   what's here
+//   GET /debug/pprof/metrics            read → map → write latency histograms
+//   GET /debug/pprof/threads            CPU time of each thread so far
+//   GET /debug/pprof/profile?seconds=N  each thread's CPU use over the next
+//                                       N seconds (10 by default, up to 60)
+//
+// There's no sampling profiler in here: which thread's CPU use went up,
+// next to the stage that got slower, says where a regression is; `perf
+// record -p PID` takes it from there. Like the API it is unauthenticated,
+// meant for loopback, and refuses requests from web pages and too many
+// connections at once the same way.
+
+use anyhow::Result;
+use serde::Serialize;
+use serde_json::json;
+use std::net::{TcpListener, TcpStream};
+use std::sync::Arc;
+use std::sync::atomic::AtomicUsize;
+use std::time::{Duration, Instant};
+
+use super::http::{self, Request, Response};
+use super::{ConnectionSlot, MAX_CONNECTIONS, refuse_cross_site};
+use crate::metrics::PipelineMetrics;
+use crate::platform::thread::{self, ThreadTimes};
+
+pub const DEFAULT_PORT: u16 = 6060;
+
+const DEFAULT_SECONDS: u64 = 10;
+const MAX_SECONDS: u64 = 60;
+
+/// One thread's share of a profile
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct ThreadProfile {
+    pub tid: u32,
+    pub name: String,
+    pub user_ms: u64,
+    pub system_ms: u64,
+    /// Of one CPU
+    pub cpu_percent: f64,
+}
+
+/// CPU use of the threads in both `before` and `after`, `window` apart,
+/// busiest first
+pub fn profile(
+    before: &[ThreadTimes],
+    after: &[ThreadTimes],
+    window: Duration,
+) -> Vec<ThreadProfile> {
+    let mut threads: Vec<ThreadProfile> = after
+        .iter()
+        .filter_map(|now| {
+            let then = before.iter().find(|then| then.tid == now.tid)?;
+            let user = now.user.saturating_sub(then.user);
+            let system = now.system.saturating_sub(then.system);
+            let busy = (user + system).as_secs_f64() / window.as_secs_f64().max(f64::EPSILON);
+            Some(ThreadProfile {
+                tid: now.tid,
+                name: now.name.clone(),
+                user_ms: user.as_millis() as u64,
+                system_ms: system.as_millis() as u64,
+                cpu_percent: (busy * 1000.0).round() / 10.0,
+            })
+        })
+        .collect();
+    threads.sort_by(|a, b| b.cpu_percent.total_cmp(&a.cpu_percent).then(a.tid.cmp(&b.tid)));
+    threads
+}
+
+/// Answer profiling requests on `listener` until the process ends
+pub fn serve(listener: TcpListener, metrics: Arc<PipelineMetrics>) -> Result<()> {
+    let open = Arc::new(AtomicUsize::new(0));
+    for stream in listener.incoming() {
+        let stream = match stream {
+            Ok(stream) => stream,
+            Err(e) => {
+                tracing::warn!("Profiling endpoint accept failed: {}", e);
+                continue;
+            }
+        };
+        let Some(slot) = ConnectionSlot::take(&open) else {
+            tracing::warn!("Profiling connection refused: {} already open", MAX_CONNECTIONS);
+            let _ =
+                http::write_response(&mut &stream, &Response::error(503, "too many connections"));
+            continue;
+        };
+        let metrics = Arc::clone(&metrics);
+        // A profile takes seconds; others shouldn't wait for it
+        std::thread::Builder::new().name("blazeremap-pprof".to_string()).spawn(move || {
+            let _slot = slot;
+            if let Err(e) = serve_connection(stream, &metrics) {
+                tracing::debug!("Profiling connection failed: {}", e);
+            }
+        })?;
+    }
+    Ok(())
+}
+
+fn serve_connection(stream: TcpStream, metrics: &PipelineMetrics) -> Result<()> {
+    stream.set_read_timeout(Some(Duration::from_secs(5)))?;
+    let response = match http::read_request(&mut std::io::BufReader::new(&stream)) {
+        Ok(request) => match refuse_cross_site(&request, stream.local_addr()?.ip()) {
+            Some(refused) => refused,
+            None => handle(&request, metrics),
+        },
+        Err(e) => Response::error(400, format!("{:#}", e)),
+    };
+    http::write_response(&mut &stream, &response)?;
+    Ok(())
+}
+
+fn handle(request: &Request, metrics: &PipelineMetrics) -> Response {
+    if request.method != "GET" {
+        return Response::method_not_allowed();
+    }
+    let result = match request.segments().as_slice() {
+        ["debug", "pprof"] => Ok(json!({
+            "metrics": "read → map → write latency histograms",
+            "threads": "CPU time of each thread so far",
+            "profile": "CPU use of each thread over ?seconds=N (default 10)",
+        })),
+        ["debug", "pprof", "metrics"] => Ok(json!(metrics.snapshot())),
+        ["debug", "pprof", "threads"] => thread::cpu_times().map(|threads| {
+            let threads = threads.iter().map(|thread| {
+                json!({
+                    "tid": thread.tid,
+                    "name": thread.name,
+                    "user_ms": thread.user.as_millis() as u64,
+                    "system_ms": thread.system.as_millis() as u64,
+                })
+            });
+            json!({ "threads": threads.collect::<Vec<_>>() })
+        }),
+        ["debug", "pprof", "profile"] => {
+            let seconds = match request.query_param("seconds").map(str::parse::<u64>) {
+                None => DEFAULT_SECONDS,
+                Some(Ok(seconds)) if (1..=MAX_SECONDS).contains(&seconds) => seconds,
+                Some(_) => {
+                    return Response::error(400, format!("seconds must be 1 to {}", MAX_SECONDS));
+                }
+            };
+            cpu_profile(Duration::from_secs(seconds))
+        }
+        _ => return Response::not_found(),
+    };
+    match result {
+        Ok(body) => Response::ok(body),
+        Err(e) => Response::error(500, format!("{:#}", e)),
+    }
+}
+
+/// Watch the threads for `window`
+fn cpu_profile(window: Duration) -> Result<serde_json::Value> {
+    let before = thread::cpu_times()?;
+    let started = Instant::now();
+    std::thread::sleep(window);
+    let after = thread::cpu_times()?;
+    let elapsed = started.elapsed();
+    let threads = profile(&before, &after, elapsed);
+    Ok(json!({ "seconds": elapsed.as_secs_f64(), "threads": threads }))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn times(tid: u32, name: &str, user_ms: u64, system_ms: u64) -> ThreadTimes {
+        ThreadTimes {
+            tid,
+            name: name.to_string(),
+            user: Duration::from_millis(user_ms),
+            system: Duration::from_millis(system_ms),
+        }
+    }
+
+    #[test]
+    fn test_profile_busiest_first() {
+        let before = [times(1, "blazeremap", 100, 50), times(2, "blazeremap-read", 10, 0)];
+        let after = [
+            times(1, "blazeremap", 200, 100),
+            times(2, "blazeremap-read", 310, 0),
+            times(3, "blazeremap-pprof", 5, 0),
+        ];
+        let threads = profile(&before, &after, Duration::from_secs(2));
+
+        assert_eq!(threads.len(), 2);
+        assert_eq!((threads[0].tid, threads[0].user_ms, threads[0].cpu_percent), (2, 300, 15.0));
+        assert_eq!((threads[1].tid, threads[1].system_ms, threads[1].cpu_percent), (1, 50, 7.5));
+    }
+
+    #[test]
+    fn test_routes() {
+        let metrics = PipelineMetrics::new();
+        let get = |path: &str, query: &str| Request {
+            method: "GET".to_string(),
+            path: path.to_string(),
+            query: query.to_string(),
+            headers: vec![],
+            body: vec![],
+        };
+
+        assert_eq!(handle(&get("/debug/pprof/", ""), &metrics).status, 200);
+        let response = handle(&get("/debug/pprof/metrics", ""), &metrics);
+        assert_eq!(response.body["frames"], 0);
+        assert_eq!(handle(&get("/debug/pprof/profile", "seconds=0"), &metrics).status, 400);
+        assert_eq!(handle(&get("/debug/pprof/profile", "seconds=x"), &metrics).status, 400);
+        assert_eq!(handle(&get("/debug/pprof/heap", ""), &metrics).status, 404);
+    }
+
+    #[test]
+    fn test_serve_refuses_web_pages() {
+        use std::io::{Read, Write};
+
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        std::thread::spawn(move || serve(listener, Arc::new(PipelineMetrics::new())));
+
+        let get = |headers: &str| {
+            let mut stream = TcpStream::connect(addr).unwrap();
+            write!(stream, "GET /debug/pprof/metrics HTTP/1.1\r\n{}\r\n", headers).unwrap();
+            let mut reply = String::new();
+            stream.read_to_string(&mut reply).unwrap();
+            reply
+        };
+        assert!(get("Host: localhost\r\n").starts_with("HTTP/1.1 200 OK\r\n"));
+        let reply = get("Host: localhost\r\nOrigin: https://evil.example\r\n");
+        assert!(reply.starts_with("HTTP/1.1 403 Forbidden\r\n"));
+        assert!(get("Host: evil.example\r\n").starts_with("HTTP/1.1 403 Forbidden\r\n"));
+    }
+}
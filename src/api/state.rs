@@ -0,0 +1,184 @@
+// Sessions `serve` brings back after a restart
+//
+//   $XDG_STATE_HOME/blazeremap/sessions.json
+//
+//   {"sessions": [{"profile": "racing", "devices": [{"path": "/dev/input/event3",
+//     "vendor_id": 1356, "product_id": 2508, "uniq": "a0:5a:5c:00:11:22"}]}]}
+//
+// Rewritten whenever a session starts or stops through the API: to a
+// temporary file first, then renamed over the old one, so a crash while
+// writing leaves the last state whole. Event node numbers change across
+// reboots, so controllers are found again by their IDs (as aliases are),
+// and by path only when they had none.
+
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+
+use crate::input::GamepadInfo;
+use crate::input::alias::DeviceIdentity;
+
+/// A controller of a saved session
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SavedDevice {
+    /// The node it had
+    pub path: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub vendor_id: Option<u16>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub product_id: Option<u16>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub uniq: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub phys: Option<String>,
+}
+
+impl SavedDevice {
+    /// The device at `path`, as whichever of `gamepads` it is
+    pub fn of(path: &str, gamepads: &[GamepadInfo]) -> Self {
+        let identity = gamepads.iter().find(|info| info.path == path).map(DeviceIdentity::of);
+        Self {
+            path: path.to_string(),
+            vendor_id: identity.as_ref().map(|identity| identity.vendor_id),
+            product_id: identity.as_ref().map(|identity| identity.product_id),
+            uniq: identity.as_ref().and_then(|identity| identity.uniq.clone()),
+            phys: identity.and_then(|identity| identity.phys),
+        }
+    }
+
+    /// Where the controller is now: found among `gamepads` by its IDs, or
+    /// for one saved without them, its old node if that's still there
+    pub fn find(&self, gamepads: &[GamepadInfo]) -> Option<String> {
+        let (Some(vendor_id), Some(product_id)) = (self.vendor_id, self.product_id) else {
+            return Path::new(&self.path).exists().then(|| self.path.clone());
+        };
+        let identity = DeviceIdentity {
+            vendor_id,
+            product_id,
+            uniq: self.uniq.clone(),
+            phys: self.phys.clone(),
+        };
+        identity.find(gamepads).map(|info| info.path.clone())
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SavedSession {
+    /// Profile id, as `POST /api/sessions` takes it
+    pub profile: String,
+    pub devices: Vec<SavedDevice>,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct StateFile {
+    sessions: Vec<SavedSession>,
+}
+
+/// The sessions file
+#[derive(Debug, Clone)]
+pub struct SessionStore {
+    path: PathBuf,
+}
+
+impl SessionStore {
+    pub fn new(path: impl Into<PathBuf>) -> Self {
+        Self { path: path.into() }
+    }
+
+    /// $XDG_STATE_HOME/blazeremap/sessions.json
+    pub fn user() -> Result<Self> {
+        Ok(Self::new(crate::logging::state_dir()?.join("sessions.json")))
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// The sessions saved last; none without the file
+    pub fn load(&self) -> Result<Vec<SavedSession>> {
+        let text = match fs::read_to_string(&self.path) {
+            Ok(text) => text,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read {}", self.path.display()));
+            }
+        };
+        let state: StateFile = serde_json::from_str(&text)
+            .with_context(|| format!("Invalid session state {}", self.path.display()))?;
+        Ok(state.sessions)
+    }
+
+    /// Replace what's saved with `sessions`, all at once
+    pub fn save(&self, sessions: &[SavedSession]) -> Result<()> {
+        let state = StateFile { sessions: sessions.to_vec() };
+        let text = serde_json::to_string_pretty(&state)? + "\n";
+        if let Some(dir) = self.path.parent() {
+            fs::create_dir_all(dir)
+                .with_context(|| format!("Failed to create {}", dir.display()))?;
+        }
+        let temporary = self.path.with_extension("json.tmp");
+        let written = fs::File::create(&temporary).and_then(|mut file| {
+            file.write_all(text.as_bytes())?;
+            file.sync_all()
+        });
+        written
+            .and_then(|()| fs::rename(&temporary, &self.path))
+            .with_context(|| format!("Failed to write {}", self.path.display()))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::gamepad::GamepadType;
+
+    fn pad(path: &str, uniq: &str) -> GamepadInfo {
+        GamepadInfo {
+            path: path.to_string(),
+            name: "Wireless Controller".to_string(),
+            gamepad_type: GamepadType::DualShock4,
+            vendor_id: 0x054c,
+            vendor_name: "Sony".to_string(),
+            product_id: 0x09cc,
+            uniq: Some(uniq.to_string()),
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
+    #[test]
+    fn test_devices_found_again_on_new_nodes() {
+        let before = [pad("/dev/input/event3", "a0:01"), pad("/dev/input/event4", "a0:02")];
+        let saved = SavedDevice::of("/dev/input/event4", &before);
+        assert_eq!(saved.uniq.as_deref(), Some("a0:02"));
+
+        let after = [pad("/dev/input/event7", "a0:02"), pad("/dev/input/event8", "a0:01")];
+        assert_eq!(saved.find(&after).as_deref(), Some("/dev/input/event7"));
+        assert_eq!(saved.find(&after[1..]), None);
+
+        let unknown = SavedDevice::of("/dev/input/event-gone", &before);
+        assert_eq!(unknown.vendor_id, None);
+        assert_eq!(unknown.find(&after), None);
+    }
+
+    #[test]
+    fn test_save_and_load() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-state-{}", std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        let store = SessionStore::new(dir.join("sessions.json"));
+        assert_eq!(store.load().unwrap(), []);
+
+        let sessions = [SavedSession {
+            profile: "racing".to_string(),
+            devices: vec![SavedDevice::of("/dev/input/event3", &[pad("/dev/input/event3", "a0")])],
+        }];
+        store.save(&sessions).unwrap();
+        store.save(&sessions).unwrap();
+        assert_eq!(store.load().unwrap(), sessions);
+        assert!(!dir.join("sessions.json.tmp").exists());
+        fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,254 @@
+// Server side of RFC 6455 WebSockets, as far as event streaming needs
+//
+// Only text frames go out; from the client we only act on close and ping.
+// The handshake needs SHA-1, small enough to carry here rather than pull in
+// a crate for one header; base64 comes from the crate profile signatures use.
+
+use base64::{Engine, engine::general_purpose::STANDARD as BASE64};
+use std::io::{Read, Write};
+
+use super::http::Request;
+
+const HANDSHAKE_GUID: &str = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11";
+/// Client frames are control frames or tiny; anything bigger is refused
+const MAX_CLIENT_PAYLOAD: u64 = 4096;
+
+const OP_TEXT: u8 = 0x1;
+const OP_CLOSE: u8 = 0x8;
+const OP_PING: u8 = 0x9;
+const OP_PONG: u8 = 0xA;
+
+/// A frame received from the client
+#[derive(Debug, PartialEq, Eq)]
+pub enum ClientFrame {
+    Close,
+    Ping(Vec<u8>),
+    /// Text, binary or pong; streaming endpoints ignore these
+    Other,
+}
+
+/// The client's `Sec-WebSocket-Key` if `request` is a valid upgrade
+pub fn upgrade_key(request: &Request) -> Option<&str> {
+    let has_token = |name: &str, token: &str| {
+        request
+            .header(name)
+            .is_some_and(|value| value.split(',').any(|v| v.trim().eq_ignore_ascii_case(token)))
+    };
+    if request.method == "GET"
+        && has_token("Upgrade", "websocket")
+        && has_token("Connection", "upgrade")
+        && request.header("Sec-WebSocket-Version") == Some("13")
+    {
+        request.header("Sec-WebSocket-Key")
+    } else {
+        None
+    }
+}
+
+/// Answer an upgrade request, switching the connection to WebSocket frames
+pub fn write_handshake<W: Write>(writer: &mut W, key: &str) -> std::io::Result<()> {
+    write!(
+        writer,
+        "HTTP/1.1 101 Switching Protocols\r\n\
+         Upgrade: websocket\r\n\
+         Connection: Upgrade\r\n\
+         Sec-WebSocket-Accept: {}\r\n\r\n",
+        accept_key(key)
+    )?;
+    writer.flush()
+}
+
+pub fn write_text<W: Write>(writer: &mut W, text: &str) -> std::io::Result<()> {
+    write_frame(writer, OP_TEXT, text.as_bytes())
+}
+
+pub fn write_ping<W: Write>(writer: &mut W) -> std::io::Result<()> {
+    write_frame(writer, OP_PING, &[])
+}
+
+pub fn write_pong<W: Write>(writer: &mut W, payload: &[u8]) -> std::io::Result<()> {
+    write_frame(writer, OP_PONG, payload)
+}
+
+pub fn write_close<W: Write>(writer: &mut W) -> std::io::Result<()> {
+    // 1000 = normal closure
+    write_frame(writer, OP_CLOSE, &1000u16.to_be_bytes())
+}
+
+/// Unmasked, unfragmented server frame
+fn write_frame<W: Write>(writer: &mut W, opcode: u8, payload: &[u8]) -> std::io::Result<()> {
+    let mut header = Vec::with_capacity(10);
+    header.push(0x80 | opcode);
+    match payload.len() {
+        len @ 0..=125 => header.push(len as u8),
+        len @ 126..=0xFFFF => {
+            header.push(126);
+            header.extend_from_slice(&(len as u16).to_be_bytes());
+        }
+        len => {
+            header.push(127);
+            header.extend_from_slice(&(len as u64).to_be_bytes());
+        }
+    }
+    writer.write_all(&header)?;
+    writer.write_all(payload)?;
+    writer.flush()
+}
+
+/// Read one client frame (clients must mask, per the RFC)
+pub fn read_frame<R: Read>(reader: &mut R) -> anyhow::Result<ClientFrame> {
+    let mut head = [0u8; 2];
+    reader.read_exact(&mut head)?;
+    let opcode = head[0] & 0x0F;
+    if head[1] & 0x80 == 0 {
+        anyhow::bail!("unmasked client frame");
+    }
+
+    let len = match head[1] & 0x7F {
+        126 => {
+            let mut len = [0u8; 2];
+            reader.read_exact(&mut len)?;
+            u16::from_be_bytes(len) as u64
+        }
+        127 => {
+            let mut len = [0u8; 8];
+            reader.read_exact(&mut len)?;
+            u64::from_be_bytes(len)
+        }
+        len => len as u64,
+    };
+    if len > MAX_CLIENT_PAYLOAD {
+        anyhow::bail!("client frame too large ({} bytes)", len);
+    }
+
+    let mut mask = [0u8; 4];
+    reader.read_exact(&mut mask)?;
+    let mut payload = vec![0u8; len as usize];
+    reader.read_exact(&mut payload)?;
+    for (i, byte) in payload.iter_mut().enumerate() {
+        *byte ^= mask[i % 4];
+    }
+
+    Ok(match opcode {
+        OP_CLOSE => ClientFrame::Close,
+        OP_PING => ClientFrame::Ping(payload),
+        _ => ClientFrame::Other,
+    })
+}
+
+fn accept_key(key: &str) -> String {
+    BASE64.encode(sha1(format!("{}{}", key, HANDSHAKE_GUID).as_bytes()))
+}
+
+fn sha1(data: &[u8]) -> [u8; 20] {
+    let mut h: [u32; 5] = [0x67452301, 0xEFCDAB89, 0x98BADCFE, 0x10325476, 0xC3D2E1F0];
+
+    let mut message = data.to_vec();
+    message.push(0x80);
+    while message.len() % 64 != 56 {
+        message.push(0);
+    }
+    message.extend_from_slice(&((data.len() as u64) * 8).to_be_bytes());
+
+    for chunk in message.chunks_exact(64) {
+        let mut w = [0u32; 80];
+        for (i, word) in chunk.chunks_exact(4).enumerate() {
+            w[i] = u32::from_be_bytes([word[0], word[1], word[2], word[3]]);
+        }
+        for i in 16..80 {
+            w[i] = (w[i - 3] ^ w[i - 8] ^ w[i - 14] ^ w[i - 16]).rotate_left(1);
+        }
+
+        let [mut a, mut b, mut c, mut d, mut e] = h;
+        for (i, &word) in w.iter().enumerate() {
+            let (f, k) = match i {
+                0..=19 => ((b & c) | (!b & d), 0x5A827999),
+                20..=39 => (b ^ c ^ d, 0x6ED9EBA1),
+                40..=59 => ((b & c) | (b & d) | (c & d), 0x8F1BBCDC),
+                _ => (b ^ c ^ d, 0xCA62C1D6),
+            };
+            let temp =
+                a.rotate_left(5).wrapping_add(f).wrapping_add(e).wrapping_add(k).wrapping_add(word);
+            e = d;
+            d = c;
+            c = b.rotate_left(30);
+            b = a;
+            a = temp;
+        }
+        for (state, value) in h.iter_mut().zip([a, b, c, d, e]) {
+            *state = state.wrapping_add(value);
+        }
+    }
+
+    let mut digest = [0u8; 20];
+    for (out, word) in digest.chunks_exact_mut(4).zip(h) {
+        out.copy_from_slice(&word.to_be_bytes());
+    }
+    digest
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_accept_key_matches_rfc_example() {
+        // RFC 6455 section 1.3
+        assert_eq!(accept_key("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=");
+    }
+
+    #[test]
+    fn test_sha1() {
+        let digest = sha1(b"abc");
+        assert_eq!(digest[..4], [0xA9, 0x99, 0x3E, 0x36]);
+    }
+
+    #[test]
+    fn test_upgrade_key_requires_websocket_headers() {
+        let mut request = Request {
+            method: "GET".to_string(),
+            path: "/api/sessions/1/events".to_string(),
+            query: String::new(),
+            headers: vec![
+                ("Upgrade".to_string(), "websocket".to_string()),
+                ("Connection".to_string(), "keep-alive, Upgrade".to_string()),
+                ("Sec-WebSocket-Version".to_string(), "13".to_string()),
+                ("Sec-WebSocket-Key".to_string(), "abc".to_string()),
+            ],
+            body: vec![],
+        };
+        assert_eq!(upgrade_key(&request), Some("abc"));
+
+        request.headers.remove(0);
+        assert_eq!(upgrade_key(&request), None);
+    }
+
+    #[test]
+    fn test_frame_lengths() {
+        let mut out = Vec::new();
+        write_text(&mut out, "hi").unwrap();
+        assert_eq!(out, [0x81, 2, b'h', b'i']);
+
+        let mut out = Vec::new();
+        write_text(&mut out, &"x".repeat(300)).unwrap();
+        assert_eq!(out[..4], [0x81, 126, 0x01, 0x2C]);
+    }
+
+    #[test]
+    fn test_read_masked_client_frames() {
+        let mask = [1, 2, 3, 4];
+        let payload: Vec<u8> =
+            b"ping".iter().zip(mask.iter().cycle()).map(|(b, m)| b ^ m).collect();
+        let mut raw = vec![0x89, 0x80 | 4];
+        raw.extend_from_slice(&mask);
+        raw.extend_from_slice(&payload);
+        raw.extend_from_slice(&[0x88, 0x80, 0, 0, 0, 0]);
+
+        let mut reader = raw.as_slice();
+        assert_eq!(read_frame(&mut reader).unwrap(), ClientFrame::Ping(b"ping".to_vec()));
+        assert_eq!(read_frame(&mut reader).unwrap(), ClientFrame::Close);
+
+        // Servers must reject unmasked frames
+        assert!(read_frame(&mut [0x81u8, 0].as_slice()).is_err());
+    }
+}
@@ -0,0 +1,217 @@
+// Audit log of what changes remapping
+//
+// On a shared machine "who changed my mappings?" deserves an answer the
+// debug log, rotated away after a day, can't give. The commands that grab
+// devices or load profiles append one JSON object per line to
+//
+//   $XDG_STATE_HOME/blazeremap/audit.log
+//
+// for each of:
+//
+// - a profile loaded, at start or switched to
+// - a device grabbed, and released again
+// - a change asked for over the control socket, with the uid and pid of the
+//   process asking, or over the API, with the client's address, and its uid
+//   and pid when it runs on this machine (as far as Linux lets us tell)
+//
+// The file is created 0600 and only ever appended to: it isn't rotated or
+// truncated, and each line goes out in one write. `blazeremap logs --audit`
+// shows it. Entries carry the time and the daemon's session id.
+
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::SystemTime;
+
+use anyhow::{Context, Result};
+use serde::Serialize;
+
+/// Something that changed how input is remapped
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+#[serde(tag = "event", rename_all = "snake_case")]
+pub enum AuditEvent {
+    /// A profile loaded from `file`, or given some other way
+    ProfileLoaded {
+        profile: String,
+        #[serde(skip_serializing_if = "Option::is_none")]
+        file: Option<PathBuf>,
+    },
+    /// Switched to by a hotkey
+    ProfileSwitched {
+        profile: String,
+    },
+    Grabbed {
+        device: String,
+    },
+    Released {
+        device: String,
+    },
+    /// A change another process asked for
+    Requested {
+        command: String,
+        #[serde(skip_serializing_if = "Option::is_none")]
+        uid: Option<u32>,
+        #[serde(skip_serializing_if = "Option::is_none")]
+        pid: Option<i32>,
+        /// Of an API client
+        #[serde(skip_serializing_if = "Option::is_none")]
+        address: Option<String>,
+    },
+}
+
+impl AuditEvent {
+    /// `command`, asked for over the control socket by `peer`
+    pub fn requested(command: &str, peer: Option<crate::ipc::Peer>) -> Self {
+        Self::Requested {
+            command: command.to_string(),
+            uid: peer.map(|peer| peer.uid),
+            pid: peer.map(|peer| peer.pid),
+            address: None,
+        }
+    }
+}
+
+/// The audit log file
+pub fn audit_path() -> Result<PathBuf> {
+    Ok(crate::logging::state_dir()?.join("audit.log"))
+}
+
+/// An audit log open for appending
+pub struct AuditLog {
+    file: File,
+}
+
+impl AuditLog {
+    /// Append to the log at `path`, making it and its directory if needed
+    pub fn open(path: &Path) -> Result<Self> {
+        if let Some(dir) = path.parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("Failed to create {}", dir.display()))?;
+        }
+        let mut options = OpenOptions::new();
+        options.create(true).append(true);
+        #[cfg(unix)]
+        std::os::unix::fs::OpenOptionsExt::mode(&mut options, 0o600);
+        let file =
+            options.open(path).with_context(|| format!("Failed to open {}", path.display()))?;
+        Ok(Self { file })
+    }
+
+    /// Append `event`, as of `time`
+    pub fn write(&mut self, event: &AuditEvent, time: SystemTime) -> Result<()> {
+        let mut line = serde_json::json!({ "time": crate::logging::utc_time(time) });
+        if let Some(id) = crate::logging::session_id() {
+            line["session_id"] = id.into();
+        }
+        if let serde_json::Value::Object(fields) = serde_json::to_value(event)? {
+            line.as_object_mut().unwrap().extend(fields);
+        }
+        // One write, so lines from several processes don't interleave
+        self.file.write_all(format!("{}\n", line).as_bytes())?;
+        Ok(())
+    }
+}
+
+/// Where `record` writes; None until `init`
+static LOG: Mutex<Option<AuditLog>> = Mutex::new(None);
+
+/// Start recording to the user's audit log
+///
+/// A log that can't be opened is reported and done without.
+pub fn init() {
+    match audit_path().and_then(|path| AuditLog::open(&path)) {
+        Ok(log) => *LOG.lock().unwrap_or_else(|e| e.into_inner()) = Some(log),
+        Err(e) => eprintln!("Warning: not keeping an audit log: {:#}", e),
+    }
+}
+
+/// Append `event` to the audit log, if `init` opened one
+pub fn record(event: AuditEvent) {
+    let mut log = LOG.lock().unwrap_or_else(|e| e.into_inner());
+    if let Some(log) = log.as_mut()
+        && let Err(e) = log.write(&event, SystemTime::now())
+    {
+        tracing::warn!("Failed to write to the audit log: {:#}", e);
+    }
+}
+
+/// An audit entry as a person reads it: time, event and the other fields;
+/// lines that aren't JSON as they are
+pub fn format_line(line: &str) -> String {
+    let Ok(serde_json::Value::Object(mut fields)) = serde_json::from_str(line) else {
+        return line.to_string();
+    };
+    let mut take = |name: &str| match fields.remove(name) {
+        Some(serde_json::Value::String(text)) => text,
+        Some(other) => other.to_string(),
+        None => String::new(),
+    };
+    let mut text = format!("{} {}", take("time"), take("event"));
+    for (name, value) in fields {
+        match value {
+            serde_json::Value::String(value) => text.push_str(&format!(" {}={}", name, value)),
+            other => text.push_str(&format!(" {}={}", name, other)),
+        }
+    }
+    text
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::{Duration, UNIX_EPOCH};
+
+    #[test]
+    fn test_entries_are_appended() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-audit-{}", std::process::id()));
+        let path = dir.join("audit.log");
+        let time = UNIX_EPOCH + Duration::from_secs(86_400);
+
+        let mut log = AuditLog::open(&path).unwrap();
+        log.write(&AuditEvent::Grabbed { device: "/dev/input/event3".to_string() }, time).unwrap();
+        drop(log);
+        let request = AuditEvent::Requested {
+            command: "players swap 1 2".to_string(),
+            uid: Some(1000),
+            pid: Some(4242),
+            address: None,
+        };
+        AuditLog::open(&path).unwrap().write(&request, time).unwrap();
+
+        let text = std::fs::read_to_string(&path).unwrap();
+        let mut lines: Vec<serde_json::Value> =
+            text.lines().map(|line| serde_json::from_str(line).unwrap()).collect();
+        // Set when another test started logging as a daemon
+        lines[0].as_object_mut().unwrap().remove("session_id");
+        assert_eq!(
+            lines[0],
+            serde_json::json!({
+                "time": "1970-01-02T00:00:00.000Z",
+                "event": "grabbed",
+                "device": "/dev/input/event3",
+            })
+        );
+        assert_eq!(lines[1]["event"], "requested");
+        assert_eq!(lines[1]["uid"], 1000);
+        assert_eq!(lines[1]["pid"], 4242);
+        assert!(lines[1].get("address").is_none());
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+            assert_eq!(mode & 0o777, 0o600);
+        }
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_format_line() {
+        let line = r#"{"time":"2026-10-16T08:30:00.250Z","event":"requested","command":"recenter","uid":1000}"#;
+        assert_eq!(
+            format_line(line),
+            "2026-10-16T08:30:00.250Z requested command=recenter uid=1000"
+        );
+        assert_eq!(format_line("not json"), "not json");
+    }
+}
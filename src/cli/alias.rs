@@ -0,0 +1,175 @@
+// Alias command - name controllers whatever event node they get
+use crate::{
+    input::{
+        InputManager,
+        alias::{AliasStore, DeviceIdentity},
+    },
+    platform,
+};
+use anyhow::{Context, Result, bail};
+use clap::{Arg, ArgMatches, Command};
+use std::io::Write;
+
+pub fn command() -> Command {
+    Command::new("alias")
+        .about("Name controllers, to select them by name instead of event node")
+        .long_about(
+            "Name controllers, to select them by name instead of event node.\n\n\
+             Event nodes are numbered in the order devices are found, which changes across \
+             reboots. An alias names a controller by its vendor and product IDs and its unique \
+             ID (usually the Bluetooth address), or the port it's plugged into when it has none. \
+             '--device NAME' then works wherever a device path does. Aliases are kept in \
+             ~/.config/blazeremap/devices.toml.",
+        )
+        .subcommand(
+            Command::new("list")
+                .visible_alias("ls")
+                .about("List aliases and where their controllers are"),
+        )
+        .subcommand(
+            Command::new("set")
+                .about("Name a connected controller")
+                .arg(
+                    Arg::new("name")
+                        .value_name("NAME")
+                        .required(true)
+                        .help("Alias, e.g. living-room-pad: letters, digits, '-' and '_'"),
+                )
+                .arg(Arg::new("device").value_name("INDEX|PATH").help(
+                    "Controller: an index from 'detect' or a device path (asked for if \
+                     several are connected)",
+                )),
+        )
+        .subcommand(
+            Command::new("remove")
+                .visible_alias("rm")
+                .about("Forget an alias")
+                .arg(Arg::new("name").value_name("NAME").required(true)),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let manager = platform::new_input_manager()?;
+    run_internal(&mut std::io::stdout(), manager.as_ref(), &AliasStore::user()?, matches)
+}
+
+fn run_internal<W: Write>(
+    writer: &mut W,
+    manager: &dyn InputManager,
+    store: &AliasStore,
+    matches: &ArgMatches,
+) -> Result<()> {
+    match matches.subcommand() {
+        Some(("set", sub_matches)) => {
+            let name = sub_matches.get_one::<String>("name").unwrap();
+            let path = super::device_path(manager, sub_matches.get_one::<String>("device"))?;
+            let info = manager
+                .list_gamepads()?
+                .gamepad_info
+                .into_iter()
+                .find(|info| info.path == path)
+                .with_context(|| format!("No controller at {}; see 'blazeremap detect'", path))?;
+            let identity = DeviceIdentity::of(&info);
+            store.set(name, &identity)?;
+            writeln!(writer, "{} is now {} ({})", name, info.name, identity)?;
+            if identity.uniq.is_none() && identity.phys.is_none() {
+                writeln!(
+                    writer,
+                    "It reports no unique ID or port, so the alias picks the first {:04x}:{:04x} \
+                     controller connected.",
+                    identity.vendor_id, identity.product_id
+                )?;
+            }
+        }
+        Some(("remove", sub_matches)) => {
+            let name = sub_matches.get_one::<String>("name").unwrap();
+            if !store.remove(name)? {
+                bail!("No alias '{}'", name);
+            }
+            writeln!(writer, "Removed {}", name)?;
+        }
+        _ => {
+            let aliases = store.load()?;
+            if aliases.is_empty() {
+                writeln!(writer, "No aliases; add one with 'blazeremap alias set NAME'")?;
+                return Ok(());
+            }
+            let gamepads = manager.list_gamepads()?.gamepad_info;
+            for (name, identity) in &aliases {
+                let place = identity.find(&gamepads).map_or("not connected", |info| &info.path);
+                writeln!(writer, "{:<20} {:<40} {}", name, identity.to_string(), place)?;
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::alias;
+    use crate::input::manager::MockInputManager;
+    use crate::input::{GamepadInfo, GamepadType, InputDetectionResult};
+
+    fn manager() -> MockInputManager {
+        let mut manager = MockInputManager::new();
+        manager.expect_list_gamepads().returning(|| {
+            Ok(InputDetectionResult {
+                gamepad_info: vec![GamepadInfo {
+                    path: "/dev/input/event7".to_string(),
+                    name: "Wireless Controller".to_string(),
+                    gamepad_type: GamepadType::DualShock4,
+                    vendor_id: 0x054c,
+                    vendor_name: "Sony".to_string(),
+                    product_id: 0x09cc,
+                    uniq: Some("a0:5a:5c:00:11:22".to_string()),
+                    phys: Some("usb-0000:00:14.0-2/input0".to_string()),
+                    capabilities: vec![],
+                }],
+                errors: vec![],
+            })
+        });
+        manager
+    }
+
+    fn run(store: &AliasStore, args: &[&str]) -> Result<String> {
+        let matches = command().try_get_matches_from([&["alias"], args].concat())?;
+        let mut output = Vec::new();
+        run_internal(&mut output, &manager(), store, &matches)?;
+        Ok(String::from_utf8(output).unwrap())
+    }
+
+    #[test]
+    fn test_set_list_resolve_remove() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-cli-alias-{}", std::process::id()));
+        let store = AliasStore::new(dir.join("devices.toml"));
+
+        assert!(run(&store, &[]).unwrap().starts_with("No aliases"));
+        assert_eq!(
+            run(&store, &["set", "living-room-pad", "0"]).unwrap(),
+            "living-room-pad is now Wireless Controller (054c:09cc (a0:5a:5c:00:11:22))\n"
+        );
+        assert!(run(&store, &["list"]).unwrap().ends_with(" /dev/input/event7\n"));
+
+        let aliases = store.load().unwrap();
+        let resolve = |selection| alias::resolve(&manager(), selection, &aliases);
+        assert_eq!(resolve("living-room-pad").unwrap(), "/dev/input/event7");
+        assert_eq!(resolve("0").unwrap(), "/dev/input/event7");
+        assert_eq!(resolve("/dev/input/event3").unwrap(), "/dev/input/event3");
+
+        let mut moved = aliases.clone();
+        moved.get_mut("living-room-pad").unwrap().uniq = Some("00:00:00:00:00:01".to_string());
+        let err = alias::resolve(&manager(), "living-room-pad", &moved).unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Controller 'living-room-pad' (054c:09cc (00:00:00:00:00:01)) is not connected"
+        );
+
+        assert_eq!(
+            run(&store, &["remove", "living-room-pad"]).unwrap(),
+            "Removed living-room-pad\n"
+        );
+        assert!(run(&store, &["remove", "living-room-pad"]).is_err());
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
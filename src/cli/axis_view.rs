@@ -0,0 +1,159 @@
+// Live picture of a controller's sticks and triggers in the terminal
+//
+// Each stick is a box with a crosshair through where it points, each trigger
+// a bar. The picture is redrawn in place with ANSI escapes, at most
+// `FRAME_INTERVAL` apart however fast the controller reports.
+
+use crate::event::{AxisCode, InputEvent};
+use crate::input::range::AxisRange;
+use std::io::{self, Write};
+use std::time::{Duration, Instant};
+
+/// Stick boxes are this many characters wide and lines high inside
+const STICK_WIDTH: usize = 21;
+const STICK_HEIGHT: usize = 11;
+/// Trigger bars are this many characters long
+const BAR_WIDTH: usize = 30;
+
+/// About 30 redraws a second
+const FRAME_INTERVAL: Duration = Duration::from_millis(33);
+
+pub(crate) struct AxisView {
+    axes: [i32; AxisCode::ALL.len()],
+    // Lines the last drawing took, to move back over them
+    drawn_lines: usize,
+    last_drawn: Option<Instant>,
+    changed: bool,
+}
+
+impl AxisView {
+    pub fn new() -> Self {
+        Self { axes: [0; AxisCode::ALL.len()], drawn_lines: 0, last_drawn: None, changed: true }
+    }
+
+    /// Follow `event`
+    pub fn update(&mut self, event: &InputEvent) {
+        if let InputEvent::Axis { code, value, .. } = *event
+            && self.axes[code.index()] != value
+        {
+            self.axes[code.index()] = value;
+            self.changed = true;
+        }
+    }
+
+    /// Draw over the last picture if anything changed and a frame is due
+    pub fn refresh<W: Write>(&mut self, writer: &mut W) -> io::Result<()> {
+        let due = self.last_drawn.is_none_or(|last| last.elapsed() >= FRAME_INTERVAL);
+        if self.changed && due {
+            self.draw(writer)?;
+        }
+        Ok(())
+    }
+
+    /// Draw over the last picture now
+    pub fn draw<W: Write>(&mut self, writer: &mut W) -> io::Result<()> {
+        let picture = self.render();
+        if self.drawn_lines > 0 {
+            // Up to the first line of the last picture
+            write!(writer, "\x1b[{}A", self.drawn_lines)?;
+        }
+        for line in &picture {
+            // Clear what's left of the old line
+            writeln!(writer, "{}\x1b[K", line)?;
+        }
+        writer.flush()?;
+        self.drawn_lines = picture.len();
+        self.last_drawn = Some(Instant::now());
+        self.changed = false;
+        Ok(())
+    }
+
+    /// The picture, line by line
+    fn render(&self) -> Vec<String> {
+        let axis = |code: AxisCode| self.axes[code.index()];
+        let left = stick("Left stick", axis(AxisCode::LeftX), axis(AxisCode::LeftY));
+        let right = stick("Right stick", axis(AxisCode::RightX), axis(AxisCode::RightY));
+        let mut lines: Vec<String> =
+            left.iter().zip(&right).map(|(left, right)| format!("{}   {}", left, right)).collect();
+        lines.push(bar("LT", axis(AxisCode::LeftTrigger)));
+        lines.push(bar("RT", axis(AxisCode::RightTrigger)));
+        lines
+    }
+}
+
+/// Where `value` falls among `cells` cells across `range`
+fn cell(value: i32, range: AxisRange, cells: usize) -> usize {
+    let to = AxisRange::new(0, cells as i32 - 1);
+    range.rescale(value, to).clamp(0, cells as i32 - 1) as usize
+}
+
+/// A stick's box, with its name above and its values below
+fn stick(name: &str, x: i32, y: i32) -> Vec<String> {
+    let (column, row) =
+        (cell(x, AxisRange::STICK, STICK_WIDTH), cell(y, AxisRange::STICK, STICK_HEIGHT));
+    let (middle_column, middle_row) = (STICK_WIDTH / 2, STICK_HEIGHT / 2);
+    let mut lines = Vec::with_capacity(STICK_HEIGHT + 4);
+    lines.push(format!(" {:<width$}", name, width = STICK_WIDTH + 1));
+    lines.push(format!("┌{}┐", "─".repeat(STICK_WIDTH)));
+    for r in 0..STICK_HEIGHT {
+        let inside: String = (0..STICK_WIDTH)
+            .map(|c| match (r == row, c == column) {
+                (true, true) => '●',
+                (true, false) => '─',
+                (false, true) => '│',
+                _ if (r, c) == (middle_row, middle_column) => '+',
+                _ => ' ',
+            })
+            .collect();
+        lines.push(format!("│{}│", inside));
+    }
+    lines.push(format!("└{}┘", "─".repeat(STICK_WIDTH)));
+    lines.push(format!(" x {:>7}  y {:>7}  ", x, y));
+    lines
+}
+
+/// A trigger's bar, filled as far as it's pulled
+fn bar(name: &str, value: i32) -> String {
+    let filled = AxisRange::TRIGGER.rescale(value, AxisRange::new(0, BAR_WIDTH as i32)) as usize;
+    format!("{} [{}{}] {:>5}", name, "█".repeat(filled), "·".repeat(BAR_WIDTH - filled), value)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_render() {
+        let mut view = AxisView::new();
+        view.update(&InputEvent::axis_move(AxisCode::LeftX, 32767));
+        view.update(&InputEvent::axis_move(AxisCode::LeftY, -32768));
+        view.update(&InputEvent::axis_move(AxisCode::RightTrigger, 512));
+        let lines = view.render();
+
+        assert_eq!(lines.len(), STICK_HEIGHT + 6);
+        // Left stick pushed up and right: the marker is in the top right corner
+        assert!(lines[2].starts_with("│────────────────────●│   │          │"), "{}", lines[2]);
+        // Right stick centered
+        assert!(lines[7].ends_with("│──────────●──────────│"), "{}", lines[7]);
+        assert_eq!(lines[14], " x   32767  y  -32768      x       0  y       0  ");
+        assert_eq!(lines[16], format!("RT [{}{}]   512", "█".repeat(15), "·".repeat(15)));
+    }
+
+    #[test]
+    fn test_draw_in_place() {
+        let mut view = AxisView::new();
+        let mut output = Vec::new();
+        view.draw(&mut output).unwrap();
+        assert!(!String::from_utf8_lossy(&output).contains("\x1b[17A"));
+
+        output.clear();
+        view.update(&InputEvent::axis_move(AxisCode::LeftX, 100));
+        view.draw(&mut output).unwrap();
+        assert!(String::from_utf8_lossy(&output).starts_with("\x1b[17A"));
+        // Nothing changed since
+        output.clear();
+        view.last_drawn = None;
+        view.refresh(&mut output).unwrap();
+        assert!(output.is_empty());
+    }
+}
@@ -0,0 +1,384 @@
+// Calibration command - view and edit a controller's stored calibration
+use super::axis_view::AxisView;
+use crate::{
+    event::{AxisCode, InputEvent},
+    input::{
+        GamepadInfo, InputManager,
+        calibration::{AxisCalibration, CalibrationStore, DeviceKey, IdleNoise, Suggestion},
+        gamepad::Gamepad,
+    },
+    platform,
+};
+use anyhow::{Context, Result, bail};
+use clap::{Arg, ArgAction, ArgMatches, Command, value_parser};
+use std::io::{IsTerminal, Write};
+use std::time::Duration;
+
+pub fn command() -> Command {
+    let device =
+        Arg::new("device").long("device").value_name("ALIAS|INDEX|PATH").global(true).help(
+            "Controller: an alias, an index from 'detect' or a device path (asked for if several \
+             are connected)",
+        );
+    Command::new("calibration")
+        .about("Show or change the calibration stored for a controller")
+        .long_about(
+            "Show or change the calibration stored for a controller.\n\n\
+             A calibration corrects a controller's sticks: the value each axis rests at is \
+             reported as centered, and an optional deadzone around it too. It's stored per \
+             controller in ~/.config/blazeremap/calibration and applied whenever that \
+             controller is read, with any profile.",
+        )
+        .subcommand_required(true)
+        .arg_required_else_help(true)
+        .arg(device)
+        .subcommand(Command::new("show").about("Print the controller's calibration"))
+        .subcommand(
+            Command::new("set")
+                .about("Calibrate one axis")
+                .arg(
+                    Arg::new("axis")
+                        .value_name("AXIS")
+                        .required(true)
+                        .value_parser(parse_axis)
+                        .help("Axis to calibrate, e.g. LeftX or RightY"),
+                )
+                .arg(
+                    Arg::new("center")
+                        .long("center")
+                        .value_name("VALUE")
+                        .required(true)
+                        .allow_negative_numbers(true)
+                        .value_parser(value_parser!(i32))
+                        .help("Value the axis rests at, as 'blazeremap read' shows it"),
+                )
+                .arg(
+                    Arg::new("deadzone")
+                        .long("deadzone")
+                        .value_name("VALUE")
+                        .default_value("0")
+                        .value_parser(value_parser!(i32).range(0..))
+                        .help("Distance from the center still reported as centered"),
+                ),
+        )
+        .subcommand(
+            Command::new("wizard")
+                .about("Measure the controller at rest and suggest a calibration")
+                .long_about(
+                    "Measure the controller at rest and suggest a calibration.\n\n\
+                     Leave the controller on a table, sticks untouched. Each stick axis is \
+                     sampled for a few seconds: its average becomes the center, and the deadzone \
+                     is made half again as wide as the furthest it wandered.",
+                )
+                .arg(
+                    Arg::new("seconds")
+                        .long("seconds")
+                        .value_name("SECONDS")
+                        .default_value("5")
+                        .value_parser(value_parser!(u64).range(1..=60))
+                        .help("How long to measure"),
+                )
+                .arg(
+                    Arg::new("apply")
+                        .long("apply")
+                        .action(ArgAction::SetTrue)
+                        .help("Store the suggested calibration"),
+                ),
+        )
+        .subcommand(
+            Command::new("kernel")
+                .about("Write the calibration into the kernel, for programs reading the controller")
+                .long_about(
+                    "Write the calibration into the kernel, for programs reading the controller.\n\n\
+                     Games and other programs reading the controller themselves see the corrected \
+                     center and deadzone too, through the axis ranges and flat the kernel reports. \
+                     The kernel keeps them until the controller is unplugged.",
+                ),
+        )
+        .subcommand(
+            Command::new("reset").about("Forget the calibration of one axis or all").arg(
+                Arg::new("axis")
+                    .value_name("AXIS")
+                    .value_parser(parse_axis)
+                    .help("Axis to forget (all if not specified)"),
+            ),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let manager = platform::new_input_manager()?;
+    run_internal(&mut std::io::stdout(), manager.as_ref(), &CalibrationStore::user()?, matches)
+}
+
+/// Names as profiles and calibration files spell them
+fn parse_axis(name: &str) -> std::result::Result<AxisCode, String> {
+    AxisCode::ALL
+        .into_iter()
+        .filter(|code| *code != AxisCode::Unknown)
+        .find(|code| format!("{:?}", code) == name)
+        .ok_or_else(|| format!("unknown axis '{}'", name))
+}
+
+fn run_internal<W: Write>(
+    writer: &mut W,
+    manager: &dyn InputManager,
+    store: &CalibrationStore,
+    matches: &ArgMatches,
+) -> Result<()> {
+    let (command, sub_matches) = matches.subcommand().unwrap();
+    let info = select_device(manager, sub_matches.get_one::<String>("device"))?;
+    let key = DeviceKey::of(&info);
+    let mut calibration = store.load(&key)?.unwrap_or_default();
+
+    match command {
+        "show" => {
+            if calibration.is_empty() {
+                writeln!(writer, "{} ({}) isn't calibrated", info.name, key)?;
+                return Ok(());
+            }
+            writeln!(writer, "{} ({}), from {}:", info.name, key, store.path(&key).display())?;
+            for axis in &calibration.axes {
+                writeln!(
+                    writer,
+                    "  {}: center {}, deadzone {}",
+                    axis.axis, axis.center, axis.deadzone
+                )?;
+            }
+            if !calibration.device_ranges.is_empty() {
+                let ranges: Vec<_> = calibration
+                    .device_ranges
+                    .iter()
+                    .map(|range| format!("{} {}..{}", range.axis, range.min, range.max))
+                    .collect();
+                writeln!(
+                    writer,
+                    "  Written into the kernel; the driver's own ranges: {}",
+                    ranges.join(", ")
+                )?;
+            }
+            return Ok(());
+        }
+        "set" => {
+            let axis = AxisCalibration {
+                axis: *sub_matches.get_one::<AxisCode>("axis").unwrap(),
+                center: *sub_matches.get_one::<i32>("center").unwrap(),
+                deadzone: *sub_matches.get_one::<i32>("deadzone").unwrap(),
+            };
+            calibration.set(axis);
+        }
+        "wizard" => {
+            let seconds = *sub_matches.get_one::<u64>("seconds").unwrap();
+            writeln!(
+                writer,
+                "Leave {} at rest with the sticks untouched; measuring for {} seconds...",
+                info.name, seconds
+            )?;
+            let gamepad = manager.open_gamepad_raw(&info.path)?;
+            // Show the sticks as they're measured, when someone's watching
+            let live = std::io::stdout().is_terminal();
+            let mut view = AxisView::new();
+            let noise = measure(gamepad, Duration::from_secs(seconds), |event| {
+                if live {
+                    view.update(event);
+                    view.refresh(writer)?;
+                }
+                Ok(())
+            })?;
+            if live {
+                view.draw(writer)?;
+            }
+            let suggestions = noise.suggestions();
+            write_summary(writer, &suggestions)?;
+            if suggestions.is_empty() {
+                return Ok(());
+            }
+            if !sub_matches.get_flag("apply") {
+                writeln!(writer, "Run again with --apply to store this calibration")?;
+                return Ok(());
+            }
+            for suggestion in &suggestions {
+                calibration.set(suggestion.calibration);
+            }
+        }
+        "kernel" => {
+            if calibration.axes.is_empty() {
+                bail!("{} ({}) isn't calibrated; there's nothing to write", info.name, key);
+            }
+            for range in platform::write_calibration_to_kernel(&info, &calibration)? {
+                calibration.set_device_range(range);
+            }
+            writeln!(writer, "Wrote the calibration of {} into the kernel", info.name)?;
+        }
+        "reset" => match sub_matches.get_one::<AxisCode>("axis") {
+            Some(code) => {
+                if !calibration.remove(*code) {
+                    bail!("{} of {} isn't calibrated", code, key);
+                }
+            }
+            None => calibration.axes.clear(),
+        },
+        _ => unreachable!("Subcommand required"),
+    }
+
+    let path = store.save(&key, &calibration)?;
+    match calibration.axes.is_empty() {
+        true => writeln!(writer, "{} ({}) is no longer calibrated", info.name, key)?,
+        false => writeln!(writer, "Saved calibration of {} to {}", info.name, path.display())?,
+    }
+    if command == "reset" && !calibration.device_ranges.is_empty() {
+        writeln!(
+            writer,
+            "The kernel keeps what was written into it until the controller is unplugged"
+        )?;
+    }
+    Ok(())
+}
+
+/// Sample the axes of `gamepad` for `duration`, showing each event to
+/// `on_event` too
+fn measure<F>(gamepad: Box<dyn Gamepad>, duration: Duration, mut on_event: F) -> Result<IdleNoise>
+where
+    F: FnMut(&InputEvent) -> Result<()>,
+{
+    let mut noise = IdleNoise::default();
+    super::read_for(gamepad, duration, |event| {
+        noise.sample(event);
+        on_event(event)
+    })?;
+    Ok(noise)
+}
+
+/// The wizard's summary of what it measured and suggests
+fn write_summary<W: Write>(writer: &mut W, suggestions: &[Suggestion]) -> Result<()> {
+    if suggestions.is_empty() {
+        writeln!(writer, "No stick moved at all; there's nothing to correct")?;
+        return Ok(());
+    }
+    writeln!(
+        writer,
+        "\n{:<10} {:>8} {:>8} {:>8} {:>9}",
+        "Axis", "Samples", "Center", "Noise", "Deadzone"
+    )?;
+    for suggestion in suggestions {
+        let axis = suggestion.calibration;
+        writeln!(
+            writer,
+            "{:<10} {:>8} {:>8} {:>8} {:>9}",
+            axis.axis.to_string(),
+            suggestion.samples,
+            axis.center,
+            format!("±{}", suggestion.noise),
+            axis.deadzone
+        )?;
+    }
+    writeln!(writer)?;
+    Ok(())
+}
+
+/// The controller `--device` picks, as `super::device_path` reads it
+fn select_device(manager: &dyn InputManager, selection: Option<&String>) -> Result<GamepadInfo> {
+    let path = super::device_path(manager, selection)?;
+    manager
+        .list_gamepads()?
+        .gamepad_info
+        .into_iter()
+        .find(|info| info.path == path)
+        .with_context(|| format!("No controller at {}; see 'blazeremap detect'", path))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::manager::MockInputManager;
+
+    fn manager() -> MockInputManager {
+        let mut manager = MockInputManager::new();
+        manager.expect_list_gamepads().returning(|| {
+            Ok(crate::input::InputDetectionResult {
+                gamepad_info: vec![GamepadInfo {
+                    path: "/dev/input/event3".to_string(),
+                    name: "Wireless Controller".to_string(),
+                    gamepad_type: crate::input::GamepadType::DualShock4,
+                    vendor_id: 0x054c,
+                    vendor_name: "Sony".to_string(),
+                    product_id: 0x09cc,
+                    uniq: Some("a0:5a:5c:00:11:22".to_string()),
+                    phys: None,
+                    capabilities: vec![],
+                }],
+                errors: vec![],
+            })
+        });
+        manager
+    }
+
+    fn run(store: &CalibrationStore, args: &[&str]) -> Result<String> {
+        let matches = command().try_get_matches_from([&["calibration"], args].concat())?;
+        let mut output = Vec::new();
+        run_internal(&mut output, &manager(), store, &matches)?;
+        Ok(String::from_utf8(output).unwrap())
+    }
+
+    #[test]
+    fn test_set_show_reset() {
+        let dir =
+            std::env::temp_dir().join(format!("blazeremap-cli-calibration-{}", std::process::id()));
+        let store = CalibrationStore::new(&dir);
+
+        assert_eq!(
+            run(&store, &["show"]).unwrap(),
+            "Wireless Controller (054c:09cc (a0:5a:5c:00:11:22)) isn't calibrated\n"
+        );
+        run(&store, &["set", "LeftX", "--center", "131", "--deadzone", "6"]).unwrap();
+        run(&store, &["set", "RightY", "--center", "-4", "--device", "0"]).unwrap();
+        let shown = run(&store, &["show", "--device", "/dev/input/event3"]).unwrap();
+        assert!(
+            shown.ends_with("  Left X: center 131, deadzone 6\n  Right Y: center -4, deadzone 0\n")
+        );
+
+        run(&store, &["reset", "LeftX"]).unwrap();
+        assert_eq!(
+            run(&store, &["reset", "LeftX"]).unwrap_err().to_string(),
+            "Left X of 054c:09cc (a0:5a:5c:00:11:22) isn't calibrated"
+        );
+        assert!(run(&store, &["reset"]).unwrap().ends_with("is no longer calibrated\n"));
+        assert!(!dir.join("054c-09cc-a0_5a_5c_00_11_22.toml").exists());
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_measure_and_summary() {
+        use crate::input::gamepad::MockGamepad;
+
+        let mut gamepad = MockGamepad::new();
+        gamepad
+            .expect_get_info()
+            .returning(|| manager().list_gamepads().unwrap().gamepad_info[0].clone());
+        let mut readings = [1000, 1300, 700].into_iter();
+        gamepad.expect_read_event().returning(move || {
+            std::thread::sleep(Duration::from_millis(1));
+            let value = readings.next().unwrap_or(1000);
+            Ok(Some(InputEvent::axis_move(AxisCode::LeftX, value)))
+        });
+
+        let suggestions = measure(Box::new(gamepad), Duration::from_millis(50), |_| Ok(()))
+            .unwrap()
+            .suggestions();
+        assert_eq!(suggestions.len(), 1);
+        assert_eq!(suggestions[0].noise, 300);
+        assert_eq!(suggestions[0].calibration.center, 1000);
+        let mut output = Vec::new();
+        write_summary(&mut output, &suggestions).unwrap();
+        let output = String::from_utf8(output).unwrap();
+        assert!(output.contains("\nLeft X    "), "{}", output);
+        assert!(output.contains("    1000     ±300       450\n"), "{}", output);
+    }
+
+    #[test]
+    fn test_rejects_unknown_axes_and_devices() {
+        let store = CalibrationStore::new(std::env::temp_dir().join("blazeremap-never-written"));
+        assert!(run(&store, &["set", "Unknown", "--center", "0"]).is_err());
+        assert!(run(&store, &["set", "LeftX", "--center", "0", "--deadzone", "-1"]).is_err());
+        assert!(run(&store, &["show", "--device", "/dev/input/event9"]).is_err());
+    }
+}
@@ -0,0 +1,278 @@
+// Desktop command - the controller as a mouse and keyboard
+use crate::{
+    Gamepad, InputManager,
+    event::EventLoop,
+    input::gamepad::{BufferedGamepad, buffered::DEFAULT_RING_CAPACITY},
+    mapping::{MappingEngine, profile::Profile},
+    output::{
+        desktop::{DesktopMode, DesktopSpeed, parse_chord},
+        identity::VirtualDeviceIdentity,
+        keyboard::VirtualKeyboard,
+        mouse::VirtualMouse,
+    },
+    platform,
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgMatches, Command, value_parser};
+use std::path::PathBuf;
+
+pub fn command() -> Command {
+    Command::new("desktop")
+        .about("Use the controller as a mouse and keyboard")
+        .long_about(
+            "Use the controller as a mouse and keyboard, e.g. on a couch PC or a handheld.\n\n\
+             The left stick moves the pointer and the right stick scrolls. Right Trigger \
+             clicks, Left Trigger right-clicks and pressing the right stick middle-clicks. The \
+             built-in desktop profile types the rest: South is Enter, East Escape, West \
+             Backspace, North the Super key, the D-pad the arrows and the shoulders Page Up \
+             and Page Down.\n\n\
+             Holding the chord (Select+Start) switches desktop mode off, leaving the \
+             controller to games, and back on.",
+        )
+        .arg(
+            Arg::new("device")
+                .short('d')
+                .long("device")
+                .value_name("ALIAS|INDEX|PATH")
+                .help("Controller to use (auto-detect if not specified)"),
+        )
+        .arg(
+            Arg::new("profile")
+                .short('p')
+                .long("profile")
+                .value_name("FILE")
+                .value_parser(value_parser!(PathBuf))
+                .help("Profile for the keys (the built-in desktop profile if not specified)"),
+        )
+        .arg(
+            Arg::new("chord")
+                .long("chord")
+                .value_name("BUTTONS")
+                .default_value("Select+Start")
+                .value_parser(parse_chord)
+                .help("Buttons held together to switch desktop mode off and on"),
+        )
+        .arg(
+            Arg::new("pointer-speed")
+                .long("pointer-speed")
+                .value_name("PIXELS")
+                .default_value("1200")
+                .value_parser(value_parser!(f32))
+                .help("Pixels a second the pointer moves with the stick all the way out"),
+        )
+        .arg(
+            Arg::new("scroll-speed")
+                .long("scroll-speed")
+                .value_name("NOTCHES")
+                .default_value("12")
+                .value_parser(value_parser!(f32))
+                .help("Wheel notches a second with the stick all the way out"),
+        )
+        .arg(
+            Arg::new("observe")
+                .long("observe")
+                .help("Open the controller read-only and never grab it")
+                .action(clap::ArgAction::SetTrue),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let manager = platform::new_input_manager()?;
+    platform::check_virtual_device_access()?;
+    run_internal(
+        matches,
+        manager.as_ref(),
+        platform::new_virtual_keyboard,
+        platform::new_virtual_mouse,
+    )
+}
+
+fn run_internal<K, M>(
+    matches: &ArgMatches,
+    manager: &dyn InputManager,
+    make_keyboard: K,
+    make_mouse: M,
+) -> Result<()>
+where
+    K: FnOnce(&VirtualDeviceIdentity) -> Result<Box<dyn VirtualKeyboard>>,
+    M: FnOnce(&VirtualDeviceIdentity) -> Result<Box<dyn VirtualMouse>>,
+{
+    let path = match matches.get_one::<String>("device") {
+        Some(selection) => super::resolve_device(manager, selection)?,
+        None => {
+            let gamepads = manager.list_gamepads()?;
+            let info = super::picker::pick(&gamepads.gamepad_info)?;
+            progress!("Using: {}", info.name);
+            info.path.clone()
+        }
+    };
+    let profile = match matches.get_one::<PathBuf>("profile") {
+        Some(path) => Profile::load_from_file(path)?,
+        None => Profile::desktop_profile(),
+    };
+    let engine = MappingEngine::load_from_profile(&profile)?;
+    let pointer = profile.settings.pointer.clone().unwrap_or_default();
+    if let Some(problem) = pointer.problem() {
+        anyhow::bail!("Invalid pointer settings: {}", problem);
+    }
+    let precision = pointer.precision_button().map(|button| (button, pointer.precision_speed));
+    let identities = &profile.settings.virtual_devices;
+    if let Some(problem) = identities.problem() {
+        anyhow::bail!("Invalid virtual device settings: {}", problem);
+    }
+
+    let _claim = platform::claim_devices(std::slice::from_ref(&path))?;
+    let controller = match matches.get_flag("observe") {
+        true => manager.open_gamepad_observed(&path),
+        false => manager.open_gamepad(&path),
+    }
+    .context("Failed to open controller")?;
+    // Read on its own thread, so the pointer keeps moving between reports
+    let controller = BufferedGamepad::spawn(controller, DEFAULT_RING_CAPACITY)
+        .context("Failed to start controller reader")?;
+    let keyboard = make_keyboard(&identities.keyboard("BlazeRemap Virtual Keyboard"))
+        .context("Failed to create virtual keyboard")?;
+    let mouse = make_mouse(&identities.mouse("BlazeRemap Virtual Mouse"))
+        .context("Failed to create virtual mouse")?;
+
+    let chord = matches.get_one::<Vec<_>>("chord").unwrap().clone();
+    let speed = DesktopSpeed {
+        pointer: *matches.get_one::<f32>("pointer-speed").unwrap(),
+        scroll: *matches.get_one::<f32>("scroll-speed").unwrap(),
+    };
+    let names: Vec<_> = chord.iter().map(ToString::to_string).collect();
+    let controller: Box<dyn Gamepad> = Box::new(
+        DesktopMode::new(Box::new(controller), mouse, speed, chord)
+            .with_pointer(pointer.curve, precision),
+    );
+
+    progress!("\nDesktop mode is on, typing with the {} profile.", profile.name);
+    if !names.is_empty() {
+        progress!("Hold {} to switch it off and on.", names.join("+"));
+    }
+    if let Some((button, _)) = precision {
+        progress!("Hold {} to slow the pointer down.", button);
+    }
+    progress!("Press Ctrl+C to exit.\n");
+    EventLoop::new(controller, engine, keyboard).run()?;
+
+    progress!("BlazeRemap stopped.");
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::OutputEvent;
+    use crate::event::{AxisCode, ButtonCode, InputEvent, KeyboardCode, KeyboardEventType};
+    use crate::input::gamepad::{GamepadInfo, GamepadType, MockGamepad};
+    use crate::input::manager::MockInputManager;
+    use crate::output::keyboard::MockVirtualKeyboard;
+    use crate::output::mouse::MouseEvent;
+    use std::sync::{Arc, Mutex};
+
+    /// Shares the frames it was sent with the test
+    struct FakeMouse(Arc<Mutex<Vec<Vec<MouseEvent>>>>);
+
+    impl VirtualMouse for FakeMouse {
+        fn emit_frame(&mut self, events: &[MouseEvent]) -> Result<()> {
+            self.0.lock().unwrap().push(events.to_vec());
+            Ok(())
+        }
+
+        fn dev_node(&mut self) -> Result<PathBuf> {
+            Ok(PathBuf::from("/dev/input/event98"))
+        }
+    }
+
+    fn test_info() -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/eventX".to_string(),
+            name: "Test Gamepad".to_string(),
+            gamepad_type: GamepadType::XboxOne,
+            vendor_id: 0,
+            vendor_name: "".to_string(),
+            product_id: 0,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
+    #[test]
+    fn test_desktop_types_keys_and_clicks() {
+        let mut manager = MockInputManager::new();
+        manager.expect_open_gamepad().with(mockall::predicate::eq("/dev/input/eventX")).returning(
+            |_| {
+                let mut events = vec![
+                    InputEvent::button_press(ButtonCode::South),
+                    InputEvent::axis_move(AxisCode::RightTrigger, 1023),
+                    InputEvent::sync(),
+                ]
+                .into_iter();
+                let mut gamepad = MockGamepad::new();
+                gamepad.expect_get_info().returning(test_info);
+                gamepad.expect_read_event().returning(move || Ok(events.next()));
+                Ok(Box::new(gamepad))
+            },
+        );
+
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard
+            .expect_emit_frame()
+            .withf(|events| {
+                events
+                    == [OutputEvent::Keyboard {
+                        code: KeyboardCode::Enter,
+                        event_type: KeyboardEventType::Press,
+                    }]
+            })
+            .times(1)
+            .returning(|_| Ok(()));
+        let frames = Arc::new(Mutex::new(Vec::new()));
+        let sent = Arc::clone(&frames);
+
+        let matches = command().get_matches_from(["desktop", "-d", "/dev/input/eventX"]);
+        run_internal(
+            &matches,
+            &manager,
+            |_| Ok(Box::new(keyboard)),
+            |_| Ok(Box::new(FakeMouse(sent))),
+        )
+        .unwrap();
+
+        let click =
+            MouseEvent::Button { button: crate::input::keymouse::MouseButton::Left, pressed: true };
+        assert_eq!(*frames.lock().unwrap(), [vec![click]]);
+    }
+
+    #[test]
+    fn test_observe_opens_read_only() {
+        let mut manager = MockInputManager::new();
+        manager.expect_open_gamepad().never();
+        manager.expect_open_gamepad_observed().times(1).returning(|_| {
+            let mut gamepad = MockGamepad::new();
+            gamepad.expect_get_info().returning(test_info);
+            gamepad.expect_read_event().returning(|| Ok(None));
+            Ok(Box::new(gamepad))
+        });
+        let frames = Arc::new(Mutex::new(Vec::new()));
+
+        let matches =
+            command().get_matches_from(["desktop", "-d", "/dev/input/eventX", "--observe"]);
+        run_internal(
+            &matches,
+            &manager,
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+            |_| Ok(Box::new(FakeMouse(frames))),
+        )
+        .unwrap();
+    }
+
+    #[test]
+    fn test_chord_option() {
+        let matches = command().get_matches_from(["desktop", "--chord", "Mode"]);
+        assert_eq!(matches.get_one::<Vec<ButtonCode>>("chord").unwrap(), &[ButtonCode::Mode]);
+        assert!(command().try_get_matches_from(["desktop", "--chord", "Select+Jump"]).is_err());
+    }
+}
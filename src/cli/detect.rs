@@ -1,61 +1,181 @@
 // Detect command - list connected gamepads
+use super::spinner::Spinner;
+use crate::input::manager::{ProbeOptions, ProbeStep};
+use crate::input::{GamepadType, filter::DeviceFilter};
 use crate::platform;
 use clap::{ArgMatches, Command};
 use std::io::Write;
+use std::sync::Arc;
+use std::time::Duration;
 
 pub fn command() -> Command {
-    Command::new("detect").about("Detect gamepads connected to your computer").arg(
-        clap::Arg::new("verbose")
-            .short('v')
-            .long("verbose")
-            .help("Show detailed information")
-            .action(clap::ArgAction::SetTrue),
-    )
+    Command::new("detect")
+        .visible_alias("ls")
+        .about("Detect gamepads connected to your computer")
+        .arg(
+            clap::Arg::new("verbose")
+                .short('v')
+                .long("verbose")
+                .help("Show detailed information")
+                .action(clap::ArgAction::SetTrue),
+        )
+        .arg(
+            clap::Arg::new("all")
+                .short('a')
+                .long("all")
+                .help("List keyboards and mice too, for 'blazeremap emulate'")
+                .action(clap::ArgAction::SetTrue),
+        )
+        .arg(
+            clap::Arg::new("vendor")
+                .long("vendor")
+                .value_name("VENDOR[:PRODUCT]")
+                .help("Only controllers with this vendor ID in hex, e.g. 054c or 054c:09cc"),
+        )
+        .arg(
+            clap::Arg::new("name")
+                .long("name")
+                .value_name("TEXT")
+                .help("Only controllers whose name contains TEXT, in any case"),
+        )
+        .arg(
+            clap::Arg::new("path")
+                .long("path")
+                .value_name("PATTERN")
+                .help("Only controllers at this device path; * matches anything"),
+        )
+        .arg(
+            clap::Arg::new("type")
+                .long("type")
+                .value_parser(GamepadType::ALL.map(GamepadType::id))
+                .help("Only controllers of this type"),
+        )
+        .arg(
+            clap::Arg::new("timeout")
+                .long("timeout")
+                .value_name("MS")
+                .default_value("2000")
+                .value_parser(clap::value_parser!(u64).range(1..=60000))
+                .help("Skip a device that hasn't opened within this long, reporting it"),
+        )
+}
+
+/// The `DeviceFilter` the filter flags make up
+fn device_filter(matches: &ArgMatches) -> anyhow::Result<DeviceFilter> {
+    let mut filter = DeviceFilter {
+        name: matches.get_one::<String>("name").cloned(),
+        path: matches.get_one::<String>("path").cloned(),
+        gamepad_type: matches.get_one::<String>("type").map(|id| id.parse()).transpose()?,
+        ..DeviceFilter::default()
+    };
+    if let Some(vendor) = matches.get_one::<String>("vendor") {
+        filter.set_vendor(vendor)?;
+    }
+    Ok(filter)
 }
 
 pub fn handle(matches: &ArgMatches) -> anyhow::Result<()> {
     let verbose = matches.get_flag("verbose");
+    let filter = device_filter(matches)?;
+
+    let timeout = Duration::from_millis(*matches.get_one::<u64>("timeout").unwrap());
+
+    progress!("Detecting gamepads...\n");
+
+    // Opening every node can take seconds, or forever for a stuck driver
+    let spinner = Spinner::start("Opening input devices...");
+    let message = spinner.messages();
+    let probe = ProbeOptions {
+        timeout: Some(timeout),
+        progress: Some(Arc::new(move |step: ProbeStep| {
+            message(format!("Opening {} ({}/{})", step.path.display(), step.number, step.total))
+        })),
+    };
+    let device_manager = platform::new_probing_input_manager(probe)?;
+    let result = device_manager.list_gamepads()?;
+    let devices = match matches.get_flag("all") {
+        true => Some(device_manager.list_devices()?),
+        false => None,
+    };
+    drop(spinner);
 
-    println!("Detecting gamepads...\n");
+    display_results(&result, verbose, &filter);
 
-    let device_manager = platform::new_input_manager();
-    let result = device_manager.list_gamepads()?;
+    if let Some(devices) = devices {
+        write_key_mouse_devices(&mut std::io::stdout(), &devices)?;
+    }
+
+    Ok(())
+}
 
-    display_results(&result, verbose);
+/// List the keyboards and mice among `devices`
+fn write_key_mouse_devices<W: Write>(
+    writer: &mut W,
+    devices: &[crate::input::InputDeviceInfo],
+) -> std::io::Result<()> {
+    use crate::input::DeviceKind;
 
+    let others: Vec<_> =
+        devices.iter().filter(|device| device.kind != DeviceKind::Gamepad).collect();
+    if others.is_empty() {
+        writeln!(writer, "No keyboards or mice found.")?;
+        return Ok(());
+    }
+    writeln!(writer, "Keyboards and mice:")?;
+    for device in others {
+        writeln!(writer, "  {:<9} {} ({})", device.kind.to_string(), device.name, device.path)?;
+    }
     Ok(())
 }
 
 /// Display detection results in a user-friendly format
-fn display_results(result: &crate::input::InputDetectionResult, verbose: bool) {
+fn display_results(
+    result: &crate::input::InputDetectionResult,
+    verbose: bool,
+    filter: &DeviceFilter,
+) {
     let mut output = std::io::stdout();
-    write_results(&mut output, result, verbose).unwrap();
+    write_results(&mut output, result, verbose, filter).unwrap();
 }
 
 /// Internal function that writes to any writer (testable!)
+///
+/// Controllers `filter` leaves out are skipped, and the rest keep their
+/// indices, which `--device` takes.
 fn write_results<W: Write>(
     writer: &mut W,
     result: &crate::input::InputDetectionResult,
     verbose: bool,
+    filter: &DeviceFilter,
 ) -> std::io::Result<()> {
     use crate::input::gamepad::capabilities_to_strings;
 
     if result.gamepad_info.is_empty() {
         writeln!(writer, "No gamepads found.")?;
-
         if !result.errors.is_empty() {
-            writeln!(writer, "\nErrors encountered:")?;
-            for error in &result.errors {
-                writeln!(writer, "  • {}", error)?;
-            }
+            writeln!(writer)?;
         }
+        return write_problems(writer, &result.errors);
+    }
 
-        return Ok(());
+    let shown: Vec<_> =
+        result.gamepad_info.iter().enumerate().filter(|(_, info)| filter.matches(info)).collect();
+    if shown.is_empty() {
+        writeln!(
+            writer,
+            "No gamepads match {} ({} connected).",
+            filter,
+            result.gamepad_info.len()
+        )?;
+        if !result.errors.is_empty() {
+            writeln!(writer)?;
+        }
+        return write_problems(writer, &result.errors);
     }
 
-    writeln!(writer, "Found {} gamepad(s):\n", result.gamepad_info.len())?;
+    writeln!(writer, "Found {} gamepad(s):\n", shown.len())?;
 
-    for (i, info) in result.gamepad_info.iter().enumerate() {
+    for &(i, info) in &shown {
         writeln!(writer, "[{}] {} ({})", i, info.name, info.path)?;
         writeln!(writer, " ├─ Type: {}", info.gamepad_type)?;
         writeln!(writer, " ├─ Vendor:")?;
@@ -77,16 +197,40 @@ fn write_results<W: Write>(
         writeln!(writer)?;
     }
 
+    write_problems(writer, &result.errors)?;
     if verbose {
+        if !result.errors.is_empty() {
+            writeln!(writer)?;
+        }
         writeln!(writer, "Verbose Information:")?;
-        for (i, info) in result.gamepad_info.iter().enumerate() {
+        for &(i, info) in &shown {
             writeln!(writer, "  [{}] Full path: {}", i, info.path)?;
+            writeln!(writer, "      Unique ID: {}", info.uniq.as_deref().unwrap_or("none"))?;
+            writeln!(writer, "      Port: {}", info.phys.as_deref().unwrap_or("unknown"))?;
         }
     }
 
     Ok(())
 }
 
+/// Devices detection found but couldn't use, and what to do about them
+fn write_problems<W: Write>(
+    writer: &mut W,
+    errors: &[crate::input::InputDeviceError],
+) -> std::io::Result<()> {
+    if errors.is_empty() {
+        return Ok(());
+    }
+    writeln!(writer, "Devices with problems:")?;
+    for error in errors {
+        writeln!(writer, "  ✗ {} ({}): {}", error.path, error.error_type, error.source)?;
+        if let Some(hint) = error.error_type.hint() {
+            writeln!(writer, "    └─ {}", hint)?;
+        }
+    }
+    Ok(())
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -101,6 +245,8 @@ mod tests {
             vendor_id: 0x054C,
             vendor_name: "Sony".to_string(),
             product_id: 0x09CC,
+            uniq: None,
+            phys: None,
             capabilities: vec![GamepadCapability::ForceFeedback],
         }
     }
@@ -110,7 +256,7 @@ mod tests {
         let result = InputDetectionResult { gamepad_info: vec![], errors: vec![] };
 
         let mut output = Vec::new();
-        write_results(&mut output, &result, false).unwrap();
+        write_results(&mut output, &result, false, &DeviceFilter::default()).unwrap();
 
         let text = String::from_utf8(output).unwrap();
         assert!(text.contains("No gamepads found"));
@@ -124,7 +270,7 @@ mod tests {
         };
 
         let mut output = Vec::new();
-        write_results(&mut output, &result, false).unwrap();
+        write_results(&mut output, &result, false, &DeviceFilter::default()).unwrap();
 
         let text = String::from_utf8(output).unwrap();
 
@@ -145,7 +291,7 @@ mod tests {
         };
 
         let mut output = Vec::new();
-        write_results(&mut output, &result, false).unwrap();
+        write_results(&mut output, &result, false, &DeviceFilter::default()).unwrap();
 
         let text = String::from_utf8(output).unwrap();
 
@@ -154,6 +300,34 @@ mod tests {
         assert!(text.contains("[1] Gamepad 2"));
     }
 
+    #[test]
+    fn test_filter_keeps_indices() {
+        let mut xbox = make_test_gamepad("Xbox Wireless Controller");
+        xbox.gamepad_type = GamepadType::XboxOne;
+        xbox.vendor_id = 0x045e;
+        let result = InputDetectionResult {
+            gamepad_info: vec![xbox, make_test_gamepad("Wireless Controller")],
+            errors: vec![],
+        };
+
+        let matches =
+            command().get_matches_from(["detect", "--vendor", "054c", "--type", "dualshock4"]);
+        let mut output = Vec::new();
+        write_results(&mut output, &result, false, &device_filter(&matches).unwrap()).unwrap();
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("Found 1 gamepad(s)"));
+        assert!(text.contains("[1] Wireless Controller"));
+        assert!(!text.contains("Xbox"));
+
+        let matches = command().get_matches_from(["detect", "--name", "joy-con"]);
+        let mut output = Vec::new();
+        write_results(&mut output, &result, false, &device_filter(&matches).unwrap()).unwrap();
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            "No gamepads match name=joy-con (2 connected).\n"
+        );
+    }
+
     #[test]
     fn test_verbose_mode() {
         let result = InputDetectionResult {
@@ -163,16 +337,83 @@ mod tests {
 
         // Test without verbose
         let mut output = Vec::new();
-        write_results(&mut output, &result, false).unwrap();
+        write_results(&mut output, &result, false, &DeviceFilter::default()).unwrap();
         let text = String::from_utf8(output).unwrap();
         assert!(!text.contains("Verbose Information"));
 
         // Test with verbose
         let mut output = Vec::new();
-        write_results(&mut output, &result, true).unwrap();
+        write_results(&mut output, &result, true, &DeviceFilter::default()).unwrap();
         let text = String::from_utf8(output).unwrap();
         assert!(text.contains("Verbose Information"));
         assert!(text.contains("Full path: /dev/input/event99"));
+        assert!(text.contains("Unique ID: none\n"));
+    }
+
+    #[test]
+    fn test_display_keyboards_and_mice() {
+        use crate::input::{DeviceKind, InputDeviceInfo};
+
+        let device = |kind, name: &str, path: &str| InputDeviceInfo {
+            path: path.to_string(),
+            name: name.to_string(),
+            kind,
+        };
+        let devices = [
+            device(DeviceKind::Gamepad, "Xbox Wireless Controller", "/dev/input/event3"),
+            device(DeviceKind::Keyboard, "AT Translated Set 2 keyboard", "/dev/input/event0"),
+            device(DeviceKind::Mouse, "Logitech USB Optical Mouse", "/dev/input/event5"),
+        ];
+
+        let mut output = Vec::new();
+        write_key_mouse_devices(&mut output, &devices).unwrap();
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("  Keyboard  AT Translated Set 2 keyboard (/dev/input/event0)\n"));
+        assert!(text.contains("  Mouse     Logitech USB Optical Mouse (/dev/input/event5)\n"));
+        assert!(!text.contains("Xbox"));
+
+        let mut output = Vec::new();
+        write_key_mouse_devices(&mut output, &devices[..1]).unwrap();
+        assert_eq!(String::from_utf8(output).unwrap(), "No keyboards or mice found.\n");
+    }
+
+    #[test]
+    fn test_display_devices_with_problems() {
+        use crate::input::{ErrorType, InputDeviceError};
+
+        let denied = |path: &str| {
+            let source = anyhow::anyhow!("Xbox Wireless Controller: Permission denied");
+            InputDeviceError::new(path.to_string(), ErrorType::Permission, source)
+        };
+        let result = InputDetectionResult {
+            gamepad_info: vec![make_test_gamepad("Test Gamepad")],
+            errors: vec![denied("/dev/input/event7")],
+        };
+        let mut output = Vec::new();
+        write_results(&mut output, &result, false, &DeviceFilter::default()).unwrap();
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("Found 1 gamepad(s)"));
+        assert!(text.ends_with(
+            "\nDevices with problems:\n  \
+             ✗ /dev/input/event7 (permission denied): Xbox Wireless Controller: Permission denied\n    \
+             └─ add your user to the 'input' group, or install a udev rule for your controller; \
+             'blazeremap doctor' checks access\n"
+        ));
+
+        let result = InputDetectionResult {
+            gamepad_info: vec![],
+            errors: vec![InputDeviceError::new(
+                "/dev/input/event9".to_string(),
+                ErrorType::Unknown,
+                anyhow::anyhow!("Pad: I/O error"),
+            )],
+        };
+        let mut output = Vec::new();
+        write_results(&mut output, &result, false, &DeviceFilter::default()).unwrap();
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            "No gamepads found.\n\nDevices with problems:\n  ✗ /dev/input/event9 (error): Pad: I/O error\n"
+        );
     }
 
     #[test]
@@ -181,7 +422,7 @@ mod tests {
             InputDetectionResult { gamepad_info: vec![make_test_gamepad("Test")], errors: vec![] };
 
         let mut output = Vec::new();
-        write_results(&mut output, &result, false).unwrap();
+        write_results(&mut output, &result, false, &DeviceFilter::default()).unwrap();
         let text = String::from_utf8(output).unwrap();
 
         // Check for tree characters
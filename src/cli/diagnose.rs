@@ -0,0 +1,321 @@
+// Diagnose command - measure how a controller behaves
+use crate::{
+    event::InputEvent,
+    input::{
+        InputManager,
+        bounce::{ButtonReport, ButtonTimings},
+        rate::{RateSummary, ReportRate},
+    },
+    platform,
+};
+use anyhow::Result;
+use clap::{Arg, ArgMatches, Command, value_parser};
+use std::io::Write;
+use std::time::Duration;
+
+pub fn command() -> Command {
+    let device =
+        Arg::new("device").long("device").value_name("ALIAS|INDEX|PATH").global(true).help(
+            "Controller: an alias, an index from 'detect' or a device path (asked for if several \
+             are connected)",
+        );
+    Command::new("diagnose")
+        .about("Measure how a controller behaves, to tell settings from failing hardware")
+        .subcommand_required(true)
+        .arg_required_else_help(true)
+        .arg(device)
+        .subcommand(
+            Command::new("buttons")
+                .about("Time presses and releases, and find buttons that bounce")
+                .long_about(
+                    "Time presses and releases, and find buttons that bounce.\n\n\
+                     Press each button a few times, quick taps and long holds. A press arriving \
+                     sooner after the same button's release than --window is contact bounce, \
+                     which reaches games as a double press. Each button that bounces gets a \
+                     suggested debounce_ms.",
+                )
+                .arg(
+                    Arg::new("seconds")
+                        .long("seconds")
+                        .value_name("SECONDS")
+                        .default_value("30")
+                        .value_parser(value_parser!(u64).range(1..=600))
+                        .help("How long to measure"),
+                )
+                .arg(
+                    Arg::new("window")
+                        .long("window")
+                        .value_name("MS")
+                        .default_value("30")
+                        .value_parser(value_parser!(u64).range(1..=500))
+                        .help("Presses this soon after a release count as bounce"),
+                ),
+        )
+        .subcommand(
+            Command::new("rate")
+                .about("Measure how many reports a second the controller sends")
+                .long_about(
+                    "Measure how many reports a second the controller sends.\n\n\
+                     Keep both sticks moving in circles while it measures: controllers only \
+                     report while something changes. The time between reports shows the rate \
+                     the connection really runs at, such as 125 Hz or 250 Hz over USB.",
+                )
+                .arg(
+                    Arg::new("seconds")
+                        .long("seconds")
+                        .value_name("SECONDS")
+                        .default_value("10")
+                        .value_parser(value_parser!(u64).range(1..=600))
+                        .help("How long to measure"),
+                ),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let manager = platform::new_input_manager()?;
+    run_internal(&mut std::io::stdout(), manager.as_ref(), matches)
+}
+
+fn run_internal<W: Write>(
+    writer: &mut W,
+    manager: &dyn InputManager,
+    matches: &ArgMatches,
+) -> Result<()> {
+    let (command, sub_matches) = matches.subcommand().unwrap();
+    let path = super::device_path(manager, sub_matches.get_one::<String>("device"))?;
+
+    match command {
+        "buttons" => {
+            let seconds = *sub_matches.get_one::<u64>("seconds").unwrap();
+            let window = Duration::from_millis(*sub_matches.get_one::<u64>("window").unwrap());
+            writeln!(
+                writer,
+                "Press each button of {} a few times, quick taps and long holds; \
+                 measuring for {} seconds...",
+                path, seconds
+            )?;
+            // Nothing between the driver and us that could hide bounce
+            let gamepad = manager.open_gamepad_raw(&path)?;
+            let mut timings = ButtonTimings::new(window);
+            super::read_for(gamepad, Duration::from_secs(seconds), |event| {
+                if let Some(gap) = timings.sample(event)
+                    && let InputEvent::Button { code, .. } = event
+                {
+                    writeln!(
+                        writer,
+                        "  {} bounced, pressed again {} after release",
+                        code,
+                        ms(gap)
+                    )?;
+                }
+                Ok(())
+            })?;
+            write_button_report(writer, &timings.reports())
+        }
+        "rate" => {
+            let seconds = *sub_matches.get_one::<u64>("seconds").unwrap();
+            writeln!(
+                writer,
+                "Keep both sticks of {} moving in circles; measuring for {} seconds...",
+                path, seconds
+            )?;
+            let bluetooth = platform::context_probe(&path, false)().bluetooth;
+            let gamepad = manager.open_gamepad_raw(&path)?;
+            let mut rate = ReportRate::default();
+            super::read_for(gamepad, Duration::from_secs(seconds), |event| {
+                rate.sample(event);
+                Ok(())
+            })?;
+            write_rate_report(writer, rate.summary(), bluetooth)
+        }
+        _ => unreachable!("Subcommand required"),
+    }
+}
+
+/// A table of each button's timing, then what to do about bounce
+fn write_button_report<W: Write>(writer: &mut W, reports: &[ButtonReport]) -> Result<()> {
+    if reports.is_empty() {
+        writeln!(writer, "No button was pressed")?;
+        return Ok(());
+    }
+    let cell = |duration: Option<Duration>| duration.map_or("-".to_string(), ms);
+    writeln!(
+        writer,
+        "\n{:<16} {:>7} {:>13} {:>11} {:>12} {:>7} {:>9}",
+        "Button", "Presses", "Shortest hold", "Median hold", "Shortest gap", "Bounces", "Debounce"
+    )?;
+    for report in reports {
+        writeln!(
+            writer,
+            "{:<16} {:>7} {:>13} {:>11} {:>12} {:>7} {:>9}",
+            report.code.to_string(),
+            report.presses,
+            cell(report.shortest_hold),
+            cell(report.median_hold),
+            cell(report.shortest_gap),
+            report.bounces,
+            report.suggested_debounce_ms().map_or("-".to_string(), |ms| format!("{} ms", ms)),
+        )?;
+    }
+
+    let bouncing: Vec<_> = reports.iter().filter(|report| report.bounces > 0).collect();
+    if bouncing.is_empty() {
+        writeln!(writer, "\nNo button bounced; debounce_ms isn't needed")?;
+        return Ok(());
+    }
+    writeln!(
+        writer,
+        "\nSet debounce_ms to the suggestion under [settings], or on the mappings of the \
+         buttons that bounced"
+    )?;
+    for report in bouncing.iter().filter(|report| report.debounce_too_long()) {
+        writeln!(
+            writer,
+            "  {}: deliberate presses came as close as {}, within its debounce; \
+             the switch is likely failing",
+            report.code,
+            cell(report.shortest_gap)
+        )?;
+    }
+    Ok(())
+}
+
+/// How often the controller reported, and what that says about its connection
+fn write_rate_report<W: Write>(
+    writer: &mut W,
+    summary: Option<RateSummary>,
+    bluetooth: bool,
+) -> Result<()> {
+    let Some(summary) = summary else {
+        writeln!(writer, "Too few reports to measure; keep the sticks moving while it measures")?;
+        return Ok(());
+    };
+    let precise = |duration: Duration| format!("{:.2} ms", duration.as_secs_f64() * 1000.0);
+    writeln!(writer, "\nConnection: {}", if bluetooth { "Bluetooth" } else { "USB" })?;
+    writeln!(
+        writer,
+        "Reports:    {} over {:.1} s of movement ({} pauses left out)",
+        summary.intervals + 1,
+        summary.moving.as_secs_f64(),
+        summary.pauses
+    )?;
+    writeln!(writer, "Rate:       {:.1} Hz", summary.hz)?;
+    writeln!(
+        writer,
+        "Interval:   median {}, fastest {}, 99% within {}",
+        precise(summary.median),
+        precise(summary.fastest),
+        precise(summary.p99)
+    )?;
+    match summary.polling_rate() {
+        Some(rate) => writeln!(writer, "Polling:    {} Hz", rate)?,
+        None if bluetooth => {
+            writeln!(writer, "Polling:    set by the controller, as usual over Bluetooth")?
+        }
+        None => writeln!(writer, "Polling:    not a usual USB rate")?,
+    }
+    // Reports arriving far apart from their rate point at interference or a busy hub
+    if summary.p99 > summary.median * 2 {
+        writeln!(
+            writer,
+            "Reports are uneven: 1 in 100 took over twice the median. On Bluetooth, move the \
+             controller closer to the receiver; on USB, try a port that isn't on a hub."
+        )?;
+    }
+    Ok(())
+}
+
+/// Milliseconds to a tenth
+fn ms(duration: Duration) -> String {
+    format!("{:.1} ms", duration.as_secs_f64() * 1000.0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::ButtonCode;
+
+    fn report(code: ButtonCode, bounce_ms: Option<u64>, gap_ms: u64) -> ButtonReport {
+        ButtonReport {
+            code,
+            presses: 12,
+            shortest_hold: Some(Duration::from_micros(41_300)),
+            median_hold: Some(Duration::from_millis(95)),
+            shortest_gap: Some(Duration::from_millis(gap_ms)),
+            bounces: bounce_ms.map_or(0, |_| 3),
+            longest_bounce: bounce_ms.map(Duration::from_millis),
+        }
+    }
+
+    fn text(reports: &[ButtonReport]) -> String {
+        let mut output = Vec::new();
+        write_button_report(&mut output, reports).unwrap();
+        String::from_utf8(output).unwrap()
+    }
+
+    #[test]
+    fn test_button_report() {
+        let output = text(&[
+            report(ButtonCode::South, None, 70),
+            report(ButtonCode::West, Some(8), 70),
+            report(ButtonCode::East, Some(24), 29),
+        ]);
+
+        assert!(
+            output.contains(
+                "South                 12       41.3 ms     95.0 ms      70.0 ms       0         -\n"
+            ),
+            "{}",
+            output
+        );
+        assert!(output.contains("      3     15 ms\n"), "{}", output);
+        assert!(output.contains("Set debounce_ms to the suggestion"), "{}", output);
+        assert!(
+            output.contains("  East: deliberate presses came as close as 29.0 ms"),
+            "{}",
+            output
+        );
+        assert!(!output.contains("  West:"), "{}", output);
+    }
+
+    #[test]
+    fn test_rate_report() {
+        let summary = RateSummary {
+            intervals: 2499,
+            pauses: 2,
+            moving: Duration::from_millis(9996),
+            hz: 250.0,
+            median: Duration::from_millis(4),
+            fastest: Duration::from_micros(3960),
+            p99: Duration::from_micros(9100),
+        };
+        let mut output = Vec::new();
+        write_rate_report(&mut output, Some(summary), false).unwrap();
+        let output = String::from_utf8(output).unwrap();
+
+        assert!(output.contains("Connection: USB\n"), "{}", output);
+        assert!(
+            output.contains("Reports:    2500 over 10.0 s of movement (2 pauses"),
+            "{}",
+            output
+        );
+        assert!(output.contains("Rate:       250.0 Hz\n"), "{}", output);
+        assert!(
+            output.contains("median 4.00 ms, fastest 3.96 ms, 99% within 9.10 ms"),
+            "{}",
+            output
+        );
+        assert!(output.contains("Polling:    250 Hz\n"), "{}", output);
+        assert!(output.contains("Reports are uneven"), "{}", output);
+
+        let mut output = Vec::new();
+        write_rate_report(&mut output, None, true).unwrap();
+        assert!(String::from_utf8(output).unwrap().starts_with("Too few reports"));
+    }
+
+    #[test]
+    fn test_button_report_without_bounce() {
+        assert!(text(&[report(ButtonCode::South, None, 70)]).contains("No button bounced"));
+        assert_eq!(text(&[]), "No button was pressed\n");
+    }
+}
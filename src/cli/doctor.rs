@@ -0,0 +1,214 @@
+// Doctor command - diagnose the environment BlazeRemap runs in
+use clap::{ArgMatches, Command};
+use std::fmt;
+use std::io::Write;
+
+pub fn command() -> Command {
+    Command::new("doctor").about("Check device access and report what BlazeRemap can do here")
+}
+
+pub fn handle(_matches: &ArgMatches) -> anyhow::Result<()> {
+    let checks = collect_checks();
+
+    let mut output = std::io::stdout();
+    write_report(&mut output, &checks)?;
+
+    Ok(())
+}
+
+/// Outcome of a single diagnostic check
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum CheckStatus {
+    Ok,
+    Warn,
+    Fail,
+}
+
+impl fmt::Display for CheckStatus {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            CheckStatus::Ok => write!(f, "✓"),
+            CheckStatus::Warn => write!(f, "!"),
+            CheckStatus::Fail => write!(f, "✗"),
+        }
+    }
+}
+
+/// A single line in the doctor report, with an optional fix-it hint
+#[derive(Debug, Clone)]
+pub(crate) struct Check {
+    pub name: &'static str,
+    pub status: CheckStatus,
+    pub detail: String,
+    pub hint: Option<String>,
+}
+
+impl Check {
+    fn new(name: &'static str, status: CheckStatus, detail: impl Into<String>) -> Self {
+        Self { name, status, detail: detail.into(), hint: None }
+    }
+
+    fn with_hint(mut self, hint: impl Into<String>) -> Self {
+        self.hint = Some(hint.into());
+        self
+    }
+}
+
+fn collect_checks() -> Vec<Check> {
+    let mut checks = vec![Check::new("Platform", CheckStatus::Ok, std::env::consts::OS)];
+
+    #[cfg(target_os = "linux")]
+    checks.extend(linux_checks());
+
+    #[cfg(not(target_os = "linux"))]
+    if let Err(err) = crate::platform::new_input_manager() {
+        checks.push(Check::new("Gamepad input", CheckStatus::Fail, err.to_string()));
+    }
+
+    checks
+}
+
+#[cfg(target_os = "linux")]
+fn linux_checks() -> Vec<Check> {
+    use crate::platform::linux::preflight;
+    use crate::platform::linux::sandbox::{self, HOST_HELPER_ENV, OperationMode, SandboxKind};
+
+    let sandbox_kind = sandbox::detect_sandbox();
+    let access = sandbox::probe_device_access();
+    let helper = sandbox::host_helper_available(&sandbox_kind);
+    let on_host = std::env::var_os(HOST_HELPER_ENV).is_some();
+
+    let mut checks = Vec::new();
+
+    let sandbox_status =
+        if sandbox_kind == SandboxKind::None { CheckStatus::Ok } else { CheckStatus::Warn };
+    checks.push(Check::new("Sandbox", sandbox_status, sandbox_kind.to_string()));
+
+    checks.push(if access.input_readable {
+        Check::new("Input devices", CheckStatus::Ok, "/dev/input/event* readable")
+    } else {
+        Check::new("Input devices", CheckStatus::Fail, "no readable /dev/input/event* node")
+            .with_hint(
+                "run 'blazeremap setup access' to join the 'input' group or install a udev rule \
+                 for your controllers",
+            )
+    });
+
+    checks.push(match preflight::check_uinput() {
+        Ok(()) => Check::new("Virtual devices", CheckStatus::Ok, "/dev/uinput writable"),
+        Err(problem) => Check::new(
+            "Virtual devices",
+            CheckStatus::Fail,
+            format!("{} {}", problem.path, problem.problem),
+        )
+        .with_hint(problem.fix),
+    });
+
+    // Remapping works without it, at normal priority
+    checks.push(match preflight::check_realtime() {
+        Ok(()) => Check::new("Real-time priority", CheckStatus::Ok, "available for --realtime"),
+        Err(problem) => Check::new("Real-time priority", CheckStatus::Warn, problem.problem)
+            .with_hint(problem.fix),
+    });
+
+    if sandbox_kind != SandboxKind::None {
+        checks.push(if helper {
+            Check::new("Host helper", CheckStatus::Ok, "flatpak-spawn --host available")
+        } else {
+            Check::new("Host helper", CheckStatus::Warn, "flatpak-spawn --host not available")
+                .with_hint("grant --talk-name=org.freedesktop.Flatpak to the sandbox")
+        });
+
+        for portal in sandbox::probe_portals() {
+            let check = match portal.version {
+                Some(version) => Check::new(
+                    portal.interface,
+                    CheckStatus::Ok,
+                    format!("version {} (not used for gamepads)", version),
+                ),
+                None => Check::new(portal.interface, CheckStatus::Warn, "not available"),
+            };
+            checks.push(check);
+        }
+    }
+
+    let mode = sandbox::select_mode(&sandbox_kind, access, helper, on_host);
+    checks.push(match mode {
+        OperationMode::Direct if access.is_complete() => {
+            Check::new("Mode", CheckStatus::Ok, "direct device access")
+        }
+        OperationMode::Direct => {
+            Check::new("Mode", CheckStatus::Warn, "direct, with missing access")
+        }
+        OperationMode::HostHelper => Check::new(
+            "Mode",
+            CheckStatus::Ok,
+            "device commands are forwarded to the host's blazeremap",
+        )
+        .with_hint("blazeremap must also be installed on the host"),
+        OperationMode::Unavailable => {
+            Check::new("Mode", CheckStatus::Fail, "devices are unreachable from this sandbox")
+                .with_hint(
+                    "desktop portals cannot read gamepads; install blazeremap on the host instead",
+                )
+        }
+    });
+
+    checks
+}
+
+/// Internal function that writes to any writer (testable!)
+fn write_report<W: Write>(writer: &mut W, checks: &[Check]) -> std::io::Result<()> {
+    writeln!(writer, "BlazeRemap environment check\n")?;
+
+    for check in checks {
+        writeln!(writer, "{} {}: {}", check.status, check.name, check.detail)?;
+        if let Some(hint) = &check.hint {
+            writeln!(writer, "    └─ {}", hint)?;
+        }
+    }
+
+    let failures = checks.iter().filter(|c| c.status == CheckStatus::Fail).count();
+    writeln!(writer)?;
+    if failures == 0 {
+        writeln!(writer, "No problems found.")?;
+    } else {
+        writeln!(writer, "{} problem(s) found.", failures)?;
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_report_all_ok() {
+        let checks = vec![Check::new("Platform", CheckStatus::Ok, "linux")];
+
+        let mut output = Vec::new();
+        write_report(&mut output, &checks).unwrap();
+
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("✓ Platform: linux"));
+        assert!(text.contains("No problems found."));
+    }
+
+    #[test]
+    fn test_report_shows_hints_and_counts_failures() {
+        let checks = vec![
+            Check::new("Input devices", CheckStatus::Fail, "no readable node").with_hint("fix it"),
+            Check::new("Sandbox", CheckStatus::Warn, "Flatpak"),
+        ];
+
+        let mut output = Vec::new();
+        write_report(&mut output, &checks).unwrap();
+
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("✗ Input devices: no readable node"));
+        assert!(text.contains("    └─ fix it"));
+        assert!(text.contains("! Sandbox: Flatpak"));
+        assert!(text.contains("1 problem(s) found."));
+    }
+}
@@ -0,0 +1,198 @@
+// Emulate command - play controller-only games with a keyboard and mouse
+use crate::{
+    input::{DeviceKind, InputManager, keymouse::KeyMouseLayout},
+    output::gamepad::{VirtualGamepad, VirtualGamepadIdentity},
+    platform,
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgAction, ArgMatches, Command, value_parser};
+use std::io::Write;
+use std::path::PathBuf;
+
+pub fn command() -> Command {
+    Command::new("emulate")
+        .about("Turn the keyboard and mouse into a virtual controller")
+        .long_about(
+            "Turn the keyboard and mouse into a virtual controller, for games that only take \
+             a controller.\n\n\
+             By default WASD moves the left stick, the mouse the right one, its buttons pull \
+             the triggers and Space presses South. A layout file binds keys differently. The \
+             keyboard and mouse are grabbed, so nothing else sees their input until Scroll \
+             Lock (the layout's release_key) is pressed.",
+        )
+        .arg(
+            Arg::new("device")
+                .short('d')
+                .long("device")
+                .value_name("PATH")
+                .action(ArgAction::Append)
+                .help("Keyboard or mouse to read, repeat for each (every one if not specified)"),
+        )
+        .arg(
+            Arg::new("layout")
+                .short('l')
+                .long("layout")
+                .value_name("FILE")
+                .value_parser(value_parser!(PathBuf))
+                .help("Layout binding keys to the controller (WASD layout if not specified)"),
+        )
+        .arg(super::simulate::type_arg())
+        .arg(
+            Arg::new("name")
+                .long("name")
+                .default_value("BlazeRemap Keyboard Controller")
+                .help("Device name of the virtual controller"),
+        )
+        .arg(
+            Arg::new("no-grab")
+                .long("no-grab")
+                .action(ArgAction::SetTrue)
+                .help("Leave the keyboard and mouse working as usual too"),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let manager = platform::new_input_manager()?;
+    platform::check_virtual_device_access()?;
+    run_internal(&mut std::io::stdout(), manager.as_ref(), matches, platform::new_virtual_gamepad)
+}
+
+fn run_internal<W, F>(
+    writer: &mut W,
+    manager: &dyn InputManager,
+    matches: &ArgMatches,
+    make_gamepad: F,
+) -> Result<()>
+where
+    W: Write,
+    F: FnOnce(&VirtualGamepadIdentity) -> Result<Box<dyn VirtualGamepad>>,
+{
+    let layout = match matches.get_one::<PathBuf>("layout") {
+        Some(path) => KeyMouseLayout::load(path)?,
+        None => KeyMouseLayout::default(),
+    };
+    let paths: Vec<String> = match matches.get_many::<String>("device") {
+        Some(paths) => paths.cloned().collect(),
+        None => manager
+            .list_devices()?
+            .into_iter()
+            .filter(|device| matches!(device.kind, DeviceKind::Keyboard | DeviceKind::Mouse))
+            .map(|device| device.path)
+            .collect(),
+    };
+    if paths.is_empty() {
+        anyhow::bail!("No keyboard or mouse found; reading them needs access to /dev/input");
+    }
+    let mut identity = VirtualGamepadIdentity::simulated(super::simulate::gamepad_type(matches));
+    identity.name = matches.get_one::<String>("name").unwrap().clone();
+    let release_key = layout.release_key;
+
+    let _claim = platform::claim_devices(&paths)?;
+    let mut gamepad = make_gamepad(&identity).context("Failed to create virtual controller")?;
+    let mut controller = manager
+        .open_key_mouse(&paths, layout, !matches.get_flag("no-grab"))
+        .context("Failed to open keyboard and mouse")?;
+    writeln!(
+        writer,
+        "Playing {} as {} at {}",
+        paths.join(", "),
+        identity.name,
+        gamepad.dev_node()?.display()
+    )?;
+    match release_key {
+        Some(key) => writeln!(writer, "Press {} to stop", key)?,
+        None => writeln!(writer, "Press Ctrl+C to stop")?,
+    }
+
+    let frames = super::merge::forward_frames(controller.as_mut(), gamepad.as_mut())?;
+    writeln!(writer, "Stopped after {} frames", frames)?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ButtonCode, InputEvent};
+    use crate::input::InputDeviceInfo;
+    use crate::input::gamepad::{GamepadInfo, GamepadType, MockGamepad};
+    use crate::input::manager::MockInputManager;
+
+    struct FakeGamepad(usize);
+
+    impl VirtualGamepad for FakeGamepad {
+        fn emit_frame(&mut self, _events: &[InputEvent]) -> Result<()> {
+            self.0 += 1;
+            Ok(())
+        }
+
+        fn dev_node(&mut self) -> Result<PathBuf> {
+            Ok(PathBuf::from("/dev/input/event99"))
+        }
+    }
+
+    #[test]
+    fn test_emulate_reads_every_keyboard_and_mouse() {
+        let mut manager = MockInputManager::new();
+        manager.expect_list_devices().returning(|| {
+            let device = |kind, path: &str| InputDeviceInfo {
+                path: path.to_string(),
+                name: "Device".to_string(),
+                kind,
+            };
+            Ok(vec![
+                device(DeviceKind::Keyboard, "/dev/input/event0"),
+                device(DeviceKind::Gamepad, "/dev/input/event3"),
+                device(DeviceKind::Mouse, "/dev/input/event5"),
+            ])
+        });
+        manager
+            .expect_open_key_mouse()
+            .withf(|paths, layout, grab| {
+                paths == ["/dev/input/event0", "/dev/input/event5"]
+                    && *layout == KeyMouseLayout::default()
+                    && *grab
+            })
+            .returning(|_, _, _| {
+                let mut events =
+                    vec![InputEvent::button_press(ButtonCode::South), InputEvent::sync()]
+                        .into_iter();
+                let mut controller = MockGamepad::new();
+                controller.expect_get_info().returning(|| GamepadInfo {
+                    path: String::new(),
+                    name: "Keyboard and Mouse".to_string(),
+                    gamepad_type: GamepadType::Generic,
+                    vendor_id: 0,
+                    vendor_name: String::new(),
+                    product_id: 0,
+                    uniq: None,
+                    phys: None,
+                    capabilities: vec![],
+                });
+                controller.expect_read_event().returning(move || Ok(events.next()));
+                Ok(Box::new(controller))
+            });
+
+        let matches = command().get_matches_from(["emulate"]);
+        let mut output = Vec::new();
+        run_internal(&mut output, &manager, &matches, |identity| {
+            assert_eq!(identity.name, "BlazeRemap Keyboard Controller");
+            Ok(Box::new(FakeGamepad(0)))
+        })
+        .unwrap();
+
+        let output = String::from_utf8(output).unwrap();
+        assert!(output.contains("at /dev/input/event99\n"), "{}", output);
+        assert!(output.contains("Press Scroll Lock to stop\n"), "{}", output);
+        assert!(output.ends_with("Stopped after 1 frames\n"), "{}", output);
+    }
+
+    #[test]
+    fn test_emulate_needs_a_keyboard_or_mouse() {
+        let mut manager = MockInputManager::new();
+        manager.expect_list_devices().returning(|| Ok(vec![]));
+        let matches = command().get_matches_from(["emulate"]);
+        let result =
+            run_internal(&mut Vec::new(), &manager, &matches, |_| Ok(Box::new(FakeGamepad(0))));
+        assert!(result.unwrap_err().to_string().contains("No keyboard or mouse found"));
+    }
+}
@@ -0,0 +1,233 @@
+// Forward command - stream a controller to another machine
+use super::with_default_port;
+use crate::{
+    audit::{self, AuditEvent},
+    event::EventLoop,
+    input::gamepad::{BufferedGamepad, GamepadType, buffered::DEFAULT_RING_CAPACITY},
+    mapping::{MappingEngine, profile::Profile},
+    output::{
+        devices::{DeviceKinds, VirtualDevices},
+        gamepad::VirtualGamepadIdentity,
+    },
+    platform::{self, new_input_manager, new_virtual_keyboard},
+    remote,
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgGroup, ArgMatches, Command};
+use std::net::{TcpListener, TcpStream};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+pub fn command() -> Command {
+    Command::new("forward")
+        .about("Forward a controller to, or receive one from, another machine over TCP")
+        .long_about(
+            "Forward a controller to, or receive one from, another machine over TCP.\n\n\
+             Sender:   blazeremap forward --to htpc.local --device /dev/input/event3\n\
+             Receiver: blazeremap forward --listen 0.0.0.0 --profile racing.toml\n\n\
+             Both sides must share a token (--token or $BLAZEREMAP_FORWARD_TOKEN). \
+             Traffic is authenticated but not encrypted.",
+        )
+        .arg(
+            Arg::new("to")
+                .long("to")
+                .value_name("HOST[:PORT]")
+                .help("Send events to a receiver at this address"),
+        )
+        .arg(
+            Arg::new("listen")
+                .long("listen")
+                .value_name("ADDR[:PORT]")
+                .help("Accept forwarded controllers on this address"),
+        )
+        .group(ArgGroup::new("mode").args(["to", "listen"]).required(true))
+        .arg(
+            Arg::new("device")
+                .short('d')
+                .long("device")
+                .help("Controller to forward: an alias, an index or a device path (auto-detects if not specified)")
+                .conflicts_with("listen"),
+        )
+        .arg(
+            Arg::new("observe")
+                .long("observe")
+                .help("Open the controller read-only and never grab it")
+                .action(clap::ArgAction::SetTrue)
+                .conflicts_with("listen"),
+        )
+        .arg(
+            Arg::new("profile")
+                .short('p')
+                .long("profile")
+                .value_name("FILE")
+                .help("Profile to map forwarded controllers with (hardcoded mappings if not given)")
+                .conflicts_with("to"),
+        )
+        .args(super::profile::integrity_args())
+        .arg(
+            Arg::new("token")
+                .long("token")
+                .env(remote::TOKEN_ENV)
+                .hide_env_values(true)
+                .required(true)
+                .help("Shared secret used to authenticate the connection"),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let token = matches.get_one::<String>("token").unwrap();
+
+    if let Some(addr) = matches.get_one::<String>("to") {
+        send(matches, &with_default_port(addr, remote::DEFAULT_PORT), token)
+    } else {
+        let addr = matches.get_one::<String>("listen").unwrap();
+        receive(matches, &with_default_port(addr, remote::DEFAULT_PORT), token)
+    }
+}
+
+fn send(matches: &ArgMatches, addr: &str, token: &str) -> Result<()> {
+    let manager = new_input_manager()?;
+
+    let device_path = match matches.get_one::<String>("device") {
+        Some(selection) => super::resolve_device(manager.as_ref(), selection)?,
+        None => {
+            let gamepads = manager.list_gamepads()?;
+            super::picker::pick(&gamepads.gamepad_info)?.path.clone()
+        }
+    };
+
+    let mut gamepad = match matches.get_flag("observe") {
+        true => manager.open_gamepad_observed(&device_path),
+        false => manager.open_gamepad(&device_path),
+    }
+    .context("Failed to open controller")?;
+    let info = gamepad.get_info();
+
+    progress!("Connecting to {}...", addr);
+    let mut stream = remote::connect(addr, token, &info)
+        .with_context(|| format!("Failed to connect to {}", addr))?;
+
+    progress!("Forwarding {} to {} (Ctrl+C to stop)", info.name, addr);
+    let sent = remote::forward_events(gamepad.as_mut(), &mut stream)?;
+
+    println!("Controller disconnected after {} events.", sent);
+    Ok(())
+}
+
+fn receive(matches: &ArgMatches, addr: &str, token: &str) -> Result<()> {
+    platform::check_virtual_device_access()?;
+
+    // Every sender is mapped with the same profile, loaded once
+    let profile = match matches.get_one::<String>("profile") {
+        Some(path) => {
+            progress!("Loading profile {}...", path);
+            let integrity = super::profile::integrity_policy(matches);
+            let profile = Profile::load_verified(Path::new(path), &integrity)?;
+            if let Some(problem) = profile.settings.virtual_devices.problem() {
+                anyhow::bail!("Invalid virtual device settings: {}", problem);
+            }
+            audit::record(AuditEvent::ProfileLoaded {
+                profile: profile.name.clone(),
+                file: Some(PathBuf::from(path)),
+            });
+            Some(Arc::new(profile))
+        }
+        None => None,
+    };
+
+    let listener =
+        TcpListener::bind(addr).with_context(|| format!("Failed to listen on {}", addr))?;
+    progress!("Waiting for forwarded controllers on {}...", addr);
+
+    // Each sender gets its own thread and virtual devices, so one that stays
+    // silent or sends garbage only loses its own connection
+    for stream in listener.incoming() {
+        let stream = match stream {
+            Ok(stream) => stream,
+            Err(e) => {
+                tracing::warn!("Forwarding accept failed: {}", e);
+                continue;
+            }
+        };
+        let (token, profile) = (token.to_string(), profile.clone());
+        std::thread::Builder::new().name("blazeremap-forward".to_string()).spawn(move || {
+            if let Err(e) = receive_from(stream, &token, profile.as_deref()) {
+                tracing::warn!("{:#}", e);
+            }
+        })?;
+    }
+
+    Ok(())
+}
+
+/// Authenticate one sender and map its controller until it disconnects
+fn receive_from(stream: TcpStream, token: &str, profile: Option<&Profile>) -> Result<()> {
+    let peer = stream.peer_addr().map(|addr| addr.to_string()).unwrap_or_else(|_| "?".into());
+    let gamepad = remote::accept(stream, token)
+        .with_context(|| format!("Rejected forwarding connection from {}", peer))?;
+
+    let info = crate::Gamepad::get_info(&gamepad);
+    println!("Receiving {} from {}", info.name, info.path);
+
+    let (engine, kinds) = match profile {
+        Some(profile) => {
+            (MappingEngine::load_from_profile(profile)?, DeviceKinds::for_profile(profile))
+        }
+        None => (MappingEngine::new_hardcoded(), DeviceKinds::KEYBOARD),
+    };
+    let identities = profile.map(|profile| profile.settings.virtual_devices.clone());
+    let identities = identities.unwrap_or_default();
+    let mut identity = VirtualGamepadIdentity::simulated(GamepadType::XboxOne);
+    identity.name = "BlazeRemap Virtual Gamepad".to_string();
+    identities.gamepad.apply_to_gamepad(&mut identity);
+    let keyboard = identities.keyboard("BlazeRemap Virtual Keyboard");
+    let mouse = identities.mouse("BlazeRemap Virtual Mouse");
+    let mut devices = VirtualDevices::new()
+        .with_lazy_keyboard(move || new_virtual_keyboard(&keyboard))
+        .with_lazy_mouse(move || platform::new_virtual_mouse(&mouse))
+        .with_lazy_gamepad(move || platform::new_virtual_gamepad(&identity));
+    for (name, device) in identities.custom {
+        let made_name = name.clone();
+        devices = devices
+            .with_lazy_custom(&name, move || platform::new_custom_device(&made_name, &device));
+    }
+    devices.prepare(kinds)?;
+
+    // Read on its own thread, so repeats and hold timers fire while the
+    // sender is idle
+    let controller = BufferedGamepad::spawn(Box::new(gamepad), DEFAULT_RING_CAPACITY)
+        .context("Failed to start controller reader")?;
+    let ring_counters = controller.counters();
+    EventLoop::for_devices(Box::new(controller), engine, devices)
+        .with_ring_counters(ring_counters)
+        .run()
+        .with_context(|| format!("Receiving {} from {} failed", info.name, info.path))?;
+
+    progress!("{} disconnected", info.name);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_with_default_port() {
+        assert_eq!(with_default_port("htpc.local", remote::DEFAULT_PORT), "htpc.local:7531");
+        assert_eq!(with_default_port("10.0.0.2:9000", remote::DEFAULT_PORT), "10.0.0.2:9000");
+        assert_eq!(with_default_port("[::1]:9000", remote::DEFAULT_PORT), "[::1]:9000");
+    }
+
+    #[test]
+    fn test_requires_mode_and_token() {
+        let result = command().try_get_matches_from(["forward", "--token", "x"]);
+        assert!(result.is_err());
+
+        let result = command().try_get_matches_from(["forward", "--to", "a", "--listen", "b"]);
+        assert!(result.is_err());
+
+        let result = command()
+            .try_get_matches_from(["forward", "--to", "a", "-p", "x.toml", "--token", "x"]);
+        assert!(result.is_err());
+    }
+}
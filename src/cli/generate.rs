@@ -0,0 +1,455 @@
+// Gen command - files generated from BlazeRemap's own definitions
+//
+// `gen docs` writes a page for every command from the same definitions the
+// parser uses, so the pages can't fall behind the flags, and a page for the
+// profile format from mapping/reference.rs. As man pages (section 1, and 5
+// for profiles) they are for distributions to package; as markdown, for
+// reading on the web. Each page goes to a file of its own with --output, or
+// all of them to stdout.
+
+use anyhow::{Context, Result};
+use clap::{Arg, ArgMatches, Command, value_parser};
+use std::path::{Path, PathBuf};
+
+use crate::exit::ExitCode;
+use crate::mapping::reference;
+
+pub fn command() -> Command {
+    Command::new("gen")
+        .about("Generate documentation from the command definitions")
+        .subcommand_required(true)
+        .subcommand(
+            Command::new("docs")
+                .about("Generate man pages or markdown for every command and the profile format")
+                .arg(
+                    Arg::new("format")
+                        .long("format")
+                        .value_parser(["man", "markdown"])
+                        .default_value("man")
+                        .help("Page format"),
+                )
+                .arg(
+                    Arg::new("output")
+                        .short('o')
+                        .long("output")
+                        .value_name("DIR")
+                        .value_parser(value_parser!(PathBuf))
+                        .help("Write each page to a file in DIR (stdout if not specified)"),
+                ),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    match matches.subcommand() {
+        Some(("docs", sub_matches)) => docs(sub_matches),
+        _ => unreachable!("Subcommand required"),
+    }
+}
+
+fn docs(matches: &ArgMatches) -> Result<()> {
+    let format = match matches.get_one::<String>("format").map(String::as_str) {
+        Some("markdown") => Format::Markdown,
+        _ => Format::Man,
+    };
+    let pages = pages(super::build_cli());
+    match matches.get_one::<PathBuf>("output") {
+        Some(dir) => {
+            write_pages(&pages, format, dir)?;
+            progress!("Wrote {} pages to {}", pages.len(), dir.display());
+        }
+        None => {
+            let text: Vec<String> = pages.iter().map(|page| page.render(format)).collect();
+            print!("{}", text.join("\n"));
+        }
+    }
+    Ok(())
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Format {
+    Man,
+    Markdown,
+}
+
+/// A piece of a page
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum Block {
+    Heading(String),
+    Subheading(String),
+    Paragraph(String),
+    /// Kept as it is, like a usage line or an example
+    Code(String),
+    /// A term, like an option, and what it is
+    Item(String, String),
+}
+
+/// One page of the manual, like blazeremap-run(1)
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Page {
+    name: String,
+    section: u8,
+    summary: String,
+    blocks: Vec<Block>,
+}
+
+impl Page {
+    fn file_name(&self, format: Format) -> String {
+        match format {
+            Format::Man => format!("{}.{}", self.name, self.section),
+            Format::Markdown => format!("{}.md", self.name),
+        }
+    }
+
+    fn render(&self, format: Format) -> String {
+        match format {
+            Format::Man => self.man(),
+            Format::Markdown => self.markdown(),
+        }
+    }
+
+    fn man(&self) -> String {
+        let mut text = format!(
+            ".TH \"{}\" \"{}\" \"\" \"blazeremap {}\" \"BlazeRemap Manual\"\n",
+            self.name.to_uppercase(),
+            self.section,
+            env!("CARGO_PKG_VERSION")
+        );
+        text.push_str(&format!(".SH NAME\n{} \\- {}\n", roff(&self.name), roff(&self.summary)));
+        for block in &self.blocks {
+            match block {
+                Block::Heading(title) => text.push_str(&format!(".SH {}\n", title.to_uppercase())),
+                Block::Subheading(title) => text.push_str(&format!(".SS \"{}\"\n", roff(title))),
+                Block::Paragraph(paragraph) => {
+                    text.push_str(&format!(".PP\n{}\n", roff(paragraph)))
+                }
+                Block::Code(code) => text.push_str(&format!(".PP\n.nf\n{}\n.fi\n", roff(code))),
+                Block::Item(term, description) => {
+                    text.push_str(&format!(".TP\n\\fB{}\\fR\n{}\n", roff(term), roff(description)))
+                }
+            }
+        }
+        text
+    }
+
+    fn markdown(&self) -> String {
+        let mut text = format!("# {}({})\n\n{}\n", self.name, self.section, self.summary);
+        let mut in_list = false;
+        for block in &self.blocks {
+            // A list of items goes without blank lines between them
+            if !(in_list && matches!(block, Block::Item(..))) {
+                text.push('\n');
+            }
+            in_list = matches!(block, Block::Item(..));
+            match block {
+                Block::Heading(title) => text.push_str(&format!("## {}\n", title)),
+                Block::Subheading(title) => text.push_str(&format!("### {}\n", title)),
+                Block::Paragraph(paragraph) => text.push_str(&format!("{}\n", paragraph)),
+                Block::Code(code) => text.push_str(&format!("```text\n{}\n```\n", code)),
+                Block::Item(term, description) => {
+                    text.push_str(&format!("- `{}`: {}\n", term, description))
+                }
+            }
+        }
+        text
+    }
+}
+
+/// `text` safe to put in a roff document
+fn roff(text: &str) -> String {
+    let escaped = text.replace('\\', "\\e").replace('-', "\\-");
+    // A line starting with a period or quote would be read as a request
+    escaped
+        .lines()
+        .map(|line| match line.starts_with(['.', '\'']) {
+            true => format!("\\&{}", line),
+            false => line.to_string(),
+        })
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+/// The pages for `cli` and every command under it, then the profile format
+fn pages(mut cli: Command) -> Vec<Page> {
+    // Built, so usages carry the whole command path and global flags show
+    // on every command
+    cli.build();
+    let mut pages = Vec::new();
+    command_pages(&cli, None, &mut pages);
+    pages.push(profile_page());
+    pages
+}
+
+fn command_pages(command: &Command, parent: Option<&str>, pages: &mut Vec<Page>) {
+    let name = match parent {
+        Some(parent) => format!("{}-{}", parent, command.get_name()),
+        None => command.get_name().to_string(),
+    };
+    let mut blocks = vec![Block::Heading("Synopsis".to_string())];
+    let usage = command.clone().render_usage().to_string();
+    let usage = usage.strip_prefix("Usage: ").unwrap_or(&usage).to_string();
+    blocks.push(Block::Code(usage));
+
+    let about = command.get_about().map(ToString::to_string).unwrap_or_default();
+    let description = command.get_long_about().map(ToString::to_string);
+    blocks.push(Block::Heading("Description".to_string()));
+    for paragraph in description.as_deref().unwrap_or(&about).split("\n\n") {
+        // Examples are indented
+        match paragraph.strip_prefix("  ") {
+            Some(example) => blocks.push(Block::Code(example.to_string())),
+            None => blocks.push(Block::Paragraph(paragraph.to_string())),
+        }
+    }
+
+    let visible = |arg: &&Arg| !arg.is_hide_set();
+    let positionals: Vec<&Arg> = command.get_positionals().filter(visible).collect();
+    if !positionals.is_empty() {
+        blocks.push(Block::Heading("Arguments".to_string()));
+        blocks.extend(positionals.into_iter().map(|arg| Block::Item(arg_term(arg), arg_help(arg))));
+    }
+    let options: Vec<&Arg> = command.get_opts().chain(flags(command)).filter(visible).collect();
+    if !options.is_empty() {
+        blocks.push(Block::Heading("Options".to_string()));
+        blocks.extend(options.into_iter().map(|arg| Block::Item(arg_term(arg), arg_help(arg))));
+    }
+
+    let subcommands: Vec<&Command> = command
+        .get_subcommands()
+        .filter(|sub| !sub.is_hide_set() && sub.get_name() != "help")
+        .collect();
+    if !subcommands.is_empty() {
+        blocks.push(Block::Heading("Commands".to_string()));
+        for sub in &subcommands {
+            let mut about = sub.get_about().map(ToString::to_string).unwrap_or_default();
+            let aliases: Vec<&str> = sub.get_visible_aliases().collect();
+            if !aliases.is_empty() {
+                about.push_str(&format!(" (also '{}')", aliases.join("', '")));
+            }
+            blocks.push(Block::Item(format!("{}-{}(1)", name, sub.get_name()), about));
+        }
+    }
+    if parent.is_none() {
+        blocks.push(Block::Heading("Exit Status".to_string()));
+        for code in ExitCode::ALL {
+            blocks.push(Block::Item(code.code().to_string(), code.meaning().to_string()));
+        }
+    }
+    blocks.push(Block::Heading("See Also".to_string()));
+    let see_also = match parent {
+        Some(parent) => format!("{}(1)", parent),
+        None => "blazeremap-profiles(5)".to_string(),
+    };
+    blocks.push(Block::Paragraph(see_also));
+
+    pages.push(Page { name: name.clone(), section: 1, summary: about, blocks });
+    for sub in subcommands {
+        command_pages(sub, Some(&name), pages);
+    }
+}
+
+/// Flags: arguments that take no value, positional or not
+fn flags(command: &Command) -> impl Iterator<Item = &Arg> {
+    command.get_arguments().filter(|arg| !arg.is_positional() && !arg.get_action().takes_values())
+}
+
+/// How an argument is written, like "-d, --device <DEVICE>"
+fn arg_term(arg: &Arg) -> String {
+    let value = match arg.get_value_names() {
+        Some(names) => names.iter().map(|name| format!("<{}>", name)).collect::<Vec<_>>(),
+        None => vec![format!("<{}>", arg.get_id().as_str().to_uppercase())],
+    }
+    .join(" ");
+    if arg.is_positional() {
+        return value;
+    }
+    let mut names = Vec::new();
+    if let Some(short) = arg.get_short() {
+        names.push(format!("-{}", short));
+    }
+    if let Some(long) = arg.get_long() {
+        names.push(format!("--{}", long));
+    }
+    let mut term = names.join(", ");
+    if arg.get_action().takes_values() {
+        term.push(' ');
+        term.push_str(&value);
+    }
+    term
+}
+
+/// What an argument does, with its default, values and environment variable
+fn arg_help(arg: &Arg) -> String {
+    let mut help =
+        arg.get_long_help().or(arg.get_help()).map(ToString::to_string).unwrap_or_default();
+    let mut notes = Vec::new();
+    let defaults: Vec<String> =
+        arg.get_default_values().iter().map(|value| value.to_string_lossy().into_owned()).collect();
+    if arg.get_action().takes_values() && !defaults.is_empty() {
+        notes.push(format!("default: {}", defaults.join(", ")));
+    }
+    let values: Vec<String> = arg
+        .get_possible_values()
+        .iter()
+        .filter(|value| !value.is_hide_set())
+        .map(|value| value.get_name().to_string())
+        .collect();
+    if !values.is_empty() {
+        notes.push(format!("possible values: {}", values.join(", ")));
+    }
+    if let Some(env) = arg.get_env() {
+        notes.push(format!("env: {}", env.to_string_lossy()));
+    }
+    if !notes.is_empty() {
+        help.push_str(&format!(" [{}]", notes.join("; ")));
+    }
+    help
+}
+
+/// blazeremap-profiles(5), from mapping/reference.rs
+fn profile_page() -> Page {
+    let mut blocks = vec![
+        Block::Heading("Description".to_string()),
+        Block::Paragraph(
+            "A profile says what each control of the controller does. It is a TOML file, or \
+             YAML or JSON with a .yaml, .yml or .json extension; all three have the same \
+             fields. 'blazeremap profile lint' reports fields it doesn't know, and 'blazeremap \
+             profile preset' writes built-in profiles out to start from."
+                .to_string(),
+        ),
+        Block::Code(
+            "schema_version = 1\nname = \"Racing\"\ndescription = \"Pedals on the triggers\"\n\n\
+             [[mappings]]\nsource_name = \"South\"\ntarget_type = \"Keyboard\"\ntarget_name = \"Space\""
+                .to_string(),
+        ),
+        Block::Heading("Fields".to_string()),
+    ];
+    for section in reference::SECTIONS {
+        let title = match section.path {
+            "" => "Top level",
+            path => path,
+        };
+        blocks.push(Block::Subheading(title.to_string()));
+        blocks.push(Block::Paragraph(section.about.to_string()));
+        for field in section.fields {
+            let description = format!("{}. {}.", field.kind, field.meaning);
+            blocks.push(Block::Item(field.name.to_string(), capitalize(&description)));
+        }
+    }
+    blocks.push(Block::Heading("Target Types".to_string()));
+    for (target_type, meaning) in reference::TARGET_TYPES {
+        blocks.push(Block::Item(format!("{:?}", target_type), format!("{}.", meaning)));
+    }
+    blocks.push(Block::Heading("Names".to_string()));
+    for (title, names) in reference::values() {
+        blocks.push(Block::Subheading(title.to_string()));
+        blocks.push(Block::Paragraph(names.join(", ")));
+    }
+    blocks.push(Block::Heading("See Also".to_string()));
+    blocks.push(Block::Paragraph("blazeremap(1), blazeremap-profile(1)".to_string()));
+    Page {
+        name: "blazeremap-profiles".to_string(),
+        section: 5,
+        summary: "BlazeRemap profile format".to_string(),
+        blocks,
+    }
+}
+
+fn capitalize(text: &str) -> String {
+    let mut chars = text.chars();
+    match chars.next() {
+        Some(first) => first.to_uppercase().chain(chars).collect(),
+        None => String::new(),
+    }
+}
+
+fn write_pages(pages: &[Page], format: Format, dir: &Path) -> Result<()> {
+    std::fs::create_dir_all(dir).with_context(|| format!("Failed to create {}", dir.display()))?;
+    for page in pages {
+        let path = dir.join(page.file_name(format));
+        std::fs::write(&path, page.render(format))
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn page<'a>(pages: &'a [Page], name: &str) -> &'a Page {
+        pages.iter().find(|page| page.name == name).unwrap()
+    }
+
+    #[test]
+    fn test_every_command_gets_a_page() {
+        let pages = pages(super::super::build_cli());
+        let cli = super::super::build_cli();
+        for command in cli.get_subcommands() {
+            page(&pages, &format!("blazeremap-{}", command.get_name()));
+        }
+        page(&pages, "blazeremap-profile-lint");
+        assert_eq!(page(&pages, "blazeremap-profiles").section, 5);
+
+        let run = page(&pages, "blazeremap-run");
+        assert!(run.blocks.contains(&Block::Code("blazeremap run [OPTIONS]".to_string())));
+        let profile = run
+            .blocks
+            .iter()
+            .find_map(|block| match block {
+                Block::Item(term, help) if term.starts_with("-p, --profile") => Some(help),
+                _ => None,
+            })
+            .unwrap();
+        assert!(profile.contains("[env: BLAZEREMAP_PROFILE]"), "{}", profile);
+        let root = page(&pages, "blazeremap");
+        let detect = Block::Item(
+            "blazeremap-detect(1)".to_string(),
+            "Detect gamepads connected to your computer (also 'ls')".to_string(),
+        );
+        assert!(root.blocks.contains(&detect));
+        // Global flags show everywhere
+        assert!(
+            run.blocks
+                .iter()
+                .any(|block| matches!(block, Block::Item(term, _) if term == "-q, --quiet"))
+        );
+    }
+
+    #[test]
+    fn test_render_man_and_markdown() {
+        let page = Page {
+            name: "blazeremap-demo".to_string(),
+            section: 1,
+            summary: "A demo".to_string(),
+            blocks: vec![
+                Block::Heading("Options".to_string()),
+                Block::Item("-n, --lines <N>".to_string(), "Lines to show".to_string()),
+                Block::Item("--all".to_string(), "Every line".to_string()),
+                Block::Paragraph(".dotfiles and back\\slashes".to_string()),
+            ],
+        };
+        let man = page.render(Format::Man);
+        assert!(man.starts_with(".TH \"BLAZEREMAP-DEMO\" \"1\""), "{}", man);
+        assert!(man.contains(".SH NAME\nblazeremap\\-demo \\- A demo\n"), "{}", man);
+        assert!(man.contains(".SH OPTIONS\n.TP\n\\fB\\-n, \\-\\-lines <N>\\fR\nLines to show\n"));
+        assert!(man.contains(".PP\n\\&.dotfiles and back\\eslashes\n"), "{}", man);
+
+        assert_eq!(
+            page.render(Format::Markdown),
+            "# blazeremap-demo(1)\n\nA demo\n\n## Options\n\n- `-n, --lines <N>`: Lines to show\n\
+             - `--all`: Every line\n\n.dotfiles and back\\slashes\n"
+        );
+    }
+
+    #[test]
+    fn test_write_pages() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-gen-{}", std::process::id()));
+        let pages = pages(super::super::build_cli());
+        write_pages(&pages, Format::Man, &dir).unwrap();
+        let root = std::fs::read_to_string(dir.join("blazeremap.1")).unwrap();
+        assert!(root.contains(".SH EXIT STATUS"), "{}", root);
+        assert!(dir.join("blazeremap-profiles.5").exists());
+        write_pages(&pages, Format::Markdown, &dir).unwrap();
+        assert!(dir.join("blazeremap-run.md").exists());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,170 @@
+// Latency command - measure end-to-end remapping overhead
+use crate::output::identity::VirtualDeviceIdentity;
+use crate::platform;
+use anyhow::{Context, Result};
+use clap::{Arg, ArgMatches, Command, value_parser};
+use std::io::Write;
+use std::time::Duration;
+
+pub fn command() -> Command {
+    Command::new("latency")
+        .about("Measure added latency by routing synthetic events through the remapper")
+        .long_about(
+            "Measure added latency by routing synthetic events through the remapper.\n\n\
+             Injects South button presses into the controller's event node, maps them \
+             through the engine and virtual keyboard, and reads the resulting key back. \
+             Other programs reading the controller will see the injected presses too.",
+        )
+        .arg(
+            Arg::new("device")
+                .short('d')
+                .long("device")
+                .help("Controller alias, index from 'detect' or device path (asked for if several are connected)"),
+        )
+        .arg(
+            Arg::new("samples")
+                .short('n')
+                .long("samples")
+                .value_parser(value_parser!(usize))
+                .default_value("200")
+                .help("Number of press/release round trips to measure"),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let samples = *matches.get_one::<usize>("samples").unwrap();
+    let manager = platform::new_input_manager()?;
+
+    let device_path = super::device_path(manager.as_ref(), matches.get_one::<String>("device"))?;
+
+    let latencies = measure(&device_path, samples, manager.as_ref())?;
+
+    let mut output = std::io::stdout();
+    write_report(&mut output, &latencies, samples)?;
+    Ok(())
+}
+
+#[cfg(target_os = "linux")]
+fn measure(
+    device_path: &str,
+    samples: usize,
+    manager: &dyn crate::input::InputManager,
+) -> Result<Vec<Duration>> {
+    use crate::event::{ButtonCode, EventLoop, KeyboardCode};
+    use crate::mapping::MappingEngine;
+    use crate::platform::linux::probe::{EventInjector, KeyReadback};
+    use std::time::Instant;
+
+    // Injected button and the key the hardcoded mappings turn it into
+    const PROBE_BUTTON: ButtonCode = ButtonCode::South;
+    const PROBE_KEY: KeyboardCode = KeyboardCode::S;
+    const READBACK_TIMEOUT: Duration = Duration::from_millis(500);
+
+    let gamepad = manager.open_gamepad(device_path).context("Failed to open controller")?;
+    let mut injector = EventInjector::open(device_path)?;
+
+    let mut keyboard =
+        platform::new_virtual_keyboard(&VirtualDeviceIdentity::named("BlazeRemap Latency Probe"))?;
+    let mut readback = KeyReadback::open_sys_path(&keyboard.sys_path()?)?;
+
+    let mut event_loop = EventLoop::new(gamepad, MappingEngine::new_hardcoded(), keyboard);
+
+    // Give udev a moment to settle on the new virtual device
+    std::thread::sleep(Duration::from_millis(200));
+
+    progress!("Measuring {} round trips on {}...", samples, device_path);
+
+    let mut latencies = Vec::with_capacity(samples * 2);
+    for _ in 0..samples {
+        for pressed in [true, false] {
+            let start = Instant::now();
+            injector.inject_button(PROBE_BUTTON, pressed)?;
+            if !event_loop.step()? {
+                anyhow::bail!("Controller disconnected during measurement");
+            }
+            match readback.wait_for(PROBE_KEY, pressed, READBACK_TIMEOUT)? {
+                Some(seen) => latencies.push(seen - start),
+                None => tracing::warn!("Injected event was not read back within timeout"),
+            }
+        }
+    }
+
+    Ok(latencies)
+}
+
+#[cfg(not(target_os = "linux"))]
+fn measure(
+    _device_path: &str,
+    _samples: usize,
+    _manager: &dyn crate::input::InputManager,
+) -> Result<Vec<Duration>> {
+    Err(platform::PlatformError::unsupported("latency measurement").into())
+}
+
+/// Nearest-rank percentile of an ascending slice
+fn percentile(sorted: &[Duration], p: f64) -> Duration {
+    let rank = ((p / 100.0) * sorted.len() as f64).ceil() as usize;
+    sorted[rank.clamp(1, sorted.len()) - 1]
+}
+
+/// Internal function that writes to any writer (testable!)
+fn write_report<W: Write>(writer: &mut W, latencies: &[Duration], samples: usize) -> Result<()> {
+    if latencies.is_empty() {
+        anyhow::bail!("No injected events were read back; is the controller grabbed elsewhere?");
+    }
+
+    let mut sorted = latencies.to_vec();
+    sorted.sort();
+
+    let lost = (samples * 2).saturating_sub(latencies.len());
+    writeln!(writer, "\nEnd-to-end latency ({} events, {} lost):", latencies.len(), lost)?;
+    for (label, value) in [
+        ("min", sorted[0]),
+        ("p50", percentile(&sorted, 50.0)),
+        ("p95", percentile(&sorted, 95.0)),
+        ("p99", percentile(&sorted, 99.0)),
+        ("max", sorted[sorted.len() - 1]),
+    ] {
+        writeln!(
+            writer,
+            "  {}: {:>8}µs ({:.3}ms)",
+            label,
+            value.as_micros(),
+            value.as_secs_f64() * 1000.0
+        )?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn us(values: &[u64]) -> Vec<Duration> {
+        values.iter().map(|&v| Duration::from_micros(v)).collect()
+    }
+
+    #[test]
+    fn test_percentile_nearest_rank() {
+        let sorted = us(&(1..=100).collect::<Vec<_>>());
+        assert_eq!(percentile(&sorted, 50.0), Duration::from_micros(50));
+        assert_eq!(percentile(&sorted, 99.0), Duration::from_micros(99));
+        assert_eq!(percentile(&us(&[7]), 95.0), Duration::from_micros(7));
+    }
+
+    #[test]
+    fn test_report_lists_percentiles_and_losses() {
+        let mut output = Vec::new();
+        write_report(&mut output, &us(&[30, 10, 20]), 2).unwrap();
+
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("3 events, 1 lost"));
+        assert!(text.contains("p50:       20µs"));
+        assert!(text.contains("max:       30µs"));
+    }
+
+    #[test]
+    fn test_report_fails_without_samples() {
+        assert!(write_report(&mut Vec::new(), &[], 10).is_err());
+    }
+}
@@ -0,0 +1,184 @@
+// Logs command - show the log the daemons keep
+use std::fs::File;
+use std::io::{Read, Seek, SeekFrom, Write};
+use std::path::Path;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use clap::{Arg, ArgAction, ArgMatches, Command, value_parser};
+
+use crate::logging::{self, Rotation};
+
+/// How often `--follow` looks for new lines
+const POLL: Duration = Duration::from_millis(250);
+
+pub fn command() -> Command {
+    Command::new("logs")
+        .about("Show the end of the log 'run' and 'serve' keep")
+        .long_about(
+            "Show the end of the log 'run' and 'serve' keep.\n\n\
+             The log is $XDG_STATE_HOME/blazeremap/blazeremap.log, rotated at 10 MiB or \
+             once a day with the last 5 kept; lines reach back into the rotated ones. \
+             Start a daemon with BLAZEREMAP_LOG set, like debug or \
+             blazeremap::output=trace, to log more than info.\n\n\
+             A daemon systemd started logs to the journal instead, with its fields as \
+             journal fields; see 'journalctl --user -u UNIT -o verbose'.\n\n\
+             --audit shows the audit log instead: $XDG_STATE_HOME/blazeremap/audit.log, \
+             where profile loads, device grabs and changes asked for over the control \
+             socket or the API are kept for good.",
+        )
+        .arg(
+            Arg::new("lines")
+                .short('n')
+                .long("lines")
+                .value_parser(value_parser!(usize))
+                .default_value("20")
+                .help("Number of lines to show"),
+        )
+        .arg(
+            Arg::new("follow")
+                .short('f')
+                .long("follow")
+                .action(ArgAction::SetTrue)
+                .help("Keep showing lines as they're logged, until Ctrl+C"),
+        )
+        .arg(
+            Arg::new("json")
+                .long("json")
+                .action(ArgAction::SetTrue)
+                .help("Show the lines as logged, one JSON object each"),
+        )
+        .arg(
+            Arg::new("audit")
+                .long("audit")
+                .action(ArgAction::SetTrue)
+                .help("Show the audit log of profile loads, grabs and requested changes"),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let audit = matches.get_flag("audit");
+    let (path, keep) = match audit {
+        true => (crate::audit::audit_path()?, 0),
+        false => (logging::log_path()?, Rotation::default().keep),
+    };
+    let count = *matches.get_one::<usize>("lines").unwrap();
+    let format: Format = match (matches.get_flag("json"), audit) {
+        (true, _) => as_logged,
+        (false, true) => crate::audit::format_line,
+        (false, false) => logging::format_line,
+    };
+    let follow = matches.get_flag("follow");
+
+    let mut out = std::io::stdout();
+    let lines = last_lines(&path, keep, count)?;
+    if lines.is_empty() && !follow {
+        println!("Nothing logged yet at {}", path.display());
+        return Ok(());
+    }
+    for line in &lines {
+        write_line(&mut out, line, format)?;
+    }
+    if follow {
+        follow_log(&mut out, &path, format)?;
+    }
+    Ok(())
+}
+
+/// How a log line is shown
+type Format = fn(&str) -> String;
+
+fn as_logged(line: &str) -> String {
+    line.to_string()
+}
+
+/// The last `count` lines of the log at `path`, reaching back into the
+/// `keep` rotated ones as needed
+fn last_lines(path: &Path, keep: usize, count: usize) -> Result<Vec<String>> {
+    let mut lines = Vec::new();
+    for n in 0..=keep {
+        if lines.len() >= count {
+            break;
+        }
+        let file = match n {
+            0 => path.to_path_buf(),
+            n => logging::rotated_path(path, n),
+        };
+        let text = match std::fs::read(&file) {
+            Ok(bytes) => String::from_utf8_lossy(&bytes).into_owned(),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => continue,
+            Err(e) => return Err(e).with_context(|| format!("Failed to read {}", file.display())),
+        };
+        let mut older: Vec<String> = text.lines().map(str::to_string).collect();
+        older.append(&mut lines);
+        lines = older;
+    }
+    Ok(lines.split_off(lines.len().saturating_sub(count)))
+}
+
+/// Show lines as they're added to the log at `path`, from a new file when
+/// it's rotated
+fn follow_log<W: Write>(out: &mut W, path: &Path, format: Format) -> Result<()> {
+    let mut offset = std::fs::metadata(path).map(|metadata| metadata.len()).unwrap_or(0);
+    let mut partial = String::new();
+    loop {
+        out.flush()?;
+        std::thread::sleep(POLL);
+        let Ok(mut file) = File::open(path) else {
+            continue;
+        };
+        let len = file.metadata()?.len();
+        // Shorter than what was read: rotated, so start over
+        if len < offset {
+            offset = 0;
+            partial.clear();
+        }
+        if len == offset {
+            continue;
+        }
+        file.seek(SeekFrom::Start(offset))?;
+        let mut bytes = Vec::new();
+        offset += file.read_to_end(&mut bytes)? as u64;
+        partial.push_str(&String::from_utf8_lossy(&bytes));
+        while let Some(end) = partial.find('\n') {
+            let line: String = partial.drain(..=end).collect();
+            write_line(out, line.trim_end(), format)?;
+        }
+    }
+}
+
+fn write_line<W: Write>(out: &mut W, line: &str, format: Format) -> Result<()> {
+    writeln!(out, "{}", format(line))?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_last_lines_reach_into_rotated_logs() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-logs-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("blazeremap.log");
+        std::fs::write(&path, "e\nf\n").unwrap();
+        std::fs::write(logging::rotated_path(&path, 1), "c\nd\n").unwrap();
+        std::fs::write(logging::rotated_path(&path, 2), "a\nb\n").unwrap();
+
+        assert_eq!(last_lines(&path, 5, 3).unwrap(), ["d", "e", "f"]);
+        assert_eq!(last_lines(&path, 1, 10).unwrap(), ["c", "d", "e", "f"]);
+        assert!(last_lines(&dir.join("missing.log"), 5, 3).unwrap().is_empty());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_lines_shown_readable_or_as_logged() {
+        let line =
+            r#"{"time":"2026-10-16T08:30:00.000Z","level":"INFO","target":"t","message":"hi"}"#;
+        let mut out = Vec::new();
+        write_line(&mut out, line, logging::format_line).unwrap();
+        write_line(&mut out, line, as_logged).unwrap();
+        let text = String::from_utf8(out).unwrap();
+        assert_eq!(text, format!("2026-10-16T08:30:00.000Z  INFO t: hi\n{}\n", line));
+    }
+}
@@ -0,0 +1,260 @@
+// Map command - remap with binds given as flags, without a profile file
+use crate::{
+    Gamepad, InputManager,
+    audit::{self, AuditEvent},
+    event::EventLoop,
+    input::gamepad::{BufferedGamepad, buffered::DEFAULT_RING_CAPACITY},
+    mapping::{
+        MappingEngine,
+        quick::{Bind, QuickMap},
+    },
+    output::{
+        desktop::{DesktopMode, DesktopSpeed},
+        devices::{DeviceKinds, VirtualDevices},
+        identity::{DeviceIdentities, VirtualDeviceIdentity},
+        keyboard::VirtualKeyboard,
+        mouse::VirtualMouse,
+    },
+    platform,
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgMatches, Command, value_parser};
+
+pub fn command() -> Command {
+    Command::new("map")
+        .about("Remap with bindings given on the command line, without a profile")
+        .long_about(
+            "Remap with bindings given on the command line, without a profile, for quick \
+             experiments and simple setups:\n\n  \
+             blazeremap map --bind BTN_SOUTH=KEY_SPACE --bind ABS_RX=mouse-x\n\n\
+             Controls go by their evdev names (BTN_SOUTH, BTN_DPAD_UP, ABS_HAT0Y-, ABS_RX) or \
+             their profile names (South, DPad Up, Right X). Buttons and D-pad directions press \
+             keys (KEY_SPACE or Space), mouse buttons (BTN_LEFT or mouse-left) or turn the wheel \
+             a notch (wheel-up); a stick axis moves the pointer (mouse-x, mouse-y) or the wheel \
+             (wheel-x, wheel-y). A later bind of the same control wins.",
+        )
+        .arg(
+            Arg::new("device")
+                .short('d')
+                .long("device")
+                .value_name("ALIAS|INDEX|PATH")
+                .help("Controller to use (auto-detect if not specified)"),
+        )
+        .arg(
+            Arg::new("bind")
+                .short('b')
+                .long("bind")
+                .value_name("SOURCE=TARGET")
+                .required(true)
+                .action(clap::ArgAction::Append)
+                .value_parser(|text: &str| text.parse::<Bind>())
+                .help("Bind a control, e.g. BTN_SOUTH=KEY_SPACE or ABS_RX=mouse-x (repeatable)"),
+        )
+        .arg(
+            Arg::new("pointer-speed")
+                .long("pointer-speed")
+                .value_name("PIXELS")
+                .default_value("1200")
+                .value_parser(value_parser!(f32))
+                .help("Pixels a second the pointer moves with the stick all the way out"),
+        )
+        .arg(
+            Arg::new("scroll-speed")
+                .long("scroll-speed")
+                .value_name("NOTCHES")
+                .default_value("12")
+                .value_parser(value_parser!(f32))
+                .help("Wheel notches a second with the stick all the way out"),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let manager = platform::new_input_manager()?;
+    platform::check_virtual_device_access()?;
+    run_internal(
+        matches,
+        manager.as_ref(),
+        platform::new_virtual_keyboard,
+        platform::new_virtual_mouse,
+    )
+}
+
+fn run_internal<K, M>(
+    matches: &ArgMatches,
+    manager: &dyn InputManager,
+    make_keyboard: K,
+    make_mouse: M,
+) -> Result<()>
+where
+    K: FnOnce(&VirtualDeviceIdentity) -> Result<Box<dyn VirtualKeyboard>> + 'static,
+    M: FnOnce(&VirtualDeviceIdentity) -> Result<Box<dyn VirtualMouse>>,
+{
+    let binds: Vec<Bind> = matches.get_many::<Bind>("bind").unwrap().copied().collect();
+    let quick = QuickMap::new(&binds);
+    let engine = MappingEngine::load_from_profile(&quick.profile)?;
+
+    let path = super::device_path(manager, matches.get_one::<String>("device"))?;
+    let _claim = platform::claim_devices(std::slice::from_ref(&path))?;
+    let controller = manager.open_gamepad(&path).context("Failed to open controller")?;
+    progress!("Using: {}", controller.get_info().name);
+    audit::record(AuditEvent::ProfileLoaded { profile: quick.profile.name.clone(), file: None });
+    let controller = BufferedGamepad::spawn(controller, DEFAULT_RING_CAPACITY)
+        .context("Failed to start controller reader")?;
+
+    // Sticks bound to the pointer are read by desktop mode, with a mouse of
+    // its own; it never switches off
+    let identities = DeviceIdentities::default();
+    let controller: Box<dyn Gamepad> = match quick.mouse {
+        Some(controls) => {
+            let mouse = make_mouse(&identities.mouse("BlazeRemap Virtual Mouse"))
+                .context("Failed to create virtual mouse")?;
+            let speed = DesktopSpeed {
+                pointer: *matches.get_one::<f32>("pointer-speed").unwrap(),
+                scroll: *matches.get_one::<f32>("scroll-speed").unwrap(),
+            };
+            Box::new(
+                DesktopMode::new(Box::new(controller), mouse, speed, Vec::new())
+                    .with_controls(controls),
+            )
+        }
+        None => Box::new(controller),
+    };
+
+    let keyboard = identities.keyboard("BlazeRemap Virtual Keyboard");
+    let mouse = identities.mouse("BlazeRemap Virtual Mouse");
+    let mut devices = VirtualDevices::new()
+        .with_lazy_keyboard(move || make_keyboard(&keyboard))
+        .with_lazy_mouse(move || platform::new_virtual_mouse(&mouse));
+    let kinds = DeviceKinds::for_profile(&quick.profile);
+    if kinds != DeviceKinds::default() {
+        progress!("Creating virtual {}...", kinds);
+    }
+    devices.prepare(kinds)?;
+
+    progress!("\nBlazeRemap is now running!");
+    progress!("Mappings:");
+    for bind in &binds {
+        progress!("  {}", bind);
+    }
+    progress!("\nPress Ctrl+C to exit.\n");
+    EventLoop::for_devices(controller, engine, devices).run()?;
+
+    progress!("BlazeRemap stopped.");
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{
+        AxisCode, ButtonCode, InputEvent, KeyboardCode, KeyboardEventType, OutputEvent,
+    };
+    use crate::input::gamepad::{GamepadInfo, GamepadType, MockGamepad};
+    use crate::input::manager::MockInputManager;
+    use crate::output::keyboard::MockVirtualKeyboard;
+    use crate::output::mouse::MouseEvent;
+    use std::path::PathBuf;
+    use std::sync::{Arc, Mutex};
+
+    /// Shares the frames it was sent with the test
+    struct FakeMouse(Arc<Mutex<Vec<Vec<MouseEvent>>>>);
+
+    impl VirtualMouse for FakeMouse {
+        fn emit_frame(&mut self, events: &[MouseEvent]) -> Result<()> {
+            self.0.lock().unwrap().push(events.to_vec());
+            Ok(())
+        }
+
+        fn dev_node(&mut self) -> Result<PathBuf> {
+            Ok(PathBuf::from("/dev/input/event98"))
+        }
+    }
+
+    fn test_info() -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/eventX".to_string(),
+            name: "Test Gamepad".to_string(),
+            gamepad_type: GamepadType::XboxOne,
+            vendor_id: 0,
+            vendor_name: "".to_string(),
+            product_id: 0,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
+    #[test]
+    fn test_map_binds_keys_and_the_pointer() {
+        let mut manager = MockInputManager::new();
+        manager.expect_open_gamepad().with(mockall::predicate::eq("/dev/input/eventX")).returning(
+            |_| {
+                let mut events = vec![
+                    InputEvent::button_press(ButtonCode::South),
+                    // Bound to nothing, so nothing is sent
+                    InputEvent::button_press(ButtonCode::East),
+                    InputEvent::axis_move(AxisCode::RightX, 32767),
+                    InputEvent::sync(),
+                ]
+                .into_iter();
+                let mut gamepad = MockGamepad::new();
+                gamepad.expect_get_info().returning(test_info);
+                gamepad.expect_read_event().returning(move || Ok(events.next()));
+                Ok(Box::new(gamepad))
+            },
+        );
+
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard
+            .expect_emit_frame()
+            .withf(|events| {
+                events
+                    == [OutputEvent::Keyboard {
+                        code: KeyboardCode::Space,
+                        event_type: KeyboardEventType::Press,
+                    }]
+            })
+            .times(1)
+            .returning(|_| Ok(()));
+        let frames = Arc::new(Mutex::new(Vec::new()));
+        let made = Arc::new(Mutex::new(false));
+        let (sent, mouse_made) = (Arc::clone(&frames), Arc::clone(&made));
+
+        let matches = command().get_matches_from([
+            "map",
+            "-d",
+            "/dev/input/eventX",
+            "--bind",
+            "BTN_SOUTH=KEY_SPACE",
+            "--bind",
+            "ABS_RX=mouse-x",
+        ]);
+        run_internal(
+            &matches,
+            &manager,
+            |_| Ok(Box::new(keyboard)),
+            move |_| {
+                *mouse_made.lock().unwrap() = true;
+                Ok(Box::new(FakeMouse(sent)))
+            },
+        )
+        .unwrap();
+
+        // The stick went to the pointer, across only
+        assert!(*made.lock().unwrap());
+        let frames = frames.lock().unwrap();
+        assert!(
+            frames.iter().flatten().all(|event| matches!(event, MouseEvent::Move { dy: 0, .. }))
+        );
+    }
+
+    #[test]
+    fn test_map_needs_a_valid_bind() {
+        assert!(command().try_get_matches_from(["map"]).is_err());
+        let error = command()
+            .try_get_matches_from(["map", "--bind", "ABS_X=KEY_A"])
+            .unwrap_err()
+            .to_string();
+        assert!(error.contains("bind it to mouse-x"), "{}", error);
+    }
+}
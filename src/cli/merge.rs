@@ -0,0 +1,216 @@
+// Merge command - several controllers presented to games as one
+use crate::{
+    event::InputEvent,
+    input::{
+        InputManager,
+        composite::{self, Source},
+    },
+    output::gamepad::{VirtualGamepad, VirtualGamepadIdentity},
+    platform,
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgAction, ArgMatches, Command};
+use std::io::Write;
+
+pub fn command() -> Command {
+    Command::new("merge")
+        .about("Combine several controllers into one virtual controller")
+        .long_about(
+            "Combine several controllers into one virtual controller.\n\n\
+             A flight stick and a throttle quadrant, or two Joy-Cons, show up to games as a \
+             single controller. Controls the devices share are renamed on the device that \
+             shouldn't keep them, after its path:\n\n  \
+             blazeremap merge -d /dev/input/event3 -d /dev/input/event5:LeftY=RightTrigger\n\n\
+             FROM=TO renames a button or an axis (an axis renamed to a trigger is rescaled), \
+             FROM=none drops it. The devices are grabbed, so games only see their input \
+             through the merged controller.",
+        )
+        .arg(
+            Arg::new("device")
+                .short('d')
+                .long("device")
+                .value_name("DEVICE[:FROM=TO,...]")
+                .value_parser(|text: &str| text.parse::<Source>())
+                .action(ArgAction::Append)
+                .required(true)
+                .help("Device to merge, repeat for each; FROM=TO renames its controls"),
+        )
+        .arg(super::simulate::type_arg())
+        .arg(
+            Arg::new("name")
+                .long("name")
+                .default_value("BlazeRemap Merged Controller")
+                .help("Device name of the merged controller"),
+        )
+        .arg(
+            Arg::new("no-grab")
+                .long("no-grab")
+                .action(ArgAction::SetTrue)
+                .help("Leave the devices' own input to other programs too"),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let manager = platform::new_input_manager()?;
+    platform::check_virtual_device_access()?;
+    run_internal(&mut std::io::stdout(), manager.as_ref(), matches, platform::new_virtual_gamepad)
+}
+
+fn run_internal<W, F>(
+    writer: &mut W,
+    manager: &dyn InputManager,
+    matches: &ArgMatches,
+    make_gamepad: F,
+) -> Result<()>
+where
+    W: Write,
+    F: FnOnce(&VirtualGamepadIdentity) -> Result<Box<dyn VirtualGamepad>>,
+{
+    let sources: Vec<Source> = matches
+        .get_many::<Source>("device")
+        .unwrap()
+        .cloned()
+        .map(|source| super::run::resolve_source(manager, source))
+        .collect::<Result<_>>()?;
+    let mut identity = VirtualGamepadIdentity::simulated(super::simulate::gamepad_type(matches));
+    identity.name = matches.get_one::<String>("name").unwrap().clone();
+
+    let _claim = platform::claim_devices(&composite::paths(&sources))?;
+    let mut controller = manager
+        .open_composite(&sources, !matches.get_flag("no-grab"))
+        .context("Failed to open controllers")?;
+    let mut gamepad = make_gamepad(&identity).context("Failed to create virtual controller")?;
+    writeln!(
+        writer,
+        "Merging {} into {} at {} (Ctrl+C to stop)",
+        controller.get_info().name,
+        identity.name,
+        gamepad.dev_node()?.display()
+    )?;
+
+    let frames = forward_frames(controller.as_mut(), gamepad.as_mut())?;
+    writeln!(writer, "Controllers disconnected after {} frames", frames)?;
+    Ok(())
+}
+
+/// Emit what `controller` reads to `gamepad` frame by frame, until every
+/// device is gone; returns the number of frames
+pub(super) fn forward_frames(
+    controller: &mut dyn crate::input::Gamepad,
+    gamepad: &mut dyn VirtualGamepad,
+) -> Result<usize> {
+    let mut frame = Vec::new();
+    let mut frames = 0;
+    while let Some(event) = controller.read_event()? {
+        if !matches!(event, InputEvent::Sync { .. }) {
+            frame.push(event);
+            continue;
+        }
+        if !frame.is_empty() {
+            gamepad.emit_frame(&frame)?;
+            frame.clear();
+            frames += 1;
+        }
+    }
+    Ok(frames)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{AxisCode, ButtonCode};
+    use crate::input::gamepad::{GamepadInfo, GamepadType, MockGamepad};
+    use crate::input::manager::MockInputManager;
+    use std::path::PathBuf;
+    use std::sync::{Arc, Mutex};
+
+    /// Shares the frames it was sent with the test
+    struct FakeGamepad(Arc<Mutex<Vec<Vec<InputEvent>>>>);
+
+    impl VirtualGamepad for FakeGamepad {
+        fn emit_frame(&mut self, events: &[InputEvent]) -> Result<()> {
+            self.0.lock().unwrap().push(events.to_vec());
+            Ok(())
+        }
+
+        fn dev_node(&mut self) -> Result<PathBuf> {
+            Ok(PathBuf::from("/dev/input/event99"))
+        }
+    }
+
+    fn info() -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Flight Stick + Throttle".to_string(),
+            gamepad_type: GamepadType::Generic,
+            vendor_id: 0,
+            vendor_name: "".to_string(),
+            product_id: 0,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
+    #[test]
+    fn test_merge_forwards_frames() {
+        let mut events = vec![
+            InputEvent::button_press(ButtonCode::South),
+            InputEvent::axis_move(AxisCode::RightTrigger, 512),
+            InputEvent::sync(),
+            InputEvent::sync(),
+            InputEvent::axis_move(AxisCode::LeftX, -32768),
+            InputEvent::sync(),
+        ]
+        .into_iter();
+        let mut controller = MockGamepad::new();
+        controller.expect_get_info().returning(info);
+        controller.expect_read_event().returning(move || Ok(events.next()));
+        let mut controller = Some(controller);
+
+        let mut manager = MockInputManager::new();
+        manager
+            .expect_open_composite()
+            .withf(|sources, grab| sources.len() == 2 && *grab)
+            .return_once(move |_, _| Ok(Box::new(controller.take().unwrap())));
+
+        let matches = command().get_matches_from([
+            "merge",
+            "-d",
+            "/dev/input/event3",
+            "-d",
+            "/dev/input/event5:LeftY=RightTrigger",
+            "--type",
+            "xbox-series",
+        ]);
+        let frames = Arc::new(Mutex::new(Vec::new()));
+        let sent = Arc::clone(&frames);
+        let mut output = Vec::new();
+        run_internal(&mut output, &manager, &matches, |identity| {
+            assert_eq!(identity.name, "BlazeRemap Merged Controller");
+            assert_eq!(identity.product_id, 0x0b12);
+            Ok(Box::new(FakeGamepad(sent)))
+        })
+        .unwrap();
+
+        let sizes: Vec<_> = frames.lock().unwrap().iter().map(Vec::len).collect();
+        assert_eq!(sizes, [2, 1]);
+        let output = String::from_utf8(output).unwrap();
+        assert!(
+            output.starts_with(
+                "Merging Flight Stick + Throttle into BlazeRemap Merged Controller at \
+                 /dev/input/event99"
+            ),
+            "{}",
+            output
+        );
+        assert!(output.ends_with("disconnected after 2 frames\n"), "{}", output);
+    }
+
+    #[test]
+    fn test_requires_devices() {
+        assert!(command().try_get_matches_from(["merge"]).is_err());
+        assert!(command().try_get_matches_from(["merge", "-d", "/dev/x:South"]).is_ok());
+        assert!(command().try_get_matches_from(["merge", "-d", "/dev/x:South=Jump"]).is_err());
+    }
+}
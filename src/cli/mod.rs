@@ -1,10 +1,71 @@
 // CLI module - command definitions and handling
+//
+// Commands are named for what they do (detect, run, record) or for what
+// they manage, with a verb under it (alias list, profile lint). A verb means
+// the same under every command and has the same short forms: list (ls),
+// remove (rm) and create (new). A command given where it isn't, like
+// 'blazeremap lint', gets a tip naming where it is.
+
+/// println! for progress and banners, which --quiet leaves out
+macro_rules! progress {
+    ($($arg:tt)*) => {
+        if !$crate::cli::quiet() {
+            println!($($arg)*);
+        }
+    };
+}
+
+mod alias;
+mod axis_view;
+mod calibration;
+mod desktop;
 mod detect;
+mod diagnose;
+mod doctor;
+mod emulate;
+mod forward;
+mod generate;
+mod latency;
+mod logs;
+mod map;
+mod merge;
+mod picker;
+mod players;
+mod profile;
 mod read;
+mod recenter;
+mod record;
+mod replay;
 mod run;
+mod serve;
+mod setup;
+mod simulate;
+mod spinner;
+mod status;
 mod test_keyboard;
+mod test_mouse;
+mod trace;
+
+use clap::{Arg, ArgAction, Command};
+use std::io::IsTerminal;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+use crate::exit::ExitCode;
 
-use clap::Command;
+/// Set by --quiet
+static QUIET: AtomicBool = AtomicBool::new(false);
+/// Set when stdin and stdout are a terminal, with someone to answer
+static INTERACTIVE: AtomicBool = AtomicBool::new(false);
+
+/// Whether to leave out progress and banners, for scripts
+pub fn quiet() -> bool {
+    QUIET.load(Ordering::Relaxed)
+}
+
+/// Whether someone at a terminal can be asked; never in tests
+pub(crate) fn interactive() -> bool {
+    INTERACTIVE.load(Ordering::Relaxed)
+}
 
 /// Build the root CLI command structure
 pub fn build_cli() -> Command {
@@ -14,21 +75,263 @@ pub fn build_cli() -> Command {
         .about("Linux keyboard-to-gamepad remapping software")
         .subcommand_required(true)
         .arg_required_else_help(true)
+        .arg(
+            Arg::new("quiet")
+                .long("quiet")
+                .short('q')
+                .global(true)
+                .action(ArgAction::SetTrue)
+                .help("Leave out progress messages and banners; results and errors still print"),
+        )
+        .subcommand(alias::command())
+        .subcommand(calibration::command())
+        .subcommand(desktop::command())
         .subcommand(detect::command())
+        .subcommand(diagnose::command())
+        .subcommand(doctor::command())
+        .subcommand(emulate::command())
+        .subcommand(forward::command())
+        .subcommand(generate::command())
+        .subcommand(latency::command())
+        .subcommand(logs::command())
+        .subcommand(map::command())
+        .subcommand(merge::command())
+        .subcommand(players::command())
+        .subcommand(profile::command())
         .subcommand(read::command())
+        .subcommand(recenter::command())
+        .subcommand(record::command())
+        .subcommand(replay::command())
         .subcommand(run::command())
+        .subcommand(serve::command())
+        .subcommand(setup::command())
+        .subcommand(simulate::command())
+        .subcommand(status::command())
         .subcommand(test_keyboard::command())
+        .subcommand(test_mouse::command())
+        .subcommand(trace::command())
 }
 
 /// Execute the CLI and handle the result
 pub fn execute() -> anyhow::Result<()> {
-    let matches = build_cli().get_matches();
+    let matches = build_cli().try_get_matches().unwrap_or_else(|e| {
+        // Like clap's own exit, but with a code of our own for usage errors
+        let e = with_nested_tip(&build_cli(), e);
+        let _ = e.print();
+        let code = if e.use_stderr() { ExitCode::Usage } else { ExitCode::Success };
+        std::process::exit(code.code())
+    });
+    QUIET.store(matches.get_flag("quiet"), Ordering::Relaxed);
+    let terminal = std::io::stdin().is_terminal() && std::io::stdout().is_terminal();
+    INTERACTIVE.store(terminal, Ordering::Relaxed);
+    // The daemons keep a log file too
+    crate::logging::init(matches!(matches.subcommand_name(), Some("run" | "serve")));
+    // So do the commands that grab devices or load profiles for remapping
+    if matches!(matches.subcommand_name(), Some("run" | "serve" | "merge" | "emulate" | "map")) {
+        crate::audit::init();
+    }
+
+    if let Some((name, _)) = matches.subcommand()
+        && needs_devices(name)
+        && forward_if_sandboxed()?
+    {
+        return Ok(());
+    }
 
     match matches.subcommand() {
+        Some(("alias", sub_matches)) => alias::handle(sub_matches),
+        Some(("calibration", sub_matches)) => calibration::handle(sub_matches),
+        Some(("desktop", sub_matches)) => desktop::handle(sub_matches),
         Some(("detect", sub_matches)) => detect::handle(sub_matches),
+        Some(("diagnose", sub_matches)) => diagnose::handle(sub_matches),
+        Some(("doctor", sub_matches)) => doctor::handle(sub_matches),
+        Some(("emulate", sub_matches)) => emulate::handle(sub_matches),
+        Some(("forward", sub_matches)) => forward::handle(sub_matches),
+        Some(("gen", sub_matches)) => generate::handle(sub_matches),
+        Some(("latency", sub_matches)) => latency::handle(sub_matches),
+        Some(("logs", sub_matches)) => logs::handle(sub_matches),
+        Some(("map", sub_matches)) => map::handle(sub_matches),
+        Some(("merge", sub_matches)) => merge::handle(sub_matches),
+        Some(("players", sub_matches)) => players::handle(sub_matches),
+        Some(("profile", sub_matches)) => profile::handle(sub_matches),
         Some(("read", sub_matches)) => read::handle(sub_matches),
+        Some(("recenter", sub_matches)) => recenter::handle(sub_matches),
+        Some(("record", sub_matches)) => record::handle(sub_matches),
+        Some(("replay", sub_matches)) => replay::handle(sub_matches),
         Some(("run", sub_matches)) => run::handle(sub_matches),
+        Some(("serve", sub_matches)) => serve::handle(sub_matches),
+        Some(("setup", sub_matches)) => setup::handle(sub_matches),
+        Some(("simulate", sub_matches)) => simulate::handle(sub_matches),
+        Some(("status", sub_matches)) => status::handle(sub_matches),
         Some(("test-keyboard", sub_matches)) => test_keyboard::handle(sub_matches),
+        Some(("test-mouse", sub_matches)) => test_mouse::handle(sub_matches),
+        Some(("trace", sub_matches)) => trace::handle(sub_matches),
         _ => unreachable!("Subcommand required"),
     }
 }
+
+/// `error` with a tip naming the subcommands an unknown command could have
+/// meant, when they're under another command: 'lint' for 'profile lint'
+fn with_nested_tip(cli: &Command, mut error: clap::Error) -> clap::Error {
+    use clap::builder::StyledStr;
+    use clap::error::{ContextKind, ContextValue, ErrorKind};
+
+    if error.kind() != ErrorKind::InvalidSubcommand {
+        return error;
+    }
+    let Some(ContextValue::String(name)) = error.get(ContextKind::InvalidSubcommand) else {
+        return error;
+    };
+    let found = nested_commands(cli, name);
+    if found.is_empty() {
+        return error;
+    }
+    let quoted: Vec<String> = found.iter().map(|path| format!("'{}'", path)).collect();
+    let tip = match quoted.len() {
+        1 => format!("a similar command exists under another: {}", quoted[0]),
+        _ => format!("similar commands exist under others: {}", quoted.join(", ")),
+    };
+    let mut tips = match error.get(ContextKind::Suggested) {
+        Some(ContextValue::StyledStrs(tips)) => tips.clone(),
+        _ => Vec::new(),
+    };
+    tips.push(StyledStr::from(tip));
+    error.insert(ContextKind::Suggested, ContextValue::StyledStrs(tips));
+    error
+}
+
+/// Full names of the subcommands one level down called `name`, by name or
+/// alias; failing those, of the ones close to it
+fn nested_commands(cli: &Command, name: &str) -> Vec<String> {
+    let name = name.to_lowercase();
+    // Allow about one typo per four characters, as profile lint does
+    let limit = (name.chars().count() / 4).max(1);
+    let mut exact = Vec::new();
+    let mut close = Vec::new();
+    for command in cli.get_subcommands() {
+        for sub in command.get_subcommands().filter(|sub| sub.get_name() != "help") {
+            let path = format!("{} {} {}", cli.get_name(), command.get_name(), sub.get_name());
+            let distance = std::iter::once(sub.get_name())
+                .chain(sub.get_all_aliases())
+                .map(|known| crate::mapping::lint::edit_distance(&name, known))
+                .min()
+                .unwrap_or(usize::MAX);
+            match distance {
+                0 => exact.push(path),
+                distance if distance <= limit => close.push(path),
+                _ => {}
+            }
+        }
+    }
+    if exact.is_empty() { close } else { exact }
+}
+
+/// Append the default port when the address doesn't carry one
+pub(crate) fn with_default_port(addr: &str, port: u16) -> String {
+    let has_port = match addr.rsplit_once(':') {
+        // Bare IPv6 addresses contain colons but no brackets
+        Some((host, suffix)) => {
+            suffix.parse::<u16>().is_ok() && (!host.contains(':') || host.ends_with(']'))
+        }
+        None => false,
+    };
+    if has_port { addr.to_string() } else { format!("{}:{}", addr, port) }
+}
+
+/// Path of the controller a `--device` option selects: an alias, an index
+/// from 'detect' or a device path; if absent, the one picked of several
+/// (see picker.rs)
+pub(crate) fn device_path(
+    manager: &dyn crate::input::InputManager,
+    selection: Option<&String>,
+) -> anyhow::Result<String> {
+    match selection {
+        Some(selection) => resolve_device(manager, selection),
+        None => Ok(picker::pick(&manager.list_gamepads()?.gamepad_info)?.path.clone()),
+    }
+}
+
+/// Path of the device `selection` names: an alias from 'alias set', an
+/// index from 'detect' or a device path
+pub(crate) fn resolve_device(
+    manager: &dyn crate::input::InputManager,
+    selection: &str,
+) -> anyhow::Result<String> {
+    crate::input::alias::resolve_user(manager, selection)
+}
+
+/// Read `gamepad` for `duration`, handing each event to `on_event`
+///
+/// Fails if the controller goes away before the time is up.
+pub(crate) fn read_for<F>(
+    gamepad: Box<dyn crate::input::Gamepad>,
+    duration: std::time::Duration,
+    mut on_event: F,
+) -> anyhow::Result<()>
+where
+    F: FnMut(&crate::event::InputEvent) -> anyhow::Result<()>,
+{
+    use crate::input::gamepad::{BufferedGamepad, Gamepad, buffered::DEFAULT_RING_CAPACITY};
+
+    let mut gamepad = BufferedGamepad::spawn(gamepad, DEFAULT_RING_CAPACITY)?;
+    let deadline = std::time::Instant::now() + duration;
+    while std::time::Instant::now() < deadline {
+        match gamepad.read_event_until(deadline)? {
+            Some(event) => on_event(&event)?,
+            None => anyhow::bail!("Controller disconnected while measuring"),
+        }
+    }
+    Ok(())
+}
+
+/// Commands that open input devices or create virtual ones
+fn needs_devices(name: &str) -> bool {
+    matches!(
+        name,
+        "alias"
+            | "calibration"
+            | "desktop"
+            | "detect"
+            | "diagnose"
+            | "emulate"
+            | "forward"
+            | "latency"
+            | "map"
+            | "merge"
+            | "read"
+            | "record"
+            | "run"
+            | "serve"
+            | "simulate"
+            | "test-keyboard"
+            | "test-mouse"
+    )
+}
+
+/// Hand the command off to the host when sandboxed without device access
+///
+/// Returns true if the command was run elsewhere and nothing is left to do.
+#[cfg(target_os = "linux")]
+fn forward_if_sandboxed() -> anyhow::Result<bool> {
+    use crate::platform::linux::sandbox::{self, OperationMode};
+
+    match sandbox::operation_mode() {
+        OperationMode::Direct => Ok(false),
+        OperationMode::HostHelper => {
+            tracing::info!("No device access in sandbox, forwarding command to host");
+            let status = sandbox::host_helper_command(std::env::args_os().skip(1)).status()?;
+            if !status.success() {
+                anyhow::bail!("host blazeremap exited with {}", status);
+            }
+            Ok(true)
+        }
+        OperationMode::Unavailable => anyhow::bail!(
+            "input devices are not reachable from this sandbox (run 'blazeremap doctor' for details)"
+        ),
+    }
+}
+
+#[cfg(not(target_os = "linux"))]
+fn forward_if_sandboxed() -> anyhow::Result<bool> {
+    Ok(false)
+}
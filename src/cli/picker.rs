@@ -0,0 +1,206 @@
+// Device picker - which controller to use when several are connected
+//
+// A command left to find its controller takes the only one there is. With
+// several, and someone at the terminal to answer, it lists them and lets
+// them pick with the arrow keys (or j/k, or the number) and Enter; Esc or q
+// cancels. Without a terminal, as in scripts, it fails listing them rather
+// than remap one nobody chose.
+
+use anyhow::{Result, bail};
+use std::io::{Read, Write};
+
+use crate::input::{GamepadInfo, manager::NoControllers};
+use crate::platform;
+
+/// The controller of `gamepads` to use, asking which when there are several
+/// and someone is at the terminal
+pub(crate) fn pick(gamepads: &[GamepadInfo]) -> Result<&GamepadInfo> {
+    let (first, rest) = gamepads.split_first().ok_or(NoControllers::Connected)?;
+    if rest.is_empty() {
+        return Ok(first);
+    }
+    let terminal = super::interactive().then(platform::unbuffered_terminal).flatten();
+    let Some(terminal) = terminal else {
+        bail!("{}", nobody_to_ask(gamepads));
+    };
+    let labels: Vec<String> =
+        gamepads.iter().map(|info| format!("{} ({})", info.name, info.path)).collect();
+    let chosen = choose(&mut std::io::stdout(), &mut std::io::stdin(), &labels);
+    drop(terminal);
+    match chosen? {
+        Some(index) => Ok(&gamepads[index]),
+        None => bail!("No controller picked; pass --device to choose one"),
+    }
+}
+
+/// What to pass instead, when there are several and nobody to ask
+fn nobody_to_ask(gamepads: &[GamepadInfo]) -> String {
+    let mut text = "Several controllers are connected; pass --device with one of:".to_string();
+    for info in gamepads {
+        text.push_str(&format!("\n  {}  {}", info.path, info.name));
+    }
+    text
+}
+
+/// A key the picker knows
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Key {
+    Up,
+    Down,
+    /// A number key: the controller by index
+    Index(usize),
+    Enter,
+    Cancel,
+}
+
+/// The keys in what one read of the terminal returned
+///
+/// An arrow key comes as an escape sequence in one read; Esc on its own
+/// is a read of just the escape.
+fn keys(input: &[u8]) -> Vec<Key> {
+    if input == b"\x1b" {
+        return vec![Key::Cancel];
+    }
+    let mut keys = Vec::new();
+    let mut bytes = input.iter().copied().peekable();
+    while let Some(byte) = bytes.next() {
+        match byte {
+            b'\x1b' => {
+                // CSI or SS3: ESC [ A or ESC O A
+                if bytes.next_if(|&b| b == b'[' || b == b'O').is_some() {
+                    match bytes.next() {
+                        Some(b'A') => keys.push(Key::Up),
+                        Some(b'B') => keys.push(Key::Down),
+                        _ => {}
+                    }
+                }
+            }
+            b'k' => keys.push(Key::Up),
+            b'j' => keys.push(Key::Down),
+            b'0'..=b'9' => keys.push(Key::Index(usize::from(byte - b'0'))),
+            b'\r' | b'\n' => keys.push(Key::Enter),
+            b'q' | 0x03 | 0x04 => keys.push(Key::Cancel),
+            _ => {}
+        }
+    }
+    keys
+}
+
+/// List `labels`, highlighting the selection, and read keys from `reader`
+/// until one is chosen; None if cancelled
+fn choose<W: Write, R: Read>(
+    writer: &mut W,
+    reader: &mut R,
+    labels: &[String],
+) -> Result<Option<usize>> {
+    writeln!(writer, "Several controllers are connected. Pick one (↑/↓ and Enter, Esc cancels):")?;
+    let mut selected = 0;
+    draw(writer, labels, selected)?;
+    let mut buffer = [0u8; 16];
+    loop {
+        let read = reader.read(&mut buffer)?;
+        if read == 0 {
+            return Ok(None);
+        }
+        for key in keys(&buffer[..read]) {
+            match key {
+                Key::Up => selected = selected.checked_sub(1).unwrap_or(labels.len() - 1),
+                Key::Down => selected = (selected + 1) % labels.len(),
+                Key::Index(index) if index < labels.len() => selected = index,
+                Key::Index(_) => {}
+                Key::Enter => return Ok(Some(selected)),
+                Key::Cancel => return Ok(None),
+            }
+        }
+        // Back up over the list and draw it again
+        write!(writer, "\x1b[{}A", labels.len())?;
+        draw(writer, labels, selected)?;
+    }
+}
+
+fn draw<W: Write>(writer: &mut W, labels: &[String], selected: usize) -> Result<()> {
+    for (index, label) in labels.iter().enumerate() {
+        let marker = if index == selected { '>' } else { ' ' };
+        writeln!(writer, "\r\x1b[2K {} {}  {}", marker, index, label)?;
+    }
+    writer.flush()?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn labels() -> Vec<String> {
+        [
+            "Xbox Controller (/dev/input/event3)",
+            "DualSense (/dev/input/event5)",
+            "8BitDo (/dev/input/event7)",
+        ]
+        .map(String::from)
+        .to_vec()
+    }
+
+    #[test]
+    fn test_nobody_to_ask_lists_the_controllers() {
+        let gamepad = |path: &str, name: &str| GamepadInfo {
+            path: path.to_string(),
+            name: name.to_string(),
+            gamepad_type: crate::input::GamepadType::Generic,
+            vendor_id: 0,
+            vendor_name: String::new(),
+            product_id: 0,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        };
+        let gamepads = [
+            gamepad("/dev/input/event3", "Xbox Controller"),
+            gamepad("/dev/input/event5", "DualSense"),
+        ];
+
+        assert_eq!(
+            nobody_to_ask(&gamepads),
+            "Several controllers are connected; pass --device with one of:\n  \
+             /dev/input/event3  Xbox Controller\n  \
+             /dev/input/event5  DualSense"
+        );
+        // Tests are never interactive
+        let err = pick(&gamepads).unwrap_err();
+        assert!(err.to_string().starts_with("Several controllers are connected"));
+        assert_eq!(pick(&gamepads[1..]).unwrap().name, "DualSense");
+    }
+
+    #[test]
+    fn test_keys() {
+        assert_eq!(keys(b"\x1b[A\x1b[B"), [Key::Up, Key::Down]);
+        assert_eq!(keys(b"\x1bOB"), [Key::Down]);
+        assert_eq!(keys(b"jk2\r"), [Key::Down, Key::Up, Key::Index(2), Key::Enter]);
+        assert_eq!(keys(b"\x1b"), [Key::Cancel]);
+        assert_eq!(keys(b"q"), [Key::Cancel]);
+        assert_eq!(keys(b"x"), []);
+    }
+
+    #[test]
+    fn test_choose_with_arrows() {
+        let mut output = Vec::new();
+        // Down twice and up three times, wrapping past the top; then Enter
+        let mut input = b"\x1b[B\x1b[B\x1b[A\x1b[A\x1b[A".chain(&b"\r"[..]);
+        let chosen = choose(&mut output, &mut input, &labels());
+        assert_eq!(chosen.unwrap(), Some(2));
+
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.starts_with("Several controllers are connected."), "{}", text);
+        assert!(text.ends_with("\r\x1b[2K > 2  8BitDo (/dev/input/event7)\n"), "{:?}", text);
+    }
+
+    #[test]
+    fn test_choose_by_number_or_cancel() {
+        let mut output = Vec::new();
+        assert_eq!(choose(&mut output, &mut &b"1\n"[..], &labels()).unwrap(), Some(1));
+        // Out of range numbers are ignored
+        assert_eq!(choose(&mut output, &mut &b"9\r"[..], &labels()).unwrap(), Some(0));
+        assert_eq!(choose(&mut output, &mut &b"\x1b"[..], &labels()).unwrap(), None);
+        assert_eq!(choose(&mut output, &mut &b""[..], &labels()).unwrap(), None);
+    }
+}
@@ -0,0 +1,84 @@
+use anyhow::Result;
+use clap::{Arg, Command, value_parser};
+use std::io::Write;
+use std::path::Path;
+
+use crate::{ipc, output::players::PlayerSlot};
+
+/// Build the 'players' command
+pub fn command() -> Command {
+    Command::new("players")
+        .about("Show or change the player numbers of the running daemon's controllers")
+        .long_about(
+            "Show or change the player numbers of the running daemon's controllers.\n\n\
+             Controllers are numbered in the order 'run --device' opened them, and show their \
+             number on their lights: the ring of an Xbox 360 controller, the player LEDs of a \
+             DualSense or Switch controller, or the lightbar color of a DualShock 4.",
+        )
+        .subcommand(
+            Command::new("swap")
+                .about("Trade two players' numbers")
+                .arg(Arg::new("a").required(true).value_parser(value_parser!(usize)))
+                .arg(Arg::new("b").required(true).value_parser(value_parser!(usize))),
+        )
+}
+
+/// CLI handle for the 'players' command
+pub fn handle(matches: &clap::ArgMatches) -> Result<()> {
+    run_internal(&mut std::io::stdout(), &ipc::socket_path(), matches)
+}
+
+fn run_internal<W: Write>(writer: &mut W, socket: &Path, matches: &clap::ArgMatches) -> Result<()> {
+    let request = match matches.subcommand() {
+        Some(("swap", swap)) => format!(
+            "players swap {} {}",
+            swap.get_one::<usize>("a").unwrap(),
+            swap.get_one::<usize>("b").unwrap()
+        ),
+        _ => "players".to_string(),
+    };
+    let players: Vec<PlayerSlot> = ipc::request(socket, &request)?;
+    for slot in &players {
+        let light = if slot.light { "" } else { " (no light)" };
+        writeln!(writer, "Player {}: {}{}", slot.player, slot.device, light)?;
+    }
+    Ok(())
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use crate::ipc::ControlServer;
+    use std::sync::{Arc, Mutex};
+
+    #[test]
+    fn test_sends_swaps_to_the_daemon() {
+        let path = std::env::temp_dir()
+            .join(format!("blazeremap-test-{}-players.sock", std::process::id()));
+        let received = Arc::new(Mutex::new(Vec::new()));
+        let log = Arc::clone(&received);
+        let _server = ControlServer::bind(
+            &path,
+            Arc::new(move |command, _| {
+                log.lock().unwrap().push(command.to_string());
+                Ok(serde_json::json!([
+                    { "player": 1, "device": "/dev/input/event5", "light": true },
+                    { "player": 2, "device": "/dev/input/event3", "light": false },
+                ]))
+            }),
+        )
+        .unwrap();
+
+        let mut output = Vec::new();
+        let matches = command().get_matches_from(["players", "swap", "1", "2"]);
+        run_internal(&mut output, &path, &matches).unwrap();
+        let matches = command().get_matches_from(["players"]);
+        run_internal(&mut Vec::new(), &path, &matches).unwrap();
+
+        assert_eq!(*received.lock().unwrap(), ["players swap 1 2", "players"]);
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            "Player 1: /dev/input/event5\nPlayer 2: /dev/input/event3 (no light)\n"
+        );
+    }
+}
@@ -0,0 +1,1005 @@
+use anyhow::{Context, Result};
+use clap::{Arg, ArgAction, Command};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::mpsc::{self, Receiver, TryRecvError};
+use std::time::Duration;
+
+use crate::{
+    event::{AxisCode, KeyboardCode},
+    input::{InputManager, gamepad::GamepadInfo, keyboard::KeyListener},
+    mapping::{
+        bundle::{self, Bundle, Metadata},
+        format::ProfileFormat,
+        integrity::{self, IntegrityPolicy, Verified},
+        lint::{self, Severity},
+        migrate::CURRENT_SCHEMA_VERSION,
+        profile::{BUILTIN_PROFILES, Profile},
+        teach::{Control, Lesson},
+    },
+    platform,
+    sync::{self, Outcome, Prefer},
+};
+
+/// How often teach mode stops waiting for a key to look for control presses
+const TEACH_POLL_INTERVAL: Duration = Duration::from_millis(20);
+
+/// Build the 'profile' command
+pub fn command() -> Command {
+    Command::new("profile")
+        .about("Manage profile files")
+        .subcommand_required(true)
+        .arg_required_else_help(true)
+        .subcommand(
+            Command::new("upgrade")
+                .about("Rewrite profiles in the current schema version (originals kept as .bak)")
+                .arg(
+                    Arg::new("files")
+                        .value_name("FILE")
+                        .required(true)
+                        .action(ArgAction::Append)
+                        .value_parser(clap::value_parser!(PathBuf)),
+                ),
+        )
+        .subcommand(
+            Command::new("create")
+                .visible_alias("new")
+                .about("Write a profile mapping every control of a connected controller")
+                .arg(
+                    Arg::new("for-device")
+                        .long("for-device")
+                        .value_name("N")
+                        .required(true)
+                        .value_parser(clap::value_parser!(usize))
+                        .help("Controller number, as listed by 'blazeremap detect'"),
+                )
+                .arg(
+                    Arg::new("file")
+                        .value_name("FILE")
+                        .value_parser(clap::value_parser!(PathBuf))
+                        .help("Where to write it, in the format its extension names; prints TOML if omitted"),
+                ),
+        )
+        .subcommand(
+            Command::new("preset")
+                .about("Write a built-in profile, such as a one-handed layout, to edit")
+                .arg(
+                    Arg::new("name")
+                        .value_name("NAME")
+                        .required(true)
+                        .value_parser(BUILTIN_PROFILES),
+                )
+                .arg(
+                    Arg::new("file")
+                        .value_name("FILE")
+                        .value_parser(clap::value_parser!(PathBuf))
+                        .help("Where to write it, in the format its extension names; prints TOML if omitted"),
+                ),
+        )
+        .subcommand(
+            Command::new("teach")
+                .about("Build a profile by pressing each control, then the key it should type")
+                .arg(
+                    Arg::new("for-device")
+                        .long("for-device")
+                        .value_name("N")
+                        .required(true)
+                        .value_parser(clap::value_parser!(usize))
+                        .help("Controller number, as listed by 'blazeremap detect'"),
+                )
+                .arg(
+                    Arg::new("name")
+                        .long("name")
+                        .value_name("NAME")
+                        .help("Profile name [default: the controller's name]"),
+                )
+                .arg(
+                    Arg::new("file")
+                        .value_name("FILE")
+                        .required(true)
+                        .value_parser(clap::value_parser!(PathBuf))
+                        .help("Where to write it, in the format its extension names"),
+                ),
+        )
+        .subcommand(
+            Command::new("seal")
+                .about("Add a checksum (and signature) to a profile, replacing any previous one")
+                .arg(
+                    Arg::new("file")
+                        .value_name("FILE")
+                        .required(true)
+                        .value_parser(clap::value_parser!(PathBuf)),
+                )
+                .arg(
+                    Arg::new("key")
+                        .long("key")
+                        .value_name("KEYFILE")
+                        .value_parser(clap::value_parser!(PathBuf))
+                        .help("Also sign with this key (see 'profile keygen')"),
+                ),
+        )
+        .subcommand(
+            Command::new("verify")
+                .about("Check profiles' seals like the daemon would")
+                .arg(
+                    Arg::new("files")
+                        .value_name("FILE")
+                        .required(true)
+                        .action(ArgAction::Append)
+                        .value_parser(clap::value_parser!(PathBuf)),
+                )
+                .args(integrity_args()),
+        )
+        .subcommand(
+            Command::new("lint")
+                .about("Report every problem in profiles, with suggested fixes")
+                .arg(
+                    Arg::new("files")
+                        .value_name("FILE")
+                        .required(true)
+                        .action(ArgAction::Append)
+                        .value_parser(clap::value_parser!(PathBuf)),
+                )
+                .arg(
+                    Arg::new("device")
+                        .long("device")
+                        .value_name("DEVICE")
+                        .help("Also check the controller DEVICE (an alias, index or path) has the controls mapped"),
+                ),
+        )
+        .subcommand(
+            Command::new("pack")
+                .about("Bundle a profile and the scripts it runs into one file to share")
+                .arg(
+                    Arg::new("file")
+                        .value_name("FILE")
+                        .required(true)
+                        .value_parser(clap::value_parser!(PathBuf)),
+                )
+                .arg(
+                    Arg::new("output")
+                        .long("output")
+                        .short('o')
+                        .value_name("BUNDLE")
+                        .value_parser(clap::value_parser!(PathBuf))
+                        .help("Where to write it [default: FILE with a .blazeremap extension]"),
+                )
+                .arg(Arg::new("author").long("author").value_name("NAME"))
+                .arg(
+                    Arg::new("controller")
+                        .long("controller")
+                        .value_name("NAME")
+                        .help("Controller the layout is made for"),
+                )
+                .arg(
+                    Arg::new("game")
+                        .long("game")
+                        .value_name("NAME")
+                        .help("Game it's for [default: the profile's game_name]"),
+                ),
+        )
+        .subcommand(
+            Command::new("unpack")
+                .about("Import a profile bundle")
+                .arg(
+                    Arg::new("bundle")
+                        .value_name("BUNDLE")
+                        .required(true)
+                        .value_parser(clap::value_parser!(PathBuf)),
+                )
+                .arg(
+                    Arg::new("dir")
+                        .long("dir")
+                        .value_name("DIR")
+                        .default_value(".")
+                        .value_parser(clap::value_parser!(PathBuf))
+                        .help("Directory to write the profile and its files to"),
+                )
+                .arg(
+                    Arg::new("force")
+                        .long("force")
+                        .action(ArgAction::SetTrue)
+                        .help("Replace existing files"),
+                ),
+        )
+        .subcommand(
+            Command::new("sync")
+                .about("Sync a directory of profiles with a WebDAV, S3 or Git remote")
+                .arg(
+                    Arg::new("dir")
+                        .value_name("DIR")
+                        .required(true)
+                        .value_parser(clap::value_parser!(PathBuf)),
+                )
+                .arg(
+                    Arg::new("remote")
+                        .long("remote")
+                        .value_name("URL")
+                        .env("BLAZEREMAP_SYNC_REMOTE")
+                        .required(true)
+                        .help("https://… WebDAV folder, s3://bucket/prefix or git+<repository>"),
+                )
+                .arg(
+                    Arg::new("prefer")
+                        .long("prefer")
+                        .value_name("SIDE")
+                        .value_parser(["local", "remote"])
+                        .help("Which copy wins for profiles changed on both sides"),
+                ),
+        )
+        .subcommand(
+            Command::new("keygen").about("Create a signing key and print its public key").arg(
+                Arg::new("file")
+                    .value_name("KEYFILE")
+                    .required(true)
+                    .value_parser(clap::value_parser!(PathBuf)),
+            ),
+        )
+}
+
+/// Options deciding which profiles the daemon accepts
+pub(super) fn integrity_args() -> [Arg; 2] {
+    [
+        Arg::new("strict-profiles")
+            .long("strict-profiles")
+            .env("BLAZEREMAP_STRICT_PROFILES")
+            .action(ArgAction::SetTrue)
+            .help("Refuse profiles that aren't sealed (or signed by a trusted key, if any)"),
+        Arg::new("trusted-key")
+            .long("trusted-key")
+            .env("BLAZEREMAP_TRUSTED_KEYS")
+            .value_name("KEY")
+            .value_delimiter(',')
+            .action(ArgAction::Append)
+            .value_parser(|key: &str| integrity::parse_public_key(key).map_err(|e| e.to_string()))
+            .help("Public key whose profile signatures are trusted (repeatable)"),
+    ]
+}
+
+/// The policy set by `integrity_args`
+pub(super) fn integrity_policy(matches: &clap::ArgMatches) -> IntegrityPolicy {
+    IntegrityPolicy {
+        strict: matches.get_flag("strict-profiles"),
+        trusted_keys: matches.get_many("trusted-key").unwrap_or_default().cloned().collect(),
+    }
+}
+
+/// CLI handle for the 'profile' command
+pub fn handle(matches: &clap::ArgMatches) -> Result<()> {
+    match matches.subcommand() {
+        Some(("upgrade", sub_matches)) => {
+            let files: Vec<&PathBuf> = sub_matches.get_many("files").unwrap_or_default().collect();
+            upgrade(&mut std::io::stdout(), &files)
+        }
+        Some(("create", sub_matches)) => {
+            let index = *sub_matches.get_one::<usize>("for-device").unwrap();
+            let info = nth_device(platform::new_input_manager()?.as_ref(), index)?;
+            let Some(path) = sub_matches.get_one::<PathBuf>("file") else {
+                print!("{}", template(&info, ProfileFormat::Toml)?);
+                return Ok(());
+            };
+            let text = template(&info, ProfileFormat::from_path(path))?;
+            std::fs::OpenOptions::new()
+                .write(true)
+                .create_new(true)
+                .open(path)
+                .and_then(|mut file| file.write_all(text.as_bytes()))
+                .with_context(|| format!("Failed to create profile {}", path.display()))?;
+            println!("Profile for {} written to {}", info.name, path.display());
+            Ok(())
+        }
+        Some(("preset", sub_matches)) => {
+            let id = sub_matches.get_one::<String>("name").unwrap();
+            let profile = Profile::builtin(id).unwrap();
+            let Some(path) = sub_matches.get_one::<PathBuf>("file") else {
+                print!("{}", ProfileFormat::Toml.encode_profile(&profile)?);
+                return Ok(());
+            };
+            let text = ProfileFormat::from_path(path).encode_profile(&profile)?;
+            std::fs::OpenOptions::new()
+                .write(true)
+                .create_new(true)
+                .open(path)
+                .and_then(|mut file| file.write_all(text.as_bytes()))
+                .with_context(|| format!("Failed to create profile {}", path.display()))?;
+            println!("{} written to {}", profile.name, path.display());
+            Ok(())
+        }
+        Some(("teach", sub_matches)) => {
+            let index = *sub_matches.get_one::<usize>("for-device").unwrap();
+            let path = sub_matches.get_one::<PathBuf>("file").unwrap();
+            if path.exists() {
+                anyhow::bail!("Failed to create profile {}: it already exists", path.display());
+            }
+            let manager = platform::new_input_manager()?;
+            let info = nth_device(manager.as_ref(), index)?;
+            let mut gamepad =
+                manager.open_gamepad_observed(&info.path).context("Failed to open controller")?;
+            let mut listener = platform::new_key_listener()?;
+
+            // The controller is read on its own thread; the channel closes
+            // when it disconnects
+            let (sender, controls) = mpsc::channel();
+            std::thread::spawn(move || {
+                loop {
+                    match gamepad.read_event() {
+                        Ok(Some(event)) => {
+                            if let Some(control) = Control::pressed_by(&event)
+                                && sender.send(control).is_err()
+                            {
+                                return;
+                            }
+                        }
+                        Ok(None) => return,
+                        Err(e) => {
+                            tracing::warn!("Failed to read controller: {}", e);
+                            return;
+                        }
+                    }
+                }
+            });
+
+            progress!("Teaching a profile for {}", info.name);
+            progress!("Press a control on the controller, then the key it should type.");
+            progress!("Press Esc with no control waiting to finish.\n");
+            let lesson = teach(&mut std::io::stdout(), &controls, listener.as_mut())?;
+            drop(listener);
+            if lesson.is_empty() {
+                println!("Nothing taught; no profile written");
+                return Ok(());
+            }
+
+            let name = sub_matches.get_one::<String>("name").unwrap_or(&info.name);
+            let text = ProfileFormat::from_path(path).encode_profile(&lesson.to_profile(name))?;
+            std::fs::OpenOptions::new()
+                .write(true)
+                .create_new(true)
+                .open(path)
+                .and_then(|mut file| file.write_all(text.as_bytes()))
+                .with_context(|| format!("Failed to create profile {}", path.display()))?;
+            println!("{} mappings written to {}", lesson.len(), path.display());
+            Ok(())
+        }
+        Some(("seal", sub_matches)) => {
+            let path = sub_matches.get_one::<PathBuf>("file").unwrap();
+            let key = match sub_matches.get_one::<PathBuf>("key") {
+                Some(key_path) => Some(integrity::parse_signing_key(
+                    &std::fs::read_to_string(key_path).context("Failed to read signing key")?,
+                )?),
+                None => None,
+            };
+            integrity::seal_file(path, key.as_ref())?;
+            let how = if key.is_some() { "sealed and signed" } else { "sealed" };
+            println!("{}: {}", path.display(), how);
+            Ok(())
+        }
+        Some(("verify", sub_matches)) => {
+            let files: Vec<&PathBuf> = sub_matches.get_many("files").unwrap_or_default().collect();
+            verify(&mut std::io::stdout(), &files, &integrity_policy(sub_matches))
+        }
+        Some(("lint", sub_matches)) => {
+            let files: Vec<&PathBuf> = sub_matches.get_many("files").unwrap_or_default().collect();
+            let device = match sub_matches.get_one::<String>("device") {
+                Some(selection) => {
+                    let manager = platform::new_input_manager()?;
+                    let path = super::resolve_device(manager.as_ref(), selection)?;
+                    Some(find_device(manager.as_ref(), &path)?)
+                }
+                None => None,
+            };
+            lint(&mut std::io::stdout(), &files, device.as_ref())
+        }
+        Some(("pack", sub_matches)) => {
+            let path = sub_matches.get_one::<PathBuf>("file").unwrap();
+            let metadata = Metadata {
+                author: sub_matches.get_one::<String>("author").cloned(),
+                controller: sub_matches.get_one::<String>("controller").cloned(),
+                game: sub_matches.get_one::<String>("game").cloned(),
+            };
+            let output = match sub_matches.get_one::<PathBuf>("output") {
+                Some(output) => output.clone(),
+                None => path.with_extension(bundle::EXTENSION),
+            };
+            pack(&mut std::io::stdout(), path, metadata, &output)
+        }
+        Some(("unpack", sub_matches)) => {
+            let path = sub_matches.get_one::<PathBuf>("bundle").unwrap();
+            let text = std::fs::read_to_string(path).context("Failed to read bundle")?;
+            unpack(
+                &mut std::io::stdout(),
+                &Bundle::parse(&text)?,
+                sub_matches.get_one::<PathBuf>("dir").unwrap(),
+                sub_matches.get_flag("force"),
+            )
+        }
+        Some(("sync", sub_matches)) => {
+            let dir = sub_matches.get_one::<PathBuf>("dir").unwrap();
+            let mut store = sync::open(sub_matches.get_one::<String>("remote").unwrap())?;
+            let prefer = match sub_matches.get_one::<String>("prefer").map(String::as_str) {
+                Some("local") => Some(Prefer::Local),
+                Some("remote") => Some(Prefer::Remote),
+                _ => None,
+            };
+            let outcomes = sync::sync(dir, store.as_mut(), prefer)?;
+            report_sync(&mut std::io::stdout(), &outcomes)
+        }
+        Some(("keygen", sub_matches)) => {
+            keygen(&mut std::io::stdout(), sub_matches.get_one::<PathBuf>("file").unwrap())
+        }
+        _ => unreachable!("Subcommand required"),
+    }
+}
+
+/// Upgrade every file, reporting each; fails if any did
+fn upgrade<W: Write>(writer: &mut W, files: &[impl AsRef<Path>]) -> Result<()> {
+    let mut failed = 0;
+    for path in files {
+        let path = path.as_ref();
+        match Profile::upgrade_file(path) {
+            Ok(CURRENT_SCHEMA_VERSION) => writeln!(
+                writer,
+                "{}: already at schema version {}",
+                path.display(),
+                CURRENT_SCHEMA_VERSION
+            )?,
+            Ok(version) => writeln!(
+                writer,
+                "{}: upgraded from schema version {} to {}",
+                path.display(),
+                version,
+                CURRENT_SCHEMA_VERSION
+            )?,
+            Err(e) => {
+                writeln!(writer, "{}: {:#}", path.display(), e)?;
+                failed += 1;
+            }
+        }
+    }
+    if failed > 0 {
+        anyhow::bail!("{} of {} profiles could not be upgraded", failed, files.len());
+    }
+    Ok(())
+}
+
+/// Check every file's seal, reporting each; fails if any didn't pass
+fn verify<W: Write>(
+    writer: &mut W,
+    files: &[impl AsRef<Path>],
+    policy: &IntegrityPolicy,
+) -> Result<()> {
+    let mut failed = 0;
+    for path in files {
+        let path = path.as_ref();
+        let outcome = std::fs::read_to_string(path)
+            .context("Failed to read profile file")
+            .and_then(|text| ProfileFormat::from_path(path).decode(&text))
+            .and_then(|table| policy.check(&table));
+        match outcome {
+            Ok(Verified::Signed) => {
+                writeln!(writer, "{}: signed by a trusted key", path.display())?
+            }
+            Ok(Verified::Checksum) => writeln!(writer, "{}: checksum ok", path.display())?,
+            Ok(Verified::Unsealed) => writeln!(writer, "{}: not sealed", path.display())?,
+            Err(e) => {
+                writeln!(writer, "{}: {:#}", path.display(), e)?;
+                failed += 1;
+            }
+        }
+    }
+    if failed > 0 {
+        anyhow::bail!("{} of {} profiles failed verification", failed, files.len());
+    }
+    Ok(())
+}
+
+/// Lint every file, listing each one's problems; fails if any has errors
+fn lint<W: Write>(
+    writer: &mut W,
+    files: &[impl AsRef<Path>],
+    device: Option<&GamepadInfo>,
+) -> Result<()> {
+    let count = |n: usize, what: &str| format!("{} {}{}", n, what, if n == 1 { "" } else { "s" });
+    let mut failed = 0;
+    for path in files {
+        let path = path.as_ref();
+        let diagnostics = match std::fs::read_to_string(path) {
+            Ok(text) => lint::lint_text(&text, ProfileFormat::from_path(path), device),
+            Err(e) => {
+                writeln!(writer, "{}: Failed to read profile file: {}", path.display(), e)?;
+                failed += 1;
+                continue;
+            }
+        };
+        let errors = diagnostics.iter().filter(|d| d.severity == Severity::Error).count();
+        let warnings = diagnostics.len() - errors;
+        match (errors, warnings) {
+            (0, 0) => writeln!(writer, "{}: ok", path.display())?,
+            (0, _) => writeln!(writer, "{}: {}", path.display(), count(warnings, "warning"))?,
+            _ => writeln!(
+                writer,
+                "{}: {}, {}",
+                path.display(),
+                count(errors, "error"),
+                count(warnings, "warning")
+            )?,
+        }
+        for diagnostic in &diagnostics {
+            writeln!(writer, "  {}", diagnostic)?;
+            if let Some(fix) = &diagnostic.fix {
+                writeln!(writer, "    fix: {}", fix)?;
+            }
+        }
+        if errors > 0 {
+            failed += 1;
+        }
+    }
+    if failed > 0 {
+        anyhow::bail!("{} of {} profiles have errors", failed, files.len());
+    }
+    Ok(())
+}
+
+fn pack<W: Write>(writer: &mut W, path: &Path, metadata: Metadata, output: &Path) -> Result<()> {
+    let bundle = Bundle::pack(path, metadata)?;
+    std::fs::write(output, bundle.to_text()?)
+        .with_context(|| format!("Failed to write {}", output.display()))?;
+    writeln!(writer, "{} packed into {}", path.display(), output.display())?;
+    for file in &bundle.files {
+        writeln!(writer, "  with {}", file.path)?;
+    }
+    Ok(())
+}
+
+/// Unpack, listing what was written so imported scripts can be reviewed
+fn unpack<W: Write>(writer: &mut W, bundle: &Bundle, dir: &Path, overwrite: bool) -> Result<()> {
+    let Metadata { author, controller, game } = &bundle.metadata;
+    for (label, value) in [("Author", author), ("Controller", controller), ("Game", game)] {
+        if let Some(value) = value {
+            writeln!(writer, "{}: {}", label, value)?;
+        }
+    }
+    let written = bundle.unpack(dir, overwrite)?;
+    writeln!(writer, "Profile written to {}", written[0].display())?;
+    for (path, file) in written[1..].iter().zip(&bundle.files) {
+        let note = if file.executable { " (executable; review before running)" } else { "" };
+        writeln!(writer, "  with {}{}", path.display(), note)?;
+    }
+    Ok(())
+}
+
+/// List what sync did with each profile; fails if any conflicted
+fn report_sync<W: Write>(writer: &mut W, outcomes: &[(String, Outcome)]) -> Result<()> {
+    let mut unchanged = 0;
+    let mut conflicts = 0;
+    for (name, outcome) in outcomes {
+        match outcome {
+            Outcome::Unchanged => unchanged += 1,
+            Outcome::Pushed => writeln!(writer, "{}: pushed", name)?,
+            Outcome::Pulled => writeln!(writer, "{}: pulled", name)?,
+            Outcome::Conflict => {
+                writeln!(writer, "{}: changed here and on the remote since the last sync", name)?;
+                conflicts += 1;
+            }
+        }
+    }
+    writeln!(writer, "{} of {} profiles already up to date", unchanged, outcomes.len())?;
+    if conflicts > 0 {
+        anyhow::bail!(
+            "{} profiles changed on both sides; rerun with --prefer local or --prefer remote",
+            conflicts
+        );
+    }
+    Ok(())
+}
+
+/// `Profile::for_device` as text, noting the controls mappings can't use
+fn template(info: &GamepadInfo, format: ProfileFormat) -> Result<String> {
+    let profile = format.encode_profile(&Profile::for_device(info))?;
+    // JSON has no comments
+    if format == ProfileFormat::Json {
+        return Ok(profile);
+    }
+    let analog: Vec<_> = info
+        .axes()
+        .into_iter()
+        .filter(|axis| !matches!(axis, AxisCode::DPadX | AxisCode::DPadY))
+        .map(|axis| axis.to_string())
+        .collect();
+    Ok(format!(
+        "# {} ({}, {:04x}:{:04x})\n# Analog axes, for scripts and action mappings: {}\n\n{}",
+        info.name,
+        info.gamepad_type,
+        info.vendor_id,
+        info.product_id,
+        analog.join(", "),
+        profile
+    ))
+}
+
+/// Pair each control pressed with the next key pressed, until Esc
+///
+/// Pressing another control before a key replaces the one waiting, and Esc
+/// is only a key to teach while a control is waiting. Ends early, keeping
+/// what was taught, if the controller goes away.
+fn teach<W: Write>(
+    writer: &mut W,
+    controls: &Receiver<Control>,
+    listener: &mut dyn KeyListener,
+) -> Result<Lesson> {
+    let mut lesson = Lesson::default();
+    let mut waiting = None;
+    loop {
+        loop {
+            match controls.try_recv() {
+                Ok(control) => {
+                    writeln!(writer, "{}: press a key", control)?;
+                    waiting = Some(control);
+                }
+                Err(TryRecvError::Empty) => break,
+                Err(TryRecvError::Disconnected) => {
+                    writeln!(writer, "Controller disconnected")?;
+                    return Ok(lesson);
+                }
+            }
+        }
+
+        let Some(key) = listener.next_key(TEACH_POLL_INTERVAL)? else {
+            continue;
+        };
+        match waiting.take() {
+            Some(control) => match lesson.teach(control, key) {
+                Some(previous) if previous != key => {
+                    writeln!(writer, "{} → {} (was {})", control, key, previous)?
+                }
+                _ => writeln!(writer, "{} → {}", control, key)?,
+            },
+            None if key == KeyboardCode::Escape => return Ok(lesson),
+            // A key with no control waiting
+            None => {}
+        }
+    }
+}
+
+/// Controller number `index` in detection order, as 'detect' lists them
+fn nth_device(manager: &dyn InputManager, index: usize) -> Result<GamepadInfo> {
+    let gamepads = manager.list_gamepads()?.gamepad_info;
+    let count = gamepads.len();
+    gamepads.into_iter().nth(index).with_context(|| {
+        format!(
+            "No controller number {} among the {} connected; see 'blazeremap detect'",
+            index, count
+        )
+    })
+}
+
+/// The connected controller at `path`
+fn find_device(manager: &dyn InputManager, path: &str) -> Result<GamepadInfo> {
+    manager
+        .list_gamepads()?
+        .gamepad_info
+        .into_iter()
+        .find(|info| info.path == path)
+        .with_context(|| format!("No controller at {}; see 'blazeremap detect'", path))
+}
+
+/// Write a new signing key to `path`, readable only by the owner
+fn keygen<W: Write>(writer: &mut W, path: &Path) -> Result<()> {
+    let key = integrity::generate_key()?;
+    let mut options = std::fs::OpenOptions::new();
+    options.write(true).create_new(true);
+    #[cfg(unix)]
+    std::os::unix::fs::OpenOptionsExt::mode(&mut options, 0o600);
+    let mut file = options
+        .open(path)
+        .with_context(|| format!("Failed to create key file {}", path.display()))?;
+    writeln!(file, "{}", integrity::encode_signing_key(&key))?;
+
+    writeln!(writer, "Signing key written to {}; keep it private.", path.display())?;
+    writeln!(
+        writer,
+        "Public key (for --trusted-key): {}",
+        integrity::encode_public_key(&key.verifying_key())
+    )?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_upgrade_reports_each_file() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-profile-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let current = dir.join("current.toml");
+        Profile::default_profile().save_to_file(&current).unwrap();
+        let missing = dir.join("missing.toml");
+
+        let mut output = Vec::new();
+        let err = upgrade(&mut output, &[&current, &missing]).unwrap_err();
+        std::fs::remove_dir_all(&dir).unwrap();
+
+        let output = String::from_utf8(output).unwrap();
+        assert_eq!(
+            output,
+            format!(
+                "{}: already at schema version 1\n{}: Failed to read profile file: No such file or directory (os error 2)\n",
+                current.display(),
+                missing.display()
+            )
+        );
+        assert_eq!(err.to_string(), "1 of 2 profiles could not be upgraded");
+    }
+
+    #[test]
+    fn test_pack_unpack() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-bundle-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let profile = dir.join("racing.toml");
+        Profile::default_profile().save_to_file(&profile).unwrap();
+        let bundle_path = profile.with_extension(bundle::EXTENSION);
+
+        let metadata = Metadata { controller: Some("Xbox".to_string()), ..Default::default() };
+        let mut output = Vec::new();
+        pack(&mut output, &profile, metadata, &bundle_path).unwrap();
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            format!("{} packed into {}\n", profile.display(), bundle_path.display())
+        );
+
+        let out = dir.join("imported");
+        let bundle = Bundle::parse(&std::fs::read_to_string(&bundle_path).unwrap()).unwrap();
+        let mut output = Vec::new();
+        unpack(&mut output, &bundle, &out, false).unwrap();
+        let imported = Profile::load_from_file(&out.join("racing.toml")).unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            format!("Controller: Xbox\nProfile written to {}\n", out.join("racing.toml").display())
+        );
+        assert_eq!(imported.name, Profile::default_profile().name);
+    }
+
+    #[test]
+    fn test_report_sync() {
+        let outcomes = [
+            ("deck.yaml".to_string(), Outcome::Pulled),
+            ("laptop.toml".to_string(), Outcome::Unchanged),
+            ("racing.toml".to_string(), Outcome::Conflict),
+        ];
+        let mut output = Vec::new();
+        let err = report_sync(&mut output, &outcomes).unwrap_err();
+        assert_eq!(
+            String::from_utf8(output).unwrap(),
+            "deck.yaml: pulled\nracing.toml: changed here and on the remote since the last sync\n1 of 3 profiles already up to date\n"
+        );
+        assert_eq!(
+            err.to_string(),
+            "1 profiles changed on both sides; rerun with --prefer local or --prefer remote"
+        );
+    }
+
+    #[test]
+    fn test_keygen_seal_verify() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-sign-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let (key, profile) = (dir.join("league.key"), dir.join("racing.toml"));
+        Profile::default_profile().save_to_file(&profile).unwrap();
+
+        let mut output = Vec::new();
+        keygen(&mut output, &key).unwrap();
+        assert!(keygen(&mut Vec::new(), &key).is_err(), "must not overwrite a key");
+        let output = String::from_utf8(output).unwrap();
+        let public = output.rsplit(' ').next().unwrap().trim();
+
+        let policy = |args: &[&str]| {
+            let matches = command().get_matches_from(
+                ["profile", "verify", "x"].iter().chain(args).collect::<Vec<_>>(),
+            );
+            integrity_policy(matches.subcommand_matches("verify").unwrap())
+        };
+        let trusting = policy(&["--strict-profiles", "--trusted-key", public]);
+        let mut report = Vec::new();
+        assert!(verify(&mut report, &[&profile], &trusting).is_err());
+
+        let signing_key =
+            integrity::parse_signing_key(&std::fs::read_to_string(&key).unwrap()).unwrap();
+        integrity::seal_file(&profile, Some(&signing_key)).unwrap();
+        verify(&mut report, &[&profile], &trusting).unwrap();
+        verify(&mut report, &[&profile], &policy(&[])).unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+
+        let report = String::from_utf8(report).unwrap();
+        let lines: Vec<_> = report.lines().map(|line| line.rsplit(": ").next().unwrap()).collect();
+        assert_eq!(lines, ["Profile is not sealed", "signed by a trusted key", "checksum ok"]);
+    }
+
+    #[test]
+    fn test_lint_reports_each_file() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-lint-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let clean = dir.join("clean.toml");
+        Profile::default_profile().save_to_file(&clean).unwrap();
+        let typo = dir.join("typo.yaml");
+        std::fs::write(
+            &typo,
+            "schema_version: 1\nname: Typo\ndescription: ''\nmappings:\n  - source_name: South\n    target_type: Keyboard\n    target_name: Spcae\n    debounce: 20\n",
+        )
+        .unwrap();
+
+        let mut output = Vec::new();
+        let err = lint(&mut output, &[&clean, &typo], None).unwrap_err();
+        std::fs::remove_dir_all(&dir).unwrap();
+
+        let output = String::from_utf8(output).unwrap();
+        assert_eq!(
+            output,
+            format!(
+                "{}: ok
+{}: 1 error, 1 warning
+  warning: mappings[0].debounce: unknown field; loading ignores it
+    fix: remove it
+  error: mappings[0].target_name: unknown key 'Spcae'
+    fix: did you mean 'Space'?
+",
+                clean.display(),
+                typo.display()
+            )
+        );
+        assert_eq!(err.to_string(), "1 of 2 profiles have errors");
+    }
+
+    fn xbox() -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Xbox Wireless Controller".to_string(),
+            gamepad_type: crate::input::GamepadType::XboxSeries,
+            vendor_id: 0x045e,
+            vendor_name: "Microsoft".to_string(),
+            product_id: 0x0b13,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
+    fn manager() -> crate::input::manager::MockInputManager {
+        let mut manager = crate::input::manager::MockInputManager::new();
+        manager.expect_list_gamepads().returning(|| {
+            Ok(crate::input::InputDetectionResult { gamepad_info: vec![xbox()], errors: vec![] })
+        });
+        manager
+    }
+
+    #[test]
+    fn test_template_loads_in_every_format() {
+        let toml = template(&xbox(), ProfileFormat::Toml).unwrap();
+        assert!(toml.starts_with(
+            "# Xbox Wireless Controller (Xbox Series X/S, 045e:0b13)\n# Analog axes, for scripts and action mappings: Left X, Left Y, Right X, Right Y, Left Trigger, Right Trigger\n\nschema_version = 1\n"
+        ));
+        for format in [ProfileFormat::Toml, ProfileFormat::Yaml, ProfileFormat::Json] {
+            let profile = Profile::decode(&template(&xbox(), format).unwrap(), format).unwrap();
+            assert_eq!(profile.mappings.len(), 17, "{}", format);
+        }
+    }
+
+    #[test]
+    fn test_nth_device() {
+        let manager = manager();
+        assert_eq!(nth_device(&manager, 0).unwrap().path, "/dev/input/event3");
+        assert_eq!(
+            nth_device(&manager, 1).unwrap_err().to_string(),
+            "No controller number 1 among the 1 connected; see 'blazeremap detect'"
+        );
+        assert!(command().try_get_matches_from(["profile", "create"]).is_err());
+    }
+
+    #[test]
+    fn test_find_device() {
+        let manager = manager();
+        assert_eq!(
+            find_device(&manager, "/dev/input/event3").unwrap().name,
+            "Xbox Wireless Controller"
+        );
+        assert_eq!(
+            find_device(&manager, "/dev/input/event9").unwrap_err().to_string(),
+            "No controller at /dev/input/event9; see 'blazeremap detect'"
+        );
+    }
+
+    /// Presses controls and keys in order; a control shows up on the channel
+    /// by the next time a key is waited for
+    enum Press {
+        Control(Control),
+        Key(KeyboardCode),
+    }
+
+    struct ScriptedListener {
+        presses: std::collections::VecDeque<Press>,
+        controls: Option<mpsc::Sender<Control>>,
+    }
+
+    impl KeyListener for ScriptedListener {
+        fn next_key(&mut self, _timeout: Duration) -> Result<Option<KeyboardCode>> {
+            match self.presses.pop_front() {
+                Some(Press::Control(control)) => {
+                    self.controls.as_ref().unwrap().send(control).unwrap();
+                    Ok(None)
+                }
+                Some(Press::Key(key)) => Ok(Some(key)),
+                // Controller unplugged
+                None => {
+                    self.controls = None;
+                    Ok(None)
+                }
+            }
+        }
+    }
+
+    fn run_teach(presses: Vec<Press>) -> (Lesson, String) {
+        let (sender, controls) = mpsc::channel();
+        let mut listener = ScriptedListener { presses: presses.into(), controls: Some(sender) };
+        let mut output = Vec::new();
+        let lesson = teach(&mut output, &controls, &mut listener).unwrap();
+        (lesson, String::from_utf8(output).unwrap())
+    }
+
+    #[test]
+    fn test_teach_pairs_controls_with_keys() {
+        use crate::event::{AxisDirection, ButtonCode};
+        let south = Control::Button(ButtonCode::South);
+        let north = Control::Button(ButtonCode::North);
+        let up = Control::DPad(AxisCode::DPadY, AxisDirection::Negative);
+
+        let (lesson, output) = run_teach(vec![
+            // Ignored: no control waiting
+            Press::Key(KeyboardCode::Q),
+            Press::Control(south),
+            Press::Key(KeyboardCode::Space),
+            // North is replaced by Up before a key comes
+            Press::Control(north),
+            Press::Control(up),
+            Press::Key(KeyboardCode::W),
+            // Esc is a key to teach while a control waits
+            Press::Control(south),
+            Press::Key(KeyboardCode::Escape),
+            Press::Key(KeyboardCode::Escape),
+            Press::Control(north),
+        ]);
+        assert_eq!(
+            output,
+            "South: press a key\nSouth → Space\nNorth: press a key\nDPad Up: press a key\n\
+             DPad Up → W\nSouth: press a key\nSouth → Escape (was Space)\n"
+        );
+        assert_eq!(lesson.len(), 2);
+        assert_eq!(lesson.to_profile("Taught").mappings[0].target_name, "Escape");
+    }
+
+    #[test]
+    fn test_teach_keeps_lesson_when_controller_disconnects() {
+        let (lesson, output) = run_teach(vec![
+            Press::Control(Control::Button(crate::event::ButtonCode::East)),
+            Press::Key(KeyboardCode::E),
+        ]);
+        assert_eq!(lesson.len(), 1);
+        assert!(output.ends_with("East → E\nController disconnected\n"));
+    }
+
+    #[test]
+    fn test_trusted_keys_are_validated() {
+        let result = command().try_get_matches_from([
+            "profile",
+            "verify",
+            "racing.toml",
+            "--trusted-key",
+            "bogus",
+        ]);
+        assert!(result.is_err());
+    }
+
+    #[test]
+    fn test_upgrade_requires_files() {
+        assert!(command().try_get_matches_from(["profile", "upgrade"]).is_err());
+    }
+}
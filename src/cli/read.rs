@@ -1,27 +1,42 @@
-use std::time::Instant;
+use std::time::{Duration, Instant};
 
-use crate::input::gamepad::Gamepad;
-use crate::platform::linux::LinuxGamepad;
+use super::axis_view::AxisView;
+use crate::input::gamepad::{BufferedGamepad, Gamepad, buffered::DEFAULT_RING_CAPACITY};
+use crate::platform;
 use anyhow::Result;
 use clap::Command;
 
 pub fn command() -> Command {
-    Command::new("read").about("Read and display gamepad events (debugging)").arg(
-        clap::Arg::new("device")
-            .help("Device path (e.g., /dev/input/event3)")
-            .required(true)
-            .index(1),
-    )
+    Command::new("read")
+        .about("Read and display gamepad events (debugging)")
+        .arg(
+            clap::Arg::new("device")
+                .help("Device path (e.g., /dev/input/event3), alias or index from 'detect'")
+                .required(true)
+                .index(1),
+        )
+        .arg(
+            clap::Arg::new("view")
+                .long("view")
+                .help("Draw the sticks and triggers live instead of listing events")
+                .action(clap::ArgAction::SetTrue),
+        )
 }
 
 pub fn handle(matches: &clap::ArgMatches) -> Result<()> {
-    let device_path = matches.get_one::<String>("device").unwrap();
+    let manager = platform::new_input_manager()?;
+    let device_path =
+        &super::resolve_device(manager.as_ref(), matches.get_one::<String>("device").unwrap())?;
 
-    println!("Opening device: {}", device_path);
-    let mut gamepad = LinuxGamepad::open(device_path)?;
+    progress!("Observing device: {}", device_path);
+    let mut gamepad = manager.open_gamepad_observed(device_path)?;
 
-    println!("Reading events (Ctrl+C to stop)...\n");
-    println!("Format: [elapsed since first event][Δ from previous] Event\n");
+    if matches.get_flag("view") {
+        return view(gamepad);
+    }
+
+    progress!("Reading events (Ctrl+C to stop)...\n");
+    progress!("Format: [elapsed since first event][Δ from previous] Event\n");
 
     let mut first_event_timestamp: Option<Instant> = None;
     let mut last_timestamp: Option<Instant> = None;
@@ -63,6 +78,21 @@ pub fn handle(matches: &clap::ArgMatches) -> Result<()> {
     Ok(())
 }
 
+/// Keep a live picture of the axes of `gamepad` on screen until it's unplugged
+fn view(gamepad: Box<dyn Gamepad>) -> Result<()> {
+    let mut gamepad = BufferedGamepad::spawn(gamepad, DEFAULT_RING_CAPACITY)?;
+    let mut view = AxisView::new();
+    progress!("Move the sticks and triggers (Ctrl+C to stop)\n");
+    let mut stdout = std::io::stdout();
+    // Woken now and then while idle, to draw what a throttled frame held back
+    while let Some(event) = gamepad.read_event_until(Instant::now() + Duration::from_millis(50))? {
+        view.update(&event);
+        view.refresh(&mut stdout)?;
+    }
+    println!("Device disconnected");
+    Ok(())
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
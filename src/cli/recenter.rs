@@ -0,0 +1,82 @@
+use anyhow::Result;
+use clap::{Arg, ArgAction, Command};
+use std::io::Write;
+use std::path::Path;
+
+use crate::{input::calibration::parse_stick_axes, ipc};
+
+/// Build the 'recenter' command
+pub fn command() -> Command {
+    Command::new("recenter")
+        .about("Take where the sticks rest now as their centers in the running daemon")
+        .long_about(
+            "Take where the sticks rest now as their centers in the running daemon.\n\n\
+             For controllers whose sticks drift once warm: leave the sticks alone and run \
+             this. It lasts until the daemon stops; 'calibration wizard --apply' keeps a \
+             center for good.",
+        )
+        .arg(
+            Arg::new("axis")
+                .value_name("AXIS")
+                .action(ArgAction::Append)
+                .help("Stick axis to recenter, like \"Left X\" (both sticks if none)"),
+        )
+}
+
+/// CLI handle for the 'recenter' command
+pub fn handle(matches: &clap::ArgMatches) -> Result<()> {
+    run_internal(&mut std::io::stdout(), &ipc::socket_path(), matches)
+}
+
+fn run_internal<W: Write>(writer: &mut W, socket: &Path, matches: &clap::ArgMatches) -> Result<()> {
+    let axes = matches
+        .get_many::<String>("axis")
+        .map(|names| names.cloned().collect::<Vec<_>>().join(","))
+        .unwrap_or_default();
+    // Caught here rather than by the daemon, so a typo doesn't need one running
+    parse_stick_axes(&axes)?;
+
+    let recentered: Vec<String> = ipc::request(socket, format!("recenter {}", axes).trim())?;
+    writeln!(writer, "Recentering {}.", recentered.join(", "))?;
+    writeln!(writer, "Each takes where it rests as its center on the controller's next event.")?;
+    Ok(())
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use crate::ipc::ControlServer;
+    use std::sync::{Arc, Mutex};
+
+    #[test]
+    fn test_sends_axes_to_the_daemon() {
+        let path = std::env::temp_dir()
+            .join(format!("blazeremap-test-{}-recenter.sock", std::process::id()));
+        let received = Arc::new(Mutex::new(Vec::new()));
+        let log = Arc::clone(&received);
+        let _server = ControlServer::bind(
+            &path,
+            Arc::new(move |command, _| {
+                log.lock().unwrap().push(command.to_string());
+                Ok(serde_json::json!(["Right X"]))
+            }),
+        )
+        .unwrap();
+
+        let mut output = Vec::new();
+        let matches = command().get_matches_from(["recenter", "Right X"]);
+        run_internal(&mut output, &path, &matches).unwrap();
+        let matches = command().get_matches_from(["recenter"]);
+        run_internal(&mut output, &path, &matches).unwrap();
+
+        assert_eq!(*received.lock().unwrap(), ["recenter Right X", "recenter"]);
+        assert!(String::from_utf8(output).unwrap().starts_with("Recentering Right X.\n"));
+    }
+
+    #[test]
+    fn test_rejects_other_axes_without_a_daemon() {
+        let matches = command().get_matches_from(["recenter", "Left Trigger"]);
+        let err = run_internal(&mut Vec::new(), Path::new("/nonexistent"), &matches).unwrap_err();
+        assert_eq!(err.to_string(), "'Left Trigger' is not a stick axis");
+    }
+}
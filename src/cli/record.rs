@@ -0,0 +1,77 @@
+// Record command - capture controller input to a trace file
+use crate::{
+    event::InputEvent,
+    platform,
+    trace::{TraceDevice, TraceWriter},
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgMatches, Command, value_parser};
+use std::io::BufWriter;
+use std::path::PathBuf;
+use std::time::Instant;
+
+pub fn command() -> Command {
+    Command::new("record")
+        .about("Record controller input to a JSONL trace file")
+        .long_about(
+            "Record controller input to a JSONL trace file.\n\n\
+             Every event is written with its time since the recording started, for bug \
+             reports and regression tests. Recording stops when the controller disconnects \
+             or on Ctrl+C.",
+        )
+        .arg(
+            Arg::new("device")
+                .short('d')
+                .long("device")
+                .help("Controller alias, index from 'detect' or device path (asked for if several are connected)"),
+        )
+        .arg(
+            Arg::new("output")
+                .short('o')
+                .long("output")
+                .value_name("FILE")
+                .required(true)
+                .value_parser(value_parser!(PathBuf))
+                .help("Trace file to write, e.g. session.jsonl"),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let output = matches.get_one::<PathBuf>("output").unwrap();
+    let manager = platform::new_input_manager()?;
+    let device_path = super::device_path(manager.as_ref(), matches.get_one::<String>("device"))?;
+    let mut gamepad =
+        manager.open_gamepad_observed(&device_path).context("Failed to open controller")?;
+    let info = gamepad.get_info();
+
+    let file = std::fs::File::create(output)
+        .with_context(|| format!("Failed to create {}", output.display()))?;
+    let mut writer =
+        TraceWriter::new(BufWriter::new(file), TraceDevice::from(&info), Instant::now())?;
+    progress!("Recording {} to {} (Ctrl+C to stop)", info.name, output.display());
+
+    let mut recorded = 0usize;
+    while let Some(event) = gamepad.read_event()? {
+        writer.record(&event)?;
+        if !matches!(event, InputEvent::Sync { .. }) {
+            recorded += 1;
+        }
+    }
+    writer.finish()?;
+    println!("Device disconnected; {} events recorded", recorded);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_command_requires_output() {
+        assert!(command().try_get_matches_from(["record"]).is_err());
+        let matches = command().try_get_matches_from(["record", "-d", "1", "-o", "a.jsonl"]);
+        let matches = matches.unwrap();
+        assert_eq!(matches.get_one::<String>("device").unwrap(), "1");
+        assert_eq!(matches.get_one::<PathBuf>("output").unwrap(), &PathBuf::from("a.jsonl"));
+    }
+}
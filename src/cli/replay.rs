@@ -0,0 +1,75 @@
+// Replay command - map a recorded trace without the controller
+use crate::{
+    mapping::{MappingEngine, profile::Profile},
+    output::identity::VirtualDeviceIdentity,
+    platform,
+    trace::{Trace, replay},
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgAction, ArgMatches, Command, value_parser};
+use std::io::Write;
+use std::path::PathBuf;
+
+pub fn command() -> Command {
+    Command::new("replay")
+        .about("Feed a recorded trace through the mapper and show the keys it produces")
+        .long_about(
+            "Feed a recorded trace through the mapper and show the keys it produces.\n\n\
+             Events are replayed at their recorded times; the keys are printed and, with \
+             --virtual, also typed on a virtual keyboard. Actions the profile triggers are \
+             listed but never run.",
+        )
+        .arg(
+            Arg::new("trace")
+                .value_name("TRACE")
+                .required(true)
+                .value_parser(value_parser!(PathBuf))
+                .help("Trace from 'blazeremap record' or 'run --trace'"),
+        )
+        .arg(
+            Arg::new("profile")
+                .short('p')
+                .long("profile")
+                .value_name("FILE")
+                .value_parser(value_parser!(PathBuf))
+                .help("Profile to map with (built-in D-pad/face-button mappings if not specified)"),
+        )
+        .arg(
+            Arg::new("virtual")
+                .long("virtual")
+                .action(ArgAction::SetTrue)
+                .help("Also type the keys on a virtual keyboard"),
+        )
+        .arg(
+            Arg::new("fast")
+                .long("fast")
+                .action(ArgAction::SetTrue)
+                .help("Don't wait between events; timing-based mappings still see recorded times"),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let path = matches.get_one::<PathBuf>("trace").unwrap();
+    let file = std::fs::File::open(path).context("Failed to open trace")?;
+    let trace = Trace::read(std::io::BufReader::new(file))?;
+    let mut engine = match matches.get_one::<PathBuf>("profile") {
+        Some(profile) => MappingEngine::load_from_profile(&Profile::load_from_file(profile)?)?,
+        None => MappingEngine::new_hardcoded(),
+    };
+    let mut keyboard = match matches.get_flag("virtual") {
+        true => Some(platform::new_virtual_keyboard(&VirtualDeviceIdentity::named(
+            "BlazeRemap Replay",
+        ))?),
+        false => None,
+    };
+
+    progress!("Replaying {} events from {}", trace.events.len(), trace.header.device.name);
+    let stdout = &mut std::io::stdout();
+    replay::replay(&trace, &mut engine, !matches.get_flag("fast"), |frame| {
+        if let Some(keyboard) = &mut keyboard {
+            keyboard.emit_frame(frame.output)?;
+        }
+        write!(stdout, "{}", frame)?;
+        Ok(())
+    })
+}
@@ -1,29 +1,283 @@
 use anyhow::{Context, Result};
 use clap::Command;
+use std::net::TcpListener;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
 
 use crate::{
-    InputManager,
+    Gamepad, InputManager,
+    action::{ActionDispatcher, ActionPolicy},
+    api::pprof,
+    audit::{self, AuditEvent},
     event::EventLoop,
-    mapping::MappingEngine,
-    output::keyboard::VirtualKeyboard,
-    platform::{new_input_manager, new_virtual_keyboard},
+    input::{
+        calibration::{Recenter, parse_stick_axes},
+        composite::{self, Source},
+        filter::DeviceFilter,
+        gamepad::{BufferedGamepad, GamepadInfo, buffered::DEFAULT_RING_CAPACITY},
+        manager::NoControllers,
+    },
+    ipc::{self, ControlServer},
+    mapping::{
+        MappingEngine,
+        context::ContextWatcher,
+        hotkey::{ProfileHotkey, ProfileSwitcher},
+        profile::Profile,
+    },
+    metrics::{PipelineMetrics, SessionEnd, SessionHealth, SessionSummary},
+    output::{
+        devices::{DeviceKinds, VirtualDevices},
+        feedback::{StickyCue, SwitchCue},
+        gamepad::{VirtualGamepad, VirtualGamepadIdentity},
+        identity::{DeviceIdentities, VirtualDeviceIdentity},
+        keyboard::VirtualKeyboard,
+        notify::Notifications,
+        players::{self, Players},
+        split::{ControlSet, SplitGamepad},
+    },
+    platform::{
+        self, new_input_manager, new_virtual_gamepad, new_virtual_keyboard, new_virtual_mouse,
+        privilege::{self, User},
+        thread,
+    },
+    trace::{TraceDevice, debug::DebugTrace},
 };
 
 /// Build the 'run' command
 pub fn command() -> Command {
-    Command::new("run").about("Run the remapping daemon").arg(
-        clap::Arg::new("device")
-            .short('d')
-            .long("device")
-            .help("Specific device path (auto-detect if not specified)"),
-    )
+    Command::new("run")
+        .visible_alias("remap")
+        .about("Run the remapping daemon")
+        .arg(
+            clap::Arg::new("device")
+                .short('d')
+                .long("device")
+                .value_name("DEVICE[:FROM=TO,...]")
+                .value_parser(|text: &str| text.parse::<Source>())
+                .action(clap::ArgAction::Append)
+                .help(
+                    "Device path, alias or index, repeat to read several controllers as one (auto-detect if not \
+                     specified); FROM=TO renames its controls, e.g. LeftY=RightTrigger",
+                ),
+        )
+        .arg(
+            clap::Arg::new("match")
+                .long("match")
+                .env("BLAZEREMAP_MATCH")
+                .value_name("FILTER")
+                .value_parser(|text: &str| text.parse::<DeviceFilter>())
+                .help(
+                    "Without --device, auto-detect only controllers matching FILTER, e.g. \
+                     vendor=054c,type=dualshock4 (keys: vendor, name, path, type)",
+                ),
+        )
+        .arg(
+            clap::Arg::new("gamepad")
+                .long("gamepad")
+                .value_name("CONTROLS")
+                .value_parser(|text: &str| text.parse::<ControlSet>())
+                .action(clap::ArgAction::Append)
+                .help(
+                    "Send these controls to a virtual gamepad of their own instead of mapping \
+                     them, e.g. DPad,Face; repeat for another gamepad",
+                ),
+        )
+        .arg(super::simulate::type_arg().help(
+            "Controller the virtual gamepads pose as: the one gamepad mappings press and the \
+             --gamepad outputs",
+        ))
+        .arg(
+            clap::Arg::new("clone-identity")
+                .long("clone-identity")
+                .action(clap::ArgAction::SetTrue)
+                .help(
+                    "Give the virtual gamepads the controller's own name and vendor and product \
+                     IDs instead of --type's, and grab the controller so games only see them",
+                ),
+        )
+        .arg(
+            clap::Arg::new("device-identity")
+                .long("device-identity")
+                .value_name("KIND:SETTINGS")
+                .value_parser(|text: &str| text.parse::<DeviceIdentities>())
+                .action(clap::ArgAction::Append)
+                .help(
+                    "Name or IDs for the virtual keyboard, mouse or gamepad, over the profile's, \
+                     e.g. 'keyboard:name=Couch Keyboard,vendor=1209:0001' (keys: name, vendor, \
+                     product, version; IDs in hex)",
+                ),
+        )
+        .arg(
+            clap::Arg::new("profile")
+                .short('p')
+                .long("profile")
+                .env("BLAZEREMAP_PROFILE")
+                .value_name("FILE")
+                .action(clap::ArgAction::Append)
+                .help(
+                    "Profile to map with (built-in D-pad/face-button mappings if not specified); \
+                     repeat to switch among several from the controller",
+                ),
+        )
+        .arg(
+            clap::Arg::new("profile-hotkey")
+                .long("profile-hotkey")
+                .value_name("CHORD=TARGET")
+                .value_parser(|text: &str| text.parse::<ProfileHotkey>())
+                .action(clap::ArgAction::Append)
+                .help(
+                    "Controls held together to switch profiles: TARGET is next, previous or a \
+                     profile's name, e.g. 'Mode+North=Racing' (default with several profiles: \
+                     Mode+DPad Right=next, Mode+DPad Left=previous)",
+                ),
+        )
+        .arg(
+            clap::Arg::new("exec-allow")
+                .long("exec-allow")
+                .env("BLAZEREMAP_EXEC_ALLOW")
+                .value_name("PROGRAM")
+                .value_delimiter(',')
+                .action(clap::ArgAction::Append)
+                .help(
+                    "Let the profile's exec actions and plugins run these programs \
+                     (repeatable); nothing runs unless allowed",
+                ),
+        )
+        .arg(
+            clap::Arg::new("exec-timeout")
+                .long("exec-timeout")
+                .env("BLAZEREMAP_EXEC_TIMEOUT")
+                .value_name("SECS")
+                .value_parser(clap::value_parser!(u64).range(1..=3600))
+                .help("Kill commands of exec actions still running after this many seconds"),
+        )
+        .arg(
+            clap::Arg::new("exec-unconfined")
+                .long("exec-unconfined")
+                .env("BLAZEREMAP_EXEC_UNCONFINED")
+                .action(clap::ArgAction::SetTrue)
+                .help(
+                    "Let exec actions and plugins delete files, gain privileges and change \
+                     the system (Linux confines them by default)",
+                ),
+        )
+        .arg(
+            // Confinement used to be opt-in; it is the default now
+            clap::Arg::new("exec-confine")
+                .long("exec-confine")
+                .env("BLAZEREMAP_EXEC_CONFINE")
+                .action(clap::ArgAction::SetTrue)
+                .conflicts_with("exec-unconfined")
+                .hide(true),
+        )
+        .arg(
+            clap::Arg::new("swap-ab-xy")
+                .long("swap-ab-xy")
+                .action(clap::ArgAction::SetTrue)
+                .help("Swap South with East and West with North before mapping (A/B and X/Y)"),
+        )
+        .arg(
+            clap::Arg::new("southpaw")
+                .long("southpaw")
+                .action(clap::ArgAction::SetTrue)
+                .help("Swap the left and right sticks before mapping"),
+        )
+        .arg(
+            clap::Arg::new("swap-dpad")
+                .long("swap-dpad")
+                .action(clap::ArgAction::SetTrue)
+                .help("Swap the D-pad with the left stick, after --southpaw"),
+        )
+        .args(super::profile::integrity_args())
+        .arg(
+            clap::Arg::new("realtime")
+                .long("realtime")
+                .env("BLAZEREMAP_REALTIME")
+                .action(clap::ArgAction::SetTrue)
+                .help(
+                    "Request real-time scheduling for the reader and mapper threads (also \
+                     [scheduling] realtime in daemon.toml)",
+                ),
+        )
+        .arg(
+            clap::Arg::new("reader-cpus")
+                .long("reader-cpus")
+                .env("BLAZEREMAP_READER_CPUS")
+                .value_name("LIST")
+                .value_parser(thread::parse_cpu_list)
+                .help("Pin the device reader thread to these CPUs (e.g. 3 or 2-3)"),
+        )
+        .arg(
+            clap::Arg::new("mapper-cpus")
+                .long("mapper-cpus")
+                .env("BLAZEREMAP_MAPPER_CPUS")
+                .value_name("LIST")
+                .value_parser(thread::parse_cpu_list)
+                .help("Pin the mapping/output thread to these CPUs"),
+        )
+        .arg(
+            clap::Arg::new("user")
+                .long("user")
+                .env("BLAZEREMAP_USER")
+                .value_name("NAME")
+                .help(
+                    "Started as root, become NAME once the devices are open (default: the user \
+                     who ran sudo)",
+                ),
+        )
+        .arg(
+            clap::Arg::new("summary")
+                .long("summary")
+                .value_name("FILE")
+                .value_parser(clap::value_parser!(PathBuf))
+                .help("Also save the summary printed on exit, as JSON for a .json FILE"),
+        )
+        .arg(
+            clap::Arg::new("trace")
+                .long("trace")
+                .value_name("FILE")
+                .value_parser(clap::value_parser!(PathBuf))
+                .help(
+                    "Write a gzip-compressed debug trace: every event with its timing, the \
+                     rules it matched and what it was mapped to",
+                ),
+        )
+        .arg(
+            clap::Arg::new("pprof")
+                .long("pprof")
+                .value_name("ADDR[:PORT]")
+                .hide(true)
+                .help("Serve thread CPU profiles and stage latencies over HTTP (port 6060)"),
+        )
 }
 
 /// CLI handle for the 'run' command
 pub fn handle(matches: &clap::ArgMatches) -> Result<()> {
-    let manager = new_input_manager();
+    // Before any thread starts, so Ctrl+C waits for the session summary
+    platform::interrupt::catch();
+    let manager = new_input_manager()?;
+    platform::check_virtual_device_access()?;
 
-    run_internal(matches, manager.as_ref(), new_virtual_keyboard)
+    let user = privilege::target(matches.get_one::<String>("user").map(String::as_str))?;
+    let socket = match &user {
+        Some(user) => ipc::user_socket_path(user),
+        None if privilege::is_root() => {
+            tracing::warn!(
+                "Running as root, and so will actions and plugins; --user NAME drops to NAME \
+                 once the devices are open"
+            );
+            ipc::socket_path()
+        }
+        None => ipc::socket_path(),
+    };
+    run_internal(matches, manager.as_ref(), new_virtual_keyboard, Some(&socket), user.as_ref())
+}
+
+/// `source` reading the device path its selection names
+pub(super) fn resolve_source(manager: &dyn InputManager, mut source: Source) -> Result<Source> {
+    source.path = super::resolve_device(manager, &source.path)?;
+    Ok(source)
 }
 
 /// Internal run logic that is decoupled from platform-specific implementations for testing
@@ -36,58 +290,396 @@ fn run_internal<F>(
     matches: &clap::ArgMatches,
     manager: &dyn InputManager,
     make_keyboard: F,
+    control_socket: Option<&Path>,
+    drop_to: Option<&User>,
 ) -> Result<()>
 where
-    F: FnOnce(&str) -> Result<Box<dyn VirtualKeyboard>>,
+    F: FnOnce(&VirtualDeviceIdentity) -> Result<Box<dyn VirtualKeyboard>> + 'static,
 {
     tracing::info!("BlazeRemap v{} starting...", env!("CARGO_PKG_VERSION"));
 
-    // Get device path
-    let device_path = if let Some(path) = matches.get_one::<String>("device") {
-        path.clone() // User specified a device path
+    // Get devices
+    let sources: Vec<Source> = if let Some(sources) = matches.get_many::<Source>("device") {
+        // User specified devices, by path, index or alias
+        sources.cloned().map(|source| resolve_source(manager, source)).collect::<Result<_>>()?
     } else {
-        // Auto-detect first controller
-        println!("Detecting controllers...");
-        let gamepads = manager.list_gamepads()?;
+        // Auto-detect the controller, asking which if there are several
+        progress!("Detecting controllers...");
+        let mut gamepads = manager.list_gamepads()?;
+        let filter = matches.get_one::<DeviceFilter>("match");
+        if let Some(filter) = filter {
+            let connected = gamepads.gamepad_info.len();
+            filter.retain(&mut gamepads.gamepad_info);
+            if gamepads.gamepad_info.is_empty() && connected > 0 {
+                return Err(
+                    NoControllers::Matching { filter: filter.to_string(), connected }.into()
+                );
+            }
+        }
 
         if gamepads.gamepad_info.is_empty() {
-            anyhow::bail!("No controllers detected. Please connect a controller.");
+            if let Some(error) = gamepads.errors.first() {
+                let (path, error_type) = (error.path.clone(), error.error_type);
+                return Err(NoControllers::Unusable { path, error_type }.into());
+            }
+            return Err(NoControllers::Connected.into());
         }
 
-        println!("Found {} gamepad(s)", gamepads.gamepad_info.len());
-        println!("Using: {}", gamepads.gamepad_info[0].name);
-        gamepads.gamepad_info[0].path.clone()
+        progress!("Found {} gamepad(s)", gamepads.gamepad_info.len());
+        // --match chooses by itself: the first controller matching
+        let info = match filter {
+            Some(_) if !super::interactive() => &gamepads.gamepad_info[0],
+            _ => super::picker::pick(&gamepads.gamepad_info)?,
+        };
+        progress!("Using: {}", info.name);
+        vec![Source { path: info.path.clone(), controls: Default::default() }]
     };
+    let device_paths = composite::paths(&sources);
+    crate::logging::set_context("device", device_paths.join(","));
+
+    // Held until we exit, so a second session on these controllers fails
+    let _claim = platform::claim_devices(&device_paths)?;
 
-    // Open controller
-    println!("Opening device: {}", device_path);
-    let controller = manager.open_gamepad(&device_path).context("Failed to open controller")?;
+    // Open controller(s); several devices are multiplexed into one stream.
+    // A clone has to be the only one games see, so its original is grabbed
+    progress!("Opening device: {}", device_paths.join(", "));
+    let clone = matches.get_flag("clone-identity");
+    let controller = if clone || sources.iter().any(|source| !source.controls.is_empty()) {
+        manager.open_composite(&sources, clone)
+    } else {
+        match device_paths.as_slice() {
+            [path] => manager.open_gamepad(path),
+            paths => manager.open_gamepads(paths),
+        }
+    }
+    .context("Failed to open controller")?;
+    let physical = controller.get_info();
+    // Numbered in the order given, on the lights they have
+    let players = Arc::new(Mutex::new(Players::open(&device_paths)));
 
-    // Create mapping engine
-    println!("Loading hardcoded mappings...");
-    let engine = MappingEngine::new_hardcoded();
+    // Read on its own thread so slow mapping never delays draining the device
+    let realtime = matches.get_flag("realtime") || crate::input::policy::realtime()?;
+    let reader_cpus = matches.get_one::<Vec<usize>>("reader-cpus").cloned();
+    let controller = BufferedGamepad::spawn_with(controller, DEFAULT_RING_CAPACITY, move || {
+        thread::tune_current_thread("reader", realtime, reader_cpus.as_deref());
+    })
+    .context("Failed to start controller reader")?;
+    let ring_counters = controller.counters();
 
-    // Create virtual keyboard
-    println!("Creating virtual keyboard...");
-    let keyboard = make_keyboard("BlazeRemap Virtual Keyboard")
-        .context("Failed to create virtual keyboard")?;
+    // Controls given to virtual gamepads never reach the mapper
+    let outputs = split_outputs(matches, &physical)?;
+    let controller: Box<dyn Gamepad> = if outputs.is_empty() {
+        Box::new(controller)
+    } else {
+        Box::new(SplitGamepad::new(Box::new(controller), outputs))
+    };
 
-    println!("\nBlazeRemap is now running!");
-    println!("Mappings:");
-    println!("  D-pad button → Arrow");
-    println!("  South button → S");
-    println!("  West button → A");
-    println!("  East button → D");
-    println!("\nPress Ctrl+C to exit.\n");
+    // Create mapping engine; the profile's actions start once root is dropped
+    let policy = ActionPolicy {
+        exec_allowlist: matches
+            .get_many::<String>("exec-allow")
+            .map(|programs| programs.cloned().collect())
+            .unwrap_or_default(),
+        exec_timeout: matches.get_one::<u64>("exec-timeout").map(|&secs| Duration::from_secs(secs)),
+        exec_confine: !matches.get_flag("exec-unconfined"),
+    };
+    let (mut engine, kinds, identities, profile, sticky_cue, switch_cue) =
+        match matches.get_many::<String>("profile") {
+            Some(paths) => {
+                let integrity = super::profile::integrity_policy(matches);
+                let mut profiles = Vec::new();
+                for path in paths {
+                    progress!("Loading profile {}...", path);
+                    let profile = Profile::load_verified(Path::new(path), &integrity)?;
+                    audit::record(AuditEvent::ProfileLoaded {
+                        profile: profile.name.clone(),
+                        file: Some(PathBuf::from(path)),
+                    });
+                    profiles.push(profile);
+                }
+                let profile = &profiles[0];
+                crate::logging::set_context("profile", &profile.name);
+                let mut engine = MappingEngine::load_from_profile(profile)?;
+                let sticky_cue = StickyCue::for_profile(profile, &device_paths[0]);
+                // Switching profiles can't make devices once root is dropped
+                let kinds = match drop_to {
+                    Some(_) => profiles
+                        .iter()
+                        .map(DeviceKinds::for_profile)
+                        .fold(DeviceKinds::default(), |all, kinds| all | kinds),
+                    None => DeviceKinds::for_profile(profile),
+                };
+                let identities = profile.settings.virtual_devices.clone();
+                let hotkeys: Vec<ProfileHotkey> = match matches.get_many("profile-hotkey") {
+                    Some(hotkeys) => hotkeys.cloned().collect(),
+                    None if profiles.len() > 1 => ProfileHotkey::defaults(),
+                    None => Vec::new(),
+                };
+                let switch_cue = match hotkeys.is_empty() {
+                    true => SwitchCue::for_profile(profile, &device_paths[0]),
+                    false => SwitchCue::for_hotkeys(profile, &device_paths[0]),
+                };
+                // Kept for its actions and watchers, which start later
+                let profile = Some(profile.clone());
+                if !hotkeys.is_empty() {
+                    for hotkey in &hotkeys {
+                        println!("Profile hotkey: {}", hotkey);
+                    }
+                    engine.set_profile_switcher(ProfileSwitcher::new(profiles, hotkeys)?)?;
+                }
+                (engine, kinds, identities, profile, sticky_cue, switch_cue)
+            }
+            None => {
+                progress!("Loading hardcoded mappings...");
+                let (engine, kinds) = (MappingEngine::new_hardcoded(), DeviceKinds::KEYBOARD);
+                (engine, kinds, DeviceIdentities::default(), None, None, None)
+            }
+        };
+    // Later flags win over earlier ones, and all of them over the profile
+    let identities = match matches.get_many::<DeviceIdentities>("device-identity") {
+        Some(flags) => flags.fold(identities, |identities, flag| flag.or(&identities)),
+        None => identities,
+    };
+    if let Some(problem) = identities.problem() {
+        anyhow::bail!("Invalid virtual device settings: {}", problem);
+    }
 
-    // Create and run event loop
-    let event_loop = EventLoop::new(controller, engine, keyboard);
-    event_loop.run()?;
+    // Flags add to the profile's own layout
+    let mut layout = engine.layout();
+    layout.swap_ab_xy |= matches.get_flag("swap-ab-xy");
+    layout.swap_sticks |= matches.get_flag("southpaw");
+    layout.swap_dpad |= matches.get_flag("swap-dpad");
+    engine.set_layout(layout);
 
-    println!("BlazeRemap stopped.");
+    // Only the devices the profile maps to; profiles switched to make theirs
+    let mut identity = gamepad_identity(matches, &physical, "BlazeRemap Virtual Gamepad");
+    identities.gamepad.apply_to_gamepad(&mut identity);
+    let keyboard = identities.keyboard("BlazeRemap Virtual Keyboard");
+    let mouse = identities.mouse("BlazeRemap Virtual Mouse");
+    let mut devices = VirtualDevices::new()
+        .with_lazy_keyboard(move || make_keyboard(&keyboard))
+        .with_lazy_mouse(move || new_virtual_mouse(&mouse))
+        .with_lazy_gamepad(move || new_virtual_gamepad(&identity));
+    // The first profile's custom devices serve every profile
+    for (name, device) in identities.custom {
+        let made_name = name.clone();
+        devices = devices
+            .with_lazy_custom(&name, move || platform::new_custom_device(&made_name, &device));
+    }
+    if kinds != DeviceKinds::default() {
+        progress!("Creating virtual {}...", kinds);
+    }
+    devices.prepare(kinds)?;
+
+    // Create and run event loop (on this thread)
+    let mapper_cpus = matches.get_one::<Vec<usize>>("mapper-cpus");
+    thread::tune_current_thread("mapper", realtime, mapper_cpus.map(Vec::as_slice));
+    // All that needs root is open; the rest, from the control socket on, runs as the user
+    if let Some(user) = drop_to {
+        let state = crate::logging::state_dir();
+        if let Err(e) = state.and_then(|dir| privilege::hand_over(user, &dir)) {
+            tracing::warn!("{:#}", e);
+        }
+        privilege::drop_to(user).context("Failed to drop root privileges")?;
+    }
+    // Plugins and the context and battery watchers start here, so under sudo
+    // xdotool, gdbus and the rest run as the user too
+    let (actions, context, notifications) = match &profile {
+        Some(profile) => (
+            ActionDispatcher::for_profile(profile, &policy)?,
+            // Conditions look at the first controller
+            ContextWatcher::for_profile(profile, &device_paths[0])?,
+            Notifications::for_profile(profile, &device_paths[0], &physical.name),
+        ),
+        None => (None, None, None),
+    };
+
+    progress!("\nBlazeRemap is now running!");
+    if !matches.contains_id("profile") {
+        progress!("Mappings:");
+        progress!("  D-pad button → Arrow");
+        progress!("  South button → S");
+        progress!("  West button → A");
+        progress!("  East button → D");
+    }
+    progress!("\nPress Ctrl+C to exit.\n");
+
+    let engine_switches = engine.profile().is_some();
+    let mut event_loop =
+        EventLoop::for_devices(controller, engine, devices).with_ring_counters(ring_counters);
+    if let Some(actions) = actions {
+        event_loop = event_loop.with_actions(actions);
+    }
+    if let Some(context) = context {
+        event_loop = event_loop.with_context(context);
+    }
+    if let Some(cue) = sticky_cue {
+        event_loop = event_loop.with_sticky_cue(cue);
+    }
+    if let Some(cue) = switch_cue {
+        event_loop = event_loop.with_switch_cue(cue);
+    }
+    if let Some(mut notifications) = notifications {
+        notifications.connected();
+        event_loop = event_loop.with_notifications(notifications);
+    }
+    if engine_switches {
+        event_loop = event_loop.with_profile_switching(policy, &device_paths[0]);
+    }
+    let debug_trace = match matches.get_one::<PathBuf>("trace") {
+        Some(path) => {
+            let trace = DebugTrace::create(path, TraceDevice::from(&physical))?;
+            println!("Writing debug trace to {}", path.display());
+            event_loop = event_loop.with_debug_trace(trace.clone());
+            Some(trace)
+        }
+        None => None,
+    };
+
+    // Lets `blazeremap status` and `recenter` reach us; remapping works without it
+    let _control = control_socket.and_then(|path| {
+        ControlServer::bind(
+            path,
+            control_handler(
+                event_loop.metrics(),
+                (event_loop.health(), device_paths.clone()),
+                Recenter::session(),
+                players,
+            ),
+        )
+        .map_err(|e| tracing::warn!("Control socket unavailable: {:#}", e))
+        .ok()
+    });
+
+    // Hidden, for chasing latency or CPU regressions where they happen
+    if let Some(addr) = matches.get_one::<String>("pprof") {
+        serve_pprof(addr, event_loop.metrics())?;
+    }
+
+    let metrics = event_loop.metrics();
+    let summary_path = matches.get_one::<PathBuf>("summary").cloned();
+    let (interrupted, path) = (Arc::clone(&metrics), summary_path.clone());
+    let interrupted_trace = debug_trace.clone();
+    platform::interrupt::on_interrupt(move || {
+        finish_trace(interrupted_trace.as_ref());
+        report_session(&interrupted, SessionEnd::Interrupted, path.as_deref())
+    });
+    let result = event_loop.run();
+    finish_trace(debug_trace.as_ref());
+    let ended = if result.is_ok() { SessionEnd::Disconnected } else { SessionEnd::Failed };
+    report_session(&metrics, ended, summary_path.as_deref());
+    result?;
+
+    progress!("BlazeRemap stopped.");
+    Ok(())
+}
+
+/// Answer profiling requests on `addr` from a thread of their own
+fn serve_pprof(addr: &str, metrics: Arc<PipelineMetrics>) -> Result<()> {
+    let addr = super::with_default_port(addr, pprof::DEFAULT_PORT);
+    let listener = TcpListener::bind(&addr).with_context(|| format!("Failed to bind {}", addr))?;
+    let local = listener.local_addr()?;
+    if !local.ip().is_loopback() {
+        tracing::warn!("Profiling on {} is reachable from the network", local);
+    }
+    println!("Profiling on http://{}/debug/pprof/", local);
+    std::thread::Builder::new().name("blazeremap-pprof".to_string()).spawn(move || {
+        if let Err(e) = pprof::serve(listener, metrics) {
+            tracing::warn!("Profiling endpoint stopped: {:#}", e);
+        }
+    })?;
     Ok(())
 }
 
+/// End the debug trace's file, if there is one
+fn finish_trace(trace: Option<&DebugTrace>) {
+    if let Some(Err(e)) = trace.map(DebugTrace::finish) {
+        tracing::warn!("{:#}", e);
+    }
+}
+
+/// Print how the session went, and save it to `path` if given
+fn report_session(metrics: &PipelineMetrics, ended: SessionEnd, path: Option<&Path>) {
+    let summary = SessionSummary::new(&metrics.snapshot(), ended);
+    println!("\n{}", summary);
+    if let Some(path) = path {
+        match summary.save(path) {
+            Ok(()) => println!("Summary saved to {}", path.display()),
+            Err(e) => tracing::warn!("Session summary not saved: {:#}", e),
+        }
+    }
+}
+
+/// What a virtual gamepad called `name` poses as: `physical` itself with
+/// `--clone-identity`, else `--type`
+fn gamepad_identity(
+    matches: &clap::ArgMatches,
+    physical: &GamepadInfo,
+    name: &str,
+) -> VirtualGamepadIdentity {
+    if matches.get_flag("clone-identity") {
+        return VirtualGamepadIdentity::cloned(physical);
+    }
+    let mut identity = VirtualGamepadIdentity::simulated(super::simulate::gamepad_type(matches));
+    identity.name = name.to_string();
+    identity
+}
+
+/// A virtual gamepad for each `--gamepad`, with the controls it takes
+fn split_outputs(
+    matches: &clap::ArgMatches,
+    physical: &GamepadInfo,
+) -> Result<Vec<(ControlSet, Box<dyn VirtualGamepad>)>> {
+    let Some(sets) = matches.get_many::<ControlSet>("gamepad") else {
+        return Ok(Vec::new());
+    };
+    let mut outputs = Vec::new();
+    for (number, controls) in sets.enumerate() {
+        let name = format!("BlazeRemap Split Controller {}", number + 1);
+        let identity = gamepad_identity(matches, physical, &name);
+        let mut gamepad = new_virtual_gamepad(&identity)
+            .with_context(|| format!("Failed to create {}", identity.name))?;
+        println!("Created {} at {}", identity.name, gamepad.dev_node()?.display());
+        outputs.push((controls.clone(), gamepad));
+    }
+    Ok(outputs)
+}
+
+/// Answers `blazeremap status` queries and `blazeremap recenter` and
+/// `players` requests; `session` is the session's health and devices
+fn control_handler(
+    metrics: Arc<PipelineMetrics>,
+    session: (Arc<SessionHealth>, Vec<String>),
+    recenter: Recenter,
+    players: Arc<Mutex<Players>>,
+) -> ipc::Handler {
+    Arc::new(move |line, peer| {
+        let (command, argument) = line.split_once(' ').unwrap_or((line, ""));
+        match command {
+            "metrics" => Ok(serde_json::to_value(metrics.snapshot())?),
+            "session" => Ok(serde_json::to_value(session.0.status(&session.1))?),
+            "recenter" => {
+                let axes = parse_stick_axes(argument)?;
+                recenter.request(&axes);
+                audit::record(AuditEvent::requested(line, peer));
+                Ok(serde_json::to_value(axes.iter().map(ToString::to_string).collect::<Vec<_>>())?)
+            }
+            "players" => {
+                let mut players = players.lock().unwrap();
+                if let Some(swap) = argument.strip_prefix("swap") {
+                    let (a, b) = players::parse_swap(swap)?;
+                    players.swap(a, b)?;
+                    audit::record(AuditEvent::requested(line, peer));
+                } else if !argument.is_empty() {
+                    anyhow::bail!("unknown players request '{}'", argument);
+                }
+                Ok(serde_json::to_value(players.slots())?)
+            }
+            other => anyhow::bail!("unknown command '{}'", other),
+        }
+    })
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -96,6 +688,20 @@ mod tests {
     use crate::input::manager::MockInputManager;
     use crate::output::keyboard::MockVirtualKeyboard;
 
+    fn test_info() -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/eventX".to_string(),
+            name: "Test Gamepad".to_string(),
+            gamepad_type: GamepadType::XboxOne,
+            vendor_id: 0,
+            vendor_name: "".to_string(),
+            product_id: 0,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
     #[test]
     fn test_run_logic_auto_detect_success() {
         let mut mock_manager = MockInputManager::new();
@@ -111,6 +717,8 @@ mod tests {
                     vendor_id: 0,
                     vendor_name: "".to_string(),
                     product_id: 0,
+                    uniq: None,
+                    phys: None,
                     capabilities: vec![],
                 }],
                 errors: vec![],
@@ -121,6 +729,7 @@ mod tests {
         mock_manager.expect_open_gamepad().with(mockall::predicate::eq(gamepad_path)).returning(
             |_| {
                 let mut mock_gamepad = MockGamepad::new();
+                mock_gamepad.expect_get_info().returning(test_info);
                 // Simulation of controller disconnection to exit loop
                 mock_gamepad.expect_read_event().returning(|| Ok(None));
                 Ok(Box::new(mock_gamepad))
@@ -129,8 +738,13 @@ mod tests {
 
         let matches = command().get_matches_from(vec!["run"]);
 
-        let result =
-            run_internal(&matches, &mock_manager, |_| Ok(Box::new(MockVirtualKeyboard::new())));
+        let result = run_internal(
+            &matches,
+            &mock_manager,
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+            None,
+            None,
+        );
 
         assert!(result.is_ok());
     }
@@ -145,8 +759,13 @@ mod tests {
 
         let matches = command().get_matches_from(vec!["run"]);
 
-        let result =
-            run_internal(&matches, &mock_manager, |_| Ok(Box::new(MockVirtualKeyboard::new())));
+        let result = run_internal(
+            &matches,
+            &mock_manager,
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+            None,
+            None,
+        );
 
         assert!(result.is_err());
         assert_eq!(
@@ -155,6 +774,34 @@ mod tests {
         );
     }
 
+    #[test]
+    fn test_run_logic_match_picks_controller() {
+        let mut mock_manager = MockInputManager::new();
+        mock_manager.expect_list_gamepads().returning(|| {
+            let mut ds4 = test_info();
+            ds4.path = "/dev/input/event7".to_string();
+            ds4.gamepad_type = GamepadType::DualShock4;
+            Ok(InputDetectionResult { gamepad_info: vec![test_info(), ds4], errors: vec![] })
+        });
+        mock_manager
+            .expect_open_gamepad()
+            .with(mockall::predicate::eq("/dev/input/event7"))
+            .returning(|_| {
+                let mut mock_gamepad = MockGamepad::new();
+                mock_gamepad.expect_get_info().returning(test_info);
+                mock_gamepad.expect_read_event().returning(|| Ok(None));
+                Ok(Box::new(mock_gamepad))
+            });
+        let keyboard = |_: &VirtualDeviceIdentity| Ok(Box::new(MockVirtualKeyboard::new()) as _);
+
+        let matches = command().get_matches_from(vec!["run", "--match", "type=dualshock4"]);
+        run_internal(&matches, &mock_manager, keyboard, None, None).unwrap();
+
+        let matches = command().get_matches_from(vec!["run", "--match", "type=dualsense"]);
+        let err = run_internal(&matches, &mock_manager, keyboard, None, None).unwrap_err();
+        assert_eq!(err.to_string(), "No controller matches type=dualsense (2 connected)");
+    }
+
     #[test]
     fn test_run_logic_manual_device() {
         let mut mock_manager = MockInputManager::new();
@@ -166,6 +813,7 @@ mod tests {
         mock_manager.expect_open_gamepad().with(mockall::predicate::eq(manual_path)).returning(
             |_| {
                 let mut mock_gamepad = MockGamepad::new();
+                mock_gamepad.expect_get_info().returning(test_info);
                 mock_gamepad.expect_read_event().returning(|| Ok(None));
                 Ok(Box::new(mock_gamepad))
             },
@@ -173,21 +821,411 @@ mod tests {
 
         let matches = command().get_matches_from(vec!["run", "--device", manual_path]);
 
+        let result = run_internal(
+            &matches,
+            &mock_manager,
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+            None,
+            None,
+        );
+
+        assert!(result.is_ok());
+    }
+
+    #[test]
+    fn test_run_logic_device_identity() {
+        let mut mock_manager = MockInputManager::new();
+        mock_manager.expect_open_gamepad().returning(|_| {
+            let mut mock_gamepad = MockGamepad::new();
+            mock_gamepad.expect_get_info().returning(test_info);
+            mock_gamepad.expect_read_event().returning(|| Ok(None));
+            Ok(Box::new(mock_gamepad))
+        });
+        let made = Arc::new(Mutex::new(None));
+        let keyboard = {
+            let made = Arc::clone(&made);
+            move |identity: &VirtualDeviceIdentity| {
+                *made.lock().unwrap() = Some(identity.clone());
+                Ok(Box::new(MockVirtualKeyboard::new()) as _)
+            }
+        };
+
+        let matches = command().get_matches_from(vec![
+            "run",
+            "--device",
+            "/dev/input/eventX",
+            "--device-identity",
+            "keyboard:name=Couch Keyboard,vendor=1209:0001",
+            "--device-identity",
+            "keyboard:version=2",
+        ]);
+        run_internal(&matches, &mock_manager, keyboard, None, None).unwrap();
+        let identity = made.lock().unwrap().take().unwrap();
+        assert_eq!(identity.name, "Couch Keyboard");
+        assert_eq!((identity.vendor_id, identity.product_id, identity.version), (0x1209, 1, 2));
+
+        let bad = command().try_get_matches_from(vec!["run", "--device-identity", "pad:name=X"]);
+        assert!(bad.is_err());
+    }
+
+    #[test]
+    fn test_control_handler_answers_metrics() {
+        let handler = control_handler(
+            Arc::new(PipelineMetrics::new()),
+            (Arc::new(SessionHealth::default()), Vec::new()),
+            Recenter::default(),
+            Arc::new(Mutex::new(Players::new(Vec::new()))),
+        );
+
+        let value = handler("metrics", None).unwrap();
+        let snapshot: crate::metrics::MetricsSnapshot = serde_json::from_value(value).unwrap();
+        assert_eq!(snapshot.frames, 0);
+        let session: crate::metrics::SessionStatus =
+            serde_json::from_value(handler("session", None).unwrap()).unwrap();
+        assert_eq!((session.profile, session.devices), (None, Vec::new()));
+        assert!(handler("reboot", None).is_err());
+    }
+
+    #[test]
+    fn test_control_handler_recenters() {
+        use crate::event::AxisCode;
+
+        let recenter = Recenter::default();
+        let mut watch = recenter.watch();
+        let handler = control_handler(
+            Arc::new(PipelineMetrics::new()),
+            (Arc::new(SessionHealth::default()), Vec::new()),
+            recenter,
+            Arc::new(Mutex::new(Players::new(Vec::new()))),
+        );
+
+        let answer = handler("recenter Left X, Left Y", None).unwrap();
+        assert_eq!(answer, serde_json::json!(["Left X", "Left Y"]));
+        assert_eq!(watch.take().collect::<Vec<_>>(), [AxisCode::LeftX, AxisCode::LeftY]);
+        assert_eq!(handler("recenter", None).unwrap().as_array().unwrap().len(), 4);
+        assert!(handler("recenter DPad X", None).is_err());
+    }
+
+    #[test]
+    fn test_control_handler_swaps_players() {
+        let players = Players::new(vec![
+            ("/dev/input/event3".to_string(), None),
+            ("/dev/input/event5".to_string(), None),
+        ]);
+        let handler = control_handler(
+            Arc::new(PipelineMetrics::new()),
+            (Arc::new(SessionHealth::default()), Vec::new()),
+            Recenter::default(),
+            Arc::new(Mutex::new(players)),
+        );
+
+        let answer = handler("players swap 2 1", None).unwrap();
+        assert_eq!(answer[0]["device"], "/dev/input/event5");
+        assert_eq!(answer[1]["player"], 2);
+        assert_eq!(handler("players", None).unwrap(), answer);
+        assert!(handler("players swap 1 3", None).is_err());
+        assert!(handler("players shuffle", None).is_err());
+    }
+
+    #[test]
+    fn test_run_logic_swap_ab_xy() {
+        use crate::event::{ButtonCode, InputEvent, KeyboardCode, KeyboardEventType, OutputEvent};
+
+        let mut mock_manager = MockInputManager::new();
+        mock_manager.expect_open_gamepad().returning(|_| {
+            let mut mock_gamepad = MockGamepad::new();
+            mock_gamepad.expect_get_info().returning(test_info);
+            mock_gamepad
+                .expect_read_event()
+                .times(1)
+                .returning(|| Ok(Some(InputEvent::button_press(ButtonCode::East))));
+            mock_gamepad.expect_read_event().returning(|| Ok(None));
+            Ok(Box::new(mock_gamepad))
+        });
+        // East acts as South, which the hardcoded mappings map to S
+        let mut mock_keyboard = MockVirtualKeyboard::new();
+        mock_keyboard
+            .expect_emit_frame()
+            .withf(|events| {
+                events
+                    == [OutputEvent::Keyboard {
+                        code: KeyboardCode::S,
+                        event_type: KeyboardEventType::Press,
+                    }]
+            })
+            .times(1)
+            .returning(|_| Ok(()));
+
+        let matches = command().get_matches_from(vec![
+            "run",
+            "--device",
+            "/dev/input/eventX",
+            "--swap-ab-xy",
+        ]);
         let result =
-            run_internal(&matches, &mock_manager, |_| Ok(Box::new(MockVirtualKeyboard::new())));
+            run_internal(&matches, &mock_manager, |_| Ok(Box::new(mock_keyboard)), None, None);
+
+        assert!(result.is_ok());
+    }
+
+    #[test]
+    fn test_realtime_flag() {
+        // Whatever BLAZEREMAP_REALTIME is where the tests run
+        let command = || command().mut_arg("realtime", |arg| arg.env(None::<&str>));
+        assert!(!command().get_matches_from(vec!["run"]).get_flag("realtime"));
+        assert!(command().get_matches_from(vec!["run", "--realtime"]).get_flag("realtime"));
+    }
+
+    #[test]
+    fn test_run_logic_renamed_controls() {
+        let mut mock_manager = MockInputManager::new();
+
+        mock_manager.expect_open_gamepads().never();
+        mock_manager
+            .expect_open_composite()
+            .withf(|sources, grab| {
+                sources.len() == 2 && sources[1].path == "/dev/input/event4" && !grab
+            })
+            .returning(|_, _| {
+                let mut mock_gamepad = MockGamepad::new();
+                mock_gamepad.expect_get_info().returning(test_info);
+                mock_gamepad.expect_read_event().returning(|| Ok(None));
+                Ok(Box::new(mock_gamepad))
+            });
+
+        let matches = command().get_matches_from(vec![
+            "run",
+            "-d",
+            "/dev/input/event3",
+            "-d",
+            "/dev/input/event4:LeftY=RightTrigger",
+        ]);
+
+        let result = run_internal(
+            &matches,
+            &mock_manager,
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+            None,
+            None,
+        );
+
+        assert!(result.is_ok());
+        assert!(command().try_get_matches_from(vec!["run", "-d", "/dev/x:Jump=South"]).is_err());
+    }
+
+    #[test]
+    fn test_run_logic_clone_identity_grabs_controller() {
+        let mut mock_manager = MockInputManager::new();
+
+        mock_manager.expect_open_gamepads().never();
+        mock_manager
+            .expect_open_composite()
+            .withf(|sources, grab| {
+                sources.len() == 1 && sources[0].path == "/dev/input/event3" && *grab
+            })
+            .returning(|_, _| {
+                let mut mock_gamepad = MockGamepad::new();
+                mock_gamepad.expect_get_info().returning(test_info);
+                mock_gamepad.expect_read_event().returning(|| Ok(None));
+                Ok(Box::new(mock_gamepad))
+            });
+
+        let matches =
+            command().get_matches_from(vec!["run", "-d", "/dev/input/event3", "--clone-identity"]);
+        let identity = gamepad_identity(&matches, &test_info(), "BlazeRemap Virtual Gamepad");
+        assert_eq!(identity.name, "Test Gamepad");
+
+        let result = run_internal(
+            &matches,
+            &mock_manager,
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+            None,
+            None,
+        );
+
+        assert!(result.is_ok());
+    }
+
+    #[test]
+    fn test_gamepad_outputs_parse_controls() {
+        let matches = command().get_matches_from(vec![
+            "run",
+            "--gamepad",
+            "DPad,Face",
+            "--gamepad",
+            "LeftX,LeftY",
+            "--type",
+            "dualsense",
+        ]);
+        assert_eq!(matches.get_many::<ControlSet>("gamepad").unwrap().count(), 2);
+        assert_eq!(super::super::simulate::gamepad_type(&matches), GamepadType::DualSense);
+
+        assert!(command().try_get_matches_from(vec!["run", "--gamepad", "Jump"]).is_err());
+    }
+
+    #[test]
+    fn test_cpu_options_parse_lists() {
+        let matches = command().get_matches_from(vec!["run", "--reader-cpus", "2-3"]);
+        assert_eq!(matches.get_one::<Vec<usize>>("reader-cpus"), Some(&vec![2, 3]));
+        assert!(matches.get_one::<Vec<usize>>("mapper-cpus").is_none());
+
+        assert!(command().try_get_matches_from(vec!["run", "--mapper-cpus", "x"]).is_err());
+    }
+
+    #[test]
+    fn test_run_logic_multiple_devices() {
+        let mut mock_manager = MockInputManager::new();
+
+        mock_manager.expect_open_gamepad().never();
+        mock_manager
+            .expect_open_gamepads()
+            .withf(|paths| paths == ["/dev/input/event3", "/dev/input/event4"])
+            .returning(|_| {
+                let mut mock_gamepad = MockGamepad::new();
+                mock_gamepad.expect_get_info().returning(test_info);
+                mock_gamepad.expect_read_event().returning(|| Ok(None));
+                Ok(Box::new(mock_gamepad))
+            });
+
+        let matches = command().get_matches_from(vec![
+            "run",
+            "-d",
+            "/dev/input/event3",
+            "-d",
+            "/dev/input/event4",
+        ]);
+
+        let result = run_internal(
+            &matches,
+            &mock_manager,
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+            None,
+            None,
+        );
 
         assert!(result.is_ok());
     }
 
+    #[test]
+    fn test_run_logic_profile_hotkeys_switch_profiles() {
+        use crate::event::{AxisCode, ButtonCode, InputEvent, KeyboardCode, OutputEvent};
+
+        let dir =
+            std::env::temp_dir().join(format!("blazeremap-run-hotkeys-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let default = dir.join("default.toml");
+        let deck = dir.join("deck.toml");
+        Profile::default_profile().save_to_file(&default).unwrap();
+        Profile::steam_deck_profile().save_to_file(&deck).unwrap();
+
+        let mut mock_manager = MockInputManager::new();
+        mock_manager.expect_open_gamepad().returning(|_| {
+            let mut events = vec![
+                InputEvent::button_press(ButtonCode::Mode),
+                InputEvent::axis_move(AxisCode::DPadX, 1),
+                InputEvent::sync(),
+                InputEvent::button_press(ButtonCode::Paddle2),
+                InputEvent::sync(),
+            ]
+            .into_iter();
+            let mut mock_gamepad = MockGamepad::new();
+            mock_gamepad.expect_get_info().returning(test_info);
+            mock_gamepad.expect_read_event().returning(move || Ok(events.next()));
+            Ok(Box::new(mock_gamepad))
+        });
+        let emitted = Arc::new(Mutex::new(Vec::new()));
+        let keyboard = {
+            let emitted = Arc::clone(&emitted);
+            move |_: &VirtualDeviceIdentity| {
+                let mut keyboard = MockVirtualKeyboard::new();
+                keyboard.expect_emit_frame().returning(move |events| {
+                    emitted.lock().unwrap().extend_from_slice(events);
+                    Ok(())
+                });
+                Ok(Box::new(keyboard) as _)
+            }
+        };
+
+        let run = |args: &[&str]| {
+            let args = [&["run", "-d", "/dev/input/eventX", "-p"], args].concat();
+            run_internal(
+                &command().get_matches_from(args),
+                &mock_manager,
+                keyboard.clone(),
+                None,
+                None,
+            )
+        };
+        let (default, deck) = (default.to_str().unwrap(), deck.to_str().unwrap());
+        run(&[default, "-p", deck]).unwrap();
+        let err = run(&[default, "--profile-hotkey", "Mode+North=Racing"]).unwrap_err();
+        std::fs::remove_dir_all(&dir).unwrap();
+
+        // Paddle 2 is only mapped by the Steam Deck profile
+        assert_eq!(
+            *emitted.lock().unwrap(),
+            [OutputEvent::Keyboard {
+                code: KeyboardCode::Space,
+                event_type: crate::event::KeyboardEventType::Press
+            }]
+        );
+        assert_eq!(err.to_string(), "Hotkey Mode+North=Racing names no profile; there are Default");
+    }
+
+    #[test]
+    fn test_run_logic_profile_with_undefined_plugin() {
+        use crate::mapping::{Mapping, types::TargetType};
+
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "Mode".to_string(),
+            target_type: TargetType::Plugin,
+            target_name: "lights".to_string(),
+            ..Default::default()
+        });
+        let path = std::env::temp_dir().join(format!("blazeremap-run-{}.toml", std::process::id()));
+        profile.save_to_file(&path).unwrap();
+
+        let mut mock_manager = MockInputManager::new();
+        mock_manager.expect_open_gamepad().returning(|_| {
+            let mut mock_gamepad = MockGamepad::new();
+            mock_gamepad.expect_get_info().returning(test_info);
+            mock_gamepad.expect_read_event().returning(|| Ok(None));
+            Ok(Box::new(mock_gamepad))
+        });
+
+        let matches = command().get_matches_from(vec![
+            "run",
+            "--device",
+            "/dev/input/eventX",
+            "--profile",
+            path.to_str().unwrap(),
+        ]);
+        let result = run_internal(
+            &matches,
+            &mock_manager,
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+            None,
+            None,
+        );
+        std::fs::remove_file(path).unwrap();
+
+        assert_eq!(
+            result.unwrap_err().to_string(),
+            "mapping for Mode uses plugin 'lights', which the profile doesn't define"
+        );
+    }
+
     #[test]
     fn test_run_logic_event_processing() {
-        use crate::event::{ButtonCode, InputEvent, KeyboardCode};
+        use crate::event::{ButtonCode, InputEvent, KeyboardCode, KeyboardEventType, OutputEvent};
 
         let mut mock_manager = MockInputManager::new();
         let manual_path = "/dev/input/eventX";
 
         mock_manager.expect_open_gamepad().returning(move |_| {
             let mut mock_gamepad = MockGamepad::new();
+            mock_gamepad.expect_get_info().returning(test_info);
             // Sequence of events: 1 press, then None to exit
             mock_gamepad
                 .expect_read_event()
@@ -200,14 +1238,21 @@ mod tests {
         let mut mock_keyboard = MockVirtualKeyboard::new();
         // The hardcoded engine maps ButtonCode::South to KeyboardCode::S
         mock_keyboard
-            .expect_press_key()
-            .with(mockall::predicate::eq(KeyboardCode::S))
+            .expect_emit_frame()
+            .withf(|events| {
+                events
+                    == [OutputEvent::Keyboard {
+                        code: KeyboardCode::S,
+                        event_type: KeyboardEventType::Press,
+                    }]
+            })
             .times(1)
             .returning(|_| Ok(()));
 
         let matches = command().get_matches_from(vec!["run", "--device", manual_path]);
 
-        let result = run_internal(&matches, &mock_manager, |_| Ok(Box::new(mock_keyboard)));
+        let result =
+            run_internal(&matches, &mock_manager, |_| Ok(Box::new(mock_keyboard)), None, None);
 
         assert!(result.is_ok());
     }
@@ -0,0 +1,81 @@
+// Serve command - local JSON API for scripts and dashboards
+use super::with_default_port;
+use crate::api::{self, Api, state::SessionStore};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgMatches, Command, value_parser};
+use std::net::TcpListener;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+pub fn command() -> Command {
+    Command::new("serve")
+        .about("Serve a local HTTP/JSON API for devices, profiles and remap sessions")
+        .long_about(
+            "Serve a local HTTP/JSON API for devices, profiles and remap sessions.\n\n\
+             curl localhost:8680/api/devices\n\
+             curl --json '{\"profile\": \"default\"}' localhost:8680/api/sessions\n\
+             curl -X DELETE localhost:8680/api/sessions/1\n\n\
+             Sessions are saved to $XDG_STATE_HOME/blazeremap/sessions.json and started \
+             again when 'serve' restarts.\n\n\
+             The API is unauthenticated; keep it on a loopback address.",
+        )
+        .arg(
+            Arg::new("listen")
+                .long("listen")
+                .value_name("ADDR[:PORT]")
+                .default_value("127.0.0.1")
+                .help("Address to listen on (port defaults to 8680)"),
+        )
+        .arg(
+            Arg::new("profiles")
+                .long("profiles")
+                .value_name("DIR")
+                .value_parser(value_parser!(PathBuf))
+                .help(
+                    "Directory of profiles (TOML, YAML or JSON) offered next to the built-in ones",
+                ),
+        )
+        .args(super::profile::integrity_args())
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let addr = with_default_port(matches.get_one::<String>("listen").unwrap(), api::DEFAULT_PORT);
+    let profile_dir = matches.get_one::<PathBuf>("profiles").cloned();
+    if let Some(dir) = &profile_dir
+        && !dir.is_dir()
+    {
+        anyhow::bail!("profile directory {} does not exist", dir.display());
+    }
+
+    let listener = TcpListener::bind(&addr).with_context(|| format!("Failed to bind {}", addr))?;
+    let local = listener.local_addr()?;
+    if !local.ip().is_loopback() {
+        tracing::warn!("API on {} is reachable from the network without authentication", local);
+    }
+    progress!("Serving API on http://{}/api (Ctrl+C to stop)", local);
+
+    let mut api = Api::new(profile_dir).with_integrity(super::profile::integrity_policy(matches));
+    match SessionStore::user() {
+        Ok(store) => api = api.with_store(store),
+        Err(e) => tracing::warn!("Sessions won't survive a restart: {:#}", e),
+    }
+    // Sessions from before a crash or reboot
+    match api.restore() {
+        Ok(0) => {}
+        Ok(restored) => progress!("Restored {} session(s)", restored),
+        Err(e) => tracing::warn!("Sessions not restored: {:#}", e),
+    }
+    api::serve(listener, Arc::new(api))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_defaults_to_loopback() {
+        let matches = command().try_get_matches_from(["serve"]).unwrap();
+        assert_eq!(matches.get_one::<String>("listen").unwrap(), "127.0.0.1");
+        assert!(matches.get_one::<PathBuf>("profiles").is_none());
+    }
+}
@@ -0,0 +1,598 @@
+// Setup command - grant the access remapping needs, asking first
+use anyhow::{Context, Result, bail};
+use clap::{Arg, ArgAction, ArgMatches, Command};
+use std::io::{BufRead, Write};
+
+const INPUT_GROUP: &str = "input";
+
+pub fn command() -> Command {
+    Command::new("setup")
+        .about("Set up this machine for BlazeRemap")
+        .subcommand_required(true)
+        .subcommand(
+            Command::new("access")
+                .about("Let your user read controllers and make virtual devices")
+                .long_about(
+                    "Let your user read controllers and make virtual devices.\n\n\
+                     Checks what is missing, explains the two ways to grant it, joining the \
+                     'input' group or installing a udev rule for controllers only, and runs the \
+                     one you pick with sudo after showing the commands.",
+                )
+                .arg(
+                    Arg::new("group")
+                        .long("group")
+                        .action(ArgAction::SetTrue)
+                        .conflicts_with("udev")
+                        .help("Join the 'input' group"),
+                )
+                .arg(
+                    Arg::new("udev")
+                        .long("udev")
+                        .action(ArgAction::SetTrue)
+                        .help("Install a udev rule for controllers and /dev/uinput instead"),
+                )
+                .arg(
+                    Arg::new("yes")
+                        .long("yes")
+                        .short('y')
+                        .action(ArgAction::SetTrue)
+                        .help("Run the commands without asking"),
+                ),
+        )
+        .subcommand(
+            Command::new("uinput")
+                .about("Load the uinput module virtual devices are made with")
+                .long_about(
+                    "Load the uinput module virtual devices are made with.\n\n\
+                     When /dev/uinput is missing because the module isn't loaded, loads it now \
+                     and at every boot, running the commands with sudo after showing them.",
+                )
+                .arg(
+                    Arg::new("yes")
+                        .long("yes")
+                        .short('y')
+                        .action(ArgAction::SetTrue)
+                        .help("Run the commands without asking"),
+                ),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    match matches.subcommand() {
+        Some(("access", sub_matches)) => {
+            let status = access_status()?;
+            let stdin = std::io::stdin();
+            run_internal(&mut std::io::stdout(), &mut stdin.lock(), &status, sub_matches, run_step)
+        }
+        Some(("uinput", sub_matches)) => {
+            let status = uinput_status()?;
+            let stdin = std::io::stdin();
+            run_uinput(&mut std::io::stdout(), &mut stdin.lock(), &status, sub_matches, run_step)
+        }
+        _ => unreachable!("Subcommand required"),
+    }
+}
+
+/// How the user stands with a group
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum GroupStatus {
+    Member,
+    /// Added since this login session started
+    JoinedAfterLogin,
+    NotMember,
+    /// No such group here
+    Missing,
+}
+
+/// What access the user has now
+#[derive(Debug, Clone)]
+struct AccessStatus {
+    user: String,
+    root: bool,
+    input_group: GroupStatus,
+    controllers_readable: bool,
+    uinput_writable: bool,
+    rules_file: String,
+    rules: String,
+}
+
+#[cfg(target_os = "linux")]
+fn access_status() -> Result<AccessStatus> {
+    use crate::platform::linux::{
+        preflight::{self, Membership},
+        sandbox,
+    };
+
+    let user = nix::unistd::User::from_uid(nix::unistd::Uid::current())
+        .ok()
+        .flatten()
+        .context("Failed to look up the current user")?;
+    let access = sandbox::probe_device_access();
+    Ok(AccessStatus {
+        user: user.name,
+        root: crate::platform::privilege::is_root(),
+        input_group: match preflight::membership(INPUT_GROUP) {
+            Some(Membership::Session) => GroupStatus::Member,
+            Some(Membership::Login) => GroupStatus::JoinedAfterLogin,
+            Some(Membership::None) => GroupStatus::NotMember,
+            None => GroupStatus::Missing,
+        },
+        controllers_readable: access.input_readable,
+        uinput_writable: access.uinput_writable,
+        rules_file: preflight::RULES_FILE.to_string(),
+        rules: preflight::udev_rules(),
+    })
+}
+
+#[cfg(not(target_os = "linux"))]
+fn access_status() -> Result<AccessStatus> {
+    Err(crate::platform::PlatformError::unsupported("setting up device access").into())
+}
+
+/// How the uinput module stands
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum ModuleStatus {
+    Loaded,
+    NotLoaded,
+    /// Not in this kernel
+    Unavailable,
+}
+
+/// Whether virtual devices can be made, and if not why
+#[derive(Debug, Clone)]
+struct UinputStatus {
+    root: bool,
+    /// /dev/uinput is there
+    node: bool,
+    module: ModuleStatus,
+    /// What `check_uinput` says is wrong, with its fix
+    problem: Option<String>,
+    modules_load_file: String,
+}
+
+#[cfg(target_os = "linux")]
+fn uinput_status() -> Result<UinputStatus> {
+    use crate::platform::linux::preflight::{self, UinputModule};
+
+    let node = std::path::Path::new("/dev/uinput").exists();
+    Ok(UinputStatus {
+        root: crate::platform::privilege::is_root(),
+        node,
+        module: match preflight::uinput_module() {
+            // Loaded however it looks, if its node is there
+            _ if node => ModuleStatus::Loaded,
+            UinputModule::Loaded => ModuleStatus::Loaded,
+            UinputModule::NotLoaded => ModuleStatus::NotLoaded,
+            UinputModule::Unavailable => ModuleStatus::Unavailable,
+        },
+        problem: preflight::check_uinput().err().map(|problem| problem.to_string()),
+        modules_load_file: preflight::MODULES_LOAD_FILE.to_string(),
+    })
+}
+
+#[cfg(not(target_os = "linux"))]
+fn uinput_status() -> Result<UinputStatus> {
+    Err(crate::platform::PlatformError::unsupported("loading the uinput module").into())
+}
+
+/// A command to run, with what to write to its stdin
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Step {
+    argv: Vec<String>,
+    input: Option<String>,
+}
+
+impl Step {
+    /// `argv` run as root: through sudo unless already `root`
+    fn root(root: bool, argv: &[&str]) -> Self {
+        let sudo = (!root).then_some("sudo");
+        Self {
+            argv: sudo.into_iter().chain(argv.iter().copied()).map(String::from).collect(),
+            input: None,
+        }
+    }
+
+    fn with_input(mut self, input: String) -> Self {
+        self.input = Some(input);
+        self
+    }
+}
+
+fn run_step(step: &Step) -> Result<()> {
+    use std::process::Stdio;
+
+    let program = &step.argv[0];
+    let mut child = std::process::Command::new(program)
+        .args(&step.argv[1..])
+        .stdin(if step.input.is_some() { Stdio::piped() } else { Stdio::inherit() })
+        .stdout(Stdio::null())
+        .spawn()
+        .with_context(|| format!("Failed to run {}", program))?;
+    if let (Some(input), Some(mut stdin)) = (&step.input, child.stdin.take()) {
+        stdin.write_all(input.as_bytes())?;
+    }
+    let status = child.wait()?;
+    if !status.success() {
+        bail!("'{}' failed: {}", step.argv.join(" "), status);
+    }
+    Ok(())
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Method {
+    Group,
+    Udev,
+}
+
+fn run_internal<W: Write, R: BufRead>(
+    writer: &mut W,
+    reader: &mut R,
+    status: &AccessStatus,
+    matches: &ArgMatches,
+    mut run: impl FnMut(&Step) -> Result<()>,
+) -> Result<()> {
+    let yes_no = |ok: bool| if ok { "yes" } else { "no" };
+    writeln!(writer, "User:                 {}", status.user)?;
+    writeln!(
+        writer,
+        "'{}' group:        {}",
+        INPUT_GROUP,
+        match status.input_group {
+            GroupStatus::Member => "member",
+            GroupStatus::JoinedAfterLogin => "joined, but not in this login session yet",
+            GroupStatus::NotMember => "not a member",
+            GroupStatus::Missing => "doesn't exist here",
+        }
+    )?;
+    writeln!(writer, "Controllers readable: {}", yes_no(status.controllers_readable))?;
+    writeln!(writer, "/dev/uinput writable: {}", yes_no(status.uinput_writable))?;
+    writeln!(writer)?;
+
+    if status.controllers_readable && status.uinput_writable {
+        writeln!(
+            writer,
+            "Nothing to do: BlazeRemap can read controllers and make virtual devices."
+        )?;
+        return Ok(());
+    }
+    if status.input_group == GroupStatus::JoinedAfterLogin {
+        writeln!(
+            writer,
+            "You joined '{}' after logging in. Log out and back in, or run 'newgrp {}', for it \
+             to take effect.",
+            INPUT_GROUP, INPUT_GROUP
+        )?;
+        return Ok(());
+    }
+
+    let can_join = status.input_group == GroupStatus::NotMember;
+    writeln!(writer, "BlazeRemap needs more access. There are two ways to grant it:\n")?;
+    match status.input_group {
+        GroupStatus::Member => writeln!(
+            writer,
+            "  1. (you are in the '{}' group already, and it doesn't grant this here)",
+            INPUT_GROUP
+        )?,
+        GroupStatus::Missing => {
+            writeln!(writer, "  1. (there is no '{}' group to join here)", INPUT_GROUP)?
+        }
+        _ => writeln!(
+            writer,
+            "  1. Join the '{}' group. Simple, but then every program you run can read every \
+             input device,\n     keyboards included: a malicious one could record what you \
+             type, passwords too.",
+            INPUT_GROUP
+        )?,
+    }
+    writeln!(
+        writer,
+        "  2. Install a udev rule giving whoever sits at this computer access to game \
+         controllers and\n     /dev/uinput only. Narrower: keyboards stay private. \
+         (/dev/uinput lets programs type as you;\n     BlazeRemap needs it either way.)\n"
+    )?;
+
+    let method = if matches.get_flag("group") {
+        Method::Group
+    } else if matches.get_flag("udev") {
+        Method::Udev
+    } else {
+        match ask(writer, reader, "Choose 1 or 2 (2 is recommended; anything else cancels): ")?
+            .as_str()
+        {
+            "1" => Method::Group,
+            "2" => Method::Udev,
+            _ => {
+                writeln!(writer, "Cancelled; nothing changed.")?;
+                return Ok(());
+            }
+        }
+    };
+    if method == Method::Group && !can_join {
+        bail!("Joining the '{}' group won't help here; use --udev", INPUT_GROUP);
+    }
+
+    let steps = match method {
+        Method::Group => {
+            vec![Step::root(status.root, &["usermod", "-aG", INPUT_GROUP, &status.user])]
+        }
+        Method::Udev => vec![
+            Step::root(status.root, &["tee", &status.rules_file]).with_input(status.rules.clone()),
+            Step::root(status.root, &["udevadm", "control", "--reload"]),
+            Step::root(status.root, &["udevadm", "trigger"]),
+        ],
+    };
+    if !confirm(writer, reader, &steps, matches, &mut run)? {
+        return Ok(());
+    }
+
+    match method {
+        Method::Group => writeln!(
+            writer,
+            "Done. Log out and back in for the '{}' group to take effect.",
+            INPUT_GROUP
+        )?,
+        Method::Udev => {
+            writeln!(writer, "Done. Reconnect your controllers if they still can't be read.")?
+        }
+    }
+    if method == Method::Group && !status.uinput_writable {
+        writeln!(
+            writer,
+            "/dev/uinput may belong to another group; if 'blazeremap doctor' still reports it, \
+             run 'blazeremap setup access --udev'."
+        )?;
+    }
+    Ok(())
+}
+
+fn run_uinput<W: Write, R: BufRead>(
+    writer: &mut W,
+    reader: &mut R,
+    status: &UinputStatus,
+    matches: &ArgMatches,
+    mut run: impl FnMut(&Step) -> Result<()>,
+) -> Result<()> {
+    writeln!(
+        writer,
+        "uinput module: {}",
+        match status.module {
+            ModuleStatus::Loaded => "loaded",
+            ModuleStatus::NotLoaded => "not loaded",
+            ModuleStatus::Unavailable => "not in this kernel",
+        }
+    )?;
+    writeln!(writer, "/dev/uinput:   {}", if status.node { "present" } else { "missing" })?;
+    writeln!(writer)?;
+
+    match (status.node, status.module) {
+        (true, _) => {
+            writeln!(writer, "Nothing to do: the uinput module is loaded.")?;
+            if let Some(problem) = &status.problem {
+                writeln!(writer, "/dev/uinput can't be used yet, though:\n{}", problem)?;
+            }
+            return Ok(());
+        }
+        (false, ModuleStatus::NotLoaded) => {}
+        (false, _) => bail!(
+            "Loading the module won't help here:\n{}",
+            status.problem.as_deref().unwrap_or("/dev/uinput is missing")
+        ),
+    }
+
+    let steps = [
+        Step::root(status.root, &["modprobe", "uinput"]),
+        Step::root(status.root, &["tee", &status.modules_load_file])
+            .with_input("uinput\n".to_string()),
+    ];
+    if !confirm(writer, reader, &steps, matches, &mut run)? {
+        return Ok(());
+    }
+    writeln!(
+        writer,
+        "Done. uinput is loaded, and will be at every boot. If /dev/uinput can't be written \
+         yet, run 'blazeremap setup access'."
+    )?;
+    Ok(())
+}
+
+/// Show `steps` and, once confirmed or given --yes, run them; false if
+/// cancelled
+fn confirm<W: Write, R: BufRead>(
+    writer: &mut W,
+    reader: &mut R,
+    steps: &[Step],
+    matches: &ArgMatches,
+    run: &mut impl FnMut(&Step) -> Result<()>,
+) -> Result<bool> {
+    writeln!(writer, "This will run:")?;
+    for step in steps {
+        writeln!(writer, "  {}", step.argv.join(" "))?;
+        if let Some(input) = &step.input {
+            for line in input.lines() {
+                writeln!(writer, "    │ {}", line)?;
+            }
+        }
+    }
+    if !matches.get_flag("yes") && ask(writer, reader, "Go ahead? [y/N] ")? != "y" {
+        writeln!(writer, "Cancelled; nothing changed.")?;
+        return Ok(false);
+    }
+    for step in steps {
+        run(step)?;
+    }
+    Ok(true)
+}
+
+/// Ask `question` and read the answer, lowercased; empty at end of input
+fn ask<W: Write, R: BufRead>(writer: &mut W, reader: &mut R, question: &str) -> Result<String> {
+    write!(writer, "{}", question)?;
+    writer.flush()?;
+    let mut answer = String::new();
+    if reader.read_line(&mut answer)? == 0 {
+        writeln!(writer)?;
+    }
+    Ok(answer.trim().to_lowercase())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn status(input_group: GroupStatus) -> AccessStatus {
+        AccessStatus {
+            user: "alice".to_string(),
+            root: false,
+            input_group,
+            controllers_readable: false,
+            uinput_writable: false,
+            rules_file: "/etc/udev/rules.d/70-blazeremap.rules".to_string(),
+            rules: "KERNEL==\"uinput\"\n".to_string(),
+        }
+    }
+
+    fn setup(status: &AccessStatus, args: &[&str], answers: &str) -> (String, Vec<Step>) {
+        let matches = command()
+            .get_matches_from(["setup", "access"].iter().chain(args).copied().collect::<Vec<_>>());
+        let (_, sub_matches) = matches.subcommand().unwrap();
+        let mut output = Vec::new();
+        let mut steps = Vec::new();
+        run_internal(&mut output, &mut answers.as_bytes(), status, sub_matches, |step: &Step| {
+            steps.push(step.clone());
+            Ok(())
+        })
+        .unwrap();
+        (String::from_utf8(output).unwrap(), steps)
+    }
+
+    #[test]
+    fn test_nothing_to_do() {
+        let status = AccessStatus {
+            controllers_readable: true,
+            uinput_writable: true,
+            ..status(GroupStatus::Member)
+        };
+        let (output, steps) = setup(&status, &[], "");
+        assert!(output.contains("Nothing to do"), "{}", output);
+        assert!(steps.is_empty());
+    }
+
+    #[test]
+    fn test_joined_after_login() {
+        let (output, steps) = setup(&status(GroupStatus::JoinedAfterLogin), &[], "");
+        assert!(output.contains("Log out and back in, or run 'newgrp input'"), "{}", output);
+        assert!(steps.is_empty());
+    }
+
+    #[test]
+    fn test_join_group_after_confirming() {
+        let (output, steps) = setup(&status(GroupStatus::NotMember), &[], "1\ny\n");
+        assert!(output.contains("could record what you type"), "{}", output);
+        assert!(output.contains("  sudo usermod -aG input alice\n"), "{}", output);
+        assert_eq!(
+            steps,
+            [Step {
+                argv: vec!["sudo", "usermod", "-aG", "input", "alice"]
+                    .into_iter()
+                    .map(String::from)
+                    .collect(),
+                input: None
+            }]
+        );
+    }
+
+    #[test]
+    fn test_udev_rule() {
+        let status = AccessStatus { root: true, ..status(GroupStatus::Missing) };
+        let (output, steps) = setup(&status, &["--udev", "--yes"], "");
+        assert!(output.contains("    │ KERNEL==\"uinput\"\n"), "{}", output);
+        let argv: Vec<String> = steps.iter().map(|step| step.argv.join(" ")).collect();
+        assert_eq!(
+            argv,
+            [
+                "tee /etc/udev/rules.d/70-blazeremap.rules",
+                "udevadm control --reload",
+                "udevadm trigger"
+            ]
+        );
+        assert_eq!(steps[0].input.as_deref(), Some("KERNEL==\"uinput\"\n"));
+    }
+
+    #[test]
+    fn test_cancelled() {
+        let (output, steps) = setup(&status(GroupStatus::NotMember), &[], "2\n\n");
+        assert!(output.ends_with("Cancelled; nothing changed.\n"), "{}", output);
+        assert!(steps.is_empty());
+        let (_, steps) = setup(&status(GroupStatus::NotMember), &[], "");
+        assert!(steps.is_empty());
+    }
+
+    #[test]
+    fn test_no_group_to_join() {
+        let matches = command().get_matches_from(["setup", "access", "--group"]);
+        let (_, sub_matches) = matches.subcommand().unwrap();
+        let err = run_internal(
+            &mut Vec::new(),
+            &mut "".as_bytes(),
+            &status(GroupStatus::Missing),
+            sub_matches,
+            |_: &Step| Ok(()),
+        )
+        .err()
+        .unwrap();
+        assert_eq!(err.to_string(), "Joining the 'input' group won't help here; use --udev");
+    }
+
+    fn uinput(args: &[&str], status: &UinputStatus, answers: &str) -> Result<(String, Vec<Step>)> {
+        let matches = command()
+            .get_matches_from(["setup", "uinput"].iter().chain(args).copied().collect::<Vec<_>>());
+        let (_, sub_matches) = matches.subcommand().unwrap();
+        let mut output = Vec::new();
+        let mut steps = Vec::new();
+        run_uinput(&mut output, &mut answers.as_bytes(), status, sub_matches, |step: &Step| {
+            steps.push(step.clone());
+            Ok(())
+        })?;
+        Ok((String::from_utf8(output).unwrap(), steps))
+    }
+
+    fn missing(module: ModuleStatus) -> UinputStatus {
+        UinputStatus {
+            root: false,
+            node: false,
+            module,
+            problem: Some("/dev/uinput: missing\n  └─ ...".to_string()),
+            modules_load_file: "/etc/modules-load.d/uinput.conf".to_string(),
+        }
+    }
+
+    #[test]
+    fn test_uinput_loaded_now_and_at_boot() {
+        let (output, steps) = uinput(&[], &missing(ModuleStatus::NotLoaded), "y\n").unwrap();
+        assert!(output.starts_with("uinput module: not loaded\n/dev/uinput:   missing\n"));
+        assert!(output.contains("  sudo modprobe uinput\n"), "{}", output);
+        assert!(output.contains("    │ uinput\n"), "{}", output);
+        let argv: Vec<String> = steps.iter().map(|step| step.argv.join(" ")).collect();
+        assert_eq!(argv, ["sudo modprobe uinput", "sudo tee /etc/modules-load.d/uinput.conf"]);
+        assert_eq!(steps[1].input.as_deref(), Some("uinput\n"));
+
+        let (output, steps) = uinput(&[], &missing(ModuleStatus::NotLoaded), "\n").unwrap();
+        assert!(output.ends_with("Cancelled; nothing changed.\n"), "{}", output);
+        assert!(steps.is_empty());
+    }
+
+    #[test]
+    fn test_uinput_nothing_to_load() {
+        let status = UinputStatus {
+            node: true,
+            module: ModuleStatus::Loaded,
+            problem: None,
+            ..missing(ModuleStatus::Loaded)
+        };
+        let (output, steps) = uinput(&["--yes"], &status, "").unwrap();
+        assert!(output.ends_with("Nothing to do: the uinput module is loaded.\n"), "{}", output);
+        assert!(steps.is_empty());
+
+        let err = uinput(&["--yes"], &missing(ModuleStatus::Unavailable), "").unwrap_err();
+        assert!(err.to_string().starts_with("Loading the module won't help here:"), "{}", err);
+    }
+}
@@ -0,0 +1,256 @@
+// Simulate command - a virtual controller driven by scripts or the terminal
+use crate::{
+    event::InputEvent,
+    input::gamepad::GamepadType,
+    output::gamepad::{VirtualGamepad, VirtualGamepadIdentity},
+    platform,
+    trace::{
+        Trace, TraceInput,
+        script::{self, Script},
+    },
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgAction, ArgMatches, Command, value_parser};
+use std::io::{BufRead, IsTerminal, Write};
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+
+pub fn command() -> Command {
+    Command::new("simulate")
+        .about("Create a virtual controller and drive it from a script or the terminal")
+        .long_about(
+            "Create a virtual controller and drive it from a script or the terminal.\n\n\
+             The controller shows up like a real one, so 'detect', 'run' and other tools can \
+             be tried without hardware, e.g. in CI containers. SCRIPT is either a trace from \
+             'blazeremap record' or one command per line:\n\n  \
+             press South          press buttons (several change in one frame)\n  \
+             release South        release them\n  \
+             tap East 50          press, hold for 50ms (default 50), release\n  \
+             axis LeftX -32768    move an axis\n  \
+             wait 100             pause for 100ms\n\n\
+             Without SCRIPT, commands are read from standard input as they are typed.",
+        )
+        .arg(
+            Arg::new("script").value_name("SCRIPT").value_parser(value_parser!(PathBuf)).help(
+                "Script or trace to play (reads commands from standard input if not specified)",
+            ),
+        )
+        .arg(type_arg())
+        .arg(Arg::new("name").long("name").help("Device name (default: after the type)"))
+        .arg(
+            Arg::new("hold")
+                .long("hold")
+                .action(ArgAction::SetTrue)
+                .help("Keep the controller connected after the script ends, until Ctrl+C"),
+        )
+}
+
+/// `--type`: the controller a virtual one poses as
+pub(super) fn type_arg() -> Arg {
+    Arg::new("type")
+        .short('t')
+        .long("type")
+        .value_parser([
+            "xbox-360",
+            "xbox-one",
+            "xbox-series",
+            "xbox-elite",
+            "dualshock4",
+            "dualsense",
+            "generic",
+        ])
+        .default_value("xbox-one")
+        .help("Controller to pose as")
+}
+
+/// The controller `--type` asks to pose as
+pub(super) fn gamepad_type(matches: &ArgMatches) -> GamepadType {
+    match matches.get_one::<String>("type").unwrap().as_str() {
+        "xbox-360" => GamepadType::Xbox360,
+        "xbox-series" => GamepadType::XboxSeries,
+        "xbox-elite" => GamepadType::XboxElite,
+        "dualshock4" => GamepadType::DualShock4,
+        "dualsense" => GamepadType::DualSense,
+        "generic" => GamepadType::Generic,
+        _ => GamepadType::XboxOne,
+    }
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    let mut identity = VirtualGamepadIdentity::simulated(gamepad_type(matches));
+    if let Some(name) = matches.get_one::<String>("name") {
+        identity.name = name.clone();
+    }
+    // Parse before creating the device, so mistakes don't leave readers a
+    // controller that does nothing
+    let script = match matches.get_one::<PathBuf>("script") {
+        Some(path) => Some(load(path)?),
+        None => None,
+    };
+
+    let mut gamepad = platform::new_virtual_gamepad(&identity)?;
+    println!("Simulating {} at {}", identity.name, gamepad.dev_node()?.display());
+
+    match script {
+        Some(script) => {
+            let frames = play(gamepad.as_mut(), &script)?;
+            println!("Played {} frames", frames);
+        }
+        None => interactive(gamepad.as_mut())?,
+    }
+
+    if matches.get_flag("hold") {
+        progress!("Holding the controller connected (Ctrl+C to stop)");
+        loop {
+            std::thread::park();
+        }
+    }
+    Ok(())
+}
+
+/// A trace, or a script to compile
+fn load(path: &Path) -> Result<Script> {
+    let text = std::fs::read_to_string(path)
+        .with_context(|| format!("Failed to read {}", path.display()))?;
+    if text.trim_start().starts_with('{') {
+        let events = Trace::read(text.as_bytes())?.events;
+        let length = events.last().map(|event| event.offset()).unwrap_or_default();
+        return Ok(Script { events, length });
+    }
+    script::parse(&text).with_context(|| format!("Invalid script {}", path.display()))
+}
+
+/// Run commands as they are typed; a bad one is reported and skipped
+fn interactive(gamepad: &mut dyn VirtualGamepad) -> Result<()> {
+    let stdin = std::io::stdin();
+    let prompt = stdin.is_terminal();
+    if prompt {
+        progress!("Type commands (press, release, tap, axis, wait); Ctrl+D to quit");
+    }
+    let mut lines = stdin.lock().lines();
+    loop {
+        if prompt {
+            print!("> ");
+            std::io::stdout().flush()?;
+        }
+        let Some(line) = lines.next() else {
+            return Ok(());
+        };
+        let (mut events, mut t_us) = (Vec::new(), 0);
+        match script::parse_line(&line?, &mut t_us, &mut events) {
+            Ok(()) => {
+                play(gamepad, &Script { events, length: Duration::from_micros(t_us) })?;
+            }
+            Err(e) => eprintln!("Error: {:#}", e),
+        }
+    }
+}
+
+/// Emit the script's events frame by frame at their times from now, then
+/// wait out its length; returns the number of frames
+fn play(gamepad: &mut dyn VirtualGamepad, script: &Script) -> Result<usize> {
+    let start = Instant::now();
+    let mut frame: Vec<InputEvent> = Vec::new();
+    let mut frames = 0;
+    let mut events = script.events.iter().peekable();
+
+    while let Some(event) = events.next() {
+        if event.input != TraceInput::Sync {
+            if frame.is_empty() {
+                std::thread::sleep(
+                    (start + event.offset()).saturating_duration_since(Instant::now()),
+                );
+            }
+            frame.push(event.to_input(start));
+            // A trace cut short mid-frame still has its last events sent
+            if events.peek().is_some() {
+                continue;
+            }
+        }
+        if frame.is_empty() {
+            continue;
+        }
+        gamepad.emit_frame(&frame)?;
+        frame.clear();
+        frames += 1;
+    }
+    std::thread::sleep((start + script.length).saturating_duration_since(Instant::now()));
+    Ok(frames)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::ButtonCode;
+
+    /// Remembers the frames it was sent and when
+    #[derive(Default)]
+    struct FakeGamepad {
+        frames: Vec<(Instant, Vec<InputEvent>)>,
+    }
+
+    impl VirtualGamepad for FakeGamepad {
+        fn emit_frame(&mut self, events: &[InputEvent]) -> Result<()> {
+            self.frames.push((Instant::now(), events.to_vec()));
+            Ok(())
+        }
+
+        fn dev_node(&mut self) -> Result<PathBuf> {
+            Ok(PathBuf::from("/dev/input/event99"))
+        }
+    }
+
+    #[test]
+    fn test_play_sends_frames_at_their_times() {
+        let script =
+            script::parse("press South East\nwait 20\nrelease South\naxis LeftX 5\nwait 10")
+                .unwrap();
+        let mut gamepad = FakeGamepad::default();
+        let start = Instant::now();
+
+        assert_eq!(play(&mut gamepad, &script).unwrap(), 3);
+        assert!(start.elapsed() >= Duration::from_millis(30));
+        let sizes: Vec<_> = gamepad.frames.iter().map(|(_, frame)| frame.len()).collect();
+        assert_eq!(sizes, [2, 1, 1]);
+        assert!(matches!(
+            gamepad.frames[1].1[0],
+            InputEvent::Button { code: ButtonCode::South, pressed: false, .. }
+        ));
+        assert!(gamepad.frames[0].0 - start < Duration::from_millis(20));
+        assert!(gamepad.frames[1].0 - start >= Duration::from_millis(20));
+    }
+
+    #[test]
+    fn test_play_sends_unsynced_tail() {
+        let mut script = script::parse("press South").unwrap();
+        script.events.pop();
+        let mut gamepad = FakeGamepad::default();
+        assert_eq!(play(&mut gamepad, &script).unwrap(), 1);
+    }
+
+    #[test]
+    fn test_load_tells_traces_from_scripts() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-simulate-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let trace = dir.join("session.jsonl");
+        std::fs::write(
+            &trace,
+            "{\"trace\":1,\"device\":{\"name\":\"Pad\",\"type\":\"Generic\",\"vendor_id\":0,\"product_id\":0}}\n\
+             {\"t_us\":5,\"type\":\"button\",\"code\":\"South\",\"pressed\":true}\n",
+        )
+        .unwrap();
+        let script = dir.join("demo.txt");
+        std::fs::write(&script, "# demo\ntap South\n").unwrap();
+        let bad = dir.join("bad.txt");
+        std::fs::write(&bad, "hold South\n").unwrap();
+
+        let loaded = load(&trace).unwrap();
+        assert_eq!(loaded.events.len(), 1);
+        assert_eq!(loaded.length, Duration::from_micros(5));
+        let loaded = load(&script).unwrap();
+        assert_eq!(loaded.events.len(), 4);
+        assert_eq!(loaded.length, Duration::from_millis(50));
+        assert!(load(&bad).is_err());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
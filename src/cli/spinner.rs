@@ -0,0 +1,102 @@
+// Spinner - shows a slow step is still going
+//
+// Drawn on stderr, on one line redrawn in place, and only when stderr is a
+// terminal and --quiet isn't given, so pipes and scripts never see it. The
+// line is cleared when the spinner is dropped, before anything else prints.
+
+use std::io::{IsTerminal, Write};
+use std::sync::{Arc, Condvar, Mutex};
+use std::thread::JoinHandle;
+use std::time::Duration;
+
+const FRAMES: [char; 10] = ['⠋', '⠙', '⠹', '⠸', '⠼', '⠴', '⠦', '⠧', '⠇', '⠏'];
+const FRAME_TIME: Duration = Duration::from_millis(80);
+
+#[derive(Default)]
+struct State {
+    message: String,
+    done: bool,
+}
+
+type Shared = Arc<(Mutex<State>, Condvar)>;
+
+pub(crate) struct Spinner {
+    state: Shared,
+    thread: Option<JoinHandle<()>>,
+}
+
+impl Spinner {
+    /// Start spinning next to `message`, if anyone would see it
+    pub fn start(message: &str) -> Self {
+        let visible = std::io::stderr().is_terminal() && !super::quiet();
+        Self::start_if(visible, message)
+    }
+
+    fn start_if(visible: bool, message: &str) -> Self {
+        let state: Shared = Arc::default();
+        state.0.lock().unwrap().message = message.to_string();
+        let thread = visible.then(|| {
+            let state = Arc::clone(&state);
+            std::thread::spawn(move || spin(&state))
+        });
+        Self { state, thread }
+    }
+
+    /// A setter for the message, for other threads and callbacks
+    pub fn messages(&self) -> impl Fn(String) + Send + Sync + 'static {
+        let state = Arc::clone(&self.state);
+        move |message| state.0.lock().unwrap_or_else(|e| e.into_inner()).message = message
+    }
+}
+
+impl Drop for Spinner {
+    fn drop(&mut self) {
+        let (lock, wake) = &*self.state;
+        lock.lock().unwrap_or_else(|e| e.into_inner()).done = true;
+        wake.notify_all();
+        if let Some(thread) = self.thread.take() {
+            let _ = thread.join();
+        }
+    }
+}
+
+/// Redraw the line until the spinner is dropped, then clear it
+fn spin(state: &Shared) {
+    let (lock, wake) = &**state;
+    let mut stderr = std::io::stderr();
+    let mut state = lock.lock().unwrap_or_else(|e| e.into_inner());
+    for frame in 0.. {
+        if state.done {
+            break;
+        }
+        let _ = write!(stderr, "{}", line(frame, &state.message));
+        let _ = stderr.flush();
+        state = wake.wait_timeout(state, FRAME_TIME).unwrap_or_else(|e| e.into_inner()).0;
+    }
+    let _ = write!(stderr, "\r\x1b[2K");
+    let _ = stderr.flush();
+}
+
+/// The spinner line at `frame`, drawn over the last one
+fn line(frame: usize, message: &str) -> String {
+    format!("\r\x1b[2K{} {}", FRAMES[frame % FRAMES.len()], message)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_line_redraws_in_place() {
+        assert_eq!(line(0, "Opening devices"), "\r\x1b[2K⠋ Opening devices");
+        assert_eq!(line(11, "Opening devices"), "\r\x1b[2K⠙ Opening devices");
+    }
+
+    #[test]
+    fn test_hidden_spinner_still_takes_messages() {
+        let spinner = Spinner::start_if(false, "Opening devices");
+        assert!(spinner.thread.is_none());
+        spinner.messages()("Opening /dev/input/event3 (1/2)".to_string());
+        assert_eq!(spinner.state.0.lock().unwrap().message, "Opening /dev/input/event3 (1/2)");
+    }
+}
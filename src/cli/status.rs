@@ -0,0 +1,210 @@
+use anyhow::Result;
+use clap::{Arg, ArgAction, Command};
+use std::io::Write;
+
+use crate::{
+    ipc,
+    metrics::{HistogramSnapshot, MetricsSnapshot, SessionStatus, format_uptime},
+    output::players::PlayerSlot,
+};
+
+/// Build the 'status' command
+pub fn command() -> Command {
+    Command::new("status").about("Show the running daemon's session, its health and rates").arg(
+        Arg::new("metrics")
+            .long("metrics")
+            .action(ArgAction::SetTrue)
+            .help("Include per-stage latency histograms (read → map → write)"),
+    )
+}
+
+/// CLI handle for the 'status' command
+pub fn handle(matches: &clap::ArgMatches) -> Result<()> {
+    let socket = ipc::socket_path();
+    let snapshot: MetricsSnapshot = ipc::request(&socket, "metrics")?;
+    // Older daemons know neither sessions nor player numbers
+    let session: Option<SessionStatus> = ipc::request(&socket, "session").ok();
+    let players: Vec<PlayerSlot> = ipc::request(&socket, "players").unwrap_or_default();
+    let report = Report { snapshot: &snapshot, session: session.as_ref(), players: &players };
+    write_report(&mut std::io::stdout(), &report, matches.get_flag("metrics"))
+}
+
+/// What the daemon answered
+struct Report<'a> {
+    snapshot: &'a MetricsSnapshot,
+    session: Option<&'a SessionStatus>,
+    players: &'a [PlayerSlot],
+}
+
+/// Internal function that writes to any writer (testable!)
+fn write_report<W: Write>(writer: &mut W, report: &Report, metrics: bool) -> Result<()> {
+    let (snapshot, players) = (report.snapshot, report.players);
+    writeln!(writer, "Daemon running for {}", format_uptime(snapshot.uptime))?;
+    if let Some(session) = report.session {
+        write_session(writer, session)?;
+    }
+    writeln!(writer, "  Frames:  {} ({:.1}/s)", snapshot.frames, snapshot.rate(snapshot.frames))?;
+    writeln!(writer, "  Events:  {} ({:.1}/s)", snapshot.events, snapshot.rate(snapshot.events))?;
+    writeln!(writer, "  Dropped: {}", snapshot.dropped)?;
+    writeln!(writer, "  Debounced: {}", snapshot.debounced)?;
+    for slot in players {
+        writeln!(writer, "  Player {}: {}", slot.player, slot.device)?;
+    }
+    let degraded = report.session.map(SessionStatus::degraded).unwrap_or_default();
+    if !degraded.is_empty() {
+        writeln!(writer, "\nDegraded:")?;
+        for problem in degraded {
+            writeln!(writer, "  ✗ {}", problem)?;
+        }
+    }
+
+    if !metrics {
+        return Ok(());
+    }
+
+    writeln!(writer, "\nStage latency (µs; percentiles are bucket upper bounds):")?;
+    writeln!(
+        writer,
+        "  {:<6} {:>9} {:>8} {:>8} {:>8} {:>8} {:>8}",
+        "stage", "count", "mean", "p50", "p95", "p99", "max"
+    )?;
+    let stages = [("read", &snapshot.read), ("map", &snapshot.map), ("write", &snapshot.write)];
+    for (name, histogram) in stages {
+        let cell = |value: Option<u64>| value.map_or("-".to_string(), |v| v.to_string());
+        writeln!(
+            writer,
+            "  {:<6} {:>9} {:>8} {:>8} {:>8} {:>8} {:>8}",
+            name,
+            histogram.count(),
+            cell(histogram.mean_us()),
+            cell(histogram.percentile_us(50.0)),
+            cell(histogram.percentile_us(95.0)),
+            cell(histogram.percentile_us(99.0)),
+            cell((histogram.count() > 0).then_some(histogram.max_us)),
+        )?;
+    }
+
+    for (name, histogram) in stages {
+        writeln!(writer, "\n{}:", name)?;
+        write_histogram(writer, histogram)?;
+    }
+    Ok(())
+}
+
+/// The session's id and each of its devices with the profile it maps with
+fn write_session<W: Write>(writer: &mut W, session: &SessionStatus) -> Result<()> {
+    match &session.session_id {
+        Some(id) => writeln!(writer, "  Session: {} (pid {})", id, session.pid)?,
+        None => writeln!(writer, "  Session: pid {}", session.pid)?,
+    }
+    let profile = session.profile.as_deref().unwrap_or("built-in mappings");
+    for device in &session.devices {
+        let state = if device.connected { "" } else { " (disconnected)" };
+        writeln!(writer, "  Device:  {} → {}{}", device.path, profile, state)?;
+    }
+    Ok(())
+}
+
+/// One bar per non-empty bucket, scaled to the fullest bucket
+fn write_histogram<W: Write>(writer: &mut W, histogram: &HistogramSnapshot) -> Result<()> {
+    const BAR_WIDTH: u64 = 40;
+
+    let peak = histogram.buckets.iter().copied().max().unwrap_or(0);
+    if peak == 0 {
+        writeln!(writer, "  (no samples)")?;
+        return Ok(());
+    }
+
+    for (index, &count) in histogram.buckets.iter().enumerate() {
+        if count == 0 {
+            continue;
+        }
+        let bar = "█".repeat((count * BAR_WIDTH).div_ceil(peak) as usize);
+        writeln!(writer, "  <{:>9}µs {:<40} {}", 1u64 << index, bar, count)?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::metrics::{DeviceStatus, PipelineMetrics};
+    use std::time::Duration;
+
+    fn sample_snapshot() -> MetricsSnapshot {
+        let metrics = PipelineMetrics::new();
+        for us in [3, 5, 6, 40] {
+            metrics.map.record(Duration::from_micros(us));
+        }
+        metrics.record_frame(4);
+        let mut snapshot = metrics.snapshot();
+        snapshot.uptime = Duration::from_secs(3723);
+        snapshot
+    }
+
+    #[test]
+    fn test_summary_without_metrics() {
+        let mut output = Vec::new();
+        let players =
+            [PlayerSlot { player: 1, device: "/dev/input/event3".to_string(), light: true }];
+        let snapshot = sample_snapshot();
+        let report = Report { snapshot: &snapshot, session: None, players: &players };
+        write_report(&mut output, &report, false).unwrap();
+
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("Daemon running for 1h 02m 03s"));
+        assert!(text.contains("Events:  4 (0.0/s)"));
+        assert!(text.contains("  Player 1: /dev/input/event3\n"));
+        assert!(!text.contains("Stage latency"));
+        assert!(!text.contains("Session:"));
+    }
+
+    #[test]
+    fn test_session_devices_and_degraded_states() {
+        let session = SessionStatus {
+            pid: 4242,
+            session_id: Some("3f9a2c0d1e8b7a65".to_string()),
+            profile: Some("Racing".to_string()),
+            devices: vec![
+                DeviceStatus {
+                    path: "/dev/input/event3".to_string(),
+                    connected: true,
+                    merged: 1250,
+                },
+                DeviceStatus { path: "/dev/input/event5".to_string(), connected: false, merged: 0 },
+            ],
+            problems: vec!["Profile 'Racing': no actions: xdotool not allowed".to_string()],
+        };
+        let mut output = Vec::new();
+        let snapshot = sample_snapshot();
+        let report = Report { snapshot: &snapshot, session: Some(&session), players: &[] };
+        write_report(&mut output, &report, false).unwrap();
+
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("  Session: 3f9a2c0d1e8b7a65 (pid 4242)\n"));
+        assert!(text.contains(
+            "  Device:  /dev/input/event3 → Racing\n  \
+             Device:  /dev/input/event5 → Racing (disconnected)\n"
+        ));
+        assert!(text.ends_with(
+            "\nDegraded:\n  \
+             ✗ /dev/input/event5 disconnected\n  \
+             ✗ /dev/input/event3 flooded events: 1250 frames merged\n  \
+             ✗ Profile 'Racing': no actions: xdotool not allowed\n"
+        ));
+    }
+
+    #[test]
+    fn test_metrics_table_and_histogram() {
+        let mut output = Vec::new();
+        let snapshot = sample_snapshot();
+        let report = Report { snapshot: &snapshot, session: None, players: &[] };
+        write_report(&mut output, &report, true).unwrap();
+
+        let text = String::from_utf8(output).unwrap();
+        assert!(text.contains("  map            4       13        8       40       40       40"));
+        assert!(text.contains("  read           0        -        -"));
+        assert!(text.contains("<        8µs"));
+        assert!(text.contains("(no samples)"));
+    }
+}
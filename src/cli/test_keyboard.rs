@@ -1,6 +1,6 @@
 use crate::event::KeyboardCode;
-use crate::output::keyboard::VirtualKeyboard;
-use crate::platform::linux::LinuxVirtualKeyboard;
+use crate::output::identity::VirtualDeviceIdentity;
+use crate::platform;
 use anyhow::Result;
 use clap::Command;
 use std::thread;
@@ -11,8 +11,9 @@ pub fn command() -> Command {
 }
 
 pub fn handle(_matches: &clap::ArgMatches) -> Result<()> {
-    println!("Creating virtual keyboard...");
-    let mut keyboard = LinuxVirtualKeyboard::new("BlazeRemap Test Keyboard")?;
+    progress!("Creating virtual keyboard...");
+    let mut keyboard =
+        platform::new_virtual_keyboard(&VirtualDeviceIdentity::named("BlazeRemap Test Keyboard"))?;
 
     // Try to show sysfs path
     match keyboard.sys_path() {
@@ -25,9 +26,9 @@ pub fn handle(_matches: &clap::ArgMatches) -> Result<()> {
         }
     }
 
-    println!("\nEmitting space key every second...");
-    println!("Open a text editor to see the output.");
-    println!("Press Ctrl+C to stop.\n");
+    progress!("\nEmitting space key every second...");
+    progress!("Open a text editor to see the output.");
+    progress!("Press Ctrl+C to stop.\n");
 
     // Emit space key in a loop
     for i in 1.. {
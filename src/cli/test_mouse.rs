@@ -0,0 +1,62 @@
+use crate::output::identity::VirtualDeviceIdentity;
+use crate::output::mouse::{MouseEvent, ScreenSize};
+use crate::platform;
+use anyhow::Result;
+use clap::{Arg, Command};
+use std::thread;
+use std::time::Duration;
+
+pub fn command() -> Command {
+    Command::new("test-mouse")
+        .about("Test virtual mouse by moving the pointer around a square every second")
+        .arg(
+            Arg::new("screen")
+                .long("screen")
+                .value_name("WIDTHxHEIGHT")
+                .value_parser(|text: &str| text.parse::<ScreenSize>())
+                .help("Make the mouse absolute on a screen this size and jump between its corners"),
+        )
+}
+
+pub fn handle(matches: &clap::ArgMatches) -> Result<()> {
+    progress!("Creating virtual mouse...");
+    let screen = matches.get_one::<ScreenSize>("screen").copied();
+    let identity = VirtualDeviceIdentity::named("BlazeRemap Test Mouse");
+    let mut mouse = match screen {
+        Some(screen) => platform::new_absolute_mouse(&identity, screen)?,
+        None => platform::new_virtual_mouse(&identity)?,
+    };
+    match mouse.dev_node() {
+        Ok(path) => println!("Virtual device node: {}", path.display()),
+        Err(e) => println!("Note: Could not get device node: {}", e),
+    }
+
+    progress!("\nMoving the pointer every second...");
+    progress!("Press Ctrl+C to stop.\n");
+
+    for step in 0.. {
+        let event = corner(step, screen);
+        mouse.emit_frame(&[event])?;
+        println!("[{}] {:?}", step + 1, event);
+        thread::sleep(Duration::from_secs(1));
+    }
+
+    Ok(())
+}
+
+/// Step `step` around the square: 200 pixels a side, or between the
+/// screen's corners a tenth of the way in
+fn corner(step: usize, screen: Option<ScreenSize>) -> MouseEvent {
+    match screen {
+        Some(ScreenSize { width, height }) => {
+            let (left, top) = ((width / 10) as i32, (height / 10) as i32);
+            let (right, bottom) = (width as i32 - left, height as i32 - top);
+            let (x, y) = [(left, top), (right, top), (right, bottom), (left, bottom)][step % 4];
+            MouseEvent::MoveTo { x, y }
+        }
+        None => {
+            let (dx, dy) = [(200, 0), (0, 200), (-200, 0), (0, -200)][step % 4];
+            MouseEvent::Move { dx, dy }
+        }
+    }
+}
@@ -0,0 +1,105 @@
+// Trace command - work with trace files
+use crate::{
+    platform,
+    trace::{Trace, evemu::EvemuRecording},
+};
+use anyhow::{Context, Result};
+use clap::{Arg, ArgMatches, Command, value_parser};
+use std::io::BufWriter;
+use std::path::PathBuf;
+
+pub fn command() -> Command {
+    Command::new("trace")
+        .about("Convert recordings into traces")
+        .subcommand_required(true)
+        .arg_required_else_help(true)
+        .subcommand(
+            Command::new("convert")
+                .about("Convert an evemu recording of a controller into a trace")
+                .long_about(
+                    "Convert an evemu recording of a controller into a trace.\n\n\
+                     The raw events are converted the way a live controller's are, so the trace \
+                     holds what 'blazeremap record' would have written. The format is described \
+                     in docs/trace-format.md.",
+                )
+                .arg(
+                    Arg::new("recording")
+                        .value_name("RECORDING")
+                        .required(true)
+                        .value_parser(value_parser!(PathBuf))
+                        .help("Output of 'evemu-record'"),
+                )
+                .arg(
+                    Arg::new("output")
+                        .short('o')
+                        .long("output")
+                        .value_name("FILE")
+                        .value_parser(value_parser!(PathBuf))
+                        .help("Trace file to write (printed if not specified)"),
+                ),
+        )
+}
+
+pub fn handle(matches: &ArgMatches) -> Result<()> {
+    match matches.subcommand() {
+        Some(("convert", sub_matches)) => {
+            let path = sub_matches.get_one::<PathBuf>("recording").unwrap();
+            let text = std::fs::read_to_string(path)
+                .with_context(|| format!("Failed to read {}", path.display()))?;
+            let trace = convert(&text)?;
+            let Some(output) = sub_matches.get_one::<PathBuf>("output") else {
+                return trace.write(std::io::stdout().lock());
+            };
+            let file = std::fs::File::create(output)
+                .with_context(|| format!("Failed to create {}", output.display()))?;
+            trace.write(BufWriter::new(file))?;
+            println!(
+                "{} events from {} written to {}",
+                trace.events.len(),
+                trace.header.device.name,
+                output.display()
+            );
+            Ok(())
+        }
+        _ => unreachable!("Subcommand required"),
+    }
+}
+
+fn convert(text: &str) -> Result<Trace> {
+    platform::evemu_to_trace(&EvemuRecording::parse(text)?)
+}
+
+#[cfg(all(test, target_os = "linux"))]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_convert() {
+        let trace = convert(
+            "N: Sony Interactive Entertainment Wireless Controller
+I: 0003 054c 0ce6 8111
+E: 0.000000 0001 0133 0001
+E: 0.000000 0000 0000 0000
+",
+        )
+        .unwrap();
+        let mut text = Vec::new();
+        trace.write(&mut text).unwrap();
+        assert_eq!(
+            String::from_utf8(text).unwrap(),
+            concat!(
+                r#"{"trace":1,"device":{"name":"Sony Interactive Entertainment Wireless Controller","type":"DualSense","vendor_id":1356,"product_id":3302,"capabilities":[]}}"#,
+                "\n",
+                r#"{"t_us":0,"type":"button","code":"North","pressed":true}"#,
+                "\n",
+                r#"{"t_us":0,"type":"sync"}"#,
+                "\n",
+            )
+        );
+    }
+
+    #[test]
+    fn test_convert_rejects_other_files() {
+        assert!(convert(r#"{"trace":1}"#).is_err());
+    }
+}
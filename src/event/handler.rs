@@ -1,19 +1,51 @@
+use std::ops::Range;
+use std::sync::Arc;
 use std::time::Instant;
 
 use anyhow::Result;
 
 use crate::{
     Gamepad,
-    event::{KeyboardEventType, OutputEvent},
-    mapping::MappingEngine,
-    output::keyboard::VirtualKeyboard,
+    action::{ActionDispatcher, ActionPolicy},
+    audit::{self, AuditEvent},
+    event::{EventTap, InputEvent, OutputEvent, RingCounters, Switch, TapEvent},
+    mapping::{MappingEngine, context::ContextWatcher},
+    metrics::{PipelineMetrics, SessionHealth},
+    output::{
+        devices::{DeviceKinds, VirtualDevices},
+        feedback::{StickyCue, SwitchCue},
+        keyboard::VirtualKeyboard,
+        notify::Notifications,
+    },
+    trace::debug::DebugTrace,
 };
 
 pub struct EventLoop {
     gamepad: Box<dyn Gamepad>,
     engine: MappingEngine,
-    keyboard: Box<dyn VirtualKeyboard>,
-    event_count: u64,
+    devices: VirtualDevices,
+    disconnected: bool,
+    ring: Option<RingCounters>,
+    metrics: Arc<PipelineMetrics>,
+    health: Arc<SessionHealth>,
+    tap: Option<EventTap>,
+    actions: Option<ActionDispatcher>,
+    context: Option<ContextWatcher>,
+    sticky_cue: Option<StickyCue>,
+    switch_cue: Option<SwitchCue>,
+    notifications: Option<Notifications>,
+    debug_trace: Option<DebugTrace>,
+    // Exec policy and controller to rebuild actions and context with, when
+    // the engine switches profiles
+    switching: Option<(ActionPolicy, String)>,
+
+    // Reused per-frame buffers
+    frame: Vec<InputEvent>,
+    output: Vec<OutputEvent>,
+    // For the debug trace: each frame event's output, and the rules it matched
+    traced: Vec<(Range<usize>, Vec<String>)>,
+
+    frame_count: u64,
     total_latency_us: u64,
 
     // Statistics
@@ -27,89 +59,584 @@ impl EventLoop {
         engine: MappingEngine,
         keyboard: Box<dyn VirtualKeyboard>,
     ) -> Self {
+        Self::for_devices(controller, engine, VirtualDevices::new().with_keyboard(keyboard))
+    }
+
+    /// Map to keys, mouse and gamepad controls, sent to `devices`
+    pub fn for_devices(
+        controller: Box<dyn Gamepad>,
+        engine: MappingEngine,
+        devices: VirtualDevices,
+    ) -> Self {
+        let health = SessionHealth::new(engine.profile().map(|profile| profile.name.as_str()));
         Self {
             gamepad: controller,
             engine,
-            keyboard,
-            event_count: 0,
+            devices,
+            disconnected: false,
+            ring: None,
+            metrics: Arc::new(PipelineMetrics::new()),
+            health: Arc::new(health),
+            tap: None,
+            actions: None,
+            context: None,
+            sticky_cue: None,
+            switch_cue: None,
+            notifications: None,
+            debug_trace: None,
+            switching: None,
+            frame: Vec::new(),
+            output: Vec::new(),
+            traced: Vec::new(),
+            frame_count: 0,
             total_latency_us: 0,
             max_latency_us: 0,
             min_latency_us: u64::MAX,
         }
     }
 
+    /// Report drops of the ring buffer feeding this loop in its statistics
+    pub fn with_ring_counters(mut self, counters: RingCounters) -> Self {
+        self.metrics.attach_ring(counters.clone());
+        self.ring = Some(counters);
+        self
+    }
+
+    /// Publish every frame and its mapped output to `tap`'s subscribers
+    pub fn with_tap(mut self, tap: EventTap) -> Self {
+        self.tap = Some(tap);
+        self
+    }
+
+    /// Hand actions triggered by the profile's action mappings to `actions`
+    pub fn with_actions(mut self, actions: ActionDispatcher) -> Self {
+        self.actions = Some(actions);
+        self
+    }
+
+    /// Switch conditional mappings as `context` reports changes
+    pub fn with_context(mut self, context: ContextWatcher) -> Self {
+        self.context = Some(context);
+        self
+    }
+
+    /// Signal sticky keys being latched and let go through `cue`
+    pub fn with_sticky_cue(mut self, cue: StickyCue) -> Self {
+        self.sticky_cue = Some(cue);
+        self
+    }
+
+    /// Confirm layer and mapping switches through `cue`
+    pub fn with_switch_cue(mut self, cue: SwitchCue) -> Self {
+        self.switch_cue = Some(cue);
+        self
+    }
+
+    /// Tell the desktop about profile switches and the controller going away
+    pub fn with_notifications(mut self, notifications: Notifications) -> Self {
+        self.notifications = Some(notifications);
+        self
+    }
+
+    /// Write every event with the rules it matched and its output to `trace`
+    pub fn with_debug_trace(mut self, trace: DebugTrace) -> Self {
+        self.debug_trace = Some(trace);
+        self
+    }
+
+    /// Start the actions and context watcher of each profile the engine's
+    /// hotkeys switch to, with `policy` and the controller at `device`
+    pub fn with_profile_switching(mut self, policy: ActionPolicy, device: &str) -> Self {
+        self.switching = Some((policy, device.to_string()));
+        self
+    }
+
+    /// Per-stage timing histograms, updated as frames are processed
+    pub fn metrics(&self) -> Arc<PipelineMetrics> {
+        Arc::clone(&self.metrics)
+    }
+
+    /// The profile mapped with and problems carried on through
+    pub fn health(&self) -> Arc<SessionHealth> {
+        Arc::clone(&self.health)
+    }
+
     /// Run the event loop (blocking)
     pub fn run(mut self) -> Result<()> {
         tracing::info!("Event loop starting...");
 
-        loop {
-            match self.gamepad.read_event()? {
-                Some(input_event) => {
-                    let start = Instant::now();
-                    // Process through mapping engine
-                    for output_event in self.engine.process(&input_event)? {
-                        #[cfg(debug_assertions)] // Only trace per button event in debug build to not interrupt latency
-                        tracing::debug!("Gamepad: {} -> {}", input_event, output_event);
-
-                        self.emit_output(output_event)?;
-                    }
+        while self.step()? {}
 
-                    // Measure ONLY processing latency
-                    let latency_us = start.elapsed().as_micros() as u64;
-
-                    self.event_count += 1;
-                    self.total_latency_us += latency_us;
-                    self.max_latency_us = self.max_latency_us.max(latency_us);
-                    self.min_latency_us = self.min_latency_us.min(latency_us);
-
-                    // Log statistics every 100 events
-                    if self.event_count.is_multiple_of(100) {
-                        let avg = self.total_latency_us / self.event_count;
-                        tracing::info!(
-                            "Stats: {} events | avg: {}µs ({:.2}ms) | min: {}µs | max: {}µs",
-                            self.event_count,
-                            avg,
-                            avg as f64 / 1000.0,
-                            self.min_latency_us,
-                            self.max_latency_us
-                        );
-                    }
-                }
+        tracing::info!("Event loop stopped");
+        // Print final statistics
+        if self.frame_count > 0 {
+            let avg = self.total_latency_us / self.frame_count;
+            tracing::info!(
+                "Final: {} frames | avg: {}µs ({:.2}ms) | min: {}µs | max: {}µs{}",
+                self.frame_count,
+                avg,
+                avg as f64 / 1000.0,
+                self.min_latency_us,
+                self.max_latency_us,
+                self.ring_summary()
+            );
+        }
+        Ok(())
+    }
+
+    /// Read, map and emit a single input frame (blocking)
+    ///
+    /// A frame is everything the controller reported up to its `Sync`, so
+    /// e.g. stick X and Y updates reach the mapping engine and the virtual
+    /// device together. Returns false once the controller has disconnected.
+    /// `run` is just this in a loop; tools like `latency` drive it one frame
+    /// at a time.
+    pub fn step(&mut self) -> Result<bool> {
+        if self.disconnected {
+            return Ok(false);
+        }
+
+        // Don't time the blocking reads
+        self.frame.clear();
+        // Only the frame's first event can wake the engine's timers late
+        let deadline = self.engine.next_deadline();
+        loop {
+            let event = match deadline {
+                Some(deadline) => self.gamepad.read_event_until(deadline)?,
+                None => self.gamepad.read_event()?,
+            };
+            match event {
+                Some(InputEvent::Sync { .. }) => break,
+                Some(input_event) => self.frame.push(input_event),
                 None => {
-                    // Controller disconnected
+                    // Controller disconnected; still flush a partial frame
                     tracing::warn!("Controller disconnected");
+                    self.disconnected = true;
+                    if let Some(notifications) = &mut self.notifications {
+                        notifications.disconnected();
+                    }
+                    if self.frame.is_empty() {
+                        return Ok(false);
+                    }
                     break;
                 }
             }
         }
+        if self.frame.is_empty() {
+            if deadline.is_some() {
+                self.tick()?;
+            }
+            return Ok(true);
+        }
 
-        tracing::info!("Event loop stopped");
-        // Print final statistics
-        if self.event_count > 0 {
-            let avg = self.total_latency_us / self.event_count;
+        let start = Instant::now();
+        // Kernel timestamp of the frame's first event → picked up here
+        self.metrics.read.record(start.saturating_duration_since(self.frame[0].timestamp()));
+
+        // Process the whole frame through the mapping engine, then emit once
+        self.output.clear();
+        // Between frames, so a frame is mapped under one context
+        if let Some(context) = self.context.as_ref().and_then(ContextWatcher::changed) {
+            self.engine.set_context(context, &mut self.output);
+        }
+        self.traced.clear();
+        for input_event in &self.frame {
+            let mapped_from = self.output.len();
+            let rules = self.debug_trace.is_some().then(|| self.engine.rules_for(input_event));
+
+            self.engine.process_into(input_event, &mut self.output)?;
+
+            if let Some(rules) = rules {
+                self.traced.push((mapped_from..self.output.len(), rules));
+            }
+
+            #[cfg(debug_assertions)]
+            // Only trace per button event in debug build to not interrupt latency
+            for output_event in &self.output[mapped_from..] {
+                tracing::debug!("Gamepad: {} -> {}", input_event, output_event);
+            }
+        }
+        let mapped = Instant::now();
+        self.metrics.map.record(mapped - start);
+
+        if !self.output.is_empty() {
+            self.devices.emit_frame(&self.output)?;
+            self.metrics.write.record(mapped.elapsed());
+        }
+        self.metrics.record_frame(self.frame.len());
+        // After the write so observers never add to input latency
+        if let Some(trace) = &self.debug_trace {
+            for (event, (output, rules)) in self.frame.iter().zip(self.traced.drain(..)) {
+                trace.record(event, start, rules, &self.output[output]);
+            }
+            trace.sync(self.frame[self.frame.len() - 1].timestamp());
+        }
+        if let Some(tap) = &self.tap {
+            tap.publish(
+                self.frame
+                    .iter()
+                    .map(|&event| TapEvent::Input(event))
+                    .chain(self.output.iter().map(|event| TapEvent::Output(event.clone()))),
+            );
+        }
+        if self.engine.take_sticky_changed()
+            && let Some(cue) = &mut self.sticky_cue
+        {
+            let held: Vec<_> = self.engine.sticky_keys().collect();
+            cue.show(&held);
+            if cue.is_visual()
+                && let Some(tap) = &self.tap
+            {
+                tap.publish([TapEvent::Sticky(held)]);
+            }
+        }
+        // Drained even without a cue so they can't pile up
+        let mut profile_switched = false;
+        for switch in self.engine.drain_switches() {
+            profile_switched |= matches!(switch, Switch::Profile(_));
+            if let Some(cue) = &mut self.switch_cue {
+                cue.show(&switch);
+                if cue.is_visual()
+                    && let Some(tap) = &self.tap
+                {
+                    tap.publish([TapEvent::Switch(switch)]);
+                }
+            }
+        }
+        // Drained even without a dispatcher so they can't pile up
+        for action in self.engine.drain_actions() {
+            if let Some(actions) = &self.actions {
+                actions.dispatch(action);
+            }
+        }
+        // After the old profile's actions went to its own dispatcher
+        if profile_switched {
+            self.profile_switched();
+        }
+        self.metrics.set_debounced(self.engine.debounced_count());
+
+        // Measure ONLY processing latency
+        let latency_us = start.elapsed().as_micros() as u64;
+
+        self.frame_count += 1;
+        self.total_latency_us += latency_us;
+        self.max_latency_us = self.max_latency_us.max(latency_us);
+        self.min_latency_us = self.min_latency_us.min(latency_us);
+
+        // Log statistics every 100 frames
+        if self.frame_count.is_multiple_of(100) {
+            let avg = self.total_latency_us / self.frame_count;
             tracing::info!(
-                "Final: {} events | avg: {}µs ({:.2}ms) | min: {}µs | max: {}µs",
-                self.event_count,
+                "Stats: {} frames | avg: {}µs ({:.2}ms) | min: {}µs | max: {}µs{}",
+                self.frame_count,
                 avg,
                 avg as f64 / 1000.0,
                 self.min_latency_us,
-                self.max_latency_us
+                self.max_latency_us,
+                self.ring_summary()
             );
         }
-        Ok(())
+        Ok(true)
     }
 
-    fn emit_output(&mut self, output_event: OutputEvent) -> Result<()> {
-        match output_event {
-            OutputEvent::Keyboard { code, event_type } => {
-                if event_type == KeyboardEventType::Press {
-                    self.keyboard.press_key(code)?;
-                } else if event_type == KeyboardEventType::Release {
-                    self.keyboard.release_key(code)?;
-                }
+    /// Emit what the engine has due with the controller idle
+    fn tick(&mut self) -> Result<()> {
+        self.output.clear();
+        self.engine.tick(Instant::now(), &mut self.output);
+        if self.output.is_empty() {
+            return Ok(());
+        }
+        self.devices.emit_frame(&self.output)?;
+        if let Some(tap) = &self.tap {
+            tap.publish(self.output.iter().map(|event| TapEvent::Output(event.clone())));
+        }
+        for action in self.engine.drain_actions() {
+            if let Some(actions) = &self.actions {
+                actions.dispatch(action);
             }
         }
-
         Ok(())
     }
+
+    /// Replace the actions and context watcher with the new profile's, and
+    /// make the devices it maps to
+    fn profile_switched(&mut self) {
+        let Some(profile) = self.engine.profile() else {
+            return;
+        };
+        crate::logging::set_context("profile", &profile.name);
+        audit::record(AuditEvent::ProfileSwitched { profile: profile.name.clone() });
+        self.health.set_profile(&profile.name);
+        if let Some(notifications) = &mut self.notifications {
+            notifications.profile_switched(&profile.name);
+        }
+        let Some((policy, device)) = &self.switching else {
+            return;
+        };
+        // Mapping goes on without what failed; `status` shows it
+        let health = &self.health;
+        let failed = |what: &str, e: anyhow::Error| {
+            let problem = format!("Profile '{}': {}: {:#}", profile.name, what, e);
+            tracing::warn!("{}", problem);
+            health.report(problem);
+        };
+        if let Err(e) = self.devices.prepare(DeviceKinds::for_profile(profile)) {
+            failed("virtual devices", e);
+        }
+        self.actions = ActionDispatcher::for_profile(profile, policy)
+            .map_err(|e| failed("no actions", e))
+            .ok()
+            .flatten();
+        self.context = ContextWatcher::for_profile(profile, device)
+            .map_err(|e| failed("no context", e))
+            .ok()
+            .flatten();
+    }
+
+    fn ring_summary(&self) -> String {
+        match &self.ring {
+            Some(counters) => format!(" | dropped: {}", counters.snapshot().dropped),
+            None => String::new(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ButtonCode, KeyboardCode, KeyboardEventType};
+    use crate::input::gamepad::MockGamepad;
+    use crate::output::keyboard::MockVirtualKeyboard;
+
+    fn scripted_gamepad(events: Vec<InputEvent>) -> MockGamepad {
+        let mut events = events.into_iter();
+        let mut gamepad = MockGamepad::new();
+        gamepad.expect_read_event().returning(move || Ok(events.next()));
+        gamepad
+    }
+
+    fn press(code: KeyboardCode) -> OutputEvent {
+        OutputEvent::Keyboard { code, event_type: KeyboardEventType::Press }
+    }
+
+    #[test]
+    fn test_step_emits_whole_frame_at_once() {
+        let gamepad = scripted_gamepad(vec![
+            InputEvent::button_press(ButtonCode::South),
+            InputEvent::button_press(ButtonCode::West),
+            InputEvent::sync(),
+            InputEvent::button_release(ButtonCode::South),
+            InputEvent::sync(),
+        ]);
+
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard
+            .expect_emit_frame()
+            .withf(|events| events == [press(KeyboardCode::S), press(KeyboardCode::A)])
+            .times(1)
+            .returning(|_| Ok(()));
+        keyboard
+            .expect_emit_frame()
+            .withf(|events| events.len() == 1 && events[0] != press(KeyboardCode::S))
+            .times(1)
+            .returning(|_| Ok(()));
+
+        let mut event_loop =
+            EventLoop::new(Box::new(gamepad), MappingEngine::new_hardcoded(), Box::new(keyboard));
+
+        assert!(event_loop.step().unwrap());
+        assert!(event_loop.step().unwrap());
+        assert!(!event_loop.step().unwrap());
+    }
+
+    #[test]
+    fn test_step_flushes_partial_frame_on_disconnect() {
+        let gamepad = scripted_gamepad(vec![InputEvent::button_press(ButtonCode::South)]);
+
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard
+            .expect_emit_frame()
+            .withf(|events| events == [press(KeyboardCode::S)])
+            .times(1)
+            .returning(|_| Ok(()));
+
+        let mut event_loop =
+            EventLoop::new(Box::new(gamepad), MappingEngine::new_hardcoded(), Box::new(keyboard));
+
+        assert!(event_loop.step().unwrap());
+        assert!(!event_loop.step().unwrap());
+    }
+
+    #[test]
+    fn test_step_skips_unmapped_frames() {
+        // Start isn't mapped by the hardcoded engine: nothing to emit
+        let gamepad =
+            scripted_gamepad(vec![InputEvent::button_press(ButtonCode::Start), InputEvent::sync()]);
+
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard.expect_emit_frame().never();
+
+        let mut event_loop =
+            EventLoop::new(Box::new(gamepad), MappingEngine::new_hardcoded(), Box::new(keyboard));
+
+        assert!(event_loop.step().unwrap());
+        assert!(!event_loop.step().unwrap());
+    }
+
+    #[test]
+    fn test_step_records_stage_metrics() {
+        let gamepad =
+            scripted_gamepad(vec![InputEvent::button_press(ButtonCode::South), InputEvent::sync()]);
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard.expect_emit_frame().returning(|_| Ok(()));
+
+        let mut event_loop =
+            EventLoop::new(Box::new(gamepad), MappingEngine::new_hardcoded(), Box::new(keyboard));
+        let metrics = event_loop.metrics();
+        while event_loop.step().unwrap() {}
+
+        let snapshot = metrics.snapshot();
+        assert_eq!((snapshot.frames, snapshot.events), (1, 1));
+        assert_eq!(snapshot.read.count(), 1);
+        assert_eq!(snapshot.map.count(), 1);
+        assert_eq!(snapshot.write.count(), 1);
+    }
+
+    #[test]
+    fn test_step_publishes_input_and_output_to_tap() {
+        let gamepad =
+            scripted_gamepad(vec![InputEvent::button_press(ButtonCode::South), InputEvent::sync()]);
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard.expect_emit_frame().returning(|_| Ok(()));
+
+        let tap = EventTap::new();
+        let events = tap.subscribe();
+        let mut event_loop =
+            EventLoop::new(Box::new(gamepad), MappingEngine::new_hardcoded(), Box::new(keyboard))
+                .with_tap(tap);
+        while event_loop.step().unwrap() {}
+
+        let seen: Vec<_> = events.try_iter().collect();
+        assert_eq!(seen.len(), 2);
+        assert!(matches!(
+            seen[0],
+            TapEvent::Input(InputEvent::Button { code: ButtonCode::South, .. })
+        ));
+        assert!(matches!(&seen[1], TapEvent::Output(event) if *event == press(KeyboardCode::S)));
+    }
+
+    #[test]
+    fn test_idle_step_lets_slow_key_through() {
+        use crate::mapping::profile::Profile;
+
+        let mut gamepad =
+            scripted_gamepad(vec![InputEvent::button_press(ButtonCode::South), InputEvent::sync()]);
+        // The controller stays quiet while the button is held
+        gamepad.expect_read_event_until().times(1).returning(|deadline| {
+            std::thread::sleep(deadline.saturating_duration_since(Instant::now()));
+            Ok(Some(InputEvent::sync()))
+        });
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard
+            .expect_emit_frame()
+            .withf(|events| events == [press(KeyboardCode::S)])
+            .times(1)
+            .returning(|_| Ok(()));
+
+        let mut profile = Profile::default_profile();
+        profile.settings.slow_keys_ms = 20;
+        let engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let mut event_loop = EventLoop::new(Box::new(gamepad), engine, Box::new(keyboard));
+        // Held back, then through once held long enough
+        assert!(event_loop.step().unwrap());
+        assert!(event_loop.step().unwrap());
+        assert!(!event_loop.step().unwrap());
+    }
+
+    #[test]
+    fn test_step_cues_sticky_keys() {
+        use crate::mapping::{Mapping, profile::Profile, types::TargetType};
+        use crate::output::feedback::MockRumble;
+
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "LeftShoulder".to_string(),
+            target_type: TargetType::Keyboard,
+            target_name: "Left Shift".to_string(),
+            sticky: true,
+            ..Default::default()
+        });
+        let gamepad = scripted_gamepad(vec![
+            InputEvent::button_press(ButtonCode::LeftShoulder),
+            InputEvent::sync(),
+            InputEvent::button_release(ButtonCode::LeftShoulder),
+            InputEvent::sync(),
+            InputEvent::button_press(ButtonCode::South),
+            InputEvent::button_release(ButtonCode::South),
+            InputEvent::sync(),
+        ]);
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard.expect_emit_frame().returning(|_| Ok(()));
+        let mut rumble = MockRumble::new();
+        rumble.expect_pulse().times(1).returning(|_, _| Ok(()));
+
+        let tap = EventTap::new();
+        let events = tap.subscribe();
+        let engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let mut event_loop = EventLoop::new(Box::new(gamepad), engine, Box::new(keyboard))
+            .with_tap(tap)
+            .with_sticky_cue(StickyCue::new(true, Some(Box::new(rumble)), 100));
+        while event_loop.step().unwrap() {}
+
+        let held: Vec<_> = events
+            .try_iter()
+            .filter_map(|event| match event {
+                TapEvent::Sticky(keys) => Some(keys),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(held, [vec![KeyboardCode::LeftShift], vec![]]);
+    }
+
+    #[test]
+    fn test_step_cues_layer_switches() {
+        use crate::event::Switch;
+        use crate::mapping::profile::Profile;
+        use crate::output::feedback::{MockRumble, SwitchCue};
+
+        let gamepad = scripted_gamepad(vec![
+            InputEvent::button_press(ButtonCode::LeftShoulder),
+            InputEvent::sync(),
+            InputEvent::button_release(ButtonCode::LeftShoulder),
+            InputEvent::sync(),
+        ]);
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard.expect_emit_frame().returning(|_| Ok(()));
+        // Only the layer coming on is felt
+        let mut rumble = MockRumble::new();
+        rumble.expect_pulse().times(1).returning(|_, _| Ok(()));
+
+        let tap = EventTap::new();
+        let events = tap.subscribe();
+        let engine = MappingEngine::load_from_profile(&Profile::one_handed_left_profile()).unwrap();
+        let mut event_loop = EventLoop::new(Box::new(gamepad), engine, Box::new(keyboard))
+            .with_tap(tap)
+            .with_switch_cue(SwitchCue::new(true, Some(Box::new(rumble)), 100));
+        while event_loop.step().unwrap() {}
+
+        let switches: Vec<_> = events
+            .try_iter()
+            .filter_map(|event| match event {
+                TapEvent::Switch(switch) => Some(switch),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(
+            switches,
+            [
+                Switch::Layer { button: ButtonCode::LeftShoulder, on: true },
+                Switch::Layer { button: ButtonCode::LeftShoulder, on: false },
+            ]
+        );
+    }
 }
@@ -74,21 +74,24 @@ impl InputEvent {
         Self::Sync { timestamp: Instant::now() }
     }
 
-    // Method to ignore for Sony DualShock4 analog sticks
-    // implement a dead zone to ignore small movements near center
-    pub fn is_in_deadzone(&self) -> bool {
-        const ANALOG_CENTER: i32 = 128; // For 0-255 range
-        const DEAD_ZONE: i32 = 10; // ±10 from center = ignore
+    /// Dead zone for the analog sticks, in the normalized stick range
+    /// (±10 of a 0-255 stick from center)
+    pub const STICK_DEADZONE: i32 = 2560;
 
+    // Dead zone for the analog sticks, to ignore small movements near center
+    // Values are in the normalized stick range, -32768..32767
+    pub fn is_in_deadzone(&self) -> bool {
         match self {
             Self::Axis { code, value, .. } => {
-                // Don't apply deadzone to triggers (they have different ranges)
-                if matches!(code, AxisCode::LeftTrigger | AxisCode::RightTrigger) {
+                // Triggers, the D-pad and trackpads have no resting wobble to hide
+                if !matches!(
+                    code,
+                    AxisCode::LeftX | AxisCode::LeftY | AxisCode::RightX | AxisCode::RightY
+                ) {
                     return false;
                 }
 
-                let distance_from_center = (value - ANALOG_CENTER).abs();
-                distance_from_center <= DEAD_ZONE
+                value.abs() <= Self::STICK_DEADZONE
             }
             _ => false, // Only axis events can be in deadzone
         }
@@ -173,9 +176,44 @@ pub enum ButtonCode {
     Paddle3,
     Paddle4,
     Touchpad,
+    LeftPad,
+    RightPad,
     Unknown,
 }
 
+impl ButtonCode {
+    /// Every button code, in declaration order
+    pub const ALL: [ButtonCode; 22] = [
+        ButtonCode::South,
+        ButtonCode::East,
+        ButtonCode::North,
+        ButtonCode::West,
+        ButtonCode::LeftShoulder,
+        ButtonCode::RightShoulder,
+        ButtonCode::LeftTrigger,
+        ButtonCode::RightTrigger,
+        ButtonCode::Select,
+        ButtonCode::Start,
+        ButtonCode::LeftStick,
+        ButtonCode::RightStick,
+        ButtonCode::Mode,
+        ButtonCode::Misc1,
+        ButtonCode::Paddle1,
+        ButtonCode::Paddle2,
+        ButtonCode::Paddle3,
+        ButtonCode::Paddle4,
+        ButtonCode::Touchpad,
+        ButtonCode::LeftPad,
+        ButtonCode::RightPad,
+        ButtonCode::Unknown,
+    ];
+
+    /// Dense index (position in `ALL`), for table lookups
+    pub const fn index(self) -> usize {
+        self as usize
+    }
+}
+
 impl Display for ButtonCode {
     fn fmt(&self, f: &mut Formatter<'_>) -> Result {
         match self {
@@ -198,6 +236,8 @@ impl Display for ButtonCode {
             Self::Paddle3 => write!(f, "Paddle 3"),
             Self::Paddle4 => write!(f, "Paddle 4"),
             Self::Touchpad => write!(f, "Touchpad"),
+            Self::LeftPad => write!(f, "Left Pad"),
+            Self::RightPad => write!(f, "Right Pad"),
             Self::Unknown => write!(f, "Unknown"),
         }
     }
@@ -220,17 +260,20 @@ impl From<&str> for ButtonCode {
             "Right Stick" | "RightStick" => ButtonCode::RightStick,
             "Mode" => ButtonCode::Mode,
             "Misc" | "Misc1" => ButtonCode::Misc1,
-            "Paddle 1" | "Paddle1" => ButtonCode::Paddle1,
-            "Paddle 2" | "Paddle2" => ButtonCode::Paddle2,
-            "Paddle 3" | "Paddle3" => ButtonCode::Paddle3,
-            "Paddle 4" | "Paddle4" => ButtonCode::Paddle4,
+            // Steam Deck back buttons follow hid-steam's paddle order
+            "Paddle 1" | "Paddle1" | "L5" => ButtonCode::Paddle1,
+            "Paddle 2" | "Paddle2" | "R5" => ButtonCode::Paddle2,
+            "Paddle 3" | "Paddle3" | "L4" => ButtonCode::Paddle3,
+            "Paddle 4" | "Paddle4" | "R4" => ButtonCode::Paddle4,
             "Touchpad" => ButtonCode::Touchpad,
+            "Left Pad" | "LeftPad" => ButtonCode::LeftPad,
+            "Right Pad" | "RightPad" => ButtonCode::RightPad,
             _ => ButtonCode::Unknown,
         }
     }
 }
 
-#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
 pub enum AxisCode {
     LeftX,
     LeftY,
@@ -240,9 +283,37 @@ pub enum AxisCode {
     RightTrigger,
     DPadX,
     DPadY,
+    LeftPadX,
+    LeftPadY,
+    RightPadX,
+    RightPadY,
     Unknown,
 }
 
+impl AxisCode {
+    /// Every axis code, in declaration order
+    pub const ALL: [AxisCode; 13] = [
+        AxisCode::LeftX,
+        AxisCode::LeftY,
+        AxisCode::RightX,
+        AxisCode::RightY,
+        AxisCode::LeftTrigger,
+        AxisCode::RightTrigger,
+        AxisCode::DPadX,
+        AxisCode::DPadY,
+        AxisCode::LeftPadX,
+        AxisCode::LeftPadY,
+        AxisCode::RightPadX,
+        AxisCode::RightPadY,
+        AxisCode::Unknown,
+    ];
+
+    /// Dense index (position in `ALL`), for table lookups
+    pub const fn index(self) -> usize {
+        self as usize
+    }
+}
+
 impl Display for AxisCode {
     fn fmt(&self, f: &mut Formatter<'_>) -> Result {
         match self {
@@ -254,6 +325,10 @@ impl Display for AxisCode {
             Self::RightTrigger => write!(f, "Right Trigger"),
             Self::DPadX => write!(f, "DPad X"),
             Self::DPadY => write!(f, "DPad Y"),
+            Self::LeftPadX => write!(f, "Left Pad X"),
+            Self::LeftPadY => write!(f, "Left Pad Y"),
+            Self::RightPadX => write!(f, "Right Pad X"),
+            Self::RightPadY => write!(f, "Right Pad Y"),
             Self::Unknown => write!(f, "Unknown"),
         }
     }
@@ -270,6 +345,10 @@ impl From<&str> for AxisCode {
             "RightTrigger" | "Right Trigger" => AxisCode::RightTrigger,
             "DPadX" | "DPad X" => AxisCode::DPadX,
             "DPadY" | "DPad Y" => AxisCode::DPadY,
+            "LeftPadX" | "Left Pad X" => AxisCode::LeftPadX,
+            "LeftPadY" | "Left Pad Y" => AxisCode::LeftPadY,
+            "RightPadX" | "Right Pad X" => AxisCode::RightPadX,
+            "RightPadY" | "Right Pad Y" => AxisCode::RightPadY,
             _ => AxisCode::Unknown,
         }
     }
@@ -300,14 +379,18 @@ pub fn axis_and_direction_to_string(axis_code: AxisCode, direction: AxisDirectio
             AxisDirection::Negative => "DPad Up".to_string(),
             AxisDirection::Positive => "DPad Down".to_string(),
         },
-        AxisCode::LeftX | AxisCode::RightX => match direction {
-            AxisDirection::Negative => axis_code.to_string() + " Left",
-            AxisDirection::Positive => axis_code.to_string() + " Right",
-        },
-        AxisCode::LeftY | AxisCode::RightY => match direction {
-            AxisDirection::Negative => axis_code.to_string() + " Up",
-            AxisDirection::Positive => axis_code.to_string() + " Down",
-        },
+        AxisCode::LeftX | AxisCode::RightX | AxisCode::LeftPadX | AxisCode::RightPadX => {
+            match direction {
+                AxisDirection::Negative => axis_code.to_string() + " Left",
+                AxisDirection::Positive => axis_code.to_string() + " Right",
+            }
+        }
+        AxisCode::LeftY | AxisCode::RightY | AxisCode::LeftPadY | AxisCode::RightPadY => {
+            match direction {
+                AxisDirection::Negative => axis_code.to_string() + " Up",
+                AxisDirection::Positive => axis_code.to_string() + " Down",
+            }
+        }
         // For other AxisCode values like triggers or unknown, use their Display implementation
         _ => axis_code.to_string(),
     }
@@ -454,28 +537,30 @@ mod tests {
     #[test]
     fn test_is_in_deadzone() {
         // Test axis events within deadzone
-        let center_event = InputEvent::axis_move(AxisCode::LeftX, 128);
+        let center_event = InputEvent::axis_move(AxisCode::LeftX, 0);
         assert!(center_event.is_in_deadzone());
 
-        let near_center_event = InputEvent::axis_move(AxisCode::LeftX, 125);
+        let near_center_event = InputEvent::axis_move(AxisCode::LeftX, -768);
         assert!(near_center_event.is_in_deadzone());
 
-        let boundary_low = InputEvent::axis_move(AxisCode::LeftX, 118);
+        let boundary_low = InputEvent::axis_move(AxisCode::LeftX, -2560);
         assert!(boundary_low.is_in_deadzone());
 
-        let boundary_high = InputEvent::axis_move(AxisCode::LeftX, 138);
+        let boundary_high = InputEvent::axis_move(AxisCode::LeftX, 2560);
         assert!(boundary_high.is_in_deadzone());
 
         // Test axis events outside deadzone
-        let outside_low = InputEvent::axis_move(AxisCode::LeftX, 110);
+        let outside_low = InputEvent::axis_move(AxisCode::LeftX, -4608);
         assert!(!outside_low.is_in_deadzone());
 
-        let outside_high = InputEvent::axis_move(AxisCode::LeftX, 150);
+        let outside_high = InputEvent::axis_move(AxisCode::LeftX, 5632);
         assert!(!outside_high.is_in_deadzone());
 
-        // Test that triggers are never in deadzone (even at center)
-        let trigger_center = InputEvent::axis_move(AxisCode::LeftTrigger, 128);
-        assert!(!trigger_center.is_in_deadzone());
+        // Test that triggers and the D-pad are never in deadzone
+        let trigger_rest = InputEvent::axis_move(AxisCode::LeftTrigger, 0);
+        assert!(!trigger_rest.is_in_deadzone());
+        let dpad_left = InputEvent::axis_move(AxisCode::DPadX, -1);
+        assert!(!dpad_left.is_in_deadzone());
 
         // Test that non-axis events are not in deadzone
         let button_event = InputEvent::button_press(ButtonCode::South);
@@ -487,17 +572,17 @@ mod tests {
 
     #[test]
     fn test_deadzone_boundary_cases() {
-        // Test exact deadzone boundaries (±10 from center)
-        let deadzone_min = InputEvent::axis_move(AxisCode::LeftX, 128 - 10);
+        // Test exact deadzone boundaries (±2560 from center)
+        let deadzone_min = InputEvent::axis_move(AxisCode::LeftX, -2560);
         assert!(deadzone_min.is_in_deadzone());
 
-        let deadzone_max = InputEvent::axis_move(AxisCode::LeftX, 128 + 10);
+        let deadzone_max = InputEvent::axis_move(AxisCode::LeftX, 2560);
         assert!(deadzone_max.is_in_deadzone());
 
-        let just_outside_min = InputEvent::axis_move(AxisCode::LeftX, 128 - 11);
+        let just_outside_min = InputEvent::axis_move(AxisCode::LeftX, -2561);
         assert!(!just_outside_min.is_in_deadzone());
 
-        let just_outside_max = InputEvent::axis_move(AxisCode::LeftX, 128 + 11);
+        let just_outside_max = InputEvent::axis_move(AxisCode::LeftX, 2561);
         assert!(!just_outside_max.is_in_deadzone());
     }
 
@@ -577,4 +662,25 @@ mod tests {
             "Unknown"
         );
     }
+
+    #[test]
+    fn test_codes_round_trip_through_display() {
+        // Profiles refer to sources by display name
+        for code in ButtonCode::ALL {
+            assert_eq!(ButtonCode::from(code.to_string().as_str()), code);
+        }
+        for code in AxisCode::ALL {
+            assert_eq!(AxisCode::from(code.to_string().as_str()), code);
+        }
+    }
+
+    #[test]
+    fn test_code_index_matches_all_order() {
+        for (i, code) in ButtonCode::ALL.iter().enumerate() {
+            assert_eq!(code.index(), i);
+        }
+        for (i, code) in AxisCode::ALL.iter().enumerate() {
+            assert_eq!(code.index(), i);
+        }
+    }
 }
@@ -6,9 +6,13 @@
 mod handler;
 mod input;
 mod output;
+mod ring;
+mod tap;
 mod time;
 
 pub use handler::EventLoop;
 pub use input::types::*;
 pub use output::types::*;
+pub use ring::{RingCloser, RingConsumer, RingCounters, RingProducer, RingStats, ring};
+pub use tap::{EventTap, TAP_CAPACITY, TapEvent};
 pub use time::*;
@@ -1,13 +1,24 @@
 use std::fmt::{Display, Formatter, Result};
+use std::sync::Arc;
 
 use serde::{Deserialize, Serialize};
 
+use crate::event::{AxisCode, AxisDirection, ButtonCode};
+use crate::output::mouse::MouseEvent;
+
 #[derive(Debug, Clone, PartialEq, Eq)]
 pub enum OutputEvent {
     Keyboard {
         code: KeyboardCode,
         event_type: KeyboardEventType, // press, release, hold
     },
+    /// A button or wheel notch of the virtual mouse
+    Mouse(MouseEvent),
+    /// A button of the virtual gamepad, or an axis pushed all the way in a
+    /// direction (centered again on release)
+    Gamepad { control: ActionSource, pressed: bool },
+    /// An event for one of the profile's custom virtual devices, by name
+    Routed { device: Arc<str>, event: Box<OutputEvent> },
 }
 
 impl Display for OutputEvent {
@@ -16,6 +27,82 @@ impl Display for OutputEvent {
             Self::Keyboard { code, event_type } => {
                 write!(f, "Keyboard: {:?} ({:?})", code, event_type)
             }
+            Self::Mouse(event) => write!(f, "Mouse: {:?}", event),
+            Self::Gamepad { control, pressed: true } => write!(f, "Gamepad: {} (Press)", control),
+            Self::Gamepad { control, pressed: false } => {
+                write!(f, "Gamepad: {} (Release)", control)
+            }
+            Self::Routed { device, event } => write!(f, "{} (on {})", event, device),
+        }
+    }
+}
+
+/// A mapping's side-effect action being triggered (see `crate::action`)
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ActionEvent {
+    /// Index into the profile's action mappings
+    pub action: usize,
+    pub source: ActionSource,
+    pub pressed: bool,
+    /// 1/0 for buttons, the axis value for axis sources
+    pub value: i32,
+}
+
+/// A change in which mappings apply, for feedback to the user
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Switch {
+    /// A layer button of mirror mappings went down (`on`) or up
+    Layer { button: ButtonCode, on: bool },
+    /// The context turned conditional mappings on or off
+    Context,
+    /// Another profile was loaded, by name
+    Profile(String),
+}
+
+impl Display for Switch {
+    fn fmt(&self, f: &mut Formatter<'_>) -> Result {
+        match self {
+            Self::Layer { button, on: true } => write!(f, "Layer {} on", button),
+            Self::Layer { button, on: false } => write!(f, "Layer {} off", button),
+            Self::Context => f.write_str("Conditional mappings switched"),
+            Self::Profile(name) => write!(f, "Profile '{}' loaded", name),
+        }
+    }
+}
+
+/// Control that triggered an action
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ActionSource {
+    Button(ButtonCode),
+    /// An axis entering or leaving a direction
+    Axis(AxisCode, AxisDirection),
+    /// Any change of an axis; "pressed" while off center
+    AxisValue(AxisCode),
+}
+
+impl ActionSource {
+    /// Name of the control, without the direction
+    pub fn name(&self) -> String {
+        match self {
+            Self::Button(code) => code.to_string(),
+            Self::Axis(code, _) | Self::AxisValue(code) => code.to_string(),
+        }
+    }
+
+    pub fn direction(&self) -> Option<AxisDirection> {
+        match self {
+            Self::Axis(_, direction) => Some(*direction),
+            _ => None,
+        }
+    }
+}
+
+impl Display for ActionSource {
+    fn fmt(&self, f: &mut Formatter<'_>) -> Result {
+        match self {
+            Self::Button(code) => write!(f, "{}", code),
+            Self::Axis(code, direction) => write!(f, "{} {}", code, direction),
+            Self::AxisValue(code) => write!(f, "{}", code),
         }
     }
 }
@@ -28,7 +115,10 @@ pub enum KeyboardEventType {
 }
 
 /// Platform-agnostic keyboard key codes.
-/// These are derived from the `evdev::KeyCode` enum, focusing on standard keyboard keys.
+/// The set started from Linux's `evdev::KeyCode`, but profiles and the engine only ever
+/// see these names; each platform translates them in its own table
+/// (`platform::linux` → evdev keys, `platform::windows` → scan codes,
+/// `platform::macos` → HID usages).
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
 pub enum KeyboardCode {
     Reserved,
@@ -115,6 +205,8 @@ pub enum KeyboardCode {
     Kp3,
     Kp0,
     KpDot,
+    F11,
+    F12,
     KpEnter,
     RightControl,
     KpSlash,
@@ -255,6 +347,239 @@ pub enum KeyboardCode {
     Unknown, // Placeholder for any unmapped keys
 }
 
+impl KeyboardCode {
+    /// Every key code, in declaration order
+    ///
+    /// Used to check that each platform translation table covers the whole
+    /// enum and that profile names round-trip.
+    pub const ALL: [KeyboardCode; 224] = [
+        KeyboardCode::Reserved,
+        KeyboardCode::Escape,
+        KeyboardCode::Num1,
+        KeyboardCode::Num2,
+        KeyboardCode::Num3,
+        KeyboardCode::Num4,
+        KeyboardCode::Num5,
+        KeyboardCode::Num6,
+        KeyboardCode::Num7,
+        KeyboardCode::Num8,
+        KeyboardCode::Num9,
+        KeyboardCode::Num0,
+        KeyboardCode::Minus,
+        KeyboardCode::Equal,
+        KeyboardCode::Backspace,
+        KeyboardCode::Tab,
+        KeyboardCode::Q,
+        KeyboardCode::W,
+        KeyboardCode::E,
+        KeyboardCode::R,
+        KeyboardCode::T,
+        KeyboardCode::Y,
+        KeyboardCode::U,
+        KeyboardCode::I,
+        KeyboardCode::O,
+        KeyboardCode::P,
+        KeyboardCode::LeftBrace,
+        KeyboardCode::RightBrace,
+        KeyboardCode::Enter,
+        KeyboardCode::LeftControl,
+        KeyboardCode::A,
+        KeyboardCode::S,
+        KeyboardCode::D,
+        KeyboardCode::F,
+        KeyboardCode::G,
+        KeyboardCode::H,
+        KeyboardCode::J,
+        KeyboardCode::K,
+        KeyboardCode::L,
+        KeyboardCode::Semicolon,
+        KeyboardCode::Apostrophe,
+        KeyboardCode::Grave,
+        KeyboardCode::LeftShift,
+        KeyboardCode::Backslash,
+        KeyboardCode::Z,
+        KeyboardCode::X,
+        KeyboardCode::C,
+        KeyboardCode::V,
+        KeyboardCode::B,
+        KeyboardCode::N,
+        KeyboardCode::M,
+        KeyboardCode::Comma,
+        KeyboardCode::Dot,
+        KeyboardCode::Slash,
+        KeyboardCode::RightShift,
+        KeyboardCode::KpAsterisk,
+        KeyboardCode::LeftAlt,
+        KeyboardCode::Space,
+        KeyboardCode::CapsLock,
+        KeyboardCode::F1,
+        KeyboardCode::F2,
+        KeyboardCode::F3,
+        KeyboardCode::F4,
+        KeyboardCode::F5,
+        KeyboardCode::F6,
+        KeyboardCode::F7,
+        KeyboardCode::F8,
+        KeyboardCode::F9,
+        KeyboardCode::F10,
+        KeyboardCode::NumLock,
+        KeyboardCode::ScrollLock,
+        KeyboardCode::Kp7,
+        KeyboardCode::Kp8,
+        KeyboardCode::Kp9,
+        KeyboardCode::KpMinus,
+        KeyboardCode::Kp4,
+        KeyboardCode::Kp5,
+        KeyboardCode::Kp6,
+        KeyboardCode::KpPlus,
+        KeyboardCode::Kp1,
+        KeyboardCode::Kp2,
+        KeyboardCode::Kp3,
+        KeyboardCode::Kp0,
+        KeyboardCode::KpDot,
+        KeyboardCode::F11,
+        KeyboardCode::F12,
+        KeyboardCode::KpEnter,
+        KeyboardCode::RightControl,
+        KeyboardCode::KpSlash,
+        KeyboardCode::SysRq,
+        KeyboardCode::RightAlt,
+        KeyboardCode::LineFeed,
+        KeyboardCode::Home,
+        KeyboardCode::Up,
+        KeyboardCode::PageUp,
+        KeyboardCode::Left,
+        KeyboardCode::Right,
+        KeyboardCode::End,
+        KeyboardCode::Down,
+        KeyboardCode::PageDown,
+        KeyboardCode::Insert,
+        KeyboardCode::Delete,
+        KeyboardCode::Macro,
+        KeyboardCode::Mute,
+        KeyboardCode::VolumeDown,
+        KeyboardCode::VolumeUp,
+        KeyboardCode::Power,
+        KeyboardCode::KpEqual,
+        KeyboardCode::KpPlusMinus,
+        KeyboardCode::Pause,
+        KeyboardCode::Scale,
+        KeyboardCode::KpComma,
+        KeyboardCode::LeftMeta,
+        KeyboardCode::RightMeta,
+        KeyboardCode::Compose,
+        KeyboardCode::Stop,
+        KeyboardCode::Again,
+        KeyboardCode::Props,
+        KeyboardCode::Undo,
+        KeyboardCode::Front,
+        KeyboardCode::Copy,
+        KeyboardCode::Open,
+        KeyboardCode::Paste,
+        KeyboardCode::Find,
+        KeyboardCode::Cut,
+        KeyboardCode::Help,
+        KeyboardCode::Menu,
+        KeyboardCode::Calc,
+        KeyboardCode::Setup,
+        KeyboardCode::Sleep,
+        KeyboardCode::WakeUp,
+        KeyboardCode::File,
+        KeyboardCode::SendFile,
+        KeyboardCode::DeleteFile,
+        KeyboardCode::Xfer,
+        KeyboardCode::Prog1,
+        KeyboardCode::Prog2,
+        KeyboardCode::Www,
+        KeyboardCode::Msdos,
+        KeyboardCode::Coffee,
+        KeyboardCode::Direction,
+        KeyboardCode::RotateDisplay,
+        KeyboardCode::CycleWindows,
+        KeyboardCode::Mail,
+        KeyboardCode::Bookmarks,
+        KeyboardCode::Computer,
+        KeyboardCode::Back,
+        KeyboardCode::Forward,
+        KeyboardCode::CloseCd,
+        KeyboardCode::EjectCd,
+        KeyboardCode::EjectCloseCd,
+        KeyboardCode::NextSong,
+        KeyboardCode::PlayPause,
+        KeyboardCode::PreviousSong,
+        KeyboardCode::StopCd,
+        KeyboardCode::Record,
+        KeyboardCode::Rewind,
+        KeyboardCode::Phone,
+        KeyboardCode::Iso,
+        KeyboardCode::Config,
+        KeyboardCode::HomePage,
+        KeyboardCode::Refresh,
+        KeyboardCode::Exit,
+        KeyboardCode::Move,
+        KeyboardCode::Edit,
+        KeyboardCode::ScrollUp,
+        KeyboardCode::ScrollDown,
+        KeyboardCode::KpLeftParen,
+        KeyboardCode::KpRightParen,
+        KeyboardCode::New,
+        KeyboardCode::Redo,
+        KeyboardCode::F13,
+        KeyboardCode::F14,
+        KeyboardCode::F15,
+        KeyboardCode::F16,
+        KeyboardCode::F17,
+        KeyboardCode::F18,
+        KeyboardCode::F19,
+        KeyboardCode::F20,
+        KeyboardCode::F21,
+        KeyboardCode::F22,
+        KeyboardCode::F23,
+        KeyboardCode::F24,
+        KeyboardCode::PlayCd,
+        KeyboardCode::PauseCd,
+        KeyboardCode::Prog3,
+        KeyboardCode::Prog4,
+        KeyboardCode::Dashboard,
+        KeyboardCode::Suspend,
+        KeyboardCode::Close,
+        KeyboardCode::Play,
+        KeyboardCode::FastForward,
+        KeyboardCode::BassBoost,
+        KeyboardCode::Print,
+        KeyboardCode::Hp,
+        KeyboardCode::Camera,
+        KeyboardCode::Sound,
+        KeyboardCode::Question,
+        KeyboardCode::Email,
+        KeyboardCode::Chat,
+        KeyboardCode::Search,
+        KeyboardCode::Connect,
+        KeyboardCode::Finance,
+        KeyboardCode::Sport,
+        KeyboardCode::Shop,
+        KeyboardCode::AlterErase,
+        KeyboardCode::Cancel,
+        KeyboardCode::BrightnessDown,
+        KeyboardCode::BrightnessUp,
+        KeyboardCode::Media,
+        KeyboardCode::SwitchVideoMode,
+        KeyboardCode::KbdIllumToggle,
+        KeyboardCode::KbdIllumDown,
+        KeyboardCode::KbdIllumUp,
+        KeyboardCode::Send,
+        KeyboardCode::Reply,
+        KeyboardCode::ForwardMail,
+        KeyboardCode::Save,
+        KeyboardCode::Documents,
+        KeyboardCode::Battery,
+        KeyboardCode::Bluetooth,
+        KeyboardCode::Wlan,
+        KeyboardCode::Uwb,
+        KeyboardCode::Unknown,
+    ];
+}
+
 impl Display for KeyboardCode {
     fn fmt(&self, f: &mut Formatter<'_>) -> Result {
         match self {
@@ -342,6 +667,8 @@ impl Display for KeyboardCode {
             Self::Kp3 => write!(f, "Kp 3"),
             Self::Kp0 => write!(f, "Kp 0"),
             Self::KpDot => write!(f, "Kp ."),
+            Self::F11 => write!(f, "F11"),
+            Self::F12 => write!(f, "F12"),
             Self::KpEnter => write!(f, "Kp Enter"),
             Self::RightControl => write!(f, "Right Control"),
             Self::KpSlash => write!(f, "Kp /"),
@@ -571,6 +898,8 @@ impl From<&str> for KeyboardCode {
             "kp 3" => KeyboardCode::Kp3,
             "kp 0" => KeyboardCode::Kp0,
             "kp ." => KeyboardCode::KpDot,
+            "f11" => KeyboardCode::F11,
+            "f12" => KeyboardCode::F12,
             "kp enter" => KeyboardCode::KpEnter,
             "right control" => KeyboardCode::RightControl,
             "kp /" => KeyboardCode::KpSlash,
@@ -810,4 +1139,12 @@ mod tests {
         assert_eq!(KeyboardCode::from(""), KeyboardCode::Unknown); // Empty string
         assert_eq!(KeyboardCode::from("unknown"), KeyboardCode::Unknown); // The explicit Unknown variant
     }
+
+    #[test]
+    fn test_display_round_trips_through_from_str() {
+        // Profiles store keys by display name, so every code must parse back
+        for code in KeyboardCode::ALL {
+            assert_eq!(KeyboardCode::from(code.to_string().as_str()), code, "{:?}", code);
+        }
+    }
 }
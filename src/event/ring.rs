@@ -0,0 +1,369 @@
+// Single-producer/single-consumer ring buffer
+//
+// Carries events from a device reader thread to the mapping thread without
+// locks on the data path: the producer only writes `tail`, the consumer only
+// writes `head`. When the ring is full the producer drops the new event and
+// counts it rather than blocking, so a stalled mapper never backs up into the
+// kernel read. The consumer can block when empty; parking is the only place
+// a lock is taken, and only while the consumer is actually asleep.
+
+use std::cell::UnsafeCell;
+use std::mem::MaybeUninit;
+use std::sync::atomic::{AtomicBool, AtomicU64, AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::thread::Thread;
+use std::time::Instant;
+
+/// Snapshot of a ring's traffic counters
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct RingStats {
+    /// Events accepted into the ring
+    pub pushed: u64,
+    /// Events discarded because the ring was full
+    pub dropped: u64,
+}
+
+/// Shared, cheaply clonable view of a ring's counters
+#[derive(Debug, Clone, Default)]
+pub struct RingCounters {
+    inner: Arc<Counters>,
+}
+
+#[derive(Debug, Default)]
+struct Counters {
+    pushed: AtomicU64,
+    dropped: AtomicU64,
+}
+
+impl RingCounters {
+    pub fn snapshot(&self) -> RingStats {
+        RingStats {
+            pushed: self.inner.pushed.load(Ordering::Relaxed),
+            dropped: self.inner.dropped.load(Ordering::Relaxed),
+        }
+    }
+}
+
+struct Shared<T> {
+    slots: Box<[UnsafeCell<MaybeUninit<T>>]>,
+    mask: usize,
+    // Next slot to read; only the consumer stores it
+    head: AtomicUsize,
+    // Next slot to write; only the producer stores it
+    tail: AtomicUsize,
+    // Set when either end goes away (or on request via `RingCloser`)
+    closed: AtomicBool,
+    waiting: AtomicBool,
+    consumer: Mutex<Option<Thread>>,
+    counters: RingCounters,
+}
+
+// SAFETY: a slot is written only by the producer while it is outside
+// head..tail and read only by the consumer while it is inside; the
+// Release/Acquire pairs on head and tail order those accesses.
+unsafe impl<T: Send> Sync for Shared<T> {}
+
+impl<T> Shared<T> {
+    fn wake_consumer(&self) {
+        if self.waiting.load(Ordering::SeqCst)
+            && let Some(thread) = self.consumer.lock().unwrap().as_ref()
+        {
+            thread.unpark();
+        }
+    }
+}
+
+/// Writing end, owned by the reader thread
+pub struct RingProducer<T> {
+    shared: Arc<Shared<T>>,
+}
+
+/// Reading end, owned by the mapping thread
+pub struct RingConsumer<T> {
+    shared: Arc<Shared<T>>,
+}
+
+/// Create a ring holding up to `capacity` events (rounded up to a power of two)
+pub fn ring<T: Copy + Send>(capacity: usize) -> (RingProducer<T>, RingConsumer<T>) {
+    let capacity = capacity.max(2).next_power_of_two();
+    let slots = (0..capacity).map(|_| UnsafeCell::new(MaybeUninit::uninit())).collect();
+    let shared = Arc::new(Shared {
+        slots,
+        mask: capacity - 1,
+        head: AtomicUsize::new(0),
+        tail: AtomicUsize::new(0),
+        closed: AtomicBool::new(false),
+        waiting: AtomicBool::new(false),
+        consumer: Mutex::new(None),
+        counters: RingCounters::default(),
+    });
+    (RingProducer { shared: Arc::clone(&shared) }, RingConsumer { shared })
+}
+
+impl<T: Copy + Send> RingProducer<T> {
+    /// Append an event; returns false (and counts a drop) if the ring is full
+    pub fn push(&mut self, value: T) -> bool {
+        let shared = &*self.shared;
+        let tail = shared.tail.load(Ordering::Relaxed);
+        let head = shared.head.load(Ordering::Acquire);
+
+        if tail.wrapping_sub(head) > shared.mask {
+            shared.counters.inner.dropped.fetch_add(1, Ordering::Relaxed);
+            return false;
+        }
+
+        // SAFETY: the slot is outside head..tail, so the consumer is not reading it
+        unsafe { (*shared.slots[tail & shared.mask].get()).write(value) };
+        shared.tail.store(tail.wrapping_add(1), Ordering::SeqCst);
+        shared.counters.inner.pushed.fetch_add(1, Ordering::Relaxed);
+
+        shared.wake_consumer();
+        true
+    }
+
+    pub fn counters(&self) -> RingCounters {
+        self.shared.counters.clone()
+    }
+
+    /// True once the consumer is gone or the ring was closed; stop producing
+    pub fn is_closed(&self) -> bool {
+        self.shared.closed.load(Ordering::SeqCst)
+    }
+}
+
+impl<T> Drop for RingProducer<T> {
+    fn drop(&mut self) {
+        self.shared.closed.store(true, Ordering::SeqCst);
+        self.shared.wake_consumer();
+    }
+}
+
+impl<T: Copy + Send> RingConsumer<T> {
+    /// Take the oldest event, if any
+    pub fn pop(&mut self) -> Option<T> {
+        let shared = &*self.shared;
+        let head = shared.head.load(Ordering::Relaxed);
+        let tail = shared.tail.load(Ordering::Acquire);
+
+        if head == tail {
+            return None;
+        }
+
+        // SAFETY: the slot is inside head..tail, so the producer has written it
+        // and will not touch it until head moves past
+        let value = unsafe { (*shared.slots[head & shared.mask].get()).assume_init() };
+        shared.head.store(head.wrapping_add(1), Ordering::Release);
+        Some(value)
+    }
+
+    /// Take the oldest event, blocking while the ring is empty
+    ///
+    /// Returns None once the producer is gone and everything was consumed.
+    pub fn pop_blocking(&mut self) -> Option<T> {
+        self.pop_waiting(None)
+    }
+
+    /// Like `pop_blocking`, but gives up at `deadline`
+    ///
+    /// None both when the deadline passed and when the ring is drained;
+    /// `is_drained` tells them apart.
+    pub fn pop_blocking_until(&mut self, deadline: Instant) -> Option<T> {
+        self.pop_waiting(Some(deadline))
+    }
+
+    /// True once the producer is gone and everything was consumed
+    pub fn is_drained(&self) -> bool {
+        self.shared.closed.load(Ordering::SeqCst)
+            && self.shared.tail.load(Ordering::SeqCst) == self.shared.head.load(Ordering::Relaxed)
+    }
+
+    fn pop_waiting(&mut self, deadline: Option<Instant>) -> Option<T> {
+        loop {
+            if let Some(value) = self.pop() {
+                return Some(value);
+            }
+            if self.shared.closed.load(Ordering::SeqCst) {
+                // The producer may have pushed right before closing
+                return self.pop();
+            }
+
+            *self.shared.consumer.lock().unwrap() = Some(std::thread::current());
+            self.shared.waiting.store(true, Ordering::SeqCst);
+            // Re-check after announcing ourselves so a push can't slip between
+            let ready = self.shared.tail.load(Ordering::SeqCst)
+                != self.shared.head.load(Ordering::Relaxed)
+                || self.shared.closed.load(Ordering::SeqCst);
+            if !ready {
+                match deadline {
+                    Some(deadline) => {
+                        let now = Instant::now();
+                        if now >= deadline {
+                            self.shared.waiting.store(false, Ordering::SeqCst);
+                            return None;
+                        }
+                        std::thread::park_timeout(deadline - now);
+                    }
+                    None => std::thread::park(),
+                }
+            }
+            self.shared.waiting.store(false, Ordering::SeqCst);
+        }
+    }
+
+    pub fn counters(&self) -> RingCounters {
+        self.shared.counters.clone()
+    }
+
+    /// Handle that can close the ring from any thread
+    pub fn closer(&self) -> RingCloser
+    where
+        T: 'static,
+    {
+        RingCloser { close: Arc::clone(&self.shared) as Arc<dyn Close> }
+    }
+}
+
+impl<T> Drop for RingConsumer<T> {
+    fn drop(&mut self) {
+        self.shared.closed.store(true, Ordering::SeqCst);
+    }
+}
+
+/// Closes a ring: a blocked consumer drains what is left and then gets None
+#[derive(Clone)]
+pub struct RingCloser {
+    close: Arc<dyn Close>,
+}
+
+impl RingCloser {
+    pub fn close(&self) {
+        self.close.close();
+    }
+}
+
+// Type-erased so the closer needn't carry the element type
+trait Close: Send + Sync {
+    fn close(&self);
+}
+
+impl<T: Send> Close for Shared<T> {
+    fn close(&self) {
+        self.closed.store(true, Ordering::SeqCst);
+        self.wake_consumer();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_push_pop_in_order() {
+        let (mut tx, mut rx) = ring::<u32>(4);
+        assert!(tx.push(1));
+        assert!(tx.push(2));
+        assert_eq!(rx.pop(), Some(1));
+        assert_eq!(rx.pop(), Some(2));
+        assert_eq!(rx.pop(), None);
+    }
+
+    #[test]
+    fn test_full_ring_drops_and_counts() {
+        let (mut tx, mut rx) = ring::<u32>(4);
+        for i in 0..6 {
+            tx.push(i);
+        }
+
+        assert_eq!(rx.counters().snapshot(), RingStats { pushed: 4, dropped: 2 });
+        // Oldest events survive, the newest were dropped
+        assert_eq!(rx.pop(), Some(0));
+        assert!(tx.push(10));
+        assert_eq!((rx.pop(), rx.pop(), rx.pop(), rx.pop()), (Some(1), Some(2), Some(3), Some(10)));
+    }
+
+    #[test]
+    fn test_capacity_rounds_up_to_power_of_two() {
+        let (mut tx, _rx) = ring::<u8>(5);
+        let accepted = (0..10).filter(|&i| tx.push(i)).count();
+        assert_eq!(accepted, 8);
+    }
+
+    #[test]
+    fn test_pop_blocking_returns_none_after_close() {
+        let (mut tx, mut rx) = ring::<u32>(4);
+        tx.push(7);
+        drop(tx);
+
+        assert_eq!(rx.pop_blocking(), Some(7));
+        assert_eq!(rx.pop_blocking(), None);
+    }
+
+    #[test]
+    fn test_pop_blocking_until_gives_up_at_deadline() {
+        let (mut tx, mut rx) = ring::<u32>(4);
+        let deadline = Instant::now() + std::time::Duration::from_millis(10);
+        assert_eq!(rx.pop_blocking_until(deadline), None);
+        assert!(Instant::now() >= deadline);
+        assert!(!rx.is_drained());
+
+        tx.push(3);
+        drop(tx);
+        assert_eq!(rx.pop_blocking_until(deadline), Some(3));
+        assert_eq!(rx.pop_blocking_until(Instant::now() + std::time::Duration::from_secs(5)), None);
+        assert!(rx.is_drained());
+    }
+
+    #[test]
+    fn test_closer_wakes_blocked_consumer() {
+        let (mut tx, mut rx) = ring::<u32>(4);
+        let closer = rx.closer();
+
+        let consumer = std::thread::spawn(move || {
+            let mut seen = Vec::new();
+            while let Some(value) = rx.pop_blocking() {
+                seen.push(value);
+            }
+            seen
+        });
+
+        tx.push(1);
+        std::thread::sleep(std::time::Duration::from_millis(20));
+        closer.close();
+
+        assert_eq!(consumer.join().unwrap(), vec![1]);
+        assert!(tx.is_closed());
+    }
+
+    #[test]
+    fn test_dropping_consumer_closes_ring() {
+        let (tx, rx) = ring::<u32>(4);
+        assert!(!tx.is_closed());
+        drop(rx);
+        assert!(tx.is_closed());
+    }
+
+    #[test]
+    fn test_cross_thread_transfer_preserves_order() {
+        const COUNT: u64 = 100_000;
+        let (mut tx, mut rx) = ring::<u64>(64);
+
+        let producer = std::thread::spawn(move || {
+            let mut next = 0;
+            while next < COUNT {
+                if tx.push(next) {
+                    next += 1;
+                } else {
+                    std::thread::yield_now();
+                }
+            }
+        });
+
+        let mut expected = 0;
+        while let Some(value) = rx.pop_blocking() {
+            assert_eq!(value, expected);
+            expected += 1;
+        }
+        producer.join().unwrap();
+        assert_eq!(expected, COUNT);
+    }
+}
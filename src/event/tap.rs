@@ -0,0 +1,131 @@
+// Observation point for a running pipeline
+//
+// The event loop publishes every input frame and the keyboard events it was
+// mapped to; visualizers and overlays subscribe. Publishing never blocks:
+// a subscriber that falls behind loses events instead of slowing the
+// mapper, and with nobody subscribed it costs one atomic load per frame.
+
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::mpsc::{Receiver, SyncSender, TrySendError, sync_channel};
+use std::sync::{Arc, Mutex};
+
+use crate::event::{InputEvent, KeyboardCode, OutputEvent, Switch};
+
+/// Events buffered per subscriber before new ones are dropped
+pub const TAP_CAPACITY: usize = 1024;
+
+/// What a subscriber sees: raw controller input and what it was mapped to
+#[derive(Debug, Clone)]
+pub enum TapEvent {
+    Input(InputEvent),
+    Output(OutputEvent),
+    /// The keys sticky mappings now hold (with a visual sticky cue)
+    Sticky(Vec<KeyboardCode>),
+    /// A layer or the mappings switched (with a visual switch cue)
+    Switch(Switch),
+}
+
+/// Cheaply clonable broadcast point shared by a loop and its observers
+#[derive(Debug, Clone, Default)]
+pub struct EventTap {
+    inner: Arc<TapInner>,
+}
+
+#[derive(Debug, Default)]
+struct TapInner {
+    subscribers: Mutex<Vec<SyncSender<TapEvent>>>,
+    // Mirrors subscribers.len() so the hot path can skip the lock
+    active: AtomicUsize,
+}
+
+impl EventTap {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// True while anyone is listening
+    #[inline]
+    pub fn is_active(&self) -> bool {
+        self.inner.active.load(Ordering::Relaxed) > 0
+    }
+
+    /// Receive events published from now on; drop the receiver to unsubscribe
+    ///
+    /// The receiver reports disconnected once the tap and every clone of it
+    /// are gone, i.e. the pipeline ended.
+    pub fn subscribe(&self) -> Receiver<TapEvent> {
+        let (sender, receiver) = sync_channel(TAP_CAPACITY);
+        let mut subscribers = self.inner.subscribers.lock().unwrap();
+        subscribers.push(sender);
+        self.inner.active.store(subscribers.len(), Ordering::Relaxed);
+        receiver
+    }
+
+    /// Hand `events` to every subscriber
+    pub fn publish(&self, events: impl IntoIterator<Item = TapEvent>) {
+        if !self.is_active() {
+            return;
+        }
+        let mut subscribers = self.inner.subscribers.lock().unwrap();
+        for event in events {
+            subscribers.retain(|sender| match sender.try_send(event.clone()) {
+                // A full subscriber just misses this event
+                Ok(()) | Err(TrySendError::Full(_)) => true,
+                Err(TrySendError::Disconnected(_)) => false,
+            });
+        }
+        self.inner.active.store(subscribers.len(), Ordering::Relaxed);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::ButtonCode;
+
+    fn press() -> TapEvent {
+        TapEvent::Input(InputEvent::button_press(ButtonCode::South))
+    }
+
+    #[test]
+    fn test_subscribers_receive_published_events() {
+        let tap = EventTap::new();
+        assert!(!tap.is_active());
+        tap.publish([press()]); // nobody listening, nothing kept
+
+        let first = tap.subscribe();
+        let second = tap.subscribe();
+        tap.publish([press(), press()]);
+
+        assert_eq!(first.try_iter().count(), 2);
+        assert_eq!(second.try_iter().count(), 2);
+    }
+
+    #[test]
+    fn test_dropped_subscriber_is_removed() {
+        let tap = EventTap::new();
+        drop(tap.subscribe());
+        assert!(tap.is_active());
+
+        tap.publish([press()]);
+        assert!(!tap.is_active());
+    }
+
+    #[test]
+    fn test_slow_subscriber_loses_events_without_blocking() {
+        let tap = EventTap::new();
+        let slow = tap.subscribe();
+        tap.publish((0..TAP_CAPACITY + 10).map(|_| press()));
+
+        assert_eq!(slow.try_iter().count(), TAP_CAPACITY);
+        assert!(tap.is_active());
+    }
+
+    #[test]
+    fn test_receiver_disconnects_with_tap() {
+        let tap = EventTap::new();
+        let receiver = tap.subscribe();
+        drop(tap);
+        assert!(receiver.recv().is_err());
+    }
+}
@@ -0,0 +1,146 @@
+// Exit codes
+//
+// Scripts and launchers branch on how a command ended, so the codes it
+// exits with are fixed:
+//
+//   0   success
+//   1   any other failure
+//   2   no controllers: none connected, none matching, or none usable
+//   3   no access to a device node or /dev/uinput: permission denied, or
+//       uinput missing
+//   4   a profile that couldn't be read or loaded
+//   5   no running daemon to ask
+//   64  a command line that doesn't parse (clap's own 2 is taken)
+//
+// A failure is told by the typed errors in its chain, the outermost known
+// one winning: a profile that can't be read for want of permission is a
+// profile error. Anything else is 1.
+
+use std::io;
+
+use crate::input::{ErrorType, InputDeviceError, manager::NoControllers};
+use crate::ipc::NoDaemon;
+use crate::mapping::profile::ProfileError;
+
+/// How a command ended, for scripts to branch on
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ExitCode {
+    Success,
+    Failure,
+    NoControllers,
+    Permission,
+    Profile,
+    NoDaemon,
+    Usage,
+}
+
+impl ExitCode {
+    /// Every code, in order
+    pub const ALL: [Self; 7] = [
+        Self::Success,
+        Self::Failure,
+        Self::NoControllers,
+        Self::Permission,
+        Self::Profile,
+        Self::NoDaemon,
+        Self::Usage,
+    ];
+
+    /// The process exit status
+    pub fn code(self) -> i32 {
+        match self {
+            Self::Success => 0,
+            Self::Failure => 1,
+            Self::NoControllers => 2,
+            Self::Permission => 3,
+            Self::Profile => 4,
+            Self::NoDaemon => 5,
+            Self::Usage => 64,
+        }
+    }
+
+    /// What the code means, for the manual
+    pub fn meaning(self) -> &'static str {
+        match self {
+            Self::Success => "Success",
+            Self::Failure => "Any other failure",
+            Self::NoControllers => "No controllers: none connected, none matching, or none usable",
+            Self::Permission => {
+                "No access to a device node or /dev/uinput: permission denied, or uinput missing"
+            }
+            Self::Profile => "A profile that couldn't be read or loaded",
+            Self::NoDaemon => "No running daemon to ask",
+            Self::Usage => "A command line that doesn't parse",
+        }
+    }
+
+    /// The code a command failing with `error` exits with
+    pub fn of(error: &anyhow::Error) -> Self {
+        error.chain().find_map(classify).unwrap_or(Self::Failure)
+    }
+}
+
+fn classify(error: &(dyn std::error::Error + 'static)) -> Option<ExitCode> {
+    if let Some(none) = error.downcast_ref::<NoControllers>() {
+        return Some(match none {
+            NoControllers::Unusable { error_type: ErrorType::Permission, .. } => {
+                ExitCode::Permission
+            }
+            _ => ExitCode::NoControllers,
+        });
+    }
+    if error.is::<ProfileError>() {
+        return Some(ExitCode::Profile);
+    }
+    if error.is::<NoDaemon>() {
+        return Some(ExitCode::NoDaemon);
+    }
+    if error
+        .downcast_ref::<InputDeviceError>()
+        .is_some_and(|e| e.error_type == ErrorType::Permission)
+    {
+        return Some(ExitCode::Permission);
+    }
+    #[cfg(target_os = "linux")]
+    {
+        if error.is::<crate::platform::linux::preflight::AccessProblem>() {
+            return Some(ExitCode::Permission);
+        }
+    }
+    match error.downcast_ref::<io::Error>() {
+        Some(e) if e.kind() == io::ErrorKind::PermissionDenied => Some(ExitCode::Permission),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anyhow::Context;
+
+    #[test]
+    fn test_failures_get_their_codes() {
+        let none = anyhow::Error::new(NoControllers::Connected);
+        assert_eq!(ExitCode::of(&none).code(), 2);
+
+        let denied = anyhow::Error::new(NoControllers::Unusable {
+            path: "/dev/input/event3".to_string(),
+            error_type: ErrorType::Permission,
+        });
+        assert_eq!(ExitCode::of(&denied), ExitCode::Permission);
+
+        let io = io::Error::from(io::ErrorKind::PermissionDenied);
+        let open: anyhow::Result<()> = Err(io).context("Failed to open /dev/uinput");
+        assert_eq!(ExitCode::of(&open.unwrap_err()).code(), 3);
+
+        assert_eq!(ExitCode::of(&anyhow::anyhow!("something else")).code(), 1);
+    }
+
+    #[test]
+    fn test_outermost_failure_wins() {
+        let io = io::Error::from(io::ErrorKind::PermissionDenied);
+        let profile = ProfileError::new("Failed to read profile file", io.into());
+        let error = anyhow::Error::new(profile).context("Failed to start");
+        assert_eq!(ExitCode::of(&error), ExitCode::Profile);
+    }
+}
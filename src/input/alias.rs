@@ -0,0 +1,308 @@
+// Controller aliases
+//
+// Event node numbers follow the order devices were found in, which changes
+// across reboots and replugs. An alias names one controller by what stays
+// the same: its vendor and product IDs, and its unique ID (usually the
+// Bluetooth address) or, for controllers reporting none, the port it's
+// plugged into. `--device living-room-pad` then reads whichever node the
+// controller has now.
+//
+//   $XDG_CONFIG_HOME/blazeremap/devices.toml
+//
+//   [living-room-pad]
+//   id = "054c:09cc"
+//   uniq = "a0:5a:5c:00:11:22"
+//
+//   [arcade-stick]
+//   id = "0f0d:0092"
+//   phys = "usb-0000:00:14.0-2/input0"
+
+use std::collections::BTreeMap;
+use std::fmt;
+use std::path::PathBuf;
+
+use anyhow::{Context, Result, bail};
+use serde::{Deserialize, Serialize};
+
+use crate::input::{GamepadInfo, InputManager};
+
+/// What tells one controller apart from the others, whatever its node
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DeviceIdentity {
+    pub vendor_id: u16,
+    pub product_id: u16,
+    pub uniq: Option<String>,
+    /// Only kept for controllers without a unique ID
+    pub phys: Option<String>,
+}
+
+impl DeviceIdentity {
+    pub fn of(info: &GamepadInfo) -> Self {
+        Self {
+            vendor_id: info.vendor_id,
+            product_id: info.product_id,
+            uniq: info.uniq.clone(),
+            phys: if info.uniq.is_some() { None } else { info.phys.clone() },
+        }
+    }
+
+    pub fn matches(&self, info: &GamepadInfo) -> bool {
+        self.covers(&DeviceIdentity {
+            vendor_id: info.vendor_id,
+            product_id: info.product_id,
+            uniq: info.uniq.clone(),
+            phys: info.phys.clone(),
+        })
+    }
+
+    /// Whether `device`, with all it reports, is this controller
+    pub fn covers(&self, device: &DeviceIdentity) -> bool {
+        self.vendor_id == device.vendor_id
+            && self.product_id == device.product_id
+            && (self.uniq.is_none() || self.uniq == device.uniq)
+            && (self.phys.is_none() || self.phys == device.phys)
+    }
+
+    /// The first of `gamepads` that is this controller
+    pub fn find<'a>(&self, gamepads: &'a [GamepadInfo]) -> Option<&'a GamepadInfo> {
+        gamepads.iter().find(|info| self.matches(info))
+    }
+}
+
+impl fmt::Display for DeviceIdentity {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{:04x}:{:04x}", self.vendor_id, self.product_id)?;
+        match (&self.uniq, &self.phys) {
+            (Some(uniq), _) => write!(f, " ({})", uniq),
+            (None, Some(phys)) => write!(f, " at {}", phys),
+            (None, None) => Ok(()),
+        }
+    }
+}
+
+/// Whether `name` can be an alias: letters, digits, `-` and `_`, and not a
+/// number, which selects a controller by index
+pub fn is_alias_name(name: &str) -> bool {
+    !name.is_empty()
+        && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+        && name.parse::<usize>().is_err()
+}
+
+/// Path of the device `selection` names: an alias of the user's, an index
+/// into the detected controllers or a device path
+pub fn resolve_user(manager: &dyn InputManager, selection: &str) -> Result<String> {
+    // Only read the aliases file for what could be an alias
+    let aliases = match is_alias_name(selection) {
+        true => AliasStore::user()?.load()?,
+        false => BTreeMap::new(),
+    };
+    resolve(manager, selection, &aliases)
+}
+
+/// `resolve_user` with `aliases`
+pub fn resolve(
+    manager: &dyn InputManager,
+    selection: &str,
+    aliases: &BTreeMap<String, DeviceIdentity>,
+) -> Result<String> {
+    if let Ok(index) = selection.parse::<usize>() {
+        let gamepads = manager.list_gamepads()?;
+        return gamepads
+            .gamepad_info
+            .get(index)
+            .map(|info| info.path.clone())
+            .with_context(|| format!("No controller at index {}", index));
+    }
+    let Some(identity) = aliases.get(selection) else {
+        return Ok(selection.to_string());
+    };
+    let gamepads = manager.list_gamepads()?;
+    identity
+        .find(&gamepads.gamepad_info)
+        .map(|info| info.path.clone())
+        .with_context(|| format!("Controller '{}' ({}) is not connected", selection, identity))
+}
+
+// One table of devices.toml
+#[derive(Debug, Serialize, Deserialize)]
+struct Entry {
+    id: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    uniq: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    phys: Option<String>,
+}
+
+impl Entry {
+    fn identity(self) -> Result<DeviceIdentity> {
+        let ids = self.id.split_once(':').and_then(|(vendor, product)| {
+            Some((u16::from_str_radix(vendor, 16).ok()?, u16::from_str_radix(product, 16).ok()?))
+        });
+        let Some((vendor_id, product_id)) = ids else {
+            bail!("'{}' is not VENDOR:PRODUCT in hex", self.id);
+        };
+        Ok(DeviceIdentity { vendor_id, product_id, uniq: self.uniq, phys: self.phys })
+    }
+}
+
+/// The aliases file
+#[derive(Debug, Clone)]
+pub struct AliasStore {
+    path: PathBuf,
+}
+
+impl AliasStore {
+    pub fn new(path: impl Into<PathBuf>) -> Self {
+        Self { path: path.into() }
+    }
+
+    /// $XDG_CONFIG_HOME/blazeremap/devices.toml
+    pub fn user() -> Result<Self> {
+        Ok(Self::new(super::config_dir()?.join("devices.toml")))
+    }
+
+    pub fn path(&self) -> &std::path::Path {
+        &self.path
+    }
+
+    /// Every alias, by name; none without the file
+    pub fn load(&self) -> Result<BTreeMap<String, DeviceIdentity>> {
+        let text = match std::fs::read_to_string(&self.path) {
+            Ok(text) => text,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(BTreeMap::new()),
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read {}", self.path.display()));
+            }
+        };
+        let entries: BTreeMap<String, Entry> = toml::from_str(&text)
+            .with_context(|| format!("Invalid aliases {}", self.path.display()))?;
+        entries
+            .into_iter()
+            .map(|(name, entry)| {
+                let identity = entry.identity().with_context(|| {
+                    format!("Invalid alias '{}' in {}", name, self.path.display())
+                })?;
+                Ok((name, identity))
+            })
+            .collect()
+    }
+
+    /// Name the controller `identity` `name`, replacing what it named before
+    pub fn set(&self, name: &str, identity: &DeviceIdentity) -> Result<()> {
+        if !is_alias_name(name) {
+            bail!("'{}' can't be an alias; use letters, digits, '-' and '_'", name);
+        }
+        let mut aliases = self.load()?;
+        aliases.insert(name.to_string(), identity.clone());
+        self.save(&aliases)
+    }
+
+    /// Forget `name`; false if there was no such alias
+    pub fn remove(&self, name: &str) -> Result<bool> {
+        let mut aliases = self.load()?;
+        if aliases.remove(name).is_none() {
+            return Ok(false);
+        }
+        self.save(&aliases)?;
+        Ok(true)
+    }
+
+    fn save(&self, aliases: &BTreeMap<String, DeviceIdentity>) -> Result<()> {
+        let entries: BTreeMap<&String, Entry> = aliases
+            .iter()
+            .map(|(name, identity)| {
+                let entry = Entry {
+                    id: format!("{:04x}:{:04x}", identity.vendor_id, identity.product_id),
+                    uniq: identity.uniq.clone(),
+                    phys: identity.phys.clone(),
+                };
+                (name, entry)
+            })
+            .collect();
+        if let Some(dir) = self.path.parent() {
+            std::fs::create_dir_all(dir)
+                .with_context(|| format!("Failed to create {}", dir.display()))?;
+        }
+        std::fs::write(&self.path, toml::to_string(&entries)?)
+            .with_context(|| format!("Failed to write {}", self.path.display()))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::GamepadType;
+
+    fn info(path: &str, uniq: Option<&str>, phys: Option<&str>) -> GamepadInfo {
+        GamepadInfo {
+            path: path.to_string(),
+            name: "Wireless Controller".to_string(),
+            gamepad_type: GamepadType::DualShock4,
+            vendor_id: 0x054c,
+            vendor_name: "Sony".to_string(),
+            product_id: 0x09cc,
+            uniq: uniq.map(str::to_string),
+            phys: phys.map(str::to_string),
+            capabilities: Vec::new(),
+        }
+    }
+
+    #[test]
+    fn test_identity_finds_controller_on_any_node() {
+        let usb = info("/dev/input/event3", None, Some("usb-0000:00:14.0-2/input0"));
+        let bluetooth =
+            info("/dev/input/event7", Some("a0:5a:5c:00:11:22"), Some("00:1a:7d:da:71:13"));
+
+        let identity = DeviceIdentity::of(&bluetooth);
+        assert_eq!(identity.phys, None);
+        assert_eq!(identity.to_string(), "054c:09cc (a0:5a:5c:00:11:22)");
+        let moved = info("/dev/input/event12", Some("a0:5a:5c:00:11:22"), Some("other"));
+        let gamepads = [usb.clone(), moved];
+        assert_eq!(identity.find(&gamepads).unwrap().path, "/dev/input/event12");
+
+        let identity = DeviceIdentity::of(&usb);
+        assert_eq!(identity.to_string(), "054c:09cc at usb-0000:00:14.0-2/input0");
+        assert!(identity.matches(&usb));
+        assert!(!identity.matches(&info(
+            "/dev/input/event3",
+            None,
+            Some("usb-0000:00:14.0-3/input0")
+        )));
+    }
+
+    #[test]
+    fn test_store_round_trip() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-aliases-{}", std::process::id()));
+        let store = AliasStore::new(dir.join("devices.toml"));
+        assert!(store.load().unwrap().is_empty());
+
+        let identity =
+            DeviceIdentity::of(&info("/dev/input/event7", Some("a0:5a:5c:00:11:22"), None));
+        store.set("living-room-pad", &identity).unwrap();
+        let text = std::fs::read_to_string(store.path()).unwrap();
+        assert!(
+            text.contains("[living-room-pad]\nid = \"054c:09cc\"\nuniq = \"a0:5a:5c:00:11:22\"\n"),
+            "{}",
+            text
+        );
+        assert_eq!(store.load().unwrap()["living-room-pad"], identity);
+
+        assert!(store.set("2", &identity).is_err());
+        assert!(store.set("/dev/input/event3", &identity).is_err());
+        assert!(store.remove("living-room-pad").unwrap());
+        assert!(!store.remove("living-room-pad").unwrap());
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_invalid_id() {
+        let dir =
+            std::env::temp_dir().join(format!("blazeremap-aliases-bad-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let store = AliasStore::new(dir.join("devices.toml"));
+        std::fs::write(store.path(), "[pad]\nid = \"sony\"\n").unwrap();
+        let err = store.load().unwrap_err();
+        assert!(format!("{:#}", err).contains("Invalid alias 'pad'"), "{:#}", err);
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+}
@@ -0,0 +1,197 @@
+// Button timing: how long presses last, and which ones are bounce
+//
+// A worn switch chatters: one press of the finger reaches us as press,
+// release, press, a few milliseconds apart. A press arriving sooner than
+// `window` after the same button was released is counted as a bounce, the
+// same rule `debounce_ms` uses to drop them; deliberate presses, even
+// mashed ones, are further apart than that.
+
+use std::time::{Duration, Instant};
+
+use crate::event::{ButtonCode, InputEvent};
+
+/// Press and release timing of each button, as events come
+#[derive(Debug, Clone)]
+pub struct ButtonTimings {
+    window: Duration,
+    buttons: Vec<ButtonTiming>,
+}
+
+#[derive(Debug, Clone)]
+struct ButtonTiming {
+    code: ButtonCode,
+    pressed_at: Option<Instant>,
+    released_at: Option<Instant>,
+    // Press to release
+    holds: Vec<Duration>,
+    // Release to the next deliberate press; bounces are kept apart
+    gaps: Vec<Duration>,
+    bounces: Vec<Duration>,
+}
+
+/// What one button did while measured
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ButtonReport {
+    pub code: ButtonCode,
+    /// Deliberate presses, bounces left out
+    pub presses: usize,
+    pub shortest_hold: Option<Duration>,
+    pub median_hold: Option<Duration>,
+    /// Shortest time between a release and a deliberate press
+    pub shortest_gap: Option<Duration>,
+    pub bounces: usize,
+    pub longest_bounce: Option<Duration>,
+}
+
+impl ButtonReport {
+    /// A `debounce_ms` dropping every bounce seen, with a little to spare;
+    /// None if the button didn't bounce
+    pub fn suggested_debounce_ms(&self) -> Option<u32> {
+        let longest = self.longest_bounce?.as_millis() as u32;
+        // 5 ms of room, rounded up to the next 5
+        Some((longest + 5).div_ceil(5) * 5)
+    }
+
+    /// Whether the suggested debounce would drop deliberate presses too
+    pub fn debounce_too_long(&self) -> bool {
+        match (self.suggested_debounce_ms(), self.shortest_gap) {
+            (Some(ms), Some(gap)) => Duration::from_millis(ms as u64) >= gap,
+            _ => false,
+        }
+    }
+}
+
+impl ButtonTimings {
+    /// Presses sooner than `window` after a release are bounce
+    pub fn new(window: Duration) -> Self {
+        Self { window, buttons: Vec::new() }
+    }
+
+    /// Take `event` into account; returns how soon after its release the
+    /// button was pressed again, if that was a bounce
+    pub fn sample(&mut self, event: &InputEvent) -> Option<Duration> {
+        let InputEvent::Button { code, pressed, timestamp } = *event else {
+            return None;
+        };
+        let index = match self.buttons.iter().position(|button| button.code == code) {
+            Some(index) => index,
+            None => {
+                self.buttons.push(ButtonTiming {
+                    code,
+                    pressed_at: None,
+                    released_at: None,
+                    holds: Vec::new(),
+                    gaps: Vec::new(),
+                    bounces: Vec::new(),
+                });
+                self.buttons.len() - 1
+            }
+        };
+        let button = &mut self.buttons[index];
+        if pressed {
+            // Key repeat and duplicate presses don't start a new one
+            if button.pressed_at.is_some() {
+                return None;
+            }
+            button.pressed_at = Some(timestamp);
+            let gap = timestamp.saturating_duration_since(button.released_at?);
+            if gap < self.window {
+                button.bounces.push(gap);
+                return Some(gap);
+            }
+            button.gaps.push(gap);
+        } else if let Some(pressed_at) = button.pressed_at.take() {
+            button.holds.push(timestamp.saturating_duration_since(pressed_at));
+            button.released_at = Some(timestamp);
+        }
+        None
+    }
+
+    /// A report for each button that was pressed, in the order they first were
+    pub fn reports(&self) -> Vec<ButtonReport> {
+        self.buttons
+            .iter()
+            .map(|button| {
+                let mut holds = button.holds.clone();
+                holds.sort();
+                ButtonReport {
+                    code: button.code,
+                    presses: holds.len() + button.pressed_at.is_some() as usize
+                        - button.bounces.len(),
+                    shortest_hold: holds.first().copied(),
+                    median_hold: holds.get(holds.len() / 2).copied(),
+                    shortest_gap: button.gaps.iter().min().copied(),
+                    bounces: button.bounces.len(),
+                    longest_bounce: button.bounces.iter().max().copied(),
+                }
+            })
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ms(base: Instant, offset: u64) -> Instant {
+        base + Duration::from_millis(offset)
+    }
+
+    #[test]
+    fn test_bounces_and_intervals() {
+        let base = Instant::now();
+        let mut timings = ButtonTimings::new(Duration::from_millis(30));
+        let mut bounced = Vec::new();
+        for (code, pressed, at) in [
+            (ButtonCode::South, true, 0),
+            (ButtonCode::South, false, 80),
+            // Chatter on the way down
+            (ButtonCode::South, true, 84),
+            (ButtonCode::South, false, 86),
+            (ButtonCode::South, true, 92),
+            (ButtonCode::South, false, 200),
+            (ButtonCode::East, true, 210),
+            (ButtonCode::South, true, 260),
+            (ButtonCode::South, true, 270),
+            (ButtonCode::South, false, 300),
+        ] {
+            let event = InputEvent::Button { code, pressed, timestamp: ms(base, at) };
+            bounced.extend(timings.sample(&event));
+        }
+        assert_eq!(bounced, [Duration::from_millis(4), Duration::from_millis(6)]);
+
+        let reports = timings.reports();
+        assert_eq!(
+            reports[0],
+            ButtonReport {
+                code: ButtonCode::South,
+                presses: 2,
+                shortest_hold: Some(Duration::from_millis(2)),
+                median_hold: Some(Duration::from_millis(80)),
+                shortest_gap: Some(Duration::from_millis(60)),
+                bounces: 2,
+                longest_bounce: Some(Duration::from_millis(6)),
+            }
+        );
+        assert_eq!(reports[0].suggested_debounce_ms(), Some(15));
+        assert!(!reports[0].debounce_too_long());
+        // Still held
+        assert_eq!(reports[1].presses, 1);
+        assert_eq!(reports[1].suggested_debounce_ms(), None);
+    }
+
+    #[test]
+    fn test_debounce_too_long() {
+        let report = ButtonReport {
+            code: ButtonCode::West,
+            presses: 10,
+            shortest_hold: None,
+            median_hold: None,
+            shortest_gap: Some(Duration::from_millis(32)),
+            bounces: 1,
+            longest_bounce: Some(Duration::from_millis(28)),
+        };
+        assert_eq!(report.suggested_debounce_ms(), Some(35));
+        assert!(report.debounce_too_long());
+    }
+}
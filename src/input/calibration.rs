@@ -0,0 +1,482 @@
+// Per-controller calibration
+//
+// Sticks rest off center, and by a different amount on every controller.
+// A calibration corrects the axes of one controller. It's kept in the config
+// directory, keyed by that controller, rather than in profiles: it applies
+// whichever profile is in use, and every time the controller is read.
+//
+//   $XDG_CONFIG_HOME/blazeremap/calibration/045e-02ea-a0_5a_5c_00_11_22.toml
+//
+//   [[axes]]
+//   axis = "LeftX"
+//   center = 900
+//   deadzone = 1500
+//
+// Values are in the normalized ranges of `input::range`. `IdleNoise` works
+// out a calibration from a controller left at rest. `Recenter` moves the
+// sticks' centers to where they rest now, for the rest of a session, when
+// a warm controller drifts from what was stored.
+//
+// A calibration can also be written into the kernel's axis info, for other
+// programs reading the controller. That changes the ranges the kernel
+// reports, so the ones it reported before are kept with the calibration,
+// under `device_ranges`, and axes are normalized from those instead.
+
+use std::fmt;
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicU32, Ordering};
+use std::sync::{Arc, OnceLock};
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+
+use crate::event::{AxisCode, InputEvent};
+use crate::input::GamepadInfo;
+use crate::input::range::AxisRange;
+
+/// Corrections for one axis
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct AxisCalibration {
+    pub axis: AxisCode,
+    /// The value at rest; reported as 0
+    #[serde(default)]
+    pub center: i32,
+    /// Values this close to `center` are reported as 0 too
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub deadzone: i32,
+}
+
+fn is_zero(value: &i32) -> bool {
+    *value == 0
+}
+
+impl AxisCalibration {
+    pub fn apply(&self, value: i32) -> i32 {
+        let offset = value.saturating_sub(self.center);
+        if offset.abs() <= self.deadzone { 0 } else { offset }
+    }
+}
+
+/// The range the driver reported for an axis before a calibration was
+/// written into the kernel
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DeviceRange {
+    pub axis: AxisCode,
+    pub min: i32,
+    pub max: i32,
+}
+
+/// Corrections for the axes of one controller
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Calibration {
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub axes: Vec<AxisCalibration>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub device_ranges: Vec<DeviceRange>,
+}
+
+impl Calibration {
+    pub fn is_empty(&self) -> bool {
+        self.axes.is_empty() && self.device_ranges.is_empty()
+    }
+
+    /// The range `code` is to be normalized from, if the kernel's no longer
+    /// tells
+    pub fn device_range(&self, code: AxisCode) -> Option<AxisRange> {
+        self.device_ranges
+            .iter()
+            .find(|range| range.axis == code)
+            .map(|range| AxisRange::new(range.min, range.max))
+    }
+
+    pub fn axis(&self, code: AxisCode) -> Option<&AxisCalibration> {
+        self.axes.iter().find(|axis| axis.axis == code)
+    }
+
+    /// Add `axis`, replacing what was there for the same axis
+    pub fn set(&mut self, axis: AxisCalibration) {
+        match self.axes.iter_mut().find(|existing| existing.axis == axis.axis) {
+            Some(existing) => *existing = axis,
+            None => self.axes.push(axis),
+        }
+    }
+
+    /// Keep `range` for its axis, replacing what was there
+    pub fn set_device_range(&mut self, range: DeviceRange) {
+        match self.device_ranges.iter_mut().find(|existing| existing.axis == range.axis) {
+            Some(existing) => *existing = range,
+            None => self.device_ranges.push(range),
+        }
+    }
+
+    /// Center `code` on `value`, where it rests now, keeping its deadzone
+    /// (the built-in one if it wasn't calibrated)
+    pub fn recenter(&mut self, code: AxisCode, value: i32) {
+        let deadzone = self.axis(code).map_or(InputEvent::STICK_DEADZONE, |axis| axis.deadzone);
+        self.set(AxisCalibration { axis: code, center: value, deadzone });
+    }
+
+    /// Returns false if the axis wasn't calibrated
+    pub fn remove(&mut self, code: AxisCode) -> bool {
+        let before = self.axes.len();
+        self.axes.retain(|axis| axis.axis != code);
+        self.axes.len() != before
+    }
+
+    /// Correct `event` if it's a calibrated axis; returns whether it was
+    pub fn apply(&self, event: &mut InputEvent) -> bool {
+        let InputEvent::Axis { code, value, .. } = event else {
+            return false;
+        };
+        match self.axis(*code) {
+            Some(axis) => {
+                *value = axis.apply(*value);
+                true
+            }
+            None => false,
+        }
+    }
+}
+
+/// How the axes of a controller at rest wander
+///
+/// Centered axes (sticks and trackpads) are measured; the others rest at an
+/// end of their range, where the driver already holds them still.
+#[derive(Debug, Clone, Default)]
+pub struct IdleNoise {
+    axes: Vec<AxisNoise>,
+}
+
+#[derive(Debug, Clone)]
+struct AxisNoise {
+    axis: AxisCode,
+    min: i32,
+    max: i32,
+    sum: i64,
+    samples: u32,
+}
+
+/// A calibration suggested for one axis, and what it was worked out from
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Suggestion {
+    /// Centered on the average, with a deadzone half again as wide as the noise
+    pub calibration: AxisCalibration,
+    /// Furthest the axis strayed from its average
+    pub noise: i32,
+    pub samples: u32,
+}
+
+impl IdleNoise {
+    /// Take `event` into account
+    pub fn sample(&mut self, event: &InputEvent) {
+        let InputEvent::Axis { code, value, .. } = *event else {
+            return;
+        };
+        if code == AxisCode::Unknown || AxisRange::canonical(code) != AxisRange::STICK {
+            return;
+        }
+        match self.axes.iter_mut().find(|axis| axis.axis == code) {
+            Some(axis) => {
+                axis.min = axis.min.min(value);
+                axis.max = axis.max.max(value);
+                axis.sum += value as i64;
+                axis.samples += 1;
+            }
+            None => self.axes.push(AxisNoise {
+                axis: code,
+                min: value,
+                max: value,
+                sum: value as i64,
+                samples: 1,
+            }),
+        }
+    }
+
+    /// A suggestion for each axis that reported anything, in the order
+    /// they first did
+    pub fn suggestions(&self) -> Vec<Suggestion> {
+        self.axes
+            .iter()
+            .map(|axis| {
+                let samples = axis.samples as i64;
+                let center = (axis.sum * 2 + samples).div_euclid(samples * 2) as i32;
+                let noise = (axis.max - center).max(center - axis.min);
+                Suggestion {
+                    calibration: AxisCalibration {
+                        axis: axis.axis,
+                        center,
+                        // Room for drift the sample missed
+                        deadzone: noise.saturating_add(noise / 2),
+                    },
+                    noise,
+                    samples: axis.samples,
+                }
+            })
+            .collect()
+    }
+}
+
+/// The axes that can be recentered: the sticks'
+///
+/// Triggers rest at an end of their range and trackpads only report while
+/// touched, so neither has a center to move.
+pub const STICK_AXES: [AxisCode; 4] =
+    [AxisCode::LeftX, AxisCode::LeftY, AxisCode::RightX, AxisCode::RightY];
+
+/// Stick axes named in `names`, separated by commas; all of them if none are
+pub fn parse_stick_axes(names: &str) -> Result<Vec<AxisCode>> {
+    let mut axes = Vec::new();
+    for name in names.split(',').map(str::trim).filter(|name| !name.is_empty()) {
+        let code = AxisCode::from(name);
+        if !STICK_AXES.contains(&code) {
+            anyhow::bail!("'{}' is not a stick axis", name);
+        }
+        if !axes.contains(&code) {
+            axes.push(code);
+        }
+    }
+    Ok(if axes.is_empty() { STICK_AXES.to_vec() } else { axes })
+}
+
+/// Requests to take where axes are now as their centers
+///
+/// Anything can raise one, from any thread; each reader watching takes it
+/// up on the next event it reads. Clones share their requests.
+#[derive(Debug, Clone)]
+pub struct Recenter {
+    // Requests so far, per axis
+    requests: Arc<[AtomicU32; AxisCode::ALL.len()]>,
+}
+
+impl Default for Recenter {
+    fn default() -> Self {
+        Self { requests: Arc::new(std::array::from_fn(|_| AtomicU32::new(0))) }
+    }
+}
+
+impl Recenter {
+    /// The one shared by the whole process: the control socket and
+    /// Recenter mappings raise it, calibrated readers watch it
+    pub fn session() -> Self {
+        static SESSION: OnceLock<Recenter> = OnceLock::new();
+        SESSION.get_or_init(Recenter::default).clone()
+    }
+
+    /// Ask readers to recenter `axes`
+    pub fn request(&self, axes: &[AxisCode]) {
+        for axis in axes {
+            self.requests[axis.index()].fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// Start watching for requests; earlier ones are already taken up
+    pub fn watch(&self) -> RecenterWatch {
+        let seen = std::array::from_fn(|index| self.requests[index].load(Ordering::Relaxed));
+        RecenterWatch { recenter: self.clone(), seen }
+    }
+}
+
+/// One reader's view of a `Recenter`
+#[derive(Debug, Clone)]
+pub struct RecenterWatch {
+    recenter: Recenter,
+    seen: [u32; AxisCode::ALL.len()],
+}
+
+impl RecenterWatch {
+    /// The axes requested since the last call
+    pub fn take(&mut self) -> impl Iterator<Item = AxisCode> + '_ {
+        STICK_AXES.into_iter().filter(|axis| {
+            let requests = self.recenter.requests[axis.index()].load(Ordering::Relaxed);
+            std::mem::replace(&mut self.seen[axis.index()], requests) != requests
+        })
+    }
+}
+
+/// The controller a calibration belongs to
+///
+/// Controllers reporting a unique ID (usually their Bluetooth address) are
+/// told apart; others share one calibration per model.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct DeviceKey {
+    pub vendor_id: u16,
+    pub product_id: u16,
+    pub uniq: Option<String>,
+}
+
+impl DeviceKey {
+    pub fn of(info: &GamepadInfo) -> Self {
+        Self { vendor_id: info.vendor_id, product_id: info.product_id, uniq: info.uniq.clone() }
+    }
+
+    /// Name of the calibration file: IDs in hex, then the unique ID with
+    /// everything but letters and digits as `_`
+    pub fn file_name(&self) -> String {
+        let mut name = format!("{:04x}-{:04x}", self.vendor_id, self.product_id);
+        if let Some(uniq) = &self.uniq {
+            name.push('-');
+            name.extend(uniq.chars().map(|c| if c.is_ascii_alphanumeric() { c } else { '_' }));
+        }
+        name + ".toml"
+    }
+}
+
+impl fmt::Display for DeviceKey {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{:04x}:{:04x}", self.vendor_id, self.product_id)?;
+        match &self.uniq {
+            Some(uniq) => write!(f, " ({})", uniq),
+            None => Ok(()),
+        }
+    }
+}
+
+/// A directory of calibrations, one file per controller
+#[derive(Debug, Clone)]
+pub struct CalibrationStore {
+    dir: PathBuf,
+}
+
+impl CalibrationStore {
+    pub fn new(dir: impl Into<PathBuf>) -> Self {
+        Self { dir: dir.into() }
+    }
+
+    /// $XDG_CONFIG_HOME/blazeremap/calibration
+    pub fn user() -> Result<Self> {
+        Ok(Self::new(super::config_dir()?.join("calibration")))
+    }
+
+    pub fn path(&self, key: &DeviceKey) -> PathBuf {
+        self.dir.join(key.file_name())
+    }
+
+    /// The calibration stored for `key`, if there is one
+    pub fn load(&self, key: &DeviceKey) -> Result<Option<Calibration>> {
+        let path = self.path(key);
+        let text = match std::fs::read_to_string(&path) {
+            Ok(text) => text,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read {}", path.display()));
+            }
+        };
+        let calibration = toml::from_str(&text)
+            .with_context(|| format!("Invalid calibration {}", path.display()))?;
+        Ok(Some(calibration))
+    }
+
+    /// Store `calibration` for `key`; an empty one removes the file
+    pub fn save(&self, key: &DeviceKey, calibration: &Calibration) -> Result<PathBuf> {
+        let path = self.path(key);
+        if calibration.is_empty() {
+            match std::fs::remove_file(&path) {
+                Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+                    return Err(e).with_context(|| format!("Failed to remove {}", path.display()));
+                }
+                _ => return Ok(path),
+            }
+        }
+        std::fs::create_dir_all(&self.dir)
+            .with_context(|| format!("Failed to create {}", self.dir.display()))?;
+        std::fs::write(&path, toml::to_string(calibration)?)
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+        Ok(path)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Instant;
+
+    fn key(uniq: Option<&str>) -> DeviceKey {
+        DeviceKey { vendor_id: 0x054c, product_id: 0x09cc, uniq: uniq.map(str::to_string) }
+    }
+
+    #[test]
+    fn test_apply() {
+        let mut calibration = Calibration::default();
+        calibration.set(AxisCalibration { axis: AxisCode::LeftX, center: 128, deadzone: 10 });
+        let axis = |code, value| InputEvent::Axis { code, value, timestamp: Instant::now() };
+
+        let mut event = axis(AxisCode::LeftX, 135);
+        assert!(calibration.apply(&mut event));
+        assert!(matches!(event, InputEvent::Axis { value: 0, .. }));
+        let mut event = axis(AxisCode::LeftX, 20);
+        calibration.apply(&mut event);
+        assert!(matches!(event, InputEvent::Axis { value: -108, .. }));
+        let mut event = axis(AxisCode::LeftY, 20);
+        assert!(!calibration.apply(&mut event));
+        assert!(matches!(event, InputEvent::Axis { value: 20, .. }));
+    }
+
+    #[test]
+    fn test_idle_noise() {
+        let mut noise = IdleNoise::default();
+        for (code, value) in [
+            (AxisCode::RightY, -400),
+            (AxisCode::LeftX, 1000),
+            (AxisCode::LeftX, 1300),
+            (AxisCode::LeftX, 700),
+            (AxisCode::LeftTrigger, 3),
+        ] {
+            noise.sample(&InputEvent::axis_move(code, value));
+        }
+        noise.sample(&InputEvent::button_press(crate::event::ButtonCode::South));
+
+        let suggestions = noise.suggestions();
+        assert_eq!(
+            suggestions,
+            [
+                Suggestion {
+                    calibration: AxisCalibration {
+                        axis: AxisCode::RightY,
+                        center: -400,
+                        deadzone: 0
+                    },
+                    noise: 0,
+                    samples: 1,
+                },
+                Suggestion {
+                    calibration: AxisCalibration {
+                        axis: AxisCode::LeftX,
+                        center: 1000,
+                        deadzone: 450
+                    },
+                    noise: 300,
+                    samples: 3,
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn test_file_name() {
+        assert_eq!(key(None).file_name(), "054c-09cc.toml");
+        assert_eq!(key(Some("a0:5a:5c:00:11:22")).file_name(), "054c-09cc-a0_5a_5c_00_11_22.toml");
+        assert_eq!(key(Some("../x")).to_string(), "054c:09cc (../x)");
+        assert_eq!(key(Some("../x")).file_name(), "054c-09cc-___x.toml");
+    }
+
+    #[test]
+    fn test_store_round_trip() {
+        let dir =
+            std::env::temp_dir().join(format!("blazeremap-calibration-{}", std::process::id()));
+        let store = CalibrationStore::new(&dir);
+        let pad = key(Some("a0:5a:5c:00:11:22"));
+        assert_eq!(store.load(&pad).unwrap(), None);
+
+        let mut calibration = Calibration::default();
+        calibration.set(AxisCalibration { axis: AxisCode::RightY, center: -300, deadzone: 0 });
+        store.save(&pad, &calibration).unwrap();
+        assert_eq!(store.load(&pad).unwrap(), Some(calibration.clone()));
+        // Another controller of the same model isn't affected
+        assert_eq!(store.load(&key(None)).unwrap(), None);
+
+        calibration.remove(AxisCode::RightY);
+        store.save(&pad, &calibration).unwrap();
+        assert_eq!(store.load(&pad).unwrap(), None);
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,183 @@
+// Composite sources: several devices read as one controller
+//
+// A flight stick and a throttle quadrant, or a pair of Joy-Cons, are separate
+// devices each reporting its own South or Left Y. Merged as they are, their
+// controls collide. Each device of a composite can rename its controls first,
+// e.g. the throttle's Left Y to Right Trigger, or drop the ones it shouldn't
+// contribute. Axes renamed across kinds are rescaled, so a stick axis becomes
+// a full trigger pull and back.
+
+use std::str::FromStr;
+
+use anyhow::{Result, bail};
+
+use crate::event::{AxisCode, ButtonCode, InputEvent};
+use crate::input::range::AxisRange;
+
+/// Controls of one device renamed, or dropped, before merging
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ControlMap {
+    // A None target drops the control
+    buttons: Vec<(ButtonCode, Option<ButtonCode>)>,
+    axes: Vec<(AxisCode, Option<AxisCode>)>,
+}
+
+impl ControlMap {
+    /// Whether every control passes through as it is
+    pub fn is_empty(&self) -> bool {
+        self.buttons.is_empty() && self.axes.is_empty()
+    }
+
+    /// Rename the control of `event`; false if it is dropped
+    pub fn apply(&self, event: &mut InputEvent) -> bool {
+        match event {
+            InputEvent::Button { code, .. } => {
+                match self.buttons.iter().find(|(from, _)| from == code) {
+                    Some((_, Some(to))) => *code = *to,
+                    Some((_, None)) => return false,
+                    None => {}
+                }
+            }
+            InputEvent::Axis { code, value, .. } => {
+                match self.axes.iter().find(|(from, _)| from == code) {
+                    Some((from, Some(to))) => {
+                        *value =
+                            AxisRange::canonical(*from).rescale(*value, AxisRange::canonical(*to));
+                        *code = *to;
+                    }
+                    Some((_, None)) => return false,
+                    None => {}
+                }
+            }
+            _ => {}
+        }
+        true
+    }
+}
+
+impl FromStr for ControlMap {
+    type Err = anyhow::Error;
+
+    /// Comma separated `FROM=TO` renames; a TO of `none` drops FROM
+    ///
+    /// Names that are both a button and an axis, such as LeftTrigger, rename
+    /// both.
+    fn from_str(text: &str) -> Result<Self> {
+        let mut map = ControlMap::default();
+        for rename in text.split(',').map(str::trim).filter(|rename| !rename.is_empty()) {
+            let Some((from, to)) = rename.split_once('=') else {
+                bail!("'{}' is not FROM=TO", rename);
+            };
+            let (from, to) = (from.trim(), to.trim());
+            let button = Some(ButtonCode::from(from)).filter(|code| *code != ButtonCode::Unknown);
+            let axis = Some(AxisCode::from(from)).filter(|code| *code != AxisCode::Unknown);
+            if button.is_none() && axis.is_none() {
+                bail!("'{}' is not a button or axis", from);
+            }
+            if to.eq_ignore_ascii_case("none") {
+                map.buttons.extend(button.map(|code| (code, None)));
+                map.axes.extend(axis.map(|code| (code, None)));
+                continue;
+            }
+            let to_button = Some(ButtonCode::from(to)).filter(|code| *code != ButtonCode::Unknown);
+            let to_axis = Some(AxisCode::from(to)).filter(|code| *code != AxisCode::Unknown);
+            let buttons = button.zip(to_button);
+            let axes = axis.zip(to_axis);
+            if buttons.is_none() && axes.is_none() {
+                bail!("'{}' and '{}' are not both buttons or both axes", from, to);
+            }
+            map.buttons.extend(buttons.map(|(from, to)| (from, Some(to))));
+            map.axes.extend(axes.map(|(from, to)| (from, Some(to))));
+        }
+        Ok(map)
+    }
+}
+
+/// One device of a composite controller: `PATH` or `PATH:FROM=TO,...`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Source {
+    pub path: String,
+    pub controls: ControlMap,
+}
+
+impl FromStr for Source {
+    type Err = anyhow::Error;
+
+    fn from_str(text: &str) -> Result<Self> {
+        // by-path device names have colons of their own
+        let (path, controls) = match text.rsplit_once(':') {
+            Some((path, controls)) if controls.contains('=') => (path, controls),
+            _ => (text, ""),
+        };
+        if path.is_empty() {
+            bail!("'{}' has no device path", text);
+        }
+        let controls = controls
+            .parse()
+            .map_err(|e: anyhow::Error| e.context(format!("Invalid controls for {}", path)))?;
+        Ok(Self { path: path.to_string(), controls })
+    }
+}
+
+/// The device paths of `sources`
+pub fn paths(sources: &[Source]) -> Vec<String> {
+    sources.iter().map(|source| source.path.clone()).collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_source() {
+        let source: Source =
+            "/dev/input/event5:LeftY=RightTrigger, South=Paddle1,Start=none".parse().unwrap();
+        assert_eq!(source.path, "/dev/input/event5");
+        assert_eq!(source.controls.axes, [(AxisCode::LeftY, Some(AxisCode::RightTrigger))]);
+        assert_eq!(
+            source.controls.buttons,
+            [(ButtonCode::South, Some(ButtonCode::Paddle1)), (ButtonCode::Start, None)]
+        );
+
+        let plain: Source =
+            "/dev/input/by-path/pci-0000:00:14.0-usb-0:1:1.0-event-joystick".parse().unwrap();
+        assert_eq!(plain.path, "/dev/input/by-path/pci-0000:00:14.0-usb-0:1:1.0-event-joystick");
+        assert!(plain.controls.is_empty());
+
+        // Both a button and an axis
+        let both: ControlMap = "LeftTrigger=RightTrigger".parse().unwrap();
+        assert_eq!((both.buttons.len(), both.axes.len()), (1, 1));
+    }
+
+    #[test]
+    fn test_parse_errors() {
+        let error = |text: &str| format!("{:#}", text.parse::<Source>().unwrap_err());
+        assert!(error("/dev/input/event5:South=East,West").contains("'West' is not FROM=TO"));
+        assert!(error("/dev/input/event5:Jump=South").contains("'Jump' is not a button or axis"));
+        assert!(
+            error("/dev/input/event5:South=LeftX").contains("are not both buttons or both axes")
+        );
+        assert!(error(":South=East").contains("has no device path"));
+    }
+
+    #[test]
+    fn test_apply() {
+        let map: ControlMap = "LeftY=RightTrigger,South=Paddle1,Start=none".parse().unwrap();
+
+        let mut throttle = InputEvent::axis_move(AxisCode::LeftY, 32767);
+        assert!(map.apply(&mut throttle));
+        assert!(matches!(
+            throttle,
+            InputEvent::Axis { code: AxisCode::RightTrigger, value: 1023, .. }
+        ));
+
+        let mut press = InputEvent::button_press(ButtonCode::South);
+        assert!(map.apply(&mut press));
+        assert!(matches!(press, InputEvent::Button { code: ButtonCode::Paddle1, .. }));
+
+        assert!(!map.apply(&mut InputEvent::button_press(ButtonCode::Start)));
+        let mut other = InputEvent::button_press(ButtonCode::East);
+        assert!(map.apply(&mut other));
+        assert!(matches!(other, InputEvent::Button { code: ButtonCode::East, .. }));
+    }
+}
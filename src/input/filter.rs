@@ -0,0 +1,187 @@
+// Narrowing detection to some controllers
+//
+// Machines with many input devices can narrow what `detect` lists and what
+// `run` picks when it detects its controller by itself:
+//
+//   vendor=054c             vendor ID in hex, or vendor:product
+//   name=wireless           part of the name, in any case
+//   path=/dev/input/event1* the device node, `*` matching anything
+//   type=dualshock4         the kind of controller
+//
+// Several conditions must all hold.
+
+use std::fmt;
+use std::str::FromStr;
+
+use anyhow::{Result, bail};
+
+use crate::input::{GamepadInfo, GamepadType};
+
+/// Conditions a controller must meet; the default lets all through
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct DeviceFilter {
+    pub vendor_id: Option<u16>,
+    pub product_id: Option<u16>,
+    pub name: Option<String>,
+    pub path: Option<String>,
+    pub gamepad_type: Option<GamepadType>,
+}
+
+impl DeviceFilter {
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+
+    /// Set the vendor, or vendor and product, from `054c` or `054c:09cc`
+    pub fn set_vendor(&mut self, text: &str) -> Result<()> {
+        let hex = |id: &str| match u16::from_str_radix(id, 16) {
+            Ok(id) => Ok(id),
+            Err(_) => bail!("'{}' is not a hex vendor or product ID, like 054c", id),
+        };
+        match text.split_once(':') {
+            Some((vendor, product)) => {
+                self.vendor_id = Some(hex(vendor)?);
+                self.product_id = Some(hex(product)?);
+            }
+            None => self.vendor_id = Some(hex(text)?),
+        }
+        Ok(())
+    }
+
+    pub fn matches(&self, info: &GamepadInfo) -> bool {
+        self.vendor_id.is_none_or(|vendor| vendor == info.vendor_id)
+            && self.product_id.is_none_or(|product| product == info.product_id)
+            && self
+                .name
+                .as_ref()
+                .is_none_or(|name| info.name.to_lowercase().contains(&name.to_lowercase()))
+            && self.path.as_ref().is_none_or(|path| wildcard(path, &info.path))
+            && self.gamepad_type.is_none_or(|gamepad_type| gamepad_type == info.gamepad_type)
+    }
+
+    /// Keep only the controllers of `gamepads` that match
+    pub fn retain(&self, gamepads: &mut Vec<GamepadInfo>) {
+        gamepads.retain(|info| self.matches(info));
+    }
+}
+
+impl FromStr for DeviceFilter {
+    type Err = anyhow::Error;
+
+    /// Comma separated `KEY=VALUE` conditions, keys as at the top of this file
+    fn from_str(text: &str) -> Result<Self> {
+        let mut filter = Self::default();
+        for condition in text.split(',').map(str::trim).filter(|c| !c.is_empty()) {
+            let Some((key, value)) = condition.split_once('=') else {
+                bail!("'{}' is not KEY=VALUE", condition);
+            };
+            let value = value.trim();
+            match key.trim() {
+                "vendor" => filter.set_vendor(value)?,
+                "name" => filter.name = Some(value.to_string()),
+                "path" => filter.path = Some(value.to_string()),
+                "type" => filter.gamepad_type = Some(value.parse()?),
+                key => bail!("Unknown condition '{}'; expected vendor, name, path or type", key),
+            }
+        }
+        Ok(filter)
+    }
+}
+
+impl fmt::Display for DeviceFilter {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let mut conditions = Vec::new();
+        match (self.vendor_id, self.product_id) {
+            (Some(vendor), Some(product)) => {
+                conditions.push(format!("vendor={:04x}:{:04x}", vendor, product))
+            }
+            (Some(vendor), None) => conditions.push(format!("vendor={:04x}", vendor)),
+            _ => {}
+        }
+        conditions.extend(self.name.as_ref().map(|name| format!("name={}", name)));
+        conditions.extend(self.path.as_ref().map(|path| format!("path={}", path)));
+        conditions.extend(self.gamepad_type.map(|kind| format!("type={}", kind.id())));
+        write!(f, "{}", conditions.join(","))
+    }
+}
+
+/// Whether `text` is `pattern`, where `*` stands for any run of characters
+fn wildcard(pattern: &str, text: &str) -> bool {
+    match pattern.split_once('*') {
+        None => pattern == text,
+        Some((head, rest)) => {
+            let Some(text) = text.strip_prefix(head) else {
+                return false;
+            };
+            (0..=text.len())
+                .filter(|&start| text.is_char_boundary(start))
+                .any(|start| wildcard(rest, &text[start..]))
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn info(path: &str, name: &str, gamepad_type: GamepadType, vendor_id: u16) -> GamepadInfo {
+        GamepadInfo {
+            path: path.to_string(),
+            name: name.to_string(),
+            gamepad_type,
+            vendor_id,
+            vendor_name: String::new(),
+            product_id: 0x09cc,
+            uniq: None,
+            phys: None,
+            capabilities: Vec::new(),
+        }
+    }
+
+    #[test]
+    fn test_filter_narrows_controllers() {
+        let mut gamepads = vec![
+            info("/dev/input/event3", "Xbox Wireless Controller", GamepadType::XboxOne, 0x045e),
+            info("/dev/input/event7", "Wireless Controller", GamepadType::DualShock4, 0x054c),
+            info("/dev/input/event12", "Wireless Controller", GamepadType::DualShock4, 0x054c),
+        ];
+
+        let filter: DeviceFilter = "vendor=054c, type=dualshock4".parse().unwrap();
+        assert_eq!(filter.to_string(), "vendor=054c,type=dualshock4");
+        let filter_paths = |filter: &DeviceFilter| {
+            gamepads
+                .iter()
+                .filter(|info| filter.matches(info))
+                .map(|info| &info.path)
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(filter_paths(&filter), ["/dev/input/event7", "/dev/input/event12"]);
+        assert_eq!(filter_paths(&"name=XBOX".parse().unwrap()), ["/dev/input/event3"]);
+        assert_eq!(
+            filter_paths(&"path=/dev/input/event1*".parse().unwrap()),
+            ["/dev/input/event12"]
+        );
+        assert_eq!(filter_paths(&"vendor=054c:09cd".parse().unwrap()), Vec::<&String>::new());
+
+        DeviceFilter::default().retain(&mut gamepads);
+        assert_eq!(gamepads.len(), 3);
+    }
+
+    #[test]
+    fn test_parse_errors() {
+        assert!("vendor=sony".parse::<DeviceFilter>().is_err());
+        assert!("type=gamecube".parse::<DeviceFilter>().is_err());
+        assert!("colour=red".parse::<DeviceFilter>().is_err());
+        assert!("dualshock4".parse::<DeviceFilter>().is_err());
+        assert!("".parse::<DeviceFilter>().unwrap().is_empty());
+    }
+
+    #[test]
+    fn test_wildcard() {
+        assert!(wildcard("/dev/input/event*", "/dev/input/event3"));
+        assert!(wildcard("*event3", "/dev/input/event3"));
+        assert!(wildcard("*", ""));
+        assert!(!wildcard("/dev/input/event1*", "/dev/input/event3"));
+        assert!(!wildcard("/dev/input/event3", "/dev/input/event31"));
+    }
+}
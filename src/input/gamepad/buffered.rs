@@ -0,0 +1,194 @@
+// Gamepad read on a dedicated thread, handed over through a ring buffer
+//
+// Keeps the blocking device read on its own thread so the kernel queue is
+// drained at a steady pace regardless of how long mapping/emitting takes.
+
+use super::{Gamepad, GamepadInfo};
+use crate::event::{InputEvent, RingCloser, RingConsumer, RingCounters, ring};
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+
+/// Default ring size; at 1kHz polling this is a full second of backlog
+pub const DEFAULT_RING_CAPACITY: usize = 1024;
+
+pub struct BufferedGamepad {
+    info: GamepadInfo,
+    events: RingConsumer<InputEvent>,
+    // Read error that stopped the reader thread, reported after the backlog
+    error: Arc<Mutex<Option<anyhow::Error>>>,
+}
+
+impl BufferedGamepad {
+    /// Move `inner` to a reader thread feeding a ring of `capacity` events
+    ///
+    /// The thread ends when the device disconnects or fails, or after its
+    /// next event once the ring was closed (so the device is released
+    /// lazily). It is never joined.
+    pub fn spawn(inner: Box<dyn Gamepad>, capacity: usize) -> anyhow::Result<Self> {
+        Self::spawn_with(inner, capacity, || {})
+    }
+
+    /// Like `spawn`, running `setup` on the reader thread before the first read
+    ///
+    /// Used for per-thread tuning such as scheduling priority.
+    pub fn spawn_with<F>(
+        mut inner: Box<dyn Gamepad>,
+        capacity: usize,
+        setup: F,
+    ) -> anyhow::Result<Self>
+    where
+        F: FnOnce() + Send + 'static,
+    {
+        let info = inner.get_info();
+        let (mut producer, events) = ring(capacity);
+        let error = Arc::new(Mutex::new(None));
+        let thread_error = Arc::clone(&error);
+
+        std::thread::Builder::new().name("blazeremap-reader".to_string()).spawn(move || {
+            setup();
+            // Warned once per spell of drops, so a flood doesn't flood the log too
+            let mut dropping = false;
+            loop {
+                if producer.is_closed() {
+                    break;
+                }
+                match inner.read_event() {
+                    Ok(Some(event)) => {
+                        let pushed = producer.push(event);
+                        if !pushed && !dropping {
+                            tracing::warn!(
+                                "Event ring full, dropped {} and any more until it drains",
+                                event
+                            );
+                        }
+                        dropping = !pushed;
+                    }
+                    Ok(None) => break,
+                    Err(e) => {
+                        *thread_error.lock().unwrap() = Some(e);
+                        break;
+                    }
+                }
+            }
+            // Dropping the producer tells the consumer no more events are coming
+        })?;
+
+        Ok(Self { info, events, error })
+    }
+
+    /// Stops delivery: `read_event` returns None once the backlog is drained
+    pub fn closer(&self) -> RingCloser {
+        self.events.closer()
+    }
+
+    /// What reading returns once the reader thread has stopped
+    fn finished(&self) -> anyhow::Result<Option<InputEvent>> {
+        match self.error.lock().unwrap().take() {
+            Some(e) => Err(e),
+            None => Ok(None),
+        }
+    }
+
+    /// Traffic and drop counters of the underlying ring
+    pub fn counters(&self) -> RingCounters {
+        self.events.counters()
+    }
+}
+
+impl Gamepad for BufferedGamepad {
+    fn get_info(&self) -> GamepadInfo {
+        self.info.clone()
+    }
+
+    fn read_event(&mut self) -> anyhow::Result<Option<InputEvent>> {
+        match self.events.pop_blocking() {
+            Some(event) => Ok(Some(event)),
+            None => self.finished(),
+        }
+    }
+
+    fn read_event_until(&mut self, deadline: Instant) -> anyhow::Result<Option<InputEvent>> {
+        match self.events.pop_blocking_until(deadline) {
+            Some(event) => Ok(Some(event)),
+            None if !self.events.is_drained() => Ok(Some(InputEvent::sync())),
+            None => self.finished(),
+        }
+    }
+
+    fn close(self) -> anyhow::Result<()> {
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::ButtonCode;
+    use crate::input::gamepad::{GamepadType, MockGamepad};
+
+    fn mock_with(mut events: Vec<anyhow::Result<Option<InputEvent>>>) -> Box<dyn Gamepad> {
+        events.reverse();
+        let mut gamepad = MockGamepad::new();
+        gamepad.expect_get_info().returning(test_info);
+        gamepad.expect_read_event().returning(move || events.pop().unwrap_or(Ok(None)));
+        Box::new(gamepad)
+    }
+
+    fn test_info() -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Test Gamepad".to_string(),
+            gamepad_type: GamepadType::XboxOne,
+            vendor_id: 0,
+            vendor_name: String::new(),
+            product_id: 0,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
+    #[test]
+    fn test_events_pass_through_until_disconnect() {
+        let inner = mock_with(vec![
+            Ok(Some(InputEvent::button_press(ButtonCode::South))),
+            Ok(Some(InputEvent::button_release(ButtonCode::South))),
+            Ok(None),
+        ]);
+        let mut gamepad = BufferedGamepad::spawn(inner, 8).unwrap();
+
+        assert_eq!(gamepad.get_info().name, "Test Gamepad");
+        assert!(gamepad.read_event().unwrap().unwrap().is_button_pressed());
+        assert!(gamepad.read_event().unwrap().unwrap().is_button_released());
+        assert!(gamepad.read_event().unwrap().is_none());
+        assert_eq!(gamepad.counters().snapshot().pushed, 2);
+    }
+
+    #[test]
+    fn test_read_error_is_reported_after_backlog() {
+        let inner = mock_with(vec![
+            Ok(Some(InputEvent::button_press(ButtonCode::South))),
+            Err(anyhow::anyhow!("device on fire")),
+        ]);
+        let mut gamepad = BufferedGamepad::spawn(inner, 8).unwrap();
+
+        assert!(gamepad.read_event().unwrap().is_some());
+        assert_eq!(gamepad.read_event().unwrap_err().to_string(), "device on fire");
+    }
+
+    #[test]
+    fn test_read_until_returns_sync_while_idle() {
+        let mut inner = MockGamepad::new();
+        inner.expect_get_info().returning(test_info);
+        inner.expect_read_event().returning(|| {
+            std::thread::sleep(std::time::Duration::from_millis(100));
+            Ok(None)
+        });
+        let mut gamepad = BufferedGamepad::spawn(Box::new(inner), 8).unwrap();
+
+        let deadline = Instant::now() + std::time::Duration::from_millis(10);
+        let event = gamepad.read_event_until(deadline).unwrap().unwrap();
+        assert!(matches!(event, InputEvent::Sync { .. }));
+        assert!(gamepad.read_event().unwrap().is_none());
+    }
+}
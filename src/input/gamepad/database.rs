@@ -12,6 +12,10 @@ struct GamepadSignature {
 
 /// Known gamepad signatures
 const KNOWN_GAMEPADS: &[GamepadSignature] = &[
+    // Xbox 360
+    GamepadSignature { vendor_id: 0x045e, product_id: 0x028e, gamepad_type: GamepadType::Xbox360 }, // Xbox 360 Controller (wired)
+    GamepadSignature { vendor_id: 0x045e, product_id: 0x028f, gamepad_type: GamepadType::Xbox360 }, // Xbox 360 Wireless Controller (Play & Charge cable)
+    GamepadSignature { vendor_id: 0x045e, product_id: 0x0719, gamepad_type: GamepadType::Xbox360 }, // Xbox 360 Wireless Receiver
     // Xbox One
     GamepadSignature { vendor_id: 0x045e, product_id: 0x02dd, gamepad_type: GamepadType::XboxOne }, // Xbox One Controller (2013, Firmware 2015)
     GamepadSignature { vendor_id: 0x045e, product_id: 0x02ea, gamepad_type: GamepadType::XboxOne }, // Xbox One S Controller (wireless via dongle)
@@ -54,6 +58,12 @@ const KNOWN_GAMEPADS: &[GamepadSignature] = &[
         product_id: 0x0ce6,
         gamepad_type: GamepadType::DualSense,
     }, // DualSense (PS5)
+    // Valve
+    GamepadSignature {
+        vendor_id: 0x28de,
+        product_id: 0x1205,
+        gamepad_type: GamepadType::SteamDeck,
+    }, // Steam Deck built-in controls
 ];
 
 /// Identify gamepad type based on vendor/product ID
@@ -85,6 +95,11 @@ pub fn get_known_vendor_database() -> HashMap<u16, &'static str> {
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_identify_xbox_360() {
+        assert_eq!(identify_gamepad(0x045e, 0x028e), GamepadType::Xbox360);
+    }
+
     #[test]
     fn test_identify_xbox_one() {
         assert_eq!(identify_gamepad(0x045e, 0x02fd), GamepadType::XboxOne);
@@ -95,6 +110,11 @@ mod tests {
         assert_eq!(identify_gamepad(0x054c, 0x09cc), GamepadType::DualShock4);
     }
 
+    #[test]
+    fn test_identify_steam_deck() {
+        assert_eq!(identify_gamepad(0x28de, 0x1205), GamepadType::SteamDeck);
+    }
+
     #[test]
     fn test_identify_unknown() {
         assert_eq!(identify_gamepad(0xFFFF, 0xFFFF), GamepadType::Generic);
@@ -1,5 +1,6 @@
 // Gamepad information
 use super::types::{GamepadCapability, GamepadType};
+use crate::event::{AxisCode, ButtonCode};
 
 /// Information about a detected gamepad
 #[derive(Debug, Clone)]
@@ -10,5 +11,56 @@ pub struct GamepadInfo {
     pub vendor_id: u16,
     pub vendor_name: String,
     pub product_id: u16,
+    /// What the driver reports as unique to this controller, such as its
+    /// Bluetooth address; None when it reports nothing
+    pub uniq: Option<String>,
+    /// Where the controller is attached, such as its USB port; None when the
+    /// driver doesn't say
+    pub phys: Option<String>,
     pub capabilities: Vec<GamepadCapability>,
 }
+
+impl GamepadInfo {
+    /// Buttons the controller reports, judging by its capabilities
+    pub fn buttons(&self) -> Vec<ButtonCode> {
+        use ButtonCode::*;
+
+        let mut buttons = vec![
+            South,
+            East,
+            North,
+            West,
+            LeftShoulder,
+            RightShoulder,
+            LeftTrigger,
+            RightTrigger,
+            Select,
+            Start,
+            Mode,
+            LeftStick,
+            RightStick,
+        ];
+        if self.has(GamepadCapability::ElitePaddles) || self.has(GamepadCapability::BackButtons) {
+            buttons.extend([Paddle1, Paddle2, Paddle3, Paddle4]);
+        }
+        if self.has(GamepadCapability::Trackpads) {
+            buttons.extend([LeftPad, RightPad]);
+        }
+        buttons
+    }
+
+    /// Axes the controller reports, judging by its capabilities
+    pub fn axes(&self) -> Vec<AxisCode> {
+        use AxisCode::*;
+
+        let mut axes = vec![LeftX, LeftY, RightX, RightY, LeftTrigger, RightTrigger, DPadX, DPadY];
+        if self.has(GamepadCapability::Trackpads) {
+            axes.extend([LeftPadX, LeftPadY, RightPadX, RightPadY]);
+        }
+        axes
+    }
+
+    fn has(&self, capability: GamepadCapability) -> bool {
+        self.capabilities.contains(&capability)
+    }
+}
@@ -1,16 +1,19 @@
 // Gamepad module
 
+pub mod buffered;
 pub mod database;
 pub mod info;
 pub mod types;
 
 // Re-export commonly used types
+pub use buffered::BufferedGamepad;
 pub use database::{get_known_vendor_database, identify_gamepad};
 pub use info::GamepadInfo;
 pub use types::{GamepadCapability, GamepadType, capabilities_to_strings};
 
+// Send so readers can live on their own thread (see `BufferedGamepad`)
 #[cfg_attr(test, mockall::automock)]
-pub trait Gamepad {
+pub trait Gamepad: Send {
     /// Get detailed info about the gamepad
     fn get_info(&self) -> GamepadInfo;
 
@@ -18,6 +21,18 @@ pub trait Gamepad {
     /// Returns None when device is disconnected
     fn read_event(&mut self) -> anyhow::Result<Option<crate::event::InputEvent>>;
 
+    /// Like `read_event`, but returns a `Sync` once `deadline` passes
+    ///
+    /// Lets the mapper act on time while the controller is idle. Readers
+    /// that can't time out wait for the next event.
+    fn read_event_until(
+        &mut self,
+        deadline: std::time::Instant,
+    ) -> anyhow::Result<Option<crate::event::InputEvent>> {
+        let _ = deadline;
+        self.read_event()
+    }
+
     /// Close releases the device
     fn close(self) -> anyhow::Result<()>;
 }
@@ -1,38 +1,91 @@
 // Gamepad type definitions
 
 use std::fmt;
+use std::str::FromStr;
 
 /// Represents different gamepad types we can detect
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
 pub enum GamepadType {
     Unknown,
+    Xbox360,
     XboxOne,
     XboxSeries,
     XboxElite,
     DualShock4,
     DualSense,
+    SteamDeck,
     Generic,
 }
 
 impl fmt::Display for GamepadType {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
         match self {
+            Self::Xbox360 => write!(f, "Xbox 360"),
             Self::XboxOne => write!(f, "Xbox One"),
             Self::XboxSeries => write!(f, "Xbox Series X/S"),
             Self::XboxElite => write!(f, "Xbox Elite"),
             Self::DualShock4 => write!(f, "DualShock 4"),
             Self::DualSense => write!(f, "DualSense"),
+            Self::SteamDeck => write!(f, "Steam Deck"),
             Self::Generic => write!(f, "Generic"),
             Self::Unknown => write!(f, "Unknown"),
         }
     }
 }
 
+impl GamepadType {
+    pub const ALL: [Self; 9] = [
+        Self::Xbox360,
+        Self::XboxOne,
+        Self::XboxSeries,
+        Self::XboxElite,
+        Self::DualShock4,
+        Self::DualSense,
+        Self::SteamDeck,
+        Self::Generic,
+        Self::Unknown,
+    ];
+
+    /// Name on the command line, e.g. `dualshock4`
+    pub fn id(self) -> &'static str {
+        match self {
+            Self::Xbox360 => "xbox-360",
+            Self::XboxOne => "xbox-one",
+            Self::XboxSeries => "xbox-series",
+            Self::XboxElite => "xbox-elite",
+            Self::DualShock4 => "dualshock4",
+            Self::DualSense => "dualsense",
+            Self::SteamDeck => "steam-deck",
+            Self::Generic => "generic",
+            Self::Unknown => "unknown",
+        }
+    }
+}
+
+impl FromStr for GamepadType {
+    type Err = anyhow::Error;
+
+    fn from_str(text: &str) -> anyhow::Result<Self> {
+        let text = text.to_ascii_lowercase();
+        Self::ALL.into_iter().find(|kind| kind.id() == text).ok_or_else(|| {
+            let ids: Vec<_> = Self::ALL.iter().map(|kind| kind.id()).collect();
+            anyhow::anyhow!(
+                "Unknown controller type '{}'; expected one of {}",
+                text,
+                ids.join(", ")
+            )
+        })
+    }
+}
+
 /// Gamepad capabilities that can be detected
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
 pub enum GamepadCapability {
     ForceFeedback,
     ElitePaddles,
+    BackButtons,
+    Trackpads,
+    Gyro,
 }
 
 impl fmt::Display for GamepadCapability {
@@ -40,6 +93,9 @@ impl fmt::Display for GamepadCapability {
         match self {
             Self::ForceFeedback => write!(f, "Force Feedback"),
             Self::ElitePaddles => write!(f, "Elite Paddles"),
+            Self::BackButtons => write!(f, "Back Buttons"),
+            Self::Trackpads => write!(f, "Trackpads"),
+            Self::Gyro => write!(f, "Gyro"),
         }
     }
 }
@@ -57,6 +113,16 @@ mod tests {
     fn test_gamepad_type_display() {
         assert_eq!(GamepadType::XboxOne.to_string(), "Xbox One");
         assert_eq!(GamepadType::DualShock4.to_string(), "DualShock 4");
+        assert_eq!(GamepadType::SteamDeck.to_string(), "Steam Deck");
+    }
+
+    #[test]
+    fn test_gamepad_type_ids() {
+        for kind in GamepadType::ALL {
+            assert_eq!(kind.id().parse::<GamepadType>().unwrap(), kind);
+        }
+        assert_eq!("DualSense".parse::<GamepadType>().unwrap(), GamepadType::DualSense);
+        assert!("gamecube".parse::<GamepadType>().is_err());
     }
 
     #[test]
@@ -0,0 +1,12 @@
+use anyhow::Result;
+use std::time::Duration;
+
+use crate::event::KeyboardCode;
+
+/// Domain trait: keys pressed on the user's physical keyboards
+pub trait KeyListener {
+    /// Wait up to `timeout` for a key press; None if none came
+    ///
+    /// Releases and auto-repeat are skipped.
+    fn next_key(&mut self, timeout: Duration) -> Result<Option<KeyboardCode>>;
+}
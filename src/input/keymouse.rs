@@ -0,0 +1,391 @@
+// Keyboard and mouse as a controller
+//
+// Reverse remapping: keys and mouse buttons press gamepad buttons or push its
+// axes, and moving the mouse deflects a stick, so keyboard players can play
+// games that only take a controller. A layout says which does what; without
+// one, the usual WASD layout is used. A layout file looks like:
+//
+//   mouse_stick = "Right"       # or "Left", or "none"
+//   mouse_sensitivity = 400     # stick units per count of movement
+//   release_key = "Scroll Lock" # gives the keyboard and mouse back
+//
+//   [bindings]
+//   W = "LeftY-"                # push an axis to its end
+//   "Left Shift" = "LeftStick"  # key names as in profiles
+//   Space = "South"             # press a button
+//   MouseLeft = "RightTrigger"  # a trigger alone is pulled all the way
+//
+// Keys pushing the same axis add up, so W with S held is centered again.
+// The stick the mouse drives returns to center once the mouse stops.
+
+use std::collections::BTreeMap;
+use std::path::Path;
+use std::str::FromStr;
+
+use anyhow::{Context, Result, bail};
+use serde::Deserialize;
+
+use crate::event::{AxisCode, ButtonCode, InputEvent, KeyboardCode};
+use crate::input::range::AxisRange;
+
+/// Buttons of a mouse
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum MouseButton {
+    Left,
+    Right,
+    Middle,
+    Side,
+    Extra,
+}
+
+/// A key or mouse button a layout binds
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum KeyMouseInput {
+    Key(KeyboardCode),
+    Mouse(MouseButton),
+}
+
+impl FromStr for KeyMouseInput {
+    type Err = anyhow::Error;
+
+    fn from_str(name: &str) -> Result<Self> {
+        let button = match name {
+            "MouseLeft" => MouseButton::Left,
+            "MouseRight" => MouseButton::Right,
+            "MouseMiddle" => MouseButton::Middle,
+            "MouseSide" => MouseButton::Side,
+            "MouseExtra" => MouseButton::Extra,
+            name => match KeyboardCode::from(name) {
+                KeyboardCode::Unknown | KeyboardCode::Reserved => {
+                    bail!("'{}' is not a key or mouse button", name)
+                }
+                code => return Ok(Self::Key(code)),
+            },
+        };
+        Ok(Self::Mouse(button))
+    }
+}
+
+/// What a bound key does on the controller
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Control {
+    Button(ButtonCode),
+    /// Push the axis by this much while held
+    Axis(AxisCode, i32),
+}
+
+impl FromStr for Control {
+    type Err = anyhow::Error;
+
+    /// A button, an axis and a direction (`LeftY-`, `DPadX+`), or a trigger
+    fn from_str(name: &str) -> Result<Self> {
+        let (axis, sign) = match name.strip_suffix(['-', '+']) {
+            Some(axis) => (axis, name.ends_with('+')),
+            None => (name, true),
+        };
+        let code = AxisCode::from(axis);
+        let range = AxisRange::canonical(code);
+        let trigger = matches!(code, AxisCode::LeftTrigger | AxisCode::RightTrigger);
+        if code != AxisCode::Unknown && (trigger || axis != name) {
+            // Pushes both ways are the same size, so opposite keys cancel out
+            return Ok(Self::Axis(code, if sign { range.max } else { -range.max }));
+        }
+        match ButtonCode::from(name) {
+            ButtonCode::Unknown => bail!("'{}' is not a button, or an axis with + or -", name),
+            code => Ok(Self::Button(code)),
+        }
+    }
+}
+
+/// Which key does what on the controller
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct KeyMouseLayout {
+    pub bindings: Vec<(KeyMouseInput, Control)>,
+    /// X and Y axes of the stick the mouse drives
+    pub mouse_stick: Option<(AxisCode, AxisCode)>,
+    /// Stick units a count of mouse movement deflects it by
+    pub mouse_sensitivity: i32,
+    /// Stops reading, so grabbed devices can't lock the user out
+    pub release_key: Option<KeyboardCode>,
+}
+
+#[derive(Deserialize)]
+#[serde(deny_unknown_fields)]
+struct LayoutFile {
+    #[serde(default = "default_mouse_stick")]
+    mouse_stick: String,
+    #[serde(default = "default_mouse_sensitivity")]
+    mouse_sensitivity: i32,
+    #[serde(default = "default_release_key")]
+    release_key: String,
+    #[serde(default)]
+    bindings: BTreeMap<String, String>,
+}
+
+fn default_mouse_stick() -> String {
+    "Right".to_string()
+}
+
+fn default_mouse_sensitivity() -> i32 {
+    400
+}
+
+fn default_release_key() -> String {
+    "Scroll Lock".to_string()
+}
+
+impl Default for KeyMouseLayout {
+    /// WASD moves, the mouse looks around and its buttons pull the triggers
+    fn default() -> Self {
+        let bindings = [
+            ("W", "LeftY-"),
+            ("S", "LeftY+"),
+            ("A", "LeftX-"),
+            ("D", "LeftX+"),
+            ("Space", "South"),
+            ("Left Control", "East"),
+            ("R", "West"),
+            ("F", "North"),
+            ("Q", "LeftShoulder"),
+            ("E", "RightShoulder"),
+            ("Left Shift", "LeftStick"),
+            ("V", "RightStick"),
+            ("Tab", "Select"),
+            ("Escape", "Start"),
+            ("Up", "DPadY-"),
+            ("Down", "DPadY+"),
+            ("Left", "DPadX-"),
+            ("Right", "DPadX+"),
+            ("MouseLeft", "RightTrigger"),
+            ("MouseRight", "LeftTrigger"),
+            ("MouseMiddle", "RightStick"),
+        ];
+        Self {
+            bindings: bindings
+                .into_iter()
+                .map(|(input, control)| (input.parse().unwrap(), control.parse().unwrap()))
+                .collect(),
+            mouse_stick: Some((AxisCode::RightX, AxisCode::RightY)),
+            mouse_sensitivity: default_mouse_sensitivity(),
+            release_key: Some(KeyboardCode::ScrollLock),
+        }
+    }
+}
+
+impl KeyMouseLayout {
+    pub fn load(path: &Path) -> Result<Self> {
+        let text = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        Self::parse(&text).with_context(|| format!("Invalid layout {}", path.display()))
+    }
+
+    pub fn parse(text: &str) -> Result<Self> {
+        let file: LayoutFile = toml::from_str(text)?;
+        let mouse_stick = match file.mouse_stick.as_str() {
+            "Left" => Some((AxisCode::LeftX, AxisCode::LeftY)),
+            "Right" => Some((AxisCode::RightX, AxisCode::RightY)),
+            "none" => None,
+            other => bail!("mouse_stick '{}' is not Left, Right or none", other),
+        };
+        if file.mouse_sensitivity <= 0 {
+            bail!("mouse_sensitivity must be above 0");
+        }
+        let release_key = match file.release_key.as_str() {
+            "none" => None,
+            name => match name.parse()? {
+                KeyMouseInput::Key(code) => Some(code),
+                KeyMouseInput::Mouse(_) => bail!("release_key must be a key"),
+            },
+        };
+        let mut bindings = Vec::new();
+        for (name, control) in &file.bindings {
+            let input = name.parse()?;
+            if release_key.is_some_and(|code| input == KeyMouseInput::Key(code)) {
+                bail!("{} is the release key", name);
+            }
+            bindings.push((input, control.parse()?));
+        }
+        Ok(Self { bindings, mouse_stick, mouse_sensitivity: file.mouse_sensitivity, release_key })
+    }
+}
+
+/// Turns key presses and mouse movement into controller events
+#[derive(Debug, Clone)]
+pub struct KeyMouseState {
+    layout: KeyMouseLayout,
+    held: Vec<KeyMouseInput>,
+    // Last value sent for each axis
+    axes: [i32; AxisCode::ALL.len()],
+}
+
+impl KeyMouseState {
+    pub fn new(layout: KeyMouseLayout) -> Self {
+        Self { layout, held: Vec::new(), axes: [0; AxisCode::ALL.len()] }
+    }
+
+    /// Send `value` for `code` unless it is already there
+    fn set_axis(&mut self, code: AxisCode, value: i32, out: &mut Vec<InputEvent>) {
+        let value = value.clamp(AxisRange::canonical(code).min, AxisRange::canonical(code).max);
+        if self.axes[code.index()] != value {
+            self.axes[code.index()] = value;
+            out.push(InputEvent::axis_move(code, value));
+        }
+    }
+
+    /// A key or mouse button went down or up; auto-repeat is skipped
+    pub fn press(&mut self, input: KeyMouseInput, pressed: bool, out: &mut Vec<InputEvent>) {
+        let was_held = self.held.contains(&input);
+        if pressed == was_held {
+            return;
+        }
+        if pressed {
+            self.held.push(input);
+        } else {
+            self.held.retain(|held| *held != input);
+        }
+        let controls: Vec<_> = self
+            .layout
+            .bindings
+            .iter()
+            .filter(|(bound, _)| *bound == input)
+            .map(|(_, control)| *control)
+            .collect();
+        for control in controls {
+            match control {
+                Control::Button(code) => out.push(match pressed {
+                    true => InputEvent::button_press(code),
+                    false => InputEvent::button_release(code),
+                }),
+                Control::Axis(code, _) => {
+                    let value = self
+                        .layout
+                        .bindings
+                        .iter()
+                        .filter(|(bound, _)| self.held.contains(bound))
+                        .filter_map(|(_, control)| match control {
+                            Control::Axis(axis, push) if *axis == code => Some(*push),
+                            _ => None,
+                        })
+                        .sum();
+                    self.set_axis(code, value, out);
+                }
+            }
+        }
+    }
+
+    /// The mouse moved by `dx`, `dy` counts since the last report
+    pub fn mouse_motion(&mut self, dx: i32, dy: i32, out: &mut Vec<InputEvent>) {
+        let Some((x, y)) = self.layout.mouse_stick else {
+            return;
+        };
+        let sensitivity = self.layout.mouse_sensitivity;
+        if dx != 0 {
+            self.set_axis(x, dx.saturating_mul(sensitivity), out);
+        }
+        if dy != 0 {
+            self.set_axis(y, dy.saturating_mul(sensitivity), out);
+        }
+    }
+
+    /// The mouse stopped; its stick goes back to center
+    pub fn mouse_rest(&mut self, out: &mut Vec<InputEvent>) {
+        if let Some((x, y)) = self.layout.mouse_stick {
+            self.set_axis(x, 0, out);
+            self.set_axis(y, 0, out);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn key(name: &str) -> KeyMouseInput {
+        name.parse().unwrap()
+    }
+
+    #[test]
+    fn test_parse_controls() {
+        assert_eq!("LeftY-".parse::<Control>().unwrap(), Control::Axis(AxisCode::LeftY, -32767));
+        assert_eq!("DPadX+".parse::<Control>().unwrap(), Control::Axis(AxisCode::DPadX, 1));
+        assert_eq!(
+            "RightTrigger".parse::<Control>().unwrap(),
+            Control::Axis(AxisCode::RightTrigger, 1023)
+        );
+        assert_eq!("South".parse::<Control>().unwrap(), Control::Button(ButtonCode::South));
+        assert!("LeftY".parse::<Control>().is_err());
+        assert!("Jump".parse::<Control>().is_err());
+
+        assert_eq!(key("MouseLeft"), KeyMouseInput::Mouse(MouseButton::Left));
+        assert_eq!(key("space"), KeyMouseInput::Key(KeyboardCode::Space));
+        assert!("Nothing".parse::<KeyMouseInput>().is_err());
+    }
+
+    #[test]
+    fn test_parse_layout() {
+        let layout = KeyMouseLayout::parse(
+            "mouse_stick = \"Left\"\nmouse_sensitivity = 100\n\n[bindings]\nJ = \"South\"\n",
+        )
+        .unwrap();
+        assert_eq!(layout.mouse_stick, Some((AxisCode::LeftX, AxisCode::LeftY)));
+        assert_eq!(layout.bindings, [(key("J"), Control::Button(ButtonCode::South))]);
+
+        assert!(KeyMouseLayout::parse("mouse_stick = \"Middle\"").is_err());
+        assert!(KeyMouseLayout::parse("[bindings]\nJ = \"Jump\"").is_err());
+        assert!(KeyMouseLayout::parse("sensitivity = 3").is_err());
+        assert!(KeyMouseLayout::parse("[bindings]\n\"Scroll Lock\" = \"South\"").is_err());
+        let layout = KeyMouseLayout::parse("release_key = \"Pause\"").unwrap();
+        assert_eq!(layout.release_key, Some(KeyboardCode::Pause));
+        assert_eq!(layout.mouse_stick, Some((AxisCode::RightX, AxisCode::RightY)));
+    }
+
+    #[test]
+    fn test_keys_push_axes_and_press_buttons() {
+        let mut state = KeyMouseState::new(KeyMouseLayout::default());
+        let mut out = Vec::new();
+
+        state.press(key("W"), true, &mut out);
+        state.press(key("W"), true, &mut out);
+        state.press(key("S"), true, &mut out);
+        state.press(key("Space"), true, &mut out);
+        state.press(key("W"), false, &mut out);
+        let axes: Vec<_> = out
+            .iter()
+            .filter_map(|event| match event {
+                InputEvent::Axis { code: AxisCode::LeftY, value, .. } => Some(*value),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(axes, [-32767, 0, 32767]);
+        assert!(out.iter().any(|event| matches!(
+            event,
+            InputEvent::Button { code: ButtonCode::South, pressed: true, .. }
+        )));
+    }
+
+    #[test]
+    fn test_mouse_drives_a_stick() {
+        let mut state = KeyMouseState::new(KeyMouseLayout::default());
+        let mut out = Vec::new();
+
+        state.mouse_motion(3, 0, &mut out);
+        state.mouse_motion(0, -200, &mut out);
+        state.mouse_rest(&mut out);
+        let moves: Vec<_> = out
+            .iter()
+            .map(|event| match event {
+                InputEvent::Axis { code, value, .. } => (*code, *value),
+                _ => unreachable!(),
+            })
+            .collect();
+        assert_eq!(
+            moves,
+            [
+                (AxisCode::RightX, 1200),
+                (AxisCode::RightY, -32768),
+                (AxisCode::RightX, 0),
+                (AxisCode::RightY, 0)
+            ]
+        );
+    }
+}
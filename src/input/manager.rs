@@ -1,6 +1,11 @@
 // Input device management types and traits
 
+use super::composite::{self, Source};
 use super::gamepad::{Gamepad, GamepadInfo};
+use super::keymouse::KeyMouseLayout;
+use std::path::Path;
+use std::sync::Arc;
+use std::time::Duration;
 use thiserror::Error;
 
 /// InputManager trait - handles input device discovery and creation
@@ -9,8 +14,136 @@ pub trait InputManager {
     /// List all connected gamepads
     fn list_gamepads(&self) -> anyhow::Result<InputDetectionResult>;
 
+    /// List every input device that could be read: controllers, keyboards
+    /// and mice
+    ///
+    /// The default only knows controllers.
+    fn list_devices(&self) -> anyhow::Result<Vec<InputDeviceInfo>> {
+        let gamepads = self.list_gamepads()?.gamepad_info;
+        Ok(gamepads
+            .into_iter()
+            .map(|info| InputDeviceInfo {
+                path: info.path,
+                name: info.name,
+                kind: DeviceKind::Gamepad,
+            })
+            .collect())
+    }
+
     /// Open a specific gamepad by path
     fn open_gamepad(&self, path: &str) -> anyhow::Result<Box<dyn Gamepad>>;
+
+    /// Open a gamepad only to watch it, for inspecting it without side
+    /// effects: it is opened read-only and never grabbed, so other programs
+    /// keep receiving its events
+    ///
+    /// Platforms that can't promise that fail.
+    fn open_gamepad_observed(&self, path: &str) -> anyhow::Result<Box<dyn Gamepad>> {
+        let _ = path;
+        anyhow::bail!("Observing a controller without side effects is not supported here")
+    }
+
+    /// Open a gamepad reporting its axes as they are, without its
+    /// calibration or the built-in deadzone, to measure them; observed
+    /// where the platform can
+    ///
+    /// The default opens it like `open_gamepad`.
+    fn open_gamepad_raw(&self, path: &str) -> anyhow::Result<Box<dyn Gamepad>> {
+        self.open_gamepad(path)
+    }
+
+    /// Open several gamepads as one merged event stream
+    ///
+    /// Platforms that can wait on many devices at once override this; the
+    /// default only handles the single-device case.
+    fn open_gamepads(&self, paths: &[String]) -> anyhow::Result<Box<dyn Gamepad>> {
+        match paths {
+            [path] => self.open_gamepad(path),
+            _ => anyhow::bail!("Reading several controllers at once is not supported here"),
+        }
+    }
+
+    /// Open `sources` as one controller, each with its controls renamed
+    ///
+    /// With `grab`, the devices are taken for ourselves: other programs stop
+    /// receiving their events. The default handles sources without renames
+    /// and doesn't grab.
+    fn open_composite(&self, sources: &[Source], grab: bool) -> anyhow::Result<Box<dyn Gamepad>> {
+        if grab || sources.iter().any(|source| !source.controls.is_empty()) {
+            anyhow::bail!("Renaming controls or grabbing devices is not supported here");
+        }
+        self.open_gamepads(&composite::paths(sources))
+    }
+
+    /// Open keyboards and mice as one controller laid out by `layout`
+    ///
+    /// With `grab`, other programs stop receiving their input; the layout's
+    /// release key ends reading.
+    fn open_key_mouse(
+        &self,
+        paths: &[String],
+        layout: KeyMouseLayout,
+        grab: bool,
+    ) -> anyhow::Result<Box<dyn Gamepad>> {
+        let _ = (paths, layout, grab);
+        anyhow::bail!("Reading keyboards and mice as a controller is not supported here")
+    }
+}
+
+/// What an input device is
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DeviceKind {
+    Gamepad,
+    Keyboard,
+    Mouse,
+}
+
+impl std::fmt::Display for DeviceKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Gamepad => write!(f, "Gamepad"),
+            Self::Keyboard => write!(f, "Keyboard"),
+            Self::Mouse => write!(f, "Mouse"),
+        }
+    }
+}
+
+/// Any input device, as far as telling it apart from others goes
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct InputDeviceInfo {
+    pub path: String,
+    pub name: String,
+    pub kind: DeviceKind,
+}
+
+/// How detection tries each device node
+#[derive(Clone, Default)]
+pub struct ProbeOptions {
+    /// Give up on a node that hasn't opened by then, reporting it as timed
+    /// out; no limit if absent
+    pub timeout: Option<Duration>,
+    /// Told of each node before it's tried, to show progress
+    pub progress: Option<ProbeProgress>,
+}
+
+/// Told of each node detection tries
+pub type ProbeProgress = Arc<dyn Fn(ProbeStep) + Send + Sync>;
+
+impl std::fmt::Debug for ProbeOptions {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ProbeOptions")
+            .field("timeout", &self.timeout)
+            .field("progress", &self.progress.is_some())
+            .finish()
+    }
+}
+
+/// The node detection is about to try, the `number`th of `total`
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ProbeStep<'a> {
+    pub path: &'a Path,
+    pub number: usize,
+    pub total: usize,
 }
 
 /// Results of gamepad detection
@@ -26,9 +159,46 @@ pub enum ErrorType {
     Permission,    // Permission denied
     NotFound,      // Device not found
     InvalidDevice, // Invalid or unsupported device
+    NotAllowed,    // Refused by the daemon settings
+    TimedOut,      // Didn't open within the probe timeout
     Unknown,       // Unknown error
 }
 
+impl ErrorType {
+    /// What the user can do about it, if we know
+    pub fn hint(self) -> Option<&'static str> {
+        match self {
+            Self::Permission => Some(
+                "add your user to the 'input' group, or install a udev rule for your controller; \
+                 'blazeremap doctor' checks access",
+            ),
+            Self::NotFound => Some("it went away while detecting; reconnect it and detect again"),
+            Self::InvalidDevice => {
+                Some("it doesn't report what a controller should; try another cable or mode")
+            }
+            Self::NotAllowed => Some("the [devices] lists of daemon.toml keep BlazeRemap off it"),
+            Self::TimedOut => Some(
+                "its driver didn't answer in time; replug it, or give it longer with 'detect \
+                 --timeout'",
+            ),
+            Self::Unknown => None,
+        }
+    }
+}
+
+impl std::fmt::Display for ErrorType {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Permission => write!(f, "permission denied"),
+            Self::NotFound => write!(f, "not found"),
+            Self::InvalidDevice => write!(f, "invalid device"),
+            Self::NotAllowed => write!(f, "not allowed"),
+            Self::TimedOut => write!(f, "timed out"),
+            Self::Unknown => write!(f, "error"),
+        }
+    }
+}
+
 /// Device-related error
 #[derive(Debug, Error)]
 pub struct InputDeviceError {
@@ -44,6 +214,18 @@ impl std::fmt::Display for InputDeviceError {
     }
 }
 
+/// No controller to remap; exits with a code of its own (see exit.rs)
+#[derive(Debug, Error)]
+pub enum NoControllers {
+    #[error("No controllers detected. Please connect a controller.")]
+    Connected,
+    #[error("No controller matches {filter} ({connected} connected)")]
+    Matching { filter: String, connected: usize },
+    /// Only ones that couldn't be opened, the first of them `path`
+    #[error("No usable controllers: {path} ({error_type}); 'blazeremap detect' shows what to do")]
+    Unusable { path: String, error_type: ErrorType },
+}
+
 impl InputDeviceError {
     pub fn new(path: String, error_type: ErrorType, source: anyhow::Error) -> Self {
         Self { path, error_type, source }
@@ -1,7 +1,32 @@
 // Input module
+pub mod alias;
+pub mod bounce;
+pub mod calibration;
+pub mod composite;
+pub mod filter;
 pub mod gamepad;
+pub mod keyboard;
+pub mod keymouse;
 pub mod manager;
+pub mod policy;
+pub mod range;
+pub mod rate;
+pub mod storm;
 
 // Re-export main types
 pub use gamepad::{Gamepad, GamepadCapability, GamepadInfo, GamepadType};
-pub use manager::{ErrorType, InputDetectionResult, InputDeviceError, InputManager};
+pub use manager::{
+    DeviceKind, ErrorType, InputDetectionResult, InputDeviceError, InputDeviceInfo, InputManager,
+};
+
+/// $XDG_CONFIG_HOME/blazeremap, where per-controller settings are kept
+pub fn config_dir() -> anyhow::Result<std::path::PathBuf> {
+    use anyhow::Context;
+    use std::path::PathBuf;
+
+    let config = match std::env::var_os("XDG_CONFIG_HOME") {
+        Some(dir) if !dir.is_empty() => PathBuf::from(dir),
+        _ => PathBuf::from(std::env::var_os("HOME").context("No home directory")?).join(".config"),
+    };
+    Ok(config.join("blazeremap"))
+}
@@ -0,0 +1,323 @@
+// Devices BlazeRemap may open
+//
+// A machine-wide install shouldn't take the keyboard away from its user
+// because of a mistyped --device or a keyboard that looks like a controller.
+// The daemon settings can name the devices it may open, and grab:
+//
+//   /etc/blazeremap/daemon.toml, and $XDG_CONFIG_HOME/blazeremap/daemon.toml
+//
+//   [devices]
+//   allow = ["054c", "045e:02ea", "living-room-pad"]
+//   deny = ["046d:c52b"]
+//
+// Entries are a vendor ID, VENDOR:PRODUCT, both four hex digits, or an alias
+// from devices.toml. With `allow` only the devices it lists may be opened;
+// `deny` refuses devices whatever `allow` says. A device has to pass both
+// files, so the user's can narrow what the system's allows, never widen it.
+// Devices refused are left out of detection, and opening one fails.
+//
+// The same files say whether `run` asks for real-time scheduling without
+// --realtime; the user's setting wins over the system's:
+//
+//   [scheduling]
+//   realtime = true
+
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result, bail};
+use serde::Deserialize;
+
+use crate::input::alias::{AliasStore, DeviceIdentity};
+
+/// The machine-wide daemon settings
+pub const SYSTEM_FILE: &str = "/etc/blazeremap/daemon.toml";
+
+/// One entry of an allow or deny list
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum Rule {
+    Ids { vendor_id: u16, product_id: Option<u16> },
+    Alias { name: String, identity: DeviceIdentity },
+}
+
+impl Rule {
+    fn parse(text: &str, aliases: &mut dyn FnMut() -> Result<AliasStore>) -> Result<Self> {
+        let hex = |id: &str| (id.len() == 4).then(|| u16::from_str_radix(id, 16).ok()).flatten();
+        let ids = match text.split_once(':') {
+            Some((vendor, product)) => hex(vendor).zip(hex(product).map(Some)),
+            None => hex(text).map(|vendor| (vendor, None)),
+        };
+        if let Some((vendor_id, product_id)) = ids {
+            return Ok(Self::Ids { vendor_id, product_id });
+        }
+        let store = aliases()?;
+        match store.load()?.remove(text) {
+            Some(identity) => Ok(Self::Alias { name: text.to_string(), identity }),
+            None => bail!(
+                "'{}' is neither a vendor ID, VENDOR:PRODUCT nor an alias in {}",
+                text,
+                store.path().display()
+            ),
+        }
+    }
+
+    fn matches(&self, device: &DeviceIdentity) -> bool {
+        match self {
+            Self::Ids { vendor_id, product_id } => {
+                *vendor_id == device.vendor_id
+                    && product_id.is_none_or(|product_id| product_id == device.product_id)
+            }
+            Self::Alias { identity, .. } => identity.covers(device),
+        }
+    }
+}
+
+/// The lists of one settings file
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Lists {
+    file: PathBuf,
+    allow: Option<Vec<Rule>>,
+    deny: Vec<Rule>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct SettingsFile {
+    #[serde(default)]
+    devices: DevicesSection,
+    #[serde(default)]
+    scheduling: SchedulingSection,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct DevicesSection {
+    allow: Option<Vec<String>>,
+    #[serde(default)]
+    deny: Vec<String>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct SchedulingSection {
+    realtime: Option<bool>,
+}
+
+/// SYSTEM_FILE and the user's daemon.toml, the user's last
+fn settings_files() -> Vec<PathBuf> {
+    let mut files = vec![PathBuf::from(SYSTEM_FILE)];
+    files.extend(super::config_dir().ok().map(|dir| dir.join("daemon.toml")));
+    files
+}
+
+/// The settings in `file`, None if there is no such file
+fn read_settings(file: &Path) -> Result<Option<SettingsFile>> {
+    let text = match std::fs::read_to_string(file) {
+        Ok(text) => text,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(None),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", file.display())),
+    };
+    let settings = toml::from_str(&text)
+        .with_context(|| format!("Invalid daemon settings {}", file.display()))?;
+    Ok(Some(settings))
+}
+
+/// Whether the daemon settings ask for real-time scheduling
+pub fn realtime() -> Result<bool> {
+    realtime_from(&settings_files())
+}
+
+/// Whether the last of `files` that says asks for real-time scheduling
+fn realtime_from(files: &[PathBuf]) -> Result<bool> {
+    let mut realtime = false;
+    for file in files {
+        if let Some(set) = read_settings(file)?.and_then(|settings| settings.scheduling.realtime) {
+            realtime = set;
+        }
+    }
+    Ok(realtime)
+}
+
+/// What the daemon settings let BlazeRemap open; the default allows all
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct DevicePolicy {
+    lists: Vec<Lists>,
+}
+
+impl DevicePolicy {
+    /// From SYSTEM_FILE and the user's daemon.toml, whichever exist
+    pub fn load() -> Result<Self> {
+        Self::load_from(&settings_files(), AliasStore::user)
+    }
+
+    /// From `files`, naming aliases of the store `aliases` gives
+    pub fn load_from(
+        files: &[PathBuf],
+        mut aliases: impl FnMut() -> Result<AliasStore>,
+    ) -> Result<Self> {
+        let mut lists = Vec::new();
+        for file in files {
+            let Some(settings) = read_settings(file)? else {
+                continue;
+            };
+            let mut parse = |entries: Vec<String>| -> Result<Vec<Rule>> {
+                entries.iter().map(|entry| Rule::parse(entry, &mut aliases)).collect()
+            };
+            let devices = settings.devices;
+            let invalid = || format!("Invalid [devices] in {}", file.display());
+            let allow = devices.allow.map(&mut parse).transpose().with_context(invalid)?;
+            let deny = parse(devices.deny).with_context(invalid)?;
+            lists.push(Lists { file: file.clone(), allow, deny });
+        }
+        Ok(Self { lists })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.lists.iter().all(|lists| lists.allow.is_none() && lists.deny.is_empty())
+    }
+
+    /// Fail, saying which file refuses it, unless the device at `path` may be
+    /// opened; `device` is what it is, None if that can't be told
+    pub fn check(&self, path: &str, device: Option<&DeviceIdentity>) -> Result<()> {
+        for lists in &self.lists {
+            let file = lists.file.display();
+            if let Some(device) = device
+                && let Some(rule) = lists.deny.iter().find(|rule| rule.matches(device))
+            {
+                bail!("{} ({}) is denied by {} in {}", path, device, rule, file);
+            }
+            match (&lists.allow, device) {
+                (Some(allow), Some(device)) if !allow.iter().any(|rule| rule.matches(device)) => {
+                    bail!("{} ({}) is not in the allow list of {}", path, device, file)
+                }
+                (Some(_), None) => {
+                    bail!("Can't tell what {} is, and {} only allows listed devices", path, file)
+                }
+                _ => {}
+            }
+        }
+        Ok(())
+    }
+}
+
+impl std::fmt::Display for Rule {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Ids { vendor_id, product_id: Some(product_id) } => {
+                write!(f, "'{:04x}:{:04x}'", vendor_id, product_id)
+            }
+            Self::Ids { vendor_id, product_id: None } => write!(f, "'{:04x}'", vendor_id),
+            Self::Alias { name, .. } => write!(f, "'{}'", name),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn pad(uniq: &str) -> DeviceIdentity {
+        DeviceIdentity {
+            vendor_id: 0x054c,
+            product_id: 0x09cc,
+            uniq: Some(uniq.to_string()),
+            phys: None,
+        }
+    }
+
+    fn keyboard() -> DeviceIdentity {
+        DeviceIdentity { vendor_id: 0x046d, product_id: 0xc52b, uniq: None, phys: None }
+    }
+
+    /// The policy of settings files with `texts`
+    fn settings(name: &str, texts: &[&str]) -> Result<DevicePolicy> {
+        let dir =
+            std::env::temp_dir().join(format!("blazeremap-policy-{}-{}", name, std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("devices.toml"), "[couch]\nid = \"054c:09cc\"\nuniq = \"a0:01\"\n")
+            .unwrap();
+        let files: Vec<PathBuf> = texts
+            .iter()
+            .enumerate()
+            .map(|(i, text)| {
+                let file = dir.join(format!("daemon{}.toml", i));
+                std::fs::write(&file, text).unwrap();
+                file
+            })
+            .collect();
+        let policy =
+            DevicePolicy::load_from(&files, || Ok(AliasStore::new(dir.join("devices.toml"))));
+        std::fs::remove_dir_all(&dir).unwrap();
+        policy
+    }
+
+    #[test]
+    fn test_without_lists_all_may_be_opened() {
+        let policy = DevicePolicy::load_from(&[PathBuf::from("/nonexistent/daemon.toml")], || {
+            panic!("aliases aren't needed")
+        })
+        .unwrap();
+        assert!(policy.is_empty());
+        assert!(policy.check("/dev/input/event3", None).is_ok());
+    }
+
+    #[test]
+    fn test_allow_and_deny() {
+        let policy = settings(
+            "lists",
+            &["[devices]\nallow = [\"054c\", \"046d\"]\ndeny = [\"046d:c52b\"]\n"],
+        )
+        .unwrap();
+        assert!(policy.check("/dev/input/event3", Some(&pad("a0:01"))).is_ok());
+
+        let err = policy.check("/dev/input/event4", Some(&keyboard())).unwrap_err().to_string();
+        assert!(
+            err.starts_with("/dev/input/event4 (046d:c52b) is denied by '046d:c52b' in "),
+            "{}",
+            err
+        );
+
+        let other = DeviceIdentity { vendor_id: 0x045e, ..keyboard() };
+        let err = policy.check("/dev/input/event5", Some(&other)).unwrap_err().to_string();
+        assert!(err.contains("is not in the allow list of"), "{}", err);
+        assert!(policy.check("/dev/input/event6", None).is_err());
+    }
+
+    #[test]
+    fn test_aliases_and_both_files() {
+        // The user's file narrows the system's to one of its pads
+        let policy = settings(
+            "aliases",
+            &["[devices]\nallow = [\"054c\"]\n", "[devices]\nallow = [\"couch\"]\n"],
+        )
+        .unwrap();
+        assert!(policy.check("/dev/input/event3", Some(&pad("a0:01"))).is_ok());
+        assert!(policy.check("/dev/input/event3", Some(&pad("a0:02"))).is_err());
+
+        let err = settings("unknown", &["[devices]\ndeny = [\"kitchen\"]\n"]).unwrap_err();
+        assert!(format!("{:#}", err).contains("'kitchen' is neither"), "{:#}", err);
+        let err = settings("typo", &["[devices]\nalow = [\"054c\"]\n"]).unwrap_err();
+        assert!(err.to_string().starts_with("Invalid daemon settings"), "{}", err);
+    }
+
+    #[test]
+    fn test_realtime_setting() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-realtime-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let file = |name: &str, text: &str| {
+            let file = dir.join(name);
+            std::fs::write(&file, text).unwrap();
+            file
+        };
+        let system = file("system.toml", "[scheduling]\nrealtime = true\n");
+        let devices_only = file("devices.toml", "[devices]\ndeny = [\"046d\"]\n");
+        let user = file("user.toml", "[scheduling]\nrealtime = false\n");
+        let typo = file("typo.toml", "[scheduling]\nrealtme = true\n");
+
+        assert!(!realtime_from(&[dir.join("missing.toml")]).unwrap());
+        assert!(realtime_from(&[system.clone(), devices_only]).unwrap());
+        // The user's file wins
+        assert!(!realtime_from(&[system, user]).unwrap());
+        assert!(realtime_from(&[typo]).is_err());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
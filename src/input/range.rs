@@ -0,0 +1,126 @@
+// Axis ranges and normalization
+//
+// Drivers disagree on axis ranges: hid-sony reports sticks and triggers as
+// 0–255, xpad sticks as -32768–32767 and triggers as 0–1023, hid-steam
+// triggers as 0–32767. Each axis is rescaled from the range its device
+// reports into one canonical range, the ones virtual controllers present,
+// so profiles, calibrations and forwarded controllers mean the same thing
+// whatever the driver.
+
+use crate::event::{AxisCode, InputEvent};
+
+/// The values an axis reports, inclusive
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct AxisRange {
+    pub min: i32,
+    pub max: i32,
+}
+
+impl AxisRange {
+    pub const STICK: Self = Self { min: -32768, max: 32767 };
+    pub const TRIGGER: Self = Self { min: 0, max: 1023 };
+    pub const HAT: Self = Self { min: -1, max: 1 };
+
+    pub const fn new(min: i32, max: i32) -> Self {
+        Self { min, max }
+    }
+
+    /// The range `code` is normalized into: sticks and trackpads centered on
+    /// 0, triggers from 0, the D-pad a hat
+    pub fn canonical(code: AxisCode) -> Self {
+        match code {
+            AxisCode::LeftTrigger | AxisCode::RightTrigger => Self::TRIGGER,
+            AxisCode::DPadX | AxisCode::DPadY => Self::HAT,
+            _ => Self::STICK,
+        }
+    }
+
+    /// Whether the range is usable at all; drivers sometimes report min = max
+    pub fn is_valid(&self) -> bool {
+        self.min < self.max
+    }
+
+    // The value a centered axis rests at; 128 for 0–255
+    fn center(&self) -> i64 {
+        (self.min as i64 + self.max as i64 + 1).div_euclid(2)
+    }
+
+    /// `value` in this range moved to the same place in `to`
+    ///
+    /// Between ranges where either is centered, each side of the center is
+    /// scaled on its own, so center lands exactly on center both ways.
+    pub fn rescale(&self, value: i32, to: AxisRange) -> i32 {
+        if !self.is_valid() || *self == to {
+            return value;
+        }
+        let value = (value as i64).clamp(self.min as i64, self.max as i64);
+        let scale = |value: i64, from: (i64, i64), onto: (i64, i64)| {
+            let span = from.1 - from.0;
+            if span == 0 {
+                return onto.0;
+            }
+            // Rounded to nearest
+            onto.0 + ((value - from.0) * (onto.1 - onto.0) * 2 + span).div_euclid(span * 2)
+        };
+        let (min, max) = (self.min as i64, self.max as i64);
+        let scaled = match to.min < 0 || self.min < 0 {
+            true => {
+                let (center, onto) = (self.center(), to.center());
+                match value < center {
+                    true => scale(value, (min, center), (to.min as i64, onto)),
+                    false => scale(value, (center, max), (onto, to.max as i64)),
+                }
+            }
+            false => scale(value, (min, max), (to.min as i64, to.max as i64)),
+        };
+        scaled as i32
+    }
+}
+
+/// Rescale `event` from `range`, the range its device reports, into its
+/// axis's canonical range; other events are left alone
+pub fn normalize(event: &mut InputEvent, range: AxisRange) {
+    if let InputEvent::Axis { code, value, .. } = event {
+        *value = range.rescale(*value, AxisRange::canonical(*code));
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_rescale_sticks() {
+        let sony = AxisRange::new(0, 255);
+        assert_eq!(sony.rescale(0, AxisRange::STICK), -32768);
+        assert_eq!(sony.rescale(128, AxisRange::STICK), 0);
+        assert_eq!(sony.rescale(255, AxisRange::STICK), 32767);
+        assert_eq!(sony.rescale(64, AxisRange::STICK), -16384);
+        // Out of range values are clamped
+        assert_eq!(sony.rescale(300, AxisRange::STICK), 32767);
+        assert_eq!(AxisRange::STICK.rescale(-1200, AxisRange::STICK), -1200);
+        // And back
+        assert_eq!(AxisRange::STICK.rescale(0, sony), 128);
+        assert_eq!(AxisRange::STICK.rescale(774, sony), 131);
+    }
+
+    #[test]
+    fn test_rescale_triggers_and_hats() {
+        assert_eq!(AxisRange::new(0, 255).rescale(255, AxisRange::TRIGGER), 1023);
+        assert_eq!(AxisRange::new(0, 255).rescale(0, AxisRange::TRIGGER), 0);
+        assert_eq!(AxisRange::new(0, 32767).rescale(16384, AxisRange::TRIGGER), 512);
+        assert_eq!(AxisRange::HAT.rescale(-1, AxisRange::HAT), -1);
+        // A range the driver got wrong is passed through
+        assert_eq!(AxisRange::new(0, 0).rescale(77, AxisRange::TRIGGER), 77);
+    }
+
+    #[test]
+    fn test_normalize() {
+        let mut event = InputEvent::axis_move(AxisCode::RightTrigger, 128);
+        normalize(&mut event, AxisRange::new(0, 255));
+        assert!(matches!(event, InputEvent::Axis { value: 514, .. }));
+        let mut event = InputEvent::axis_move(AxisCode::LeftY, 0);
+        normalize(&mut event, AxisRange::new(0, 255));
+        assert!(matches!(event, InputEvent::Axis { value: -32768, .. }));
+    }
+}
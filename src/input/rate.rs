@@ -0,0 +1,126 @@
+// Report rate: how often a controller sends its state
+//
+// While anything on it changes, a controller sends a report every polling
+// interval: 125 Hz for many on USB unless told otherwise, 250 Hz and up for
+// others, and a rate of its own over Bluetooth. Each report reaches us as one
+// frame, so with the sticks kept moving, the time between frames is the
+// interval. Longer pauses are the movement stopping rather than reports the
+// controller skipped, and are left out.
+
+use std::time::{Duration, Instant};
+
+use crate::event::InputEvent;
+
+/// Frames further apart than this are a pause in the movement
+const IDLE_GAP: Duration = Duration::from_millis(50);
+
+/// Rates USB controllers are commonly polled at, in Hz
+pub const POLLING_RATES: [u32; 5] = [125, 250, 500, 1000, 8000];
+
+/// Time between the frames of a controller, as events come
+#[derive(Debug, Clone, Default)]
+pub struct ReportRate {
+    last: Option<Instant>,
+    intervals: Vec<Duration>,
+    pauses: usize,
+}
+
+/// What the frames of a controller came at
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct RateSummary {
+    /// Intervals measured; pauses left out
+    pub intervals: usize,
+    pub pauses: usize,
+    /// Time spent moving
+    pub moving: Duration,
+    /// Frames a second while moving
+    pub hz: f64,
+    pub median: Duration,
+    pub fastest: Duration,
+    /// 99 in 100 intervals were this short or shorter
+    pub p99: Duration,
+}
+
+impl RateSummary {
+    /// The common polling rate the median interval is within 10% of, if any
+    pub fn polling_rate(&self) -> Option<u32> {
+        let median_hz = 1.0 / self.median.as_secs_f64();
+        POLLING_RATES.into_iter().find(|&rate| (median_hz / rate as f64 - 1.0).abs() <= 0.1)
+    }
+}
+
+impl ReportRate {
+    /// Take `event` into account; frames are counted by their `Sync`
+    pub fn sample(&mut self, event: &InputEvent) {
+        let InputEvent::Sync { timestamp } = *event else {
+            return;
+        };
+        if let Some(last) = self.last.replace(timestamp) {
+            match timestamp.saturating_duration_since(last) {
+                interval if interval > IDLE_GAP => self.pauses += 1,
+                interval => self.intervals.push(interval),
+            }
+        }
+    }
+
+    /// None until two frames came close enough together
+    pub fn summary(&self) -> Option<RateSummary> {
+        if self.intervals.is_empty() {
+            return None;
+        }
+        let mut intervals = self.intervals.clone();
+        intervals.sort();
+        let moving: Duration = intervals.iter().sum();
+        let p99 = (intervals.len() * 99).div_ceil(100) - 1;
+        Some(RateSummary {
+            intervals: intervals.len(),
+            pauses: self.pauses,
+            moving,
+            hz: intervals.len() as f64 / moving.as_secs_f64().max(f64::MIN_POSITIVE),
+            median: intervals[intervals.len() / 2],
+            fastest: intervals[0],
+            p99: intervals[p99],
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn rate_of(offsets_us: impl IntoIterator<Item = u64>) -> ReportRate {
+        let base = Instant::now();
+        let mut rate = ReportRate::default();
+        rate.sample(&InputEvent::button_press(crate::event::ButtonCode::South));
+        for offset in offsets_us {
+            rate.sample(&InputEvent::sync_at(base + Duration::from_micros(offset)));
+        }
+        rate
+    }
+
+    #[test]
+    fn test_summary() {
+        // 4 ms apart, one late report, then a pause
+        let mut offsets: Vec<u64> = (0..100).map(|n| n * 4000).collect();
+        offsets.push(396_000 + 6000);
+        offsets.push(402_000 + 200_000);
+        offsets.push(602_000 + 4000);
+        let summary = rate_of(offsets).summary().unwrap();
+
+        assert_eq!(summary.intervals, 101);
+        assert_eq!(summary.pauses, 1);
+        assert_eq!(summary.median, Duration::from_millis(4));
+        assert_eq!(summary.fastest, Duration::from_millis(4));
+        assert_eq!(summary.p99, Duration::from_millis(4));
+        assert_eq!(summary.moving, Duration::from_millis(406));
+        assert!((summary.hz - 248.8).abs() < 0.1, "{}", summary.hz);
+        assert_eq!(summary.polling_rate(), Some(250));
+    }
+
+    #[test]
+    fn test_unusual_rates_and_too_few_frames() {
+        let summary = rate_of((0..10).map(|n| n * 6700)).summary().unwrap();
+        assert_eq!(summary.polling_rate(), None);
+        assert_eq!(rate_of([0]).summary(), None);
+    }
+}
@@ -0,0 +1,207 @@
+// Event storms
+//
+// A controller sends one frame per report: up to 1000 a second for nearly
+// all of them, 8000 for the fastest. A broken one, or a virtual device made
+// to flood us, can send far more, and every frame costs mapping and writing
+// out. Each device's frames pass a `StormGuard`, which lets FRAME_LIMIT a
+// second through, in bursts of up to BURST.
+//
+// Frames beyond that are held back and merged, the latest value of each
+// control winning, into the next frame let through. What the device ends up
+// at still arrives, so a button let go during a storm doesn't stay held, and
+// what is held never grows past one event per control. Frames merged away
+// are counted per device; `blazeremap status` shows them, and the start of
+// each storm is logged.
+
+use std::collections::{BTreeMap, VecDeque};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use crate::event::InputEvent;
+
+/// Frames a second a device may send before they're merged
+pub const FRAME_LIMIT: u32 = 10_000;
+/// Frames a device may send at once, above the limit, before they're merged
+pub const BURST: u32 = 1_000;
+
+/// Frames merged away so far, by device
+static MERGED: Mutex<BTreeMap<String, Arc<AtomicU64>>> = Mutex::new(BTreeMap::new());
+
+/// Frames of the device at `path` merged away since it was opened
+pub fn merged_frames(path: &str) -> u64 {
+    let merged = MERGED.lock().unwrap_or_else(|e| e.into_inner());
+    merged.get(path).map_or(0, |count| count.load(Ordering::Relaxed))
+}
+
+/// Keeps one device's frames to FRAME_LIMIT a second; see above
+#[derive(Debug)]
+pub struct StormGuard {
+    path: String,
+    per_sec: f64,
+    burst: f64,
+    tokens: f64,
+    refilled: Instant,
+    // The merged frame waiting for its turn, without its Sync
+    held: Vec<InputEvent>,
+    merged: Arc<AtomicU64>,
+    storming: bool,
+}
+
+impl StormGuard {
+    /// Guard the device at `path` with the default limits
+    pub fn new(path: &str) -> Self {
+        Self::with_limit(path, FRAME_LIMIT, BURST, Instant::now())
+    }
+
+    /// `per_sec` frames a second, in bursts of up to `burst`, from `now`
+    pub fn with_limit(path: &str, per_sec: u32, burst: u32, now: Instant) -> Self {
+        let merged = Arc::new(AtomicU64::new(0));
+        MERGED
+            .lock()
+            .unwrap_or_else(|e| e.into_inner())
+            .insert(path.to_string(), Arc::clone(&merged));
+        Self {
+            path: path.to_string(),
+            per_sec: f64::from(per_sec.max(1)),
+            burst: f64::from(burst.max(1)),
+            tokens: f64::from(burst.max(1)),
+            refilled: now,
+            held: Vec::new(),
+            merged,
+            storming: false,
+        }
+    }
+
+    fn refill(&mut self, now: Instant) {
+        let elapsed = now.saturating_duration_since(self.refilled).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * self.per_sec).min(self.burst);
+        self.refilled = now;
+        if self.storming && self.tokens >= self.burst {
+            self.storming = false;
+            tracing::info!("{} calmed down", self.path);
+        }
+    }
+
+    /// Take the complete frames at the front of `incoming`, each closed by
+    /// its Sync, passing them on to `out` or holding them back
+    pub fn admit(
+        &mut self,
+        incoming: &mut VecDeque<InputEvent>,
+        now: Instant,
+        out: &mut VecDeque<InputEvent>,
+    ) {
+        while let Some(end) = incoming.iter().position(|e| matches!(e, InputEvent::Sync { .. })) {
+            for event in incoming.drain(..end) {
+                self.hold(event);
+            }
+            let sync = incoming.pop_front().unwrap();
+            self.refill(now);
+            if self.tokens >= 1.0 {
+                self.tokens -= 1.0;
+                out.extend(self.held.drain(..));
+                out.push_back(sync);
+                continue;
+            }
+            self.merged.fetch_add(1, Ordering::Relaxed);
+            if !self.storming {
+                self.storming = true;
+                tracing::warn!(
+                    "{} is flooding events; merging frames beyond {} a second",
+                    self.path,
+                    self.per_sec
+                );
+            }
+        }
+    }
+
+    /// Pass on the frame held back, if it may go now; otherwise when it may
+    pub fn release(&mut self, now: Instant, out: &mut VecDeque<InputEvent>) -> Option<Instant> {
+        if self.held.is_empty() {
+            return None;
+        }
+        self.refill(now);
+        if self.tokens >= 1.0 {
+            self.tokens -= 1.0;
+            out.extend(self.held.drain(..));
+            out.push_back(InputEvent::Sync { timestamp: now });
+            return None;
+        }
+        Some(now + Duration::from_secs_f64((1.0 - self.tokens) / self.per_sec))
+    }
+
+    /// Add `event` to the held frame, replacing the control's earlier value
+    fn hold(&mut self, event: InputEvent) {
+        let same = |held: &InputEvent| match (held, &event) {
+            (InputEvent::Button { code: a, .. }, InputEvent::Button { code: b, .. }) => a == b,
+            (InputEvent::Axis { code: a, .. }, InputEvent::Axis { code: b, .. }) => a == b,
+            _ => false,
+        };
+        match self.held.iter_mut().find(|held| same(held)) {
+            Some(held) => *held = event,
+            None => self.held.push(event),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{AxisCode, ButtonCode};
+
+    fn frame(events: &[InputEvent]) -> VecDeque<InputEvent> {
+        events.iter().copied().chain([InputEvent::sync()]).collect()
+    }
+
+    #[test]
+    fn test_frames_within_the_limit_pass() {
+        let now = Instant::now();
+        let mut guard = StormGuard::with_limit("/dev/input/storm-calm", 100, 2, now);
+        let mut out = VecDeque::new();
+        let mut incoming = frame(&[InputEvent::button_press(ButtonCode::South)]);
+        incoming.extend(frame(&[InputEvent::button_release(ButtonCode::South)]));
+        incoming.push_back(InputEvent::axis_move(AxisCode::LeftX, 5));
+
+        guard.admit(&mut incoming, now, &mut out);
+        assert_eq!(out.len(), 4);
+        // The frame still being read stays
+        assert_eq!(incoming.len(), 1);
+        assert_eq!(merged_frames("/dev/input/storm-calm"), 0);
+        assert_eq!(guard.release(now, &mut out), None);
+    }
+
+    #[test]
+    fn test_storms_are_merged_into_the_latest_state() {
+        let now = Instant::now();
+        let mut guard = StormGuard::with_limit("/dev/input/storm-flood", 100, 1, now);
+        let mut out = VecDeque::new();
+        let mut incoming = VecDeque::new();
+        for value in 0..50 {
+            incoming.extend(frame(&[
+                InputEvent::button_press(ButtonCode::South),
+                InputEvent::axis_move(AxisCode::LeftX, value),
+            ]));
+            incoming.extend(frame(&[InputEvent::button_release(ButtonCode::South)]));
+        }
+
+        guard.admit(&mut incoming, now, &mut out);
+        // Only the first frame went; 99 wait merged into one
+        assert_eq!(out.len(), 3);
+        assert_eq!(merged_frames("/dev/input/storm-flood"), 99);
+
+        out.clear();
+        let due = guard.release(now, &mut out).unwrap();
+        assert_eq!(due, now + Duration::from_millis(10));
+        assert!(out.is_empty());
+        assert_eq!(guard.release(due, &mut out), None);
+        let held: Vec<_> = out
+            .iter()
+            .map(|event| match *event {
+                InputEvent::Button { code, pressed, .. } => format!("{} {}", code, pressed),
+                InputEvent::Axis { code, value, .. } => format!("{} {}", code, value),
+                InputEvent::Sync { .. } => "sync".to_string(),
+            })
+            .collect();
+        assert_eq!(held, ["South false", "Left X 49", "sync"]);
+    }
+}
@@ -0,0 +1,252 @@
+// Control socket between a running daemon and CLI queries
+//
+// Line protocol over a Unix socket: the client sends one command line (a
+// word, then its argument if it takes one), the daemon answers with one JSON line, either `{"ok": <value>}` or
+// `{"error": "<message>"}`. The socket is created 0600 so only the user
+// running the daemon can talk to it. Handlers are told who asked, so the
+// changes they make can be audited.
+
+use serde::de::DeserializeOwned;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+/// Overrides the socket location (used by tests and multi-instance setups)
+pub const SOCKET_ENV: &str = "BLAZEREMAP_SOCKET";
+
+/// Answers one command from a peer, where it could be told; the value is
+/// sent back as JSON
+pub type Handler =
+    Arc<dyn Fn(&str, Option<Peer>) -> anyhow::Result<serde_json::Value> + Send + Sync>;
+
+/// The process at the other end of a connection
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Peer {
+    pub uid: u32,
+    pub pid: i32,
+}
+
+/// No daemon listening on the socket at `path`
+#[derive(Debug, thiserror::Error)]
+#[error("No running daemon found at {} (is 'blazeremap run' active?)", path.display())]
+pub struct NoDaemon {
+    pub path: PathBuf,
+    #[source]
+    source: std::io::Error,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum Response {
+    Ok(serde_json::Value),
+    Error(String),
+}
+
+/// Where the daemon listens: $BLAZEREMAP_SOCKET, else $XDG_RUNTIME_DIR
+pub fn socket_path() -> PathBuf {
+    let user = std::env::var("USER").unwrap_or_else(|_| "default".to_string());
+    socket_path_in(std::env::var_os("XDG_RUNTIME_DIR").map(PathBuf::from), &user)
+}
+
+/// Where the daemon of `user` listens, when it was started as root for them
+pub fn user_socket_path(user: &crate::platform::privilege::User) -> PathBuf {
+    // Their runtime dir, as logind makes it; sudo doesn't pass theirs on
+    let runtime = Path::new("/run/user").join(user.uid.to_string());
+    socket_path_in(runtime.is_dir().then_some(runtime), &user.name)
+}
+
+fn socket_path_in(runtime_dir: Option<PathBuf>, user: &str) -> PathBuf {
+    if let Some(path) = std::env::var_os(SOCKET_ENV) {
+        return PathBuf::from(path);
+    }
+    match runtime_dir {
+        Some(dir) => dir.join("blazeremap.sock"),
+        // macOS has a per-user temp dir; elsewhere keep users apart by name
+        None => std::env::temp_dir().join(format!("blazeremap-{}.sock", user)),
+    }
+}
+
+/// Listening side; the socket file is removed on drop
+pub struct ControlServer {
+    path: PathBuf,
+}
+
+impl ControlServer {
+    /// Bind `path` and answer requests with `handler` on a background thread
+    #[cfg(unix)]
+    pub fn bind(path: &Path, handler: Handler) -> anyhow::Result<Self> {
+        use std::os::unix::fs::PermissionsExt;
+        use std::os::unix::net::{UnixListener, UnixStream};
+
+        if path.exists() {
+            if UnixStream::connect(path).is_ok() {
+                anyhow::bail!("another blazeremap daemon is listening on {}", path.display());
+            }
+            // Left behind by a daemon that didn't shut down cleanly
+            std::fs::remove_file(path)?;
+        }
+
+        let listener = UnixListener::bind(path)?;
+        std::fs::set_permissions(path, std::fs::Permissions::from_mode(0o600))?;
+
+        std::thread::Builder::new().name("blazeremap-ipc".to_string()).spawn(move || {
+            for stream in listener.incoming() {
+                match stream {
+                    Ok(stream) => {
+                        if let Err(e) = serve_connection(stream, handler.as_ref()) {
+                            tracing::debug!("Control connection failed: {}", e);
+                        }
+                    }
+                    Err(e) => tracing::warn!("Control socket accept failed: {}", e),
+                }
+            }
+        })?;
+
+        tracing::info!("Control socket listening on {}", path.display());
+        Ok(Self { path: path.to_path_buf() })
+    }
+
+    #[cfg(not(unix))]
+    pub fn bind(_path: &Path, _handler: Handler) -> anyhow::Result<Self> {
+        Err(crate::platform::PlatformError::unsupported("control socket").into())
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
+impl Drop for ControlServer {
+    fn drop(&mut self) {
+        let _ = std::fs::remove_file(&self.path);
+    }
+}
+
+#[cfg(unix)]
+fn serve_connection(
+    stream: std::os::unix::net::UnixStream,
+    handler: &(dyn Fn(&str, Option<Peer>) -> anyhow::Result<serde_json::Value> + Send + Sync),
+) -> anyhow::Result<()> {
+    use std::io::{BufRead, BufReader, Read, Write};
+
+    // A silent client must not wedge the (single) accept thread
+    stream.set_read_timeout(Some(std::time::Duration::from_secs(1)))?;
+
+    let mut line = String::new();
+    BufReader::new((&stream).take(1024)).read_line(&mut line)?;
+
+    let response = match handler(line.trim(), peer(&stream)) {
+        Ok(value) => Response::Ok(value),
+        Err(e) => Response::Error(format!("{:#}", e)),
+    };
+    let mut writer = &stream;
+    serde_json::to_writer(&mut writer, &response)?;
+    writer.write_all(b"\n")?;
+    Ok(())
+}
+
+/// Who connected on `stream`, as the kernel saw them when they did
+#[cfg(target_os = "linux")]
+fn peer(stream: &std::os::unix::net::UnixStream) -> Option<Peer> {
+    use std::os::fd::AsRawFd;
+
+    let mut credentials = libc::ucred { pid: 0, uid: 0, gid: 0 };
+    let mut len = std::mem::size_of::<libc::ucred>() as libc::socklen_t;
+    // SAFETY: SO_PEERCRED fills in a ucred of the length given
+    let result = unsafe {
+        libc::getsockopt(
+            stream.as_raw_fd(),
+            libc::SOL_SOCKET,
+            libc::SO_PEERCRED,
+            (&mut credentials as *mut libc::ucred).cast(),
+            &mut len,
+        )
+    };
+    (result == 0).then_some(Peer { uid: credentials.uid, pid: credentials.pid })
+}
+
+#[cfg(all(unix, not(target_os = "linux")))]
+fn peer(_stream: &std::os::unix::net::UnixStream) -> Option<Peer> {
+    None
+}
+
+/// Send `command` to the daemon at `path` and decode its answer
+#[cfg(unix)]
+pub fn request<T: DeserializeOwned>(path: &Path, command: &str) -> anyhow::Result<T> {
+    use anyhow::Context;
+    use std::io::{BufRead, BufReader, Write};
+    use std::os::unix::net::UnixStream;
+
+    let mut stream = UnixStream::connect(path)
+        .map_err(|source| NoDaemon { path: path.to_path_buf(), source })?;
+    stream.set_read_timeout(Some(std::time::Duration::from_secs(5)))?;
+    writeln!(stream, "{}", command)?;
+
+    let mut line = String::new();
+    BufReader::new(&stream).read_line(&mut line)?;
+    match serde_json::from_str(&line).context("Malformed daemon response")? {
+        Response::Ok(value) => Ok(serde_json::from_value(value)?),
+        Response::Error(message) => anyhow::bail!("daemon: {}", message),
+    }
+}
+
+#[cfg(not(unix))]
+pub fn request<T: DeserializeOwned>(_path: &Path, _command: &str) -> anyhow::Result<T> {
+    Err(crate::platform::PlatformError::unsupported("control socket").into())
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+
+    fn test_socket(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!("blazeremap-test-{}-{}.sock", std::process::id(), name))
+    }
+
+    fn echo_handler() -> Handler {
+        Arc::new(|command, peer| match command {
+            "ping" => Ok(serde_json::json!("pong")),
+            "whoami" => Ok(serde_json::json!(peer.map(|peer| (peer.uid, peer.pid)))),
+            other => anyhow::bail!("unknown command '{}'", other),
+        })
+    }
+
+    #[test]
+    fn test_request_round_trip() {
+        let path = test_socket("round-trip");
+        let _server = ControlServer::bind(&path, echo_handler()).unwrap();
+
+        let answer: String = request(&path, "ping").unwrap();
+        assert_eq!(answer, "pong");
+
+        let err = request::<String>(&path, "bogus").unwrap_err();
+        assert_eq!(err.to_string(), "daemon: unknown command 'bogus'");
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn test_handler_is_told_who_asked() {
+        let path = test_socket("peer");
+        let _server = ControlServer::bind(&path, echo_handler()).unwrap();
+
+        let (uid, pid): (u32, i32) = request(&path, "whoami").unwrap();
+        assert_eq!(uid, nix::unistd::Uid::current().as_raw());
+        assert_eq!(pid, std::process::id() as i32);
+    }
+
+    #[test]
+    fn test_second_daemon_is_refused_and_socket_cleaned_up() {
+        let path = test_socket("exclusive");
+        let server = ControlServer::bind(&path, echo_handler()).unwrap();
+        assert!(ControlServer::bind(&path, echo_handler()).is_err());
+
+        drop(server);
+        assert!(!path.exists());
+    }
+
+    #[test]
+    fn test_request_without_daemon_fails() {
+        let err = request::<String>(&test_socket("missing"), "ping").unwrap_err();
+        assert!(err.to_string().contains("No running daemon"));
+    }
+}
@@ -7,18 +7,62 @@
 //!
 //! - `device`: Core domain logic (gamepads, capabilities, traits)
 //! - `platform`: Platform-specific implementations (Linux evdev)
+//! - `remote`: Network forwarding of controller input between machines
+//! - `action`: Side-effect actions (external plugins) triggered by mappings
+//! - `api`: Local HTTP/JSON API served by `blazeremap serve`
+//! - `metrics`/`ipc`: Pipeline instrumentation and the daemon control socket
+//! - `logging`: Terminal output and the daemons' rotated log files
+//! - `audit`: Append-only record of profile loads, grabs and requested changes
+//! - `exit`: The exit codes scripts branch on
+//! - `session`: Embeddable remap sessions for programs linking the library
+//! - `sync`: Profile sync with WebDAV, S3 and Git remotes
+//! - `trace`: Recorded controller input, for bug reports and tests
 //! - `cli`: User interface layer (CLI commands)
 //! - `app`: Application composition and wiring
+//!
+//! # Embedding
+//!
+//! Launchers and kiosk software can run a remap session in-process:
+//!
+//! ```no_run
+//! use blazeremap::{Profile, Session, SessionConfig};
+//!
+//! # fn main() -> anyhow::Result<()> {
+//! let pads = blazeremap::list_gamepads()?;
+//! let session = Session::start(SessionConfig {
+//!     devices: vec![pads.gamepad_info[0].path.clone()],
+//!     profile: Some(Profile::load_from_file("racing.toml".as_ref())?),
+//!     ..Default::default()
+//! })?;
+//! // ... later
+//! session.stop()?;
+//! # Ok(())
+//! # }
+//! ```
 
 // Public modules
+pub mod action;
+pub mod api;
 pub mod app;
+pub mod audit;
 pub mod cli;
 pub mod event;
+pub mod exit;
 pub mod input;
+pub mod ipc;
+pub mod logging;
 pub mod mapping;
+pub mod metrics;
 pub mod output;
 pub mod platform;
+pub mod remote;
+pub mod session;
+pub mod sync;
+pub mod trace;
 
 // Re-export commonly used types
 pub use input::gamepad::{Gamepad, GamepadInfo, GamepadType};
 pub use input::{InputDetectionResult, InputManager};
+pub use mapping::profile::Profile;
+pub use metrics::MetricsSnapshot;
+pub use session::{Session, SessionConfig, list_gamepads};
@@ -0,0 +1,488 @@
+// Logging
+//
+// Everything logs with `tracing`. Messages go to the terminal as they always
+// have, filtered by RUST_LOG. The daemons (`run` and `serve`) also keep a
+// log file, since they often run where nobody watches a terminal:
+//
+//   $XDG_STATE_HOME/blazeremap/blazeremap.log
+//
+// One JSON object per line, with the time, level, target and the event's
+// fields, at the level BLAZEREMAP_LOG sets (info by default). The file is
+// rotated when it grows past a size or gets older than a day: it becomes
+// blazeremap.log.1, the older ones move up one, and the oldest is dropped.
+// `blazeremap logs` reads them back.
+//
+// A daemon systemd started, with its output going to the journal, logs to
+// the journal instead of both: one entry per event, at the syslog priority
+// of its level, with its fields as journal fields (DEVICE, FRAMES, ...).
+// Daemon entries in either place also carry the session's context: a
+// SESSION_ID for the run, and the device and profile once known.
+
+use std::collections::BTreeMap;
+use std::ffi::OsString;
+use std::fmt::Display;
+use std::fs::{self, File, OpenOptions};
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::{Mutex, RwLock};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use serde_json::{Map, Value};
+use tracing::field::{Field, Visit};
+use tracing::{Event, Level, Subscriber};
+use tracing_subscriber::layer::{self, Layer, SubscriberExt};
+use tracing_subscriber::util::SubscriberInitExt;
+use tracing_subscriber::{EnvFilter, fmt};
+
+/// $XDG_STATE_HOME/blazeremap, where the logs are kept
+pub fn state_dir() -> Result<PathBuf> {
+    let state = match std::env::var_os("XDG_STATE_HOME") {
+        Some(dir) if !dir.is_empty() => PathBuf::from(dir),
+        _ => PathBuf::from(std::env::var_os("HOME").context("No home directory")?)
+            .join(".local")
+            .join("state"),
+    };
+    Ok(state.join("blazeremap"))
+}
+
+/// The daemons' log file
+pub fn log_path() -> Result<PathBuf> {
+    Ok(state_dir()?.join("blazeremap.log"))
+}
+
+/// When a log file is rotated, and how many old ones are kept
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Rotation {
+    pub max_bytes: u64,
+    /// None to rotate on size alone
+    pub max_age: Option<Duration>,
+    pub keep: usize,
+}
+
+impl Default for Rotation {
+    fn default() -> Self {
+        Self {
+            max_bytes: 10 * 1024 * 1024,
+            max_age: Some(Duration::from_secs(24 * 60 * 60)),
+            keep: 5,
+        }
+    }
+}
+
+/// `path` with `.n` added, where the `n`th newest old log goes
+pub fn rotated_path(path: &Path, n: usize) -> PathBuf {
+    let mut name = OsString::from(path.as_os_str());
+    name.push(format!(".{}", n));
+    PathBuf::from(name)
+}
+
+/// A log file that moves itself aside as `rotation` says
+pub struct RotatingFile {
+    path: PathBuf,
+    rotation: Rotation,
+    file: File,
+    size: u64,
+    started: SystemTime,
+}
+
+impl RotatingFile {
+    /// Append to the log at `path`, making its directory if needed
+    pub fn open(path: &Path, rotation: Rotation) -> Result<Self> {
+        if let Some(dir) = path.parent() {
+            fs::create_dir_all(dir)
+                .with_context(|| format!("Failed to create {}", dir.display()))?;
+        }
+        let file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .with_context(|| format!("Failed to open {}", path.display()))?;
+        let metadata = file.metadata()?;
+        // A file carried over from an earlier run is as old as its first line
+        let started = metadata.created().unwrap_or_else(|_| SystemTime::now());
+        Ok(Self { path: path.to_path_buf(), rotation, file, size: metadata.len(), started })
+    }
+
+    fn due(&self, incoming: usize) -> bool {
+        if self.size == 0 {
+            return false;
+        }
+        let too_big = self.size + incoming as u64 > self.rotation.max_bytes;
+        let age = SystemTime::now().duration_since(self.started).unwrap_or_default();
+        too_big || self.rotation.max_age.is_some_and(|max_age| age >= max_age)
+    }
+
+    fn rotate(&mut self) -> io::Result<()> {
+        let keep = self.rotation.keep;
+        for n in (1..keep).rev() {
+            match fs::rename(rotated_path(&self.path, n), rotated_path(&self.path, n + 1)) {
+                Err(e) if e.kind() != io::ErrorKind::NotFound => return Err(e),
+                _ => {}
+            }
+        }
+        if keep > 0 {
+            fs::rename(&self.path, rotated_path(&self.path, 1))?;
+        }
+        self.file = OpenOptions::new().create(true).write(true).truncate(true).open(&self.path)?;
+        self.size = 0;
+        self.started = SystemTime::now();
+        Ok(())
+    }
+}
+
+impl Write for RotatingFile {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        if self.due(buf.len()) {
+            self.rotate()?;
+        }
+        let written = self.file.write(buf)?;
+        self.size += written as u64;
+        Ok(written)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.file.flush()
+    }
+}
+
+/// Fields added to every daemon log entry, by name
+static CONTEXT: RwLock<BTreeMap<&'static str, String>> = RwLock::new(BTreeMap::new());
+
+/// Add `name` to every log entry from now on, replacing an earlier value
+pub fn set_context(name: &'static str, value: impl Display) {
+    if let Ok(mut context) = CONTEXT.write() {
+        context.insert(name, value.to_string());
+    }
+}
+
+/// The daemon's session id, as its log entries carry it
+pub fn session_id() -> Option<String> {
+    CONTEXT.read().ok().and_then(|context| context.get("session_id").cloned())
+}
+
+fn context() -> Vec<(&'static str, String)> {
+    CONTEXT.read().map(|context| context.clone().into_iter().collect()).unwrap_or_default()
+}
+
+/// 16 hex digits telling one daemon run's entries from the next's
+fn new_session_id() -> String {
+    let mut id = [0u8; 8];
+    if getrandom::fill(&mut id).is_err() {
+        let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap_or_default();
+        id = (now.as_nanos() as u64 ^ u64::from(std::process::id())).to_le_bytes();
+    }
+    id.iter().map(|byte| format!("{:02x}", byte)).collect()
+}
+
+/// Writes each event as a line of JSON
+struct JsonLayer<W> {
+    out: Mutex<W>,
+}
+
+impl<S: Subscriber, W: Write + 'static> Layer<S> for JsonLayer<W> {
+    fn on_event(&self, event: &Event<'_>, _: layer::Context<'_, S>) {
+        let metadata = event.metadata();
+        let mut line = Map::new();
+        line.insert("time".to_string(), utc_time(SystemTime::now()).into());
+        line.insert("level".to_string(), metadata.level().as_str().into());
+        line.insert("target".to_string(), metadata.target().into());
+        for (name, value) in context() {
+            line.insert(name.to_string(), value.into());
+        }
+        event.record(&mut JsonFields(&mut line));
+        let Ok(mut out) = self.out.lock() else {
+            return;
+        };
+        // Nowhere left to report a failing log
+        let _ = writeln!(out, "{}", Value::Object(line));
+    }
+}
+
+struct JsonFields<'a>(&'a mut Map<String, Value>);
+
+impl Visit for JsonFields<'_> {
+    fn record_f64(&mut self, field: &Field, value: f64) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_i64(&mut self, field: &Field, value: i64) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_u64(&mut self, field: &Field, value: u64) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_bool(&mut self, field: &Field, value: bool) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.0.insert(field.name().to_string(), value.into());
+    }
+
+    fn record_debug(&mut self, field: &Field, value: &dyn std::fmt::Debug) {
+        self.0.insert(field.name().to_string(), format!("{:?}", value).into());
+    }
+}
+
+/// The syslog priority journald files a `level` under
+fn priority(level: &Level) -> u8 {
+    match *level {
+        Level::ERROR => 3,
+        Level::WARN => 4,
+        Level::INFO => 6,
+        Level::DEBUG | Level::TRACE => 7,
+    }
+}
+
+type SendEntry = Box<dyn Fn(&[(String, String)]) + Send + Sync>;
+
+/// Sends each event as a journal entry of `(name, value)` fields; `send`
+/// makes the names journal field names
+struct JournalLayer {
+    send: SendEntry,
+}
+
+impl<S: Subscriber> Layer<S> for JournalLayer {
+    fn on_event(&self, event: &Event<'_>, _: layer::Context<'_, S>) {
+        let metadata = event.metadata();
+        let mut fields = vec![
+            ("PRIORITY".to_string(), priority(metadata.level()).to_string()),
+            ("SYSLOG_IDENTIFIER".to_string(), "blazeremap".to_string()),
+            ("TARGET".to_string(), metadata.target().to_string()),
+        ];
+        if let (Some(file), Some(line)) = (metadata.file(), metadata.line()) {
+            fields.push(("CODE_FILE".to_string(), file.to_string()));
+            fields.push(("CODE_LINE".to_string(), line.to_string()));
+        }
+        let mut own = Vec::new();
+        event.record(&mut TextFields(&mut own));
+        // The event's own fields win over the context's
+        for (name, value) in context() {
+            if !own.iter().any(|(field, _)| field == name) {
+                fields.push((name.to_string(), value));
+            }
+        }
+        fields.append(&mut own);
+        (self.send)(&fields);
+    }
+}
+
+struct TextFields<'a>(&'a mut Vec<(String, String)>);
+
+impl Visit for TextFields<'_> {
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.0.push((field.name().to_string(), value.to_string()));
+    }
+
+    fn record_debug(&mut self, field: &Field, value: &dyn std::fmt::Debug) {
+        self.0.push((field.name().to_string(), format!("{:?}", value)));
+    }
+}
+
+/// The journal, when systemd made it our output
+fn journal() -> Option<JournalLayer> {
+    #[cfg(target_os = "linux")]
+    {
+        use crate::platform::linux::journal::{self, Journal};
+
+        if !journal::is_journal_stream() {
+            return None;
+        }
+        match Journal::connect() {
+            Ok(journal) => {
+                let send = move |fields: &[(String, String)]| {
+                    // Nowhere left to report a failing log
+                    let _ = journal.send(fields.iter().map(|(n, v)| (n.as_str(), v.as_str())));
+                };
+                return Some(JournalLayer { send: Box::new(send) });
+            }
+            Err(e) => eprintln!("Warning: not logging to the journal: {}", e),
+        }
+    }
+    None
+}
+
+/// Log to the terminal; a `daemon` also logs to the log file, or under
+/// systemd to the journal alone
+///
+/// A log file that can't be opened is reported and done without.
+pub fn init(daemon: bool) {
+    let journal = match daemon {
+        true => journal(),
+        false => None,
+    };
+    let daemon_filter =
+        || EnvFilter::try_from_env("BLAZEREMAP_LOG").unwrap_or_else(|_| EnvFilter::new("info"));
+    // The journal gets our terminal output too; it's had the entry already
+    let terminal =
+        journal.is_none().then(|| fmt::layer().with_filter(EnvFilter::from_default_env()));
+    let file = match daemon && journal.is_none() {
+        true => match log_path().and_then(|path| RotatingFile::open(&path, Rotation::default())) {
+            Ok(file) => Some(file),
+            Err(e) => {
+                eprintln!("Warning: not keeping a log file: {:#}", e);
+                None
+            }
+        },
+        false => None,
+    };
+    let file = file.map(|file| JsonLayer { out: Mutex::new(file) }.with_filter(daemon_filter()));
+    let journal = journal.map(|journal| journal.with_filter(daemon_filter()));
+    if daemon {
+        set_context("session_id", new_session_id());
+    }
+    // Fails only if something set a subscriber already, which then logs
+    let _ = tracing_subscriber::registry().with(terminal).with(file).with(journal).try_init();
+}
+
+/// `time` as UTC in RFC 3339, like 2026-10-16T08:30:00.250Z
+pub fn utc_time(time: SystemTime) -> String {
+    let since = time.duration_since(UNIX_EPOCH).unwrap_or_default();
+    let secs = since.as_secs();
+    let (days, rest) = ((secs / 86_400) as i64, secs % 86_400);
+    // Days to a civil date, after Howard Hinnant's days_from_civil inverse
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let doe = z.rem_euclid(146_097);
+    let yoe = (doe - doe / 1460 + doe / 36_524 - doe / 146_096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + i64::from(month <= 2);
+    format!(
+        "{:04}-{:02}-{:02}T{:02}:{:02}:{:02}.{:03}Z",
+        year,
+        month,
+        day,
+        rest / 3600,
+        rest / 60 % 60,
+        rest % 60,
+        since.subsec_millis()
+    )
+}
+
+/// A log line as a person reads it: time, level, target, message and the
+/// other fields; lines that aren't JSON as they are
+pub fn format_line(line: &str) -> String {
+    let Ok(Value::Object(mut fields)) = serde_json::from_str::<Value>(line) else {
+        return line.to_string();
+    };
+    let mut take = |name: &str| fields.remove(name).map(plain).unwrap_or_default();
+    let (time, level, target, message) =
+        (take("time"), take("level"), take("target"), take("message"));
+    let mut text = format!("{} {:>5} {}: {}", time, level, target, message);
+    for (name, value) in fields {
+        text.push_str(&format!(" {}={}", name, plain(value)));
+    }
+    text
+}
+
+/// Strings without their quotes, anything else as JSON
+fn plain(value: Value) -> String {
+    match value {
+        Value::String(text) => text,
+        other => other.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_rotates_on_size_and_keeps_the_newest() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-log-{}", std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        let path = dir.join("blazeremap.log");
+        let rotation = Rotation { max_bytes: 10, max_age: None, keep: 2 };
+        let mut log = RotatingFile::open(&path, rotation).unwrap();
+        for line in ["first\n", "second\n", "third\n", "fourth\n"] {
+            log.write_all(line.as_bytes()).unwrap();
+        }
+
+        let read = |path: &Path| fs::read_to_string(path).unwrap();
+        assert_eq!(read(&path), "fourth\n");
+        assert_eq!(read(&rotated_path(&path, 1)), "third\n");
+        assert_eq!(read(&rotated_path(&path, 2)), "second\n");
+        assert!(!rotated_path(&path, 3).exists());
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_events_logged_as_json() {
+        #[derive(Clone, Default)]
+        struct Shared(std::sync::Arc<Mutex<Vec<u8>>>);
+
+        impl Write for Shared {
+            fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+                self.0.lock().unwrap().write(buf)
+            }
+            fn flush(&mut self) -> io::Result<()> {
+                Ok(())
+            }
+        }
+
+        let out = Shared::default();
+        let subscriber =
+            tracing_subscriber::registry().with(JsonLayer { out: Mutex::new(out.clone()) });
+        tracing::subscriber::with_default(subscriber, || {
+            tracing::warn!(frames = 3, device = "p2", "No virtual mouse");
+        });
+
+        let text = String::from_utf8(out.0.lock().unwrap().clone()).unwrap();
+        let line: Value = serde_json::from_str(text.trim_end()).unwrap();
+        assert_eq!(line["level"], "WARN");
+        assert_eq!(line["target"], "blazeremap::logging::tests");
+        assert_eq!(line["message"], "No virtual mouse");
+        assert_eq!((&line["frames"], &line["device"]), (&Value::from(3), &Value::from("p2")));
+    }
+
+    #[test]
+    fn test_events_sent_to_the_journal() {
+        let entries = std::sync::Arc::new(Mutex::new(Vec::new()));
+        let sent = std::sync::Arc::clone(&entries);
+        let send = move |fields: &[(String, String)]| sent.lock().unwrap().push(fields.to_vec());
+        let subscriber = tracing_subscriber::registry().with(JournalLayer { send: Box::new(send) });
+        tracing::subscriber::with_default(subscriber, || {
+            tracing::error!(device = "/dev/input/event3", "Controller gone");
+        });
+
+        let entries = entries.lock().unwrap();
+        let field = |name: &str| {
+            entries[0].iter().find(|(field, _)| field == name).map(|(_, value)| value.as_str())
+        };
+        assert_eq!(field("PRIORITY"), Some("3"));
+        assert_eq!(field("SYSLOG_IDENTIFIER"), Some("blazeremap"));
+        assert_eq!(field("message"), Some("Controller gone"));
+        assert_eq!(field("device"), Some("/dev/input/event3"));
+    }
+
+    #[test]
+    fn test_priorities() {
+        let priorities = [Level::ERROR, Level::WARN, Level::INFO, Level::DEBUG, Level::TRACE]
+            .map(|level| priority(&level));
+        assert_eq!(priorities, [3, 4, 6, 7, 7]);
+        assert_eq!(new_session_id().len(), 16);
+    }
+
+    #[test]
+    fn test_utc_time() {
+        assert_eq!(utc_time(UNIX_EPOCH), "1970-01-01T00:00:00.000Z");
+        let leap_day = UNIX_EPOCH + Duration::from_millis(1_709_210_096_250);
+        assert_eq!(utc_time(leap_day), "2024-02-29T12:34:56.250Z");
+    }
+
+    #[test]
+    fn test_json_lines_read_back() {
+        let line = r#"{"time":"2026-10-16T08:30:00.000Z","level":"WARN","target":"blazeremap::output::devices","message":"No virtual mouse","frames":3}"#;
+        assert_eq!(
+            format_line(line),
+            "2026-10-16T08:30:00.000Z  WARN blazeremap::output::devices: No virtual mouse frames=3"
+        );
+        assert_eq!(format_line("not json"), "not json");
+    }
+}
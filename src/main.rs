@@ -1,12 +1,11 @@
 // Binary entry point for BlazeRemap
 use blazeremap::app::App;
 use blazeremap::event::init_time_anchor;
+use blazeremap::exit::ExitCode;
 use std::process;
 
 fn main() {
-    // Initialize logging
-    tracing_subscriber::fmt::init();
-
+    // Logging starts once the command is known (see cli::execute)
     init_time_anchor();
 
     // Run the app and exit with appropriate code
@@ -18,10 +17,10 @@ fn run() -> i32 {
     let app = App::new();
 
     match app.run() {
-        Ok(_) => 0,
+        Ok(_) => ExitCode::Success.code(),
         Err(e) => {
-            eprintln!("Error: {}", e);
-            1
+            eprintln!("Error: {:#}", e);
+            ExitCode::of(&e).code()
         }
     }
 }
@@ -0,0 +1,327 @@
+// Profile bundles: a profile and what it needs, in one file to share
+//
+// `profile pack` writes a `.blazeremap` bundle. It's TOML, so it survives
+// being pasted into a forum post:
+//
+//   bundle = 1
+//   [metadata]   who made it, for which controller and game
+//   [profile]    file name and the profile's text, untouched so seals hold
+//   [[files]]    scripts its plugins and exec mappings run, in base64
+//
+// A file is bundled when a plugin's command or args, or an exec mapping's
+// command, names a relative path that exists next to the profile. Unpacking
+// writes everything back relative to the profile and refuses paths that
+// would leave the directory it's unpacked into.
+
+use anyhow::{Context, Result};
+use base64::{Engine, engine::general_purpose::STANDARD as BASE64};
+use serde::{Deserialize, Serialize};
+use std::path::{Component, Path, PathBuf};
+
+use crate::mapping::{format::ProfileFormat, integrity::sha256_hex, profile::Profile};
+
+/// Extension of bundle files
+pub const EXTENSION: &str = "blazeremap";
+
+/// Version of the layout above
+pub const BUNDLE_VERSION: u32 = 1;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Bundle {
+    pub bundle: u32,
+    #[serde(default)]
+    pub metadata: Metadata,
+    pub profile: BundledProfile,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub files: Vec<BundledFile>,
+}
+
+/// What a bundle is for; all optional, for people browsing a forum
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Metadata {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub author: Option<String>,
+    /// Controller the layout was made for, e.g. "Xbox Elite"
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub controller: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub game: Option<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct BundledProfile {
+    /// File name, whose extension gives the format
+    pub file: String,
+    pub text: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct BundledFile {
+    /// Relative to the profile
+    pub path: String,
+    #[serde(default)]
+    pub executable: bool,
+    /// Hex SHA-256 of the contents, to catch bundles mangled in transit
+    pub sha256: String,
+    /// Base64
+    pub contents: String,
+}
+
+impl Bundle {
+    /// Bundle the profile at `path` with the files it references
+    ///
+    /// `metadata.game` defaults to the profile's `game_name`.
+    pub fn pack(path: &Path, mut metadata: Metadata) -> Result<Self> {
+        let text = std::fs::read_to_string(path).context("Failed to read profile file")?;
+        let file = path
+            .file_name()
+            .and_then(|name| name.to_str())
+            .context("Profile file name isn't valid UTF-8")?
+            .to_string();
+        // Don't share something that doesn't load
+        let profile = Profile::decode(&text, ProfileFormat::from_path(path))
+            .with_context(|| format!("Failed to load profile {}", path.display()))?;
+        metadata.game = metadata.game.or(profile.game_name.clone());
+
+        let dir = path.parent().unwrap_or(Path::new("."));
+        let mut files: Vec<BundledFile> = Vec::new();
+        for reference in referenced_paths(&profile) {
+            let source = dir.join(reference);
+            let Some(path) = normalized(reference) else { continue };
+            if !source.is_file() || files.iter().any(|file| file.path == path) {
+                continue;
+            }
+            let contents = std::fs::read(&source)
+                .with_context(|| format!("Failed to read {}", source.display()))?;
+            files.push(BundledFile {
+                path,
+                executable: is_executable(&source)?,
+                sha256: sha256_hex(&contents),
+                contents: BASE64.encode(&contents),
+            });
+        }
+        Ok(Self { bundle: BUNDLE_VERSION, metadata, profile: BundledProfile { file, text }, files })
+    }
+
+    pub fn parse(text: &str) -> Result<Self> {
+        let bundle: Self = toml::from_str(text).context("Failed to parse bundle")?;
+        if bundle.bundle > BUNDLE_VERSION {
+            anyhow::bail!(
+                "Bundle version {} is newer than this BlazeRemap supports ({})",
+                bundle.bundle,
+                BUNDLE_VERSION
+            );
+        }
+        Ok(bundle)
+    }
+
+    pub fn to_text(&self) -> Result<String> {
+        toml::to_string_pretty(self).context("Failed to serialize bundle")
+    }
+
+    /// Write the profile and its files into `dir`; returns the paths written,
+    /// profile first
+    ///
+    /// Everything is checked before anything is written. Existing files are
+    /// only replaced with `overwrite`.
+    pub fn unpack(&self, dir: &Path, overwrite: bool) -> Result<Vec<PathBuf>> {
+        let profile_path = match normalized(&self.profile.file) {
+            Some(file) if !file.contains('/') => dir.join(file),
+            _ => anyhow::bail!("Bundled profile name '{}' isn't a file name", self.profile.file),
+        };
+        Profile::decode(&self.profile.text, ProfileFormat::from_path(&profile_path))
+            .context("Bundled profile doesn't load")?;
+
+        let mut writes = vec![(profile_path, self.profile.text.as_bytes().to_vec(), false)];
+        for file in &self.files {
+            let Some(path) = normalized(&file.path) else {
+                anyhow::bail!(
+                    "Bundled file '{}' would be written outside {}",
+                    file.path,
+                    dir.display()
+                );
+            };
+            let contents = BASE64
+                .decode(file.contents.trim())
+                .ok()
+                .filter(|contents| file.sha256.eq_ignore_ascii_case(&sha256_hex(contents)))
+                .with_context(|| format!("Bundled file '{}' is damaged", file.path))?;
+            writes.push((dir.join(path), contents, file.executable));
+        }
+        if !overwrite && let Some((path, ..)) = writes.iter().find(|(path, ..)| path.exists()) {
+            anyhow::bail!("{} already exists", path.display());
+        }
+
+        for (path, contents, executable) in &writes {
+            if let Some(parent) = path.parent() {
+                std::fs::create_dir_all(parent)?;
+            }
+            std::fs::write(path, contents)
+                .with_context(|| format!("Failed to write {}", path.display()))?;
+            if *executable {
+                set_executable(path)?;
+            }
+        }
+        Ok(writes.into_iter().map(|(path, ..)| path).collect())
+    }
+}
+
+/// Arguments of the profile's commands that could be files next to it
+fn referenced_paths(profile: &Profile) -> impl Iterator<Item = &str> {
+    let plugins =
+        profile.plugins.iter().flat_map(|plugin| [&plugin.command].into_iter().chain(&plugin.args));
+    let commands = profile.action_mappings().flat_map(|mapping| &mapping.command);
+    plugins.chain(commands).map(String::as_str)
+}
+
+/// `path` with `.` segments dropped and `/` separators, if it's relative and
+/// stays below where it's relative to
+fn normalized(path: &str) -> Option<String> {
+    let mut segments = Vec::new();
+    for component in Path::new(path).components() {
+        match component {
+            Component::Normal(segment) => segments.push(segment.to_str()?),
+            Component::CurDir => {}
+            Component::ParentDir | Component::RootDir | Component::Prefix(_) => return None,
+        }
+    }
+    (!segments.is_empty()).then(|| segments.join("/"))
+}
+
+#[cfg(unix)]
+fn is_executable(path: &Path) -> Result<bool> {
+    use std::os::unix::fs::PermissionsExt;
+    Ok(std::fs::metadata(path)?.permissions().mode() & 0o111 != 0)
+}
+
+#[cfg(not(unix))]
+fn is_executable(_path: &Path) -> Result<bool> {
+    Ok(false)
+}
+
+#[cfg(unix)]
+fn set_executable(path: &Path) -> Result<()> {
+    use std::os::unix::fs::PermissionsExt;
+    let mut permissions = std::fs::metadata(path)?.permissions();
+    permissions.set_mode(permissions.mode() | 0o755);
+    Ok(std::fs::set_permissions(path, permissions)?)
+}
+
+#[cfg(not(unix))]
+fn set_executable(_path: &Path) -> Result<()> {
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PROFILE: &str = r#"# Alt+Tab on the guide button
+schema_version = 1
+name = "Desktop"
+description = "Window switching"
+game_name = "Any"
+
+[[plugins]]
+name = "lights"
+command = "./plugins/lights.py"
+args = ["--config", "lights.json", "--verbose"]
+
+[[mappings]]
+source_name = "Mode"
+target_type = "Exec"
+command = ["./alttab.sh", "/usr/bin/env"]
+"#;
+
+    fn temp_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("blazeremap-{}-{}", name, std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    #[test]
+    fn test_pack_and_unpack() {
+        let dir = temp_dir("pack");
+        std::fs::create_dir_all(dir.join("plugins")).unwrap();
+        std::fs::write(dir.join("desktop.toml"), PROFILE).unwrap();
+        std::fs::write(dir.join("plugins/lights.py"), "print('hi')").unwrap();
+        std::fs::write(dir.join("lights.json"), "{}").unwrap();
+        std::fs::write(dir.join("alttab.sh"), "#!/bin/sh\n").unwrap();
+        set_executable(&dir.join("alttab.sh")).unwrap();
+
+        let metadata = Metadata { author: Some("sam".to_string()), ..Default::default() };
+        let bundle = Bundle::pack(&dir.join("desktop.toml"), metadata).unwrap();
+        assert_eq!(bundle.metadata.game.as_deref(), Some("Any"));
+        let paths: Vec<_> = bundle.files.iter().map(|file| file.path.as_str()).collect();
+        assert_eq!(paths, ["plugins/lights.py", "lights.json", "alttab.sh"]);
+        assert!(bundle.files[2].executable && !bundle.files[1].executable);
+
+        let text = bundle.to_text().unwrap();
+        let out = temp_dir("unpack");
+        let written = Bundle::parse(&text).unwrap().unpack(&out, false).unwrap();
+        assert_eq!(written[0], out.join("desktop.toml"));
+        // Byte for byte, so comments and seals survive
+        assert_eq!(std::fs::read_to_string(&written[0]).unwrap(), PROFILE);
+        assert_eq!(std::fs::read_to_string(out.join("plugins/lights.py")).unwrap(), "print('hi')");
+        assert!(is_executable(&out.join("alttab.sh")).unwrap());
+
+        let err = Bundle::parse(&text).unwrap().unpack(&out, false).unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            format!("{} already exists", out.join("desktop.toml").display())
+        );
+        Bundle::parse(&text).unwrap().unpack(&out, true).unwrap();
+
+        std::fs::remove_dir_all(&dir).unwrap();
+        std::fs::remove_dir_all(&out).unwrap();
+    }
+
+    #[test]
+    fn test_unpack_refuses_bad_bundles() {
+        let dir = temp_dir("bad-bundle");
+        let unpack = |file: &str, path: &str, contents: &str| {
+            let bundle = Bundle {
+                bundle: BUNDLE_VERSION,
+                metadata: Metadata::default(),
+                profile: BundledProfile { file: file.to_string(), text: PROFILE.to_string() },
+                files: vec![BundledFile {
+                    path: path.to_string(),
+                    executable: false,
+                    sha256: sha256_hex(b"hi"),
+                    contents: BASE64.encode(contents),
+                }],
+            };
+            bundle.unpack(&dir, false).unwrap_err().to_string()
+        };
+        assert_eq!(
+            unpack("../desktop.toml", "a.sh", "hi"),
+            "Bundled profile name '../desktop.toml' isn't a file name"
+        );
+        assert_eq!(
+            unpack("desktop.toml", "../../.bashrc", "hi"),
+            format!("Bundled file '../../.bashrc' would be written outside {}", dir.display())
+        );
+        assert_eq!(unpack("desktop.toml", "a.sh", "rm -rf ~"), "Bundled file 'a.sh' is damaged");
+        assert!(!dir.join("desktop.toml").exists(), "nothing is written unless all is well");
+        std::fs::remove_dir_all(&dir).unwrap();
+
+        let newer = "bundle = 2\n[profile]\nfile = \"a.toml\"\ntext = \"\"\n";
+        assert_eq!(
+            Bundle::parse(newer).unwrap_err().to_string(),
+            "Bundle version 2 is newer than this BlazeRemap supports (1)"
+        );
+    }
+
+    #[test]
+    fn test_normalized() {
+        assert_eq!(normalized("./plugins/./x.py").as_deref(), Some("plugins/x.py"));
+        assert_eq!(normalized("x.py").as_deref(), Some("x.py"));
+        assert_eq!(normalized("/usr/bin/env"), None);
+        assert_eq!(normalized("a/../../b"), None);
+        assert_eq!(normalized("."), None);
+    }
+}
@@ -0,0 +1,201 @@
+// Runtime context for conditional mappings
+//
+// A mapping with `conditions` only applies while they hold, so one profile
+// can e.g. map South differently in a browser or once the battery runs low.
+// The context is sampled off the input path by a `ContextWatcher`; the
+// mapper picks changes up between frames and the engine swaps its table.
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::sync::mpsc::{self, RecvTimeoutError};
+use std::sync::{Arc, Mutex};
+use std::thread::JoinHandle;
+use std::time::Duration;
+
+use crate::mapping::profile::Profile;
+
+/// How often the watcher samples when nobody says otherwise
+pub const DEFAULT_CONTEXT_INTERVAL: Duration = Duration::from_secs(1);
+
+/// What conditions are checked against
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct MappingContext {
+    /// Title of the focused window, if it could be found out
+    pub window: Option<String>,
+    /// The controller is connected over Bluetooth
+    pub bluetooth: bool,
+    /// Controller battery charge in percent, if it reports one
+    pub battery: Option<u8>,
+}
+
+/// When a mapping applies; every condition set must hold
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Conditions {
+    /// Case-insensitive part of the focused window's title
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub window: Option<String>,
+
+    /// Connected over Bluetooth (true) or not (false)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub bluetooth: Option<bool>,
+
+    /// Battery charge below this percentage
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub battery_below: Option<u8>,
+}
+
+impl Conditions {
+    /// Unknown window titles and battery levels never match
+    pub fn matches(&self, context: &MappingContext) -> bool {
+        let window = self.window.as_ref().is_none_or(|part| {
+            context
+                .window
+                .as_ref()
+                .is_some_and(|title| title.to_lowercase().contains(&part.to_lowercase()))
+        });
+        let bluetooth = self.bluetooth.is_none_or(|wanted| wanted == context.bluetooth);
+        let battery = self
+            .battery_below
+            .is_none_or(|limit| context.battery.is_some_and(|level| level < limit));
+        window && bluetooth && battery
+    }
+}
+
+/// Samples the context on its own thread
+///
+/// Stops when dropped.
+pub struct ContextWatcher {
+    pending: Arc<Mutex<Option<MappingContext>>>,
+    stop: Option<mpsc::Sender<()>>,
+    thread: Option<JoinHandle<()>>,
+}
+
+impl ContextWatcher {
+    /// Watch the controller at `device`, if the profile has conditional mappings
+    pub fn for_profile(profile: &Profile, device: &str) -> Result<Option<Self>> {
+        let mut conditions =
+            profile.mappings.iter().filter_map(|m| m.conditions.as_ref()).peekable();
+        if conditions.peek().is_none() {
+            return Ok(None);
+        }
+        let window = conditions.any(|c| c.window.is_some());
+        let probe = crate::platform::context_probe(device, window);
+        Self::spawn(DEFAULT_CONTEXT_INTERVAL, probe).map(Some)
+    }
+
+    /// Call `probe` every `interval`; the first sample is taken right away
+    pub fn spawn<F>(interval: Duration, mut probe: F) -> Result<Self>
+    where
+        F: FnMut() -> MappingContext + Send + 'static,
+    {
+        let pending = Arc::new(Mutex::new(None));
+        let (stop, stopped) = mpsc::channel::<()>();
+        let thread = std::thread::Builder::new()
+            .name("blazeremap-context".to_string())
+            .spawn({
+                let pending = Arc::clone(&pending);
+                move || {
+                    let mut last = None;
+                    loop {
+                        let context = probe();
+                        if last.as_ref() != Some(&context) {
+                            tracing::debug!("Context changed: {:?}", context);
+                            *pending.lock().unwrap() = Some(context.clone());
+                            last = Some(context);
+                        }
+                        if stopped.recv_timeout(interval) != Err(RecvTimeoutError::Timeout) {
+                            break;
+                        }
+                    }
+                }
+            })
+            .context("Failed to start context watcher")?;
+
+        Ok(Self { pending, stop: Some(stop), thread: Some(thread) })
+    }
+
+    /// The context, if it changed since the last call
+    ///
+    /// Never blocks; a sample being stored right now is picked up next time.
+    pub fn changed(&self) -> Option<MappingContext> {
+        self.pending.try_lock().ok()?.take()
+    }
+}
+
+impl Drop for ContextWatcher {
+    fn drop(&mut self) {
+        drop(self.stop.take());
+        if let Some(thread) = self.thread.take() {
+            let _ = thread.join();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::time::Instant;
+
+    #[test]
+    fn test_conditions_match() {
+        let context = MappingContext {
+            window: Some("Steam - Big Picture".to_string()),
+            bluetooth: true,
+            battery: Some(15),
+        };
+        let conditions = |toml: &str| toml::from_str::<Conditions>(toml).unwrap();
+
+        assert!(conditions("").matches(&context));
+        assert!(conditions("window = \"big picture\"").matches(&context));
+        assert!(!conditions("window = \"firefox\"").matches(&context));
+        assert!(conditions("bluetooth = true\nbattery_below = 20").matches(&context));
+        assert!(!conditions("bluetooth = true\nbattery_below = 15").matches(&context));
+        assert!(!conditions("bluetooth = false").matches(&context));
+
+        // Nothing known about window or battery
+        let unknown = MappingContext::default();
+        assert!(!conditions("window = \"steam\"").matches(&unknown));
+        assert!(!conditions("battery_below = 100").matches(&unknown));
+        assert!(conditions("bluetooth = false").matches(&unknown));
+    }
+
+    #[test]
+    fn test_unknown_condition_is_rejected() {
+        assert!(toml::from_str::<Conditions>("battery_above = 50").is_err());
+    }
+
+    #[test]
+    fn test_watcher_reports_changes_once() {
+        let bluetooth = Arc::new(AtomicBool::new(false));
+        let watcher = ContextWatcher::spawn(Duration::from_millis(5), {
+            let bluetooth = Arc::clone(&bluetooth);
+            move || MappingContext {
+                bluetooth: bluetooth.load(Ordering::Relaxed),
+                ..Default::default()
+            }
+        })
+        .unwrap();
+        let next = || {
+            let deadline = Instant::now() + Duration::from_secs(5);
+            loop {
+                if let Some(context) = watcher.changed() {
+                    return Some(context.bluetooth);
+                }
+                if Instant::now() > deadline {
+                    return None;
+                }
+                std::thread::sleep(Duration::from_millis(1));
+            }
+        };
+
+        assert_eq!(next(), Some(false));
+        bluetooth.store(true, Ordering::Relaxed);
+        assert_eq!(next(), Some(true));
+
+        // Unchanged samples aren't reported again
+        std::thread::sleep(Duration::from_millis(30));
+        assert_eq!(watcher.changed(), None);
+    }
+}
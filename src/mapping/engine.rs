@@ -1,297 +1,2339 @@
-use std::collections::HashMap;
+use std::time::{Duration, Instant};
 
-use anyhow::Result;
+use anyhow::{Context, Result};
 
 use crate::{
     event::{
-        AxisCode, AxisDirection, ButtonCode, InputEvent, KeyboardCode, KeyboardEventType,
-        OutputEvent,
+        ActionEvent, ActionSource, AxisCode, AxisDirection, ButtonCode, InputEvent, KeyboardCode,
+        KeyboardEventType, OutputEvent, Switch,
     },
     mapping::{
-        MappingRule::{self, AxisDirectionToKey, ButtonToKey},
+        Mapping, MappingRule,
+        context::{Conditions, MappingContext},
+        hotkey::{Chord, ProfileSwitcher},
+        layout::Layout,
         profile::Profile,
+        script::{Script, ScriptInput},
+        table::{Mirror, Repeat, RuleTable},
+        types::{DesktopAction, FlickTarget, RoutedTarget, TargetType},
     },
+    output::identity::{DeviceIdentities, DeviceKind},
 };
 
+/// How soon after leaving rest a stick has to pass a flick's threshold;
+/// slower is a push, and fires nothing
+const FLICK_TIME: Duration = Duration::from_millis(200);
+
 pub struct MappingEngine {
-    button_rules: HashMap<ButtonCode, KeyboardCode>,
-    axis_rules: HashMap<(AxisCode, AxisDirection), KeyboardCode>,
-    axis_states: HashMap<AxisCode, i32>, // Track current axis values
+    rules: RuleTable,
+    axis_states: [i32; AxisCode::ALL.len()], // Track current axis values
+    button_states: [bool; ButtonCode::ALL.len()],
+    // The controller as it is; the states above are as mirrors make it appear
+    physical_axes: [i32; AxisCode::ALL.len()],
+    physical_buttons: [bool; ButtonCode::ALL.len()],
+    debounce: [DebounceState; ButtonCode::ALL.len()],
+    debounced: u64,
+    // Minimum hold time, and when each button still short of it was pressed
+    slow_keys: Duration,
+    held_back: [Option<Instant>; ButtonCode::ALL.len()],
+    // Controls swapped before anything else sees them
+    layout: Layout,
+    // Left and right analog triggers read as their buttons, when set
+    triggers: [Option<TriggerButton>; 2],
+    // The key repeating while held, and the time of the event being mapped
+    repeating: Option<Repeating>,
+    now: Instant,
+    // Actions triggered since the last `drain_actions`
+    actions: Vec<ActionEvent>,
+    scripts: Vec<Script>,
+    // Keys each script pressed, released with its source
+    script_keys: Vec<Vec<KeyboardCode>>,
+    context: MappingContext,
+    // Kept to rebuild `rules` on context changes; None without conditions
+    conditional: Option<CompiledRules>,
+    // Keys latched by sticky mappings, with the button that latched each
+    sticky: Vec<(ButtonCode, KeyboardCode)>,
+    // The press that lets go of the latched keys once it's over
+    sticky_release: Option<ActionSource>,
+    sticky_changed: bool,
+    // Layer and mapping switches since the last `drain_switches`
+    switches: Vec<Switch>,
+    // Profiles the controller's hotkeys switch among, if any
+    switcher: Option<ProfileSwitcher>,
+    // Each axis's progress through a flick
+    flicks: [FlickState; AxisCode::ALL.len()],
+}
+
+/// A profile's rules before conditions are applied
+struct CompiledRules {
+    rules: Vec<MappingRule>,
+    // Parallel to `rules`; None applies everywhere
+    conditions: Vec<Option<Conditions>>,
+    // Later entries win
+    debounce: Vec<(ButtonCode, u32)>,
+    sticky: Vec<ButtonCode>,
+    repeat: Vec<(ActionSource, Option<Repeat>)>,
+}
+
+impl CompiledRules {
+    fn is_conditional(&self) -> bool {
+        self.conditions.iter().any(Option::is_some)
+    }
+
+    /// Whether any rule applies in one context but not the other
+    fn differ(&self, a: &MappingContext, b: &MappingContext) -> bool {
+        self.conditions.iter().flatten().any(|c| c.matches(a) != c.matches(b))
+    }
+
+    /// The lookup table for the rules active in `context`
+    fn table(&self, context: &MappingContext) -> RuleTable {
+        let active = self.rules.iter().zip(&self.conditions).filter_map(|(rule, conditions)| {
+            conditions.as_ref().is_none_or(|c| c.matches(context)).then_some(rule)
+        });
+        let mut table = RuleTable::compile(active);
+        for &(code, window_ms) in &self.debounce {
+            table.set_debounce(code, window_ms);
+        }
+        for &code in &self.sticky {
+            table.set_sticky(code, true);
+        }
+        for &(source, repeat) in &self.repeat {
+            table.set_repeat(source, repeat);
+        }
+        table
+    }
+}
+
+/// Key, mouse or gamepad control, script and action a held control triggered
+type HeldTargets = (Option<KeyboardCode>, Option<RoutedTarget>, Option<usize>, Option<usize>);
+
+/// A held key, due to repeat at `next`
+#[derive(Debug, Clone, Copy)]
+struct Repeating {
+    source: ActionSource,
+    key: KeyboardCode,
+    next: Instant,
+    interval: Duration,
+}
+
+/// An analog trigger standing in for its button
+#[derive(Debug, Clone, Copy)]
+struct TriggerButton {
+    press: i32,
+    release: i32,
+    down: bool,
+}
+
+impl TriggerButton {
+    /// Each trigger button, with the axis it's read from
+    const ALL: [(ButtonCode, AxisCode); 2] = [
+        (ButtonCode::LeftTrigger, AxisCode::LeftTrigger),
+        (ButtonCode::RightTrigger, AxisCode::RightTrigger),
+    ];
+
+    fn for_profile(profile: &Profile) -> [Option<Self>; 2] {
+        [profile.settings.left_trigger, profile.settings.right_trigger].map(|threshold| {
+            threshold.map(|threshold| Self {
+                press: threshold.press,
+                release: threshold.release(),
+                down: false,
+            })
+        })
+    }
+
+    /// Whether the button goes down or up as the trigger moves to `value`
+    fn crossed(&mut self, value: i32) -> Option<bool> {
+        let down = match self.down {
+            false => value >= self.press,
+            true => value >= self.release,
+        };
+        (down != std::mem::replace(&mut self.down, down)).then_some(down)
+    }
+}
+
+/// A stick axis on its way through a flick
+#[derive(Debug, Clone, Default)]
+struct FlickState {
+    // When it left rest, while it's away
+    moved_at: Option<Instant>,
+    // It got its one chance to flick since leaving rest
+    spent: bool,
+    fired_at: Option<Instant>,
+    // Pressed by the flick until the stick is back at rest
+    held: Option<FlickTarget>,
+}
+
+/// Per-button debounce bookkeeping
+///
+/// Worn switches double-fire: one physical press arrives as press, release,
+/// press, release in quick succession. A press within the window after a
+/// release starts a spurious pair; it and its release are both dropped.
+#[derive(Debug, Clone, Copy, Default)]
+struct DebounceState {
+    last_release: Option<Instant>,
+    suppressing: bool,
+}
+
+impl MappingEngine {
+    pub fn load_from_profile(profile: &Profile) -> Result<Self> {
+        let (compiled, scripts) = compile_profile(profile)?;
+        let mut engine = Self::with_rules(compiled.table(&MappingContext::default()), scripts);
+        engine.conditional = compiled.is_conditional().then_some(compiled);
+        engine.slow_keys = Duration::from_millis(profile.settings.slow_keys_ms as u64);
+        engine.layout = Layout::for_settings(&profile.settings);
+        engine.triggers = TriggerButton::for_profile(profile);
+        Ok(engine)
+    }
+
+    pub fn new_hardcoded() -> Self {
+        let rules = [
+            // Button mappings
+            MappingRule::button_to_key(ButtonCode::South, KeyboardCode::S),
+            MappingRule::button_to_key(ButtonCode::East, KeyboardCode::D),
+            MappingRule::button_to_key(ButtonCode::West, KeyboardCode::A),
+            // DPad mappings
+            MappingRule::axis_direction_to_key(
+                AxisCode::DPadY,
+                AxisDirection::Negative,
+                KeyboardCode::Up,
+            ),
+            MappingRule::axis_direction_to_key(
+                AxisCode::DPadY,
+                AxisDirection::Positive,
+                KeyboardCode::Down,
+            ),
+            MappingRule::axis_direction_to_key(
+                AxisCode::DPadX,
+                AxisDirection::Negative,
+                KeyboardCode::Left,
+            ),
+            MappingRule::axis_direction_to_key(
+                AxisCode::DPadX,
+                AxisDirection::Positive,
+                KeyboardCode::Right,
+            ),
+        ];
+
+        Self::with_rules(RuleTable::compile(&rules), Vec::new())
+    }
+
+    fn with_rules(rules: RuleTable, scripts: Vec<Script>) -> Self {
+        tracing::info!(
+            "Mapping engine initialized with {} button rules, {} axis rules",
+            rules.button_count(),
+            rules.axis_count()
+        );
+        Self {
+            rules,
+            axis_states: [0; AxisCode::ALL.len()],
+            button_states: [false; ButtonCode::ALL.len()],
+            physical_axes: [0; AxisCode::ALL.len()],
+            physical_buttons: [false; ButtonCode::ALL.len()],
+            debounce: [DebounceState::default(); ButtonCode::ALL.len()],
+            debounced: 0,
+            slow_keys: Duration::ZERO,
+            held_back: [None; ButtonCode::ALL.len()],
+            layout: Layout::default(),
+            triggers: [None; 2],
+            repeating: None,
+            now: Instant::now(),
+            actions: Vec::new(),
+            script_keys: vec![Vec::new(); scripts.len()],
+            scripts,
+            context: MappingContext::default(),
+            conditional: None,
+            sticky: Vec::new(),
+            sticky_release: None,
+            sticky_changed: false,
+            switches: Vec::new(),
+            switcher: None,
+            flicks: std::array::from_fn(|_| FlickState::default()),
+        }
+    }
+
+    /// Recompile the lookup tables from `profile`
+    ///
+    /// Axis state is kept: it mirrors the physical controller, not the profile.
+    /// On error the current tables stay in place.
+    pub fn reload(&mut self, profile: &Profile) -> Result<()> {
+        let (compiled, scripts) = compile_profile(profile)?;
+        self.install(profile, compiled, scripts);
+        Ok(())
+    }
+
+    fn install(&mut self, profile: &Profile, compiled: CompiledRules, scripts: Vec<Script>) {
+        self.rules = compiled.table(&self.context);
+        self.conditional = compiled.is_conditional().then_some(compiled);
+        self.script_keys = vec![Vec::new(); scripts.len()];
+        self.scripts = scripts;
+        self.slow_keys = Duration::from_millis(profile.settings.slow_keys_ms as u64);
+        self.layout = Layout::for_settings(&profile.settings);
+        // A trigger held through the reload stays down until it's let go
+        let mut triggers = TriggerButton::for_profile(profile);
+        for (trigger, old) in triggers.iter_mut().zip(self.triggers) {
+            if let (Some(trigger), Some(old)) = (trigger, old) {
+                trigger.down = old.down;
+            }
+        }
+        self.triggers = triggers;
+        self.switches.push(Switch::Profile(profile.name.clone()));
+
+        tracing::info!(
+            "Loaded profile '{}': {} button rules, {} axis rules",
+            profile.name,
+            self.rules.button_count(),
+            self.rules.axis_count()
+        );
+    }
+
+    /// Let the controller's hotkeys switch among `switcher`'s profiles
+    ///
+    /// Its current profile should be the one loaded. Fails naming a profile
+    /// that doesn't compile, so a bad one is caught before it's switched to.
+    pub fn set_profile_switcher(&mut self, switcher: ProfileSwitcher) -> Result<()> {
+        for profile in switcher.profiles() {
+            compile_profile(profile)
+                .with_context(|| format!("Invalid profile '{}'", profile.name))?;
+        }
+        self.switcher = Some(switcher);
+        Ok(())
+    }
+
+    /// The profile hotkeys last switched to, with a profile switcher
+    pub fn profile(&self) -> Option<&Profile> {
+        self.switcher.as_ref().map(ProfileSwitcher::current)
+    }
+
+    /// Hand a control going on or off to the hotkeys; true if they take it
+    fn hotkey(&mut self, chord: Chord, out: &mut Vec<OutputEvent>) -> bool {
+        match chord {
+            Chord::Pass => false,
+            Chord::Taken => true,
+            Chord::Switch(index) => {
+                self.switch_profile(index, out);
+                true
+            }
+        }
+    }
+
+    /// Load the switcher's profile `index`, letting go of everything held
+    /// under the mappings it was pressed with first
+    fn switch_profile(&mut self, index: usize, out: &mut Vec<OutputEvent>) {
+        let Some(switcher) = &mut self.switcher else {
+            return;
+        };
+        let profile = switcher.profiles()[index].clone();
+        let (compiled, scripts) = match compile_profile(&profile) {
+            Ok(compiled) => compiled,
+            Err(e) => {
+                tracing::warn!("Not switching to profile '{}': {:#}", profile.name, e);
+                return;
+            }
+        };
+        switcher.set_current(index);
+        self.release_held(out);
+        self.install(&profile, compiled, scripts);
+    }
+
+    /// Let go of every key, script and action held, and the sticky keys
+    fn release_held(&mut self, out: &mut Vec<OutputEvent>) {
+        const NONE: HeldTargets = (None, None, None, None);
+        for code in ButtonCode::ALL {
+            if self.button_states[code.index()] {
+                let held = (
+                    self.rules.button(code),
+                    self.rules.button_device(code).cloned(),
+                    self.rules.button_script(code),
+                    self.rules.button_action(code),
+                );
+                self.release_changed(ActionSource::Button(code), held, NONE, out);
+            }
+        }
+        for code in [AxisCode::DPadX, AxisCode::DPadY] {
+            if let Some(direction) = Self::value_to_direction(self.axis_states[code.index()]) {
+                let held = (
+                    self.rules.axis(code, direction),
+                    self.rules.axis_device(code, direction).cloned(),
+                    self.rules.axis_script(code, direction),
+                    self.rules.axis_action(code, direction),
+                );
+                let source = ActionSource::Axis(code, direction);
+                self.release_changed(source, held, NONE, out);
+            }
+        }
+        for state in &mut self.flicks {
+            if let Some(target) = state.held.take() {
+                target.output(false, out);
+            }
+        }
+        if !self.sticky.is_empty() {
+            for (_, code) in self.sticky.drain(..) {
+                out.push(OutputEvent::Keyboard { code, event_type: KeyboardEventType::Release });
+            }
+            self.sticky_release = None;
+            self.sticky_changed = true;
+        }
+    }
+
+    /// Apply the mappings whose conditions hold in `context`
+    ///
+    /// Controls held across the switch are released under the mapping they
+    /// were pressed with; the new one applies from their next press.
+    pub fn set_context(&mut self, context: MappingContext, out: &mut Vec<OutputEvent>) {
+        if context == self.context {
+            return;
+        }
+        let previous = std::mem::replace(&mut self.context, context);
+        let Some(conditional) = &self.conditional else {
+            return;
+        };
+        if !conditional.differ(&previous, &self.context) {
+            return;
+        }
+        let next = conditional.table(&self.context);
+
+        for code in ButtonCode::ALL {
+            if self.button_states[code.index()] {
+                let held = |t: &RuleTable| {
+                    (
+                        t.button(code),
+                        t.button_device(code).cloned(),
+                        t.button_script(code),
+                        t.button_action(code),
+                    )
+                };
+                self.release_changed(
+                    ActionSource::Button(code),
+                    held(&self.rules),
+                    held(&next),
+                    out,
+                );
+            }
+        }
+        for code in [AxisCode::DPadX, AxisCode::DPadY] {
+            if let Some(direction) = Self::value_to_direction(self.axis_states[code.index()]) {
+                let held = |t: &RuleTable| {
+                    (
+                        t.axis(code, direction),
+                        t.axis_device(code, direction).cloned(),
+                        t.axis_script(code, direction),
+                        t.axis_action(code, direction),
+                    )
+                };
+                let source = ActionSource::Axis(code, direction);
+                self.release_changed(source, held(&self.rules), held(&next), out);
+            }
+        }
+        self.rules = next;
+        self.switches.push(Switch::Context);
+    }
+
+    /// The controls swapped before mapping
+    pub fn layout(&self) -> Layout {
+        self.layout
+    }
+
+    /// Swap controls as `layout` says from the next event on
+    ///
+    /// Set by the profile; this is for overrides such as `run --swap-ab-xy`.
+    pub fn set_layout(&mut self, layout: Layout) {
+        self.layout = layout;
+    }
+
+    /// The context conditions are currently checked against
+    pub fn context(&self) -> &MappingContext {
+        &self.context
+    }
+
+    fn release_changed(
+        &mut self,
+        source: ActionSource,
+        (key, device, script, action): HeldTargets,
+        next: HeldTargets,
+        out: &mut Vec<OutputEvent>,
+    ) {
+        if let Some(code) = key
+            && next.0 != key
+        {
+            out.push(OutputEvent::Keyboard { code, event_type: KeyboardEventType::Release });
+            self.repeating.take_if(|repeating| repeating.source == source);
+        }
+        if let Some(target) = &device
+            && next.1 != device
+        {
+            out.extend(target.output(false));
+        }
+        if let Some(index) = script
+            && next.2 != script
+        {
+            self.run_script(index, source, false, 0, out);
+        }
+        if let Some(action) = action
+            && next.3 != Some(action)
+        {
+            self.actions.push(ActionEvent { action, source, pressed: false, value: 0 });
+        }
+    }
+
+    /// Button events dropped by debouncing or as too short so far
+    pub fn debounced_count(&self) -> u64 {
+        self.debounced
+    }
+
+    /// Keys sticky mappings are holding
+    pub fn sticky_keys(&self) -> impl Iterator<Item = KeyboardCode> + '_ {
+        self.sticky.iter().map(|&(_, key)| key)
+    }
+
+    /// True if sticky keys were latched or let go since the last call
+    pub fn take_sticky_changed(&mut self) -> bool {
+        std::mem::take(&mut self.sticky_changed)
+    }
+
+    /// When `tick` next has something to do, if ever
+    pub fn next_deadline(&self) -> Option<Instant> {
+        let held_back =
+            self.held_back.iter().flatten().map(|&pressed_at| pressed_at + self.slow_keys);
+        held_back.chain(self.repeating.map(|repeating| repeating.next)).min()
+    }
+
+    /// Map what is due by `now` without any new input
+    ///
+    /// Presses held back for `slow_keys_ms` go through once held that long,
+    /// and held keys repeat. Events call this themselves; the event loop
+    /// calls it when the controller is idle at `next_deadline`.
+    pub fn tick(&mut self, now: Instant, out: &mut Vec<OutputEvent>) {
+        self.now = now;
+        if let Some(repeating) = &mut self.repeating
+            && repeating.next <= now
+        {
+            out.push(OutputEvent::Keyboard {
+                code: repeating.key,
+                event_type: KeyboardEventType::Hold,
+            });
+            // Late ticks don't make up for missed repeats
+            repeating.next = (repeating.next + repeating.interval).max(now + repeating.interval);
+        }
+        for code in ButtonCode::ALL {
+            if let Some(pressed_at) = self.held_back[code.index()]
+                && now.saturating_duration_since(pressed_at) >= self.slow_keys
+            {
+                self.held_back[code.index()] = None;
+                self.accept_button(code, true, out);
+            }
+        }
+    }
+
+    /// The rules the active mappings have for `event`'s control, for debug
+    /// traces; call before processing it
+    ///
+    /// The control is taken as the layout swaps it, and an axis back at
+    /// center by the direction it's leaving.
+    pub fn rules_for(&self, event: &InputEvent) -> Vec<String> {
+        let source = match *event {
+            InputEvent::Button { code, .. } => ActionSource::Button(self.layout.button(code)),
+            InputEvent::Axis { code, value, .. } => {
+                let (code, value) = self.layout.axis(code, value);
+                let direction = Self::value_to_direction(value)
+                    .or_else(|| Self::value_to_direction(self.axis_states[code.index()]));
+                match direction {
+                    Some(direction) => ActionSource::Axis(code, direction),
+                    None => ActionSource::AxisValue(code),
+                }
+            }
+            InputEvent::Sync { .. } => return Vec::new(),
+        };
+
+        let mut rules = Vec::new();
+        let (key, device, action, script, text) = match source {
+            ActionSource::Button(code) => (
+                self.rules.button(code),
+                self.rules.button_device(code),
+                self.rules.button_action(code),
+                self.rules.button_script(code),
+                self.rules.button_text(code),
+            ),
+            ActionSource::Axis(code, direction) => (
+                self.rules.axis(code, direction),
+                self.rules.axis_device(code, direction),
+                self.rules.axis_action(code, direction),
+                self.rules.axis_script(code, direction),
+                self.rules.axis_text(code, direction),
+            ),
+            ActionSource::AxisValue(_) => (None, None, None, None, None),
+        };
+        if let Some(key) = key {
+            let sticky = matches!(source, ActionSource::Button(code) if self.rules.is_sticky(code));
+            rules.push(format!("key {}{}", key, if sticky { " (sticky)" } else { "" }));
+        }
+        if let Some(RoutedTarget { target, device }) = device {
+            match device {
+                Some(device) => rules.push(format!("{:?} on {}", target, device)),
+                None => rules.push(format!("{:?}", target)),
+            }
+        }
+        if let Some(action) = action {
+            rules.push(format!("action {}", action));
+        }
+        if let ActionSource::Axis(code, _) | ActionSource::AxisValue(code) = source
+            && let Some(action) = self.rules.axis_value_action(code)
+        {
+            rules.push(format!("action {} (every change)", action));
+        }
+        if let Some(script) = script {
+            rules.push(format!("script {}", script));
+        }
+        if text.is_some() {
+            rules.push("text".to_string());
+        }
+        if let ActionSource::Axis(code, direction) = source
+            && let Some(flick) = self.rules.flick(code, direction)
+        {
+            rules.push(format!("flick {:?}", flick.target));
+        }
+        // A whole axis mirrors whichever way it's pushed
+        let mirrored = |mirror: &&Mirror| match (mirror.source, source) {
+            (ActionSource::AxisValue(a), ActionSource::Axis(b, _)) => a == b,
+            (mirrored, source) => mirrored == source,
+        };
+        for mirror in self.rules.mirrors().iter().filter(mirrored) {
+            match mirror.layer {
+                Some(layer) => {
+                    rules.push(format!("acts as {} while {} held", mirror.target, layer))
+                }
+                None => rules.push(format!("acts as {}", mirror.target)),
+            }
+        }
+        rules
+    }
+
+    /// Take the actions triggered by the events processed so far
+    pub fn drain_actions(&mut self) -> std::vec::Drain<'_, ActionEvent> {
+        self.actions.drain(..)
+    }
+
+    /// Take the layer and mapping switches since the last call
+    pub fn drain_switches(&mut self) -> std::vec::Drain<'_, Switch> {
+        self.switches.drain(..)
+    }
+
+    pub fn process(&mut self, event: &InputEvent) -> Result<Vec<OutputEvent>> {
+        let mut events = Vec::new();
+        self.process_into(event, &mut events)?;
+        Ok(events)
+    }
+
+    /// Like `process`, but appends to a caller-owned buffer (no allocation)
+    pub fn process_into(&mut self, event: &InputEvent, out: &mut Vec<OutputEvent>) -> Result<()> {
+        match *event {
+            InputEvent::Button { code, pressed, timestamp } => {
+                let code = self.layout.button(code);
+                self.tick(timestamp, out);
+                // Its analog axis decides instead
+                if self.trigger(code).is_some() {
+                    return Ok(());
+                }
+                self.filter_button(code, pressed, timestamp, out);
+            }
+            InputEvent::Axis { code, value, timestamp } => {
+                let (code, value) = self.layout.axis(code, value);
+                self.tick(timestamp, out);
+                if matches!(code, AxisCode::DPadX | AxisCode::DPadY)
+                    && let Some(switcher) = &mut self.switcher
+                {
+                    let chord = switcher.dpad(code, Self::value_to_direction(value));
+                    if self.hotkey(chord, out) {
+                        return Ok(());
+                    }
+                }
+                if let Some((button, _)) = TriggerButton::ALL.iter().find(|(_, axis)| *axis == code)
+                    && let Some(pressed) = self.trigger(*button).and_then(|t| t.crossed(value))
+                {
+                    self.filter_button(*button, pressed, timestamp, out);
+                }
+                self.physical_axes[code.index()] = value;
+                match self.rules.mirrors().is_empty() {
+                    true => self.process_axis(code, value, out),
+                    false => self.process_mirrored(out),
+                }
+            }
+            InputEvent::Sync { .. } => {}
+        }
+        Ok(())
+    }
+
+    /// The analog trigger standing in for `code`, if it's a trigger with thresholds
+    fn trigger(&mut self, code: ButtonCode) -> Option<&mut TriggerButton> {
+        let index = TriggerButton::ALL.iter().position(|&(button, _)| button == code)?;
+        self.triggers[index].as_mut()
+    }
+
+    /// Map a button event unless debouncing or slow keys drop it
+    fn filter_button(
+        &mut self,
+        code: ButtonCode,
+        pressed: bool,
+        timestamp: Instant,
+        out: &mut Vec<OutputEvent>,
+    ) {
+        if self.debounce_button(code, pressed, timestamp)
+            || self.hold_back(code, pressed, timestamp)
+        {
+            return;
+        }
+        self.accept_button(code, pressed, out);
+    }
+
+    /// Map a button event that made it through the filters
+    fn accept_button(&mut self, code: ButtonCode, pressed: bool, out: &mut Vec<OutputEvent>) {
+        if let Some(switcher) = &mut self.switcher {
+            let chord = switcher.button(code, pressed);
+            if self.hotkey(chord, out) {
+                return;
+            }
+        }
+        let was = std::mem::replace(&mut self.physical_buttons[code.index()], pressed);
+        match self.rules.mirrors().is_empty() {
+            true => self.process_button(code, pressed, out),
+            false => {
+                if was != pressed && self.rules.mirrors().iter().any(|m| m.layer == Some(code)) {
+                    self.switches.push(Switch::Layer { button: code, on: pressed });
+                }
+                self.process_mirrored(out)
+            }
+        }
+    }
+
+    /// Map whatever changed in the controller as the mirrors make it appear
+    ///
+    /// Worked out from the physical state every time, so letting go of a
+    /// layer while its controls are held moves them back to their own
+    /// mappings.
+    fn process_mirrored(&mut self, out: &mut Vec<OutputEvent>) {
+        let (physical_buttons, physical_axes) = (self.physical_buttons, self.physical_axes);
+        let (mut buttons, mut axes) = (physical_buttons, physical_axes);
+        let active = self
+            .rules
+            .mirrors()
+            .iter()
+            .filter(|mirror| mirror.layer.is_none_or(|layer| physical_buttons[layer.index()]));
+        let is_on = |source| match source {
+            ActionSource::Button(code) => physical_buttons[code.index()],
+            ActionSource::Axis(code, direction) => {
+                Self::value_to_direction(physical_axes[code.index()]) == Some(direction)
+            }
+            ActionSource::AxisValue(code) => physical_axes[code.index()] != 0,
+        };
+
+        // Redirected controls no longer act as themselves...
+        for &Mirror { source, .. } in active.clone() {
+            if is_on(source) {
+                match source {
+                    ActionSource::Button(code) => buttons[code.index()] = false,
+                    ActionSource::Axis(code, _) | ActionSource::AxisValue(code) => {
+                        axes[code.index()] = 0
+                    }
+                }
+            }
+        }
+        // ...but as their targets
+        for &Mirror { source, target, .. } in active {
+            if !is_on(source) {
+                continue;
+            }
+            match (source, target) {
+                (_, ActionSource::Button(code)) => buttons[code.index()] = true,
+                (_, ActionSource::Axis(code, AxisDirection::Negative)) => axes[code.index()] = -1,
+                (_, ActionSource::Axis(code, AxisDirection::Positive)) => axes[code.index()] = 1,
+                (ActionSource::AxisValue(from), ActionSource::AxisValue(code)) => {
+                    axes[code.index()] = physical_axes[from.index()]
+                }
+                // Rejected when the profile was compiled
+                (_, ActionSource::AxisValue(_)) => {}
+            }
+        }
+
+        for code in ButtonCode::ALL {
+            if buttons[code.index()] != self.button_states[code.index()] {
+                self.process_button(code, buttons[code.index()], out);
+            }
+        }
+        for code in AxisCode::ALL {
+            if axes[code.index()] != self.axis_states[code.index()] {
+                self.process_axis(code, axes[code.index()], out);
+            }
+        }
+    }
+
+    /// Returns true if the event is chatter and must be dropped
+    fn debounce_button(&mut self, code: ButtonCode, pressed: bool, timestamp: Instant) -> bool {
+        let window = self.rules.debounce(code);
+        if window.is_zero() {
+            return false;
+        }
+
+        let state = &mut self.debounce[code.index()];
+        let bounce = if pressed {
+            let since_release = state.last_release.map(|t| timestamp.saturating_duration_since(t));
+            state.suppressing = since_release.is_some_and(|elapsed| elapsed < window);
+            state.suppressing
+        } else {
+            // Either way this is now the last release; chatter extends the window
+            state.last_release = Some(timestamp);
+            std::mem::take(&mut state.suppressing)
+        };
+
+        if bounce {
+            self.debounced += 1;
+        }
+        bounce
+    }
+
+    /// Returns true if the event waits for, or fell short of, `slow_keys`
+    ///
+    /// Hand tremors cause brief presses nobody meant; a press only counts
+    /// once the button was held long enough, and is dropped with its
+    /// release otherwise. `tick` lets the presses that make it through.
+    fn hold_back(&mut self, code: ButtonCode, pressed: bool, timestamp: Instant) -> bool {
+        let held_back = &mut self.held_back[code.index()];
+        if pressed {
+            if self.slow_keys.is_zero() {
+                return false;
+            }
+            *held_back = Some(timestamp);
+            return true;
+        }
+        if held_back.take().is_none() {
+            return false;
+        }
+        self.debounced += 2;
+        true
+    }
+
+    fn process_button(&mut self, code: ButtonCode, pressed: bool, out: &mut Vec<OutputEvent>) {
+        self.button_states[code.index()] = pressed;
+        if let Some(script) = self.rules.button_script(code) {
+            self.run_script(script, ActionSource::Button(code), pressed, 1, out);
+        }
+        if let Some(action) = self.rules.button_action(code) {
+            let source = ActionSource::Button(code);
+            self.actions.push(ActionEvent { action, source, pressed, value: pressed as i32 });
+        }
+        let sticky = self.rules.is_sticky(code);
+        if let Some(target_key) = self.rules.button(code) {
+            if !sticky {
+                out.push(OutputEvent::Keyboard {
+                    code: target_key,
+                    event_type: if pressed {
+                        KeyboardEventType::Press
+                    } else {
+                        KeyboardEventType::Release
+                    },
+                });
+                self.repeat_while_held(ActionSource::Button(code), target_key, pressed);
+            } else if pressed {
+                self.latch(code, target_key, out);
+            }
+        }
+        if let Some(target) = self.rules.button_device(code) {
+            out.extend(target.output(pressed));
+        }
+        if pressed && let Some(text) = self.rules.button_text(code) {
+            text.output(out);
+        }
+        if !sticky {
+            self.release_sticky_after(ActionSource::Button(code), pressed, out);
+        }
+    }
+
+    /// Start repeating `key` if `source`'s mapping asks for it, or stop
+    ///
+    /// Like on a keyboard, only the key pressed last repeats, and letting go
+    /// of it stops repeating until the next press.
+    fn repeat_while_held(&mut self, source: ActionSource, key: KeyboardCode, pressed: bool) {
+        if !pressed {
+            self.repeating.take_if(|repeating| repeating.source == source);
+            return;
+        }
+        self.repeating = self.rules.repeat(source).map(|repeat| Repeating {
+            source,
+            key,
+            next: self.now + repeat.delay,
+            interval: repeat.interval,
+        });
+    }
+
+    /// Hold `key` for a sticky button, or let go of it if it's held already
+    ///
+    /// The button's own release doesn't release the key; the end of the
+    /// next press does (see `release_sticky_after`).
+    fn latch(&mut self, code: ButtonCode, key: KeyboardCode, out: &mut Vec<OutputEvent>) {
+        match self.sticky.iter().position(|&(latched, _)| latched == code) {
+            Some(index) => {
+                let (_, key) = self.sticky.remove(index);
+                out.push(OutputEvent::Keyboard {
+                    code: key,
+                    event_type: KeyboardEventType::Release,
+                });
+                if self.sticky.is_empty() {
+                    self.sticky_release = None;
+                }
+            }
+            None => {
+                self.sticky.push((code, key));
+                out.push(OutputEvent::Keyboard { code: key, event_type: KeyboardEventType::Press });
+            }
+        }
+        self.sticky_changed = true;
+    }
+
+    /// Release the latched keys once the first press after latching is over
+    ///
+    /// Waiting for the release rather than the press keeps e.g. Shift held
+    /// for as long as the key it modifies.
+    fn release_sticky_after(
+        &mut self,
+        source: ActionSource,
+        pressed: bool,
+        out: &mut Vec<OutputEvent>,
+    ) {
+        if self.sticky.is_empty() {
+            return;
+        }
+        if pressed {
+            self.sticky_release.get_or_insert(source);
+        } else if self.sticky_release == Some(source) {
+            self.sticky_release = None;
+            for (_, code) in self.sticky.drain(..) {
+                out.push(OutputEvent::Keyboard { code, event_type: KeyboardEventType::Release });
+            }
+            self.sticky_changed = true;
+        }
+    }
+
+    fn process_axis(&mut self, code: AxisCode, new_value: i32, out: &mut Vec<OutputEvent>) {
+        let old_value = std::mem::replace(&mut self.axis_states[code.index()], new_value);
+        if let Some(action) = self.rules.axis_value_action(code)
+            && new_value != old_value
+        {
+            let source = ActionSource::AxisValue(code);
+            self.actions.push(ActionEvent {
+                action,
+                source,
+                pressed: new_value != 0,
+                value: new_value,
+            });
+        }
+        self.flick(code, new_value, out);
+
+        // Only the D-pad maps to keys; other axes are tracked for scripts
+        if !matches!(code, AxisCode::DPadX | AxisCode::DPadY) {
+            return;
+        }
+
+        // Detect direction changes and generate press/release events
+        let old_direction = Self::value_to_direction(old_value);
+        let new_direction = Self::value_to_direction(new_value);
+        if old_direction == new_direction {
+            return;
+        }
+
+        // Release old direction
+        if let Some(old_dir) = old_direction {
+            self.axis_direction(code, old_dir, false, out);
+        }
+
+        // Press new direction if active
+        if let Some(new_dir) = new_direction {
+            self.axis_direction(code, new_dir, true, out);
+        }
+    }
+
+    fn axis_direction(
+        &mut self,
+        code: AxisCode,
+        direction: AxisDirection,
+        pressed: bool,
+        out: &mut Vec<OutputEvent>,
+    ) {
+        if let Some(action) = self.rules.axis_action(code, direction) {
+            let source = ActionSource::Axis(code, direction);
+            let value = self.axis_states[code.index()];
+            self.actions.push(ActionEvent { action, source, pressed, value });
+        }
+        if let Some(script) = self.rules.axis_script(code, direction) {
+            let value = self.axis_states[code.index()];
+            self.run_script(script, ActionSource::Axis(code, direction), pressed, value, out);
+        }
+        if let Some(target_key) = self.rules.axis(code, direction) {
+            out.push(OutputEvent::Keyboard {
+                code: target_key,
+                event_type: if pressed {
+                    KeyboardEventType::Press
+                } else {
+                    KeyboardEventType::Release
+                },
+            });
+            self.repeat_while_held(ActionSource::Axis(code, direction), target_key, pressed);
+        }
+        if let Some(target) = self.rules.axis_device(code, direction) {
+            out.extend(target.output(pressed));
+        }
+        if pressed && let Some(text) = self.rules.axis_text(code, direction) {
+            text.output(out);
+        }
+        self.release_sticky_after(ActionSource::Axis(code, direction), pressed, out);
+    }
+
+    /// Fire the flick mapping of stick `code` as it moves to `value`
+    ///
+    /// A flick is the stick pushed from rest past its mapping's threshold
+    /// within `FLICK_TIME`. It presses the target once, unless the axis
+    /// flicked within the cooldown, which keeps a stick springing back past
+    /// center from flicking the other way. The target is let go at rest.
+    fn flick(&mut self, code: AxisCode, value: i32, out: &mut Vec<OutputEvent>) {
+        let state = &mut self.flicks[code.index()];
+        if value.abs() <= InputEvent::STICK_DEADZONE {
+            state.moved_at = None;
+            state.spent = false;
+            if let Some(target) = state.held.take() {
+                target.output(false, out);
+            }
+            return;
+        }
+        let moved_at = *state.moved_at.get_or_insert(self.now);
+        if state.spent {
+            return;
+        }
+        let direction = match value < 0 {
+            true => AxisDirection::Negative,
+            false => AxisDirection::Positive,
+        };
+        let Some(rule) = self.rules.flick(code, direction) else {
+            return;
+        };
+        if value.abs() < rule.flick.threshold {
+            return;
+        }
+        state.spent = true;
+        let cooldown = Duration::from_millis(rule.flick.cooldown_ms as u64);
+        let cooling =
+            state.fired_at.is_some_and(|at| self.now.saturating_duration_since(at) < cooldown);
+        if cooling || self.now.saturating_duration_since(moved_at) > FLICK_TIME {
+            return;
+        }
+        state.fired_at = Some(self.now);
+        rule.target.output(true, out);
+        state.held = Some(rule.target.clone());
+    }
+
+    /// Press the keys script `index` yields, or release the ones it pressed
+    fn run_script(
+        &mut self,
+        index: usize,
+        source: ActionSource,
+        pressed: bool,
+        value: i32,
+        out: &mut Vec<OutputEvent>,
+    ) {
+        let held = &mut self.script_keys[index];
+        for code in held.drain(..) {
+            out.push(OutputEvent::Keyboard { code, event_type: KeyboardEventType::Release });
+        }
+        if !pressed {
+            return;
+        }
+
+        let input = ScriptInput { value, buttons: &self.button_states, axes: &self.axis_states };
+        if let Err(e) = self.scripts[index].eval_keys(&input, held) {
+            tracing::warn!("Script for {} failed: {}", source, e);
+            held.clear();
+        }
+        for &code in held.iter() {
+            out.push(OutputEvent::Keyboard { code, event_type: KeyboardEventType::Press });
+        }
+    }
+
+    fn value_to_direction(value: i32) -> Option<AxisDirection> {
+        const THRESHOLD: i32 = 0;
+
+        if value > THRESHOLD {
+            Some(AxisDirection::Positive)
+        } else if value < -THRESHOLD {
+            Some(AxisDirection::Negative)
+        } else {
+            None // Centered/neutral
+        }
+    }
 }
 
-impl MappingEngine {
-    pub fn load_from_profile(profile: &Profile) -> Result<Self> {
-        let mut button_rules = HashMap::new();
-        let mut axis_rules = HashMap::new();
+fn compile_profile(profile: &Profile) -> Result<(CompiledRules, Vec<Script>)> {
+    let mut rules = Vec::with_capacity(profile.mappings.len());
+    let conditions = profile.mappings.iter().map(|mapping| mapping.conditions.clone()).collect();
+    let mut scripts = Vec::new();
+    // Numbered in the order of `Profile::action_mappings`
+    let mut next_action = 0;
+    for mapping in &profile.mappings {
+        check_device(mapping, &profile.settings.virtual_devices)?;
+        if let Some(flick) = mapping.flick {
+            if let Some(problem) = flick.problem() {
+                anyhow::bail!("Invalid flick for {}: {}", mapping.source_name, problem);
+            }
+            let rule = MappingRule::flick(mapping)
+                .with_context(|| {
+                    format!(
+                        "Flick mapping for {} needs a Positive or Negative direction",
+                        mapping.source_name
+                    )
+                })?
+                .with_context(|| {
+                    format!(
+                        "Flick mapping for {} can't press {:?} target '{}'",
+                        mapping.source_name, mapping.target_type, mapping.target_name
+                    )
+                })?;
+            rules.push(rule);
+        } else if mapping.target_type.is_action() {
+            rules.push(MappingRule::action(mapping, next_action)?);
+            next_action += 1;
+        } else if mapping.target_type == TargetType::Mirror {
+            rules.push(MappingRule::mirror(mapping).with_context(|| {
+                format!(
+                    "Mirror mapping for {} can't act as '{}'",
+                    mapping.source_name, mapping.target_name
+                )
+            })?);
+        } else if mapping.target_type == TargetType::Desktop
+            && DesktopAction::from_name(&mapping.target_name).is_none()
+        {
+            anyhow::bail!(
+                "Unknown desktop action '{}' for {}",
+                mapping.target_name,
+                mapping.source_name
+            );
+        } else if matches!(mapping.target_type, TargetType::Mouse | TargetType::Gamepad)
+            || mapping.custom_device().is_some()
+        {
+            let rule = MappingRule::device(mapping)?.with_context(|| {
+                format!(
+                    "Unknown {:?} target '{}' for {}",
+                    mapping.target_type, mapping.target_name, mapping.source_name
+                )
+            })?;
+            rules.push(rule);
+        } else if mapping.target_type == TargetType::Text {
+            let layout = profile.settings.keyboard_layout;
+            rules.push(
+                MappingRule::text(mapping, layout)
+                    .with_context(|| format!("Invalid text for {}", mapping.source_name))?,
+            );
+        } else if mapping.target_type == TargetType::Script {
+            let source = mapping.script.as_deref().with_context(|| {
+                format!("Script mapping for {} has no script", mapping.source_name)
+            })?;
+            let script = Script::parse(source)
+                .with_context(|| format!("Invalid script for {}", mapping.source_name))?;
+            rules.push(MappingRule::script(mapping, scripts.len())?);
+            scripts.push(script);
+        } else {
+            rules.push(MappingRule::try_from(mapping)?);
+        }
+    }
+
+    for (name, threshold) in [
+        ("left_trigger", profile.settings.left_trigger),
+        ("right_trigger", profile.settings.right_trigger),
+    ] {
+        if let Some(problem) = threshold.and_then(|threshold| threshold.problem()) {
+            anyhow::bail!("Invalid {}: {}", name, problem);
+        }
+    }
+
+    // Bounce keys is debouncing with a window long enough for tremors
+    let bounce_keys_ms = profile.settings.bounce_keys_ms;
+    let mut debounce: Vec<_> = ButtonCode::ALL
+        .iter()
+        .map(|&code| (code, profile.settings.debounce_ms.max(bounce_keys_ms)))
+        .collect();
+    for mapping in &profile.mappings {
+        if let (Some(window_ms), None) = (mapping.debounce_ms, &mapping.source_direction) {
+            let code = ButtonCode::from(mapping.source_name.as_str());
+            debounce.push((code, window_ms.max(bounce_keys_ms)));
+        }
+    }
+    let sticky = profile
+        .mappings
+        .iter()
+        .filter(|m| {
+            m.sticky
+                && m.source_direction.is_none()
+                && m.target_type == TargetType::Keyboard
+                && m.custom_device().is_none()
+        })
+        .map(|m| ButtonCode::from(m.source_name.as_str()))
+        .collect();
+    // Parallel to the mappings, so each key rule is its mapping's
+    let repeat = rules
+        .iter()
+        .zip(&profile.mappings)
+        .filter_map(|(rule, mapping)| match *rule {
+            MappingRule::ButtonToKey { source, .. } if !mapping.sticky => {
+                Some((ActionSource::Button(source), Repeat::of(mapping)))
+            }
+            MappingRule::AxisDirectionToKey { source, direction, .. } => {
+                Some((ActionSource::Axis(source, direction), Repeat::of(mapping)))
+            }
+            _ => None,
+        })
+        .collect();
+    Ok((CompiledRules { rules, conditions, debounce, sticky, repeat }, scripts))
+}
+
+/// Fail if `mapping` routes to a device `identities` doesn't declare, or
+/// one of another kind than its target type
+///
+/// `device` only counts for keyboard, mouse and gamepad targets.
+fn check_device(mapping: &Mapping, identities: &DeviceIdentities) -> Result<()> {
+    let (Some(device), Some(kind)) = (&mapping.device, mapping.target_type.device_kind()) else {
+        return Ok(());
+    };
+    let device_kind = match DeviceKind::from_name(device) {
+        Some(usual) => usual,
+        None => {
+            identities
+                .custom
+                .get(device)
+                .with_context(|| {
+                    format!(
+                        "Mapping for {} routes to unknown device '{}'",
+                        mapping.source_name, device
+                    )
+                })?
+                .kind
+        }
+    };
+    if device_kind != kind {
+        anyhow::bail!(
+            "Mapping for {} can't send {:?} output to {} device '{}'",
+            mapping.source_name,
+            mapping.target_type,
+            device_kind,
+            device
+        );
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_mapping_engine_hardcoded_press() {
+        let mut engine = MappingEngine::new_hardcoded();
+        let input = InputEvent::button_press(ButtonCode::South);
+
+        let result = engine.process(&input).unwrap();
+
+        assert_eq!(result.len(), 1);
+        let OutputEvent::Keyboard { code, event_type } = result[0] else {
+            panic!("{} is not a key", result[0]);
+        };
+        assert_eq!(code, KeyboardCode::S);
+        assert_eq!(event_type, KeyboardEventType::Press);
+    }
+
+    #[test]
+    fn test_mapping_engine_hardcoded_release() {
+        let mut engine = MappingEngine::new_hardcoded();
+        let input = InputEvent::button_release(ButtonCode::East);
+
+        let result = engine.process(&input).unwrap();
+
+        assert_eq!(result.len(), 1);
+        let OutputEvent::Keyboard { code, event_type } = result[0] else {
+            panic!("{} is not a key", result[0]);
+        };
+        assert_eq!(code, KeyboardCode::D);
+        assert_eq!(event_type, KeyboardEventType::Release);
+    }
+
+    #[test]
+    fn test_unmapped_button() {
+        let mut engine = MappingEngine::new_hardcoded();
+        let input = InputEvent::button_press(ButtonCode::North); // North is not in hardcoded rules
+
+        let result = engine.process(&input).unwrap();
+        assert!(result.is_empty());
+    }
+
+    #[test]
+    fn test_axis_passthrough_returns_none() {
+        let mut engine = MappingEngine::new_hardcoded();
+        let input = InputEvent::axis_move(AxisCode::LeftX, 100);
+
+        let result = engine.process(&input).unwrap();
+        assert!(result.is_empty());
+    }
+
+    #[test]
+    fn test_sync_returns_none() {
+        let mut engine = MappingEngine::new_hardcoded();
+        let input = InputEvent::sync();
+
+        let result = engine.process(&input).unwrap();
+        assert!(result.is_empty());
+    }
+
+    #[test]
+    fn test_dpad_up_press() {
+        let mut engine = MappingEngine::new_hardcoded();
+        let input = InputEvent::axis_move(AxisCode::DPadY, -1);
+
+        let events = engine.process(&input).unwrap();
+        assert_eq!(events.len(), 1);
+
+        let OutputEvent::Keyboard { code, event_type } = events[0] else {
+            panic!("{} is not a key", events[0]);
+        };
+        assert_eq!(code, KeyboardCode::Up);
+        assert_eq!(event_type, KeyboardEventType::Press);
+    }
+
+    #[test]
+    fn test_dpad_release() {
+        let mut engine = MappingEngine::new_hardcoded();
+
+        // Press up
+        engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+
+        // Release (return to center)
+        let events = engine.process(&InputEvent::axis_move(AxisCode::DPadY, 0)).unwrap();
+
+        assert_eq!(events.len(), 1);
+        let OutputEvent::Keyboard { code, event_type } = events[0] else {
+            panic!("{} is not a key", events[0]);
+        };
+        assert_eq!(code, KeyboardCode::Up);
+        assert_eq!(event_type, KeyboardEventType::Release);
+    }
+
+    #[test]
+    fn test_dpad_direction_change() {
+        let mut engine = MappingEngine::new_hardcoded();
+
+        // Press up
+        engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+
+        // Change to down (should release up, press down)
+        let events = engine.process(&InputEvent::axis_move(AxisCode::DPadY, 1)).unwrap();
+
+        assert_eq!(events.len(), 2);
+
+        let OutputEvent::Keyboard { code: code1, event_type: type1 } = events[0] else {
+            panic!("{} is not a key", events[0]);
+        };
+        assert_eq!(code1, KeyboardCode::Up);
+        assert_eq!(type1, KeyboardEventType::Release);
+
+        let OutputEvent::Keyboard { code: code2, event_type: type2 } = events[1] else {
+            panic!("{} is not a key", events[1]);
+        };
+        assert_eq!(code2, KeyboardCode::Down);
+        assert_eq!(type2, KeyboardEventType::Press);
+    }
+
+    #[test]
+    fn test_rules_for_describe_the_matched_mappings() {
+        let mut engine = MappingEngine::new_hardcoded();
+        let rules = |engine: &MappingEngine, event| engine.rules_for(&event);
+
+        assert_eq!(rules(&engine, InputEvent::button_press(ButtonCode::South)), ["key S"]);
+        assert!(rules(&engine, InputEvent::button_press(ButtonCode::North)).is_empty());
+        engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+        // Centering lets go of the direction it was in
+        assert_eq!(rules(&engine, InputEvent::axis_move(AxisCode::DPadY, 0)), ["key Up"]);
+
+        engine.set_layout(Layout { swap_ab_xy: true, ..Layout::default() });
+        assert_eq!(rules(&engine, InputEvent::button_press(ButtonCode::East)), ["key S"]);
+    }
+
+    #[test]
+    fn test_load_from_profile() {
+        let profile = Profile::default_profile();
+        let engine = MappingEngine::load_from_profile(&profile).unwrap();
+
+        assert_eq!(engine.rules.button_count(), 6);
+        assert_eq!(engine.rules.axis_count(), 4);
+
+        // Verify some specific mappings from default profile
+        assert_eq!(engine.rules.button(ButtonCode::North), Some(KeyboardCode::W));
+        assert_eq!(
+            engine.rules.axis(AxisCode::DPadY, AxisDirection::Negative),
+            Some(KeyboardCode::Up)
+        );
+    }
+
+    #[test]
+    fn test_load_from_invalid_profile() {
+        use crate::mapping::Mapping;
+        use crate::mapping::types::TargetType;
+
+        let profile = Profile {
+            schema_version: crate::mapping::migrate::CURRENT_SCHEMA_VERSION,
+            name: "Invalid".to_string(),
+            description: "Invalid profile".to_string(),
+            game_name: None,
+            mappings: vec![Mapping {
+                source_name: "DPadX".to_string(),
+                source_direction: Some("Invalid".to_string()),
+                target_type: TargetType::Keyboard,
+                target_name: "A".to_string(),
+                ..Default::default()
+            }],
+            settings: Default::default(),
+            plugins: vec![],
+            mqtt: None,
+            osc: None,
+        };
+
+        let result = MappingEngine::load_from_profile(&profile);
+        assert!(result.is_err());
+    }
+
+    #[test]
+    fn test_reload_swaps_rules_and_keeps_axis_state() {
+        let mut engine = MappingEngine::new_hardcoded();
+
+        // Hold up on the hardcoded rules, then switch profiles
+        engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+        engine.reload(&Profile::default_profile()).unwrap();
+
+        // North is only mapped by the default profile
+        let events = engine.process(&InputEvent::button_press(ButtonCode::North)).unwrap();
+        assert_eq!(
+            events,
+            [OutputEvent::Keyboard { code: KeyboardCode::W, event_type: KeyboardEventType::Press }]
+        );
+
+        // Still pressed: releasing must emit the release
+        let events = engine.process(&InputEvent::axis_move(AxisCode::DPadY, 0)).unwrap();
+        assert_eq!(events.len(), 1);
+    }
+
+    fn debounced_profile(window_ms: u32) -> Profile {
+        let mut profile = Profile::default_profile();
+        profile.settings.debounce_ms = window_ms;
+        profile
+    }
+
+    fn ms(base: Instant, offset: u64) -> Instant {
+        base + std::time::Duration::from_millis(offset)
+    }
+
+    #[test]
+    fn test_debounce_drops_double_fire() {
+        let mut engine = MappingEngine::load_from_profile(&debounced_profile(20)).unwrap();
+        let t = Instant::now();
+
+        let mut emitted = Vec::new();
+        for event in [
+            InputEvent::button_press_at(ButtonCode::South, ms(t, 0)),
+            InputEvent::button_release_at(ButtonCode::South, ms(t, 30)),
+            // Chatter: a second tap 5ms after the release
+            InputEvent::button_press_at(ButtonCode::South, ms(t, 35)),
+            InputEvent::button_release_at(ButtonCode::South, ms(t, 40)),
+        ] {
+            emitted.extend(engine.process(&event).unwrap());
+        }
+
+        assert_eq!(emitted.len(), 2);
+        assert_eq!(engine.debounced_count(), 2);
+    }
+
+    #[test]
+    fn test_debounce_keeps_deliberate_presses() {
+        let mut engine = MappingEngine::load_from_profile(&debounced_profile(20)).unwrap();
+        let t = Instant::now();
+
+        let mut emitted = Vec::new();
+        for event in [
+            InputEvent::button_press_at(ButtonCode::South, ms(t, 0)),
+            InputEvent::button_release_at(ButtonCode::South, ms(t, 30)),
+            InputEvent::button_press_at(ButtonCode::South, ms(t, 80)),
+            InputEvent::button_release_at(ButtonCode::South, ms(t, 120)),
+        ] {
+            emitted.extend(engine.process(&event).unwrap());
+        }
+
+        assert_eq!(emitted.len(), 4);
+        assert_eq!(engine.debounced_count(), 0);
+    }
+
+    #[test]
+    fn test_mapping_debounce_overrides_profile() {
+        let mut profile = debounced_profile(0);
+        let south = profile.mappings.iter_mut().find(|m| m.source_name == "South").unwrap();
+        south.debounce_ms = Some(50);
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let t = Instant::now();
+
+        // South is debounced, West (profile default 0) is not
+        for code in [ButtonCode::South, ButtonCode::West] {
+            engine.process(&InputEvent::button_press_at(code, ms(t, 0))).unwrap();
+            engine.process(&InputEvent::button_release_at(code, ms(t, 10))).unwrap();
+            engine.process(&InputEvent::button_press_at(code, ms(t, 20))).unwrap();
+        }
+        assert_eq!(engine.debounced_count(), 1);
+    }
+
+    #[test]
+    fn test_slow_keys_drop_brief_presses() {
+        use KeyboardEventType::{Press, Release};
+
+        let mut profile = Profile::default_profile();
+        profile.settings.slow_keys_ms = 100;
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let base = Instant::now();
+        let mut step = |event: InputEvent| engine.process(&event).unwrap();
+
+        // Let go too soon: nothing
+        assert!(step(InputEvent::button_press_at(ButtonCode::South, ms(base, 0))).is_empty());
+        assert!(step(InputEvent::button_release_at(ButtonCode::South, ms(base, 60))).is_empty());
+
+        // Held long enough: pressed when the time is up, not at release
+        assert!(step(InputEvent::button_press_at(ButtonCode::South, ms(base, 200))).is_empty());
+        assert_eq!(engine.next_deadline(), Some(ms(base, 300)));
+        let mut out = Vec::new();
+        engine.tick(ms(base, 299), &mut out);
+        assert!(out.is_empty());
+        engine.tick(ms(base, 300), &mut out);
+        assert_eq!(out, [key(KeyboardCode::S, Press)]);
+        assert_eq!(engine.next_deadline(), None);
+        let out = engine.process(&InputEvent::button_release_at(ButtonCode::South, ms(base, 900)));
+        assert_eq!(out.unwrap(), [key(KeyboardCode::S, Release)]);
+        assert_eq!(engine.debounced_count(), 2);
+    }
+
+    #[test]
+    fn test_later_event_lets_slow_key_through_first() {
+        use KeyboardEventType::Press;
+
+        let mut profile = Profile::default_profile();
+        profile.settings.slow_keys_ms = 100;
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let base = Instant::now();
+
+        engine.process(&InputEvent::button_press_at(ButtonCode::South, ms(base, 0))).unwrap();
+        let out =
+            engine.process(&InputEvent::button_press_at(ButtonCode::North, ms(base, 150))).unwrap();
+        assert_eq!(out, [key(KeyboardCode::S, Press)]);
+    }
+
+    #[test]
+    fn test_bounce_keys_outlast_mapping_debounce() {
+        let mut profile = debounced_profile(0);
+        profile.settings.bounce_keys_ms = 300;
+        let south = profile.mappings.iter_mut().find(|m| m.source_name == "South").unwrap();
+        south.debounce_ms = Some(10);
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let base = Instant::now();
+        let mut step = |event: InputEvent| engine.process(&event).unwrap().len();
+
+        assert_eq!(step(InputEvent::button_press_at(ButtonCode::South, ms(base, 0))), 1);
+        assert_eq!(step(InputEvent::button_release_at(ButtonCode::South, ms(base, 50))), 1);
+        // A tremor pressing again
+        assert_eq!(step(InputEvent::button_press_at(ButtonCode::South, ms(base, 250))), 0);
+        assert_eq!(step(InputEvent::button_release_at(ButtonCode::South, ms(base, 280))), 0);
+        assert_eq!(step(InputEvent::button_press_at(ButtonCode::South, ms(base, 700))), 1);
+    }
+
+    #[test]
+    fn test_held_key_repeats() {
+        use KeyboardEventType::{Hold, Press, Release};
 
-        for mapping in &profile.mappings {
-            match MappingRule::try_from(mapping)? {
-                ButtonToKey { source, target } => {
-                    button_rules.insert(source, target);
-                }
-                AxisDirectionToKey { source, direction, target } => {
-                    axis_rules.insert((source, direction), target);
-                }
+        let mut profile = Profile::default_profile();
+        for mapping in &mut profile.mappings {
+            if mapping.source_name == "South" || mapping.target_name == "Up" {
+                mapping.repeat_delay_ms = Some(300);
+                mapping.repeat_rate = Some(20);
             }
         }
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let base = Instant::now();
 
-        tracing::info!(
-            "Mapping engine initialized with {} button rules, {} axis rules",
-            button_rules.len(),
-            axis_rules.len()
-        );
+        let out = engine.process(&InputEvent::button_press_at(ButtonCode::South, ms(base, 0)));
+        assert_eq!(out.unwrap(), [key(KeyboardCode::S, Press)]);
+        assert_eq!(engine.next_deadline(), Some(ms(base, 300)));
+        let mut out = Vec::new();
+        for at in [300, 350, 400] {
+            engine.tick(ms(base, at), &mut out);
+        }
+        assert_eq!(out, vec![key(KeyboardCode::S, Hold); 3]);
+        assert_eq!(engine.next_deadline(), Some(ms(base, 450)));
+
+        // Letting go stops it
+        let out = engine.process(&InputEvent::button_release_at(ButtonCode::South, ms(base, 440)));
+        assert_eq!(out.unwrap(), [key(KeyboardCode::S, Release)]);
+        assert_eq!(engine.next_deadline(), None);
 
-        Ok(Self { button_rules, axis_rules, axis_states: HashMap::new() })
+        // As on a keyboard, pressing another key stops the repeat for good
+        engine.process(&InputEvent::button_press_at(ButtonCode::South, ms(base, 450))).unwrap();
+        engine.process(&InputEvent::button_press_at(ButtonCode::North, ms(base, 460))).unwrap();
+        engine.process(&InputEvent::button_release_at(ButtonCode::North, ms(base, 470))).unwrap();
+        assert_eq!(engine.next_deadline(), None);
+        engine.process(&InputEvent::button_release_at(ButtonCode::South, ms(base, 480))).unwrap();
+
+        // D-pad directions repeat too
+        engine.process(&InputEvent::axis_move_at(AxisCode::DPadY, -1, ms(base, 500))).unwrap();
+        let mut out = Vec::new();
+        engine.tick(ms(base, 800), &mut out);
+        assert_eq!(out, [key(KeyboardCode::Up, Hold)]);
     }
 
-    pub fn new_hardcoded() -> Self {
-        let mut button_rules = HashMap::new();
-        let mut axis_rules = HashMap::new();
+    fn key(code: KeyboardCode, event_type: KeyboardEventType) -> OutputEvent {
+        OutputEvent::Keyboard { code, event_type }
+    }
+
+    fn sticky_profile() -> Profile {
+        use crate::mapping::{Mapping, types::TargetType};
+
+        let mut profile = Profile::default_profile();
+        for (source, target) in [("LeftShoulder", "Left Shift"), ("RightShoulder", "Left Control")]
+        {
+            profile.mappings.push(Mapping {
+                source_name: source.to_string(),
+                target_type: TargetType::Keyboard,
+                target_name: target.to_string(),
+                sticky: true,
+                ..Default::default()
+            });
+        }
+        profile
+    }
 
-        // Button mappings
-        button_rules.insert(ButtonCode::South, KeyboardCode::S);
-        button_rules.insert(ButtonCode::East, KeyboardCode::D);
-        button_rules.insert(ButtonCode::West, KeyboardCode::A);
+    #[test]
+    fn test_sticky_key_held_until_next_press_is_over() {
+        use KeyboardEventType::{Press, Release};
 
-        // DPad mappings
-        axis_rules.insert((AxisCode::DPadY, AxisDirection::Negative), KeyboardCode::Up);
-        axis_rules.insert((AxisCode::DPadY, AxisDirection::Positive), KeyboardCode::Down);
-        axis_rules.insert((AxisCode::DPadX, AxisDirection::Negative), KeyboardCode::Left);
-        axis_rules.insert((AxisCode::DPadX, AxisDirection::Positive), KeyboardCode::Right);
+        let mut engine = MappingEngine::load_from_profile(&sticky_profile()).unwrap();
+        let mut step = |event: InputEvent| engine.process(&event).unwrap();
 
-        tracing::info!(
-            "Mapping engine initialized with {} button rules, {} axis rules",
-            button_rules.len(),
-            axis_rules.len()
+        assert_eq!(
+            step(InputEvent::button_press(ButtonCode::LeftShoulder)),
+            [key(KeyboardCode::LeftShift, Press)]
+        );
+        // Letting go of the sticky button keeps its key down
+        assert!(step(InputEvent::button_release(ButtonCode::LeftShoulder)).is_empty());
+        assert_eq!(
+            step(InputEvent::button_press(ButtonCode::South)),
+            [key(KeyboardCode::S, Press)]
+        );
+        assert_eq!(
+            step(InputEvent::button_release(ButtonCode::South)),
+            [key(KeyboardCode::S, Release), key(KeyboardCode::LeftShift, Release)]
+        );
+        // Only the first press after latching lets go
+        assert_eq!(
+            step(InputEvent::button_press(ButtonCode::South)),
+            [key(KeyboardCode::S, Press)]
         );
-
-        Self { button_rules, axis_rules, axis_states: HashMap::new() }
     }
 
-    pub fn process(&mut self, event: &InputEvent) -> Result<Vec<OutputEvent>> {
-        match event {
-            InputEvent::Button { code, pressed, .. } => self.process_button(*code, *pressed),
-            InputEvent::Axis { code, value, .. } => self.process_axis(*code, *value),
-            InputEvent::Sync { .. } => Ok(vec![]),
+    #[test]
+    fn test_sticky_keys_combine_and_toggle() {
+        use KeyboardEventType::Release;
+
+        let mut engine = MappingEngine::load_from_profile(&sticky_profile()).unwrap();
+        for code in [ButtonCode::LeftShoulder, ButtonCode::RightShoulder] {
+            engine.process(&InputEvent::button_press(code)).unwrap();
+            engine.process(&InputEvent::button_release(code)).unwrap();
         }
+        assert!(engine.take_sticky_changed());
+        assert!(!engine.take_sticky_changed());
+        assert_eq!(
+            engine.sticky_keys().collect::<Vec<_>>(),
+            [KeyboardCode::LeftShift, KeyboardCode::LeftControl]
+        );
+
+        // Pressing a sticky button again lets go of its key alone
+        let out = engine.process(&InputEvent::button_press(ButtonCode::LeftShoulder)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::LeftShift, Release)]);
+        assert!(engine.take_sticky_changed());
+
+        // The D-pad counts as a press too
+        engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+        let out = engine.process(&InputEvent::axis_move(AxisCode::DPadY, 0)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::Up, Release), key(KeyboardCode::LeftControl, Release)]);
+        assert_eq!(engine.sticky_keys().count(), 0);
     }
 
-    fn process_button(&self, code: ButtonCode, pressed: bool) -> Result<Vec<OutputEvent>> {
-        if let Some(&target_key) = self.button_rules.get(&code) {
-            let event = OutputEvent::Keyboard {
-                code: target_key,
-                event_type: if pressed {
-                    KeyboardEventType::Press
-                } else {
-                    KeyboardEventType::Release
-                },
-            };
-            Ok(vec![event])
-        } else {
-            Ok(vec![])
-        }
+    #[test]
+    fn test_mirror_layer_makes_dpad_act_as_face_buttons() {
+        use KeyboardEventType::{Press, Release};
+
+        let mut engine =
+            MappingEngine::load_from_profile(&Profile::one_handed_left_profile()).unwrap();
+        let mut step = |event: InputEvent| engine.process(&event).unwrap();
+
+        // The layer button has no key of its own
+        assert!(step(InputEvent::button_press(ButtonCode::LeftShoulder)).is_empty());
+        assert_eq!(step(InputEvent::axis_move(AxisCode::DPadY, -1)), [key(KeyboardCode::W, Press)]);
+        // Letting go of the layer while the D-pad is held moves it back
+        assert_eq!(
+            step(InputEvent::button_release(ButtonCode::LeftShoulder)),
+            [key(KeyboardCode::W, Release), key(KeyboardCode::Up, Press)]
+        );
+        assert_eq!(
+            step(InputEvent::axis_move(AxisCode::DPadY, 0)),
+            [key(KeyboardCode::Up, Release)]
+        );
+        // Without the layer, a face button is itself
+        assert_eq!(
+            step(InputEvent::button_press(ButtonCode::North)),
+            [key(KeyboardCode::W, Press)]
+        );
     }
 
-    fn process_axis(&mut self, code: AxisCode, new_value: i32) -> Result<Vec<OutputEvent>> {
-        // Skip if not a DPad axis or if in deadzone
-        if !matches!(code, AxisCode::DPadX | AxisCode::DPadY) {
-            return Ok(vec![]);
-        }
+    #[test]
+    fn test_mirror_face_buttons_and_stick() {
+        use KeyboardEventType::{Press, Release};
 
-        let old_value = self.axis_states.get(&code).copied().unwrap_or(0);
-        self.axis_states.insert(code, new_value);
+        let mut engine =
+            MappingEngine::load_from_profile(&Profile::one_handed_right_profile()).unwrap();
+        engine.process(&InputEvent::button_press(ButtonCode::RightShoulder)).unwrap();
+        let out = engine.process(&InputEvent::button_press(ButtonCode::West)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::Left, Press)]);
+        let out = engine.process(&InputEvent::button_release(ButtonCode::West)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::Left, Release)]);
 
-        let mut events = Vec::new();
+        engine.process(&InputEvent::axis_move(AxisCode::RightX, 12000)).unwrap();
+        assert_eq!(engine.axis_states[AxisCode::LeftX.index()], 12000);
+        assert_eq!(engine.axis_states[AxisCode::RightX.index()], 0);
+        engine.process(&InputEvent::button_release(ButtonCode::RightShoulder)).unwrap();
+        assert_eq!(engine.axis_states[AxisCode::LeftX.index()], 0);
+        assert_eq!(engine.axis_states[AxisCode::RightX.index()], 12000);
+    }
 
-        // Detect direction changes and generate press/release events
-        let old_direction = Self::value_to_direction(old_value);
-        let new_direction = Self::value_to_direction(new_value);
+    #[test]
+    fn test_unknown_desktop_action_fails_profile_load() {
+        use crate::mapping::{Mapping, types::TargetType};
 
-        // Release old direction if it changed
-        #[allow(clippy::collapsible_if)]
-        if let Some(old_dir) = old_direction {
-            if old_direction != new_direction {
-                if let Some(&target_key) = self.axis_rules.get(&(code, old_dir)) {
-                    events.push(OutputEvent::Keyboard {
-                        code: target_key,
-                        event_type: KeyboardEventType::Release,
-                    });
-                }
-            }
-        }
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: ButtonCode::Mode.to_string(),
+            target_type: TargetType::Desktop,
+            target_name: "Lights".to_string(),
+            ..Default::default()
+        });
+        let err = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(format!("{:#}", err), "Unknown desktop action 'Lights' for Mode");
+    }
 
-        // Press new direction if: active
-        #[allow(clippy::collapsible_if)]
-        if let Some(new_dir) = new_direction {
-            if old_direction != new_direction {
-                if let Some(&target_key) = self.axis_rules.get(&(code, new_dir)) {
-                    events.push(OutputEvent::Keyboard {
-                        code: target_key,
-                        event_type: KeyboardEventType::Press,
-                    });
-                }
-            }
-        }
+    #[test]
+    fn test_invalid_mirror_fails_profile_load() {
+        use crate::mapping::{Mapping, types::TargetType};
 
-        Ok(events)
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: ButtonCode::South.to_string(),
+            target_type: TargetType::Mirror,
+            target_name: AxisCode::LeftX.to_string(),
+            ..Default::default()
+        });
+        let err = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(format!("{:#}", err), "Mirror mapping for South can't act as 'Left X'");
     }
 
-    fn value_to_direction(value: i32) -> Option<AxisDirection> {
-        const THRESHOLD: i32 = 0;
+    #[test]
+    fn test_mouse_and_gamepad_targets() {
+        use crate::input::keymouse::MouseButton;
+        use crate::mapping::{Mapping, types::TargetType};
+        use crate::output::mouse::MouseEvent;
 
-        if value > THRESHOLD {
-            Some(AxisDirection::Positive)
-        } else if value < -THRESHOLD {
-            Some(AxisDirection::Negative)
-        } else {
-            None // Centered/neutral
-        }
+        let mut profile = Profile::default_profile();
+        let mapping = |source: &str, direction: Option<&str>, target_type, target: &str| Mapping {
+            source_name: source.to_string(),
+            source_direction: direction.map(str::to_string),
+            target_type,
+            target_name: target.to_string(),
+            ..Default::default()
+        };
+        profile.mappings = vec![
+            mapping("Right Shoulder", None, TargetType::Mouse, "Left"),
+            mapping("Left Shoulder", None, TargetType::Mouse, "Wheel Down"),
+            mapping("DPad Y", Some("Negative"), TargetType::Gamepad, "Left Y Up"),
+            mapping("Mode", None, TargetType::Gamepad, "Start"),
+        ];
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+
+        let click =
+            |pressed| OutputEvent::Mouse(MouseEvent::Button { button: MouseButton::Left, pressed });
+        let out = engine.process(&InputEvent::button_press(ButtonCode::RightShoulder)).unwrap();
+        assert_eq!(out, [click(true)]);
+        let out = engine.process(&InputEvent::button_release(ButtonCode::RightShoulder)).unwrap();
+        assert_eq!(out, [click(false)]);
+
+        // The wheel turns a notch per press
+        let out = engine.process(&InputEvent::button_press(ButtonCode::LeftShoulder)).unwrap();
+        assert_eq!(out, [OutputEvent::Mouse(MouseEvent::Scroll { vertical: -1, horizontal: 0 })]);
+        assert!(
+            engine
+                .process(&InputEvent::button_release(ButtonCode::LeftShoulder))
+                .unwrap()
+                .is_empty()
+        );
+
+        let stick_up = ActionSource::Axis(AxisCode::LeftY, AxisDirection::Negative);
+        let out = engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+        assert_eq!(out, [OutputEvent::Gamepad { control: stick_up, pressed: true }]);
+        let out = engine.process(&InputEvent::axis_move(AxisCode::DPadY, 0)).unwrap();
+        assert_eq!(out, [OutputEvent::Gamepad { control: stick_up, pressed: false }]);
+
+        profile.mappings.push(mapping("South", None, TargetType::Gamepad, "Jump"));
+        let err = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(format!("{:#}", err), "Unknown Gamepad target 'Jump' for South");
     }
-}
 
-#[cfg(test)]
-mod tests {
-    use super::*;
-    use crate::event::{AxisCode, ButtonCode};
+    #[test]
+    fn test_mappings_route_to_custom_devices() {
+        use crate::mapping::{Mapping, types::TargetType};
+        use crate::output::identity::DeviceIdentities;
+        use std::sync::Arc;
+
+        let mut profile = Profile::default_profile();
+        profile.settings.virtual_devices = toml::from_str::<DeviceIdentities>(
+            "custom.p2 = { kind = \"gamepad\" }\ncustom.chat = { kind = \"keyboard\" }",
+        )
+        .unwrap();
+        let mapping = |source: &str, target_type, target: &str, device: &str| Mapping {
+            source_name: source.to_string(),
+            target_type,
+            target_name: target.to_string(),
+            device: Some(device.to_string()),
+            sticky: true,
+            ..Default::default()
+        };
+        profile.mappings = vec![
+            mapping("South", TargetType::Gamepad, "East", "p2"),
+            mapping("North", TargetType::Keyboard, "T", "chat"),
+            mapping("West", TargetType::Keyboard, "Space", "keyboard"),
+        ];
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+
+        let routed = |device: &str, event| OutputEvent::Routed {
+            device: Arc::from(device),
+            event: Box::new(event),
+        };
+        let east = ActionSource::Button(ButtonCode::East);
+        let out = engine.process(&InputEvent::button_press(ButtonCode::South)).unwrap();
+        assert_eq!(out, [routed("p2", OutputEvent::Gamepad { control: east, pressed: true })]);
+        // Keys on a custom keyboard are plain presses: never sticky
+        engine.process(&InputEvent::button_press(ButtonCode::North)).unwrap();
+        let out = engine.process(&InputEvent::button_release(ButtonCode::North)).unwrap();
+        let release =
+            OutputEvent::Keyboard { code: KeyboardCode::T, event_type: KeyboardEventType::Release };
+        assert_eq!(out, [routed("chat", release)]);
+
+        profile.mappings.push(mapping("East", TargetType::Mouse, "Left", "p3"));
+        let err = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(format!("{:#}", err), "Mapping for East routes to unknown device 'p3'");
+        profile.mappings.pop();
+        profile.mappings.push(mapping("East", TargetType::Mouse, "Left", "p2"));
+        let err = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(
+            format!("{:#}", err),
+            "Mapping for East can't send Mouse output to gamepad device 'p2'"
+        );
+    }
 
     #[test]
-    fn test_mapping_engine_hardcoded_press() {
-        let mut engine = MappingEngine::new_hardcoded();
-        let input = InputEvent::button_press(ButtonCode::South);
+    fn test_stick_flicks_fire_once_per_flick() {
+        use crate::mapping::{Mapping, types::Flick};
+        use crate::output::mouse::MouseEvent;
+        use KeyboardEventType::{Press, Release};
 
-        let result = engine.process(&input).unwrap();
+        let mut profile = Profile::default_profile();
+        let flick = |direction: &str, target_type, target: &str| Mapping {
+            source_name: "Right Y".to_string(),
+            source_direction: Some(direction.to_string()),
+            target_type,
+            target_name: target.to_string(),
+            flick: Some(Flick::default()),
+            ..Default::default()
+        };
+        profile.mappings = vec![
+            flick("Negative", TargetType::Mouse, "Wheel Up"),
+            flick("Positive", TargetType::Keyboard, "Left Control + ="),
+        ];
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let base = Instant::now();
+        let mut stick = |value, at| {
+            let event = InputEvent::Axis { code: AxisCode::RightY, value, timestamp: ms(base, at) };
+            engine.process(&event).unwrap()
+        };
 
-        assert_eq!(result.len(), 1);
-        let OutputEvent::Keyboard { code, event_type } = result[0];
-        assert_eq!(code, KeyboardCode::S);
-        assert_eq!(event_type, KeyboardEventType::Press);
+        let scroll = OutputEvent::Mouse(MouseEvent::Scroll { vertical: 1, horizontal: 0 });
+        assert_eq!(stick(-30000, 0), [scroll.clone()]);
+        assert!(stick(-32768, 10).is_empty());
+        assert!(stick(0, 40).is_empty());
+        // Springing back past center is within the cooldown
+        assert!(stick(25000, 60).is_empty());
+        assert!(stick(0, 80).is_empty());
+        assert_eq!(stick(-30000, 300), [scroll]);
+        assert!(stick(0, 320).is_empty());
+
+        // A slow push isn't a flick
+        assert!(stick(8000, 600).is_empty());
+        assert!(stick(30000, 900).is_empty());
+        assert!(stick(0, 950).is_empty());
+
+        assert_eq!(
+            stick(30000, 1200),
+            [key(KeyboardCode::LeftControl, Press), key(KeyboardCode::Equal, Press)]
+        );
+        assert_eq!(
+            stick(1000, 1260),
+            [key(KeyboardCode::Equal, Release), key(KeyboardCode::LeftControl, Release)]
+        );
+
+        profile.mappings[0].flick = Some(Flick { threshold: 100, cooldown_ms: 0 });
+        let err = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(
+            err.to_string(),
+            "Invalid flick for Right Y: threshold 100 must be between 2561 and 32767"
+        );
     }
 
     #[test]
-    fn test_mapping_engine_hardcoded_release() {
-        let mut engine = MappingEngine::new_hardcoded();
-        let input = InputEvent::button_release(ButtonCode::East);
+    fn test_swap_ab_xy_applies_before_mappings() {
+        use KeyboardEventType::Press;
 
-        let result = engine.process(&input).unwrap();
+        let mut profile = Profile::default_profile();
+        profile.settings.swap_ab_xy = true;
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
 
-        assert_eq!(result.len(), 1);
-        let OutputEvent::Keyboard { code, event_type } = result[0];
-        assert_eq!(code, KeyboardCode::D);
-        assert_eq!(event_type, KeyboardEventType::Release);
+        let out = engine.process(&InputEvent::button_press(ButtonCode::East)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::S, Press)]);
+        let out = engine.process(&InputEvent::button_press(ButtonCode::North)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::A, Press)]);
+
+        engine.set_layout(Layout::default());
+        let out = engine.process(&InputEvent::button_press(ButtonCode::West)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::A, Press)]);
     }
 
     #[test]
-    fn test_unmapped_button() {
-        let mut engine = MappingEngine::new_hardcoded();
-        let input = InputEvent::button_press(ButtonCode::North); // North is not in hardcoded rules
+    fn test_southpaw_dpad_moves_to_the_right_stick() {
+        use KeyboardEventType::{Press, Release};
 
-        let result = engine.process(&input).unwrap();
-        assert!(result.is_empty());
+        let mut engine =
+            MappingEngine::load_from_profile(&Profile::southpaw_profile(true)).unwrap();
+        let axis = |code, value| InputEvent::Axis { code, value, timestamp: Instant::now() };
+
+        // The right stick drives the D-pad's arrow keys...
+        let out = engine.process(&axis(AxisCode::RightX, -20_000)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::Left, Press)]);
+        let out = engine.process(&axis(AxisCode::RightX, 0)).unwrap();
+        assert_eq!(out, [key(KeyboardCode::Left, Release)]);
+        // ...and the D-pad, now a stick, no longer does
+        let out = engine.process(&axis(AxisCode::DPadX, -1)).unwrap();
+        assert_eq!(out, []);
+        assert_eq!(engine.axis_states[AxisCode::LeftX.index()], -1);
     }
 
     #[test]
-    fn test_axis_passthrough_returns_none() {
-        let mut engine = MappingEngine::new_hardcoded();
-        let input = InputEvent::axis_move(AxisCode::LeftX, 100);
+    fn test_trigger_thresholds_press_with_hysteresis() {
+        use crate::mapping::{Mapping, profile::TriggerThreshold};
+        use KeyboardEventType::{Press, Release};
 
-        let result = engine.process(&input).unwrap();
-        assert!(result.is_empty());
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: ButtonCode::RightTrigger.to_string(),
+            target_type: TargetType::Keyboard,
+            target_name: KeyboardCode::Space.to_string(),
+            ..Default::default()
+        });
+        profile.settings.right_trigger = Some(TriggerThreshold { press: 100, release: Some(60) });
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let trigger = |value| InputEvent::Axis {
+            code: AxisCode::RightTrigger,
+            value,
+            timestamp: Instant::now(),
+        };
+        let right_trigger = KeyboardCode::Space;
+
+        assert_eq!(engine.process(&trigger(99)).unwrap(), []);
+        assert_eq!(engine.process(&trigger(100)).unwrap(), [key(right_trigger, Press)]);
+        // Resting between the thresholds doesn't chatter
+        assert_eq!(engine.process(&trigger(70)).unwrap(), []);
+        assert_eq!(engine.process(&trigger(110)).unwrap(), []);
+        assert_eq!(engine.process(&trigger(59)).unwrap(), [key(right_trigger, Release)]);
+
+        // The controller's own trigger button is left to the axis
+        let out = engine.process(&InputEvent::button_press(ButtonCode::RightTrigger)).unwrap();
+        assert_eq!(out, []);
     }
 
     #[test]
-    fn test_sync_returns_none() {
-        let mut engine = MappingEngine::new_hardcoded();
-        let input = InputEvent::sync();
+    fn test_invalid_trigger_threshold_fails_profile_load() {
+        use crate::mapping::profile::TriggerThreshold;
 
-        let result = engine.process(&input).unwrap();
-        assert!(result.is_empty());
+        let mut profile = Profile::default_profile();
+        profile.settings.left_trigger = Some(TriggerThreshold { press: 50, release: Some(80) });
+        let error = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(
+            error.to_string(),
+            "Invalid left_trigger: release threshold 80 must be between 1 and press (50)"
+        );
     }
 
     #[test]
-    fn test_dpad_up_press() {
-        let mut engine = MappingEngine::new_hardcoded();
-        let input = InputEvent::axis_move(AxisCode::DPadY, -1);
+    fn test_action_mappings_queue_actions() {
+        use crate::mapping::{Mapping, types::TargetType};
 
-        let events = engine.process(&input).unwrap();
-        assert_eq!(events.len(), 1);
+        let mut profile = Profile::default_profile();
+        for (source, direction) in [("Mode", None), ("DPad Y", Some("Negative")), ("Left X", None)]
+        {
+            profile.mappings.push(Mapping {
+                source_name: source.to_string(),
+                source_direction: direction.map(str::to_string),
+                target_type: TargetType::Plugin,
+                target_name: "lights".to_string(),
+                ..Default::default()
+            });
+        }
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
 
-        let OutputEvent::Keyboard { code, event_type } = events[0];
-        assert_eq!(code, KeyboardCode::Up);
-        assert_eq!(event_type, KeyboardEventType::Press);
+        // Actions never reach the virtual keyboard
+        assert!(engine.process(&InputEvent::button_press(ButtonCode::Mode)).unwrap().is_empty());
+        // DPad up is both a key and an action
+        let keys = engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+        assert_eq!(keys.len(), 1);
+        // A stick without direction reports every change
+        engine.process(&InputEvent::axis_move(AxisCode::LeftX, 1200)).unwrap();
+        engine.process(&InputEvent::axis_move(AxisCode::LeftX, 1200)).unwrap();
+        engine.process(&InputEvent::axis_move(AxisCode::LeftX, 0)).unwrap();
+
+        let actions: Vec<_> = engine.drain_actions().collect();
+        let left_x = ActionSource::AxisValue(AxisCode::LeftX);
+        assert_eq!(
+            actions,
+            [
+                ActionEvent {
+                    action: 0,
+                    source: ActionSource::Button(ButtonCode::Mode),
+                    pressed: true,
+                    value: 1,
+                },
+                ActionEvent {
+                    action: 1,
+                    source: ActionSource::Axis(AxisCode::DPadY, AxisDirection::Negative),
+                    pressed: true,
+                    value: -1,
+                },
+                ActionEvent { action: 2, source: left_x, pressed: true, value: 1200 },
+                ActionEvent { action: 2, source: left_x, pressed: false, value: 0 },
+            ]
+        );
+        assert_eq!(engine.drain_actions().count(), 0);
     }
 
     #[test]
-    fn test_dpad_release() {
-        let mut engine = MappingEngine::new_hardcoded();
+    fn test_script_mapping_depends_on_other_controls() {
+        use crate::mapping::{Mapping, types::TargetType};
 
-        // Press up
-        engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "Right Shoulder".to_string(),
+            target_type: TargetType::Script,
+            script: Some(
+                r#"if axis("Left Y") < -16000 then ["Left Shift", "W"] else "Space""#.into(),
+            ),
+            ..Default::default()
+        });
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let key = |code, event_type| OutputEvent::Keyboard { code, event_type };
 
-        // Release (return to center)
-        let events = engine.process(&InputEvent::axis_move(AxisCode::DPadY, 0)).unwrap();
+        assert_eq!(
+            engine.process(&InputEvent::button_press(ButtonCode::RightShoulder)).unwrap(),
+            [key(KeyboardCode::Space, KeyboardEventType::Press)]
+        );
+        // Releases what the press chose, whatever the stick does meanwhile
+        engine.process(&InputEvent::axis_move(AxisCode::LeftY, -30000)).unwrap();
+        assert_eq!(
+            engine.process(&InputEvent::button_release(ButtonCode::RightShoulder)).unwrap(),
+            [key(KeyboardCode::Space, KeyboardEventType::Release)]
+        );
 
-        assert_eq!(events.len(), 1);
-        let OutputEvent::Keyboard { code, event_type } = events[0];
-        assert_eq!(code, KeyboardCode::Up);
-        assert_eq!(event_type, KeyboardEventType::Release);
+        engine.process(&InputEvent::button_press(ButtonCode::RightShoulder)).unwrap();
+        assert_eq!(
+            engine.process(&InputEvent::button_release(ButtonCode::RightShoulder)).unwrap(),
+            [
+                key(KeyboardCode::LeftShift, KeyboardEventType::Release),
+                key(KeyboardCode::W, KeyboardEventType::Release),
+            ]
+        );
     }
 
     #[test]
-    fn test_dpad_direction_change() {
-        let mut engine = MappingEngine::new_hardcoded();
+    fn test_invalid_script_fails_profile_load() {
+        use crate::mapping::{Mapping, types::TargetType};
 
-        // Press up
-        engine.process(&InputEvent::axis_move(AxisCode::DPadY, -1)).unwrap();
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "South".to_string(),
+            target_type: TargetType::Script,
+            script: Some("if true then \"A\"".into()),
+            ..Default::default()
+        });
 
-        // Change to down (should release up, press down)
-        let events = engine.process(&InputEvent::axis_move(AxisCode::DPadY, 1)).unwrap();
+        let err = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(format!("{:#}", err), "Invalid script for South: expected 'else' at column 17");
+    }
 
-        assert_eq!(events.len(), 2);
+    #[test]
+    fn test_text_mapping_types_on_press() {
+        use crate::mapping::{Mapping, text::KeyboardLayout, types::TargetType};
 
-        let OutputEvent::Keyboard { code: code1, event_type: type1 } = events[0];
-        assert_eq!(code1, KeyboardCode::Up);
-        assert_eq!(type1, KeyboardEventType::Release);
+        let mut profile = Profile::default_profile();
+        profile.settings.keyboard_layout = KeyboardLayout::De;
+        profile.mappings.push(Mapping {
+            source_name: "Right Shoulder".to_string(),
+            target_type: TargetType::Text,
+            target_name: "Zy".to_string(),
+            ..Default::default()
+        });
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
 
-        let OutputEvent::Keyboard { code: code2, event_type: type2 } = events[1];
-        assert_eq!(code2, KeyboardCode::Down);
-        assert_eq!(type2, KeyboardEventType::Press);
+        assert_eq!(
+            engine.process(&InputEvent::button_press(ButtonCode::RightShoulder)).unwrap(),
+            [
+                key(KeyboardCode::LeftShift, KeyboardEventType::Press),
+                key(KeyboardCode::Y, KeyboardEventType::Press),
+                key(KeyboardCode::Y, KeyboardEventType::Release),
+                key(KeyboardCode::LeftShift, KeyboardEventType::Release),
+                key(KeyboardCode::Z, KeyboardEventType::Press),
+                key(KeyboardCode::Z, KeyboardEventType::Release),
+            ]
+        );
+        assert_eq!(
+            engine.process(&InputEvent::button_release(ButtonCode::RightShoulder)).unwrap(),
+            []
+        );
+
+        profile.mappings.last_mut().unwrap().target_name = "a|b".to_string();
+        let err = MappingEngine::load_from_profile(&profile).err().unwrap();
+        assert_eq!(
+            format!("{:#}", err),
+            "Invalid text for Right Shoulder: Can't type '|' on the de keyboard layout"
+        );
     }
 
     #[test]
-    fn test_load_from_profile() {
-        let profile = Profile::default_profile();
-        let engine = MappingEngine::load_from_profile(&profile).unwrap();
+    fn test_conditional_mapping_follows_context() {
+        use crate::mapping::{Mapping, types::TargetType};
 
-        assert_eq!(engine.button_rules.len(), 6);
-        assert_eq!(engine.axis_rules.len(), 4);
+        // Overrides the default South → S while a browser has focus
+        let mut profile = Profile::default_profile();
+        profile.mappings.push(Mapping {
+            source_name: "South".to_string(),
+            target_type: TargetType::Keyboard,
+            target_name: "Space".to_string(),
+            conditions: Some(Conditions { window: Some("Firefox".into()), ..Default::default() }),
+            ..Default::default()
+        });
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let key = |code, event_type| OutputEvent::Keyboard { code, event_type };
+        let browser =
+            MappingContext { window: Some("Docs — Firefox".into()), ..Default::default() };
 
-        // Verify some specific mappings from default profile
-        assert_eq!(engine.button_rules.get(&ButtonCode::North), Some(&KeyboardCode::W));
+        let mut out = Vec::new();
+        engine.set_context(browser.clone(), &mut out);
+        assert!(out.is_empty());
+        assert_eq!(
+            engine.process(&InputEvent::button_press(ButtonCode::South)).unwrap(),
+            [key(KeyboardCode::Space, KeyboardEventType::Press)]
+        );
+
+        // Held across the switch: released as Space, S applies from the next press
+        engine.set_context(MappingContext::default(), &mut out);
+        assert_eq!(out, [key(KeyboardCode::Space, KeyboardEventType::Release)]);
+        engine.process(&InputEvent::button_release(ButtonCode::South)).unwrap();
+        assert_eq!(
+            engine.process(&InputEvent::button_press(ButtonCode::South)).unwrap(),
+            [key(KeyboardCode::S, KeyboardEventType::Press)]
+        );
+
+        // Unconditional mappings don't care
+        out.clear();
+        engine.set_context(browser, &mut out);
+        assert_eq!(out, [key(KeyboardCode::S, KeyboardEventType::Release)]);
         assert_eq!(
-            engine.axis_rules.get(&(AxisCode::DPadY, AxisDirection::Negative)),
-            Some(&KeyboardCode::Up)
+            engine.process(&InputEvent::button_press(ButtonCode::North)).unwrap(),
+            [key(KeyboardCode::W, KeyboardEventType::Press)]
         );
     }
 
     #[test]
-    fn test_load_from_invalid_profile() {
-        use crate::mapping::Mapping;
-        use crate::mapping::types::TargetType;
+    fn test_switches_are_reported() {
+        use crate::mapping::{Mapping, types::TargetType};
 
-        let profile = Profile {
-            name: "Invalid".to_string(),
-            description: "Invalid profile".to_string(),
-            game_name: None,
-            mappings: vec![Mapping {
-                source_name: "DPadX".to_string(),
-                source_direction: Some("Invalid".to_string()),
-                target_type: TargetType::Keyboard,
-                target_name: "A".to_string(),
-            }],
-            settings: Default::default(),
+        let mut profile = Profile::one_handed_left_profile();
+        profile.mappings.push(Mapping {
+            source_name: "Start".to_string(),
+            target_type: TargetType::Keyboard,
+            target_name: "Escape".to_string(),
+            conditions: Some(Conditions { bluetooth: Some(true), ..Default::default() }),
+            ..Default::default()
+        });
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+        let mut out = Vec::new();
+
+        engine.process(&InputEvent::button_press(ButtonCode::LeftShoulder)).unwrap();
+        engine.process(&InputEvent::button_release(ButtonCode::LeftShoulder)).unwrap();
+        // Other buttons aren't layers
+        engine.process(&InputEvent::button_press(ButtonCode::South)).unwrap();
+        // A context no condition cares about switches nothing
+        let window = MappingContext { window: Some("Terminal".into()), ..Default::default() };
+        engine.set_context(window, &mut out);
+        engine.set_context(MappingContext { bluetooth: true, ..Default::default() }, &mut out);
+        engine.reload(&Profile::default_profile()).unwrap();
+
+        let switches: Vec<_> = engine.drain_switches().collect();
+        assert_eq!(
+            switches,
+            [
+                Switch::Layer { button: ButtonCode::LeftShoulder, on: true },
+                Switch::Layer { button: ButtonCode::LeftShoulder, on: false },
+                Switch::Context,
+                Switch::Profile("Default".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_hotkey_switches_profile_and_lets_go_of_held_keys() {
+        use crate::mapping::hotkey::{ProfileHotkey, ProfileSwitcher};
+
+        let default = Profile::default_profile();
+        let deck = Profile::steam_deck_profile();
+        let mut engine = MappingEngine::load_from_profile(&default).unwrap();
+        let switcher = ProfileSwitcher::new(vec![default, deck], ProfileHotkey::defaults());
+        engine.set_profile_switcher(switcher.unwrap()).unwrap();
+        let key = |code, event_type| OutputEvent::Keyboard { code, event_type };
+
+        // Held through the switch, so released under the mapping it pressed
+        assert_eq!(
+            engine.process(&InputEvent::button_press(ButtonCode::South)).unwrap(),
+            [key(KeyboardCode::S, KeyboardEventType::Press)]
+        );
+        assert!(engine.process(&InputEvent::button_press(ButtonCode::Mode)).unwrap().is_empty());
+        assert_eq!(
+            engine.process(&InputEvent::axis_move(AxisCode::DPadX, 1)).unwrap(),
+            [key(KeyboardCode::S, KeyboardEventType::Release)]
+        );
+        assert_eq!(engine.profile().unwrap().name, "Steam Deck");
+        assert_eq!(
+            engine.drain_switches().collect::<Vec<_>>(),
+            [Switch::Profile("Steam Deck".to_string())]
+        );
+
+        // The D-pad's release is the hotkey's too
+        assert!(engine.process(&InputEvent::axis_move(AxisCode::DPadX, 0)).unwrap().is_empty());
+        assert_eq!(
+            engine.process(&InputEvent::button_press(ButtonCode::Paddle2)).unwrap(),
+            [key(KeyboardCode::Space, KeyboardEventType::Press)]
+        );
+        engine.process(&InputEvent::axis_move(AxisCode::DPadX, -1)).unwrap();
+        assert_eq!(engine.profile().unwrap().name, "Default");
+    }
+
+    /// The fuzz/ mapper target's check on pseudo-random sequences, so plain
+    /// `cargo test` runs it too
+    #[test]
+    fn test_random_event_sequences_leave_nothing_held() {
+        use crate::mapping::format::ProfileFormat;
+        use std::collections::HashSet;
+        use std::time::Duration;
+
+        let profile =
+            Profile::decode(include_str!("../../fuzz/mapper_profile.toml"), ProfileFormat::Toml)
+                .unwrap();
+        let mut seed = 0x2545_f491_4f6c_dd1d_u64;
+        let mut random = move |n: usize| {
+            seed ^= seed << 13;
+            seed ^= seed >> 7;
+            seed ^= seed << 17;
+            (seed % n as u64) as usize
         };
 
-        let result = MappingEngine::load_from_profile(&profile);
-        assert!(result.is_err());
+        for _ in 0..200 {
+            let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+            let mut now = Instant::now();
+            let mut out = Vec::new();
+            let mut keys = HashSet::new();
+            let mut actions = HashSet::new();
+            let mut track = |engine: &mut MappingEngine, out: &mut Vec<OutputEvent>| {
+                for event in out.drain(..) {
+                    let OutputEvent::Keyboard { code, event_type } = event else {
+                        panic!("{} is not a key", event);
+                    };
+                    match event_type {
+                        KeyboardEventType::Press => keys.insert(code),
+                        _ => keys.remove(&code),
+                    };
+                }
+                for action in engine.drain_actions() {
+                    let id = (action.action, action.source.to_string());
+                    match action.pressed {
+                        true => actions.insert(id),
+                        false => actions.remove(&id),
+                    };
+                }
+            };
+
+            for _ in 0..100 {
+                now += Duration::from_millis(random(40) as u64);
+                let event = match random(5) {
+                    0 => InputEvent::Button {
+                        code: ButtonCode::ALL[random(ButtonCode::ALL.len())],
+                        pressed: random(2) == 0,
+                        timestamp: now,
+                    },
+                    1 | 2 => InputEvent::Axis {
+                        code: AxisCode::ALL[random(AxisCode::ALL.len())],
+                        value: [0, -1, 1, -20000, 20000][random(5)],
+                        timestamp: now,
+                    },
+                    3 => InputEvent::Sync { timestamp: now },
+                    _ => {
+                        let context = MappingContext {
+                            window: (random(2) == 0).then(|| "Docs — Firefox".to_string()),
+                            bluetooth: random(2) == 0,
+                            battery: Some(random(101) as u8),
+                        };
+                        engine.set_context(context, &mut out);
+                        track(&mut engine, &mut out);
+                        continue;
+                    }
+                };
+                engine.process_into(&event, &mut out).unwrap();
+                track(&mut engine, &mut out);
+            }
+
+            now += Duration::from_secs(1);
+            for code in ButtonCode::ALL {
+                let event = InputEvent::Button { code, pressed: false, timestamp: now };
+                engine.process_into(&event, &mut out).unwrap();
+            }
+            for code in AxisCode::ALL {
+                let event = InputEvent::Axis { code, value: 0, timestamp: now };
+                engine.process_into(&event, &mut out).unwrap();
+            }
+            track(&mut engine, &mut out);
+            assert!(keys.is_empty(), "keys left held: {:?}", keys);
+            assert!(actions.is_empty(), "actions left held: {:?}", actions);
+        }
     }
 }
@@ -0,0 +1,251 @@
+// Profile file formats
+//
+// TOML is the native format; YAML and JSON work too, picked by extension.
+// Every format decodes to the same TOML document, so seals, schema
+// migrations and validation behave identically whichever one a file uses,
+// and a profile converted between formats keeps its checksum.
+
+use anyhow::{Context, Result};
+use std::path::Path;
+use toml::Table;
+
+use crate::mapping::{integrity::Integrity, profile::Profile, yaml};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ProfileFormat {
+    Toml,
+    Yaml,
+    Json,
+}
+
+impl ProfileFormat {
+    /// Extensions of profile files, in order of preference when several
+    /// files share a name
+    pub const EXTENSIONS: [&str; 4] = ["toml", "yaml", "yml", "json"];
+
+    pub fn from_extension(extension: &str) -> Option<Self> {
+        match extension.to_ascii_lowercase().as_str() {
+            "toml" => Some(Self::Toml),
+            "yaml" | "yml" => Some(Self::Yaml),
+            "json" => Some(Self::Json),
+            _ => None,
+        }
+    }
+
+    /// By the file's extension; TOML unless it's a known other one
+    pub fn from_path(path: &Path) -> Self {
+        path.extension()
+            .and_then(|extension| extension.to_str())
+            .and_then(Self::from_extension)
+            .unwrap_or(Self::Toml)
+    }
+
+    /// Parse a document, not yet checked against the profile schema
+    pub fn decode(self, text: &str) -> Result<Table> {
+        let context = || format!("Failed to parse profile {}", self);
+        match self {
+            Self::Toml => toml::from_str(text).with_context(context),
+            Self::Yaml => yaml::parse(text).with_context(context),
+            Self::Json => {
+                let document: serde_json::Value =
+                    serde_json::from_str(text).with_context(context)?;
+                match toml::Value::try_from(document).with_context(context)? {
+                    toml::Value::Table(table) => Ok(table),
+                    _ => anyhow::bail!("A JSON profile must be an object"),
+                }
+            }
+        }
+    }
+
+    pub fn encode(self, document: &Table) -> Result<String> {
+        Ok(match self {
+            Self::Toml => toml::to_string_pretty(document)?,
+            Self::Yaml => yaml::to_string(document),
+            Self::Json => serde_json::to_string_pretty(document)? + "\n",
+        })
+    }
+
+    pub fn encode_profile(self, profile: &Profile) -> Result<String> {
+        Ok(match self {
+            // Field order as declared, rather than the document's
+            Self::Toml => toml::to_string_pretty(profile)?,
+            Self::Json => serde_json::to_string_pretty(profile)? + "\n",
+            Self::Yaml => match toml::Value::try_from(profile)? {
+                toml::Value::Table(table) => yaml::to_string(&table),
+                _ => unreachable!("profiles serialize as tables"),
+            },
+        })
+    }
+
+    /// `text` without its integrity section
+    ///
+    /// TOML and YAML are edited as text so comments survive; JSON has none
+    /// and is rewritten.
+    pub fn without_integrity(self, text: &str) -> Result<String> {
+        match self {
+            Self::Toml => Ok(drop_section(text, |line| {
+                let line = line.trim_start();
+                line.starts_with('[').then(|| line.starts_with("[integrity]"))
+            })),
+            // Top-level keys start in the first column
+            Self::Yaml => Ok(drop_section(text, |line| {
+                let top_level = !line.starts_with([' ', '#']) && !line.trim().is_empty();
+                top_level.then(|| line.starts_with("integrity:"))
+            })),
+            Self::Json => {
+                let mut document = self.decode(text)?;
+                document.remove("integrity");
+                self.encode(&document)
+            }
+        }
+    }
+
+    /// Add `integrity` to a document that has none
+    pub fn with_integrity(self, text: &str, integrity: &Integrity) -> Result<String> {
+        let seal = match toml::Value::try_from(integrity)? {
+            toml::Value::Table(table) => table,
+            _ => unreachable!("the seal serializes as a table"),
+        };
+        let mut sealed = text.trim_end().to_string();
+        match self {
+            Self::Toml => {
+                sealed.push_str("\n\n[integrity]\n");
+                sealed.push_str(&toml::to_string(&seal)?);
+            }
+            Self::Yaml => {
+                let mut section = Table::new();
+                section.insert("integrity".to_string(), toml::Value::Table(seal));
+                sealed.push_str("\n\n");
+                sealed.push_str(&yaml::to_string(&section));
+            }
+            Self::Json => {
+                let mut document = self.decode(text)?;
+                document.insert("integrity".to_string(), toml::Value::Table(seal));
+                sealed = self.encode(&document)?;
+            }
+        }
+        Ok(sealed)
+    }
+}
+
+impl std::fmt::Display for ProfileFormat {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(match self {
+            Self::Toml => "TOML",
+            Self::Yaml => "YAML",
+            Self::Json => "JSON",
+        })
+    }
+}
+
+/// Drop the lines of one section
+///
+/// `starts` tells for a line whether it begins a section (Some) and whether
+/// that's the one to drop (Some(true)).
+fn drop_section(text: &str, starts: impl Fn(&str) -> Option<bool>) -> String {
+    let mut inside = false;
+    let mut out = String::with_capacity(text.len());
+    for line in text.lines() {
+        if let Some(dropped) = starts(line) {
+            inside = dropped;
+        }
+        if !inside {
+            out.push_str(line);
+            out.push('\n');
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::mapping::integrity;
+
+    const YAML: &str = r#"# Racing, for people who like YAML
+name: Racing
+description: "Shared by the league"
+mappings:
+  - source_name: South
+    target_type: Keyboard
+    target_name: Space
+  - source_name: DPad Y
+    source_direction: up
+    target_type: Keyboard
+    target_name: W
+"#;
+
+    #[test]
+    fn test_format_from_path() {
+        let format = |path: &str| ProfileFormat::from_path(Path::new(path));
+        assert_eq!(format("racing.toml"), ProfileFormat::Toml);
+        assert_eq!(format("racing.YML"), ProfileFormat::Yaml);
+        assert_eq!(format("racing.yaml"), ProfileFormat::Yaml);
+        assert_eq!(format("racing.json"), ProfileFormat::Json);
+        assert_eq!(format("racing.profile"), ProfileFormat::Toml);
+        assert_eq!(format("racing"), ProfileFormat::Toml);
+    }
+
+    #[test]
+    fn test_formats_load_alike() {
+        let yaml = Profile::decode(YAML, ProfileFormat::Yaml).unwrap();
+        // Migrated like any other profile
+        assert_eq!(yaml.schema_version, 1);
+        assert_eq!(yaml.mappings[1].source_direction.as_deref(), Some("Negative"));
+
+        for format in [ProfileFormat::Toml, ProfileFormat::Yaml, ProfileFormat::Json] {
+            let text = format.encode_profile(&yaml).unwrap();
+            let loaded = Profile::decode(&text, format).unwrap();
+            assert_eq!(format.encode_profile(&loaded).unwrap(), text, "{}", format);
+            assert_eq!(loaded.mappings.len(), 2);
+        }
+    }
+
+    #[test]
+    fn test_invalid_profiles_fail_alike() {
+        let cases = [
+            (ProfileFormat::Toml, "name = \"x\"\nmappings = 3\n"),
+            (ProfileFormat::Yaml, "name: x\nmappings: 3\n"),
+            (ProfileFormat::Json, r#"{"name": "x", "mappings": 3}"#),
+        ];
+        for (format, text) in cases {
+            let err = Profile::decode(text, format).unwrap_err();
+            assert_eq!(err.to_string(), format!("Failed to parse profile {}", format));
+        }
+        assert_eq!(
+            Profile::decode("[1, 2]", ProfileFormat::Json).unwrap_err().to_string(),
+            "A JSON profile must be an object"
+        );
+    }
+
+    #[test]
+    fn test_seal_survives_conversion() {
+        let table = ProfileFormat::Yaml.decode(YAML).unwrap();
+        let integrity = integrity::seal(&table, None);
+
+        for format in [ProfileFormat::Toml, ProfileFormat::Yaml, ProfileFormat::Json] {
+            let body = format.encode(&table).unwrap();
+            let sealed = format.with_integrity(&body, &integrity).unwrap();
+            let decoded = format.decode(&sealed).unwrap();
+            assert_eq!(integrity::verify(&decoded, &[]).unwrap(), integrity::Verified::Checksum);
+            assert_eq!(format.decode(&format.without_integrity(&sealed).unwrap()).unwrap(), table);
+        }
+    }
+
+    #[test]
+    fn test_yaml_seal_keeps_comments() {
+        let path =
+            std::env::temp_dir().join(format!("blazeremap-seal-{}.yaml", std::process::id()));
+        std::fs::write(&path, YAML).unwrap();
+
+        integrity::seal_file(&path, None).unwrap();
+        integrity::seal_file(&path, None).unwrap();
+        let sealed = std::fs::read_to_string(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+
+        assert!(sealed.starts_with(YAML));
+        assert_eq!(sealed.matches("integrity:").count(), 1);
+        let table = ProfileFormat::Yaml.decode(&sealed).unwrap();
+        assert_eq!(integrity::verify(&table, &[]).unwrap(), integrity::Verified::Checksum);
+    }
+}
@@ -0,0 +1,290 @@
+// Switching profiles from the controller
+//
+// `run` can be given several profiles. A chord of controls held together
+// steps through them or jumps to one by name, without reaching for the
+// keyboard:
+//
+//   Mode+DPad Right=next        the default chords, with several profiles
+//   Mode+DPad Left=previous
+//   Mode+North=Racing           the profile named Racing
+//
+// The engine watches for the chords before mapping anything. The control
+// completing a chord is taken, press and release; the others map as
+// usual, so chords are best built on a button the profiles leave free.
+
+use std::fmt;
+use std::str::FromStr;
+
+use anyhow::{Result, bail};
+
+use crate::{
+    event::{ActionSource, AxisCode, AxisDirection, ButtonCode, axis_and_direction_to_string},
+    mapping::profile::Profile,
+};
+
+/// Where a hotkey switches to
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum HotkeyTarget {
+    Next,
+    Previous,
+    /// The profile of this name, in any case
+    Profile(String),
+}
+
+/// A chord and the profile it switches to
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ProfileHotkey {
+    pub chord: Vec<ActionSource>,
+    pub target: HotkeyTarget,
+}
+
+impl ProfileHotkey {
+    /// Mode with D-pad Right or Left, for the next or previous profile
+    pub fn defaults() -> Vec<Self> {
+        let dpad = |direction| {
+            vec![
+                ActionSource::Button(ButtonCode::Mode),
+                ActionSource::Axis(AxisCode::DPadX, direction),
+            ]
+        };
+        vec![
+            Self { chord: dpad(AxisDirection::Positive), target: HotkeyTarget::Next },
+            Self { chord: dpad(AxisDirection::Negative), target: HotkeyTarget::Previous },
+        ]
+    }
+}
+
+/// A button, or a D-pad direction like "DPad Right" (spaces optional)
+fn chord_control(name: &str) -> Option<ActionSource> {
+    let code = ButtonCode::from(name);
+    if code != ButtonCode::Unknown {
+        return Some(ActionSource::Button(code));
+    }
+    let squeezed = |text: &str| text.replace(' ', "").to_lowercase();
+    for code in [AxisCode::DPadX, AxisCode::DPadY] {
+        for direction in [AxisDirection::Negative, AxisDirection::Positive] {
+            if squeezed(&axis_and_direction_to_string(code, direction)) == squeezed(name) {
+                return Some(ActionSource::Axis(code, direction));
+            }
+        }
+    }
+    None
+}
+
+fn control_name(source: &ActionSource) -> String {
+    match *source {
+        ActionSource::Axis(code, direction) => axis_and_direction_to_string(code, direction),
+        source => source.to_string(),
+    }
+}
+
+impl FromStr for ProfileHotkey {
+    type Err = anyhow::Error;
+
+    /// `CHORD=TARGET`, like "Mode+DPad Right=next" or "Mode+North=Racing"
+    fn from_str(text: &str) -> Result<Self> {
+        let Some((chord, target)) = text.rsplit_once('=') else {
+            bail!("'{}' is not CHORD=TARGET, like Mode+DPad Right=next", text);
+        };
+        let mut controls = Vec::new();
+        for name in chord.split('+').map(str::trim) {
+            let Some(control) = chord_control(name) else {
+                bail!("'{}' is not a button or D-pad direction", name);
+            };
+            if !controls.contains(&control) {
+                controls.push(control);
+            }
+        }
+        let target = match target.trim() {
+            "" => bail!("'{}' names no profile; use next, previous or a profile name", text),
+            "next" => HotkeyTarget::Next,
+            "previous" => HotkeyTarget::Previous,
+            name => HotkeyTarget::Profile(name.to_string()),
+        };
+        Ok(Self { chord: controls, target })
+    }
+}
+
+impl fmt::Display for ProfileHotkey {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let chord: Vec<String> = self.chord.iter().map(control_name).collect();
+        let target = match &self.target {
+            HotkeyTarget::Next => "next",
+            HotkeyTarget::Previous => "previous",
+            HotkeyTarget::Profile(name) => name,
+        };
+        write!(f, "{}={}", chord.join("+"), target)
+    }
+}
+
+/// What a control going on or off means to the hotkeys
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(super) enum Chord {
+    /// Not theirs; map it as usual
+    Pass,
+    /// Part of a chord that went off; drop it
+    Taken,
+    /// Completed a chord; drop it and switch to this profile
+    Switch(usize),
+}
+
+/// The profiles hotkeys switch among, and which chord controls are held
+#[derive(Debug, Clone)]
+pub struct ProfileSwitcher {
+    profiles: Vec<Profile>,
+    hotkeys: Vec<ProfileHotkey>,
+    current: usize,
+    held: Vec<ActionSource>,
+    // Controls that completed a chord, dropped until they're let go
+    taken: Vec<ActionSource>,
+}
+
+impl ProfileSwitcher {
+    /// Switch among `profiles` with `hotkeys`, starting on the first
+    ///
+    /// Fails if there are no profiles or a hotkey names none of them.
+    pub fn new(profiles: Vec<Profile>, hotkeys: Vec<ProfileHotkey>) -> Result<Self> {
+        if profiles.is_empty() {
+            bail!("No profiles to switch among");
+        }
+        for hotkey in &hotkeys {
+            if let HotkeyTarget::Profile(name) = &hotkey.target
+                && !profiles.iter().any(|profile| profile.name.eq_ignore_ascii_case(name))
+            {
+                let names: Vec<&str> = profiles.iter().map(|p| p.name.as_str()).collect();
+                bail!("Hotkey {} names no profile; there are {}", hotkey, names.join(", "));
+            }
+        }
+        Ok(Self { profiles, hotkeys, current: 0, held: Vec::new(), taken: Vec::new() })
+    }
+
+    pub fn profiles(&self) -> &[Profile] {
+        &self.profiles
+    }
+
+    /// The profile in use
+    pub fn current(&self) -> &Profile {
+        &self.profiles[self.current]
+    }
+
+    /// Note that profile `index` is in use now
+    pub(super) fn set_current(&mut self, index: usize) {
+        self.current = index;
+    }
+
+    /// Track a button going on or off
+    pub(super) fn button(&mut self, code: ButtonCode, pressed: bool) -> Chord {
+        self.control(ActionSource::Button(code), pressed)
+    }
+
+    /// Track a D-pad axis moving to `direction` (None when centered)
+    pub(super) fn dpad(&mut self, code: AxisCode, direction: Option<AxisDirection>) -> Chord {
+        let was = self
+            .held
+            .iter()
+            .copied()
+            .find(|held| matches!(held, ActionSource::Axis(axis, _) if *axis == code));
+        if was.and_then(|source| source.direction()) == direction {
+            return Chord::Pass;
+        }
+        let released = was.map(|source| self.control(source, false));
+        match direction {
+            Some(direction) => self.control(ActionSource::Axis(code, direction), true),
+            None => released.unwrap_or(Chord::Pass),
+        }
+    }
+
+    fn control(&mut self, source: ActionSource, on: bool) -> Chord {
+        self.held.retain(|&held| held != source);
+        if !on {
+            let taken = self.taken.contains(&source);
+            self.taken.retain(|&control| control != source);
+            return if taken { Chord::Taken } else { Chord::Pass };
+        }
+        self.held.push(source);
+        let Some(hotkey) = self.hotkeys.iter().find(|hotkey| {
+            hotkey.chord.contains(&source)
+                && hotkey.chord.iter().all(|control| self.held.contains(control))
+        }) else {
+            return Chord::Pass;
+        };
+        let count = self.profiles.len();
+        let index = match &hotkey.target {
+            HotkeyTarget::Next => (self.current + 1) % count,
+            HotkeyTarget::Previous => (self.current + count - 1) % count,
+            HotkeyTarget::Profile(name) => {
+                match self.profiles.iter().position(|p| p.name.eq_ignore_ascii_case(name)) {
+                    Some(index) => index,
+                    None => return Chord::Pass,
+                }
+            }
+        };
+        self.taken.push(source);
+        Chord::Switch(index)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn profiles(names: &[&str]) -> Vec<Profile> {
+        names
+            .iter()
+            .map(|name| {
+                let mut profile = Profile::default_profile();
+                profile.name = name.to_string();
+                profile
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_parse_hotkeys() {
+        let hotkey: ProfileHotkey = "Mode + DPadRight=next".parse().unwrap();
+        assert_eq!(hotkey, ProfileHotkey::defaults()[0]);
+        assert_eq!(hotkey.to_string(), "Mode+DPad Right=next");
+
+        let hotkey: ProfileHotkey = "Select+Start+North=Racing".parse().unwrap();
+        assert_eq!(hotkey.chord.len(), 3);
+        assert_eq!(hotkey.target, HotkeyTarget::Profile("Racing".to_string()));
+
+        assert!("Mode+Jump=next".parse::<ProfileHotkey>().is_err());
+        assert!("Mode+North".parse::<ProfileHotkey>().is_err());
+        assert!("Mode+North=".parse::<ProfileHotkey>().is_err());
+    }
+
+    #[test]
+    fn test_chords_cycle_and_jump() {
+        let mut hotkeys = ProfileHotkey::defaults();
+        hotkeys.push("Mode+North=racing".parse().unwrap());
+        let mut switcher =
+            ProfileSwitcher::new(profiles(&["Default", "Racing", "Menus"]), hotkeys).unwrap();
+
+        // D-pad on its own is the profile's
+        assert_eq!(switcher.dpad(AxisCode::DPadX, Some(AxisDirection::Positive)), Chord::Pass);
+        assert_eq!(switcher.dpad(AxisCode::DPadX, None), Chord::Pass);
+
+        assert_eq!(switcher.button(ButtonCode::Mode, true), Chord::Pass);
+        assert_eq!(switcher.dpad(AxisCode::DPadX, Some(AxisDirection::Negative)), Chord::Switch(2));
+        switcher.set_current(2);
+        assert_eq!(switcher.dpad(AxisCode::DPadX, None), Chord::Taken);
+        assert_eq!(switcher.dpad(AxisCode::DPadX, Some(AxisDirection::Positive)), Chord::Switch(0));
+        switcher.set_current(0);
+        assert_eq!(switcher.button(ButtonCode::North, true), Chord::Switch(1));
+        assert_eq!(switcher.button(ButtonCode::North, false), Chord::Taken);
+        assert_eq!(switcher.button(ButtonCode::Mode, false), Chord::Pass);
+        assert_eq!(switcher.button(ButtonCode::North, true), Chord::Pass);
+    }
+
+    #[test]
+    fn test_hotkey_must_name_a_profile() {
+        let hotkeys = vec!["Mode+North=Racing".parse().unwrap()];
+        let err = ProfileSwitcher::new(profiles(&["Default", "Menus"]), hotkeys).unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Hotkey Mode+North=Racing names no profile; there are Default, Menus"
+        );
+        assert!(ProfileSwitcher::new(Vec::new(), ProfileHotkey::defaults()).is_err());
+    }
+}
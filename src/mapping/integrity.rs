@@ -0,0 +1,330 @@
+// Profile integrity: checksums and signatures
+//
+// A sealed profile has an `[integrity]` table with the SHA-256 of its
+// content and, optionally, an Ed25519 signature over the same bytes:
+//
+//   [integrity]
+//   sha256 = "9f2c…"
+//   signature = "base64…"
+//
+// Content is the parsed TOML minus that table, encoded as JSON with sorted
+// keys, so comments and layout don't matter but every value does. It's
+// checked before schema migrations run, so an old signed profile stays valid.
+
+use anyhow::{Context, Result};
+use base64::{Engine, engine::general_purpose::STANDARD as BASE64};
+use ed25519_dalek::{Signature, Signer, SigningKey, Verifier, VerifyingKey};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::path::Path;
+use toml::{Table, Value};
+
+use crate::mapping::{format::ProfileFormat, profile::Profile};
+
+/// The `[integrity]` table
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Integrity {
+    /// Hex SHA-256 of the content
+    pub sha256: String,
+    /// Base64 Ed25519 signature of the content
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub signature: Option<String>,
+}
+
+/// How far a profile's seal could be checked
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Verified {
+    /// No `[integrity]` table
+    Unsealed,
+    /// Checksum matches; no signature, or no trusted keys to check it with
+    Checksum,
+    /// Checksum matches and a trusted key signed it
+    Signed,
+}
+
+/// What to accept from profiles the daemon loads
+///
+/// Comes from whoever runs the daemon, like `ActionPolicy`.
+#[derive(Debug, Clone, Default)]
+pub struct IntegrityPolicy {
+    /// Refuse profiles that fail a check or aren't sealed, instead of warning;
+    /// with trusted keys, also refuse ones they didn't sign
+    pub strict: bool,
+    /// Keys signatures are checked against
+    pub trusted_keys: Vec<VerifyingKey>,
+}
+
+impl IntegrityPolicy {
+    /// Check `profile` (the raw TOML); failed checks only warn unless strict
+    pub fn apply(&self, profile: &Table) -> Result<Verified> {
+        match self.check(profile) {
+            Err(e) if !self.strict => {
+                tracing::warn!("{:#}", e);
+                Ok(Verified::Unsealed)
+            }
+            outcome => outcome,
+        }
+    }
+
+    /// Like `apply`, but a seal that doesn't match is always an error
+    pub fn check(&self, profile: &Table) -> Result<Verified> {
+        let verified = verify(profile, &self.trusted_keys)?;
+        match verified {
+            Verified::Unsealed if self.strict => anyhow::bail!("Profile is not sealed"),
+            Verified::Checksum if self.strict && !self.trusted_keys.is_empty() => {
+                anyhow::bail!("Profile is not signed by a trusted key")
+            }
+            verified => Ok(verified),
+        }
+    }
+}
+
+/// Check a profile's seal against its content
+pub fn verify(profile: &Table, trusted_keys: &[VerifyingKey]) -> Result<Verified> {
+    let Some(integrity) = profile.get("integrity") else {
+        return Ok(Verified::Unsealed);
+    };
+    let integrity: Integrity =
+        integrity.clone().try_into().context("Invalid [integrity] table in profile")?;
+
+    let content = content(profile);
+    if !integrity.sha256.eq_ignore_ascii_case(&sha256_hex(&content)) {
+        anyhow::bail!("Profile checksum does not match; it changed after it was sealed");
+    }
+    let (Some(signature), false) = (&integrity.signature, trusted_keys.is_empty()) else {
+        return Ok(Verified::Checksum);
+    };
+
+    let signature = BASE64
+        .decode(signature)
+        .ok()
+        .and_then(|bytes| Signature::from_slice(&bytes).ok())
+        .context("Profile signature is not a base64 Ed25519 signature")?;
+    if trusted_keys.iter().any(|key| key.verify(&content, &signature).is_ok()) {
+        Ok(Verified::Signed)
+    } else {
+        anyhow::bail!("Profile signature does not match any trusted key")
+    }
+}
+
+/// The `[integrity]` table for `profile`'s current content
+pub fn seal(profile: &Table, key: Option<&SigningKey>) -> Integrity {
+    let content = content(profile);
+    Integrity {
+        sha256: sha256_hex(&content),
+        signature: key.map(|key| BASE64.encode(key.sign(&content).to_bytes())),
+    }
+}
+
+/// Seal a profile file in place, replacing any previous seal
+///
+/// Only the integrity section is rewritten, so comments survive (JSON has
+/// none and is rewritten whole).
+pub fn seal_file(path: &Path, key: Option<&SigningKey>) -> Result<Integrity> {
+    let format = ProfileFormat::from_path(path);
+    let text = std::fs::read_to_string(path).context("Failed to read profile file")?;
+    let body = format.without_integrity(&text)?;
+    // Don't vouch for something that doesn't load
+    Profile::decode(&body, format)?;
+    let table = format.decode(&body)?;
+    if table.contains_key("integrity") {
+        anyhow::bail!("Write the profile's integrity table as an [integrity] section to reseal it");
+    }
+
+    let integrity = seal(&table, key);
+    let sealed = format.with_integrity(&body, &integrity).context("Failed to serialize seal")?;
+    std::fs::write(path, sealed).context("Failed to write profile file")?;
+    Ok(integrity)
+}
+
+/// Make a signing key; it's also its own file format (base64 of the seed)
+pub fn generate_key() -> Result<SigningKey> {
+    let mut seed = [0u8; 32];
+    getrandom::fill(&mut seed).map_err(|e| anyhow::anyhow!("no randomness for a key: {}", e))?;
+    Ok(SigningKey::from_bytes(&seed))
+}
+
+pub fn encode_signing_key(key: &SigningKey) -> String {
+    BASE64.encode(key.to_bytes())
+}
+
+pub fn parse_signing_key(text: &str) -> Result<SigningKey> {
+    let seed: [u8; 32] = BASE64
+        .decode(text.trim())
+        .ok()
+        .and_then(|bytes| bytes.try_into().ok())
+        .context("Signing key must be 32 bytes of base64")?;
+    Ok(SigningKey::from_bytes(&seed))
+}
+
+pub fn encode_public_key(key: &VerifyingKey) -> String {
+    BASE64.encode(key.to_bytes())
+}
+
+pub fn parse_public_key(text: &str) -> Result<VerifyingKey> {
+    let bytes: [u8; 32] =
+        BASE64
+            .decode(text.trim())
+            .ok()
+            .and_then(|bytes| bytes.try_into().ok())
+            .with_context(|| format!("Public key '{}' must be 32 bytes of base64", text))?;
+    VerifyingKey::from_bytes(&bytes)
+        .with_context(|| format!("'{}' is not an Ed25519 public key", text))
+}
+
+/// Bytes checksums and signatures cover
+fn content(profile: &Table) -> Vec<u8> {
+    let mut out = String::new();
+    let mut content = profile.clone();
+    content.remove("integrity");
+    canonical_json(&Value::Table(content), &mut out);
+    out.into_bytes()
+}
+
+/// JSON with sorted keys and no whitespace, whatever order the file used
+fn canonical_json(value: &Value, out: &mut String) {
+    let quoted = |s: &str| serde_json::Value::from(s).to_string();
+    match value {
+        Value::Table(table) => {
+            let mut entries: Vec<_> = table.iter().collect();
+            entries.sort_by_key(|&(key, _)| key);
+            out.push('{');
+            for (i, (key, value)) in entries.into_iter().enumerate() {
+                if i > 0 {
+                    out.push(',');
+                }
+                out.push_str(&quoted(key));
+                out.push(':');
+                canonical_json(value, out);
+            }
+            out.push('}');
+        }
+        Value::Array(items) => {
+            out.push('[');
+            for (i, item) in items.iter().enumerate() {
+                if i > 0 {
+                    out.push(',');
+                }
+                canonical_json(item, out);
+            }
+            out.push(']');
+        }
+        Value::String(s) => out.push_str(&quoted(s)),
+        Value::Integer(n) => out.push_str(&n.to_string()),
+        Value::Float(x) => out.push_str(&serde_json::Value::from(*x).to_string()),
+        Value::Boolean(b) => out.push_str(&b.to_string()),
+        Value::Datetime(datetime) => out.push_str(&quoted(&datetime.to_string())),
+    }
+}
+
+pub(crate) fn sha256_hex(bytes: &[u8]) -> String {
+    Sha256::digest(bytes).iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PROFILE: &str = r#"name = "Racing"
+description = "Shared by the league"
+
+[[mappings]]
+source_name = "South"
+target_type = "Keyboard"
+target_name = "Space"
+"#;
+
+    fn sealed(text: &str, key: Option<&SigningKey>) -> Table {
+        let mut table: Table = toml::from_str(text).unwrap();
+        let integrity = seal(&table, key);
+        table.insert("integrity".to_string(), Value::try_from(integrity).unwrap());
+        table
+    }
+
+    #[test]
+    fn test_layout_does_not_matter_but_values_do() {
+        let table: Table = toml::from_str(PROFILE).unwrap();
+        let reordered: Table = toml::from_str(
+            "description = \"Shared by the league\" # comment\nname = \"Racing\"\n\n[[mappings]]\ntarget_name = \"Space\"\nsource_name = \"South\"\ntarget_type = \"Keyboard\"\n",
+        )
+        .unwrap();
+        assert_eq!(seal(&table, None), seal(&reordered, None));
+
+        let mut changed = sealed(PROFILE, None);
+        changed["mappings"][0]["target_name"] = Value::from("Enter");
+        assert_eq!(
+            verify(&changed, &[]).unwrap_err().to_string(),
+            "Profile checksum does not match; it changed after it was sealed"
+        );
+        assert_eq!(verify(&sealed(PROFILE, None), &[]).unwrap(), Verified::Checksum);
+    }
+
+    #[test]
+    fn test_signatures() {
+        let key = parse_signing_key(&encode_signing_key(&generate_key().unwrap())).unwrap();
+        let other = generate_key().unwrap().verifying_key();
+        let public = parse_public_key(&encode_public_key(&key.verifying_key())).unwrap();
+        let table = sealed(PROFILE, Some(&key));
+
+        assert_eq!(verify(&table, &[other, public]).unwrap(), Verified::Signed);
+        assert_eq!(
+            verify(&table, &[other]).unwrap_err().to_string(),
+            "Profile signature does not match any trusted key"
+        );
+        // Nothing to check it against
+        assert_eq!(verify(&table, &[]).unwrap(), Verified::Checksum);
+    }
+
+    #[test]
+    fn test_policy() {
+        let key = generate_key().unwrap();
+        let unsealed: Table = toml::from_str(PROFILE).unwrap();
+        let lenient = IntegrityPolicy::default();
+        let strict = IntegrityPolicy { strict: true, trusted_keys: vec![] };
+        let strict_signed =
+            IntegrityPolicy { strict: true, trusted_keys: vec![key.verifying_key()] };
+
+        assert_eq!(lenient.apply(&unsealed).unwrap(), Verified::Unsealed);
+        assert_eq!(strict.apply(&unsealed).unwrap_err().to_string(), "Profile is not sealed");
+        assert_eq!(strict.apply(&sealed(PROFILE, None)).unwrap(), Verified::Checksum);
+        assert_eq!(
+            strict_signed.apply(&sealed(PROFILE, None)).unwrap_err().to_string(),
+            "Profile is not signed by a trusted key"
+        );
+        assert_eq!(strict_signed.apply(&sealed(PROFILE, Some(&key))).unwrap(), Verified::Signed);
+
+        // Tampering only warns unless strict
+        let mut tampered = sealed(PROFILE, Some(&key));
+        tampered["name"] = Value::from("Racing!");
+        assert_eq!(lenient.apply(&tampered).unwrap(), Verified::Unsealed);
+        assert!(strict_signed.apply(&tampered).is_err());
+    }
+
+    #[test]
+    fn test_seal_file_keeps_comments_and_reseals() {
+        let path =
+            std::env::temp_dir().join(format!("blazeremap-seal-{}.toml", std::process::id()));
+        let text = format!("# Racing league profile\n{}", PROFILE);
+        std::fs::write(&path, &text).unwrap();
+        let key = generate_key().unwrap();
+
+        seal_file(&path, None).unwrap();
+        let integrity = seal_file(&path, Some(&key)).unwrap();
+        let sealed = std::fs::read_to_string(&path).unwrap();
+        std::fs::remove_file(&path).unwrap();
+
+        assert!(sealed.starts_with(&text));
+        assert_eq!(sealed.matches("[integrity]").count(), 1);
+        let table: Table = toml::from_str(&sealed).unwrap();
+        assert_eq!(verify(&table, &[key.verifying_key()]).unwrap(), Verified::Signed);
+        assert_eq!(table["integrity"].clone().try_into::<Integrity>().unwrap(), integrity);
+    }
+
+    #[test]
+    fn test_invalid_keys() {
+        assert!(parse_public_key("not base64!").is_err());
+        assert!(parse_public_key(&BASE64.encode([1u8; 16])).is_err());
+        assert!(parse_signing_key("").is_err());
+    }
+}
@@ -0,0 +1,119 @@
+// Controls swapped before mapping
+//
+// Players moving between controller families expect the button in the same
+// place to do the same thing, whatever it's called. A layout swaps controls
+// as they come in, so every mapping, mirror and script of the profile
+// applies to the swapped controls without being rewritten.
+
+use crate::{
+    event::{AxisCode, ButtonCode},
+    mapping::profile::ProfileSettings,
+};
+
+/// Which controls trade places before the profile sees them
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct Layout {
+    /// South ↔ East and West ↔ North: A/B and X/Y as on the other family
+    pub swap_ab_xy: bool,
+    /// Left stick ↔ right stick, clicks included: southpaw
+    pub swap_sticks: bool,
+    /// D-pad ↔ left stick, after `swap_sticks`
+    pub swap_dpad: bool,
+}
+
+impl Layout {
+    pub fn for_settings(settings: &ProfileSettings) -> Self {
+        Self {
+            swap_ab_xy: settings.swap_ab_xy,
+            swap_sticks: settings.swap_sticks,
+            swap_dpad: settings.swap_dpad,
+        }
+    }
+
+    /// The button `code` acts as
+    #[inline]
+    pub fn button(self, code: ButtonCode) -> ButtonCode {
+        match code {
+            ButtonCode::South if self.swap_ab_xy => ButtonCode::East,
+            ButtonCode::East if self.swap_ab_xy => ButtonCode::South,
+            ButtonCode::West if self.swap_ab_xy => ButtonCode::North,
+            ButtonCode::North if self.swap_ab_xy => ButtonCode::West,
+            ButtonCode::LeftStick if self.swap_sticks => ButtonCode::RightStick,
+            ButtonCode::RightStick if self.swap_sticks => ButtonCode::LeftStick,
+            other => other,
+        }
+    }
+
+    /// The axis `code` acts as, and its value there
+    ///
+    /// A stick moved onto the D-pad only keeps its direction, -1 or 1; the
+    /// D-pad moved onto a stick reaches it as -1, 0 or 1, like a Mirror.
+    #[inline]
+    pub fn axis(self, code: AxisCode, value: i32) -> (AxisCode, i32) {
+        let code = match code {
+            AxisCode::LeftX if self.swap_sticks => AxisCode::RightX,
+            AxisCode::LeftY if self.swap_sticks => AxisCode::RightY,
+            AxisCode::RightX if self.swap_sticks => AxisCode::LeftX,
+            AxisCode::RightY if self.swap_sticks => AxisCode::LeftY,
+            other => other,
+        };
+        match code {
+            AxisCode::LeftX if self.swap_dpad => (AxisCode::DPadX, value.signum()),
+            AxisCode::LeftY if self.swap_dpad => (AxisCode::DPadY, value.signum()),
+            AxisCode::DPadX if self.swap_dpad => (AxisCode::LeftX, value),
+            AxisCode::DPadY if self.swap_dpad => (AxisCode::LeftY, value),
+            other => (other, value),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_swap_ab_xy() {
+        let layout = Layout { swap_ab_xy: true, ..Default::default() };
+        let swapped: Vec<_> = [
+            ButtonCode::South,
+            ButtonCode::East,
+            ButtonCode::West,
+            ButtonCode::North,
+            ButtonCode::Start,
+        ]
+        .map(|code| layout.button(code))
+        .into();
+        assert_eq!(
+            swapped,
+            [
+                ButtonCode::East,
+                ButtonCode::South,
+                ButtonCode::North,
+                ButtonCode::West,
+                ButtonCode::Start
+            ]
+        );
+        assert_eq!(Layout::default().button(ButtonCode::South), ButtonCode::South);
+    }
+
+    #[test]
+    fn test_swap_sticks_and_dpad() {
+        let southpaw = Layout { swap_sticks: true, ..Default::default() };
+        assert_eq!(southpaw.axis(AxisCode::LeftX, -900), (AxisCode::RightX, -900));
+        assert_eq!(southpaw.axis(AxisCode::RightY, 400), (AxisCode::LeftY, 400));
+        assert_eq!(southpaw.axis(AxisCode::DPadX, 1), (AxisCode::DPadX, 1));
+        assert_eq!(southpaw.button(ButtonCode::RightStick), ButtonCode::LeftStick);
+
+        let dpad = Layout { swap_dpad: true, ..Default::default() };
+        assert_eq!(dpad.axis(AxisCode::LeftX, -900), (AxisCode::DPadX, -1));
+        assert_eq!(dpad.axis(AxisCode::LeftY, 0), (AxisCode::DPadY, 0));
+        assert_eq!(dpad.axis(AxisCode::DPadY, 1), (AxisCode::LeftY, 1));
+        assert_eq!(dpad.axis(AxisCode::RightX, 5), (AxisCode::RightX, 5));
+
+        // The right stick steers, the left one is the D-pad, the D-pad the right stick
+        let both = Layout { swap_sticks: true, swap_dpad: true, ..Default::default() };
+        assert_eq!(both.axis(AxisCode::RightX, 700), (AxisCode::DPadX, 1));
+        assert_eq!(both.axis(AxisCode::LeftX, 700), (AxisCode::RightX, 700));
+        assert_eq!(both.axis(AxisCode::DPadX, -1), (AxisCode::LeftX, -1));
+    }
+}
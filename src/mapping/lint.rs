@@ -0,0 +1,1711 @@
+// Profile lint: every problem in a profile, not just the first
+//
+// Loading stops at the first error and silently ignores what it doesn't
+// know, like a misspelt field. Lint reads the document the same way loading
+// does and reports everything it finds, each with the field it's in and,
+// when there's an obvious one, a fix. Given a connected controller, it also
+// flags mappings for controls that controller doesn't have.
+
+use std::fmt;
+use toml::{Table, Value};
+
+use crate::{
+    action::osc::OscAction,
+    event::{
+        ActionSource, AxisCode, AxisDirection, ButtonCode, KeyboardCode,
+        axis_and_direction_to_string,
+    },
+    input::{
+        calibration::parse_stick_axes,
+        gamepad::{GamepadCapability, GamepadInfo, GamepadType},
+    },
+    mapping::{
+        Mapping, MappingRule,
+        format::ProfileFormat,
+        integrity,
+        migrate::{self, CURRENT_SCHEMA_VERSION},
+        profile::Profile,
+        script::Script,
+        text::Text,
+        types::{Cue, DesktopAction, DeviceTarget, FlickTarget, TargetType},
+    },
+    output::identity::DeviceKind,
+};
+
+pub(crate) const PROFILE_FIELDS: [&str; 9] = [
+    "schema_version",
+    "name",
+    "description",
+    "game_name",
+    "mappings",
+    "settings",
+    "plugins",
+    "mqtt",
+    "osc",
+];
+pub(crate) const MAPPING_FIELDS: [&str; 17] = [
+    "source_name",
+    "source_direction",
+    "target_type",
+    "target_name",
+    "device",
+    "debounce_ms",
+    "sticky",
+    "repeat_delay_ms",
+    "repeat_rate",
+    "params",
+    "script",
+    "command",
+    "on",
+    "rate_limit_ms",
+    "layer",
+    "flick",
+    "conditions",
+];
+pub(crate) const SETTINGS_FIELDS: [&str; 16] = [
+    "vibration_enabled",
+    "vibration_intensity",
+    "debounce_ms",
+    "slow_keys_ms",
+    "bounce_keys_ms",
+    "swap_ab_xy",
+    "swap_sticks",
+    "swap_dpad",
+    "left_trigger",
+    "right_trigger",
+    "sticky_cue",
+    "switch_cue",
+    "notify",
+    "pointer",
+    "keyboard_layout",
+    "virtual_devices",
+];
+pub(crate) const TRIGGER_FIELDS: [&str; 2] = ["press", "release"];
+pub(crate) const POINTER_FIELDS: [&str; 3] = ["curve", "precision_button", "precision_speed"];
+pub(crate) const VIRTUAL_DEVICE_FIELDS: [&str; 4] = ["keyboard", "mouse", "gamepad", "custom"];
+pub(crate) const IDENTITY_FIELDS: [&str; 4] = ["name", "vendor_id", "product_id", "version"];
+pub(crate) const CUSTOM_DEVICE_FIELDS: [&str; 5] =
+    ["kind", "name", "vendor_id", "product_id", "version"];
+pub(crate) const FLICK_FIELDS: [&str; 2] = ["threshold", "cooldown_ms"];
+pub(crate) const PLUGIN_FIELDS: [&str; 3] = ["name", "command", "args"];
+pub(crate) const MQTT_FIELDS: [&str; 4] = ["broker", "client_id", "username", "password"];
+pub(crate) const OSC_FIELDS: [&str; 1] = ["to"];
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum Severity {
+    /// The profile doesn't load, or a mapping can't work
+    Error,
+    /// It loads, but probably doesn't do what was meant
+    Warning,
+}
+
+impl fmt::Display for Severity {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::Error => "error",
+            Self::Warning => "warning",
+        })
+    }
+}
+
+/// One problem found in a profile
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Diagnostic {
+    pub severity: Severity,
+    /// Field it's in, like `mappings[2].target_name`; empty for the whole file
+    pub path: String,
+    pub message: String,
+    /// What would fix it, when there's an obvious answer
+    pub fix: Option<String>,
+}
+
+impl Diagnostic {
+    fn error(path: impl Into<String>, message: impl Into<String>) -> Self {
+        Self { severity: Severity::Error, path: path.into(), message: message.into(), fix: None }
+    }
+
+    fn warning(path: impl Into<String>, message: impl Into<String>) -> Self {
+        Self { severity: Severity::Warning, ..Self::error(path, message) }
+    }
+
+    fn fix(mut self, fix: impl Into<String>) -> Self {
+        self.fix = Some(fix.into());
+        self
+    }
+}
+
+impl fmt::Display for Diagnostic {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: ", self.severity)?;
+        if !self.path.is_empty() {
+            write!(f, "{}: ", self.path)?;
+        }
+        f.write_str(&self.message)
+    }
+}
+
+/// Lint a profile file's text, as loading would read it
+pub fn lint_text(
+    text: &str,
+    format: ProfileFormat,
+    device: Option<&GamepadInfo>,
+) -> Vec<Diagnostic> {
+    let mut table = match format.decode(text) {
+        Ok(table) => table,
+        Err(e) => return vec![Diagnostic::error("", format!("{:#}", e))],
+    };
+
+    let mut diagnostics = Vec::new();
+    if let Err(e) = integrity::verify(&table, &[]) {
+        diagnostics.push(
+            Diagnostic::warning("integrity", format!("{:#}", e))
+                .fix("reseal it with 'blazeremap profile seal'"),
+        );
+    }
+    table.remove("integrity");
+    match migrate::migrate(&mut table) {
+        Ok(version) if version < CURRENT_SCHEMA_VERSION => diagnostics.push(
+            Diagnostic::warning(
+                "schema_version",
+                format!("written in schema version {}; it's upgraded on every load", version),
+            )
+            .fix("run 'blazeremap profile upgrade' on it"),
+        ),
+        Ok(_) => {}
+        Err(e) => {
+            diagnostics.push(Diagnostic::error("schema_version", format!("{:#}", e)));
+            return diagnostics;
+        }
+    }
+    unknown_fields(&table, &mut diagnostics);
+
+    match table.clone().try_into::<Profile>() {
+        Ok(profile) => diagnostics.extend(lint(&profile, device)),
+        Err(e) => {
+            // Point at the mappings that don't parse, if that's the problem
+            let before = diagnostics.len();
+            if let Some(Value::Array(mappings)) = table.get("mappings") {
+                for (i, mapping) in mappings.iter().enumerate() {
+                    if let Err(e) = mapping.clone().try_into::<Mapping>() {
+                        let message = e.to_string();
+                        diagnostics
+                            .push(Diagnostic::error(format!("mappings[{}]", i), message.trim()));
+                    }
+                }
+            }
+            if diagnostics.len() == before {
+                diagnostics.push(Diagnostic::error("", e.to_string().trim()));
+            }
+        }
+    }
+    diagnostics
+}
+
+/// Lint a profile that parsed; with `device`, also check it has the controls
+/// the profile maps
+pub fn lint(profile: &Profile, device: Option<&GamepadInfo>) -> Vec<Diagnostic> {
+    let mut diagnostics = Vec::new();
+    if profile.mappings.is_empty() {
+        diagnostics.push(Diagnostic::warning("mappings", "the profile maps nothing"));
+    }
+
+    // What each usable mapping occupies, to find ones hidden by later ones
+    let mut slots = Vec::new();
+    for (i, mapping) in profile.mappings.iter().enumerate() {
+        let path = format!("mappings[{}]", i);
+        check_target(profile, mapping, &path, &mut diagnostics);
+        check_output_device(profile, mapping, &path, &mut diagnostics);
+        check_ignored_fields(mapping, &path, &mut diagnostics);
+        check_flick(mapping, &path, &mut diagnostics);
+        let Some(source) = check_source(mapping, &path, &mut diagnostics) else {
+            continue;
+        };
+        if let Some(device) = device {
+            check_device(source, device, &path, &mut diagnostics);
+        }
+        slots.push((i, Slot::of(mapping), source, mapping.conditions.as_ref()));
+    }
+
+    for (k, &(i, slot, source, conditions)) in slots.iter().enumerate() {
+        // A later mapping of the same control wins wherever it applies
+        let hidden_by =
+            slots[k + 1..].iter().find(|&&(_, other, other_source, other_conditions)| {
+                other == slot
+                    && other_source == source
+                    && (other_conditions.is_none() || other_conditions == conditions)
+            });
+        if let Some(&(j, ..)) = hidden_by {
+            diagnostics.push(
+                Diagnostic::warning(
+                    format!("mappings[{}]", i),
+                    format!("never applies: mappings[{}] also maps {} and comes later", j, source),
+                )
+                .fix(format!("remove one of them, or give mappings[{}] conditions", j)),
+            );
+            continue;
+        }
+        // A control mirrored without a layer always acts as its target
+        let mirrored_by = slots.iter().find(|&&(j, other, other_source, other_conditions)| {
+            j != i
+                && other == Slot::Mirror(None)
+                && !matches!(slot, Slot::Mirror(_))
+                && other_conditions.is_none()
+                && (other_source == source
+                    || matches!(other_source, ActionSource::AxisValue(_))
+                        && other_source.name() == source.name())
+        });
+        if let Some(&(j, ..)) = mirrored_by {
+            diagnostics.push(
+                Diagnostic::warning(
+                    format!("mappings[{}]", i),
+                    format!(
+                        "never applies: mappings[{}] makes {} act as another control",
+                        j, source
+                    ),
+                )
+                .fix(format!("remove one of them, or give mappings[{}] a layer", j)),
+            );
+        }
+    }
+
+    for (trigger, threshold) in [
+        ("left_trigger", profile.settings.left_trigger),
+        ("right_trigger", profile.settings.right_trigger),
+    ] {
+        if let Some(problem) = threshold.and_then(|threshold| threshold.problem()) {
+            diagnostics.push(Diagnostic::error(format!("settings.{}", trigger), problem));
+        }
+    }
+    if let Some(problem) = profile.settings.pointer.as_ref().and_then(|pointer| pointer.problem()) {
+        diagnostics.push(Diagnostic::error("settings.pointer", problem));
+    }
+    for (device, problem) in profile.settings.virtual_devices.problems() {
+        diagnostics
+            .push(Diagnostic::error(format!("settings.virtual_devices.{}", device), problem));
+    }
+
+    let cues = &profile.settings.sticky_cue;
+    if !cues.is_empty() && !profile.mappings.iter().any(|mapping| mapping.sticky) {
+        diagnostics.push(
+            Diagnostic::warning("settings.sticky_cue", "no mapping is sticky").fix("remove it"),
+        );
+    } else if cues.contains(&Cue::Rumble) && !profile.settings.vibration_enabled {
+        diagnostics.push(
+            Diagnostic::warning("settings.sticky_cue", "rumble is off: vibration_enabled is false")
+                .fix("set vibration_enabled = true"),
+        );
+    }
+    let cues = &profile.settings.switch_cue;
+    let switches = profile.mappings.iter().any(|mapping| {
+        mapping.conditions.is_some()
+            || mapping.target_type == TargetType::Mirror && mapping.layer.is_some()
+    });
+    if !cues.is_empty() && !switches {
+        diagnostics.push(
+            Diagnostic::warning(
+                "settings.switch_cue",
+                "nothing switches: no mirror mapping has a layer and no mapping has conditions",
+            )
+            .fix("remove it"),
+        );
+    } else if cues.contains(&Cue::Rumble) && !profile.settings.vibration_enabled {
+        diagnostics.push(
+            Diagnostic::warning("settings.switch_cue", "rumble is off: vibration_enabled is false")
+                .fix("set vibration_enabled = true"),
+        );
+    }
+
+    for (k, plugin) in profile.plugins.iter().enumerate() {
+        let used = profile.mappings.iter().any(|mapping| {
+            mapping.target_type == TargetType::Plugin && mapping.target_name == plugin.name
+        });
+        if !used {
+            diagnostics.push(
+                Diagnostic::warning(
+                    format!("plugins[{}]", k),
+                    format!("no mapping uses plugin '{}'", plugin.name),
+                )
+                .fix("remove it"),
+            );
+        }
+    }
+    for (section, target_type, set) in [
+        ("mqtt", TargetType::Mqtt, profile.mqtt.is_some()),
+        ("osc", TargetType::Osc, profile.osc.is_some()),
+    ] {
+        if set && !profile.mappings.iter().any(|mapping| mapping.target_type == target_type) {
+            diagnostics.push(
+                Diagnostic::warning(
+                    section,
+                    format!("no mapping has target_type {:?}", target_type),
+                )
+                .fix("remove it"),
+            );
+        }
+    }
+    diagnostics
+}
+
+/// Which of a control's rule slots a mapping fills; each holds one mapping
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Slot {
+    Key,
+    Script,
+    Action,
+    Flick,
+    /// Mirrors of one control under different layers apply together
+    Mirror(Option<ButtonCode>),
+}
+
+impl Slot {
+    fn of(mapping: &Mapping) -> Self {
+        if mapping.flick.is_some() {
+            return Self::Flick;
+        }
+        match mapping.target_type {
+            TargetType::Script => Self::Script,
+            TargetType::Mirror => Self::Mirror(mapping.layer.as_deref().map(ButtonCode::from)),
+            action if action.is_action() => Self::Action,
+            _ => Self::Key,
+        }
+    }
+}
+
+/// The control a mapping listens to, if it names one that can fire
+fn check_source(
+    mapping: &Mapping,
+    path: &str,
+    diagnostics: &mut Vec<Diagnostic>,
+) -> Option<ActionSource> {
+    let name = mapping.source_name.as_str();
+    let (button, axis) = (ButtonCode::from(name), AxisCode::from(name));
+    let source_name = format!("{}.source_name", path);
+
+    let Some(direction) = &mapping.source_direction else {
+        if button != ButtonCode::Unknown {
+            return Some(ActionSource::Button(button));
+        }
+        let whole_axis =
+            mapping.target_type.is_action() || mapping.target_type == TargetType::Mirror;
+        if axis != AxisCode::Unknown && whole_axis {
+            return Some(ActionSource::AxisValue(axis));
+        }
+        if axis != AxisCode::Unknown {
+            diagnostics.push(
+                Diagnostic::error(
+                    format!("{}.source_direction", path),
+                    format!(
+                        "{} is an axis; {:?} mappings of it need a direction",
+                        axis, mapping.target_type
+                    ),
+                )
+                .fix("set source_direction to Positive or Negative"),
+            );
+        } else {
+            let controls = ButtonCode::ALL.iter().map(ToString::to_string);
+            let controls = controls.chain(AxisCode::ALL.iter().map(ToString::to_string));
+            diagnostics.push(
+                Diagnostic::error(source_name, format!("unknown control '{}'", name)).fix(
+                    did_you_mean(name, controls).unwrap_or_else(|| {
+                        "use a control name, like South or Left Shoulder".to_string()
+                    }),
+                ),
+            );
+        }
+        return None;
+    };
+
+    let direction = match direction.as_str() {
+        "Positive" => AxisDirection::Positive,
+        "Negative" => AxisDirection::Negative,
+        other => {
+            diagnostics.push(
+                Diagnostic::error(
+                    format!("{}.source_direction", path),
+                    format!("unknown direction '{}'", other),
+                )
+                .fix("use Positive (down/right) or Negative (up/left)"),
+            );
+            return None;
+        }
+    };
+    if axis == AxisCode::Unknown {
+        let axes = AxisCode::ALL.iter().map(ToString::to_string);
+        diagnostics.push(
+            Diagnostic::error(source_name, format!("unknown axis '{}'", name)).fix(
+                did_you_mean(name, axes).unwrap_or_else(|| "use DPad X or DPad Y".to_string()),
+            ),
+        );
+        return None;
+    }
+    let source = ActionSource::Axis(axis, direction);
+    // The engine only turns D-pad movement into presses; check_flick sees
+    // to flicks
+    if !matches!(axis, AxisCode::DPadX | AxisCode::DPadY) && mapping.flick.is_none() {
+        let fix = if mapping.target_type.is_action() {
+            "map DPad X or DPad Y, or drop source_direction to act on every change of the axis"
+        } else {
+            "map DPad X or DPad Y instead"
+        };
+        diagnostics.push(
+            Diagnostic::warning(
+                path,
+                format!("only D-pad directions trigger mappings; {} never fires", source),
+            )
+            .fix(fix),
+        );
+    }
+    Some(source)
+}
+
+fn check_target(
+    profile: &Profile,
+    mapping: &Mapping,
+    path: &str,
+    diagnostics: &mut Vec<Diagnostic>,
+) {
+    let target = mapping.target_name.as_str();
+    let target_name = format!("{}.target_name", path);
+    match mapping.target_type {
+        TargetType::Mouse | TargetType::Gamepad => {
+            if DeviceTarget::from_name(mapping.target_type, target).is_none() {
+                let kind = format!("{:?}", mapping.target_type).to_lowercase();
+                let message = match target.is_empty() {
+                    true => format!("no {} control to press", kind),
+                    false => format!("unknown {} control '{}'", kind, target),
+                };
+                let names = DeviceTarget::names(mapping.target_type);
+                let fix = did_you_mean(target, names.iter().cloned()).unwrap_or_else(|| {
+                    match mapping.target_type {
+                        TargetType::Mouse => format!("use one of {}", names.join(", ")),
+                        _ => "use a button like South or a direction like DPad Up".to_string(),
+                    }
+                });
+                diagnostics.push(Diagnostic::error(target_name, message).fix(fix));
+            }
+        }
+        TargetType::Keyboard => {
+            if target.is_empty() {
+                diagnostics.push(
+                    Diagnostic::error(target_name, "no key to press")
+                        .fix("set target_name to a key, like Space"),
+                );
+            } else if KeyboardCode::from(target) == KeyboardCode::Unknown
+                && (mapping.flick.is_none()
+                    || FlickTarget::from_name(TargetType::Keyboard, target).is_none())
+            {
+                let keys = KeyboardCode::ALL
+                    .iter()
+                    .map(ToString::to_string)
+                    .filter(|key| KeyboardCode::from(key.as_str()) != KeyboardCode::Unknown);
+                diagnostics.push(
+                    Diagnostic::error(target_name, format!("unknown key '{}'", target)).fix(
+                        did_you_mean(target, keys).unwrap_or_else(|| {
+                            "use a key name, like Space or Left Shift".to_string()
+                        }),
+                    ),
+                );
+            }
+        }
+        TargetType::Desktop => {
+            if DesktopAction::from_name(target).is_none() {
+                let message = match target.is_empty() {
+                    true => "no desktop action".to_string(),
+                    false => format!("unknown desktop action '{}'", target),
+                };
+                let actions = DesktopAction::ALL.iter().map(ToString::to_string);
+                let fix = did_you_mean(target, actions.clone()).unwrap_or_else(|| {
+                    format!("use one of {}", actions.collect::<Vec<_>>().join(", "))
+                });
+                diagnostics.push(Diagnostic::error(target_name, message).fix(fix));
+            }
+        }
+        TargetType::Text => {
+            if let Err(e) = Text::parse(target, profile.settings.keyboard_layout) {
+                let fix = match target.is_empty() {
+                    true => "set target_name to the text to type",
+                    false => "drop the character, or set keyboard_layout to the desktop's layout",
+                };
+                diagnostics.push(Diagnostic::error(target_name, e.to_string()).fix(fix));
+            }
+        }
+        TargetType::Script => match &mapping.script {
+            None => {
+                diagnostics.push(Diagnostic::error(path, "script mapping has no script").fix(
+                    "add a script choosing the keys, like 'if value > 0 then \"W\" else none'",
+                ))
+            }
+            Some(script) => {
+                if let Err(e) = Script::parse(script) {
+                    diagnostics.push(Diagnostic::error(format!("{}.script", path), e.to_string()));
+                }
+            }
+        },
+        TargetType::Exec => {
+            if mapping.command.is_empty() {
+                diagnostics
+                    .push(Diagnostic::error(format!("{}.command", path), "no command to run").fix(
+                    "set command to the program and its arguments, like [\"notify-send\", \"Hi\"]",
+                ));
+            }
+        }
+        TargetType::Plugin => {
+            if !profile.plugins.iter().any(|plugin| plugin.name == target) {
+                let defined = profile.plugins.iter().map(|plugin| plugin.name.clone());
+                diagnostics.push(
+                    Diagnostic::error(target_name, format!("plugin '{}' isn't defined", target))
+                        .fix(
+                            did_you_mean(target, defined).unwrap_or_else(|| {
+                                format!("add a plugins entry named '{}'", target)
+                            }),
+                        ),
+                );
+            }
+        }
+        TargetType::Mqtt => {
+            if target.is_empty() {
+                diagnostics.push(
+                    Diagnostic::error(target_name, "no MQTT topic")
+                        .fix("set target_name to the topic to publish to"),
+                );
+            }
+            if profile.mqtt.is_none() {
+                diagnostics.push(
+                    Diagnostic::error(
+                        path,
+                        "publishes to MQTT, but the profile has no mqtt broker",
+                    )
+                    .fix("add an mqtt table with broker = \"host:1883\""),
+                );
+            }
+        }
+        TargetType::Osc => {
+            let default_to = profile.osc.as_ref().map(|osc| osc.to.as_str());
+            if let Err(e) = OscAction::new(mapping, default_to) {
+                diagnostics.push(Diagnostic::error(path, format!("{:#}", e)));
+            }
+        }
+        TargetType::Mirror => check_mirror(mapping, path, diagnostics),
+        TargetType::Recenter => {
+            if let Err(e) = parse_stick_axes(target) {
+                diagnostics.push(Diagnostic::error(target_name, e.to_string()).fix(
+                    "name stick axes, like Left X, Left Y, or leave it empty for both sticks",
+                ));
+            }
+        }
+    }
+}
+
+fn check_mirror(mapping: &Mapping, path: &str, diagnostics: &mut Vec<Diagnostic>) {
+    if MappingRule::mirror(mapping).is_some() {
+        return;
+    }
+    let buttons = || ButtonCode::ALL.iter().map(ToString::to_string);
+    if let Some(layer) = &mapping.layer {
+        if ButtonCode::from(layer.as_str()) == ButtonCode::Unknown {
+            diagnostics.push(
+                Diagnostic::error(format!("{}.layer", path), format!("unknown button '{}'", layer))
+                    .fix(
+                        did_you_mean(layer, buttons())
+                            .unwrap_or_else(|| "use a button name, like Left Shoulder".to_string()),
+                    ),
+            );
+            return;
+        }
+        if ButtonCode::from(layer.as_str()) == ButtonCode::from(mapping.source_name.as_str()) {
+            diagnostics.push(
+                Diagnostic::error(format!("{}.layer", path), "a layer button can't mirror itself")
+                    .fix("use another button as the layer"),
+            );
+            return;
+        }
+    }
+    // Unknown sources are check_source's to report
+    let name = mapping.source_name.as_str();
+    if ButtonCode::from(name) == ButtonCode::Unknown && AxisCode::from(name) == AxisCode::Unknown {
+        return;
+    }
+    let target = mapping.target_name.as_str();
+    let controls = buttons()
+        .chain([AxisCode::DPadX, AxisCode::DPadY].into_iter().flat_map(|code| {
+            [AxisDirection::Negative, AxisDirection::Positive]
+                .map(|direction| axis_and_direction_to_string(code, direction))
+        }))
+        .chain(AxisCode::ALL.iter().map(ToString::to_string));
+    // A control of the wrong kind needs the rule, not a spelling
+    let known = controls.clone().any(|control| control.eq_ignore_ascii_case(target));
+    let suggestion = if known { None } else { did_you_mean(target, controls) };
+    diagnostics.push(
+        Diagnostic::error(
+            format!("{}.target_name", path),
+            format!("{} can't act as '{}'", mapping.source_name, target),
+        )
+        .fix(suggestion.unwrap_or_else(|| {
+            "buttons and D-pad directions act as a button or a D-pad direction, like North or \
+             DPad Up; axes as another axis, like Right X"
+                .to_string()
+        })),
+    );
+}
+
+/// Fields the mapping's target type doesn't read
+fn check_ignored_fields(mapping: &Mapping, path: &str, diagnostics: &mut Vec<Diagnostic>) {
+    use TargetType::*;
+
+    let reads = |types: &[TargetType]| types.contains(&mapping.target_type);
+    let ignored = [
+        ("target_name", !mapping.target_name.is_empty() && reads(&[Script, Exec])),
+        ("script", mapping.script.is_some() && !reads(&[Script])),
+        ("command", !mapping.command.is_empty() && !reads(&[Exec])),
+        ("rate_limit_ms", mapping.rate_limit_ms.is_some() && !reads(&[Exec])),
+        ("on", mapping.on.is_some() && !reads(&[Exec, Mqtt])),
+        ("params", mapping.params.is_some() && !reads(&[Plugin, Mqtt, Osc])),
+        ("sticky", mapping.sticky && !reads(&[Keyboard])),
+        ("repeat_delay_ms", mapping.repeat_delay_ms.is_some() && !reads(&[Keyboard, Desktop])),
+        ("repeat_rate", mapping.repeat_rate.is_some() && !reads(&[Keyboard, Desktop])),
+        ("layer", mapping.layer.is_some() && !reads(&[Mirror])),
+        ("flick", mapping.flick.is_some() && !reads(&[Keyboard, Desktop, Mouse, Gamepad])),
+        ("device", mapping.device.is_some() && !reads(&[Keyboard, Mouse, Gamepad])),
+    ];
+    for (field, _) in ignored.iter().filter(|(_, ignored)| *ignored) {
+        diagnostics.push(
+            Diagnostic::warning(
+                format!("{}.{}", path, field),
+                format!("{:?} mappings ignore {}", mapping.target_type, field),
+            )
+            .fix("remove it"),
+        );
+    }
+    if mapping.debounce_ms.is_some() && mapping.source_direction.is_some() {
+        diagnostics.push(
+            Diagnostic::warning(format!("{}.debounce_ms", path), "only buttons are debounced")
+                .fix("remove it"),
+        );
+    }
+    if mapping.sticky && mapping.source_direction.is_some() {
+        diagnostics.push(
+            Diagnostic::warning(format!("{}.sticky", path), "only buttons can be sticky")
+                .fix("remove it"),
+        );
+    }
+    let repeats = mapping.repeat_delay_ms.is_some() || mapping.repeat_rate.is_some();
+    if repeats && mapping.sticky && mapping.target_type == TargetType::Keyboard {
+        diagnostics.push(
+            Diagnostic::warning(format!("{}.repeat_rate", path), "sticky keys don't repeat")
+                .fix("remove sticky or the repeat settings"),
+        );
+    }
+}
+
+/// The device a mapping sends to has to be declared, and of the kind its
+/// target type presses
+fn check_output_device(
+    profile: &Profile,
+    mapping: &Mapping,
+    path: &str,
+    diagnostics: &mut Vec<Diagnostic>,
+) {
+    let (Some(device), Some(kind)) = (&mapping.device, mapping.target_type.device_kind()) else {
+        return;
+    };
+    let path = format!("{}.device", path);
+    let custom = &profile.settings.virtual_devices.custom;
+    let device_kind = match DeviceKind::from_name(device) {
+        Some(usual) => usual,
+        None => match custom.get(device) {
+            Some(declared) => declared.kind,
+            None => {
+                let names =
+                    DeviceKind::ALL.iter().map(ToString::to_string).chain(custom.keys().cloned());
+                let fix = did_you_mean(device, names).unwrap_or_else(|| {
+                    format!("declare it under settings.virtual_devices.custom.{}", device)
+                });
+                diagnostics
+                    .push(Diagnostic::error(path, format!("unknown device '{}'", device)).fix(fix));
+                return;
+            }
+        },
+    };
+    if device_kind != kind {
+        diagnostics.push(
+            Diagnostic::error(
+                path,
+                format!(
+                    "'{}' is a {}; {:?} mappings need a {}",
+                    device, device_kind, mapping.target_type, kind
+                ),
+            )
+            .fix(format!("route it to a {} device", kind)),
+        );
+        return;
+    }
+    if mapping.flick.is_some() && DeviceKind::from_name(device).is_none() {
+        diagnostics.push(
+            Diagnostic::warning(path, "flicks always press the usual device; device is ignored")
+                .fix("remove it"),
+        );
+        return;
+    }
+    let holds =
+        mapping.sticky || mapping.repeat_delay_ms.is_some() || mapping.repeat_rate.is_some();
+    if holds && mapping.custom_device().is_some() {
+        diagnostics.push(
+            Diagnostic::warning(
+                path,
+                "keys on a custom device are plain presses; sticky and repeat settings are ignored",
+            )
+            .fix("remove them, or send to the usual keyboard"),
+        );
+    }
+}
+
+/// Flicks need a stick direction, a threshold it reaches, and no settings
+/// for holding keys
+fn check_flick(mapping: &Mapping, path: &str, diagnostics: &mut Vec<Diagnostic>) {
+    let Some(flick) = mapping.flick else {
+        return;
+    };
+    if let Some(problem) = flick.problem() {
+        diagnostics.push(Diagnostic::error(format!("{}.flick.threshold", path), problem));
+    }
+    let name = mapping.source_name.as_str();
+    let axis = AxisCode::from(name);
+    let stick =
+        matches!(axis, AxisCode::LeftX | AxisCode::LeftY | AxisCode::RightX | AxisCode::RightY);
+    if mapping.source_direction.is_none() && ButtonCode::from(name) != ButtonCode::Unknown {
+        diagnostics.push(
+            Diagnostic::error(
+                format!("{}.flick", path),
+                format!("{} is a button; only sticks flick", name),
+            )
+            .fix("map a stick direction, like Right Y with source_direction Negative"),
+        );
+    } else if mapping.source_direction.is_some() && axis != AxisCode::Unknown && !stick {
+        diagnostics.push(
+            Diagnostic::warning(path, format!("only sticks flick; {} never fires", axis))
+                .fix("map Left X, Left Y, Right X or Right Y instead"),
+        );
+    }
+    let holds =
+        mapping.sticky || mapping.repeat_delay_ms.is_some() || mapping.repeat_rate.is_some();
+    if holds {
+        diagnostics.push(
+            Diagnostic::warning(
+                format!("{}.flick", path),
+                "a flick presses once; sticky and repeat settings are ignored",
+            )
+            .fix("remove them"),
+        );
+    }
+}
+
+/// Controls the device doesn't have
+fn check_device(
+    source: ActionSource,
+    device: &GamepadInfo,
+    path: &str,
+    diagnostics: &mut Vec<Diagnostic>,
+) {
+    use ButtonCode::*;
+
+    let has = |capability| device.capabilities.contains(&capability);
+    let is_pad_axis = |code| {
+        matches!(
+            code,
+            AxisCode::LeftPadX | AxisCode::LeftPadY | AxisCode::RightPadX | AxisCode::RightPadY
+        )
+    };
+    let missing = match source {
+        ActionSource::Button(Paddle1 | Paddle2 | Paddle3 | Paddle4)
+            if !has(GamepadCapability::ElitePaddles) && !has(GamepadCapability::BackButtons) =>
+        {
+            "paddles or back buttons"
+        }
+        ActionSource::Button(LeftPad | RightPad) if !has(GamepadCapability::Trackpads) => {
+            "trackpads"
+        }
+        ActionSource::Axis(code, _) | ActionSource::AxisValue(code)
+            if is_pad_axis(code) && !has(GamepadCapability::Trackpads) =>
+        {
+            "trackpads"
+        }
+        ActionSource::Button(Touchpad)
+            if matches!(
+                device.gamepad_type,
+                GamepadType::Xbox360
+                    | GamepadType::XboxOne
+                    | GamepadType::XboxSeries
+                    | GamepadType::XboxElite
+            ) =>
+        {
+            "touchpad"
+        }
+        _ => return,
+    };
+    diagnostics.push(
+        Diagnostic::warning(
+            format!("{}.source_name", path),
+            format!("{} has no {}; {} never fires on it", device.name, missing, source),
+        )
+        .fix("map a control it has (see 'blazeremap detect')"),
+    );
+}
+
+/// Warn about fields loading ignores, which are mostly typos
+fn unknown_fields(profile: &Table, diagnostics: &mut Vec<Diagnostic>) {
+    check_fields(profile, &PROFILE_FIELDS, "", diagnostics);
+    if let Some(Value::Table(settings)) = profile.get("settings") {
+        check_fields(settings, &SETTINGS_FIELDS, "settings", diagnostics);
+        for trigger in ["left_trigger", "right_trigger"] {
+            if let Some(Value::Table(threshold)) = settings.get(trigger) {
+                let path = format!("settings.{}", trigger);
+                check_fields(threshold, &TRIGGER_FIELDS, &path, diagnostics);
+            }
+        }
+        if let Some(Value::Table(pointer)) = settings.get("pointer") {
+            check_fields(pointer, &POINTER_FIELDS, "settings.pointer", diagnostics);
+        }
+        if let Some(Value::Table(devices)) = settings.get("virtual_devices") {
+            let path = "settings.virtual_devices";
+            check_fields(devices, &VIRTUAL_DEVICE_FIELDS, path, diagnostics);
+            for (kind, identity) in devices {
+                let Value::Table(identity) = identity else {
+                    continue;
+                };
+                let path = format!("{}.{}", path, kind);
+                if kind != "custom" {
+                    check_fields(identity, &IDENTITY_FIELDS, &path, diagnostics);
+                    continue;
+                }
+                for (name, device) in identity {
+                    if let Value::Table(device) = device {
+                        let path = format!("{}.{}", path, name);
+                        check_fields(device, &CUSTOM_DEVICE_FIELDS, &path, diagnostics);
+                    }
+                }
+            }
+        }
+    }
+    if let Some(Value::Table(mqtt)) = profile.get("mqtt") {
+        check_fields(mqtt, &MQTT_FIELDS, "mqtt", diagnostics);
+    }
+    if let Some(Value::Table(osc)) = profile.get("osc") {
+        check_fields(osc, &OSC_FIELDS, "osc", diagnostics);
+    }
+    if let Some(Value::Array(mappings)) = profile.get("mappings") {
+        for (i, mapping) in mappings.iter().enumerate() {
+            if let Some(Value::Table(flick)) = mapping.get("flick") {
+                let path = format!("mappings[{}].flick", i);
+                check_fields(flick, &FLICK_FIELDS, &path, diagnostics);
+            }
+        }
+    }
+    for (list, known) in [("mappings", &MAPPING_FIELDS[..]), ("plugins", &PLUGIN_FIELDS[..])] {
+        let Some(Value::Array(items)) = profile.get(list) else {
+            continue;
+        };
+        for (i, item) in items.iter().enumerate() {
+            if let Value::Table(item) = item {
+                check_fields(item, known, &format!("{}[{}]", list, i), diagnostics);
+            }
+        }
+    }
+}
+
+fn check_fields(table: &Table, known: &[&str], path: &str, diagnostics: &mut Vec<Diagnostic>) {
+    for key in table.keys().filter(|key| !known.contains(&key.as_str())) {
+        let path = if path.is_empty() { key.clone() } else { format!("{}.{}", path, key) };
+        let fix = did_you_mean(key, known.iter().map(ToString::to_string))
+            .unwrap_or_else(|| "remove it".to_string());
+        diagnostics.push(Diagnostic::warning(path, "unknown field; loading ignores it").fix(fix));
+    }
+}
+
+/// "did you mean 'X'?" for the candidate closest to a misspelt `name`
+fn did_you_mean(name: &str, candidates: impl IntoIterator<Item = String>) -> Option<String> {
+    let name = name.to_lowercase();
+    // Allow about one typo per four characters
+    let limit = (name.chars().count() / 4).max(1);
+    candidates
+        .into_iter()
+        .map(|candidate| (edit_distance(&name, &candidate.to_lowercase()), candidate))
+        .filter(|(distance, _)| *distance <= limit)
+        .min_by_key(|(distance, _)| *distance)
+        .map(|(_, candidate)| format!("did you mean '{}'?", candidate))
+}
+
+/// Edits (insert, delete, replace or swap two neighbours) turning `a` into `b`
+pub(crate) fn edit_distance(a: &str, b: &str) -> usize {
+    let (a, b): (Vec<char>, Vec<char>) = (a.chars().collect(), b.chars().collect());
+    // Rows for the prefixes of `a` one and two shorter than the current one
+    let mut previous: Vec<usize> = (0..=b.len()).collect();
+    let mut before_previous = previous.clone();
+    for i in 1..=a.len() {
+        let mut row = vec![i; b.len() + 1];
+        for j in 1..=b.len() {
+            let cost = (a[i - 1] != b[j - 1]) as usize;
+            row[j] = (previous[j] + 1).min(row[j - 1] + 1).min(previous[j - 1] + cost);
+            if i > 1 && j > 1 && a[i - 1] == b[j - 2] && a[i - 2] == b[j - 1] {
+                row[j] = row[j].min(before_previous[j - 2] + 1);
+            }
+        }
+        before_previous = std::mem::replace(&mut previous, row);
+    }
+    previous[b.len()]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn lint_toml(text: &str) -> Vec<(Severity, String)> {
+        lint_text(text, ProfileFormat::Toml, None)
+            .into_iter()
+            .map(|diagnostic| (diagnostic.severity, diagnostic.path))
+            .collect()
+    }
+
+    fn device(capabilities: Vec<GamepadCapability>) -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Xbox Wireless Controller".to_string(),
+            gamepad_type: GamepadType::XboxSeries,
+            vendor_id: 0x045e,
+            vendor_name: "Microsoft".to_string(),
+            product_id: 0x0b13,
+            uniq: None,
+            phys: None,
+            capabilities,
+        }
+    }
+
+    #[test]
+    fn test_builtin_profiles_are_clean() {
+        for id in crate::mapping::profile::BUILTIN_PROFILES {
+            assert_eq!(lint(&Profile::builtin(id).unwrap(), None), [], "{}", id);
+        }
+    }
+
+    #[test]
+    fn test_field_lists_match_the_profile() {
+        let keys = |value: Value| value.as_table().unwrap().keys().cloned().collect::<Vec<_>>();
+        let profile: Profile = toml::from_str(
+            r#"
+schema_version = 1
+name = "All"
+description = "Every field"
+game_name = "Game"
+plugins = [{ name = "p", command = "p", args = ["a"] }]
+mqtt = { broker = "b", client_id = "c", username = "u", password = "p" }
+osc = { to = "localhost:9000" }
+
+[settings]
+slow_keys_ms = 1
+bounce_keys_ms = 1
+swap_ab_xy = true
+swap_sticks = true
+swap_dpad = true
+left_trigger = { press = 2, release = 1 }
+right_trigger = { press = 1 }
+sticky_cue = ["visual"]
+switch_cue = ["sound"]
+notify = ["battery_low"]
+pointer = { curve = "cubic", precision_button = "Left Shoulder", precision_speed = 0.5 }
+keyboard_layout = "de"
+virtual_devices = { keyboard = { name = "K", vendor_id = 1, product_id = 2, version = 3 }, mouse = { name = "M" }, gamepad = { name = "G" }, custom = { p2 = { kind = "keyboard", name = "P2", vendor_id = 1, product_id = 2, version = 3 } } }
+
+[[mappings]]
+source_name = "South"
+source_direction = "Positive"
+target_type = "Exec"
+target_name = "x"
+device = "p2"
+debounce_ms = 1
+sticky = true
+repeat_delay_ms = 1
+repeat_rate = 1
+params = 1
+script = "none"
+command = ["true"]
+on = "both"
+rate_limit_ms = 1
+layer = "Mode"
+flick = { threshold = 20000, cooldown_ms = 1 }
+conditions = { bluetooth = true }
+"#,
+        )
+        .unwrap();
+        let table = Value::try_from(&profile).unwrap();
+
+        assert_eq!(keys(table.clone()), PROFILE_FIELDS);
+        assert_eq!(keys(table["mappings"][0].clone()), MAPPING_FIELDS);
+        assert_eq!(keys(table["mappings"][0]["flick"].clone()), FLICK_FIELDS);
+        assert_eq!(keys(table["settings"].clone()), SETTINGS_FIELDS);
+        assert_eq!(keys(table["settings"]["left_trigger"].clone()), TRIGGER_FIELDS);
+        assert_eq!(keys(table["settings"]["pointer"].clone()), POINTER_FIELDS);
+        let devices = table["settings"]["virtual_devices"].clone();
+        assert_eq!(keys(devices.clone()), VIRTUAL_DEVICE_FIELDS);
+        assert_eq!(keys(devices["keyboard"].clone()), IDENTITY_FIELDS);
+        assert_eq!(keys(devices["custom"]["p2"].clone()), CUSTOM_DEVICE_FIELDS);
+        assert_eq!(keys(table["plugins"][0].clone()), PLUGIN_FIELDS);
+        assert_eq!(keys(table["mqtt"].clone()), MQTT_FIELDS);
+        assert_eq!(keys(table["osc"].clone()), OSC_FIELDS);
+    }
+
+    #[test]
+    fn test_reports_every_problem_with_a_fix() {
+        let diagnostics = lint_text(
+            r#"
+schema_version = 1
+name = "Racing"
+description = "Typos everywhere"
+
+[[mappings]]
+source_name = "Sout"
+target_type = "Keyboard"
+target_name = "Space"
+
+[[mappings]]
+source_name = "East"
+target_type = "Keyboard"
+target_nmae = "Enter"
+
+[[mappings]]
+source_name = "North"
+target_type = "Keyboard"
+target_name = "Spcae"
+
+[[mappings]]
+source_name = "DPad Y"
+target_type = "Keyboard"
+target_name = "W"
+"#,
+            ProfileFormat::Toml,
+            None,
+        );
+        let found: Vec<_> = diagnostics
+            .iter()
+            .map(|d| (d.severity, d.path.as_str(), d.fix.as_deref().unwrap_or("")))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (Severity::Warning, "mappings[1].target_nmae", "did you mean 'target_name'?"),
+                (Severity::Error, "mappings[0].source_name", "did you mean 'South'?"),
+                (
+                    Severity::Error,
+                    "mappings[1].target_name",
+                    "set target_name to a key, like Space"
+                ),
+                (Severity::Error, "mappings[2].target_name", "did you mean 'Space'?"),
+                (
+                    Severity::Error,
+                    "mappings[3].source_direction",
+                    "set source_direction to Positive or Negative"
+                ),
+            ]
+        );
+        assert_eq!(
+            diagnostics[3].to_string(),
+            "error: mappings[2].target_name: unknown key 'Spcae'"
+        );
+    }
+
+    #[test]
+    fn test_warns_about_mappings_that_never_fire() {
+        let found = lint_toml(
+            r#"
+schema_version = 1
+name = "Racing"
+description = ""
+plugins = [{ name = "lights", command = "lights" }]
+
+[[mappings]]
+source_name = "South"
+target_type = "Keyboard"
+target_name = "S"
+conditions = { window = "firefox" }
+
+[[mappings]]
+source_name = "South"
+target_type = "Exec"
+command = ["true"]
+script = "none"
+
+[[mappings]]
+source_name = "South"
+target_type = "Keyboard"
+target_name = "Space"
+
+[[mappings]]
+source_name = "Left X"
+source_direction = "Positive"
+target_type = "Keyboard"
+target_name = "D"
+debounce_ms = 20
+"#,
+        );
+        assert_eq!(
+            found,
+            [
+                (Severity::Warning, "mappings[1].script".to_string()),
+                (Severity::Warning, "mappings[3].debounce_ms".to_string()),
+                (Severity::Warning, "mappings[3]".to_string()),
+                (Severity::Warning, "mappings[0]".to_string()),
+                (Severity::Warning, "plugins[0]".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_action_targets() {
+        let found = lint_toml(
+            r#"
+schema_version = 1
+name = "Actions"
+description = ""
+
+[[mappings]]
+source_name = "South"
+target_type = "Plugin"
+target_name = "lights"
+
+[[mappings]]
+source_name = "East"
+target_type = "Mqtt"
+target_name = "home/pad"
+
+[[mappings]]
+source_name = "West"
+target_type = "Osc"
+target_name = "no-slash"
+
+[[mappings]]
+source_name = "North"
+target_type = "Exec"
+
+[[mappings]]
+source_name = "Start"
+target_type = "Script"
+script = "if then"
+"#,
+        );
+        let paths: Vec<_> = found.iter().map(|(_, path)| path.as_str()).collect();
+        assert_eq!(
+            paths,
+            [
+                "mappings[0].target_name",
+                "mappings[1]",
+                "mappings[2]",
+                "mappings[3].command",
+                "mappings[4].script",
+            ]
+        );
+        assert!(found.iter().all(|(severity, _)| *severity == Severity::Error));
+    }
+
+    #[test]
+    fn test_sticky_mappings() {
+        let found = lint_toml(
+            r#"
+schema_version = 1
+name = "Sticky"
+description = ""
+settings = { vibration_enabled = false, sticky_cue = ["rumble"] }
+
+[[mappings]]
+source_name = "LeftShoulder"
+target_type = "Keyboard"
+target_name = "Left Shift"
+sticky = true
+
+[[mappings]]
+source_name = "DPadY"
+source_direction = "Negative"
+target_type = "Keyboard"
+target_name = "Up"
+sticky = true
+
+[[mappings]]
+source_name = "Start"
+target_type = "Exec"
+command = ["true"]
+sticky = true
+"#,
+        );
+        assert_eq!(
+            found,
+            [
+                (Severity::Warning, "mappings[1].sticky".to_string()),
+                (Severity::Warning, "mappings[2].sticky".to_string()),
+                (Severity::Warning, "settings.sticky_cue".to_string()),
+            ]
+        );
+
+        let mut profile = Profile::default_profile();
+        profile.settings.sticky_cue = vec![Cue::Visual];
+        let found = lint(&profile, None);
+        assert_eq!(found.len(), 1);
+        assert_eq!(found[0].message, "no mapping is sticky");
+
+        profile.settings.sticky_cue.clear();
+        profile.settings.switch_cue = vec![Cue::Sound];
+        let found = lint(&profile, None);
+        assert_eq!(found.len(), 1);
+        assert_eq!(found[0].path, "settings.switch_cue");
+        // Its layers switch
+        let mut profile = Profile::one_handed_left_profile();
+        profile.settings.switch_cue = vec![Cue::Sound];
+        assert_eq!(lint(&profile, None), []);
+    }
+
+    #[test]
+    fn test_repeat_settings() {
+        let found = lint_toml(
+            r#"
+schema_version = 1
+name = "Repeat"
+description = ""
+
+[[mappings]]
+source_name = "DPadY"
+source_direction = "Negative"
+target_type = "Keyboard"
+target_name = "Up"
+repeat_delay_ms = 400
+repeat_rate = 20
+
+[[mappings]]
+source_name = "LeftShoulder"
+target_type = "Keyboard"
+target_name = "Left Shift"
+sticky = true
+repeat_rate = 20
+
+[[mappings]]
+source_name = "Start"
+target_type = "Exec"
+command = ["true"]
+repeat_delay_ms = 400
+"#,
+        );
+        assert_eq!(
+            found,
+            [
+                (Severity::Warning, "mappings[1].repeat_rate".to_string()),
+                (Severity::Warning, "mappings[2].repeat_delay_ms".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_trigger_thresholds() {
+        let found = lint_toml(
+            r#"
+schema_version = 1
+name = "Triggers"
+description = ""
+
+[settings]
+left_trigger = { press = 40, release = 60 }
+right_trigger = { press = 40, relase = 20 }
+pointer = { curve = "linear", precision_button = "Left Bumper", precison_speed = 0.5 }
+virtual_devices = { mouse = { name = "", vendor = 0x1209 } }
+
+[[mappings]]
+source_name = "RightTrigger"
+target_type = "Keyboard"
+target_name = "Space"
+"#,
+        );
+        assert_eq!(
+            found,
+            [
+                (Severity::Warning, "settings.right_trigger.relase".to_string()),
+                (Severity::Warning, "settings.pointer.precison_speed".to_string()),
+                (Severity::Warning, "settings.virtual_devices.mouse.vendor".to_string()),
+                (Severity::Error, "settings.left_trigger".to_string()),
+                (Severity::Error, "settings.pointer".to_string()),
+                (Severity::Error, "settings.virtual_devices.mouse".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_routed_mappings() {
+        let found = lint_toml(
+            r#"
+schema_version = 1
+name = "Couch"
+description = ""
+
+[settings.virtual_devices.custom.p2]
+kind = "gamepad"
+nmae = "Player 2"
+
+[settings.virtual_devices.custom.mouse]
+kind = "mouse"
+
+[[mappings]]
+source_name = "South"
+target_type = "Gamepad"
+target_name = "South"
+device = "p2"
+
+[[mappings]]
+source_name = "East"
+target_type = "Gamepad"
+target_name = "East"
+device = "p3"
+
+[[mappings]]
+source_name = "West"
+target_type = "Keyboard"
+target_name = "Space"
+device = "p2"
+
+[[mappings]]
+source_name = "North"
+target_type = "Exec"
+command = ["true"]
+device = "p2"
+"#,
+        );
+        assert_eq!(
+            found,
+            [
+                (Severity::Warning, "settings.virtual_devices.custom.p2.nmae".to_string()),
+                (Severity::Error, "mappings[1].device".to_string()),
+                (Severity::Error, "mappings[2].device".to_string()),
+                (Severity::Warning, "mappings[3].device".to_string()),
+                (Severity::Error, "settings.virtual_devices.custom.mouse".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_recenter_targets() {
+        let found = lint_text(
+            r#"
+schema_version = 1
+name = "Drift"
+description = ""
+
+[[mappings]]
+source_name = "Left Stick"
+target_type = "Recenter"
+
+[[mappings]]
+source_name = "Right Stick"
+target_type = "Recenter"
+target_name = "Right X, Right Trigger"
+"#,
+            ProfileFormat::Toml,
+            None,
+        );
+        let found: Vec<_> =
+            found.iter().map(|d| (d.severity, d.path.as_str(), d.message.as_str())).collect();
+        assert_eq!(
+            found,
+            [(Severity::Error, "mappings[1].target_name", "'Right Trigger' is not a stick axis")]
+        );
+    }
+
+    #[test]
+    fn test_desktop_actions() {
+        let found = lint_text(
+            r#"
+schema_version = 1
+name = "Remote"
+description = ""
+
+[[mappings]]
+source_name = "Right Shoulder"
+target_type = "Desktop"
+target_name = "volume up"
+repeat_rate = 10
+
+[[mappings]]
+source_name = "Left Shoulder"
+target_type = "Desktop"
+target_name = "Volume Dwn"
+
+[[mappings]]
+source_name = "Select"
+target_type = "Desktop"
+target_name = "Lights"
+"#,
+            ProfileFormat::Toml,
+            None,
+        );
+        let found: Vec<_> = found
+            .iter()
+            .map(|d| (d.severity, d.path.as_str(), d.fix.as_deref().unwrap_or("")))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (Severity::Error, "mappings[1].target_name", "did you mean 'Volume Down'?"),
+                (
+                    Severity::Error,
+                    "mappings[2].target_name",
+                    "use one of Volume Up, Volume Down, Mute, Play/Pause, Next Track, \
+                     Previous Track, Stop Media, Brightness Up, Brightness Down, Screenshot"
+                ),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_mouse_and_gamepad_targets() {
+        let found = lint_text(
+            r#"
+schema_version = 1
+name = "Mixed"
+description = ""
+
+[[mappings]]
+source_name = "Right Shoulder"
+target_type = "Mouse"
+target_name = "left"
+
+[[mappings]]
+source_name = "Left Shoulder"
+target_type = "Mouse"
+target_name = "Wheel Dwn"
+
+[[mappings]]
+source_name = "DPad Y"
+source_direction = "Negative"
+target_type = "Gamepad"
+target_name = "Left Y Up"
+
+[[mappings]]
+source_name = "South"
+target_type = "Gamepad"
+target_name = "Jump"
+"#,
+            ProfileFormat::Toml,
+            None,
+        );
+        let found: Vec<_> = found
+            .iter()
+            .map(|d| (d.severity, d.path.as_str(), d.fix.as_deref().unwrap_or("")))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (Severity::Error, "mappings[1].target_name", "did you mean 'Wheel Down'?"),
+                (
+                    Severity::Error,
+                    "mappings[3].target_name",
+                    "use a button like South or a direction like DPad Up"
+                ),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_flick_mappings() {
+        let found = lint_text(
+            r#"
+schema_version = 1
+name = "Flicks"
+description = ""
+
+[[mappings]]
+source_name = "Right Y"
+source_direction = "Negative"
+target_type = "Mouse"
+target_name = "Wheel Up"
+flick = { threshold = 24000 }
+
+[[mappings]]
+source_name = "Right Y"
+source_direction = "Positive"
+target_type = "Keyboard"
+target_name = "Left Control+-"
+flick = { treshold = 24000 }
+
+[[mappings]]
+source_name = "South"
+target_type = "Keyboard"
+target_name = "Left Control+="
+flick = { threshold = 40000 }
+
+[[mappings]]
+source_name = "DPad X"
+source_direction = "Positive"
+target_type = "Keyboard"
+target_name = "Right"
+repeat_rate = 10
+flick = {}
+"#,
+            ProfileFormat::Toml,
+            None,
+        );
+        let found: Vec<_> = found.iter().map(|d| (d.severity, d.path.as_str())).collect();
+        assert_eq!(
+            found,
+            [
+                (Severity::Warning, "mappings[1].flick.treshold"),
+                (Severity::Error, "mappings[2].flick.threshold"),
+                (Severity::Error, "mappings[2].flick"),
+                (Severity::Warning, "mappings[3]"),
+                (Severity::Warning, "mappings[3].flick"),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_text_mappings() {
+        let found = lint_text(
+            r#"
+schema_version = 1
+name = "Texts"
+description = ""
+
+[settings]
+keyboard_layout = "uk"
+
+[[mappings]]
+source_name = "South"
+target_type = "Text"
+target_name = "£5, @home"
+
+[[mappings]]
+source_name = "East"
+target_type = "Text"
+target_name = "50€"
+
+[[mappings]]
+source_name = "West"
+target_type = "Text"
+"#,
+            ProfileFormat::Toml,
+            None,
+        );
+        let found: Vec<_> = found.iter().map(|d| (d.severity, d.message.as_str())).collect();
+        assert_eq!(
+            found,
+            [
+                (Severity::Error, "Can't type '€' on the uk keyboard layout"),
+                (Severity::Error, "No text to type"),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_mirror_mappings() {
+        let found = lint_text(
+            r#"
+schema_version = 1
+name = "Mirrors"
+description = ""
+
+[[mappings]]
+source_name = "South"
+target_type = "Keyboard"
+target_name = "Space"
+
+[[mappings]]
+source_name = "South"
+target_type = "Mirror"
+target_name = "DPad Up"
+
+[[mappings]]
+source_name = "Left X"
+target_type = "Mirror"
+target_name = "Rigth X"
+layer = "Left Shoulder"
+
+[[mappings]]
+source_name = "East"
+target_type = "Mirror"
+target_name = "Left X"
+
+[[mappings]]
+source_name = "West"
+target_type = "Mirror"
+target_name = "North"
+layer = "Left Shoulder"
+
+[[mappings]]
+source_name = "North"
+target_type = "Mirror"
+target_name = "West"
+layer = "Shoulder"
+"#,
+            ProfileFormat::Toml,
+            None,
+        );
+        let found: Vec<_> = found
+            .iter()
+            .map(|d| (d.severity, d.path.as_str(), d.fix.as_deref().unwrap_or("")))
+            .collect();
+        assert_eq!(
+            found,
+            [
+                (Severity::Error, "mappings[2].target_name", "did you mean 'Right X'?"),
+                (
+                    Severity::Error,
+                    "mappings[3].target_name",
+                    "buttons and D-pad directions act as a button or a D-pad direction, like \
+                     North or DPad Up; axes as another axis, like Right X"
+                ),
+                (Severity::Error, "mappings[5].layer", "use a button name, like Left Shoulder"),
+                (
+                    Severity::Warning,
+                    "mappings[0]",
+                    "remove one of them, or give mappings[1] a layer"
+                ),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_checks_the_device_has_the_controls() {
+        let mut profile = Profile::steam_deck_profile();
+        profile.mappings.retain(|mapping| mapping.source_name.starts_with("Paddle"));
+
+        let pad = device(vec![GamepadCapability::ForceFeedback]);
+        let diagnostics = lint(&profile, Some(&pad));
+        assert!(!diagnostics.is_empty());
+        assert!(diagnostics.iter().all(|d| d.severity == Severity::Warning
+            && d.message.starts_with("Xbox Wireless Controller has no paddles or back buttons")));
+
+        let elite = device(vec![GamepadCapability::ElitePaddles]);
+        assert_eq!(lint(&profile, Some(&elite)), []);
+    }
+
+    #[test]
+    fn test_unparseable_profiles() {
+        assert_eq!(lint_toml("name = ["), [(Severity::Error, String::new())]);
+        assert_eq!(
+            lint_toml(
+                "schema_version = 1\nname = \"x\"\ndescription = \"\"\n\n[[mappings]]\nsource_name = 3\n"
+            ),
+            [(Severity::Error, "mappings[0]".to_string())]
+        );
+        assert_eq!(
+            lint_toml("schema_version = 99\nname = \"x\""),
+            [(Severity::Error, "schema_version".to_string())]
+        );
+    }
+
+    #[test]
+    fn test_did_you_mean() {
+        let names = || ["Left Shoulder", "Right Shoulder"].map(String::from);
+        assert_eq!(
+            did_you_mean("left shoulder", names()).unwrap(),
+            "did you mean 'Left Shoulder'?"
+        );
+        assert_eq!(
+            did_you_mean("Rigth Shoulder", names()).unwrap(),
+            "did you mean 'Right Shoulder'?"
+        );
+        assert_eq!(did_you_mean("Trigger", names()), None);
+        assert_eq!(edit_distance("kitten", "sitting"), 3);
+        assert_eq!(edit_distance("Spcae", "Space"), 1);
+    }
+}
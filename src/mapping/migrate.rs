@@ -0,0 +1,115 @@
+// Profile schema migrations
+//
+// Profiles carry a `schema_version`. When the format changes, bump
+// CURRENT_SCHEMA_VERSION and append a step to MIGRATIONS that rewrites a
+// profile of the previous version. Loading runs every step from the file's
+// version up, on the raw TOML, so steps can still read fields and values the
+// current `Profile` no longer knows.
+
+use anyhow::{Context, Result};
+use toml::{Table, Value};
+
+/// Version written by this build; files without one are version 0
+pub const CURRENT_SCHEMA_VERSION: u32 = 1;
+
+/// Rewrites a profile of version `i` (its index) into version `i + 1`
+type Migration = fn(&mut Table) -> Result<()>;
+
+const MIGRATIONS: [Migration; CURRENT_SCHEMA_VERSION as usize] = [named_directions];
+
+/// Upgrade `profile` to the current version in place; returns the version it had
+pub fn migrate(profile: &mut Table) -> Result<u32> {
+    let version = match profile.get("schema_version") {
+        None => 0,
+        Some(Value::Integer(version)) => u32::try_from(*version)
+            .with_context(|| format!("Invalid schema_version {}", version))?,
+        Some(other) => anyhow::bail!("schema_version must be a number, not {}", other),
+    };
+    if version > CURRENT_SCHEMA_VERSION {
+        anyhow::bail!(
+            "Profile schema version {} is newer than this blazeremap supports ({}); please upgrade",
+            version,
+            CURRENT_SCHEMA_VERSION
+        );
+    }
+
+    for (from, step) in MIGRATIONS.iter().enumerate().skip(version as usize) {
+        step(profile)
+            .with_context(|| format!("Failed to upgrade profile from schema version {}", from))?;
+    }
+    profile.insert("schema_version".to_string(), Value::Integer(CURRENT_SCHEMA_VERSION as i64));
+    Ok(version)
+}
+
+/// 0 → 1: unversioned profiles could name D-pad directions up/down/left/right
+fn named_directions(profile: &mut Table) -> Result<()> {
+    let Some(Value::Array(mappings)) = profile.get_mut("mappings") else {
+        return Ok(());
+    };
+    for mapping in mappings.iter_mut().filter_map(Value::as_table_mut) {
+        if let Some(Value::String(direction)) = mapping.get_mut("source_direction") {
+            let upgraded = match direction.to_lowercase().as_str() {
+                "up" | "left" | "negative" => "Negative",
+                "down" | "right" | "positive" => "Positive",
+                // Left for loading to reject with the usual error
+                _ => continue,
+            };
+            *direction = upgraded.to_string();
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn table(toml: &str) -> Table {
+        toml::from_str(toml).unwrap()
+    }
+
+    #[test]
+    fn test_unversioned_profile_is_upgraded() {
+        let mut profile = table(
+            r#"
+[[mappings]]
+source_name = "DPad Y"
+source_direction = "up"
+
+[[mappings]]
+source_name = "DPad X"
+source_direction = "Right"
+"#,
+        );
+
+        assert_eq!(migrate(&mut profile).unwrap(), 0);
+        assert_eq!(profile["schema_version"].as_integer(), Some(CURRENT_SCHEMA_VERSION as i64));
+        let directions: Vec<_> = profile["mappings"]
+            .as_array()
+            .unwrap()
+            .iter()
+            .map(|mapping| mapping["source_direction"].as_str().unwrap())
+            .collect();
+        assert_eq!(directions, ["Negative", "Positive"]);
+    }
+
+    #[test]
+    fn test_current_profile_is_untouched() {
+        let text = "schema_version = 1\n\n[[mappings]]\nsource_direction = \"Negative\"\n";
+        let mut profile = table(text);
+
+        assert_eq!(migrate(&mut profile).unwrap(), CURRENT_SCHEMA_VERSION);
+        assert_eq!(profile, table(text));
+    }
+
+    #[test]
+    fn test_unsupported_versions_are_rejected() {
+        let err = migrate(&mut table("schema_version = 99")).unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Profile schema version 99 is newer than this blazeremap supports (1); please upgrade"
+        );
+        assert!(migrate(&mut table("schema_version = -1")).is_err());
+        assert!(migrate(&mut table("schema_version = \"1\"")).is_err());
+    }
+}
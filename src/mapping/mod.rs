@@ -1,24 +1,46 @@
+pub mod bundle;
+pub mod context;
 pub mod engine;
+pub mod format;
+pub mod hotkey;
+pub mod integrity;
+pub mod layout;
+pub mod lint;
+pub mod migrate;
 pub mod profile;
+pub mod quick;
+pub mod reference;
 pub mod rules;
+pub mod script;
+pub mod table;
+pub mod teach;
+pub mod text;
 pub mod types;
+pub mod yaml;
 
 pub use engine::MappingEngine;
 pub use rules::MappingRule;
 pub use rules::MappingRule::AxisDirectionToKey;
 pub use rules::MappingRule::ButtonToKey;
+pub use table::RuleTable;
 
 use serde::Deserialize;
 use serde::Serialize;
 
-use crate::mapping::types::TargetType;
+use crate::{
+    mapping::{
+        context::Conditions,
+        types::{Flick, TargetType, TriggerOn},
+    },
+    output::identity::DeviceKind,
+};
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct Mapping {
     /// Source button name (for readability)
     pub source_name: String,
 
-    /// Source direction (up, right, left, down)
+    /// Source direction of axis mappings (Positive, Negative)
     #[serde(skip_serializing_if = "Option::is_none")]
     pub source_direction: Option<String>,
 
@@ -26,5 +48,76 @@ pub struct Mapping {
     pub target_type: TargetType, // "keyboard", "mouse", "gamepad"
 
     /// Target key name (for readability)
+    #[serde(default, skip_serializing_if = "String::is_empty")]
     pub target_name: String,
+
+    /// Virtual device to send to: the usual one for the target type, or a
+    /// custom device of the profile by name (keyboard, mouse and gamepad
+    /// targets)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub device: Option<String>,
+
+    /// Debounce window for this button, overriding the profile setting
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub debounce_ms: Option<u32>,
+
+    /// Keep the key held after release until the next button press is over
+    /// (button to keyboard mappings)
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub sticky: bool,
+
+    /// How long the key is held before it starts repeating (keyboard targets)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub repeat_delay_ms: Option<u32>,
+
+    /// Repeats per second once the key repeats (keyboard targets; 0 = off)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub repeat_rate: Option<u32>,
+
+    /// Free-form settings handed to the action (plugin targets)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub params: Option<serde_json::Value>,
+
+    /// Expression choosing the keys to press (script targets)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub script: Option<String>,
+
+    /// Program and arguments to run, without a shell (exec targets)
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub command: Vec<String>,
+
+    /// Press, release or both (exec targets; default press)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub on: Option<TriggerOn>,
+
+    /// Minimum time between two runs (exec targets)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rate_limit_ms: Option<u32>,
+
+    /// Button that must be held for the mapping to apply (mirror targets)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub layer: Option<String>,
+
+    /// Fire once per flick of a stick direction instead of while it's held
+    /// (keyboard, desktop, mouse and gamepad targets)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub flick: Option<Flick>,
+
+    /// Only apply while these hold (window, connection, battery)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub conditions: Option<Conditions>,
+}
+
+impl Mapping {
+    /// The custom device the mapping sends to, if its `device` names one
+    /// rather than a usual device
+    ///
+    /// Only keyboard, mouse and gamepad targets can be sent elsewhere, and
+    /// not by flick mappings.
+    pub fn custom_device(&self) -> Option<&str> {
+        if self.flick.is_some() || self.target_type.device_kind().is_none() {
+            return None;
+        }
+        self.device.as_deref().filter(|name| DeviceKind::from_name(name).is_none())
+    }
 }
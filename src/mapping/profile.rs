@@ -4,12 +4,52 @@ use serde::{Deserialize, Serialize};
 
 use crate::{
     event::{AxisCode, AxisDirection, ButtonCode, KeyboardCode},
-    mapping::{Mapping, types::TargetType},
+    input::gamepad::GamepadInfo,
+    mapping::{
+        Mapping,
+        format::ProfileFormat,
+        integrity::IntegrityPolicy,
+        migrate::{self, CURRENT_SCHEMA_VERSION},
+        text::KeyboardLayout,
+        types::{Cue, Notify, TargetType},
+    },
+    output::identity::DeviceIdentities,
 };
 
+/// Ids of the profiles `Profile::builtin` knows
+pub const BUILTIN_PROFILES: [&str; 7] = [
+    "default",
+    "steam-deck",
+    "one-handed-left",
+    "one-handed-right",
+    "southpaw",
+    "southpaw-dpad",
+    "desktop",
+];
+
+/// A profile file that couldn't be read or loaded; exits with a code of
+/// its own (see exit.rs)
+#[derive(Debug, thiserror::Error)]
+#[error("{message}")]
+pub struct ProfileError {
+    message: String,
+    #[source]
+    source: anyhow::Error,
+}
+
+impl ProfileError {
+    pub fn new(message: impl Into<String>, source: anyhow::Error) -> Self {
+        Self { message: message.into(), source }
+    }
+}
+
 /// Complete controller profile
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct Profile {
+    /// Format version; older files are upgraded when loaded
+    #[serde(default)]
+    pub schema_version: u32,
+
     pub name: String,
     pub description: String,
 
@@ -19,6 +59,151 @@ pub struct Profile {
 
     #[serde(default)]
     pub settings: ProfileSettings,
+
+    /// External action providers mappings can target by name
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub plugins: Vec<PluginSpec>,
+
+    /// Broker for `Mqtt` mappings
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub mqtt: Option<MqttSettings>,
+
+    /// Default destination for `Osc` mappings
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub osc: Option<OscSettings>,
+}
+
+/// An executable speaking the plugin protocol on stdin/stdout
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct PluginSpec {
+    pub name: String,
+    pub command: String,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub args: Vec<String>,
+}
+
+/// MQTT broker connection
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct MqttSettings {
+    /// host[:port], port defaulting to 1883
+    pub broker: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub client_id: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub username: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub password: Option<String>,
+}
+
+/// Where OSC messages go unless a mapping says otherwise
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct OscSettings {
+    /// host:port
+    pub to: String,
+}
+
+/// Where an analog trigger counts as its button being pressed
+///
+/// In normalized units, the same on every controller: 0 released to 1023
+/// fully pulled.
+/// The button goes down at `press` and up below `release`; a lower
+/// `release` keeps a trigger resting near `press` from chattering.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct TriggerThreshold {
+    pub press: i32,
+    /// Defaults to `press`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub release: Option<i32>,
+}
+
+impl TriggerThreshold {
+    pub fn release(&self) -> i32 {
+        self.release.unwrap_or(self.press)
+    }
+
+    /// Why the thresholds can't work, if they can't
+    pub fn problem(&self) -> Option<String> {
+        if self.press < 1 {
+            return Some(format!("press threshold {} must be at least 1", self.press));
+        }
+        let release = self.release();
+        (release < 1 || release > self.press).then(|| {
+            format!("release threshold {} must be between 1 and press ({})", release, self.press)
+        })
+    }
+}
+
+/// How pointer speed grows as desktop mode's stick is pushed further
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum PointerCurve {
+    /// In step with the stick
+    Linear,
+    /// Slow near center for small corrections, fast at the edge
+    #[default]
+    Quadratic,
+    /// Slower still near center, for fine aiming
+    Cubic,
+}
+
+impl PointerCurve {
+    /// Speed, from 0 to 1, for the stick pushed `amount` of the way out
+    pub fn apply(self, amount: f32) -> f32 {
+        match self {
+            Self::Linear => amount,
+            Self::Quadratic => amount.powi(2),
+            Self::Cubic => amount.powi(3),
+        }
+    }
+}
+
+/// How desktop mode's stick moves the pointer
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PointerSettings {
+    #[serde(default)]
+    pub curve: PointerCurve,
+
+    /// Button held to slow the pointer down for precise moves
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub precision_button: Option<String>,
+
+    /// Speed while the precision button is held, as a share of full speed
+    #[serde(default = "PointerSettings::default_precision_speed")]
+    pub precision_speed: f32,
+}
+
+impl PointerSettings {
+    fn default_precision_speed() -> f32 {
+        0.25
+    }
+
+    /// The precision button, if there's one and it's a button
+    pub fn precision_button(&self) -> Option<ButtonCode> {
+        let code = ButtonCode::from(self.precision_button.as_deref()?);
+        (code != ButtonCode::Unknown).then_some(code)
+    }
+
+    /// Why the settings can't work, if they can't
+    pub fn problem(&self) -> Option<String> {
+        if let Some(name) = &self.precision_button
+            && self.precision_button().is_none()
+        {
+            return Some(format!("precision_button '{}' is not a button", name));
+        }
+        (self.precision_speed <= 0.0 || self.precision_speed > 1.0).then(|| {
+            format!("precision_speed {} must be above 0 and at most 1", self.precision_speed)
+        })
+    }
+}
+
+impl Default for PointerSettings {
+    fn default() -> Self {
+        Self {
+            curve: PointerCurve::default(),
+            precision_button: None,
+            precision_speed: Self::default_precision_speed(),
+        }
+    }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -28,6 +213,72 @@ pub struct ProfileSettings {
 
     #[serde(default = "default_vibration_intensity")]
     pub vibration_intensity: u8, // 0-100
+
+    /// Ignore a press arriving this soon after a release (0 = off)
+    ///
+    /// Filters double-fire from worn buttons; mappings can override it.
+    #[serde(default)]
+    pub debounce_ms: u32,
+
+    /// Only count presses held at least this long (0 = off)
+    ///
+    /// Slow keys, for hand tremors: brief presses are dropped.
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub slow_keys_ms: u32,
+
+    /// Ignore a press this soon after a release, on every button (0 = off)
+    ///
+    /// Bounce keys, for hand tremors: a longer debounce that mappings can't
+    /// shorten.
+    #[serde(default, skip_serializing_if = "is_zero")]
+    pub bounce_keys_ms: u32,
+
+    /// Swap South with East and West with North before mapping, for
+    /// players used to the other controller family's A/B and X/Y
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub swap_ab_xy: bool,
+
+    /// Swap the left and right sticks and their clicks, for southpaw players
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub swap_sticks: bool,
+
+    /// Swap the D-pad with the left stick, after `swap_sticks`
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub swap_dpad: bool,
+
+    /// Read the left trigger's analog axis as its button, at these thresholds
+    ///
+    /// The controller's own trigger button is ignored then.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub left_trigger: Option<TriggerThreshold>,
+
+    /// Like `left_trigger`, for the right trigger
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub right_trigger: Option<TriggerThreshold>,
+
+    /// How to signal that a sticky mapping latched its key
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub sticky_cue: Vec<Cue>,
+
+    /// How to confirm a mirror layer or conditional mappings switching
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub switch_cue: Vec<Cue>,
+
+    /// What to send desktop notifications for
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub notify: Vec<Notify>,
+
+    /// Pointer curve and precision button for desktop mode
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pointer: Option<PointerSettings>,
+
+    /// The layout the desktop types with, for text mappings
+    #[serde(default, skip_serializing_if = "is_default")]
+    pub keyboard_layout: KeyboardLayout,
+
+    /// Names and IDs for the virtual devices, in place of BlazeRemap's own
+    #[serde(default, skip_serializing_if = "DeviceIdentities::is_empty")]
+    pub virtual_devices: DeviceIdentities,
 }
 
 fn default_vibration_enabled() -> bool {
@@ -36,12 +287,32 @@ fn default_vibration_enabled() -> bool {
 fn default_vibration_intensity() -> u8 {
     100
 }
+fn is_zero(value: &u32) -> bool {
+    *value == 0
+}
+fn is_default<T: Default + PartialEq>(value: &T) -> bool {
+    *value == T::default()
+}
 
 impl Default for ProfileSettings {
     fn default() -> Self {
         Self {
             vibration_enabled: default_vibration_enabled(),
             vibration_intensity: default_vibration_intensity(),
+            debounce_ms: 0,
+            slow_keys_ms: 0,
+            bounce_keys_ms: 0,
+            swap_ab_xy: false,
+            swap_sticks: false,
+            swap_dpad: false,
+            left_trigger: None,
+            right_trigger: None,
+            sticky_cue: Vec::new(),
+            switch_cue: Vec::new(),
+            notify: Vec::new(),
+            pointer: None,
+            keyboard_layout: KeyboardLayout::default(),
+            virtual_devices: DeviceIdentities::default(),
         }
     }
 }
@@ -50,6 +321,7 @@ impl Profile {
     /// Create a default profile (hardcoded mappings)
     pub fn default_profile() -> Self {
         Self {
+            schema_version: CURRENT_SCHEMA_VERSION,
             name: "Default".to_string(),
             description: "Default button mappings".to_string(),
             game_name: None,
@@ -59,36 +331,42 @@ impl Profile {
                     source_direction: None,
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::W.to_string(),
+                    ..Default::default()
                 },
                 Mapping {
                     source_name: ButtonCode::West.to_string(),
                     source_direction: None,
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::A.to_string(),
+                    ..Default::default()
                 },
                 Mapping {
                     source_name: ButtonCode::South.to_string(),
                     source_direction: None,
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::S.to_string(),
+                    ..Default::default()
                 },
                 Mapping {
                     source_name: ButtonCode::East.to_string(),
                     source_direction: None,
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::D.to_string(),
+                    ..Default::default()
                 },
                 Mapping {
                     source_name: ButtonCode::Select.to_string(),
                     source_direction: None,
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::Escape.to_string(),
+                    ..Default::default()
                 },
                 Mapping {
                     source_name: ButtonCode::Start.to_string(),
                     source_direction: None,
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::Enter.to_string(),
+                    ..Default::default()
                 },
                 //
                 Mapping {
@@ -96,48 +374,336 @@ impl Profile {
                     source_direction: Some(AxisDirection::Negative.to_string()),
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::Up.to_string(),
+                    ..Default::default()
                 },
                 Mapping {
                     source_name: AxisCode::DPadY.to_string(),
                     source_direction: Some(AxisDirection::Positive.to_string()),
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::Down.to_string(),
+                    ..Default::default()
                 },
                 Mapping {
                     source_name: AxisCode::DPadX.to_string(),
                     source_direction: Some(AxisDirection::Negative.to_string()),
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::Left.to_string(),
+                    ..Default::default()
                 },
                 Mapping {
                     source_name: AxisCode::DPadX.to_string(),
                     source_direction: Some(AxisDirection::Positive.to_string()),
                     target_type: TargetType::Keyboard,
                     target_name: KeyboardCode::Right.to_string(),
+                    ..Default::default()
                 },
             ],
             settings: ProfileSettings::default(),
+            plugins: Vec::new(),
+            mqtt: None,
+            osc: None,
+        }
+    }
+
+    /// Template for the Steam Deck's built-in controls
+    ///
+    /// Starts from the default mappings and adds the four back grips, which
+    /// are the reason most Deck users remap in the first place.
+    pub fn steam_deck_profile() -> Self {
+        let mut profile = Self::default_profile();
+        profile.name = "Steam Deck".to_string();
+        profile.description = "Default mappings plus L4/L5/R4/R5 back buttons".to_string();
+
+        let back_buttons = [
+            (ButtonCode::Paddle3, KeyboardCode::Q),         // L4
+            (ButtonCode::Paddle1, KeyboardCode::LeftShift), // L5
+            (ButtonCode::Paddle4, KeyboardCode::E),         // R4
+            (ButtonCode::Paddle2, KeyboardCode::Space),     // R5
+        ];
+        for (button, key) in back_buttons {
+            profile.mappings.push(Mapping {
+                source_name: button.to_string(),
+                source_direction: None,
+                target_type: TargetType::Keyboard,
+                target_name: key.to_string(),
+                ..Default::default()
+            });
+        }
+
+        profile
+    }
+
+    /// Default mappings for players with only the left hand free
+    ///
+    /// Holding Left Shoulder turns the left side into the right one: the
+    /// D-pad acts as the face buttons, the left stick as the right stick.
+    pub fn one_handed_left_profile() -> Self {
+        Self::one_handed(
+            "One-Handed (Left)",
+            ButtonCode::LeftShoulder,
+            [
+                (AxisCode::DPadY.to_string(), Some(AxisDirection::Negative), "North"),
+                (AxisCode::DPadX.to_string(), Some(AxisDirection::Negative), "West"),
+                (AxisCode::DPadY.to_string(), Some(AxisDirection::Positive), "South"),
+                (AxisCode::DPadX.to_string(), Some(AxisDirection::Positive), "East"),
+                (AxisCode::LeftX.to_string(), None, "Right X"),
+                (AxisCode::LeftY.to_string(), None, "Right Y"),
+                (ButtonCode::LeftTrigger.to_string(), None, "RightTrigger"),
+                (ButtonCode::LeftStick.to_string(), None, "RightStick"),
+                (ButtonCode::Select.to_string(), None, "Start"),
+            ],
+        )
+    }
+
+    /// Default mappings for players with only the right hand free
+    ///
+    /// Holding Right Shoulder turns the right side into the left one: the
+    /// face buttons act as the D-pad, the right stick as the left stick.
+    pub fn one_handed_right_profile() -> Self {
+        Self::one_handed(
+            "One-Handed (Right)",
+            ButtonCode::RightShoulder,
+            [
+                (ButtonCode::North.to_string(), None, "DPad Up"),
+                (ButtonCode::West.to_string(), None, "DPad Left"),
+                (ButtonCode::South.to_string(), None, "DPad Down"),
+                (ButtonCode::East.to_string(), None, "DPad Right"),
+                (AxisCode::RightX.to_string(), None, "Left X"),
+                (AxisCode::RightY.to_string(), None, "Left Y"),
+                (ButtonCode::RightTrigger.to_string(), None, "LeftTrigger"),
+                (ButtonCode::RightStick.to_string(), None, "LeftStick"),
+                (ButtonCode::Start.to_string(), None, "Select"),
+            ],
+        )
+    }
+
+    /// The default profile, with each source acting as its target while
+    /// `layer` is held
+    fn one_handed(
+        name: &str,
+        layer: ButtonCode,
+        mirrors: [(String, Option<AxisDirection>, &str); 9],
+    ) -> Self {
+        let mut profile = Self::default_profile();
+        // The layer button is busy being held
+        profile.mappings.retain(|mapping| ButtonCode::from(mapping.source_name.as_str()) != layer);
+        profile.name = name.to_string();
+        profile.description = format!("Default mappings; hold {} to mirror the controller", layer);
+        for (source, direction, target) in mirrors {
+            profile.mappings.push(Mapping {
+                source_name: source,
+                source_direction: direction.map(|direction| direction.to_string()),
+                target_type: TargetType::Mirror,
+                target_name: target.to_string(),
+                layer: Some(layer.to_string()),
+                ..Default::default()
+            });
+        }
+        profile
+    }
+
+    /// Default mappings for players who steer with the right stick
+    ///
+    /// With `dpad`, the D-pad also trades places with the (now right-hand)
+    /// left stick.
+    pub fn southpaw_profile(dpad: bool) -> Self {
+        let mut profile = Self::default_profile();
+        profile.settings.swap_sticks = true;
+        profile.settings.swap_dpad = dpad;
+        match dpad {
+            true => {
+                profile.name = "Southpaw (D-pad)".to_string();
+                profile.description =
+                    "Default mappings with the sticks swapped and the D-pad on the left stick"
+                        .to_string();
+            }
+            false => {
+                profile.name = "Southpaw".to_string();
+                profile.description = "Default mappings with the sticks swapped".to_string();
+            }
+        }
+        profile
+    }
+
+    /// Keys for getting around the desktop with the controller
+    ///
+    /// The mouse half of desktop mode is the sticks and triggers (see
+    /// `output::desktop`), so those stay unmapped, as do Select and Start,
+    /// which switch desktop mode by default.
+    pub fn desktop_profile() -> Self {
+        let mut profile = Self::default_profile();
+        profile.name = "Desktop".to_string();
+        profile.description =
+            "Keys for desktop mode; the sticks and triggers drive the mouse".to_string();
+        profile.mappings.retain(|mapping| mapping.source_direction.is_some());
+        let buttons = [
+            (ButtonCode::South, KeyboardCode::Enter),
+            (ButtonCode::East, KeyboardCode::Escape),
+            (ButtonCode::West, KeyboardCode::Backspace),
+            (ButtonCode::North, KeyboardCode::LeftMeta),
+            (ButtonCode::LeftShoulder, KeyboardCode::PageUp),
+            (ButtonCode::RightShoulder, KeyboardCode::PageDown),
+        ];
+        for (button, key) in buttons {
+            profile.mappings.push(Mapping {
+                source_name: button.to_string(),
+                source_direction: None,
+                target_type: TargetType::Keyboard,
+                target_name: key.to_string(),
+                ..Default::default()
+            });
         }
+        profile
     }
 
-    /// Save profile to TOML file
+    /// A built-in profile by id, as listed in `BUILTIN_PROFILES`
+    pub fn builtin(id: &str) -> Option<Self> {
+        match id {
+            "default" => Some(Self::default_profile()),
+            "steam-deck" => Some(Self::steam_deck_profile()),
+            "one-handed-left" => Some(Self::one_handed_left_profile()),
+            "one-handed-right" => Some(Self::one_handed_right_profile()),
+            "southpaw" => Some(Self::southpaw_profile(false)),
+            "southpaw-dpad" => Some(Self::southpaw_profile(true)),
+            "desktop" => Some(Self::desktop_profile()),
+            _ => None,
+        }
+    }
+
+    /// Skeleton for a connected controller: every button and D-pad direction
+    /// it has, each mapped to its own key
+    ///
+    /// Keys follow the default profile where it maps the control, so the
+    /// result is usable as is and obvious to edit.
+    pub fn for_device(info: &GamepadInfo) -> Self {
+        let key = |button| match button {
+            ButtonCode::North => KeyboardCode::W,
+            ButtonCode::West => KeyboardCode::A,
+            ButtonCode::South => KeyboardCode::S,
+            ButtonCode::East => KeyboardCode::D,
+            ButtonCode::Select => KeyboardCode::Escape,
+            ButtonCode::Start => KeyboardCode::Enter,
+            ButtonCode::LeftShoulder => KeyboardCode::Q,
+            ButtonCode::RightShoulder => KeyboardCode::E,
+            ButtonCode::LeftTrigger => KeyboardCode::Z,
+            ButtonCode::RightTrigger => KeyboardCode::X,
+            ButtonCode::LeftStick => KeyboardCode::LeftShift,
+            ButtonCode::RightStick => KeyboardCode::V,
+            ButtonCode::Mode => KeyboardCode::F1,
+            ButtonCode::Paddle1 => KeyboardCode::Num1,
+            ButtonCode::Paddle2 => KeyboardCode::Num2,
+            ButtonCode::Paddle3 => KeyboardCode::Num3,
+            ButtonCode::Paddle4 => KeyboardCode::Num4,
+            ButtonCode::LeftPad => KeyboardCode::F2,
+            ButtonCode::RightPad => KeyboardCode::F3,
+            _ => KeyboardCode::Unknown,
+        };
+        let mut mappings: Vec<_> = info
+            .buttons()
+            .into_iter()
+            .filter(|&button| key(button) != KeyboardCode::Unknown)
+            .map(|button| Mapping {
+                source_name: button.to_string(),
+                source_direction: None,
+                target_type: TargetType::Keyboard,
+                target_name: key(button).to_string(),
+                ..Default::default()
+            })
+            .collect();
+        // The D-pad as in the default profile
+        let defaults = Self::default_profile().mappings;
+        mappings.extend(defaults.into_iter().filter(|mapping| mapping.source_direction.is_some()));
+
+        Self {
+            name: info.name.clone(),
+            description: format!("Every control of a {} controller", info.gamepad_type),
+            mappings,
+            ..Self::default_profile()
+        }
+    }
+
+    /// Mappings that trigger actions, in the order action indexes refer to
+    pub fn action_mappings(&self) -> impl Iterator<Item = &Mapping> {
+        self.mappings.iter().filter(|mapping| mapping.target_type.is_action())
+    }
+
+    /// Save profile to a file, in the format its extension names
     pub fn save_to_file(&self, path: &std::path::Path) -> Result<()> {
-        let toml_string = toml::to_string_pretty(self).context("Failed to serialize profile")?;
+        let text = ProfileFormat::from_path(path)
+            .encode_profile(self)
+            .context("Failed to serialize profile")?;
 
-        std::fs::write(path, toml_string).context("Failed to write profile file")?;
+        std::fs::write(path, text).context("Failed to write profile file")?;
 
         Ok(())
     }
 
-    /// Load profile from TOML file
+    /// Load profile from a TOML, YAML or JSON file
+    ///
+    /// Profiles of an older schema version are upgraded in memory only; see
+    /// `upgrade_file` to update the file itself.
     pub fn load_from_file(path: &std::path::Path) -> Result<Self> {
-        let toml_string = std::fs::read_to_string(path).context("Failed to read profile file")?;
-
-        let profile: Profile =
-            toml::from_str(&toml_string).context("Failed to parse profile JSON")?;
+        Self::load_verified(path, &IntegrityPolicy::default())
+    }
 
+    /// Load a profile file, checking its seal according to `policy`
+    pub fn load_verified(path: &std::path::Path, policy: &IntegrityPolicy) -> Result<Self> {
+        let text = std::fs::read_to_string(path)
+            .map_err(|e| ProfileError::new("Failed to read profile file", e.into()))?;
+
+        let (profile, version) = Self::parse(&text, ProfileFormat::from_path(path), policy)
+            .map_err(|e| {
+                ProfileError::new(format!("Failed to load profile {}", path.display()), e)
+            })?;
+        if version < CURRENT_SCHEMA_VERSION {
+            tracing::info!(
+                "Upgraded {} from schema version {} in memory; run 'blazeremap profile upgrade' to update the file",
+                path.display(),
+                version
+            );
+        }
         Ok(profile)
     }
+
+    /// Parse a profile, upgrading it from older schema versions
+    pub fn decode(text: &str, format: ProfileFormat) -> Result<Self> {
+        Ok(Self::parse(text, format, &IntegrityPolicy::default())?.0)
+    }
+
+    /// Rewrite a profile file in the current schema version
+    ///
+    /// Returns the version the file had; a current file is left alone.
+    /// Otherwise the original is kept as `<file>.bak`, since rewriting drops
+    /// comments, formatting and any seal.
+    pub fn upgrade_file(path: &std::path::Path) -> Result<u32> {
+        let text = std::fs::read_to_string(path).context("Failed to read profile file")?;
+        let format = ProfileFormat::from_path(path);
+        let (profile, version) = Self::parse(&text, format, &IntegrityPolicy::default())?;
+        if version == CURRENT_SCHEMA_VERSION {
+            return Ok(version);
+        }
+
+        let mut backup = path.as_os_str().to_owned();
+        backup.push(".bak");
+        std::fs::write(&backup, &text).context("Failed to back up profile file")?;
+        profile.save_to_file(path)?;
+        Ok(version)
+    }
+
+    /// Returns the profile and the schema version it was written in
+    ///
+    /// Every format goes through the same TOML document, so they're
+    /// validated alike.
+    fn parse(text: &str, format: ProfileFormat, policy: &IntegrityPolicy) -> Result<(Self, u32)> {
+        let mut table = format.decode(text)?;
+        // The seal covers the file as written, before any upgrade
+        policy.apply(&table)?;
+        table.remove("integrity");
+        let version = migrate::migrate(&mut table)?;
+        let profile =
+            table.try_into().with_context(|| format!("Failed to parse profile {}", format))?;
+        Ok((profile, version))
+    }
 }
 
 #[cfg(test)]
@@ -151,12 +717,53 @@ mod tests {
         assert_eq!(profile.mappings.len(), 10); // Corrected mapping count
     }
 
+    #[test]
+    fn test_profile_for_device_maps_what_it_has() {
+        use crate::input::gamepad::{GamepadCapability, GamepadType};
+        use crate::mapping::lint;
+
+        let mut info = GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Xbox Wireless Controller".to_string(),
+            gamepad_type: GamepadType::XboxSeries,
+            vendor_id: 0x045e,
+            vendor_name: "Microsoft".to_string(),
+            product_id: 0x0b13,
+            uniq: None,
+            phys: None,
+            capabilities: vec![GamepadCapability::ForceFeedback],
+        };
+        let profile = Profile::for_device(&info);
+        assert_eq!(profile.name, "Xbox Wireless Controller");
+        assert_eq!(profile.mappings.len(), 13 + 4);
+        assert_eq!(lint::lint(&profile, Some(&info)), []);
+
+        info.capabilities.push(GamepadCapability::ElitePaddles);
+        let profile = Profile::for_device(&info);
+        let keys: Vec<_> = profile.mappings.iter().map(|m| m.target_name.as_str()).collect();
+        assert_eq!(profile.mappings.len(), 17 + 4);
+        assert!(keys.iter().all(|key| keys.iter().filter(|other| other == &key).count() == 1));
+        assert_eq!(lint::lint(&profile, Some(&info)), []);
+    }
+
+    #[test]
+    fn test_steam_deck_profile_maps_back_buttons() {
+        use crate::mapping::MappingEngine;
+
+        let profile = Profile::steam_deck_profile();
+        assert_eq!(profile.mappings.len(), 14);
+
+        // Every template mapping must be loadable by the engine
+        assert!(MappingEngine::load_from_profile(&profile).is_ok());
+    }
+
     #[test]
     fn test_profile_serialization() {
         let profile = Profile::default_profile();
         let toml_string = toml::to_string_pretty(&profile).unwrap();
 
-        let expected_toml = r#"name = "Default"
+        let expected_toml = r#"schema_version = 1
+name = "Default"
 description = "Default button mappings"
 
 [[mappings]]
@@ -216,6 +823,7 @@ target_name = "Right"
 [settings]
 vibration_enabled = true
 vibration_intensity = 100
+debounce_ms = 0
 "#;
 
         assert_eq!(toml_string, expected_toml);
@@ -235,6 +843,67 @@ vibration_intensity = 100
         assert_eq!(profile.mappings.len(), loaded.mappings.len());
     }
 
+    #[test]
+    fn test_profile_with_plugins() {
+        let profile: Profile = toml::from_str(
+            r#"name = "Living room"
+description = "Couch gaming with the lights down"
+
+[[mappings]]
+source_name = "Mode"
+target_type = "Plugin"
+target_name = "lights"
+params = { scene = "movie", brightness = 40 }
+
+[[plugins]]
+name = "lights"
+command = "/usr/local/bin/hue-plugin"
+args = ["--bridge", "192.168.1.20"]
+"#,
+        )
+        .unwrap();
+
+        assert_eq!(
+            profile.plugins,
+            [PluginSpec {
+                name: "lights".to_string(),
+                command: "/usr/local/bin/hue-plugin".to_string(),
+                args: vec!["--bridge".to_string(), "192.168.1.20".to_string()],
+            }]
+        );
+        let action = profile.action_mappings().next().unwrap();
+        assert_eq!(action.params, Some(serde_json::json!({ "scene": "movie", "brightness": 40 })));
+    }
+
+    #[test]
+    fn test_upgrade_file_keeps_backup() {
+        let path =
+            std::env::temp_dir().join(format!("blazeremap-upgrade-{}.toml", std::process::id()));
+        let backup = path.with_extension("toml.bak");
+        let old = r#"name = "Old"
+description = "Written before schema versions"
+
+[[mappings]]
+source_name = "DPad Y"
+source_direction = "up"
+target_type = "Keyboard"
+target_name = "W"
+"#;
+        std::fs::write(&path, old).unwrap();
+
+        assert_eq!(Profile::upgrade_file(&path).unwrap(), 0);
+        let upgraded = Profile::load_from_file(&path).unwrap();
+        assert_eq!(upgraded.schema_version, CURRENT_SCHEMA_VERSION);
+        assert_eq!(upgraded.mappings[0].source_direction.as_deref(), Some("Negative"));
+        assert_eq!(std::fs::read_to_string(&backup).unwrap(), old);
+
+        // Already current: nothing to do
+        std::fs::remove_file(&backup).unwrap();
+        assert_eq!(Profile::upgrade_file(&path).unwrap(), CURRENT_SCHEMA_VERSION);
+        assert!(!backup.exists());
+        std::fs::remove_file(path).unwrap();
+    }
+
     #[test]
     fn test_profile_save_load() {
         use std::path::PathBuf;
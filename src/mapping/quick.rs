@@ -0,0 +1,386 @@
+// Quick mappings - a profile made from command line binds
+//
+// `blazeremap map --bind SOURCE=TARGET` remaps without a profile file, for
+// trying something out. Controls go by their evdev names (BTN_SOUTH,
+// BTN_DPAD_UP, ABS_RX, KEY_SPACE, BTN_LEFT) or as profiles name them (South,
+// DPad Up, Right X, Space); case doesn't matter.
+//
+// Buttons and D-pad directions press keys, mouse buttons or a wheel notch
+// (wheel-up, wheel-down, wheel-left, wheel-right), as a profile mapping
+// would. Profiles leave the pointer to desktop mode, so a stick axis bound
+// to mouse-x, mouse-y, wheel-x or wheel-y is handed to it instead (see
+// output/desktop.rs).
+
+use std::str::FromStr;
+
+use anyhow::{Result, bail};
+
+use crate::event::{AxisCode, AxisDirection, ButtonCode, KeyboardCode};
+use crate::mapping::{Mapping, profile::Profile, types::TargetType};
+use crate::output::desktop::MouseControls;
+
+/// A control that can be bound
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum BindSource {
+    Button(ButtonCode),
+    /// A D-pad direction
+    DPad(AxisCode, AxisDirection),
+    /// A stick axis, whole
+    Stick(AxisCode),
+}
+
+/// What a control can be bound to
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum BindTarget {
+    Key(KeyboardCode),
+    /// A mouse button or wheel notch, by its profile name
+    Mouse(&'static str),
+    /// The pointer or the wheel: 0 and 1 move the pointer across and down,
+    /// 2 and 3 turn the wheel across and down
+    MouseAxis(usize),
+}
+
+/// One `SOURCE=TARGET` bind
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Bind {
+    pub source: BindSource,
+    pub target: BindTarget,
+}
+
+/// Evdev names of the gamepad buttons
+const BUTTONS: [(&str, ButtonCode); 21] = [
+    ("BTN_SOUTH", ButtonCode::South),
+    ("BTN_A", ButtonCode::South),
+    ("BTN_EAST", ButtonCode::East),
+    ("BTN_B", ButtonCode::East),
+    // The kernel names North X and West Y, whatever the labels say
+    ("BTN_NORTH", ButtonCode::North),
+    ("BTN_X", ButtonCode::North),
+    ("BTN_WEST", ButtonCode::West),
+    ("BTN_Y", ButtonCode::West),
+    ("BTN_TL", ButtonCode::LeftShoulder),
+    ("BTN_TR", ButtonCode::RightShoulder),
+    ("BTN_TL2", ButtonCode::LeftTrigger),
+    ("BTN_TR2", ButtonCode::RightTrigger),
+    ("BTN_SELECT", ButtonCode::Select),
+    ("BTN_START", ButtonCode::Start),
+    ("BTN_MODE", ButtonCode::Mode),
+    ("BTN_THUMBL", ButtonCode::LeftStick),
+    ("BTN_THUMBR", ButtonCode::RightStick),
+    ("BTN_TRIGGER_HAPPY1", ButtonCode::Paddle1),
+    ("BTN_TRIGGER_HAPPY2", ButtonCode::Paddle2),
+    ("BTN_TRIGGER_HAPPY3", ButtonCode::Paddle3),
+    ("BTN_TRIGGER_HAPPY4", ButtonCode::Paddle4),
+];
+
+/// Evdev names of the D-pad directions
+const DPAD: [(&str, AxisCode, AxisDirection); 4] = [
+    ("BTN_DPAD_UP", AxisCode::DPadY, AxisDirection::Negative),
+    ("BTN_DPAD_DOWN", AxisCode::DPadY, AxisDirection::Positive),
+    ("BTN_DPAD_LEFT", AxisCode::DPadX, AxisDirection::Negative),
+    ("BTN_DPAD_RIGHT", AxisCode::DPadX, AxisDirection::Positive),
+];
+
+/// Evdev names of the axes; the triggers are bound as buttons
+const AXES: [(&str, AxisCode); 6] = [
+    ("ABS_X", AxisCode::LeftX),
+    ("ABS_Y", AxisCode::LeftY),
+    ("ABS_RX", AxisCode::RightX),
+    ("ABS_RY", AxisCode::RightY),
+    ("ABS_HAT0X", AxisCode::DPadX),
+    ("ABS_HAT0Y", AxisCode::DPadY),
+];
+
+/// Mouse buttons and wheel notches, by evdev name or our own
+const MOUSE: [(&str, &str); 14] = [
+    ("BTN_LEFT", "Left"),
+    ("BTN_RIGHT", "Right"),
+    ("BTN_MIDDLE", "Middle"),
+    ("BTN_SIDE", "Side"),
+    ("BTN_EXTRA", "Extra"),
+    ("MOUSE-LEFT", "Left"),
+    ("MOUSE-RIGHT", "Right"),
+    ("MOUSE-MIDDLE", "Middle"),
+    ("MOUSE-SIDE", "Side"),
+    ("MOUSE-EXTRA", "Extra"),
+    ("WHEEL-UP", "Wheel Up"),
+    ("WHEEL-DOWN", "Wheel Down"),
+    ("WHEEL-LEFT", "Wheel Left"),
+    ("WHEEL-RIGHT", "Wheel Right"),
+];
+
+/// The pointer and wheel axes, in `BindTarget::MouseAxis` order
+const MOUSE_AXES: [&str; 4] = ["MOUSE-X", "MOUSE-Y", "WHEEL-X", "WHEEL-Y"];
+
+/// Upper case without spaces or underscores, so "Left X" matches "LEFTX"
+/// and "KEY_LEFTMETA" matches "Left Meta"
+fn squeeze(name: &str) -> String {
+    name.chars().filter(|c| !matches!(c, ' ' | '_')).map(|c| c.to_ascii_uppercase()).collect()
+}
+
+fn parse_source(name: &str) -> Result<BindSource> {
+    let upper = name.trim().to_ascii_uppercase();
+    if let Some(&(_, code)) = BUTTONS.iter().find(|(evdev, _)| *evdev == upper) {
+        return Ok(BindSource::Button(code));
+    }
+    if let Some(&(_, axis, direction)) = DPAD.iter().find(|(evdev, ..)| *evdev == upper) {
+        return Ok(BindSource::DPad(axis, direction));
+    }
+    match upper.as_str() {
+        "ABS_Z" => return Ok(BindSource::Button(ButtonCode::LeftTrigger)),
+        "ABS_RZ" => return Ok(BindSource::Button(ButtonCode::RightTrigger)),
+        _ => {}
+    }
+    // ABS_HAT0Y- and DPad Y- are directions of the axis
+    let (axis_name, direction) = match upper.strip_suffix(['-', '+']) {
+        Some(rest) if upper.ends_with('-') => (rest, Some(AxisDirection::Negative)),
+        Some(rest) => (rest, Some(AxisDirection::Positive)),
+        None => (upper.as_str(), None),
+    };
+    let axis = match AXES.iter().find(|(evdev, _)| *evdev == axis_name) {
+        Some(&(_, axis)) => axis,
+        None => AxisCode::ALL
+            .into_iter()
+            .find(|&axis| {
+                axis != AxisCode::Unknown && squeeze(&axis.to_string()) == squeeze(axis_name)
+            })
+            .unwrap_or(AxisCode::Unknown),
+    };
+    let dpad = matches!(axis, AxisCode::DPadX | AxisCode::DPadY);
+    match (axis, direction) {
+        (AxisCode::Unknown, _) => {}
+        (axis, Some(direction)) if dpad => return Ok(BindSource::DPad(axis, direction)),
+        (_, None) if dpad => bail!("{} needs a direction, like {}- or {}+", name, name, name),
+        (AxisCode::LeftTrigger | AxisCode::RightTrigger, _) => {}
+        (axis, None) => return Ok(BindSource::Stick(axis)),
+        (_, Some(_)) => {
+            bail!("{} is a stick; bind it whole, to mouse-x, mouse-y, wheel-x or wheel-y", name)
+        }
+    }
+    // Profile names, like South, Left Trigger or DPad Up
+    let code = ButtonCode::ALL
+        .into_iter()
+        .find(|&code| code != ButtonCode::Unknown && squeeze(&code.to_string()) == squeeze(name));
+    if let Some(code) = code {
+        return Ok(BindSource::Button(code));
+    }
+    let dpad = [AxisCode::DPadX, AxisCode::DPadY].into_iter().flat_map(|axis| {
+        [AxisDirection::Negative, AxisDirection::Positive].map(|direction| (axis, direction))
+    });
+    for (axis, direction) in dpad {
+        let label = crate::event::axis_and_direction_to_string(axis, direction);
+        if squeeze(&label) == squeeze(name) {
+            return Ok(BindSource::DPad(axis, direction));
+        }
+    }
+    bail!("'{}' is not a controller button or axis, like BTN_SOUTH, BTN_DPAD_UP or ABS_RX", name)
+}
+
+fn parse_target(name: &str) -> Result<BindTarget> {
+    let upper = name.trim().to_ascii_uppercase();
+    if let Some(slot) = MOUSE_AXES.iter().position(|&axis| axis == upper) {
+        return Ok(BindTarget::MouseAxis(slot));
+    }
+    if let Some(&(_, target)) = MOUSE.iter().find(|(known, _)| *known == upper) {
+        return Ok(BindTarget::Mouse(target));
+    }
+    // Evdev key names squeeze to our names, but for a few
+    let key = upper.strip_prefix("KEY_").unwrap_or(&upper);
+    let key = match key {
+        "ESC" => "ESCAPE",
+        "LEFTCTRL" => "LEFTCONTROL",
+        "RIGHTCTRL" => "RIGHTCONTROL",
+        key => key,
+    };
+    let code = KeyboardCode::ALL.into_iter().find(|&code| {
+        code != KeyboardCode::Unknown
+            && (squeeze(&code.to_string()) == squeeze(key)
+                || squeeze(&format!("{:?}", code)) == squeeze(key))
+    });
+    match code {
+        Some(code) => Ok(BindTarget::Key(code)),
+        None => bail!(
+            "'{}' is not a key, mouse button or pointer axis, like KEY_SPACE, BTN_LEFT or mouse-x",
+            name
+        ),
+    }
+}
+
+impl std::fmt::Display for Bind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self.source {
+            BindSource::Button(code) => write!(f, "{}", code)?,
+            BindSource::DPad(axis, direction) => {
+                write!(f, "{}", crate::event::axis_and_direction_to_string(axis, direction))?
+            }
+            BindSource::Stick(axis) => write!(f, "{}", axis)?,
+        }
+        match self.target {
+            BindTarget::Key(code) => write!(f, " → {}", code),
+            BindTarget::Mouse(name) => write!(f, " → Mouse {}", name),
+            BindTarget::MouseAxis(slot) => {
+                let names = ["Pointer X", "Pointer Y", "Wheel X", "Wheel Y"];
+                write!(f, " → {}", names[slot])
+            }
+        }
+    }
+}
+
+impl FromStr for Bind {
+    type Err = anyhow::Error;
+
+    fn from_str(text: &str) -> Result<Self> {
+        let Some((source, target)) = text.split_once('=') else {
+            bail!("expected SOURCE=TARGET, like BTN_SOUTH=KEY_SPACE");
+        };
+        let bind = Self { source: parse_source(source)?, target: parse_target(target)? };
+        match bind {
+            Bind { source: BindSource::Stick(_), target: BindTarget::MouseAxis(_) } => Ok(bind),
+            Bind { source: BindSource::Stick(axis), .. } => {
+                bail!("{} is a stick; bind it to mouse-x, mouse-y, wheel-x or wheel-y", axis)
+            }
+            Bind { target: BindTarget::MouseAxis(_), .. } => {
+                bail!("{} is a button; only a stick axis can move the pointer", source.trim())
+            }
+            bind => Ok(bind),
+        }
+    }
+}
+
+/// A profile of binds, and the mouse axes for desktop mode to drive
+#[derive(Debug, Clone)]
+pub struct QuickMap {
+    pub profile: Profile,
+    /// None when nothing is bound to the pointer or the wheel
+    pub mouse: Option<MouseControls>,
+}
+
+impl QuickMap {
+    /// Later binds of a control win over earlier ones
+    pub fn new(binds: &[Bind]) -> Self {
+        let mut mappings: Vec<Mapping> = Vec::new();
+        let mut axes = [None; 4];
+        for bind in binds {
+            let (source_name, source_direction) = match bind.source {
+                BindSource::Button(code) => (code.to_string(), None),
+                BindSource::DPad(axis, direction) => {
+                    (axis.to_string(), Some(direction.to_string()))
+                }
+                BindSource::Stick(axis) => {
+                    if let BindTarget::MouseAxis(slot) = bind.target {
+                        // An axis drives one of the pointer or the wheel
+                        axes.iter_mut()
+                            .filter(|held| **held == Some(axis))
+                            .for_each(|held| *held = None);
+                        axes[slot] = Some(axis);
+                    }
+                    continue;
+                }
+            };
+            let (target_type, target_name) = match bind.target {
+                BindTarget::Key(code) => (TargetType::Keyboard, code.to_string()),
+                BindTarget::Mouse(name) => (TargetType::Mouse, name.to_string()),
+                BindTarget::MouseAxis(_) => continue,
+            };
+            mappings.retain(|mapping| {
+                (&mapping.source_name, &mapping.source_direction)
+                    != (&source_name, &source_direction)
+            });
+            mappings.push(Mapping {
+                source_name,
+                source_direction,
+                target_type,
+                target_name,
+                ..Default::default()
+            });
+        }
+        let mut profile = Profile::default_profile();
+        profile.name = "Quick map".to_string();
+        profile.description = "Mappings given on the command line".to_string();
+        profile.mappings = mappings;
+        let mouse = axes
+            .iter()
+            .any(Option::is_some)
+            .then(|| MouseControls::axes([axes[0], axes[1]], [axes[2], axes[3]]));
+        Self { profile, mouse }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn bind(text: &str) -> Bind {
+        text.parse().unwrap()
+    }
+
+    #[test]
+    fn test_parse_binds() {
+        assert_eq!(
+            bind("BTN_SOUTH=KEY_SPACE"),
+            Bind {
+                source: BindSource::Button(ButtonCode::South),
+                target: BindTarget::Key(KeyboardCode::Space),
+            }
+        );
+        assert_eq!(
+            bind("left shoulder=key_leftctrl").target,
+            BindTarget::Key(KeyboardCode::LeftControl)
+        );
+        assert_eq!(bind("BTN_TL=Page Up").target, BindTarget::Key(KeyboardCode::PageUp));
+        assert_eq!(bind("ABS_RZ=BTN_LEFT").source, BindSource::Button(ButtonCode::RightTrigger));
+        assert_eq!(bind("BTN_B=BTN_LEFT").target, BindTarget::Mouse("Left"));
+        assert_eq!(bind("North=wheel-up").target, BindTarget::Mouse("Wheel Up"));
+        assert_eq!(
+            bind("ABS_HAT0Y-=KEY_UP").source,
+            BindSource::DPad(AxisCode::DPadY, AxisDirection::Negative)
+        );
+        assert_eq!(bind("DPad Right=D").source, bind("BTN_DPAD_RIGHT=D").source);
+        assert_eq!(
+            bind("ABS_RX=mouse-x"),
+            Bind { source: BindSource::Stick(AxisCode::RightX), target: BindTarget::MouseAxis(0) }
+        );
+        assert_eq!(bind("Left Y=wheel-y").target, BindTarget::MouseAxis(3));
+        assert_eq!(bind("BTN_DPAD_UP=BTN_LEFT").to_string(), "DPad Up → Mouse Left");
+        assert_eq!(bind("ABS_RX=mouse-x").to_string(), "Right X → Pointer X");
+    }
+
+    #[test]
+    fn test_parse_rejects_what_cant_work() {
+        let error = |text: &str| text.parse::<Bind>().unwrap_err().to_string();
+        assert!(error("BTN_SOUTH").contains("SOURCE=TARGET"));
+        assert!(error("BTN_JUMP=KEY_SPACE").contains("not a controller button"));
+        assert!(error("BTN_SOUTH=KEY_WARP").contains("not a key"));
+        assert!(error("ABS_X=KEY_A").contains("bind it to mouse-x"));
+        assert!(error("ABS_X-=KEY_A").contains("bind it whole"));
+        assert!(error("ABS_HAT0X=KEY_A").contains("needs a direction"));
+        assert!(error("BTN_SOUTH=mouse-x").contains("only a stick axis"));
+    }
+
+    #[test]
+    fn test_quick_map() {
+        let binds = [
+            "BTN_SOUTH=KEY_A",
+            "BTN_SOUTH=KEY_SPACE",
+            "ABS_RX=mouse-x",
+            "ABS_RY=mouse-y",
+            "ABS_RX=wheel-x",
+        ];
+        let quick = QuickMap::new(&binds.map(bind));
+
+        let [mapping] = &quick.profile.mappings[..] else {
+            panic!("{:?}", quick.profile.mappings);
+        };
+        assert_eq!(
+            (mapping.source_name.as_str(), mapping.target_name.as_str()),
+            ("South", "Space")
+        );
+        // Rebinding Right X moved it from the pointer to the wheel
+        let controls =
+            MouseControls::axes([None, Some(AxisCode::RightY)], [Some(AxisCode::RightX), None]);
+        assert_eq!(quick.mouse, Some(controls));
+        assert!(crate::mapping::MappingEngine::load_from_profile(&quick.profile).is_ok());
+
+        assert_eq!(QuickMap::new(&[bind("BTN_SOUTH=KEY_A")]).mouse, None);
+    }
+}
@@ -0,0 +1,355 @@
+// Profile reference: every field a profile has, for `blazeremap gen docs`
+//
+// The fields of each table with their type and meaning, and the names the
+// fields take. The names come from the code; the field lists are checked
+// against the ones lint knows, so a field profiles gain without a line here
+// fails the tests.
+
+use crate::event::{AxisCode, ButtonCode};
+use crate::mapping::profile::PointerCurve;
+use crate::mapping::text::KeyboardLayout;
+use crate::mapping::types::{Cue, DesktopAction, DeviceTarget, Notify, TargetType};
+
+/// One field of a profile table
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Field {
+    pub name: &'static str,
+    /// Like "string", "integer" or "array of tables"
+    pub kind: &'static str,
+    pub meaning: &'static str,
+}
+
+/// A table of a profile, like `settings` or each of `mappings`
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Section {
+    /// Where the table is, like `settings.pointer`; empty for the top level
+    pub path: &'static str,
+    pub about: &'static str,
+    pub fields: &'static [Field],
+}
+
+const fn field(name: &'static str, kind: &'static str, meaning: &'static str) -> Field {
+    Field { name, kind, meaning }
+}
+
+pub const SECTIONS: [Section; 13] = [
+    Section {
+        path: "",
+        about: "The top level of the file.",
+        fields: &[
+            field(
+                "schema_version",
+                "integer",
+                "Format version; older files are upgraded when loaded",
+            ),
+            field("name", "string", "Shown when the profile loads and in `blazeremap status`"),
+            field("description", "string", "What the profile is for"),
+            field("game_name", "string", "Optional; the game it was made for"),
+            field("mappings", "array of tables", "What each control does; see `mappings`"),
+            field("settings", "table", "Optional; see `settings`"),
+            field(
+                "plugins",
+                "array of tables",
+                "Optional; external action providers, see `plugins`",
+            ),
+            field("mqtt", "table", "Optional; the broker for Mqtt mappings"),
+            field("osc", "table", "Optional; where Osc mappings send unless they say otherwise"),
+        ],
+    },
+    Section {
+        path: "mappings",
+        about: "One control, or one direction of an axis, and what it does. Only `source_name` \
+                and `target_type` are needed by every mapping.",
+        fields: &[
+            field("source_name", "string", "The control, like South, Left Shoulder or DPad Y"),
+            field(
+                "source_direction",
+                "string",
+                "Positive (down, right) or Negative (up, left), for axes",
+            ),
+            field("target_type", "string", "What kind of target; see target types below"),
+            field("target_name", "string", "The key, button, action or address, by target type"),
+            field(
+                "device",
+                "string",
+                "keyboard, mouse, gamepad or a custom device of the profile to send to",
+            ),
+            field("debounce_ms", "integer", "Debounce window for this button, over the setting"),
+            field(
+                "sticky",
+                "boolean",
+                "Keep the key held after release until the next press is over",
+            ),
+            field(
+                "repeat_delay_ms",
+                "integer",
+                "How long the key is held before it repeats (keyboard targets)",
+            ),
+            field(
+                "repeat_rate",
+                "integer",
+                "Repeats a second once the key repeats (keyboard targets; 0 = off)",
+            ),
+            field("params", "any", "Settings handed to the action (plugin targets)"),
+            field("script", "string", "Expression choosing the keys to press (script targets)"),
+            field(
+                "command",
+                "array of strings",
+                "Program and arguments to run, without a shell (exec targets)",
+            ),
+            field("on", "string", "press, release or both (exec targets; default press)"),
+            field("rate_limit_ms", "integer", "Minimum time between two runs (exec targets)"),
+            field(
+                "layer",
+                "string",
+                "Button that must be held for the mapping to apply (mirror targets)",
+            ),
+            field(
+                "flick",
+                "table",
+                "Fire once per flick of a stick direction; see `mappings.flick`",
+            ),
+            field("conditions", "table", "Only apply while these hold; see `mappings.conditions`"),
+        ],
+    },
+    Section {
+        path: "mappings.flick",
+        about: "A stick direction pressing once per flick instead of while held.",
+        fields: &[
+            field(
+                "threshold",
+                "integer",
+                "How far the stick has to go, 0 at rest to 32767 (default 20000)",
+            ),
+            field("cooldown_ms", "integer", "Time before the same axis can flick again"),
+        ],
+    },
+    Section {
+        path: "mappings.conditions",
+        about: "When the mapping applies; every condition set must hold.",
+        fields: &[
+            field("window", "string", "Part of the focused window's title, any case"),
+            field("bluetooth", "boolean", "Connected over Bluetooth (true) or not (false)"),
+            field("battery_below", "integer", "Battery charge below this percentage"),
+        ],
+    },
+    Section {
+        path: "settings",
+        about: "How the whole controller is read. Every field is optional.",
+        fields: &[
+            field("vibration_enabled", "boolean", "Whether rumble cues are felt (default true)"),
+            field("vibration_intensity", "integer", "Rumble strength, 0 to 100 (default 100)"),
+            field("debounce_ms", "integer", "Ignore a press this soon after a release (0 = off)"),
+            field(
+                "slow_keys_ms",
+                "integer",
+                "Only count presses held at least this long (0 = off)",
+            ),
+            field(
+                "bounce_keys_ms",
+                "integer",
+                "A debounce on every button that mappings can't shorten (0 = off)",
+            ),
+            field(
+                "swap_ab_xy",
+                "boolean",
+                "Swap South with East and West with North before mapping",
+            ),
+            field(
+                "swap_sticks",
+                "boolean",
+                "Swap the sticks and their clicks, for southpaw players",
+            ),
+            field("swap_dpad", "boolean", "Swap the D-pad with the left stick, after swap_sticks"),
+            field("left_trigger", "table", "Read the left trigger's axis as its button; see below"),
+            field("right_trigger", "table", "Like left_trigger, for the right trigger"),
+            field("sticky_cue", "array of strings", "Cues for a sticky mapping latching its key"),
+            field(
+                "switch_cue",
+                "array of strings",
+                "Cues for a layer or conditional mappings switching",
+            ),
+            field("notify", "array of strings", "What to send desktop notifications for"),
+            field("pointer", "table", "Pointer curve and precision button for desktop mode"),
+            field(
+                "keyboard_layout",
+                "string",
+                "The layout the desktop types with, for text mappings",
+            ),
+            field("virtual_devices", "table", "Names and IDs for the virtual devices"),
+        ],
+    },
+    Section {
+        path: "settings.left_trigger, settings.right_trigger",
+        about: "Where the analog trigger counts as pressed, from 0 released to 1023 fully \
+                pulled.",
+        fields: &[
+            field("press", "integer", "The button goes down here"),
+            field("release", "integer", "And up below here (default press)"),
+        ],
+    },
+    Section {
+        path: "settings.pointer",
+        about: "How desktop mode moves the pointer.",
+        fields: &[
+            field("curve", "string", "How the pointer speeds up as the stick is pushed"),
+            field("precision_button", "string", "Button held to slow the pointer down"),
+            field(
+                "precision_speed",
+                "number",
+                "Speed while it's held, as a share of full speed (default 0.25)",
+            ),
+        ],
+    },
+    Section {
+        path: "settings.virtual_devices",
+        about: "What the virtual devices present themselves as.",
+        fields: &[
+            field("keyboard", "table", "The virtual keyboard's identity"),
+            field("mouse", "table", "The virtual mouse's identity"),
+            field("gamepad", "table", "The virtual gamepad's identity"),
+            field(
+                "custom",
+                "table of tables",
+                "More devices by name, for mappings' device to send to",
+            ),
+        ],
+    },
+    Section {
+        path: "settings.virtual_devices.keyboard, .mouse, .gamepad",
+        about: "Parts of a device's identity to change; the rest stays BlazeRemap's.",
+        fields: &[
+            field("name", "string", "Device name"),
+            field("vendor_id", "integer", "USB vendor ID"),
+            field("product_id", "integer", "USB product ID"),
+            field("version", "integer", "Version number"),
+        ],
+    },
+    Section {
+        path: "settings.virtual_devices.custom.NAME",
+        about: "A device of the profile's own, which mappings send to with `device = \"NAME\"`.",
+        fields: &[
+            field("kind", "string", "keyboard, mouse or gamepad"),
+            field("name", "string", "Device name (default BlazeRemap NAME)"),
+            field("vendor_id", "integer", "USB vendor ID"),
+            field("product_id", "integer", "USB product ID"),
+            field("version", "integer", "Version number"),
+        ],
+    },
+    Section {
+        path: "plugins",
+        about: "An executable speaking the plugin protocol on stdin and stdout.",
+        fields: &[
+            field("name", "string", "What plugin mappings call it in target_name"),
+            field("command", "string", "The program"),
+            field("args", "array of strings", "Its arguments"),
+        ],
+    },
+    Section {
+        path: "mqtt",
+        about: "The MQTT broker Mqtt mappings publish to.",
+        fields: &[
+            field("broker", "string", "host[:port], the port defaulting to 1883"),
+            field("client_id", "string", "Optional"),
+            field("username", "string", "Optional"),
+            field("password", "string", "Optional"),
+        ],
+    },
+    Section {
+        path: "osc",
+        about: "Where Osc mappings send by default.",
+        fields: &[field("to", "string", "host:port")],
+    },
+];
+
+/// What each target type does with `target_name`
+pub const TARGET_TYPES: [(TargetType, &str); 12] = [
+    (TargetType::Keyboard, "Presses the key, or keys joined with +, in target_name"),
+    (TargetType::Mouse, "Presses the mouse button or turns the wheel a notch"),
+    (TargetType::Gamepad, "Presses the virtual gamepad's button or direction"),
+    (TargetType::Plugin, "Runs the action of the plugin named in target_name"),
+    (TargetType::Script, "Presses the keys the mapping's script picks"),
+    (TargetType::Exec, "Runs the mapping's command"),
+    (TargetType::Mqtt, "Publishes to the MQTT topic in target_name"),
+    (TargetType::Osc, "Sends OSC messages to the address template in target_name"),
+    (TargetType::Mirror, "Makes the source act as the control named in target_name"),
+    (TargetType::Desktop, "A desktop or media operation, like Volume Up"),
+    (TargetType::Recenter, "Recenters the stick axes in target_name (both sticks if empty)"),
+    (TargetType::Text, "Types the text in target_name"),
+];
+
+/// The names each kind of value takes, like the buttons for source_name
+pub fn values() -> Vec<(&'static str, Vec<String>)> {
+    fn names<T: ToString>(items: impl IntoIterator<Item = T>) -> Vec<String> {
+        items.into_iter().map(|item| item.to_string()).collect()
+    }
+    fn serialized<T: serde::Serialize>(items: impl IntoIterator<Item = T>) -> Vec<String> {
+        items
+            .into_iter()
+            .map(|item| match serde_json::to_value(item) {
+                Ok(serde_json::Value::String(name)) => name,
+                other => format!("{:?}", other),
+            })
+            .collect()
+    }
+    let buttons = ButtonCode::ALL.into_iter().filter(|&code| code != ButtonCode::Unknown);
+    let axes = AxisCode::ALL.into_iter().filter(|&code| code != AxisCode::Unknown);
+    vec![
+        ("Buttons (source_name)", names(buttons)),
+        ("Axes (source_name)", names(axes)),
+        ("Mouse targets (target_name)", DeviceTarget::names(TargetType::Mouse)),
+        ("Desktop targets (target_name)", names(DesktopAction::ALL)),
+        ("Cues (sticky_cue, switch_cue)", serialized([Cue::Visual, Cue::Rumble, Cue::Sound])),
+        (
+            "Notifications (notify)",
+            serialized([Notify::ProfileSwitch, Notify::Connection, Notify::BatteryLow]),
+        ),
+        (
+            "Pointer curves (curve)",
+            serialized([PointerCurve::Linear, PointerCurve::Quadratic, PointerCurve::Cubic]),
+        ),
+        (
+            "Keyboard layouts (keyboard_layout)",
+            serialized([KeyboardLayout::Us, KeyboardLayout::Uk, KeyboardLayout::De]),
+        ),
+    ]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::mapping::lint;
+
+    fn fields(path: &str) -> Vec<&'static str> {
+        let section = SECTIONS.iter().find(|section| section.path == path).unwrap();
+        section.fields.iter().map(|field| field.name).collect()
+    }
+
+    #[test]
+    fn test_sections_list_the_fields_lint_knows() {
+        assert_eq!(fields(""), lint::PROFILE_FIELDS);
+        assert_eq!(fields("mappings"), lint::MAPPING_FIELDS);
+        assert_eq!(fields("mappings.flick"), lint::FLICK_FIELDS);
+        assert_eq!(fields("settings"), lint::SETTINGS_FIELDS);
+        assert_eq!(fields("settings.left_trigger, settings.right_trigger"), lint::TRIGGER_FIELDS);
+        assert_eq!(fields("settings.pointer"), lint::POINTER_FIELDS);
+        assert_eq!(fields("settings.virtual_devices"), lint::VIRTUAL_DEVICE_FIELDS);
+        assert_eq!(
+            fields("settings.virtual_devices.keyboard, .mouse, .gamepad"),
+            lint::IDENTITY_FIELDS
+        );
+        assert_eq!(fields("settings.virtual_devices.custom.NAME"), lint::CUSTOM_DEVICE_FIELDS);
+        assert_eq!(fields("plugins"), lint::PLUGIN_FIELDS);
+        assert_eq!(fields("mqtt"), lint::MQTT_FIELDS);
+        assert_eq!(fields("osc"), lint::OSC_FIELDS);
+    }
+
+    #[test]
+    fn test_every_target_type_is_described() {
+        let described: Vec<TargetType> = TARGET_TYPES.iter().map(|&(kind, _)| kind).collect();
+        assert_eq!(described, TargetType::ALL);
+        let values = values();
+        assert!(values[0].1.contains(&"Left Shoulder".to_string()));
+        assert_eq!(values[6].1, ["linear", "quadratic", "cubic"]);
+    }
+}
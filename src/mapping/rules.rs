@@ -1,14 +1,92 @@
+use std::sync::Arc;
+
 use thiserror::Error;
 
 use crate::{
-    event::{AxisCode, AxisDirection, ButtonCode, KeyboardCode},
-    mapping::Mapping,
+    event::{
+        ActionSource, AxisCode, AxisDirection, ButtonCode, KeyboardCode,
+        axis_and_direction_to_string,
+    },
+    mapping::{
+        Mapping,
+        text::{KeyboardLayout, Text},
+        types::{DesktopAction, DeviceTarget, Flick, FlickTarget, RoutedTarget, TargetType},
+    },
 };
 
 #[derive(Debug, Clone, PartialEq, Eq)]
 pub enum MappingRule {
-    ButtonToKey { source: ButtonCode, target: KeyboardCode },
-    AxisDirectionToKey { source: AxisCode, direction: AxisDirection, target: KeyboardCode },
+    ButtonToKey {
+        source: ButtonCode,
+        target: KeyboardCode,
+    },
+    AxisDirectionToKey {
+        source: AxisCode,
+        direction: AxisDirection,
+        target: KeyboardCode,
+    },
+    /// Presses a button or wheel of the virtual mouse, a control of the
+    /// virtual gamepad, or either or a key on a custom device
+    ButtonToDevice {
+        source: ButtonCode,
+        target: RoutedTarget,
+    },
+    AxisDirectionToDevice {
+        source: AxisCode,
+        direction: AxisDirection,
+        target: RoutedTarget,
+    },
+    /// `action` indexes the profile's action mappings
+    ButtonToAction {
+        source: ButtonCode,
+        action: usize,
+    },
+    AxisDirectionToAction {
+        source: AxisCode,
+        direction: AxisDirection,
+        action: usize,
+    },
+    /// Fires on every change of the axis
+    AxisToAction {
+        source: AxisCode,
+        action: usize,
+    },
+    /// `script` indexes the profile's script mappings
+    ButtonToScript {
+        source: ButtonCode,
+        script: usize,
+    },
+    AxisDirectionToScript {
+        source: AxisCode,
+        direction: AxisDirection,
+        script: usize,
+    },
+    /// Presses `target` once per flick of the stick, until it's back at rest
+    Flick {
+        source: AxisCode,
+        direction: AxisDirection,
+        flick: Flick,
+        target: FlickTarget,
+    },
+    /// Types `text` when the source is pressed
+    ButtonToText {
+        source: ButtonCode,
+        text: Text,
+    },
+    AxisDirectionToText {
+        source: AxisCode,
+        direction: AxisDirection,
+        text: Text,
+    },
+    /// `source` acts as `target` while `layer` is held (always without one)
+    ///
+    /// Buttons and D-pad directions stand in for each other; a whole axis
+    /// only for another axis.
+    Mirror {
+        source: ActionSource,
+        target: ActionSource,
+        layer: Option<ButtonCode>,
+    },
 }
 
 impl MappingRule {
@@ -23,6 +101,141 @@ impl MappingRule {
     ) -> Self {
         Self::AxisDirectionToKey { source, direction, target }
     }
+
+    /// Rule triggering action number `action` from an action mapping
+    ///
+    /// An axis without a direction triggers on every value change. Names
+    /// that are both (the triggers) mean the button.
+    pub fn action(mapping: &Mapping, action: usize) -> Result<Self, InvalidSourceDirectionError> {
+        let name = mapping.source_name.as_str();
+        Ok(match source_direction(mapping)? {
+            Some(direction) => {
+                Self::AxisDirectionToAction { source: AxisCode::from(name), direction, action }
+            }
+            None if ButtonCode::from(name) == ButtonCode::Unknown
+                && AxisCode::from(name) != AxisCode::Unknown =>
+            {
+                Self::AxisToAction { source: AxisCode::from(name), action }
+            }
+            None => Self::ButtonToAction { source: ButtonCode::from(name), action },
+        })
+    }
+
+    /// Rule pressing the mouse or gamepad control in a mapping's
+    /// `target_name`, or the key on a custom keyboard, on the device it
+    /// routes to; None if the device has no such control
+    pub fn device(mapping: &Mapping) -> Result<Option<Self>, InvalidSourceDirectionError> {
+        let target = match mapping.target_type {
+            TargetType::Keyboard => Some(KeyboardCode::from(mapping.target_name.as_str()))
+                .filter(|&code| code != KeyboardCode::Unknown)
+                .map(DeviceTarget::Key),
+            target_type => DeviceTarget::from_name(target_type, &mapping.target_name),
+        };
+        let Some(target) = target else {
+            return Ok(None);
+        };
+        let target = RoutedTarget { target, device: mapping.custom_device().map(Arc::from) };
+        let name = mapping.source_name.as_str();
+        Ok(Some(match source_direction(mapping)? {
+            Some(direction) => {
+                Self::AxisDirectionToDevice { source: AxisCode::from(name), direction, target }
+            }
+            None => Self::ButtonToDevice { source: ButtonCode::from(name), target },
+        }))
+    }
+
+    /// Rule for a mapping with `flick` set; None if its target can't be
+    /// flicked or there's no such target
+    pub fn flick(mapping: &Mapping) -> Result<Option<Self>, InvalidSourceDirectionError> {
+        let direction = source_direction(mapping)?.ok_or(InvalidSourceDirectionError)?;
+        let Some(target) = FlickTarget::from_name(mapping.target_type, &mapping.target_name) else {
+            return Ok(None);
+        };
+        Ok(Some(Self::Flick {
+            source: AxisCode::from(mapping.source_name.as_str()),
+            direction,
+            flick: mapping.flick.unwrap_or_default(),
+            target,
+        }))
+    }
+
+    /// Rule typing a text mapping's `target_name` on `layout`
+    pub fn text(mapping: &Mapping, layout: KeyboardLayout) -> anyhow::Result<Self> {
+        let text = Text::parse(&mapping.target_name, layout)?;
+        let name = mapping.source_name.as_str();
+        Ok(match source_direction(mapping)? {
+            Some(direction) => {
+                Self::AxisDirectionToText { source: AxisCode::from(name), direction, text }
+            }
+            None => Self::ButtonToText { source: ButtonCode::from(name), text },
+        })
+    }
+
+    /// Rule running script number `script` from a script mapping
+    pub fn script(mapping: &Mapping, script: usize) -> Result<Self, InvalidSourceDirectionError> {
+        Ok(match source_direction(mapping)? {
+            Some(direction) => Self::AxisDirectionToScript {
+                source: AxisCode::from(mapping.source_name.as_str()),
+                direction,
+                script,
+            },
+            None => Self::ButtonToScript {
+                source: ButtonCode::from(mapping.source_name.as_str()),
+                script,
+            },
+        })
+    }
+
+    /// Rule making the source act as the control in `target_name`
+    ///
+    /// None if either isn't a control, the two can't stand in for each
+    /// other, or the layer isn't a button.
+    pub fn mirror(mapping: &Mapping) -> Option<Self> {
+        let name = mapping.source_name.as_str();
+        let source = match source_direction(mapping).ok()? {
+            Some(direction) => ActionSource::Axis(AxisCode::from(name), direction),
+            None if ButtonCode::from(name) != ButtonCode::Unknown => {
+                ActionSource::Button(ButtonCode::from(name))
+            }
+            None => ActionSource::AxisValue(AxisCode::from(name)),
+        };
+        let target = mirror_target(&mapping.target_name);
+        let presses = |control| match control {
+            ActionSource::Button(code) => code != ButtonCode::Unknown,
+            ActionSource::Axis(code, _) => matches!(code, AxisCode::DPadX | AxisCode::DPadY),
+            ActionSource::AxisValue(_) => false,
+        };
+        let valid = match (source, target) {
+            (ActionSource::AxisValue(source), ActionSource::AxisValue(target)) => {
+                source != AxisCode::Unknown && target != AxisCode::Unknown
+            }
+            (source, target) => presses(source) && presses(target),
+        };
+        let layer = match mapping.layer.as_deref().map(ButtonCode::from) {
+            Some(ButtonCode::Unknown) => return None,
+            layer => layer,
+        };
+        // The layer button itself can't be redirected by its own layer
+        let valid = valid
+            && source != target
+            && layer.is_none_or(|layer| source != ActionSource::Button(layer));
+        valid.then_some(Self::Mirror { source, target, layer })
+    }
+}
+
+/// A button, a D-pad direction like "DPad Up", or an axis
+fn mirror_target(name: &str) -> ActionSource {
+    if ButtonCode::from(name) != ButtonCode::Unknown {
+        return ActionSource::Button(ButtonCode::from(name));
+    }
+    for code in [AxisCode::DPadX, AxisCode::DPadY] {
+        for direction in [AxisDirection::Negative, AxisDirection::Positive] {
+            if axis_and_direction_to_string(code, direction) == name {
+                return ActionSource::Axis(code, direction);
+            }
+        }
+    }
+    ActionSource::AxisValue(AxisCode::from(name))
 }
 
 #[derive(Error, Debug)]
@@ -32,27 +245,38 @@ pub struct InvalidSourceDirectionError;
 impl TryFrom<&Mapping> for MappingRule {
     type Error = InvalidSourceDirectionError;
     fn try_from(mapping: &Mapping) -> Result<Self, Self::Error> {
-        if mapping.source_direction.is_some() {
-            let direction = match mapping.source_direction.as_deref().unwrap_or_default() {
-                "Positive" => AxisDirection::Positive,
-                "Negative" => AxisDirection::Negative,
-                _ => return Err(InvalidSourceDirectionError),
-            };
-
+        let target = match mapping.target_type {
+            TargetType::Desktop => DesktopAction::from_name(&mapping.target_name)
+                .map_or(KeyboardCode::Unknown, DesktopAction::key),
+            _ => KeyboardCode::from(mapping.target_name.as_str()),
+        };
+        if let Some(direction) = source_direction(mapping)? {
             Ok(MappingRule::AxisDirectionToKey {
                 source: AxisCode::from(mapping.source_name.as_str()),
                 direction,
-                target: KeyboardCode::from(mapping.target_name.as_str()),
+                target,
             })
         } else {
             Ok(MappingRule::ButtonToKey {
                 source: ButtonCode::from(mapping.source_name.as_str()),
-                target: KeyboardCode::from(mapping.target_name.as_str()),
+                target,
             })
         }
     }
 }
 
+/// Direction of an axis mapping; None for button mappings
+fn source_direction(
+    mapping: &Mapping,
+) -> Result<Option<AxisDirection>, InvalidSourceDirectionError> {
+    match mapping.source_direction.as_deref() {
+        None => Ok(None),
+        Some("Positive") => Ok(Some(AxisDirection::Positive)),
+        Some("Negative") => Ok(Some(AxisDirection::Negative)),
+        Some(_) => Err(InvalidSourceDirectionError),
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use crate::mapping::{MappingRule::AxisDirectionToKey, rules::MappingRule::ButtonToKey};
@@ -93,4 +317,22 @@ mod tests {
         assert_eq!(rule1, rule2);
         assert_ne!(rule1, rule3);
     }
+
+    #[test]
+    fn test_desktop_mapping_sends_its_media_key() {
+        let mapping = Mapping {
+            source_name: "Select".to_string(),
+            target_type: TargetType::Desktop,
+            target_name: "play pause".to_string(),
+            ..Default::default()
+        };
+        assert_eq!(
+            MappingRule::try_from(&mapping).unwrap(),
+            ButtonToKey { source: ButtonCode::Select, target: KeyboardCode::PlayPause }
+        );
+        for action in DesktopAction::ALL {
+            assert_eq!(DesktopAction::from_name(&action.to_string()), Some(action));
+        }
+        assert_eq!(DesktopAction::from_name("Volume"), None);
+    }
 }
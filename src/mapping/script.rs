@@ -0,0 +1,555 @@
+// Expression scripts for conditional mappings
+//
+// A `Script` mapping's body is a small expression evaluated when its source
+// is pressed (or its axis direction engaged). It sees the triggering event
+// and the controller state, and yields the keys to hold:
+//
+//   if axis("Left Y") < -16000 then ["Left Shift", "W"] else "W"
+//
+// Values are integers, booleans, key names and `none`. Inputs:
+//   value             the triggering event's value (1 for buttons)
+//   button("East")    whether another button is held
+//   axis("Left X")    another axis' current value
+// The keys yielded are pressed right away and released with the source.
+// Names are resolved when the profile loads, so typos fail the load rather
+// than the first press, and evaluation never allocates.
+
+use thiserror::Error;
+
+use crate::event::{AxisCode, ButtonCode, KeyboardCode};
+
+/// A script that failed to parse
+#[derive(Error, Debug, Clone, PartialEq, Eq)]
+#[error("{message} at column {column}")]
+pub struct ScriptError {
+    pub message: String,
+    pub column: usize,
+}
+
+/// Controller state a script is evaluated against
+pub struct ScriptInput<'a> {
+    /// Value of the triggering event
+    pub value: i32,
+    /// Held state per `ButtonCode::index`
+    pub buttons: &'a [bool],
+    /// Current value per `AxisCode::index`
+    pub axes: &'a [i32],
+}
+
+/// A parsed script, ready to evaluate
+#[derive(Debug, Clone, PartialEq)]
+pub struct Script {
+    body: Expr,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Value {
+    None,
+    Bool(bool),
+    Int(i64),
+    Key(KeyboardCode),
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum BinOp {
+    Add,
+    Sub,
+    Mul,
+    Div,
+    Rem,
+    Eq,
+    Ne,
+    Lt,
+    Le,
+    Gt,
+    Ge,
+    And,
+    Or,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Expr {
+    Literal(Value),
+    EventValue,
+    Button(ButtonCode),
+    Axis(AxisCode),
+    List(Vec<Expr>),
+    Not(Box<Expr>),
+    Neg(Box<Expr>),
+    Binary(BinOp, Box<Expr>, Box<Expr>),
+    If(Box<Expr>, Box<Expr>, Box<Expr>),
+}
+
+impl Script {
+    pub fn parse(source: &str) -> Result<Self, ScriptError> {
+        let tokens = tokenize(source)?;
+        let mut parser = Parser { tokens, pos: 0, end: source.chars().count() + 1 };
+        let body = parser.expr()?;
+        if let Some(token) = parser.tokens.get(parser.pos) {
+            return Err(parser.error_at(token.column, "unexpected input after the expression"));
+        }
+        Ok(Self { body })
+    }
+
+    /// Append the keys the script yields for `input` to `keys`
+    ///
+    /// Fails on type errors such as comparing a key with a number; `keys`
+    /// may then hold part of the result.
+    pub fn eval_keys(
+        &self,
+        input: &ScriptInput,
+        keys: &mut Vec<KeyboardCode>,
+    ) -> Result<(), &'static str> {
+        emit(&self.body, input, keys)
+    }
+}
+
+fn emit(
+    expr: &Expr,
+    input: &ScriptInput,
+    keys: &mut Vec<KeyboardCode>,
+) -> Result<(), &'static str> {
+    match expr {
+        Expr::If(condition, then, otherwise) => {
+            if eval_bool(condition, input)? {
+                emit(then, input, keys)
+            } else {
+                emit(otherwise, input, keys)
+            }
+        }
+        Expr::List(items) => items.iter().try_for_each(|item| emit(item, input, keys)),
+        other => match eval(other, input)? {
+            Value::Key(key) => {
+                keys.push(key);
+                Ok(())
+            }
+            Value::None => Ok(()),
+            _ => Err("script must yield key names or none"),
+        },
+    }
+}
+
+fn eval_bool(expr: &Expr, input: &ScriptInput) -> Result<bool, &'static str> {
+    match eval(expr, input)? {
+        Value::Bool(b) => Ok(b),
+        _ => Err("expected true or false"),
+    }
+}
+
+fn eval_int(expr: &Expr, input: &ScriptInput) -> Result<i64, &'static str> {
+    match eval(expr, input)? {
+        Value::Int(n) => Ok(n),
+        _ => Err("expected a number"),
+    }
+}
+
+fn eval(expr: &Expr, input: &ScriptInput) -> Result<Value, &'static str> {
+    Ok(match expr {
+        Expr::Literal(value) => *value,
+        Expr::EventValue => Value::Int(input.value as i64),
+        Expr::Button(code) => {
+            Value::Bool(input.buttons.get(code.index()).copied().unwrap_or(false))
+        }
+        Expr::Axis(code) => Value::Int(input.axes.get(code.index()).copied().unwrap_or(0) as i64),
+        Expr::List(_) => return Err("a list can only be the script's result"),
+        Expr::Not(inner) => Value::Bool(!eval_bool(inner, input)?),
+        Expr::Neg(inner) => Value::Int(eval_int(inner, input)?.checked_neg().ok_or("overflow")?),
+        Expr::If(condition, then, otherwise) => {
+            if eval_bool(condition, input)? {
+                eval(then, input)?
+            } else {
+                eval(otherwise, input)?
+            }
+        }
+        Expr::Binary(BinOp::And, lhs, rhs) => {
+            Value::Bool(eval_bool(lhs, input)? && eval_bool(rhs, input)?)
+        }
+        Expr::Binary(BinOp::Or, lhs, rhs) => {
+            Value::Bool(eval_bool(lhs, input)? || eval_bool(rhs, input)?)
+        }
+        Expr::Binary(BinOp::Eq, lhs, rhs) => Value::Bool(eval(lhs, input)? == eval(rhs, input)?),
+        Expr::Binary(BinOp::Ne, lhs, rhs) => Value::Bool(eval(lhs, input)? != eval(rhs, input)?),
+        Expr::Binary(op, lhs, rhs) => {
+            let (a, b) = (eval_int(lhs, input)?, eval_int(rhs, input)?);
+            match op {
+                BinOp::Add => Value::Int(a.checked_add(b).ok_or("overflow")?),
+                BinOp::Sub => Value::Int(a.checked_sub(b).ok_or("overflow")?),
+                BinOp::Mul => Value::Int(a.checked_mul(b).ok_or("overflow")?),
+                BinOp::Div => Value::Int(a.checked_div(b).ok_or("division by zero")?),
+                BinOp::Rem => Value::Int(a.checked_rem(b).ok_or("division by zero")?),
+                BinOp::Lt => Value::Bool(a < b),
+                BinOp::Le => Value::Bool(a <= b),
+                BinOp::Gt => Value::Bool(a > b),
+                BinOp::Ge => Value::Bool(a >= b),
+                BinOp::Eq | BinOp::Ne | BinOp::And | BinOp::Or => unreachable!(),
+            }
+        }
+    })
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum TokenKind {
+    Int(i64),
+    Str(String),
+    Ident(String),
+    Symbol(&'static str),
+}
+
+#[derive(Debug, Clone)]
+struct Token {
+    kind: TokenKind,
+    /// 1-based, in characters
+    column: usize,
+}
+
+// Longest first so `<=` isn't read as `<`
+const SYMBOLS: [&str; 16] =
+    ["==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "(", ")", "[", "]", ","];
+
+fn tokenize(source: &str) -> Result<Vec<Token>, ScriptError> {
+    let chars: Vec<char> = source.chars().collect();
+    let mut tokens = Vec::new();
+    let mut i = 0;
+
+    while i < chars.len() {
+        let c = chars[i];
+        let column = i + 1;
+        if c.is_whitespace() {
+            i += 1;
+        } else if c.is_ascii_digit() {
+            let start = i;
+            while i < chars.len() && chars[i].is_ascii_digit() {
+                i += 1;
+            }
+            let text: String = chars[start..i].iter().collect();
+            let n = text
+                .parse()
+                .map_err(|_| ScriptError { message: "number too large".to_string(), column })?;
+            tokens.push(Token { kind: TokenKind::Int(n), column });
+        } else if c == '"' {
+            let start = i + 1;
+            i = start;
+            while i < chars.len() && chars[i] != '"' {
+                i += 1;
+            }
+            if i == chars.len() {
+                return Err(ScriptError { message: "unterminated string".to_string(), column });
+            }
+            tokens.push(Token { kind: TokenKind::Str(chars[start..i].iter().collect()), column });
+            i += 1;
+        } else if c.is_alphabetic() || c == '_' {
+            let start = i;
+            while i < chars.len() && (chars[i].is_alphanumeric() || chars[i] == '_') {
+                i += 1;
+            }
+            tokens.push(Token { kind: TokenKind::Ident(chars[start..i].iter().collect()), column });
+        } else {
+            let rest: String = chars[i..chars.len().min(i + 2)].iter().collect();
+            let Some(symbol) = SYMBOLS.iter().find(|s| rest.starts_with(**s)) else {
+                return Err(ScriptError { message: format!("unexpected '{}'", c), column });
+            };
+            tokens.push(Token { kind: TokenKind::Symbol(symbol), column });
+            i += symbol.len();
+        }
+    }
+    Ok(tokens)
+}
+
+/// Recursive descent, loosest binding first:
+/// if/then/else, or, and, not, comparison, + -, * / %, unary -, atoms
+struct Parser {
+    tokens: Vec<Token>,
+    pos: usize,
+    // Column reported for "unexpected end"
+    end: usize,
+}
+
+impl Parser {
+    fn error_at(&self, column: usize, message: impl Into<String>) -> ScriptError {
+        ScriptError { message: message.into(), column }
+    }
+
+    fn peek(&self) -> Option<&TokenKind> {
+        self.tokens.get(self.pos).map(|t| &t.kind)
+    }
+
+    fn column(&self) -> usize {
+        self.tokens.get(self.pos).map_or(self.end, |t| t.column)
+    }
+
+    fn next(&mut self) -> Result<Token, ScriptError> {
+        let token = self.tokens.get(self.pos).cloned();
+        self.pos += 1;
+        token.ok_or_else(|| self.error_at(self.end, "unexpected end of script"))
+    }
+
+    fn eat_keyword(&mut self, keyword: &str) -> bool {
+        let found = matches!(self.peek(), Some(TokenKind::Ident(word)) if word == keyword);
+        if found {
+            self.pos += 1;
+        }
+        found
+    }
+
+    fn eat_symbol(&mut self, symbol: &str) -> bool {
+        let found = matches!(self.peek(), Some(TokenKind::Symbol(s)) if *s == symbol);
+        if found {
+            self.pos += 1;
+        }
+        found
+    }
+
+    fn expect_keyword(&mut self, keyword: &str) -> Result<(), ScriptError> {
+        if self.eat_keyword(keyword) {
+            Ok(())
+        } else {
+            Err(self.error_at(self.column(), format!("expected '{}'", keyword)))
+        }
+    }
+
+    fn expect_symbol(&mut self, symbol: &str) -> Result<(), ScriptError> {
+        if self.eat_symbol(symbol) {
+            Ok(())
+        } else {
+            Err(self.error_at(self.column(), format!("expected '{}'", symbol)))
+        }
+    }
+
+    fn expr(&mut self) -> Result<Expr, ScriptError> {
+        if self.eat_keyword("if") {
+            let condition = self.expr()?;
+            self.expect_keyword("then")?;
+            let then = self.expr()?;
+            self.expect_keyword("else")?;
+            let otherwise = self.expr()?;
+            return Ok(Expr::If(Box::new(condition), Box::new(then), Box::new(otherwise)));
+        }
+        self.or()
+    }
+
+    fn or(&mut self) -> Result<Expr, ScriptError> {
+        let mut lhs = self.and()?;
+        while self.eat_keyword("or") {
+            lhs = Expr::Binary(BinOp::Or, Box::new(lhs), Box::new(self.and()?));
+        }
+        Ok(lhs)
+    }
+
+    fn and(&mut self) -> Result<Expr, ScriptError> {
+        let mut lhs = self.not()?;
+        while self.eat_keyword("and") {
+            lhs = Expr::Binary(BinOp::And, Box::new(lhs), Box::new(self.not()?));
+        }
+        Ok(lhs)
+    }
+
+    fn not(&mut self) -> Result<Expr, ScriptError> {
+        if self.eat_keyword("not") {
+            return Ok(Expr::Not(Box::new(self.not()?)));
+        }
+        self.comparison()
+    }
+
+    fn comparison(&mut self) -> Result<Expr, ScriptError> {
+        let lhs = self.sum()?;
+        for (symbol, op) in [
+            ("==", BinOp::Eq),
+            ("!=", BinOp::Ne),
+            ("<=", BinOp::Le),
+            (">=", BinOp::Ge),
+            ("<", BinOp::Lt),
+            (">", BinOp::Gt),
+        ] {
+            if self.eat_symbol(symbol) {
+                return Ok(Expr::Binary(op, Box::new(lhs), Box::new(self.sum()?)));
+            }
+        }
+        Ok(lhs)
+    }
+
+    fn sum(&mut self) -> Result<Expr, ScriptError> {
+        let mut lhs = self.product()?;
+        loop {
+            let op = if self.eat_symbol("+") {
+                BinOp::Add
+            } else if self.eat_symbol("-") {
+                BinOp::Sub
+            } else {
+                return Ok(lhs);
+            };
+            lhs = Expr::Binary(op, Box::new(lhs), Box::new(self.product()?));
+        }
+    }
+
+    fn product(&mut self) -> Result<Expr, ScriptError> {
+        let mut lhs = self.unary()?;
+        loop {
+            let op = if self.eat_symbol("*") {
+                BinOp::Mul
+            } else if self.eat_symbol("/") {
+                BinOp::Div
+            } else if self.eat_symbol("%") {
+                BinOp::Rem
+            } else {
+                return Ok(lhs);
+            };
+            lhs = Expr::Binary(op, Box::new(lhs), Box::new(self.unary()?));
+        }
+    }
+
+    fn unary(&mut self) -> Result<Expr, ScriptError> {
+        if self.eat_symbol("-") {
+            return Ok(Expr::Neg(Box::new(self.unary()?)));
+        }
+        self.atom()
+    }
+
+    fn atom(&mut self) -> Result<Expr, ScriptError> {
+        let token = self.next()?;
+        match token.kind {
+            TokenKind::Int(n) => Ok(Expr::Literal(Value::Int(n))),
+            TokenKind::Str(name) => match KeyboardCode::from(name.as_str()) {
+                KeyboardCode::Unknown => {
+                    Err(self.error_at(token.column, format!("unknown key '{}'", name)))
+                }
+                key => Ok(Expr::Literal(Value::Key(key))),
+            },
+            TokenKind::Symbol("(") => {
+                let inner = self.expr()?;
+                self.expect_symbol(")")?;
+                Ok(inner)
+            }
+            TokenKind::Symbol("[") => {
+                let mut items = Vec::new();
+                if !self.eat_symbol("]") {
+                    loop {
+                        items.push(self.expr()?);
+                        if self.eat_symbol("]") {
+                            break;
+                        }
+                        self.expect_symbol(",")?;
+                    }
+                }
+                Ok(Expr::List(items))
+            }
+            TokenKind::Ident(word) => match word.as_str() {
+                "true" => Ok(Expr::Literal(Value::Bool(true))),
+                "false" => Ok(Expr::Literal(Value::Bool(false))),
+                "none" => Ok(Expr::Literal(Value::None)),
+                "value" => Ok(Expr::EventValue),
+                "button" => {
+                    let (name, column) = self.name_argument()?;
+                    match ButtonCode::from(name.as_str()) {
+                        ButtonCode::Unknown => {
+                            Err(self.error_at(column, format!("unknown button '{}'", name)))
+                        }
+                        code => Ok(Expr::Button(code)),
+                    }
+                }
+                "axis" => {
+                    let (name, column) = self.name_argument()?;
+                    match AxisCode::from(name.as_str()) {
+                        AxisCode::Unknown => {
+                            Err(self.error_at(column, format!("unknown axis '{}'", name)))
+                        }
+                        code => Ok(Expr::Axis(code)),
+                    }
+                }
+                _ => Err(self.error_at(token.column, format!("unknown name '{}'", word))),
+            },
+            TokenKind::Symbol(symbol) => {
+                Err(self.error_at(token.column, format!("unexpected '{}'", symbol)))
+            }
+        }
+    }
+
+    /// The `("Name")` after `button`/`axis`
+    fn name_argument(&mut self) -> Result<(String, usize), ScriptError> {
+        self.expect_symbol("(")?;
+        let token = self.next()?;
+        let TokenKind::Str(name) = token.kind else {
+            return Err(self.error_at(token.column, "expected a quoted name"));
+        };
+        self.expect_symbol(")")?;
+        Ok((name, token.column))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn run(
+        source: &str,
+        value: i32,
+        buttons: &[ButtonCode],
+        axes: &[(AxisCode, i32)],
+    ) -> Vec<KeyboardCode> {
+        let mut button_states = [false; ButtonCode::ALL.len()];
+        for code in buttons {
+            button_states[code.index()] = true;
+        }
+        let mut axis_states = [0; AxisCode::ALL.len()];
+        for (code, v) in axes {
+            axis_states[code.index()] = *v;
+        }
+        let input = ScriptInput { value, buttons: &button_states, axes: &axis_states };
+
+        let mut keys = Vec::new();
+        Script::parse(source).unwrap().eval_keys(&input, &mut keys).unwrap();
+        keys
+    }
+
+    #[test]
+    fn test_conditional_on_other_controls() {
+        let script = r#"if axis("Left Y") < -16000 then ["Left Shift", "W"] else "W""#;
+        assert_eq!(run(script, 1, &[], &[]), [KeyboardCode::W]);
+        assert_eq!(
+            run(script, 1, &[], &[(AxisCode::LeftY, -30000)]),
+            [KeyboardCode::LeftShift, KeyboardCode::W]
+        );
+
+        let script =
+            r#"if button("Left Shoulder") and not button("Right Shoulder") then "Q" else none"#;
+        assert_eq!(run(script, 1, &[ButtonCode::LeftShoulder], &[]), [KeyboardCode::Q]);
+        assert_eq!(run(script, 1, &[ButtonCode::LeftShoulder, ButtonCode::RightShoulder], &[]), []);
+    }
+
+    #[test]
+    fn test_arithmetic_and_event_value() {
+        assert_eq!(
+            run("if value * 2 + 1 >= 7 then \"A\" else \"B\"", 3, &[], &[]),
+            [KeyboardCode::A]
+        );
+        assert_eq!(
+            run("if -value % 2 == 0 then \"A\" else \"B\"", -3, &[], &[]),
+            [KeyboardCode::B]
+        );
+    }
+
+    #[test]
+    fn test_parse_errors_point_at_the_problem() {
+        let err = |source| Script::parse(source).unwrap_err().to_string();
+        assert_eq!(
+            err(r#"if button("Eest") then "A" else none"#),
+            "unknown button 'Eest' at column 11"
+        );
+        assert_eq!(err(r#""Spcae""#), "unknown key 'Spcae' at column 1");
+        assert_eq!(err(r#"if true then "A""#), "expected 'else' at column 17");
+        assert_eq!(err("value +"), "unexpected end of script at column 8");
+        assert_eq!(err(r#""A" "B""#), "unexpected input after the expression at column 5");
+    }
+
+    #[test]
+    fn test_type_errors_surface_at_runtime() {
+        let script = Script::parse(r#"if "A" > 1 then "A" else none"#).unwrap();
+        let input = ScriptInput { value: 1, buttons: &[], axes: &[] };
+        assert_eq!(script.eval_keys(&input, &mut Vec::new()), Err("expected a number"));
+
+        let script = Script::parse("value").unwrap();
+        assert_eq!(
+            script.eval_keys(&input, &mut Vec::new()),
+            Err("script must yield key names or none")
+        );
+    }
+}
@@ -0,0 +1,408 @@
+use std::time::Duration;
+
+use crate::{
+    event::{ActionSource, AxisCode, AxisDirection, ButtonCode, KeyboardCode},
+    mapping::{
+        Mapping, MappingRule,
+        text::Text,
+        types::{Flick, FlickTarget, RoutedTarget},
+    },
+};
+
+const BUTTONS: usize = ButtonCode::ALL.len();
+const AXES: usize = AxisCode::ALL.len();
+
+/// A control standing in for another (see `MappingRule::Mirror`)
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Mirror {
+    pub source: ActionSource,
+    pub target: ActionSource,
+    pub layer: Option<ButtonCode>,
+}
+
+/// A stick direction pressing its target once per flick (see
+/// `MappingRule::Flick`)
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FlickRule {
+    pub source: AxisCode,
+    pub direction: AxisDirection,
+    pub flick: Flick,
+    pub target: FlickTarget,
+}
+
+/// How a held key repeats, like a keyboard's
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Repeat {
+    pub delay: Duration,
+    pub interval: Duration,
+}
+
+impl Repeat {
+    /// The kernel's keyboard defaults, for whichever of the two isn't set
+    pub const DEFAULT_DELAY_MS: u32 = 250;
+    pub const DEFAULT_RATE: u32 = 33;
+
+    /// How `mapping`'s key repeats; None if it doesn't
+    pub fn of(mapping: &Mapping) -> Option<Self> {
+        if mapping.repeat_delay_ms.is_none() && mapping.repeat_rate.is_none() {
+            return None;
+        }
+        let rate = mapping.repeat_rate.unwrap_or(Self::DEFAULT_RATE);
+        if rate == 0 {
+            return None;
+        }
+        let delay_ms = mapping.repeat_delay_ms.unwrap_or(Self::DEFAULT_DELAY_MS);
+        Some(Self {
+            delay: Duration::from_millis(delay_ms as u64),
+            interval: Duration::from_secs(1) / rate,
+        })
+    }
+}
+
+/// Mapping rules compiled into dense arrays indexed by event code
+///
+/// Built once when a profile is loaded (and again when it changes) so the
+/// per-event path is an array index instead of a hash lookup.
+#[derive(Debug, Clone)]
+pub struct RuleTable {
+    buttons: [Option<KeyboardCode>; BUTTONS],
+    // [negative, positive] target per axis
+    axes: [[Option<KeyboardCode>; 2]; AXES],
+    // Index into `devices` per button/axis direction: a mouse, gamepad or
+    // custom device control, next to the key
+    button_devices: [Option<usize>; BUTTONS],
+    axis_devices: [[Option<usize>; 2]; AXES],
+    devices: Vec<RoutedTarget>,
+    // Action index per button/axis direction; independent of the key target
+    button_actions: [Option<usize>; BUTTONS],
+    axis_actions: [[Option<usize>; 2]; AXES],
+    axis_value_actions: [Option<usize>; AXES],
+    // Script index per button/axis direction
+    button_scripts: [Option<usize>; BUTTONS],
+    axis_scripts: [[Option<usize>; 2]; AXES],
+    // Index into `texts` per button/axis direction
+    button_texts: [Option<usize>; BUTTONS],
+    axis_texts: [[Option<usize>; 2]; AXES],
+    texts: Vec<Text>,
+    // Debounce window per button, 0 = off
+    debounce_ms: [u32; BUTTONS],
+    // Buttons whose key stays held until the next press is over
+    sticky: [bool; BUTTONS],
+    // Keys repeating while their button or D-pad direction is held
+    button_repeat: [Option<Repeat>; BUTTONS],
+    axis_repeat: [[Option<Repeat>; 2]; AXES],
+    // Few per profile, so lists
+    mirrors: Vec<Mirror>,
+    flicks: Vec<FlickRule>,
+}
+
+impl RuleTable {
+    pub fn new() -> Self {
+        Self {
+            buttons: [None; BUTTONS],
+            axes: [[None; 2]; AXES],
+            button_devices: [None; BUTTONS],
+            axis_devices: [[None; 2]; AXES],
+            devices: Vec::new(),
+            button_actions: [None; BUTTONS],
+            axis_actions: [[None; 2]; AXES],
+            axis_value_actions: [None; AXES],
+            button_scripts: [None; BUTTONS],
+            axis_scripts: [[None; 2]; AXES],
+            button_texts: [None; BUTTONS],
+            axis_texts: [[None; 2]; AXES],
+            texts: Vec::new(),
+            debounce_ms: [0; BUTTONS],
+            sticky: [false; BUTTONS],
+            button_repeat: [None; BUTTONS],
+            axis_repeat: [[None; 2]; AXES],
+            mirrors: Vec::new(),
+            flicks: Vec::new(),
+        }
+    }
+
+    /// Compile rules; later rules for the same source win, as before
+    pub fn compile<'a>(rules: impl IntoIterator<Item = &'a MappingRule>) -> Self {
+        let mut table = Self::new();
+        for rule in rules {
+            table.insert(rule);
+        }
+        table
+    }
+
+    pub fn insert(&mut self, rule: &MappingRule) {
+        match *rule {
+            MappingRule::ButtonToKey { source, target } => {
+                self.buttons[source.index()] = Some(target);
+            }
+            MappingRule::AxisDirectionToKey { source, direction, target } => {
+                self.axes[source.index()][direction_slot(direction)] = Some(target);
+            }
+            MappingRule::ButtonToDevice { source, ref target } => {
+                self.button_devices[source.index()] = Some(self.devices.len());
+                self.devices.push(target.clone());
+            }
+            MappingRule::AxisDirectionToDevice { source, direction, ref target } => {
+                self.axis_devices[source.index()][direction_slot(direction)] =
+                    Some(self.devices.len());
+                self.devices.push(target.clone());
+            }
+            MappingRule::ButtonToAction { source, action } => {
+                self.button_actions[source.index()] = Some(action);
+            }
+            MappingRule::AxisDirectionToAction { source, direction, action } => {
+                self.axis_actions[source.index()][direction_slot(direction)] = Some(action);
+            }
+            MappingRule::AxisToAction { source, action } => {
+                self.axis_value_actions[source.index()] = Some(action);
+            }
+            MappingRule::ButtonToScript { source, script } => {
+                self.button_scripts[source.index()] = Some(script);
+            }
+            MappingRule::AxisDirectionToScript { source, direction, script } => {
+                self.axis_scripts[source.index()][direction_slot(direction)] = Some(script);
+            }
+            MappingRule::ButtonToText { source, ref text } => {
+                self.button_texts[source.index()] = Some(self.texts.len());
+                self.texts.push(text.clone());
+            }
+            MappingRule::AxisDirectionToText { source, direction, ref text } => {
+                self.axis_texts[source.index()][direction_slot(direction)] = Some(self.texts.len());
+                self.texts.push(text.clone());
+            }
+            MappingRule::Mirror { source, target, layer } => {
+                self.mirrors.retain(|mirror| (mirror.source, mirror.layer) != (source, layer));
+                self.mirrors.push(Mirror { source, target, layer });
+            }
+            MappingRule::Flick { source, direction, flick, ref target } => {
+                self.flicks.retain(|rule| (rule.source, rule.direction) != (source, direction));
+                self.flicks.push(FlickRule { source, direction, flick, target: target.clone() });
+            }
+        }
+    }
+
+    #[inline]
+    pub fn button(&self, code: ButtonCode) -> Option<KeyboardCode> {
+        self.buttons[code.index()]
+    }
+
+    #[inline]
+    pub fn axis(&self, code: AxisCode, direction: AxisDirection) -> Option<KeyboardCode> {
+        self.axes[code.index()][direction_slot(direction)]
+    }
+
+    #[inline]
+    pub fn button_device(&self, code: ButtonCode) -> Option<&RoutedTarget> {
+        self.button_devices[code.index()].map(|index| &self.devices[index])
+    }
+
+    #[inline]
+    pub fn axis_device(&self, code: AxisCode, direction: AxisDirection) -> Option<&RoutedTarget> {
+        self.axis_devices[code.index()][direction_slot(direction)].map(|index| &self.devices[index])
+    }
+
+    #[inline]
+    pub fn button_action(&self, code: ButtonCode) -> Option<usize> {
+        self.button_actions[code.index()]
+    }
+
+    #[inline]
+    pub fn axis_action(&self, code: AxisCode, direction: AxisDirection) -> Option<usize> {
+        self.axis_actions[code.index()][direction_slot(direction)]
+    }
+
+    /// Action fired on every change of the axis
+    #[inline]
+    pub fn axis_value_action(&self, code: AxisCode) -> Option<usize> {
+        self.axis_value_actions[code.index()]
+    }
+
+    #[inline]
+    pub fn button_script(&self, code: ButtonCode) -> Option<usize> {
+        self.button_scripts[code.index()]
+    }
+
+    #[inline]
+    pub fn axis_script(&self, code: AxisCode, direction: AxisDirection) -> Option<usize> {
+        self.axis_scripts[code.index()][direction_slot(direction)]
+    }
+
+    #[inline]
+    pub fn button_text(&self, code: ButtonCode) -> Option<&Text> {
+        self.button_texts[code.index()].map(|index| &self.texts[index])
+    }
+
+    #[inline]
+    pub fn axis_text(&self, code: AxisCode, direction: AxisDirection) -> Option<&Text> {
+        self.axis_texts[code.index()][direction_slot(direction)].map(|index| &self.texts[index])
+    }
+
+    /// Controls standing in for others, in the order they were inserted
+    #[inline]
+    pub fn mirrors(&self) -> &[Mirror] {
+        &self.mirrors
+    }
+
+    /// The flick mapping of a stick direction, if it has one
+    #[inline]
+    pub fn flick(&self, code: AxisCode, direction: AxisDirection) -> Option<&FlickRule> {
+        self.flicks.iter().find(|rule| (rule.source, rule.direction) == (code, direction))
+    }
+
+    pub fn set_debounce(&mut self, code: ButtonCode, window_ms: u32) {
+        self.debounce_ms[code.index()] = window_ms;
+    }
+
+    #[inline]
+    pub fn debounce(&self, code: ButtonCode) -> Duration {
+        Duration::from_millis(self.debounce_ms[code.index()] as u64)
+    }
+
+    pub fn set_sticky(&mut self, code: ButtonCode, sticky: bool) {
+        self.sticky[code.index()] = sticky;
+    }
+
+    #[inline]
+    pub fn is_sticky(&self, code: ButtonCode) -> bool {
+        self.sticky[code.index()]
+    }
+
+    pub fn set_repeat(&mut self, source: ActionSource, repeat: Option<Repeat>) {
+        match source {
+            ActionSource::Button(code) => self.button_repeat[code.index()] = repeat,
+            ActionSource::Axis(code, direction) => {
+                self.axis_repeat[code.index()][direction_slot(direction)] = repeat
+            }
+            // Whole axes don't press keys
+            ActionSource::AxisValue(_) => {}
+        }
+    }
+
+    #[inline]
+    pub fn repeat(&self, source: ActionSource) -> Option<Repeat> {
+        match source {
+            ActionSource::Button(code) => self.button_repeat[code.index()],
+            ActionSource::Axis(code, direction) => {
+                self.axis_repeat[code.index()][direction_slot(direction)]
+            }
+            ActionSource::AxisValue(_) => None,
+        }
+    }
+
+    /// Number of buttons with a rule
+    pub fn button_count(&self) -> usize {
+        (0..BUTTONS)
+            .filter(|&i| {
+                self.buttons[i].is_some()
+                    || self.button_devices[i].is_some()
+                    || self.button_actions[i].is_some()
+                    || self.button_scripts[i].is_some()
+                    || self.button_texts[i].is_some()
+            })
+            .count()
+    }
+
+    /// Number of (axis, direction) pairs with a rule, plus whole-axis rules
+    pub fn axis_count(&self) -> usize {
+        let directional = (0..AXES)
+            .flat_map(|i| [(i, 0), (i, 1)])
+            .filter(|&(i, slot)| {
+                self.axes[i][slot].is_some()
+                    || self.axis_devices[i][slot].is_some()
+                    || self.axis_actions[i][slot].is_some()
+                    || self.axis_scripts[i][slot].is_some()
+                    || self.axis_texts[i][slot].is_some()
+                    || self.flicks.iter().any(|rule| {
+                        (rule.source.index(), direction_slot(rule.direction)) == (i, slot)
+                    })
+            })
+            .count();
+        directional + self.axis_value_actions.iter().flatten().count()
+    }
+}
+
+impl Default for RuleTable {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+#[inline]
+fn direction_slot(direction: AxisDirection) -> usize {
+    match direction {
+        AxisDirection::Negative => 0,
+        AxisDirection::Positive => 1,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_compile_and_lookup() {
+        let rules = [
+            MappingRule::button_to_key(ButtonCode::South, KeyboardCode::S),
+            MappingRule::axis_direction_to_key(
+                AxisCode::DPadY,
+                AxisDirection::Negative,
+                KeyboardCode::Up,
+            ),
+        ];
+        let table = RuleTable::compile(&rules);
+
+        assert_eq!(table.button(ButtonCode::South), Some(KeyboardCode::S));
+        assert_eq!(table.button(ButtonCode::North), None);
+        assert_eq!(table.axis(AxisCode::DPadY, AxisDirection::Negative), Some(KeyboardCode::Up));
+        assert_eq!(table.axis(AxisCode::DPadY, AxisDirection::Positive), None);
+        assert_eq!((table.button_count(), table.axis_count()), (1, 1));
+    }
+
+    #[test]
+    fn test_later_rule_overrides_earlier() {
+        let rules = [
+            MappingRule::button_to_key(ButtonCode::South, KeyboardCode::S),
+            MappingRule::button_to_key(ButtonCode::South, KeyboardCode::Space),
+        ];
+        let table = RuleTable::compile(&rules);
+
+        assert_eq!(table.button(ButtonCode::South), Some(KeyboardCode::Space));
+        assert_eq!(table.button_count(), 1);
+    }
+
+    #[test]
+    fn test_later_mirror_of_a_layer_replaces_earlier() {
+        let mirror = |target, layer| MappingRule::Mirror {
+            source: ActionSource::Button(ButtonCode::South),
+            target: ActionSource::Button(target),
+            layer,
+        };
+        let rules = [
+            mirror(ButtonCode::North, None),
+            mirror(ButtonCode::East, Some(ButtonCode::LeftShoulder)),
+            mirror(ButtonCode::West, None),
+        ];
+        let table = RuleTable::compile(&rules);
+
+        let targets: Vec<_> = table.mirrors().iter().map(|mirror| mirror.target).collect();
+        assert_eq!(
+            targets,
+            [ActionSource::Button(ButtonCode::East), ActionSource::Button(ButtonCode::West)]
+        );
+    }
+
+    #[test]
+    fn test_actions_sit_next_to_keys() {
+        let rules = [
+            MappingRule::button_to_key(ButtonCode::South, KeyboardCode::S),
+            MappingRule::ButtonToAction { source: ButtonCode::South, action: 0 },
+            MappingRule::ButtonToAction { source: ButtonCode::Mode, action: 1 },
+        ];
+        let table = RuleTable::compile(&rules);
+
+        assert_eq!(table.button(ButtonCode::South), Some(KeyboardCode::S));
+        assert_eq!(table.button_action(ButtonCode::South), Some(0));
+        assert_eq!(table.button_action(ButtonCode::Mode), Some(1));
+        assert_eq!(table.button_count(), 2);
+    }
+}
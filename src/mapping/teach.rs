@@ -0,0 +1,167 @@
+// Teach mode: a profile built from controls and keys pressed in pairs
+//
+// The user presses a control on the controller, then the key it should
+// type. Only controls that can press keys are taught: buttons and D-pad
+// directions. Teaching a control again replaces its key.
+
+use std::fmt;
+
+use crate::event::{
+    AxisCode, AxisDirection, ButtonCode, InputEvent, KeyboardCode, axis_and_direction_to_string,
+};
+use crate::mapping::{Mapping, profile::Profile, types::TargetType};
+
+/// A control that can be mapped to a key
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Control {
+    Button(ButtonCode),
+    DPad(AxisCode, AxisDirection),
+}
+
+impl Control {
+    /// The control `event` starts pressing, if any; releases and the
+    /// D-pad returning to center aren't
+    pub fn pressed_by(event: &InputEvent) -> Option<Self> {
+        match *event {
+            InputEvent::Button { code, pressed: true, .. } if code != ButtonCode::Unknown => {
+                Some(Self::Button(code))
+            }
+            InputEvent::Axis {
+                code: code @ (AxisCode::DPadX | AxisCode::DPadY), value, ..
+            } => match value.signum() {
+                -1 => Some(Self::DPad(code, AxisDirection::Negative)),
+                1 => Some(Self::DPad(code, AxisDirection::Positive)),
+                _ => None,
+            },
+            _ => None,
+        }
+    }
+
+    fn mapping(self, key: KeyboardCode) -> Mapping {
+        let (source_name, source_direction) = match self {
+            Self::Button(code) => (code.to_string(), None),
+            Self::DPad(code, direction) => (code.to_string(), Some(direction.to_string())),
+        };
+        Mapping {
+            source_name,
+            source_direction,
+            target_type: TargetType::Keyboard,
+            target_name: key.to_string(),
+            ..Default::default()
+        }
+    }
+}
+
+impl fmt::Display for Control {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match *self {
+            Self::Button(code) => write!(f, "{}", code),
+            Self::DPad(code, direction) => {
+                write!(f, "{}", axis_and_direction_to_string(code, direction))
+            }
+        }
+    }
+}
+
+/// The pairs taught so far, in the order they were first taught
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Lesson {
+    pairs: Vec<(Control, KeyboardCode)>,
+}
+
+impl Lesson {
+    /// Map `control` to `key`; returns the key it was mapped to before
+    pub fn teach(&mut self, control: Control, key: KeyboardCode) -> Option<KeyboardCode> {
+        match self.pairs.iter_mut().find(|(taught, _)| *taught == control) {
+            Some((_, previous)) => Some(std::mem::replace(previous, key)),
+            None => {
+                self.pairs.push((control, key));
+                None
+            }
+        }
+    }
+
+    pub fn len(&self) -> usize {
+        self.pairs.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.pairs.is_empty()
+    }
+
+    /// A profile with the taught mappings and default settings
+    pub fn to_profile(&self, name: &str) -> Profile {
+        Profile {
+            name: name.to_string(),
+            description: "Taught with 'blazeremap profile teach'".to_string(),
+            mappings: self.pairs.iter().map(|&(control, key)| control.mapping(key)).collect(),
+            ..Profile::default_profile()
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{KeyboardEventType, OutputEvent};
+    use crate::mapping::MappingEngine;
+    use crate::mapping::format::ProfileFormat;
+
+    fn press(code: KeyboardCode) -> OutputEvent {
+        OutputEvent::Keyboard { code, event_type: KeyboardEventType::Press }
+    }
+
+    #[test]
+    fn test_pressed_by() {
+        let control = |event| Control::pressed_by(&event);
+        assert_eq!(
+            control(InputEvent::button_press(ButtonCode::South)),
+            Some(Control::Button(ButtonCode::South))
+        );
+        assert_eq!(control(InputEvent::button_release(ButtonCode::South)), None);
+        assert_eq!(control(InputEvent::button_press(ButtonCode::Unknown)), None);
+        assert_eq!(
+            control(InputEvent::axis_move(AxisCode::DPadY, -1)),
+            Some(Control::DPad(AxisCode::DPadY, AxisDirection::Negative))
+        );
+        assert_eq!(control(InputEvent::axis_move(AxisCode::DPadX, 0)), None);
+        // Sticks can't press keys
+        assert_eq!(control(InputEvent::axis_move(AxisCode::LeftX, 32767)), None);
+        assert_eq!(control(InputEvent::sync()), None);
+    }
+
+    #[test]
+    fn test_reteaching_replaces_key_in_place() {
+        let mut lesson = Lesson::default();
+        let south = Control::Button(ButtonCode::South);
+        let up = Control::DPad(AxisCode::DPadY, AxisDirection::Negative);
+        assert_eq!(lesson.teach(south, KeyboardCode::Space), None);
+        assert_eq!(lesson.teach(up, KeyboardCode::W), None);
+        assert_eq!(lesson.teach(south, KeyboardCode::Enter), Some(KeyboardCode::Space));
+        assert_eq!(lesson.len(), 2);
+        assert_eq!(lesson.pairs, [(south, KeyboardCode::Enter), (up, KeyboardCode::W)]);
+        assert_eq!(up.to_string(), "DPad Up");
+    }
+
+    #[test]
+    fn test_taught_profile_maps_what_was_taught() {
+        let mut lesson = Lesson::default();
+        lesson.teach(Control::Button(ButtonCode::LeftShoulder), KeyboardCode::Q);
+        lesson.teach(Control::DPad(AxisCode::DPadX, AxisDirection::Positive), KeyboardCode::D);
+        let profile = lesson.to_profile("Taught");
+
+        // Survives a save and load
+        let text = ProfileFormat::Toml.encode_profile(&profile).unwrap();
+        let profile = Profile::decode(&text, ProfileFormat::Toml).unwrap();
+        assert_eq!(profile.name, "Taught");
+        let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+
+        let out = engine.process(&InputEvent::button_press(ButtonCode::LeftShoulder)).unwrap();
+        assert_eq!(out, [press(KeyboardCode::Q)]);
+        let out = engine.process(&InputEvent::axis_move(AxisCode::DPadX, 1)).unwrap();
+        assert_eq!(out, [press(KeyboardCode::D)]);
+        // Nothing else is mapped
+        let out = engine.process(&InputEvent::button_press(ButtonCode::South)).unwrap();
+        assert!(out.is_empty());
+    }
+}
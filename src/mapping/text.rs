@@ -0,0 +1,240 @@
+// Typing text from a mapping
+//
+// A `Text` mapping types its `target_name` when its source is pressed, for
+// chat phrases or a login name:
+//
+//   target_type = "Text"
+//   target_name = "gg, well played!"
+//
+// The virtual keyboard sends key codes, not characters, so which keys type
+// a character depends on the layout the desktop has set. The profile's
+// `keyboard_layout` says which that is; each character is then its key,
+// with Shift or AltGr held where the layout needs it. Characters are looked
+// up when the profile loads, so one the layout can't type fails the load.
+//
+// Characters on the key next to the left Shift of ISO keyboards, like the
+// German < > |, can't be typed: the virtual keyboard has no such key.
+
+use std::fmt;
+
+use anyhow::{Result, bail};
+use serde::{Deserialize, Serialize};
+
+use crate::event::{KeyboardCode, KeyboardEventType, OutputEvent};
+
+/// The keyboard layout the desktop types with
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum KeyboardLayout {
+    /// US English
+    #[default]
+    Us,
+    /// UK English
+    Uk,
+    /// German (QWERTZ)
+    De,
+}
+
+/// A key and the characters it types: alone, with Shift and with AltGr
+type Row = (KeyboardCode, &'static str);
+
+/// The keys all three layouts share, beyond the letters
+const COMMON: &[Row] =
+    &[(KeyboardCode::Space, " "), (KeyboardCode::Enter, "\n"), (KeyboardCode::Tab, "\t")];
+
+const US: &[Row] = &[
+    (KeyboardCode::Num1, "1!"),
+    (KeyboardCode::Num2, "2@"),
+    (KeyboardCode::Num3, "3#"),
+    (KeyboardCode::Num4, "4$"),
+    (KeyboardCode::Num5, "5%"),
+    (KeyboardCode::Num6, "6^"),
+    (KeyboardCode::Num7, "7&"),
+    (KeyboardCode::Num8, "8*"),
+    (KeyboardCode::Num9, "9("),
+    (KeyboardCode::Num0, "0)"),
+    (KeyboardCode::Minus, "-_"),
+    (KeyboardCode::Equal, "=+"),
+    (KeyboardCode::LeftBrace, "[{"),
+    (KeyboardCode::RightBrace, "]}"),
+    (KeyboardCode::Backslash, "\\|"),
+    (KeyboardCode::Semicolon, ";:"),
+    (KeyboardCode::Apostrophe, "'\""),
+    (KeyboardCode::Grave, "`~"),
+    (KeyboardCode::Comma, ",<"),
+    (KeyboardCode::Dot, ".>"),
+    (KeyboardCode::Slash, "/?"),
+];
+
+const UK: &[Row] = &[
+    (KeyboardCode::Num1, "1!"),
+    (KeyboardCode::Num2, "2\""),
+    (KeyboardCode::Num3, "3£"),
+    (KeyboardCode::Num4, "4$"),
+    (KeyboardCode::Num5, "5%"),
+    (KeyboardCode::Num6, "6^"),
+    (KeyboardCode::Num7, "7&"),
+    (KeyboardCode::Num8, "8*"),
+    (KeyboardCode::Num9, "9("),
+    (KeyboardCode::Num0, "0)"),
+    (KeyboardCode::Minus, "-_"),
+    (KeyboardCode::Equal, "=+"),
+    (KeyboardCode::LeftBrace, "[{"),
+    (KeyboardCode::RightBrace, "]}"),
+    (KeyboardCode::Backslash, "#~"),
+    (KeyboardCode::Semicolon, ";:"),
+    (KeyboardCode::Apostrophe, "'@"),
+    (KeyboardCode::Grave, "`¬"),
+    (KeyboardCode::Comma, ",<"),
+    (KeyboardCode::Dot, ".>"),
+    (KeyboardCode::Slash, "/?"),
+];
+
+const DE: &[Row] = &[
+    (KeyboardCode::Num1, "1!"),
+    (KeyboardCode::Num2, "2\"²"),
+    (KeyboardCode::Num3, "3§³"),
+    (KeyboardCode::Num4, "4$"),
+    (KeyboardCode::Num5, "5%"),
+    (KeyboardCode::Num6, "6&"),
+    (KeyboardCode::Num7, "7/{"),
+    (KeyboardCode::Num8, "8(["),
+    (KeyboardCode::Num9, "9)]"),
+    (KeyboardCode::Num0, "0=}"),
+    (KeyboardCode::Minus, "ß?\\"),
+    (KeyboardCode::LeftBrace, "üÜ"),
+    (KeyboardCode::RightBrace, "+*~"),
+    (KeyboardCode::Backslash, "#'"),
+    (KeyboardCode::Semicolon, "öÖ"),
+    (KeyboardCode::Apostrophe, "äÄ"),
+    (KeyboardCode::Comma, ",;"),
+    (KeyboardCode::Dot, ".:"),
+    (KeyboardCode::Slash, "-_"),
+    // Y and Z trade places, and some letters type more with AltGr
+    (KeyboardCode::Y, "zZ"),
+    (KeyboardCode::Z, "yY"),
+    (KeyboardCode::Q, "qQ@"),
+    (KeyboardCode::E, "eE€"),
+    (KeyboardCode::M, "mMµ"),
+];
+
+impl KeyboardLayout {
+    fn rows(self) -> &'static [Row] {
+        match self {
+            Self::Us => US,
+            Self::Uk => UK,
+            Self::De => DE,
+        }
+    }
+
+    /// The key typing `c`, with the modifier to hold, if any
+    fn keystroke(self, c: char) -> Option<(KeyboardCode, Option<KeyboardCode>)> {
+        let modifiers = [None, Some(KeyboardCode::LeftShift), Some(KeyboardCode::RightAlt)];
+        for &(key, chars) in self.rows().iter().chain(COMMON) {
+            if let Some(level) = chars.chars().position(|typed| typed == c) {
+                return Some((key, modifiers[level]));
+            }
+        }
+        // The letters the layout leaves where they are
+        if !c.is_ascii_alphabetic() {
+            return None;
+        }
+        let key = KeyboardCode::from(c.to_ascii_lowercase().to_string().as_str());
+        let shift = c.is_ascii_uppercase().then_some(KeyboardCode::LeftShift);
+        Some((key, shift))
+    }
+}
+
+impl fmt::Display for KeyboardLayout {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::Us => "us",
+            Self::Uk => "uk",
+            Self::De => "de",
+        })
+    }
+}
+
+/// A string as the keys that type it on one layout
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Text {
+    strokes: Vec<(KeyboardCode, Option<KeyboardCode>)>,
+}
+
+impl Text {
+    /// The keys typing `text` on `layout`; fails on the first character the
+    /// layout can't type
+    pub fn parse(text: &str, layout: KeyboardLayout) -> Result<Self> {
+        if text.is_empty() {
+            bail!("No text to type");
+        }
+        let mut strokes = Vec::with_capacity(text.len());
+        for c in text.chars() {
+            let Some(stroke) = layout.keystroke(c) else {
+                bail!("Can't type {:?} on the {} keyboard layout", c, layout);
+            };
+            strokes.push(stroke);
+        }
+        Ok(Self { strokes })
+    }
+
+    /// Append the presses and releases typing the text
+    pub fn output(&self, out: &mut Vec<OutputEvent>) {
+        let event = |code, event_type| OutputEvent::Keyboard { code, event_type };
+        for &(key, modifier) in &self.strokes {
+            out.extend(modifier.map(|code| event(code, KeyboardEventType::Press)));
+            out.push(event(key, KeyboardEventType::Press));
+            out.push(event(key, KeyboardEventType::Release));
+            out.extend(modifier.map(|code| event(code, KeyboardEventType::Release)));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn keys(text: &str, layout: KeyboardLayout) -> Vec<String> {
+        let mut out = Vec::new();
+        Text::parse(text, layout).unwrap().output(&mut out);
+        out.iter()
+            .filter_map(|event| match event {
+                OutputEvent::Keyboard { code, event_type: KeyboardEventType::Press } => {
+                    Some(code.to_string())
+                }
+                _ => None,
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_shift_and_altgr_per_layout() {
+        assert_eq!(keys("Hi!", KeyboardLayout::Us), ["Left Shift", "H", "I", "Left Shift", "1"]);
+        assert_eq!(keys("@", KeyboardLayout::Uk), ["Left Shift", "'"]);
+        assert_eq!(keys("zy@", KeyboardLayout::De), ["Y", "Z", "Right Alt", "Q"]);
+
+        let mut out = Vec::new();
+        Text::parse("a", KeyboardLayout::Us).unwrap().output(&mut out);
+        assert!(matches!(
+            out[..],
+            [
+                OutputEvent::Keyboard {
+                    code: KeyboardCode::A,
+                    event_type: KeyboardEventType::Press
+                },
+                OutputEvent::Keyboard {
+                    code: KeyboardCode::A,
+                    event_type: KeyboardEventType::Release
+                },
+            ]
+        ));
+    }
+
+    #[test]
+    fn test_untypable_text_fails() {
+        let err = Text::parse("<3", KeyboardLayout::De).unwrap_err();
+        assert_eq!(err.to_string(), "Can't type '<' on the de keyboard layout");
+        assert!(Text::parse("ä", KeyboardLayout::Us).is_err());
+        assert!(Text::parse("", KeyboardLayout::Us).is_err());
+    }
+}
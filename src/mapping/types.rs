@@ -1,8 +1,401 @@
+use std::sync::Arc;
+
 use serde::{Deserialize, Serialize};
 
-#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+use crate::{
+    event::{
+        ActionSource, AxisCode, AxisDirection, ButtonCode, InputEvent, KeyboardCode,
+        KeyboardEventType, OutputEvent, axis_and_direction_to_string,
+    },
+    input::{keymouse::MouseButton, range::AxisRange},
+    output::{identity::DeviceKind, mouse::MouseEvent},
+};
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
 pub enum TargetType {
+    #[default]
     Keyboard,
     Mouse,
     Gamepad,
+    /// Action provided by an external plugin named in `target_name`
+    Plugin,
+    /// Keys chosen by the mapping's `script` (see `mapping::script`)
+    Script,
+    /// Runs the mapping's `command`
+    Exec,
+    /// Publishes to the MQTT topic in `target_name`
+    Mqtt,
+    /// Sends OSC messages to the address template in `target_name`
+    Osc,
+    /// Makes the source act as the control named in `target_name`
+    Mirror,
+    /// A desktop or media operation named in `target_name`, like Volume Up
+    Desktop,
+    /// Recenters the stick axes named in `target_name` (both sticks if empty)
+    Recenter,
+    /// Types the text in `target_name` (see `mapping::text`)
+    Text,
+}
+
+impl TargetType {
+    /// Every target type, in declaration order
+    pub const ALL: [Self; 12] = [
+        Self::Keyboard,
+        Self::Mouse,
+        Self::Gamepad,
+        Self::Plugin,
+        Self::Script,
+        Self::Exec,
+        Self::Mqtt,
+        Self::Osc,
+        Self::Mirror,
+        Self::Desktop,
+        Self::Recenter,
+        Self::Text,
+    ];
+
+    /// Targets run as side-effect actions instead of virtual device output
+    pub fn is_action(self) -> bool {
+        matches!(self, Self::Plugin | Self::Exec | Self::Mqtt | Self::Osc | Self::Recenter)
+    }
+
+    /// The kind of virtual device the target type presses, if it presses one
+    /// a mapping can pick with its `device`
+    pub fn device_kind(self) -> Option<DeviceKind> {
+        match self {
+            Self::Keyboard => Some(DeviceKind::Keyboard),
+            Self::Mouse => Some(DeviceKind::Mouse),
+            Self::Gamepad => Some(DeviceKind::Gamepad),
+            _ => None,
+        }
+    }
+}
+
+/// A way of telling the user something happened without a screen
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Cue {
+    /// A message in the terminal and to event subscribers such as overlays
+    Visual,
+    /// A short pulse of the controller's rumble motors
+    Rumble,
+    /// A short sound from the desktop's sound theme
+    Sound,
+}
+
+/// What a desktop notification is sent for
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Notify {
+    /// The profile hotkeys switching profiles
+    ProfileSwitch,
+    /// The controller being connected and disconnected
+    Connection,
+    /// The controller's battery running low
+    BatteryLow,
+}
+
+/// Which edges of the source fire a one-shot action
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TriggerOn {
+    #[default]
+    Press,
+    Release,
+    Both,
+}
+
+impl TriggerOn {
+    pub fn fires(self, pressed: bool) -> bool {
+        match self {
+            Self::Press => pressed,
+            Self::Release => !pressed,
+            Self::Both => true,
+        }
+    }
+}
+
+/// Desktop and media operations, for using the controller as a remote
+///
+/// Each is sent as the media key desktops already bind to it.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DesktopAction {
+    VolumeUp,
+    VolumeDown,
+    Mute,
+    PlayPause,
+    NextTrack,
+    PreviousTrack,
+    StopMedia,
+    BrightnessUp,
+    BrightnessDown,
+    Screenshot,
+}
+
+impl DesktopAction {
+    pub const ALL: [Self; 10] = [
+        Self::VolumeUp,
+        Self::VolumeDown,
+        Self::Mute,
+        Self::PlayPause,
+        Self::NextTrack,
+        Self::PreviousTrack,
+        Self::StopMedia,
+        Self::BrightnessUp,
+        Self::BrightnessDown,
+        Self::Screenshot,
+    ];
+
+    /// The action called `name`, ignoring case, spaces and punctuation
+    pub fn from_name(name: &str) -> Option<Self> {
+        let simplify = |name: &str| {
+            name.chars()
+                .filter(char::is_ascii_alphanumeric)
+                .map(|c| c.to_ascii_lowercase())
+                .collect::<String>()
+        };
+        let name = simplify(name);
+        Self::ALL.into_iter().find(|action| simplify(&action.to_string()) == name)
+    }
+
+    /// The key that performs it
+    pub fn key(self) -> KeyboardCode {
+        match self {
+            Self::VolumeUp => KeyboardCode::VolumeUp,
+            Self::VolumeDown => KeyboardCode::VolumeDown,
+            Self::Mute => KeyboardCode::Mute,
+            Self::PlayPause => KeyboardCode::PlayPause,
+            Self::NextTrack => KeyboardCode::NextSong,
+            Self::PreviousTrack => KeyboardCode::PreviousSong,
+            Self::StopMedia => KeyboardCode::StopCd,
+            Self::BrightnessUp => KeyboardCode::BrightnessUp,
+            Self::BrightnessDown => KeyboardCode::BrightnessDown,
+            // Print Screen
+            Self::Screenshot => KeyboardCode::SysRq,
+        }
+    }
+}
+
+impl std::fmt::Display for DesktopAction {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let name = match self {
+            Self::VolumeUp => "Volume Up",
+            Self::VolumeDown => "Volume Down",
+            Self::Mute => "Mute",
+            Self::PlayPause => "Play/Pause",
+            Self::NextTrack => "Next Track",
+            Self::PreviousTrack => "Previous Track",
+            Self::StopMedia => "Stop Media",
+            Self::BrightnessUp => "Brightness Up",
+            Self::BrightnessDown => "Brightness Down",
+            Self::Screenshot => "Screenshot",
+        };
+        f.write_str(name)
+    }
+}
+
+/// What a mouse or gamepad mapping presses on its virtual device, or a
+/// keyboard mapping on a custom one
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DeviceTarget {
+    Key(KeyboardCode),
+    MouseButton(MouseButton),
+    /// One notch of the wheels per press; positive is up and right
+    Wheel {
+        vertical: i32,
+        horizontal: i32,
+    },
+    /// A gamepad button, or a stick or D-pad direction
+    Gamepad(ActionSource),
+}
+
+impl DeviceTarget {
+    /// Axes a gamepad target can push; the triggers are pulled by their buttons
+    const GAMEPAD_AXES: [AxisCode; 6] = [
+        AxisCode::LeftX,
+        AxisCode::LeftY,
+        AxisCode::RightX,
+        AxisCode::RightY,
+        AxisCode::DPadX,
+        AxisCode::DPadY,
+    ];
+
+    /// Every target of a `target_type` device, with its name
+    fn all(target_type: TargetType) -> Vec<(String, Self)> {
+        match target_type {
+            TargetType::Mouse => [
+                ("Left", Self::MouseButton(MouseButton::Left)),
+                ("Right", Self::MouseButton(MouseButton::Right)),
+                ("Middle", Self::MouseButton(MouseButton::Middle)),
+                ("Side", Self::MouseButton(MouseButton::Side)),
+                ("Extra", Self::MouseButton(MouseButton::Extra)),
+                ("Wheel Up", Self::Wheel { vertical: 1, horizontal: 0 }),
+                ("Wheel Down", Self::Wheel { vertical: -1, horizontal: 0 }),
+                ("Wheel Left", Self::Wheel { vertical: 0, horizontal: -1 }),
+                ("Wheel Right", Self::Wheel { vertical: 0, horizontal: 1 }),
+            ]
+            .into_iter()
+            .map(|(name, target)| (name.to_string(), target))
+            .collect(),
+            TargetType::Gamepad => {
+                let buttons = ButtonCode::ALL
+                    .into_iter()
+                    .filter(|&code| code != ButtonCode::Unknown)
+                    .map(|code| (code.to_string(), Self::Gamepad(ActionSource::Button(code))));
+                let directions = Self::GAMEPAD_AXES.into_iter().flat_map(|code| {
+                    [AxisDirection::Negative, AxisDirection::Positive].map(|direction| {
+                        let name = axis_and_direction_to_string(code, direction);
+                        (name, Self::Gamepad(ActionSource::Axis(code, direction)))
+                    })
+                });
+                buttons.chain(directions).collect()
+            }
+            _ => Vec::new(),
+        }
+    }
+
+    /// The target called `name` on a `target_type` device, ignoring case
+    /// and spaces: a mouse button like Left or a wheel direction like Wheel
+    /// Up; a gamepad button like South or a direction like DPad Up or Left X
+    /// Right
+    pub fn from_name(target_type: TargetType, name: &str) -> Option<Self> {
+        let squeezed = |name: &str| name.replace(' ', "").to_lowercase();
+        Self::all(target_type)
+            .into_iter()
+            .find(|(known, _)| squeezed(known) == squeezed(name))
+            .map(|(_, target)| target)
+    }
+
+    /// Names of the targets a `target_type` device has
+    pub fn names(target_type: TargetType) -> Vec<String> {
+        Self::all(target_type).into_iter().map(|(name, _)| name).collect()
+    }
+
+    /// What pressing or letting go of the source sends; wheels turn on the
+    /// press only
+    pub fn output(self, pressed: bool) -> Option<OutputEvent> {
+        match self {
+            Self::Key(code) => {
+                let event_type =
+                    if pressed { KeyboardEventType::Press } else { KeyboardEventType::Release };
+                Some(OutputEvent::Keyboard { code, event_type })
+            }
+            Self::MouseButton(button) => {
+                Some(OutputEvent::Mouse(MouseEvent::Button { button, pressed }))
+            }
+            Self::Wheel { vertical, horizontal } => {
+                pressed.then_some(OutputEvent::Mouse(MouseEvent::Scroll { vertical, horizontal }))
+            }
+            Self::Gamepad(control) => Some(OutputEvent::Gamepad { control, pressed }),
+        }
+    }
+}
+
+/// A device target, sent to the profile's custom device named `device` if
+/// there is one
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RoutedTarget {
+    pub target: DeviceTarget,
+    pub device: Option<Arc<str>>,
+}
+
+impl RoutedTarget {
+    /// What pressing or letting go of the source sends, and where
+    pub fn output(&self, pressed: bool) -> Option<OutputEvent> {
+        let event = self.target.output(pressed)?;
+        Some(match &self.device {
+            Some(device) => OutputEvent::Routed { device: device.clone(), event: Box::new(event) },
+            None => event,
+        })
+    }
+}
+
+/// When a stick direction counts as flicked (see `MappingRule::Flick`)
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Flick {
+    /// How far the stick has to go, from 0 at rest to 32767 all the way
+    #[serde(default = "Flick::default_threshold")]
+    pub threshold: i32,
+    /// Time after a flick during which the same stick axis can't flick again
+    #[serde(default = "Flick::default_cooldown_ms")]
+    pub cooldown_ms: u32,
+}
+
+impl Flick {
+    fn default_threshold() -> i32 {
+        20000
+    }
+
+    fn default_cooldown_ms() -> u32 {
+        150
+    }
+
+    /// Why the threshold can't work, if it can't
+    pub fn problem(&self) -> Option<String> {
+        let lowest = InputEvent::STICK_DEADZONE + 1;
+        (self.threshold < lowest || self.threshold > AxisRange::STICK.max).then(|| {
+            format!(
+                "threshold {} must be between {} and {}",
+                self.threshold,
+                lowest,
+                AxisRange::STICK.max
+            )
+        })
+    }
+}
+
+impl Default for Flick {
+    fn default() -> Self {
+        Self { threshold: Self::default_threshold(), cooldown_ms: Self::default_cooldown_ms() }
+    }
+}
+
+/// What a flick presses until the stick is back at rest
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum FlickTarget {
+    /// Pressed in order and let go in reverse, like Left Control+=
+    Keys(Vec<KeyboardCode>),
+    Device(DeviceTarget),
+}
+
+impl FlickTarget {
+    /// The target of a `target_type` mapping called `name`: a key or keys
+    /// joined by `+`, a desktop action, or a mouse or gamepad control
+    pub fn from_name(target_type: TargetType, name: &str) -> Option<Self> {
+        match target_type {
+            TargetType::Keyboard => {
+                // Whole first, for keys like "Kp +"
+                if KeyboardCode::from(name) != KeyboardCode::Unknown {
+                    return Some(Self::Keys(vec![KeyboardCode::from(name)]));
+                }
+                let keys: Vec<KeyboardCode> =
+                    name.split('+').map(|key| KeyboardCode::from(key.trim())).collect();
+                (!keys.contains(&KeyboardCode::Unknown)).then_some(Self::Keys(keys))
+            }
+            TargetType::Desktop => {
+                DesktopAction::from_name(name).map(|action| Self::Keys(vec![action.key()]))
+            }
+            TargetType::Mouse | TargetType::Gamepad => {
+                DeviceTarget::from_name(target_type, name).map(Self::Device)
+            }
+            _ => None,
+        }
+    }
+
+    /// Append what the flick going out, or the stick coming back, sends
+    pub fn output(&self, pressed: bool, out: &mut Vec<OutputEvent>) {
+        match self {
+            Self::Keys(keys) if pressed => {
+                out.extend(keys.iter().map(|&code| OutputEvent::Keyboard {
+                    code,
+                    event_type: KeyboardEventType::Press,
+                }))
+            }
+            Self::Keys(keys) => out.extend(keys.iter().rev().map(|&code| OutputEvent::Keyboard {
+                code,
+                event_type: KeyboardEventType::Release,
+            })),
+            Self::Device(target) => out.extend(target.output(pressed)),
+        }
+    }
 }
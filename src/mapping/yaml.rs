@@ -0,0 +1,602 @@
+// Just enough YAML for profiles
+//
+// Profiles only need a small, predictable subset: block mappings and lists,
+// one-line flow `[..]` and `{..}`, quoted and plain scalars, and comments.
+// Anchors, tags, multi-line scalars and multiple documents are rejected
+// rather than misread. Documents decode to TOML values, which is what
+// profiles are validated as, so nulls (which TOML can't hold) are errors too.
+
+use toml::{Table, Value};
+
+#[derive(Debug, Clone, PartialEq, Eq, thiserror::Error)]
+#[error("{message} on line {line}")]
+pub struct YamlError {
+    pub message: String,
+    pub line: usize,
+}
+
+fn error<T>(line: usize, message: impl Into<String>) -> Result<T, YamlError> {
+    Err(YamlError { message: message.into(), line })
+}
+
+/// Parse a document whose top level is a mapping
+pub fn parse(text: &str) -> Result<Table, YamlError> {
+    let lines = lines(text)?;
+    let Some(first) = lines.first().copied() else {
+        return Ok(Table::new());
+    };
+    let mut parser = Parser { lines, pos: 0 };
+    let document = parser.block(first.indent)?;
+    if let Some(line) = parser.peek() {
+        return error(line.number, "unexpected indentation");
+    }
+    match document {
+        Value::Table(table) => Ok(table),
+        _ => error(first.number, "a profile must be a mapping of keys to values"),
+    }
+}
+
+/// Block style for nested mappings and lists of mappings, flow for the rest
+pub fn to_string(document: &Table) -> String {
+    let mut out = String::new();
+    write_table(document, 0, &mut out);
+    out
+}
+
+#[derive(Debug, Clone, Copy)]
+struct Line<'a> {
+    number: usize,
+    indent: usize,
+    // Without indentation, comment and trailing whitespace
+    text: &'a str,
+}
+
+fn lines(text: &str) -> Result<Vec<Line<'_>>, YamlError> {
+    let mut lines = Vec::new();
+    for (index, raw) in text.lines().enumerate() {
+        let number = index + 1;
+        let content = strip_comment(raw).trim_end();
+        let text = content.trim_start_matches(' ');
+        if text.is_empty() {
+            continue;
+        }
+        if text.starts_with('\t') {
+            return error(number, "tabs can't indent YAML; use spaces");
+        }
+        let indent = content.len() - text.len();
+        match text {
+            "---" if indent == 0 && lines.is_empty() => continue,
+            "---" | "..." => return error(number, "only one document per file is supported"),
+            _ if text.starts_with('%') => return error(number, "YAML directives aren't supported"),
+            _ => lines.push(Line { number, indent, text }),
+        }
+    }
+    Ok(lines)
+}
+
+/// Cut a `#` comment that starts a line or follows whitespace, outside quotes
+fn strip_comment(line: &str) -> &str {
+    let (mut single, mut double, mut escaped) = (false, false, false);
+    let mut previous = ' ';
+    for (i, c) in line.char_indices() {
+        match c {
+            _ if escaped => escaped = false,
+            '\\' if double => escaped = true,
+            '"' if !single => double = !double,
+            '\'' if !double => single = !single,
+            '#' if !single && !double && previous.is_whitespace() => return &line[..i],
+            _ => {}
+        }
+        previous = c;
+    }
+    line
+}
+
+fn is_list_item(text: &str) -> bool {
+    text == "-" || text.starts_with("- ")
+}
+
+/// Split `key: value` (value may be empty); None if the text isn't an entry
+fn split_entry(text: &str) -> Option<(String, &str)> {
+    if text.starts_with(['"', '\'']) {
+        let mut flow = Flow { text, pos: 0, line: 0 };
+        let Ok(Value::String(key)) = flow.quoted() else {
+            return None;
+        };
+        let rest = &text[flow.pos..];
+        return (rest == ":" || rest.starts_with(": ")).then(|| (key, rest[1..].trim()));
+    }
+    if text.starts_with(['[', '{']) || is_list_item(text) {
+        return None;
+    }
+    let (key, value) = match text.find(": ") {
+        Some(at) => (&text[..at], &text[at + 2..]),
+        None => (text.strip_suffix(':')?, ""),
+    };
+    let key = key.trim_end();
+    (!key.is_empty()).then(|| (key.to_string(), value.trim()))
+}
+
+struct Parser<'a> {
+    lines: Vec<Line<'a>>,
+    pos: usize,
+}
+
+impl<'a> Parser<'a> {
+    fn peek(&self) -> Option<Line<'a>> {
+        self.lines.get(self.pos).copied()
+    }
+
+    fn block(&mut self, indent: usize) -> Result<Value, YamlError> {
+        match self.peek() {
+            Some(line) if is_list_item(line.text) => self.list(indent),
+            _ => self.mapping(indent),
+        }
+    }
+
+    fn mapping(&mut self, indent: usize) -> Result<Value, YamlError> {
+        let mut table = Table::new();
+        while let Some(line) = self.peek() {
+            if line.indent < indent {
+                break;
+            }
+            if line.indent > indent {
+                return error(line.number, "unexpected indentation");
+            }
+            let Some((key, rest)) = split_entry(line.text) else {
+                return error(line.number, "expected 'key: value'");
+            };
+            let number = line.number;
+            self.pos += 1;
+
+            let value = if rest.is_empty() {
+                match self.peek() {
+                    Some(next) if next.indent > indent => self.block(next.indent)?,
+                    // Lists may sit at their key's indentation
+                    Some(next) if next.indent == indent && is_list_item(next.text) => {
+                        self.list(indent)?
+                    }
+                    _ => return error(number, format!("'{}' has no value", key)),
+                }
+            } else {
+                flow(rest, number)?
+            };
+            if table.contains_key(&key) {
+                return error(number, format!("duplicate key '{}'", key));
+            }
+            table.insert(key, value);
+        }
+        Ok(Value::Table(table))
+    }
+
+    fn list(&mut self, indent: usize) -> Result<Value, YamlError> {
+        let mut items = Vec::new();
+        while let Some(line) = self.peek() {
+            if line.indent > indent {
+                return error(line.number, "unexpected indentation");
+            }
+            if line.indent < indent || !is_list_item(line.text) {
+                break;
+            }
+            let rest = line.text[1..].trim_start();
+            if rest.is_empty() {
+                self.pos += 1;
+                match self.peek() {
+                    Some(next) if next.indent > indent => items.push(self.block(next.indent)?),
+                    _ => return error(line.number, "empty list item"),
+                }
+            } else if split_entry(rest).is_some() || is_list_item(rest) {
+                // A nested block starting after the dash: read it as if the
+                // dash were indentation
+                let nested = indent + (line.text.len() - rest.len());
+                self.lines[self.pos] = Line { indent: nested, text: rest, ..line };
+                items.push(self.block(nested)?);
+            } else {
+                self.pos += 1;
+                items.push(flow(rest, line.number)?);
+            }
+        }
+        Ok(Value::Array(items))
+    }
+}
+
+/// A scalar or a one-line flow collection
+fn flow(text: &str, line: usize) -> Result<Value, YamlError> {
+    let mut flow = Flow { text, pos: 0, line };
+    let value = flow.value(false)?;
+    flow.skip_spaces();
+    match flow.peek() {
+        None => Ok(value),
+        Some(c) => error(line, format!("unexpected '{}'", c)),
+    }
+}
+
+struct Flow<'a> {
+    text: &'a str,
+    pos: usize,
+    line: usize,
+}
+
+impl<'a> Flow<'a> {
+    fn peek(&self) -> Option<char> {
+        self.text[self.pos..].chars().next()
+    }
+
+    fn bump(&mut self) -> Option<char> {
+        let c = self.peek()?;
+        self.pos += c.len_utf8();
+        Some(c)
+    }
+
+    fn skip_spaces(&mut self) {
+        while self.peek() == Some(' ') {
+            self.pos += 1;
+        }
+    }
+
+    fn value(&mut self, in_flow: bool) -> Result<Value, YamlError> {
+        self.skip_spaces();
+        match self.peek() {
+            Some('[') => self.sequence(),
+            Some('{') => self.table(),
+            Some('"' | '\'') => self.quoted(),
+            Some(c @ ('&' | '*')) => {
+                error(self.line, format!("YAML anchors ('{}') aren't supported", c))
+            }
+            Some('!') => error(self.line, "YAML tags aren't supported"),
+            Some('|' | '>') => error(self.line, "multi-line strings aren't supported"),
+            Some(c @ ('@' | '`')) => error(self.line, format!("'{}' can't start a value", c)),
+            _ => {
+                let text = self.plain(in_flow);
+                match plain_scalar(text) {
+                    _ if text.is_empty() => error(self.line, "missing value"),
+                    Some(value) => Ok(value),
+                    None => error(self.line, "null values aren't supported; leave the key out"),
+                }
+            }
+        }
+    }
+
+    fn sequence(&mut self) -> Result<Value, YamlError> {
+        self.bump();
+        let mut items = Vec::new();
+        loop {
+            self.skip_spaces();
+            if self.peek() == Some(']') {
+                self.bump();
+                return Ok(Value::Array(items));
+            }
+            items.push(self.value(true)?);
+            self.skip_spaces();
+            match self.bump() {
+                Some(',') => {}
+                Some(']') => return Ok(Value::Array(items)),
+                _ => return error(self.line, "expected ',' or ']'"),
+            }
+        }
+    }
+
+    fn table(&mut self) -> Result<Value, YamlError> {
+        self.bump();
+        let mut table = Table::new();
+        loop {
+            self.skip_spaces();
+            if self.peek() == Some('}') {
+                self.bump();
+                return Ok(Value::Table(table));
+            }
+            let key = match self.value(true)? {
+                Value::String(key) => key,
+                other => other.to_string(),
+            };
+            self.skip_spaces();
+            if self.bump() != Some(':') {
+                return error(self.line, format!("expected ':' after '{}'", key));
+            }
+            let value = self.value(true)?;
+            if table.insert(key.clone(), value).is_some() {
+                return error(self.line, format!("duplicate key '{}'", key));
+            }
+            self.skip_spaces();
+            match self.bump() {
+                Some(',') => {}
+                Some('}') => return Ok(Value::Table(table)),
+                _ => return error(self.line, "expected ',' or '}'"),
+            }
+        }
+    }
+
+    fn quoted(&mut self) -> Result<Value, YamlError> {
+        let quote = self.bump();
+        let mut out = String::new();
+        loop {
+            match (quote, self.bump()) {
+                (_, None) => return error(self.line, "unterminated string"),
+                (Some('\''), Some('\'')) if self.peek() == Some('\'') => {
+                    self.bump();
+                    out.push('\'');
+                }
+                (q, Some(c)) if Some(c) == q => return Ok(Value::String(out)),
+                (Some('"'), Some('\\')) => out.push(self.escape()?),
+                (_, Some(c)) => out.push(c),
+            }
+        }
+    }
+
+    fn escape(&mut self) -> Result<char, YamlError> {
+        Ok(match self.bump() {
+            Some('n') => '\n',
+            Some('t') => '\t',
+            Some('r') => '\r',
+            Some('0') => '\0',
+            Some('b') => '\u{8}',
+            Some('f') => '\u{c}',
+            Some(c @ ('"' | '\\' | '/' | ' ')) => c,
+            Some('u') => {
+                let hex = self.text.get(self.pos..self.pos + 4).unwrap_or("");
+                self.pos += hex.len();
+                match u32::from_str_radix(hex, 16).ok().and_then(char::from_u32) {
+                    Some(c) => c,
+                    None => return error(self.line, "invalid \\u escape"),
+                }
+            }
+            _ => return error(self.line, "unknown escape in string"),
+        })
+    }
+
+    /// Unquoted text, up to the end or, in flow context, a `,]}` or `: `
+    fn plain(&mut self, in_flow: bool) -> &'a str {
+        let start = self.pos;
+        while let Some(c) = self.peek() {
+            if in_flow {
+                let next = self.text[self.pos + 1..].chars().next();
+                let ends_key = c == ':' && next.is_none_or(|n| matches!(n, ' ' | ',' | ']' | '}'));
+                if matches!(c, ',' | ']' | '}') || ends_key {
+                    break;
+                }
+            }
+            self.pos += c.len_utf8();
+        }
+        self.text[start..self.pos].trim_end()
+    }
+}
+
+/// What an unquoted scalar means; None for null
+fn plain_scalar(text: &str) -> Option<Value> {
+    Some(match text {
+        "null" | "Null" | "NULL" | "~" => return None,
+        "true" | "True" | "TRUE" => Value::Boolean(true),
+        "false" | "False" | "FALSE" => Value::Boolean(false),
+        ".inf" | ".Inf" | ".INF" | "+.inf" => Value::Float(f64::INFINITY),
+        "-.inf" | "-.Inf" | "-.INF" => Value::Float(f64::NEG_INFINITY),
+        ".nan" | ".NaN" | ".NAN" => Value::Float(f64::NAN),
+        _ => {
+            let numeric = text.bytes().any(|b| b.is_ascii_digit())
+                && text.bytes().all(|b| b.is_ascii_digit() || b"+-.eE".contains(&b));
+            if let (true, Ok(n)) = (numeric, text.parse::<i64>()) {
+                Value::Integer(n)
+            } else if let (true, Ok(x)) = (numeric, text.parse::<f64>()) {
+                Value::Float(x)
+            } else {
+                Value::String(text.to_string())
+            }
+        }
+    })
+}
+
+fn write_table(table: &Table, indent: usize, out: &mut String) {
+    for (key, value) in table {
+        pad(indent, out);
+        write_entry(key, value, indent, out);
+    }
+}
+
+/// `key: value`, the key already indented
+fn write_entry(key: &str, value: &Value, indent: usize, out: &mut String) {
+    write_string(key, out);
+    out.push(':');
+    match value {
+        Value::Table(table) if !table.is_empty() => {
+            out.push('\n');
+            write_table(table, indent + 2, out);
+        }
+        Value::Array(items) if is_block(items) => {
+            out.push('\n');
+            write_list(items, indent + 2, out);
+        }
+        other => {
+            out.push(' ');
+            write_flow(other, out);
+            out.push('\n');
+        }
+    }
+}
+
+fn write_list(items: &[Value], indent: usize, out: &mut String) {
+    for item in items {
+        pad(indent, out);
+        out.push('-');
+        match item {
+            // First entry on the dash's line, the rest lined up under it
+            Value::Table(table) if !table.is_empty() => {
+                for (i, (key, value)) in table.iter().enumerate() {
+                    if i == 0 {
+                        out.push(' ');
+                    } else {
+                        pad(indent + 2, out);
+                    }
+                    write_entry(key, value, indent + 2, out);
+                }
+            }
+            Value::Array(inner) if is_block(inner) => {
+                out.push('\n');
+                write_list(inner, indent + 2, out);
+            }
+            other => {
+                out.push(' ');
+                write_flow(other, out);
+                out.push('\n');
+            }
+        }
+    }
+}
+
+/// Lists holding mappings are written as blocks, others inline
+fn is_block(items: &[Value]) -> bool {
+    items.iter().any(|item| matches!(item, Value::Table(table) if !table.is_empty()))
+}
+
+fn write_flow(value: &Value, out: &mut String) {
+    match value {
+        Value::String(s) => write_string(s, out),
+        Value::Integer(n) => out.push_str(&n.to_string()),
+        Value::Float(x) if x.is_nan() => out.push_str(".nan"),
+        Value::Float(x) if x.is_infinite() => out.push_str(if *x > 0.0 { ".inf" } else { "-.inf" }),
+        Value::Float(x) => out.push_str(&format!("{:?}", x)),
+        Value::Boolean(b) => out.push_str(&b.to_string()),
+        Value::Datetime(datetime) => write_string(&datetime.to_string(), out),
+        Value::Array(items) => {
+            out.push('[');
+            for (i, item) in items.iter().enumerate() {
+                if i > 0 {
+                    out.push_str(", ");
+                }
+                write_flow(item, out);
+            }
+            out.push(']');
+        }
+        Value::Table(table) => {
+            out.push('{');
+            for (i, (key, value)) in table.iter().enumerate() {
+                if i > 0 {
+                    out.push_str(", ");
+                }
+                write_string(key, out);
+                out.push_str(": ");
+                write_flow(value, out);
+            }
+            out.push('}');
+        }
+    }
+}
+
+/// Plain when that reads back as the same string, double-quoted otherwise
+fn write_string(s: &str, out: &mut String) {
+    let plain = !s.is_empty()
+        && plain_scalar(s) == Some(Value::String(s.to_string()))
+        && !s.starts_with(['-', '?', ':', '&', '*', '!', '|', '>', '\'', '"', '%', '@', '`', ' '])
+        && !s.ends_with([' ', ':'])
+        && !s.contains([',', '[', ']', '{', '}', '#', '\n', '\t', '\r'])
+        && !s.contains(": ");
+    if plain {
+        out.push_str(s);
+    } else {
+        // JSON strings are valid double-quoted YAML
+        out.push_str(&serde_json::Value::from(s).to_string());
+    }
+}
+
+fn pad(indent: usize, out: &mut String) {
+    out.extend(std::iter::repeat_n(' ', indent));
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_profile_shapes() {
+        let document = parse(
+            r#"---
+name: Racing   # comment
+description: "Says \"go\""
+schema_version: 1
+
+mappings:
+- source_name: South
+  target_type: Keyboard
+  target_name: 'It''s #1'
+- source_name: Mode
+  target_type: Exec
+  command: [notify-send, "a, b"]
+  params: {to: 127.0.0.1:9000, range: [-1, 1.5]}
+
+settings:
+  vibration_enabled: false
+"#,
+        )
+        .unwrap();
+
+        let expected: Table = toml::from_str(
+            r#"
+name = "Racing"
+description = 'Says "go"'
+schema_version = 1
+
+[[mappings]]
+source_name = "South"
+target_type = "Keyboard"
+target_name = "It's #1"
+
+[[mappings]]
+source_name = "Mode"
+target_type = "Exec"
+command = ["notify-send", "a, b"]
+params = { to = "127.0.0.1:9000", range = [-1, 1.5] }
+
+[settings]
+vibration_enabled = false
+"#,
+        )
+        .unwrap();
+        assert_eq!(document, expected);
+    }
+
+    #[test]
+    fn test_nested_lists() {
+        let document = parse("grid:\n  - - 1\n    - 2\n  -\n    - 3\n").unwrap();
+        let expected: Table = toml::from_str("grid = [[1, 2], [3]]").unwrap();
+        assert_eq!(document, expected);
+    }
+
+    #[test]
+    fn test_round_trip() {
+        let document: Table = toml::from_str(
+            r#"
+name = "a: b"
+plain = "Left Shift"
+numbers = ["1", "true", "", "-x"]
+float = 0.5
+big = 1e300
+empty = []
+nothing = {}
+nested = { list = [{ deep = "yes" }] }
+
+[[mappings]]
+source_name = "DPad Y"
+on = "Both"
+"#,
+        )
+        .unwrap();
+
+        let text = to_string(&document);
+        assert_eq!(parse(&text).unwrap(), document, "{}", text);
+    }
+
+    #[test]
+    fn test_errors_name_the_line() {
+        let err = |text| parse(text).unwrap_err().to_string();
+
+        assert_eq!(err("a: 1\n  b: 2\n"), "unexpected indentation on line 2");
+        assert_eq!(err("a: 1\na: 2\n"), "duplicate key 'a' on line 2");
+        assert_eq!(err("a:\nb: 1\n"), "'a' has no value on line 1");
+        assert_eq!(err("a: ~\n"), "null values aren't supported; leave the key out on line 1");
+        assert_eq!(err("a: *ref\n"), "YAML anchors ('*') aren't supported on line 1");
+        assert_eq!(err("a: |\n  text\n"), "multi-line strings aren't supported on line 1");
+        assert_eq!(err("a: [1, 2\n"), "expected ',' or ']' on line 1");
+        assert_eq!(err("a: \"open\n"), "unterminated string on line 1");
+        assert_eq!(err("- 1\n"), "a profile must be a mapping of keys to values on line 1");
+        assert_eq!(err("a: 1\n---\nb: 2\n"), "only one document per file is supported on line 2");
+        assert_eq!(err("\ta: 1\n"), "tabs can't indent YAML; use spaces on line 1");
+    }
+}
@@ -0,0 +1,127 @@
+// How a running session is holding up, for `blazeremap status`
+//
+// The event loop keeps the profile it maps with here, and the problems it
+// carried on through, like a profile switched to whose actions didn't
+// start. Controllers that went away are found when asked: their device
+// nodes are gone, and ones that flooded events by the frames their storm
+// guard merged.
+
+use std::fmt::Display;
+use std::path::Path;
+use std::sync::Mutex;
+
+use serde::{Deserialize, Serialize};
+
+#[derive(Debug, Default)]
+pub struct SessionHealth {
+    profile: Mutex<Option<String>>,
+    problems: Mutex<Vec<String>>,
+}
+
+impl SessionHealth {
+    /// A session mapping with `profile`, None for the built-in mappings
+    pub fn new(profile: Option<&str>) -> Self {
+        Self { profile: Mutex::new(profile.map(str::to_string)), problems: Mutex::default() }
+    }
+
+    pub fn set_profile(&self, name: &str) {
+        if let Ok(mut profile) = self.profile.lock() {
+            *profile = Some(name.to_string());
+        }
+    }
+
+    /// Note something the session lives with from now on
+    pub fn report(&self, problem: impl Display) {
+        if let Ok(mut problems) = self.problems.lock() {
+            problems.push(problem.to_string());
+        }
+    }
+
+    /// The session reading `devices`, as it is now
+    pub fn status(&self, devices: &[String]) -> SessionStatus {
+        SessionStatus {
+            pid: std::process::id(),
+            session_id: crate::logging::session_id(),
+            profile: self.profile.lock().ok().and_then(|profile| profile.clone()),
+            devices: devices
+                .iter()
+                .map(|path| DeviceStatus {
+                    path: path.clone(),
+                    connected: Path::new(path).exists(),
+                    merged: crate::input::storm::merged_frames(path),
+                })
+                .collect(),
+            problems: self.problems.lock().map(|problems| problems.clone()).unwrap_or_default(),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SessionStatus {
+    pub pid: u32,
+    /// As in the daemon's log entries
+    pub session_id: Option<String>,
+    /// None for the built-in mappings
+    pub profile: Option<String>,
+    pub devices: Vec<DeviceStatus>,
+    pub problems: Vec<String>,
+}
+
+impl SessionStatus {
+    /// Everything wrong with the session: controllers gone, controllers
+    /// flooding events, then problems
+    pub fn degraded(&self) -> Vec<String> {
+        let gone = self.devices.iter().filter(|device| !device.connected);
+        let flooding = self.devices.iter().filter(|device| device.merged > 0);
+        gone.map(|device| format!("{} disconnected", device.path))
+            .chain(flooding.map(|device| {
+                format!("{} flooded events: {} frames merged", device.path, device.merged)
+            }))
+            .chain(self.problems.iter().cloned())
+            .collect()
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DeviceStatus {
+    pub path: String,
+    pub connected: bool,
+    /// Frames sent beyond the storm limit, merged into others
+    #[serde(default)]
+    pub merged: u64,
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_status_reports_switches_and_problems() {
+        let health = SessionHealth::new(Some("Default"));
+        health.set_profile("Racing");
+        health.report("Profile 'Racing': no actions: xdotool not allowed");
+        let here = env!("CARGO_MANIFEST_DIR").to_string();
+        let status = health.status(&[here.clone(), "/dev/input/event-gone".to_string()]);
+
+        assert_eq!(status.pid, std::process::id());
+        assert_eq!(status.profile.as_deref(), Some("Racing"));
+        assert_eq!(
+            status.devices,
+            [
+                DeviceStatus { path: here, connected: true, merged: 0 },
+                DeviceStatus {
+                    path: "/dev/input/event-gone".to_string(),
+                    connected: false,
+                    merged: 0
+                },
+            ]
+        );
+        assert_eq!(
+            status.degraded(),
+            [
+                "/dev/input/event-gone disconnected",
+                "Profile 'Racing': no actions: xdotool not allowed"
+            ]
+        );
+    }
+}
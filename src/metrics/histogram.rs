@@ -0,0 +1,136 @@
+// Lock-free latency histogram with power-of-two microsecond buckets
+//
+// Bucket 0 holds values below 1µs; bucket i (i >= 1) holds values in
+// [2^(i-1), 2^i) µs. That is coarse, but recording is three relaxed atomic
+// adds, cheap enough to leave on in the hot path.
+
+use serde::{Deserialize, Serialize};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::Duration;
+
+/// Number of buckets; the last one also takes everything above ~16s
+pub const BUCKETS: usize = 26;
+
+#[derive(Debug)]
+pub struct Histogram {
+    buckets: [AtomicU64; BUCKETS],
+    sum_us: AtomicU64,
+    max_us: AtomicU64,
+}
+
+impl Histogram {
+    pub fn new() -> Self {
+        Self {
+            buckets: std::array::from_fn(|_| AtomicU64::new(0)),
+            sum_us: AtomicU64::new(0),
+            max_us: AtomicU64::new(0),
+        }
+    }
+
+    pub fn record(&self, duration: Duration) {
+        let us = duration.as_micros().min(u64::MAX as u128) as u64;
+        self.buckets[bucket_index(us)].fetch_add(1, Ordering::Relaxed);
+        self.sum_us.fetch_add(us, Ordering::Relaxed);
+        self.max_us.fetch_max(us, Ordering::Relaxed);
+    }
+
+    pub fn snapshot(&self) -> HistogramSnapshot {
+        HistogramSnapshot {
+            buckets: self.buckets.iter().map(|b| b.load(Ordering::Relaxed)).collect(),
+            sum_us: self.sum_us.load(Ordering::Relaxed),
+            max_us: self.max_us.load(Ordering::Relaxed),
+        }
+    }
+}
+
+impl Default for Histogram {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+fn bucket_index(us: u64) -> usize {
+    ((u64::BITS - us.leading_zeros()) as usize).min(BUCKETS - 1)
+}
+
+/// Exclusive upper bound (µs) of a bucket
+fn bucket_upper_us(index: usize) -> u64 {
+    1 << index
+}
+
+/// Point-in-time copy of a histogram, as sent over IPC
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HistogramSnapshot {
+    pub buckets: Vec<u64>,
+    pub sum_us: u64,
+    pub max_us: u64,
+}
+
+impl HistogramSnapshot {
+    pub fn count(&self) -> u64 {
+        self.buckets.iter().sum()
+    }
+
+    pub fn mean_us(&self) -> Option<u64> {
+        let count = self.count();
+        (count > 0).then(|| self.sum_us / count)
+    }
+
+    /// Upper bound (µs) of the bucket holding the p-th percentile
+    ///
+    /// Capped at the observed maximum, so a single sample reports exactly.
+    pub fn percentile_us(&self, p: f64) -> Option<u64> {
+        let count = self.count();
+        if count == 0 {
+            return None;
+        }
+
+        let rank = ((p / 100.0) * count as f64).ceil().max(1.0) as u64;
+        let mut seen = 0;
+        for (index, &bucket) in self.buckets.iter().enumerate() {
+            seen += bucket;
+            if seen >= rank {
+                return Some(bucket_upper_us(index).min(self.max_us));
+            }
+        }
+        Some(self.max_us)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_bucket_index() {
+        assert_eq!(bucket_index(0), 0);
+        assert_eq!(bucket_index(1), 1);
+        assert_eq!(bucket_index(3), 2);
+        assert_eq!(bucket_index(64), 7);
+        assert_eq!(bucket_index(u64::MAX), BUCKETS - 1);
+    }
+
+    #[test]
+    fn test_snapshot_statistics() {
+        let histogram = Histogram::new();
+        for us in [10, 20, 30, 40, 1000] {
+            histogram.record(Duration::from_micros(us));
+        }
+
+        let snapshot = histogram.snapshot();
+        assert_eq!(snapshot.count(), 5);
+        assert_eq!(snapshot.mean_us(), Some(220));
+        assert_eq!(snapshot.max_us, 1000);
+        // 30µs lives in [16, 32)
+        assert_eq!(snapshot.percentile_us(50.0), Some(32));
+        assert_eq!(snapshot.percentile_us(100.0), Some(1000));
+    }
+
+    #[test]
+    fn test_empty_snapshot() {
+        let snapshot = Histogram::new().snapshot();
+        assert_eq!(snapshot.count(), 0);
+        assert_eq!(snapshot.mean_us(), None);
+        assert_eq!(snapshot.percentile_us(99.0), None);
+    }
+}
@@ -0,0 +1,143 @@
+// Pipeline metrics
+//
+// The event loop records per-frame stage timings here; the daemon hands out
+// snapshots over its control socket (`blazeremap status --metrics`) and sums
+// up the last one when it stops. Next to them it keeps the session's health:
+// the profile in use and what it carried on through.
+//
+// Stages:
+// - read:  kernel event timestamp → frame picked up by the mapper (includes
+//          the reader thread and the ring buffer)
+// - map:   mapping engine over the whole frame
+// - write: emitting the frame on the virtual device
+
+mod health;
+mod histogram;
+mod summary;
+
+pub use health::{DeviceStatus, SessionHealth, SessionStatus};
+pub use histogram::{BUCKETS, Histogram, HistogramSnapshot};
+pub use summary::{Percentiles, SessionEnd, SessionSummary, format_uptime};
+
+use crate::event::RingCounters;
+use serde::{Deserialize, Serialize};
+use std::sync::OnceLock;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, Instant};
+
+#[derive(Debug)]
+pub struct PipelineMetrics {
+    started: Instant,
+    pub read: Histogram,
+    pub map: Histogram,
+    pub write: Histogram,
+    frames: AtomicU64,
+    events: AtomicU64,
+    debounced: AtomicU64,
+    ring: OnceLock<RingCounters>,
+}
+
+impl PipelineMetrics {
+    pub fn new() -> Self {
+        Self {
+            started: Instant::now(),
+            read: Histogram::new(),
+            map: Histogram::new(),
+            write: Histogram::new(),
+            frames: AtomicU64::new(0),
+            events: AtomicU64::new(0),
+            debounced: AtomicU64::new(0),
+            ring: OnceLock::new(),
+        }
+    }
+
+    /// Count a processed frame of `events` input events
+    pub fn record_frame(&self, events: usize) {
+        self.frames.fetch_add(1, Ordering::Relaxed);
+        self.events.fetch_add(events as u64, Ordering::Relaxed);
+    }
+
+    /// Publish the mapper's running total of debounced button events
+    pub fn set_debounced(&self, total: u64) {
+        self.debounced.store(total, Ordering::Relaxed);
+    }
+
+    /// Include the drop counters of the ring feeding the pipeline
+    pub fn attach_ring(&self, counters: RingCounters) {
+        let _ = self.ring.set(counters);
+    }
+
+    pub fn snapshot(&self) -> MetricsSnapshot {
+        MetricsSnapshot {
+            uptime: self.started.elapsed(),
+            frames: self.frames.load(Ordering::Relaxed),
+            events: self.events.load(Ordering::Relaxed),
+            dropped: self.ring.get().map_or(0, |ring| ring.snapshot().dropped),
+            debounced: self.debounced.load(Ordering::Relaxed),
+            read: self.read.snapshot(),
+            map: self.map.snapshot(),
+            write: self.write.snapshot(),
+        }
+    }
+}
+
+impl Default for PipelineMetrics {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct MetricsSnapshot {
+    pub uptime: Duration,
+    pub frames: u64,
+    pub events: u64,
+    pub dropped: u64,
+    #[serde(default)]
+    pub debounced: u64,
+    pub read: HistogramSnapshot,
+    pub map: HistogramSnapshot,
+    pub write: HistogramSnapshot,
+}
+
+impl MetricsSnapshot {
+    /// Average rate per second over the uptime
+    pub fn rate(&self, count: u64) -> f64 {
+        let secs = self.uptime.as_secs_f64();
+        if secs > 0.0 { count as f64 / secs } else { 0.0 }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::ring;
+
+    #[test]
+    fn test_snapshot_counts_frames_and_drops() {
+        let metrics = PipelineMetrics::new();
+        let (mut producer, _consumer) = ring::<u8>(2);
+        metrics.attach_ring(producer.counters());
+        for i in 0..3 {
+            producer.push(i);
+        }
+
+        metrics.record_frame(2);
+        metrics.record_frame(1);
+        metrics.map.record(Duration::from_micros(5));
+
+        let snapshot = metrics.snapshot();
+        assert_eq!((snapshot.frames, snapshot.events, snapshot.dropped), (2, 3, 1));
+        assert_eq!(snapshot.map.count(), 1);
+    }
+
+    #[test]
+    fn test_snapshot_round_trips_through_json() {
+        let metrics = PipelineMetrics::new();
+        metrics.write.record(Duration::from_micros(42));
+
+        let snapshot = metrics.snapshot();
+        let json = serde_json::to_string(&snapshot).unwrap();
+        assert_eq!(serde_json::from_str::<MetricsSnapshot>(&json).unwrap(), snapshot);
+    }
+}
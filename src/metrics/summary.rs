@@ -0,0 +1,174 @@
+// What a remapping session did, for when it ends
+//
+// Built from the pipeline metrics' last snapshot. `run` prints it on the
+// way out and can save it too, as text or (for a .json path) JSON.
+
+use std::fmt::{Display, Formatter, Result as FmtResult};
+use std::path::Path;
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use serde::Serialize;
+
+use super::{HistogramSnapshot, MetricsSnapshot};
+
+/// Why a session ended
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum SessionEnd {
+    /// The controller went away; sessions don't wait for it to come back
+    Disconnected,
+    /// Ctrl+C or SIGTERM
+    Interrupted,
+    /// Stopped by an error
+    Failed,
+}
+
+impl Display for SessionEnd {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        match self {
+            Self::Disconnected => write!(f, "controller disconnected"),
+            Self::Interrupted => write!(f, "interrupted"),
+            Self::Failed => write!(f, "failed"),
+        }
+    }
+}
+
+/// Percentiles of a latency histogram, in µs; None without samples
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize)]
+pub struct Percentiles {
+    pub p50: Option<u64>,
+    pub p95: Option<u64>,
+    pub p99: Option<u64>,
+    pub max: Option<u64>,
+}
+
+impl From<&HistogramSnapshot> for Percentiles {
+    fn from(histogram: &HistogramSnapshot) -> Self {
+        Self {
+            p50: histogram.percentile_us(50.0),
+            p95: histogram.percentile_us(95.0),
+            p99: histogram.percentile_us(99.0),
+            max: (histogram.count() > 0).then_some(histogram.max_us),
+        }
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct SessionSummary {
+    pub ended: SessionEnd,
+    pub duration_secs: f64,
+    pub frames: u64,
+    pub events: u64,
+    /// Mapping engine time per frame
+    pub translation_us: Percentiles,
+    /// Lost to a full ring buffer
+    pub dropped: u64,
+    /// Filtered out as switch bounce
+    pub debounced: u64,
+}
+
+impl SessionSummary {
+    pub fn new(snapshot: &MetricsSnapshot, ended: SessionEnd) -> Self {
+        Self {
+            ended,
+            duration_secs: snapshot.uptime.as_secs_f64(),
+            frames: snapshot.frames,
+            events: snapshot.events,
+            translation_us: Percentiles::from(&snapshot.map),
+            dropped: snapshot.dropped,
+            debounced: snapshot.debounced,
+        }
+    }
+
+    /// Write to `path`: JSON if it ends in .json, the printed text otherwise
+    pub fn save(&self, path: &Path) -> Result<()> {
+        let text = match path.extension().is_some_and(|extension| extension == "json") {
+            true => serde_json::to_string_pretty(self)? + "\n",
+            false => self.to_string(),
+        };
+        std::fs::write(path, text).with_context(|| format!("Failed to write {}", path.display()))
+    }
+}
+
+impl Display for SessionSummary {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        let cell = |value: Option<u64>| value.map_or("-".to_string(), |v| format!("{}µs", v));
+        let latency = &self.translation_us;
+        let rate = match self.duration_secs > 0.0 {
+            true => self.events as f64 / self.duration_secs,
+            false => 0.0,
+        };
+        writeln!(f, "Session summary")?;
+        writeln!(
+            f,
+            "  Duration:    {}",
+            format_uptime(Duration::from_secs_f64(self.duration_secs))
+        )?;
+        writeln!(f, "  Ended:       {}", self.ended)?;
+        writeln!(f, "  Events:      {} in {} frames ({:.1}/s)", self.events, self.frames, rate)?;
+        writeln!(
+            f,
+            "  Translation: p50 {}, p95 {}, p99 {}, max {}",
+            cell(latency.p50),
+            cell(latency.p95),
+            cell(latency.p99),
+            cell(latency.max)
+        )?;
+        writeln!(f, "  Dropped:     {} (ring buffer full)", self.dropped)?;
+        writeln!(f, "  Debounced:   {}", self.debounced)
+    }
+}
+
+/// A duration as hours, minutes and seconds, like "25h 01m 01s"
+pub fn format_uptime(uptime: Duration) -> String {
+    let secs = uptime.as_secs();
+    format!("{}h {:02}m {:02}s", secs / 3600, secs / 60 % 60, secs % 60)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::metrics::PipelineMetrics;
+    use serde_json::Value;
+
+    #[test]
+    fn test_format_uptime() {
+        assert_eq!(format_uptime(Duration::from_secs(59)), "0h 00m 59s");
+        assert_eq!(format_uptime(Duration::from_secs(90061)), "25h 01m 01s");
+    }
+
+    #[test]
+    fn test_summary_text_and_json() {
+        let metrics = PipelineMetrics::new();
+        metrics.record_frame(3);
+        metrics.map.record(Duration::from_micros(5));
+        metrics.set_debounced(2);
+        let mut snapshot = metrics.snapshot();
+        snapshot.uptime = Duration::from_secs(61);
+
+        let summary = SessionSummary::new(&snapshot, SessionEnd::Disconnected);
+        assert_eq!(
+            summary.to_string(),
+            "Session summary\n  \
+             Duration:    0h 01m 01s\n  \
+             Ended:       controller disconnected\n  \
+             Events:      3 in 1 frames (0.0/s)\n  \
+             Translation: p50 5µs, p95 5µs, p99 5µs, max 5µs\n  \
+             Dropped:     0 (ring buffer full)\n  \
+             Debounced:   2\n"
+        );
+
+        let json = serde_json::to_value(&summary).unwrap();
+        assert_eq!(json["ended"], "disconnected");
+        assert_eq!(json["translation_us"]["p99"], 5);
+        assert_eq!(json["events"], 3);
+    }
+
+    #[test]
+    fn test_summary_without_samples() {
+        let summary = SessionSummary::new(&MetricsSnapshot::default(), SessionEnd::Interrupted);
+        assert!(summary.to_string().contains("Translation: p50 -, p95 -, p99 -, max -\n"));
+        assert_eq!(serde_json::to_value(&summary).unwrap()["translation_us"]["p50"], Value::Null);
+    }
+}
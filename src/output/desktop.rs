@@ -0,0 +1,621 @@
+// Desktop mode: the controller as a mouse, next to its keys
+//
+// While on, the left stick moves the pointer, the right stick scrolls, the
+// triggers click (right for the left button, left for the right one) and
+// pressing the right stick middle-clicks. Everything else is read on as
+// the controller's own, so the profile turns it into keys as usual. A chord
+// of buttons switches desktop mode off, leaving the controller to games,
+// and back on. The profile can pick how the pointer speeds up as the stick
+// is pushed, and a button that slows it down while held.
+//
+// Other commands can hand the mouse other axes, without the clicks, as
+// `blazeremap map` does for a stick bound to mouse-x.
+//
+// Controllers only report a stick when it moves, so while the pointer or
+// the wheel is pushed the controller is read with a deadline of `TICK` and
+// the movement since the last frame is sent on every frame, timed out or
+// not.
+
+use std::collections::VecDeque;
+use std::time::{Duration, Instant};
+
+use anyhow::{Result, bail};
+
+use crate::event::{AxisCode, ButtonCode, InputEvent};
+use crate::input::keymouse::MouseButton;
+use crate::input::range::AxisRange;
+use crate::input::{Gamepad, GamepadInfo};
+use crate::mapping::profile::PointerCurve;
+use crate::output::mouse::{MouseEvent, VirtualMouse};
+
+/// How often the pointer moves while a stick is pushed
+const TICK: Duration = Duration::from_millis(8);
+
+/// Buttons held together to switch desktop mode, like "Select+Start"
+pub fn parse_chord(text: &str) -> Result<Vec<ButtonCode>> {
+    let mut chord = Vec::new();
+    for name in text.split('+').map(str::trim) {
+        let code = ButtonCode::from(name);
+        if code == ButtonCode::Unknown {
+            bail!("'{}' is not a button", name);
+        }
+        if !chord.contains(&code) {
+            chord.push(code);
+        }
+    }
+    Ok(chord)
+}
+
+/// How fast the sticks move the pointer and the wheel
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct DesktopSpeed {
+    /// Pixels per second with the left stick all the way out
+    pub pointer: f32,
+    /// Notches per second with the right stick all the way out
+    pub scroll: f32,
+}
+
+impl Default for DesktopSpeed {
+    fn default() -> Self {
+        Self { pointer: 1200.0, scroll: 12.0 }
+    }
+}
+
+/// Which controls drive the mouse
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct MouseControls {
+    /// Axes moving the pointer right and down
+    pub pointer: [Option<AxisCode>; 2],
+    /// Axes turning the wheel right and down
+    pub wheel: [Option<AxisCode>; 2],
+    /// Whether the triggers and the right stick click
+    pub clicks: bool,
+}
+
+impl Default for MouseControls {
+    fn default() -> Self {
+        Self {
+            pointer: [Some(AxisCode::LeftX), Some(AxisCode::LeftY)],
+            wheel: [Some(AxisCode::RightX), Some(AxisCode::RightY)],
+            clicks: true,
+        }
+    }
+}
+
+impl MouseControls {
+    /// Only the axes of `pointer` and `wheel`, without clicks
+    pub fn axes(pointer: [Option<AxisCode>; 2], wheel: [Option<AxisCode>; 2]) -> Self {
+        Self { pointer, wheel, clicks: false }
+    }
+
+    /// Where `code` goes in the pointer and wheel axes, in that order
+    fn slot(&self, code: AxisCode) -> Option<usize> {
+        self.pointer.iter().chain(&self.wheel).position(|&axis| axis == Some(code))
+    }
+}
+
+/// How far a stick is pushed, from -1 to 1 past the deadzone, on `curve`
+fn deflection(value: i32, curve: PointerCurve) -> f32 {
+    let deadzone = InputEvent::STICK_DEADZONE;
+    if value.abs() <= deadzone {
+        return 0.0;
+    }
+    let amount = (value.abs() - deadzone) as f32 / (AxisRange::STICK.max - deadzone) as f32;
+    curve.apply(amount.min(1.0)) * value.signum() as f32
+}
+
+/// Whole steps out of `amount`, keeping the fraction in `rest` for later
+fn whole(amount: f32, rest: &mut f32) -> i32 {
+    let total = amount + *rest;
+    let steps = total.trunc();
+    *rest = total - steps;
+    steps as i32
+}
+
+/// A controller that drives `mouse` while desktop mode is on
+///
+/// Reads like the controller, minus the controls the mouse takes; while
+/// off, it reads as a controller nobody touches.
+pub struct DesktopMode {
+    controller: Box<dyn Gamepad>,
+    mouse: Box<dyn VirtualMouse>,
+    speed: DesktopSpeed,
+    chord: Vec<ButtonCode>,
+    on: bool,
+    controls: MouseControls,
+    curve: PointerCurve,
+    // The button slowing the pointer, its share of full speed, and whether
+    // it's held
+    precision: Option<(ButtonCode, f32)>,
+    precise: bool,
+
+    // Buttons physically held, for the chord
+    held: Vec<ButtonCode>,
+    // Buttons and off-center axes read on, to let go of when switching off
+    passed_buttons: Vec<ButtonCode>,
+    passed_axes: Vec<AxisCode>,
+    // Events to read before the controller's next
+    pending: VecDeque<InputEvent>,
+
+    // Stick positions, and when the pointer and wheel last moved
+    sticks: [i32; 4],
+    moved_at: Instant,
+    rest: [f32; 4],
+    // Mouse buttons down, and which control holds each down
+    clicks: Vec<(MouseButton, ClickSource)>,
+    frame: Vec<MouseEvent>,
+}
+
+/// What can hold a mouse button down
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum ClickSource {
+    Button(ButtonCode),
+    Trigger(AxisCode),
+}
+
+impl DesktopMode {
+    /// Drive `mouse` with `controller`; holding the `chord` buttons switches
+    /// between desktop mode and the controller (no switching if empty)
+    pub fn new(
+        controller: Box<dyn Gamepad>,
+        mouse: Box<dyn VirtualMouse>,
+        speed: DesktopSpeed,
+        chord: Vec<ButtonCode>,
+    ) -> Self {
+        Self {
+            controller,
+            mouse,
+            speed,
+            chord,
+            on: true,
+            controls: MouseControls::default(),
+            curve: PointerCurve::default(),
+            precision: None,
+            precise: false,
+            held: Vec::new(),
+            passed_buttons: Vec::new(),
+            passed_axes: Vec::new(),
+            pending: VecDeque::new(),
+            sticks: [0; 4],
+            moved_at: Instant::now(),
+            rest: [0.0; 4],
+            clicks: Vec::new(),
+            frame: Vec::new(),
+        }
+    }
+
+    /// Move the pointer on `curve`, and at the `precision` share of its
+    /// speed while the `precision` button is held
+    pub fn with_pointer(
+        mut self,
+        curve: PointerCurve,
+        precision: Option<(ButtonCode, f32)>,
+    ) -> Self {
+        self.curve = curve;
+        self.precision = precision;
+        self
+    }
+
+    /// Drive the mouse with `controls` instead of the sticks and triggers
+    pub fn with_controls(mut self, controls: MouseControls) -> Self {
+        self.controls = controls;
+        self
+    }
+
+    pub fn is_on(&self) -> bool {
+        self.on
+    }
+
+    /// Whether a stick is pushed, so the pointer or the wheel keeps moving
+    fn moving(&self) -> bool {
+        self.sticks.iter().any(|&value| deflection(value, PointerCurve::Linear) != 0.0)
+    }
+
+    /// Press or let go of `button` for `source`, clicking only on the
+    /// first press and the last release
+    fn click(&mut self, button: MouseButton, source: ClickSource, pressed: bool) {
+        let before = self.clicks.iter().any(|&(down, _)| down == button);
+        self.clicks.retain(|&click| click != (button, source));
+        if pressed {
+            self.clicks.push((button, source));
+        }
+        let after = self.clicks.iter().any(|&(down, _)| down == button);
+        if before != after {
+            self.frame.push(MouseEvent::Button { button, pressed: after });
+        }
+    }
+
+    /// Take `event` for the mouse; false if it's not a mouse control
+    fn take(&mut self, event: &InputEvent) -> bool {
+        match *event {
+            InputEvent::Button { code, pressed, .. } => {
+                if self.precision.is_some_and(|(button, _)| button == code) {
+                    self.precise = pressed;
+                    return true;
+                }
+                let button = match code {
+                    _ if !self.controls.clicks => return false,
+                    ButtonCode::RightTrigger => MouseButton::Left,
+                    ButtonCode::LeftTrigger => MouseButton::Right,
+                    ButtonCode::RightStick => MouseButton::Middle,
+                    _ => return false,
+                };
+                self.click(button, ClickSource::Button(code), pressed);
+            }
+            InputEvent::Axis { code, value, .. } => {
+                let stick = match (self.controls.slot(code), code) {
+                    (Some(slot), _) => slot,
+                    (None, AxisCode::RightTrigger | AxisCode::LeftTrigger)
+                        if self.controls.clicks =>
+                    {
+                        let button = match code {
+                            AxisCode::RightTrigger => MouseButton::Left,
+                            _ => MouseButton::Right,
+                        };
+                        let pressed = value > AxisRange::TRIGGER.max / 2;
+                        self.click(button, ClickSource::Trigger(code), pressed);
+                        return true;
+                    }
+                    _ => return false,
+                };
+                if !self.moving() {
+                    // Moving starts now, not when the stick was last let go
+                    self.moved_at = Instant::now();
+                }
+                self.sticks[stick] = value;
+            }
+            InputEvent::Sync { .. } => return false,
+        }
+        true
+    }
+
+    /// Send the mouse what changed since the last frame
+    fn flush(&mut self) -> Result<()> {
+        if self.moving() {
+            let now = Instant::now();
+            let seconds = now.saturating_duration_since(self.moved_at).as_secs_f32();
+            self.moved_at = now;
+            let [x, y] =
+                [self.sticks[0], self.sticks[1]].map(|value| deflection(value, self.curve));
+            let [wheel_x, wheel_y] = [self.sticks[2], self.sticks[3]]
+                .map(|value| deflection(value, PointerCurve::Quadratic));
+            let [rest_x, rest_y, rest_wheel_x, rest_wheel_y] = &mut self.rest;
+            let precision = match self.precision {
+                Some((_, share)) if self.precise => share,
+                _ => 1.0,
+            };
+            let pointer = self.speed.pointer * precision * seconds;
+            let scroll = self.speed.scroll * seconds;
+            let (dx, dy) = (whole(x * pointer, rest_x), whole(y * pointer, rest_y));
+            // Pushing the stick up scrolls up
+            let vertical = whole(-wheel_y * scroll, rest_wheel_y);
+            let horizontal = whole(wheel_x * scroll, rest_wheel_x);
+            if dx != 0 || dy != 0 {
+                self.frame.push(MouseEvent::Move { dx, dy });
+            }
+            if vertical != 0 || horizontal != 0 {
+                self.frame.push(MouseEvent::Scroll { vertical, horizontal });
+            }
+        } else {
+            self.rest = [0.0; 4];
+        }
+        if !self.frame.is_empty() {
+            self.mouse.emit_frame(&self.frame)?;
+            self.frame.clear();
+        }
+        Ok(())
+    }
+
+    /// Turn desktop mode on or off
+    ///
+    /// Switching off lets go of the mouse and of every button and axis read
+    /// on, so nothing stays pressed.
+    fn switch(&mut self) {
+        self.on = !self.on;
+        tracing::info!("Desktop mode {}", if self.on { "on" } else { "off" });
+        if self.on {
+            return;
+        }
+        self.sticks = [0; 4];
+        self.precise = false;
+        for (button, _) in std::mem::take(&mut self.clicks) {
+            let event = MouseEvent::Button { button, pressed: false };
+            if !self.frame.contains(&event) {
+                self.frame.push(event);
+            }
+        }
+        let buttons = self.passed_buttons.drain(..).map(InputEvent::button_release);
+        self.pending.extend(buttons);
+        let axes = self.passed_axes.drain(..).map(|code| InputEvent::axis_move(code, 0));
+        self.pending.extend(axes);
+    }
+
+    /// Track a button for the chord; true if it completes the chord
+    fn chord_pressed(&mut self, code: ButtonCode, pressed: bool) -> bool {
+        self.held.retain(|&held| held != code);
+        if !pressed {
+            return false;
+        }
+        self.held.push(code);
+        !self.chord.is_empty()
+            && self.chord.contains(&code)
+            && self.chord.iter().all(|button| self.held.contains(button))
+    }
+
+    /// Whether `event` is read on, remembering what it leaves pressed
+    fn pass(&mut self, event: &InputEvent) -> bool {
+        match *event {
+            InputEvent::Button { code, pressed: true, .. } => {
+                if !self.passed_buttons.contains(&code) {
+                    self.passed_buttons.push(code);
+                }
+                true
+            }
+            // A release only for a press that was read on
+            InputEvent::Button { code, pressed: false, .. } => {
+                let passed = self.passed_buttons.contains(&code);
+                self.passed_buttons.retain(|&button| button != code);
+                passed
+            }
+            InputEvent::Axis { code, value, .. } => {
+                self.passed_axes.retain(|&axis| axis != code);
+                if value != 0 {
+                    self.passed_axes.push(code);
+                }
+                true
+            }
+            InputEvent::Sync { .. } => true,
+        }
+    }
+
+    /// The next event read on, the frame's Sync, or None once the
+    /// controller is gone
+    fn next(&mut self, deadline: Option<Instant>) -> Result<Option<InputEvent>> {
+        loop {
+            if let Some(event) = self.pending.pop_front() {
+                return Ok(Some(event));
+            }
+            let deadline = match (deadline, self.on && self.moving()) {
+                (deadline, true) => {
+                    let tick = self.moved_at + TICK;
+                    Some(deadline.map_or(tick, |deadline| deadline.min(tick)))
+                }
+                (deadline, false) => deadline,
+            };
+            let event = match deadline {
+                Some(deadline) => self.controller.read_event_until(deadline)?,
+                None => self.controller.read_event()?,
+            };
+            let Some(event) = event else {
+                // A frame cut short still reaches the mouse
+                self.flush()?;
+                return Ok(None);
+            };
+            if let InputEvent::Sync { .. } = event {
+                self.flush()?;
+                return Ok(Some(event));
+            }
+            if let InputEvent::Button { code, pressed, .. } = event
+                && self.chord_pressed(code, pressed)
+            {
+                self.switch();
+                continue;
+            }
+            if self.on && !self.take(&event) && self.pass(&event) {
+                return Ok(Some(event));
+            }
+        }
+    }
+}
+
+impl Gamepad for DesktopMode {
+    fn get_info(&self) -> GamepadInfo {
+        self.controller.get_info()
+    }
+
+    fn read_event(&mut self) -> Result<Option<InputEvent>> {
+        self.next(None)
+    }
+
+    fn read_event_until(&mut self, deadline: Instant) -> Result<Option<InputEvent>> {
+        self.next(Some(deadline))
+    }
+
+    fn close(self) -> Result<()> {
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::gamepad::MockGamepad;
+    use std::path::PathBuf;
+    use std::sync::{Arc, Mutex};
+
+    /// Shares the frames it was sent with the test
+    struct FakeMouse(Arc<Mutex<Vec<Vec<MouseEvent>>>>);
+
+    impl VirtualMouse for FakeMouse {
+        fn emit_frame(&mut self, events: &[MouseEvent]) -> Result<()> {
+            self.0.lock().unwrap().push(events.to_vec());
+            Ok(())
+        }
+
+        fn dev_node(&mut self) -> Result<PathBuf> {
+            Ok(PathBuf::from("/dev/input/event98"))
+        }
+    }
+
+    fn desktop(events: Vec<InputEvent>) -> (DesktopMode, Arc<Mutex<Vec<Vec<MouseEvent>>>>) {
+        // Read the same with or without a deadline
+        let events = Arc::new(Mutex::new(events.into_iter()));
+        let until = Arc::clone(&events);
+        let mut controller = MockGamepad::new();
+        controller.expect_read_event().returning(move || Ok(events.lock().unwrap().next()));
+        controller.expect_read_event_until().returning(move |_| Ok(until.lock().unwrap().next()));
+        let frames = Arc::new(Mutex::new(Vec::new()));
+        let mouse = Box::new(FakeMouse(Arc::clone(&frames)));
+        let chord = parse_chord("Select+Start").unwrap();
+        (DesktopMode::new(Box::new(controller), mouse, DesktopSpeed::default(), chord), frames)
+    }
+
+    fn read_all(desktop: &mut DesktopMode) -> Vec<InputEvent> {
+        let mut events = Vec::new();
+        while let Some(event) = desktop.read_event().unwrap() {
+            events.push(event);
+        }
+        events
+    }
+
+    #[test]
+    fn test_parse_chord() {
+        assert_eq!(parse_chord("Select + Start").unwrap(), [ButtonCode::Select, ButtonCode::Start]);
+        assert_eq!(parse_chord("Mode").unwrap(), [ButtonCode::Mode]);
+        assert!(parse_chord("Select+Jump").is_err());
+    }
+
+    #[test]
+    fn test_deflection_has_a_deadzone_and_a_curve() {
+        let quadratic = |value| deflection(value, PointerCurve::Quadratic);
+        assert_eq!(quadratic(InputEvent::STICK_DEADZONE), 0.0);
+        assert_eq!(quadratic(32767), 1.0);
+        assert_eq!(quadratic(-32768), -1.0);
+        let half = (32767 + InputEvent::STICK_DEADZONE) / 2;
+        assert!((quadratic(half) - 0.25).abs() < 0.01, "{}", quadratic(half));
+        assert!((deflection(half, PointerCurve::Linear) - 0.5).abs() < 0.01);
+        assert!((deflection(-half, PointerCurve::Cubic) + 0.125).abs() < 0.01);
+
+        let mut rest = 0.0;
+        assert_eq!(whole(0.6, &mut rest), 0);
+        assert_eq!(whole(0.6, &mut rest), 1);
+        assert!((rest - 0.2).abs() < 0.001);
+    }
+
+    #[test]
+    fn test_triggers_click_and_the_rest_reads_on() {
+        let (mut desktop, frames) = desktop(vec![
+            InputEvent::axis_move(AxisCode::RightTrigger, 1023),
+            InputEvent::button_press(ButtonCode::RightTrigger),
+            InputEvent::button_press(ButtonCode::South),
+            InputEvent::sync(),
+            InputEvent::axis_move(AxisCode::RightTrigger, 0),
+            InputEvent::sync(),
+            InputEvent::button_release(ButtonCode::RightTrigger),
+            InputEvent::button_release(ButtonCode::South),
+            InputEvent::sync(),
+        ]);
+        let events = read_all(&mut desktop);
+        assert!(matches!(events[0], InputEvent::Button { code: ButtonCode::South, .. }));
+        assert_eq!(events.len(), 5);
+
+        // One click, though both the axis and the button report the trigger
+        let press = MouseEvent::Button { button: MouseButton::Left, pressed: true };
+        let release = MouseEvent::Button { button: MouseButton::Left, pressed: false };
+        assert_eq!(*frames.lock().unwrap(), [vec![press], vec![release]]);
+    }
+
+    #[test]
+    fn test_stick_moves_the_pointer_until_let_go() {
+        let (mut desktop, frames) =
+            desktop(vec![InputEvent::axis_move(AxisCode::LeftX, 32767), InputEvent::sync()]);
+        assert!(matches!(desktop.read_event().unwrap(), Some(InputEvent::Sync { .. })));
+        std::thread::sleep(Duration::from_millis(20));
+        desktop.flush().unwrap();
+
+        let frames = frames.lock().unwrap();
+        let [MouseEvent::Move { dx, dy: 0 }] = frames.last().unwrap()[..] else {
+            panic!("{:?}", frames);
+        };
+        // 1200 pixels a second for at least 20ms
+        assert!(dx >= 24, "{}", dx);
+    }
+
+    #[test]
+    fn test_controls_pick_the_pointer_axes() {
+        let (desktop, frames) = desktop(vec![
+            InputEvent::axis_move(AxisCode::LeftX, 32767),
+            InputEvent::axis_move(AxisCode::RightTrigger, 1023),
+            InputEvent::axis_move(AxisCode::RightX, -32768),
+            InputEvent::sync(),
+        ]);
+        let controls = MouseControls::axes([Some(AxisCode::RightX), None], [None, None]);
+        let mut desktop = desktop.with_controls(controls);
+        // The left stick and the trigger read on, without clicking
+        let events = [(); 3].map(|_| desktop.read_event().unwrap().unwrap());
+        assert!(matches!(events[0], InputEvent::Axis { code: AxisCode::LeftX, .. }));
+        assert!(matches!(events[1], InputEvent::Axis { code: AxisCode::RightTrigger, .. }));
+        assert!(matches!(events[2], InputEvent::Sync { .. }));
+        std::thread::sleep(Duration::from_millis(20));
+        desktop.flush().unwrap();
+
+        let frames = frames.lock().unwrap();
+        let [MouseEvent::Move { dx, dy: 0 }] = frames.last().unwrap()[..] else {
+            panic!("{:?}", frames);
+        };
+        assert!(dx <= -24, "{}", dx);
+    }
+
+    #[test]
+    fn test_precision_button_slows_the_pointer() {
+        let (desktop, frames) = desktop(vec![
+            InputEvent::button_press(ButtonCode::LeftShoulder),
+            InputEvent::axis_move(AxisCode::LeftX, 32767),
+            InputEvent::sync(),
+        ]);
+        let precision = Some((ButtonCode::LeftShoulder, 0.25));
+        let mut desktop = desktop.with_pointer(PointerCurve::Linear, precision);
+        let start = Instant::now();
+        // The button is the pointer's, not the profile's
+        assert!(matches!(desktop.read_event().unwrap(), Some(InputEvent::Sync { .. })));
+        std::thread::sleep(Duration::from_millis(40));
+        desktop.flush().unwrap();
+        let elapsed = start.elapsed().as_secs_f32();
+
+        let frames = frames.lock().unwrap();
+        let [MouseEvent::Move { dx, dy: 0 }] = frames.last().unwrap()[..] else {
+            panic!("{:?}", frames);
+        };
+        // A quarter of 1200 pixels a second
+        assert!(dx >= 12 && dx as f32 <= 300.0 * elapsed + 1.0, "{} in {}s", dx, elapsed);
+    }
+
+    #[test]
+    fn test_chord_switches_off_and_lets_go() {
+        let (mut desktop, frames) = desktop(vec![
+            InputEvent::button_press(ButtonCode::North),
+            InputEvent::axis_move(AxisCode::DPadX, 1),
+            InputEvent::axis_move(AxisCode::LeftTrigger, 1023),
+            InputEvent::sync(),
+            InputEvent::button_press(ButtonCode::Select),
+            InputEvent::button_press(ButtonCode::Start),
+            InputEvent::sync(),
+            // Off: nothing reads on, not even the release
+            InputEvent::button_release(ButtonCode::Select),
+            InputEvent::button_release(ButtonCode::North),
+            InputEvent::axis_move(AxisCode::LeftTrigger, 0),
+            InputEvent::button_press(ButtonCode::East),
+            InputEvent::sync(),
+        ]);
+        let events = read_all(&mut desktop);
+        assert!(!desktop.is_on());
+
+        let released: Vec<_> = events
+            .iter()
+            .filter_map(|event| match *event {
+                InputEvent::Button { code, pressed: false, .. } => Some(code.to_string()),
+                InputEvent::Axis { code, value: 0, .. } => Some(code.to_string()),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(released, ["North", "Select", "DPad X"]);
+        assert!(!events.iter().any(|event| matches!(
+            event,
+            InputEvent::Button { code: ButtonCode::East | ButtonCode::Start, .. }
+        )));
+
+        let frames = frames.lock().unwrap();
+        let release = MouseEvent::Button { button: MouseButton::Right, pressed: false };
+        assert_eq!(frames.last().unwrap()[..], [release]);
+    }
+}
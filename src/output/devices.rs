@@ -0,0 +1,539 @@
+// The virtual devices a session sends to
+//
+// Mappings can press keys, mouse buttons and wheels, or gamepad controls.
+// Each kind of device is only made once a profile maps to it, so a
+// keyboard-only profile doesn't leave an idle mouse and gamepad behind for
+// games to find. Profiles switched to later make what they need then.
+//
+// Custom devices a profile declares are different: declaring one is asking
+// for it, so they're all made with the profile. Mappings send to them by
+// name, in events wrapped as `OutputEvent::Routed`.
+
+use std::fmt;
+use std::sync::Arc;
+
+use anyhow::{Context, Result};
+
+use crate::{
+    event::{ActionSource, AxisCode, AxisDirection, InputEvent, OutputEvent},
+    input::range::AxisRange,
+    mapping::{profile::Profile, types::TargetType},
+    output::{
+        gamepad::VirtualGamepad, keyboard::VirtualKeyboard, mouse::MouseEvent, mouse::VirtualMouse,
+    },
+};
+
+/// Which virtual devices are needed
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct DeviceKinds {
+    pub keyboard: bool,
+    pub mouse: bool,
+    pub gamepad: bool,
+}
+
+impl DeviceKinds {
+    /// Just a keyboard, as the built-in mappings need
+    pub const KEYBOARD: Self = Self { keyboard: true, mouse: false, gamepad: false };
+
+    /// The devices `profile`'s mappings send to
+    pub fn for_profile(profile: &Profile) -> Self {
+        let mut kinds = Self::default();
+        for mapping in &profile.mappings {
+            if mapping.custom_device().is_some() {
+                continue;
+            }
+            match mapping.target_type {
+                // Desktop actions, scripts and text press keys too
+                TargetType::Keyboard
+                | TargetType::Desktop
+                | TargetType::Script
+                | TargetType::Text => kinds.keyboard = true,
+                TargetType::Mouse => kinds.mouse = true,
+                TargetType::Gamepad => kinds.gamepad = true,
+                _ => {}
+            }
+        }
+        kinds
+    }
+}
+
+impl std::ops::BitOr for DeviceKinds {
+    type Output = Self;
+
+    /// The devices either needs
+    fn bitor(self, other: Self) -> Self {
+        Self {
+            keyboard: self.keyboard || other.keyboard,
+            mouse: self.mouse || other.mouse,
+            gamepad: self.gamepad || other.gamepad,
+        }
+    }
+}
+
+impl fmt::Display for DeviceKinds {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let kinds: Vec<&str> =
+            [(self.keyboard, "keyboard"), (self.mouse, "mouse"), (self.gamepad, "gamepad")]
+                .into_iter()
+                .filter_map(|(needed, kind)| needed.then_some(kind))
+                .collect();
+        match kinds.is_empty() {
+            true => f.write_str("none"),
+            false => f.write_str(&kinds.join(", ")),
+        }
+    }
+}
+
+/// One of a profile's custom devices
+pub enum AnyDevice {
+    Keyboard(Box<dyn VirtualKeyboard>),
+    Mouse(Box<dyn VirtualMouse>),
+    Gamepad(Box<dyn VirtualGamepad>),
+}
+
+type Maker<T> = Box<dyn FnOnce() -> Result<Box<T>>>;
+
+/// A device, the means to make it, or neither
+enum Slot<T: ?Sized> {
+    Ready(Box<T>),
+    Pending(Maker<T>),
+    /// Couldn't be made; its events are dropped, with one warning
+    Absent {
+        warned: bool,
+    },
+}
+
+impl<T: ?Sized> Slot<T> {
+    /// The device, made now if it's still pending
+    fn make(&mut self, kind: &str) -> Result<&mut T> {
+        if let Self::Pending(_) = self {
+            let Self::Pending(make) = std::mem::replace(self, Self::Absent { warned: true }) else {
+                unreachable!();
+            };
+            *self =
+                Self::Ready(make().with_context(|| format!("Failed to create virtual {}", kind))?);
+            tracing::info!("Created virtual {}", kind);
+        }
+        match self {
+            Self::Ready(device) => Ok(device),
+            _ => anyhow::bail!("No virtual {} in this session", kind),
+        }
+    }
+
+    /// The device to send to, or None to drop the events
+    fn get(&mut self, kind: &str) -> Option<&mut T> {
+        if let Self::Absent { warned } = self {
+            if !std::mem::replace(warned, true) {
+                tracing::warn!("No virtual {} in this session; dropping what's mapped to it", kind);
+            }
+            return None;
+        }
+        match self.make(kind) {
+            Ok(device) => Some(device),
+            Err(e) => {
+                tracing::warn!("{:#}; dropping what's mapped to it", e);
+                None
+            }
+        }
+    }
+}
+
+/// The keyboard, mouse and gamepad mapped output goes to, each made when
+/// first needed, and the custom devices by name
+pub struct VirtualDevices {
+    keyboard: Slot<dyn VirtualKeyboard>,
+    mouse: Slot<dyn VirtualMouse>,
+    gamepad: Slot<dyn VirtualGamepad>,
+    // Few per profile, so a list
+    custom: Vec<(String, Slot<AnyDevice>)>,
+    // Reused per-frame buffers, one per device
+    keys: Vec<OutputEvent>,
+    clicks: Vec<MouseEvent>,
+    controls: Vec<InputEvent>,
+    routed: Vec<(Arc<str>, OutputEvent)>,
+}
+
+impl VirtualDevices {
+    /// No devices; events for them are dropped until one is given
+    pub fn new() -> Self {
+        Self {
+            keyboard: Slot::Absent { warned: false },
+            mouse: Slot::Absent { warned: false },
+            gamepad: Slot::Absent { warned: false },
+            custom: Vec::new(),
+            keys: Vec::new(),
+            clicks: Vec::new(),
+            controls: Vec::new(),
+            routed: Vec::new(),
+        }
+    }
+
+    /// Send key events to `keyboard`, made already
+    pub fn with_keyboard(mut self, keyboard: Box<dyn VirtualKeyboard>) -> Self {
+        self.keyboard = Slot::Ready(keyboard);
+        self
+    }
+
+    /// Send key events to a keyboard `make` makes when first needed
+    pub fn with_lazy_keyboard(
+        mut self,
+        make: impl FnOnce() -> Result<Box<dyn VirtualKeyboard>> + 'static,
+    ) -> Self {
+        self.keyboard = Slot::Pending(Box::new(make));
+        self
+    }
+
+    /// Send mouse events to a mouse `make` makes when first needed
+    pub fn with_lazy_mouse(
+        mut self,
+        make: impl FnOnce() -> Result<Box<dyn VirtualMouse>> + 'static,
+    ) -> Self {
+        self.mouse = Slot::Pending(Box::new(make));
+        self
+    }
+
+    /// Send gamepad events to a gamepad `make` makes when first needed
+    pub fn with_lazy_gamepad(
+        mut self,
+        make: impl FnOnce() -> Result<Box<dyn VirtualGamepad>> + 'static,
+    ) -> Self {
+        self.gamepad = Slot::Pending(Box::new(make));
+        self
+    }
+
+    /// Send events routed to `name` to a device `make` makes with the
+    /// others
+    pub fn with_lazy_custom(
+        mut self,
+        name: &str,
+        make: impl FnOnce() -> Result<AnyDevice> + 'static,
+    ) -> Self {
+        self.custom.retain(|(known, _)| known != name);
+        self.custom.push((name.to_string(), Slot::Pending(Box::new(move || make().map(Box::new)))));
+        self
+    }
+
+    /// Make the `kinds` of device not made yet, and every custom device
+    ///
+    /// Done when a profile is loaded, so games see its devices before its
+    /// first press. Fails on the first device that can't be made.
+    pub fn prepare(&mut self, kinds: DeviceKinds) -> Result<()> {
+        if kinds.keyboard {
+            self.keyboard.make("keyboard")?;
+        }
+        if kinds.mouse {
+            self.mouse.make("mouse")?;
+        }
+        if kinds.gamepad {
+            self.gamepad.make("gamepad")?;
+        }
+        for (name, device) in &mut self.custom {
+            device.make(&format!("device '{}'", name))?;
+        }
+        Ok(())
+    }
+
+    /// Emit everything one input frame was mapped to, one frame per device
+    ///
+    /// Keys are the exception: a key pressed twice in a frame, as typed text
+    /// does, would look like one press, so the keyboard gets a new frame
+    /// wherever a key comes back.
+    pub fn emit_frame(&mut self, events: &[OutputEvent]) -> Result<()> {
+        self.keys.clear();
+        self.clicks.clear();
+        self.controls.clear();
+        self.routed.clear();
+        for event in events {
+            match *event {
+                OutputEvent::Keyboard { .. } => self.keys.push(event.clone()),
+                OutputEvent::Mouse(event) => self.clicks.push(event),
+                OutputEvent::Gamepad { control, pressed } => {
+                    self.controls.extend(gamepad_event(control, pressed))
+                }
+                OutputEvent::Routed { ref device, ref event } => {
+                    self.routed.push((device.clone(), (**event).clone()))
+                }
+            }
+        }
+        if !self.keys.is_empty()
+            && let Some(keyboard) = self.keyboard.get("keyboard")
+        {
+            emit_keys(keyboard, &self.keys)?;
+        }
+        if !self.clicks.is_empty()
+            && let Some(mouse) = self.mouse.get("mouse")
+        {
+            mouse.emit_frame(&self.clicks)?;
+        }
+        if !self.controls.is_empty()
+            && let Some(gamepad) = self.gamepad.get("gamepad")
+        {
+            gamepad.emit_frame(&self.controls)?;
+        }
+        if !self.routed.is_empty() {
+            let routed = std::mem::take(&mut self.routed);
+            let result = self.emit_routed(&routed);
+            self.routed = routed;
+            result?;
+        }
+        Ok(())
+    }
+
+    /// Emit the routed events of a frame, one frame per custom device
+    fn emit_routed(&mut self, routed: &[(Arc<str>, OutputEvent)]) -> Result<()> {
+        for (i, (name, _)) in routed.iter().enumerate() {
+            if routed[..i].iter().any(|(earlier, _)| earlier == name) {
+                continue;
+            }
+            let events: Vec<OutputEvent> = routed[i..]
+                .iter()
+                .filter(|(device, _)| device == name)
+                .map(|(_, event)| event.clone())
+                .collect();
+            // A device no profile declared: drop its events, warning once
+            let index = match self.custom.iter().position(|(known, _)| **known == **name) {
+                Some(index) => index,
+                None => {
+                    self.custom.push((name.to_string(), Slot::Absent { warned: false }));
+                    self.custom.len() - 1
+                }
+            };
+            let Some(device) = self.custom[index].1.get(&format!("device '{}'", name)) else {
+                continue;
+            };
+            match device {
+                AnyDevice::Keyboard(keyboard) => emit_keys(keyboard.as_mut(), &events)?,
+                AnyDevice::Mouse(mouse) => {
+                    let clicks: Vec<MouseEvent> = events
+                        .iter()
+                        .filter_map(|event| match *event {
+                            OutputEvent::Mouse(click) => Some(click),
+                            _ => None,
+                        })
+                        .collect();
+                    mouse.emit_frame(&clicks)?;
+                }
+                AnyDevice::Gamepad(gamepad) => {
+                    let controls: Vec<InputEvent> = events
+                        .iter()
+                        .filter_map(|event| match *event {
+                            OutputEvent::Gamepad { control, pressed } => {
+                                gamepad_event(control, pressed)
+                            }
+                            _ => None,
+                        })
+                        .collect();
+                    gamepad.emit_frame(&controls)?;
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+impl Default for VirtualDevices {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+/// Emit `keys` to `keyboard`, in a new frame wherever a key comes back
+fn emit_keys(keyboard: &mut dyn VirtualKeyboard, keys: &[OutputEvent]) -> Result<()> {
+    let mut start = 0;
+    for (i, event) in keys.iter().enumerate() {
+        if keys[start..i].iter().any(|earlier| same_key(earlier, event)) {
+            keyboard.emit_frame(&keys[start..i])?;
+            start = i;
+        }
+    }
+    keyboard.emit_frame(&keys[start..])
+}
+
+fn same_key(a: &OutputEvent, b: &OutputEvent) -> bool {
+    matches!(
+        (a, b),
+        (OutputEvent::Keyboard { code: a, .. }, OutputEvent::Keyboard { code: b, .. }) if a == b
+    )
+}
+
+/// A gamepad control pressed or let go, as the virtual gamepad takes it:
+/// directions push their axis all the way, and center it on release
+fn gamepad_event(control: ActionSource, pressed: bool) -> Option<InputEvent> {
+    match control {
+        ActionSource::Button(code) => Some(match pressed {
+            true => InputEvent::button_press(code),
+            false => InputEvent::button_release(code),
+        }),
+        ActionSource::Axis(code, direction) => {
+            let range = match code {
+                AxisCode::DPadX | AxisCode::DPadY => AxisRange::HAT,
+                _ => AxisRange::STICK,
+            };
+            let value = match (pressed, direction) {
+                (false, _) => 0,
+                (true, AxisDirection::Negative) => range.min,
+                (true, AxisDirection::Positive) => range.max,
+            };
+            Some(InputEvent::axis_move(code, value))
+        }
+        // Not a control mappings press
+        ActionSource::AxisValue(_) => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ButtonCode, KeyboardCode, KeyboardEventType};
+    use crate::input::keymouse::MouseButton;
+    use crate::output::keyboard::MockVirtualKeyboard;
+    use std::sync::{Arc, Mutex};
+
+    /// Mouse and gamepad recording each frame they're sent
+    #[derive(Clone, Default)]
+    struct Recorder(Arc<Mutex<Vec<String>>>);
+
+    impl VirtualMouse for Recorder {
+        fn emit_frame(&mut self, events: &[MouseEvent]) -> Result<()> {
+            self.0.lock().unwrap().push(format!("mouse {:?}", events));
+            Ok(())
+        }
+        fn dev_node(&mut self) -> Result<std::path::PathBuf> {
+            Ok("/dev/input/event9".into())
+        }
+    }
+
+    impl VirtualGamepad for Recorder {
+        fn emit_frame(&mut self, events: &[InputEvent]) -> Result<()> {
+            let events: Vec<String> = events.iter().map(ToString::to_string).collect();
+            self.0.lock().unwrap().push(format!("gamepad {}", events.join(", ")));
+            Ok(())
+        }
+        fn dev_node(&mut self) -> Result<std::path::PathBuf> {
+            Ok("/dev/input/event10".into())
+        }
+    }
+
+    #[test]
+    fn test_events_go_to_their_device_made_when_first_needed() {
+        let recorder = Recorder::default();
+        let made = Arc::new(Mutex::new(Vec::new()));
+        let (mouse, gamepad) = (recorder.clone(), recorder.clone());
+        let (made_mouse, made_gamepad) = (Arc::clone(&made), Arc::clone(&made));
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard
+            .expect_emit_frame()
+            .withf(|events| matches!(events, [OutputEvent::Keyboard { code: KeyboardCode::S, .. }]))
+            .times(1)
+            .returning(|_| Ok(()));
+        let mut devices = VirtualDevices::new()
+            .with_keyboard(Box::new(keyboard))
+            .with_lazy_mouse(move || {
+                made_mouse.lock().unwrap().push("mouse");
+                Ok(Box::new(mouse))
+            })
+            .with_lazy_gamepad(move || {
+                made_gamepad.lock().unwrap().push("gamepad");
+                Ok(Box::new(gamepad))
+            });
+
+        devices.prepare(DeviceKinds { mouse: true, ..DeviceKinds::KEYBOARD }).unwrap();
+        assert_eq!(*made.lock().unwrap(), ["mouse"]);
+
+        let click = MouseEvent::Button { button: MouseButton::Left, pressed: true };
+        devices
+            .emit_frame(&[
+                OutputEvent::Keyboard {
+                    code: KeyboardCode::S,
+                    event_type: KeyboardEventType::Press,
+                },
+                OutputEvent::Mouse(click),
+                OutputEvent::Gamepad {
+                    control: ActionSource::Axis(AxisCode::LeftY, AxisDirection::Negative),
+                    pressed: true,
+                },
+                OutputEvent::Gamepad {
+                    control: ActionSource::Button(ButtonCode::South),
+                    pressed: true,
+                },
+            ])
+            .unwrap();
+        assert_eq!(*made.lock().unwrap(), ["mouse", "gamepad"]);
+        let frames = recorder.0.lock().unwrap();
+        assert_eq!(frames[0], format!("mouse {:?}", [click]));
+        assert!(frames[1].starts_with("gamepad ") && frames[1].contains("-32768"));
+    }
+
+    #[test]
+    fn test_repeated_keys_get_a_frame_each() {
+        let frames = Arc::new(Mutex::new(Vec::new()));
+        let recorded = Arc::clone(&frames);
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard.expect_emit_frame().returning(move |events| {
+            recorded.lock().unwrap().push(events.len());
+            Ok(())
+        });
+        let mut devices = VirtualDevices::new().with_keyboard(Box::new(keyboard));
+
+        let key = |code, event_type| OutputEvent::Keyboard { code, event_type };
+        let (press, release) = (KeyboardEventType::Press, KeyboardEventType::Release);
+        devices
+            .emit_frame(&[
+                key(KeyboardCode::L, press),
+                key(KeyboardCode::L, release),
+                key(KeyboardCode::O, press),
+                key(KeyboardCode::L, press),
+                key(KeyboardCode::L, release),
+            ])
+            .unwrap();
+        assert_eq!(*frames.lock().unwrap(), [1, 2, 1, 1]);
+    }
+
+    #[test]
+    fn test_routed_events_go_to_their_custom_device() {
+        let recorder = Recorder::default();
+        let (p2, main) = (recorder.clone(), recorder.clone());
+        let mut devices = VirtualDevices::new()
+            .with_lazy_gamepad(move || Ok(Box::new(main)))
+            .with_lazy_custom("p2", move || Ok(AnyDevice::Gamepad(Box::new(p2))));
+        devices.prepare(DeviceKinds::default()).unwrap();
+
+        let south = |pressed| OutputEvent::Gamepad {
+            control: ActionSource::Button(ButtonCode::South),
+            pressed,
+        };
+        let routed = |device: &str, event| OutputEvent::Routed {
+            device: Arc::from(device),
+            event: Box::new(event),
+        };
+        devices
+            .emit_frame(&[
+                routed("p2", south(true)),
+                south(false),
+                routed("p3", south(true)),
+                routed("p2", south(false)),
+            ])
+            .unwrap();
+        // The usual gamepad first; p3 was never declared, so it's dropped
+        assert_eq!(
+            *recorder.0.lock().unwrap(),
+            ["gamepad South (released)", "gamepad South (pressed), South (released)"]
+        );
+    }
+
+    #[test]
+    fn test_missing_device_drops_its_events() {
+        let mut devices = VirtualDevices::new().with_lazy_mouse(|| anyhow::bail!("no uinput"));
+        assert!(devices.prepare(DeviceKinds::default()).is_ok());
+        assert!(devices.prepare(DeviceKinds { mouse: true, ..Default::default() }).is_err());
+
+        let scroll = MouseEvent::Scroll { vertical: 1, horizontal: 0 };
+        let key =
+            OutputEvent::Keyboard { code: KeyboardCode::S, event_type: KeyboardEventType::Press };
+        assert!(devices.emit_frame(&[OutputEvent::Mouse(scroll), key]).is_ok());
+        assert_eq!(
+            DeviceKinds { mouse: true, ..DeviceKinds::KEYBOARD }.to_string(),
+            "keyboard, mouse"
+        );
+    }
+}
@@ -0,0 +1,265 @@
+// Feedback to the user through the controller, the speakers and the terminal
+//
+// Some states, like a sticky key being held or a layer being on, aren't
+// visible anywhere. The profile picks how they are signalled: a message for
+// overlays and the terminal, a short rumble, a sound, or any mix of them.
+
+use std::time::Duration;
+
+use anyhow::Result;
+
+use crate::{
+    event::{KeyboardCode, Switch},
+    mapping::{profile::Profile, types::Cue},
+    platform,
+};
+
+/// How long a sticky key latching rumbles the controller
+const STICKY_PULSE: Duration = Duration::from_millis(80);
+/// How long a layer or mapping switch rumbles the controller
+const SWITCH_PULSE: Duration = Duration::from_millis(150);
+
+/// Sounds from the freedesktop sound theme
+const STICKY_SOUND: &str = "button-toggle-on";
+const SWITCH_SOUND: &str = "message";
+
+/// Domain trait: the physical controller's rumble motors
+#[cfg_attr(test, mockall::automock)]
+pub trait Rumble: Send {
+    /// Rumble at `strength` percent for `duration`; returns without waiting
+    fn pulse(&mut self, strength: u8, duration: Duration) -> Result<()>;
+}
+
+/// Domain trait: the desktop's sound output
+#[cfg_attr(test, mockall::automock)]
+pub trait Sound: Send {
+    /// Play the sound theme's sound `id`; returns without waiting
+    fn play(&mut self, id: &str) -> Result<()>;
+}
+
+/// The rumble and sound a cue uses, dropped once they fail
+struct Alert {
+    rumble: Option<Box<dyn Rumble>>,
+    sound: Option<Box<dyn Sound>>,
+    strength: u8,
+}
+
+impl Alert {
+    /// Open what `cues` ask for; `what` names the cue in warnings
+    fn for_cues(cues: &[Cue], profile: &Profile, device: &str, what: &str) -> Self {
+        let settings = &profile.settings;
+        let rumble = match cues.contains(&Cue::Rumble) && settings.vibration_enabled {
+            true => platform::new_rumble(device)
+                .map_err(|e| tracing::warn!("No rumble cue for {}: {:#}", what, e))
+                .ok(),
+            false => None,
+        };
+        let sound = match cues.contains(&Cue::Sound) {
+            true => platform::new_sound()
+                .map_err(|e| tracing::warn!("No sound cue for {}: {:#}", what, e))
+                .ok(),
+            false => None,
+        };
+        Self { rumble, sound, strength: settings.vibration_intensity }
+    }
+
+    fn fire(&mut self, pulse: Duration, sound: &str, what: &str) {
+        if let Some(rumble) = &mut self.rumble
+            && let Err(e) = rumble.pulse(self.strength, pulse)
+        {
+            // Likely unplugged; don't warn on every press
+            tracing::warn!("Rumble failed, {} go without it: {:#}", what, e);
+            self.rumble = None;
+        }
+        if let Some(player) = &mut self.sound
+            && let Err(e) = player.play(sound)
+        {
+            tracing::warn!("Sound failed, {} go without it: {:#}", what, e);
+            self.sound = None;
+        }
+    }
+}
+
+/// Signals keys being latched and let go by sticky mappings
+pub struct StickyCue {
+    visual: bool,
+    alert: Alert,
+    // Keys held at the last change, to rumble only when one is added
+    held: usize,
+}
+
+impl StickyCue {
+    pub fn new(visual: bool, rumble: Option<Box<dyn Rumble>>, strength: u8) -> Self {
+        Self { visual, alert: Alert { rumble, sound: None, strength }, held: 0 }
+    }
+
+    /// The cue `profile` asks for, rumbling the controller at `device`
+    ///
+    /// None without `sticky_cue`. A controller that can't rumble leaves just
+    /// the other cues.
+    pub fn for_profile(profile: &Profile, device: &str) -> Option<Self> {
+        let cues = &profile.settings.sticky_cue;
+        if cues.is_empty() {
+            return None;
+        }
+        Some(Self {
+            visual: cues.contains(&Cue::Visual),
+            alert: Alert::for_cues(cues, profile, device, "sticky keys"),
+            held: 0,
+        })
+    }
+
+    /// Whether event subscribers are told about sticky keys
+    pub fn is_visual(&self) -> bool {
+        self.visual
+    }
+
+    /// Signal that sticky mappings now hold `held`
+    pub fn show(&mut self, held: &[KeyboardCode]) {
+        if self.visual {
+            match held {
+                [] => tracing::info!("Sticky keys released"),
+                keys => tracing::info!(
+                    "Sticky: {} held",
+                    keys.iter().map(ToString::to_string).collect::<Vec<_>>().join(" + ")
+                ),
+            }
+        }
+        let latched = held.len() > self.held;
+        self.held = held.len();
+        if latched {
+            self.alert.fire(STICKY_PULSE, STICKY_SOUND, "sticky keys");
+        }
+    }
+}
+
+/// Confirms layer and mapping switches without a look at the screen
+pub struct SwitchCue {
+    visual: bool,
+    alert: Alert,
+    // Only profile switches are confirmed
+    profiles_only: bool,
+}
+
+impl SwitchCue {
+    pub fn new(visual: bool, rumble: Option<Box<dyn Rumble>>, strength: u8) -> Self {
+        Self { visual, alert: Alert { rumble, sound: None, strength }, profiles_only: false }
+    }
+
+    /// The cue `profile` asks for, rumbling the controller at `device`
+    ///
+    /// None without `switch_cue`.
+    pub fn for_profile(profile: &Profile, device: &str) -> Option<Self> {
+        let cues = &profile.settings.switch_cue;
+        if cues.is_empty() {
+            return None;
+        }
+        Some(Self {
+            visual: cues.contains(&Cue::Visual),
+            alert: Alert::for_cues(cues, profile, device, "switches"),
+            profiles_only: false,
+        })
+    }
+
+    /// Like `for_profile`, but with profile hotkeys
+    ///
+    /// Without `switch_cue` the controller still rumbles when its hotkeys
+    /// switch profiles, and only then.
+    pub fn for_hotkeys(profile: &Profile, device: &str) -> Option<Self> {
+        if let Some(cue) = Self::for_profile(profile, device) {
+            return Some(cue);
+        }
+        let alert = Alert::for_cues(&[Cue::Rumble], profile, device, "profile switches");
+        alert.rumble.is_some().then_some(Self { visual: false, alert, profiles_only: true })
+    }
+
+    /// Whether event subscribers are told about switches
+    pub fn is_visual(&self) -> bool {
+        self.visual
+    }
+
+    /// Signal `switch`; letting go of a layer is only shown, not felt or heard
+    pub fn show(&mut self, switch: &Switch) {
+        if self.profiles_only && !matches!(switch, Switch::Profile(_)) {
+            return;
+        }
+        if self.visual {
+            tracing::info!("{}", switch);
+        }
+        if !matches!(switch, Switch::Layer { on: false, .. }) {
+            self.alert.fire(SWITCH_PULSE, SWITCH_SOUND, "switches");
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::ButtonCode;
+
+    #[test]
+    fn test_rumbles_when_a_key_latches() {
+        let mut rumble = MockRumble::new();
+        rumble
+            .expect_pulse()
+            .withf(|&strength, &duration| strength == 60 && duration == STICKY_PULSE)
+            .times(2)
+            .returning(|_, _| Ok(()));
+        let mut cue = StickyCue::new(false, Some(Box::new(rumble)), 60);
+
+        cue.show(&[KeyboardCode::LeftShift]);
+        cue.show(&[KeyboardCode::LeftShift, KeyboardCode::LeftControl]);
+        // Letting go is silent
+        cue.show(&[KeyboardCode::LeftShift]);
+        cue.show(&[]);
+    }
+
+    #[test]
+    fn test_failed_rumble_is_dropped() {
+        let mut rumble = MockRumble::new();
+        rumble.expect_pulse().times(1).returning(|_, _| anyhow::bail!("No such device"));
+        let mut cue = StickyCue::new(true, Some(Box::new(rumble)), 100);
+
+        cue.show(&[KeyboardCode::LeftShift]);
+        cue.show(&[]);
+        cue.show(&[KeyboardCode::LeftShift]);
+        assert!(cue.alert.rumble.is_none());
+    }
+
+    #[test]
+    fn test_switch_cue_sounds_when_a_layer_comes_on() {
+        let mut sound = MockSound::new();
+        sound.expect_play().withf(|id| id == SWITCH_SOUND).times(2).returning(|_| Ok(()));
+        let mut cue = SwitchCue::new(false, None, 100);
+        cue.alert.sound = Some(Box::new(sound));
+
+        cue.show(&Switch::Layer { button: ButtonCode::Mode, on: true });
+        cue.show(&Switch::Layer { button: ButtonCode::Mode, on: false });
+        cue.show(&Switch::Context);
+    }
+
+    #[test]
+    fn test_hotkey_cue_only_rumbles_for_profiles() {
+        let mut rumble = MockRumble::new();
+        rumble.expect_pulse().times(1).returning(|_, _| Ok(()));
+        let mut cue = SwitchCue::new(false, Some(Box::new(rumble)), 100);
+        cue.profiles_only = true;
+
+        cue.show(&Switch::Layer { button: ButtonCode::Mode, on: true });
+        cue.show(&Switch::Context);
+        cue.show(&Switch::Profile("Racing".to_string()));
+    }
+
+    #[test]
+    fn test_for_profile() {
+        let mut profile = Profile::default_profile();
+        assert!(StickyCue::for_profile(&profile, "/dev/input/event3").is_none());
+
+        // Rumble is off, so no device is opened
+        profile.settings.sticky_cue = vec![Cue::Visual, Cue::Rumble];
+        profile.settings.vibration_enabled = false;
+        let cue = StickyCue::for_profile(&profile, "/dev/input/event3").unwrap();
+        assert!(cue.is_visual());
+        assert!(cue.alert.rumble.is_none());
+    }
+}
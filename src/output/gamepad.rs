@@ -0,0 +1,137 @@
+use anyhow::Result;
+
+use crate::event::InputEvent;
+use crate::input::gamepad::{GamepadInfo, GamepadType};
+use crate::input::range::AxisRange;
+
+/// What a virtual controller presents itself as
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VirtualGamepadIdentity {
+    pub name: String,
+    pub vendor_id: u16,
+    pub product_id: u16,
+    /// Device version, which some games' controller databases key on too
+    pub version: u16,
+    /// Four back paddles, as on an Xbox Elite
+    pub paddles: bool,
+    /// Triggers are axes only, with no buttons of their own; trigger
+    /// button events pull them all the way
+    pub analog_triggers: bool,
+    /// Range the triggers report
+    pub trigger_range: AxisRange,
+}
+
+impl VirtualGamepadIdentity {
+    /// A stand-in for a `gamepad_type` controller, with the IDs detection
+    /// knows it by
+    ///
+    /// Only the IDs differ: every kind reports xpad ranges (sticks
+    /// -32768..32767, triggers 0..1023, D-pad on a hat). The Steam Deck lays
+    /// its controls out differently and gets the generic stand-in.
+    ///
+    /// The Xbox 360 pad is the exception: it's what games that only know
+    /// XInput controllers look for, so it copies the real one as the kernel
+    /// presents it, name, version, 0..255 triggers without buttons and all.
+    pub fn simulated(gamepad_type: GamepadType) -> Self {
+        if gamepad_type == GamepadType::Xbox360 {
+            return Self {
+                name: "Microsoft X-Box 360 pad".to_string(),
+                vendor_id: 0x045e,
+                product_id: 0x028e,
+                version: 0x0110,
+                paddles: false,
+                analog_triggers: true,
+                trigger_range: AxisRange::new(0, 255),
+            };
+        }
+        let (kind, vendor_id, product_id) = match gamepad_type {
+            GamepadType::XboxOne => ("Xbox One", 0x045e, 0x02ea),
+            GamepadType::XboxSeries => ("Xbox Series", 0x045e, 0x0b12),
+            GamepadType::XboxElite => ("Xbox Elite", 0x045e, 0x0b00),
+            GamepadType::DualShock4 => ("DualShock 4", 0x054c, 0x09cc),
+            GamepadType::DualSense => ("DualSense", 0x054c, 0x0ce6),
+            GamepadType::Xbox360
+            | GamepadType::SteamDeck
+            | GamepadType::Generic
+            | GamepadType::Unknown => ("Generic", 0x0000, 0x0000),
+        };
+        Self {
+            name: format!("BlazeRemap Simulated {} Controller", kind),
+            vendor_id,
+            product_id,
+            version: 1,
+            paddles: gamepad_type == GamepadType::XboxElite,
+            analog_triggers: false,
+            trigger_range: AxisRange::TRIGGER,
+        }
+    }
+
+    /// A copy of the controller `info` describes: its name and IDs, with
+    /// the controls and ranges of the kind it is
+    ///
+    /// Games that keep bindings per device, or check which device they're
+    /// reading, then take the copy for the original. The original should
+    /// be grabbed, or they see both.
+    pub fn cloned(info: &GamepadInfo) -> Self {
+        Self {
+            name: info.name.clone(),
+            vendor_id: info.vendor_id,
+            product_id: info.product_id,
+            ..Self::simulated(info.gamepad_type)
+        }
+    }
+}
+
+/// Domain trait: a controller BlazeRemap makes up
+// Send so a split controller's outputs can move with its reader
+pub trait VirtualGamepad: Send {
+    /// Emit one frame of button and axis changes
+    ///
+    /// Syncs in `events` are skipped; the frame is closed by a single one.
+    fn emit_frame(&mut self, events: &[InputEvent]) -> Result<()>;
+    /// Event node readers open, e.g. /dev/input/event7
+    fn dev_node(&mut self) -> Result<std::path::PathBuf>;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::gamepad::identify_gamepad;
+
+    #[test]
+    fn test_simulated_identity_is_detected_as_its_type() {
+        for gamepad_type in [
+            GamepadType::XboxOne,
+            GamepadType::XboxSeries,
+            GamepadType::XboxElite,
+            GamepadType::DualShock4,
+            GamepadType::DualSense,
+        ] {
+            let identity = VirtualGamepadIdentity::simulated(gamepad_type);
+            assert_eq!(identify_gamepad(identity.vendor_id, identity.product_id), gamepad_type);
+            assert!(identity.name.contains("Controller"));
+        }
+        let xbox360 = VirtualGamepadIdentity::simulated(GamepadType::Xbox360);
+        assert_eq!(identify_gamepad(xbox360.vendor_id, xbox360.product_id), GamepadType::Xbox360);
+        assert!(xbox360.analog_triggers && !xbox360.paddles);
+
+        let info = GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Microsoft X-Box 360 pad".to_string(),
+            gamepad_type: GamepadType::Xbox360,
+            vendor_id: 0x045e,
+            vendor_name: "Microsoft".to_string(),
+            product_id: 0x028f,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        };
+        let cloned = VirtualGamepadIdentity::cloned(&info);
+        assert_eq!((cloned.name.as_str(), cloned.product_id), ("Microsoft X-Box 360 pad", 0x028f));
+        assert_eq!(cloned.trigger_range, xbox360.trigger_range);
+
+        let generic = VirtualGamepadIdentity::simulated(GamepadType::SteamDeck);
+        assert_eq!(generic, VirtualGamepadIdentity::simulated(GamepadType::Generic));
+        assert!(!generic.paddles);
+    }
+}
@@ -0,0 +1,362 @@
+// What the virtual devices call themselves
+//
+// Every virtual device has a name and vendor, product and version IDs that
+// games and desktops see. Telling several BlazeRemap sessions apart, or
+// getting past a game that only takes devices it knows, means setting them.
+// A profile's settings or `run --device-identity` can set any of them:
+//
+//   [settings.virtual_devices.gamepad]
+//   name = "Player 2 Pad"
+//   vendor_id = 0x045e
+//
+//   --device-identity "keyboard:name=Couch Keyboard,vendor=1209:0001"
+//
+// What's left out keeps its default, and the flag wins over the profile.
+//
+// A profile can also declare devices of its own beyond those three, for
+// mappings to send to by name with their `device` field:
+//
+//   [settings.virtual_devices.custom.p2]
+//   kind = "gamepad"
+//   name = "Player 2 Pad"
+
+use std::collections::BTreeMap;
+use std::fmt;
+use std::str::FromStr;
+
+use anyhow::{Result, bail};
+use serde::{Deserialize, Serialize};
+
+use crate::{input::gamepad::GamepadType, output::gamepad::VirtualGamepadIdentity};
+
+/// Longest name uinput takes, in bytes
+const MAX_NAME_LEN: usize = 79;
+
+/// What a virtual keyboard or mouse presents itself as
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct VirtualDeviceIdentity {
+    pub name: String,
+    pub vendor_id: u16,
+    pub product_id: u16,
+    pub version: u16,
+}
+
+impl VirtualDeviceIdentity {
+    /// `name`, with the IDs virtual keyboards and mice have always had
+    pub fn named(name: &str) -> Self {
+        Self { name: name.to_string(), vendor_id: 0x1234, product_id: 0x5678, version: 0x0111 }
+    }
+}
+
+/// The parts of one device's identity to change; None keeps the default
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct IdentitySettings {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub name: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub vendor_id: Option<u16>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub product_id: Option<u16>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub version: Option<u16>,
+}
+
+impl IdentitySettings {
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+
+    /// These settings, with `fallback`'s where these leave one out
+    pub fn or(&self, fallback: &Self) -> Self {
+        Self {
+            name: self.name.clone().or_else(|| fallback.name.clone()),
+            vendor_id: self.vendor_id.or(fallback.vendor_id),
+            product_id: self.product_id.or(fallback.product_id),
+            version: self.version.or(fallback.version),
+        }
+    }
+
+    /// Why the settings can't work, if they can't
+    pub fn problem(&self) -> Option<String> {
+        let name = self.name.as_deref()?;
+        if name.trim().is_empty() {
+            return Some("name can't be empty".to_string());
+        }
+        (name.len() > MAX_NAME_LEN)
+            .then(|| format!("name '{}' is longer than {} bytes", name, MAX_NAME_LEN))
+    }
+
+    pub fn apply(&self, identity: &mut VirtualDeviceIdentity) {
+        if let Some(name) = &self.name {
+            identity.name = name.clone();
+        }
+        identity.vendor_id = self.vendor_id.unwrap_or(identity.vendor_id);
+        identity.product_id = self.product_id.unwrap_or(identity.product_id);
+        identity.version = self.version.unwrap_or(identity.version);
+    }
+
+    /// Like `apply`; the gamepad's controls and ranges stay as they are
+    pub fn apply_to_gamepad(&self, identity: &mut VirtualGamepadIdentity) {
+        if let Some(name) = &self.name {
+            identity.name = name.clone();
+        }
+        identity.vendor_id = self.vendor_id.unwrap_or(identity.vendor_id);
+        identity.product_id = self.product_id.unwrap_or(identity.product_id);
+        identity.version = self.version.unwrap_or(identity.version);
+    }
+}
+
+fn hex_id(text: &str) -> Result<u16> {
+    match u16::from_str_radix(text.trim_start_matches("0x"), 16) {
+        Ok(id) => Ok(id),
+        Err(_) => bail!("'{}' is not a hex ID, like 054c", text),
+    }
+}
+
+impl FromStr for IdentitySettings {
+    type Err = anyhow::Error;
+
+    /// Comma separated `name=`, `vendor=` (`054c` or `054c:09cc`),
+    /// `product=` and `version=`, IDs in hex
+    fn from_str(text: &str) -> Result<Self> {
+        let mut settings = Self::default();
+        for part in text.split(',').map(str::trim).filter(|part| !part.is_empty()) {
+            let Some((key, value)) = part.split_once('=') else {
+                bail!("'{}' is not KEY=VALUE", part);
+            };
+            let value = value.trim();
+            match key.trim() {
+                "name" => settings.name = Some(value.to_string()),
+                "vendor" => match value.split_once(':') {
+                    Some((vendor, product)) => {
+                        settings.vendor_id = Some(hex_id(vendor)?);
+                        settings.product_id = Some(hex_id(product)?);
+                    }
+                    None => settings.vendor_id = Some(hex_id(value)?),
+                },
+                "product" => settings.product_id = Some(hex_id(value)?),
+                "version" => settings.version = Some(hex_id(value)?),
+                other => bail!("unknown key '{}'; use name, vendor, product or version", other),
+            }
+        }
+        if let Some(problem) = settings.problem() {
+            bail!("{}", problem);
+        }
+        Ok(settings)
+    }
+}
+
+/// The kinds of virtual device
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DeviceKind {
+    Keyboard,
+    Mouse,
+    Gamepad,
+}
+
+impl DeviceKind {
+    pub const ALL: [Self; 3] = [Self::Keyboard, Self::Mouse, Self::Gamepad];
+
+    /// The kind called `name`, like "mouse"
+    pub fn from_name(name: &str) -> Option<Self> {
+        Self::ALL.into_iter().find(|kind| kind.to_string() == name)
+    }
+}
+
+impl fmt::Display for DeviceKind {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::Keyboard => "keyboard",
+            Self::Mouse => "mouse",
+            Self::Gamepad => "gamepad",
+        })
+    }
+}
+
+/// A virtual device a profile declares, beyond the usual three
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CustomDevice {
+    pub kind: DeviceKind,
+    #[serde(flatten)]
+    pub identity: IdentitySettings,
+}
+
+impl CustomDevice {
+    /// What the device called `name` in the profile presents itself as
+    pub fn identity(&self, name: &str) -> VirtualDeviceIdentity {
+        let mut identity = VirtualDeviceIdentity::named(&format!("BlazeRemap {}", name));
+        self.identity.apply(&mut identity);
+        identity
+    }
+
+    /// What the gamepad called `name` in the profile poses as: an Xbox One
+    /// pad, unless its settings say otherwise
+    pub fn gamepad_identity(&self, name: &str) -> VirtualGamepadIdentity {
+        let mut identity = VirtualGamepadIdentity::simulated(GamepadType::XboxOne);
+        identity.name = format!("BlazeRemap {}", name);
+        self.identity.apply_to_gamepad(&mut identity);
+        identity
+    }
+}
+
+/// Identity settings for each kind of virtual device, and the profile's
+/// custom devices by name
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DeviceIdentities {
+    #[serde(default, skip_serializing_if = "IdentitySettings::is_empty")]
+    pub keyboard: IdentitySettings,
+    #[serde(default, skip_serializing_if = "IdentitySettings::is_empty")]
+    pub mouse: IdentitySettings,
+    #[serde(default, skip_serializing_if = "IdentitySettings::is_empty")]
+    pub gamepad: IdentitySettings,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub custom: BTreeMap<String, CustomDevice>,
+}
+
+impl DeviceIdentities {
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+
+    /// Each device's settings, with `fallback`'s where these leave one out
+    pub fn or(&self, fallback: &Self) -> Self {
+        let mut custom = fallback.custom.clone();
+        custom.extend(self.custom.clone());
+        Self {
+            keyboard: self.keyboard.or(&fallback.keyboard),
+            mouse: self.mouse.or(&fallback.mouse),
+            gamepad: self.gamepad.or(&fallback.gamepad),
+            custom,
+        }
+    }
+
+    /// The first device whose settings can't work, and why
+    pub fn problem(&self) -> Option<String> {
+        self.problems().next().map(|(device, problem)| format!("{}: {}", device, problem))
+    }
+
+    /// Each device whose settings can't work, as its path under
+    /// `virtual_devices`, and why
+    pub fn problems(&self) -> impl Iterator<Item = (String, String)> + '_ {
+        let usual =
+            [("keyboard", &self.keyboard), ("mouse", &self.mouse), ("gamepad", &self.gamepad)]
+                .into_iter()
+                .filter_map(|(kind, settings)| Some((kind.to_string(), settings.problem()?)));
+        let custom = self.custom.iter().filter_map(|(name, device)| {
+            let problem = match DeviceKind::from_name(name) {
+                Some(kind) => {
+                    Some(format!("'{}' names the usual {}; call it something else", name, kind))
+                }
+                None if name.trim().is_empty() => Some("a custom device needs a name".to_string()),
+                None => device.identity.problem(),
+            }?;
+            Some((format!("custom.{}", name), problem))
+        });
+        usual.chain(custom)
+    }
+
+    /// The keyboard called `name` unless the settings say otherwise
+    pub fn keyboard(&self, name: &str) -> VirtualDeviceIdentity {
+        let mut identity = VirtualDeviceIdentity::named(name);
+        self.keyboard.apply(&mut identity);
+        identity
+    }
+
+    /// The mouse called `name` unless the settings say otherwise
+    pub fn mouse(&self, name: &str) -> VirtualDeviceIdentity {
+        let mut identity = VirtualDeviceIdentity::named(name);
+        self.mouse.apply(&mut identity);
+        identity
+    }
+}
+
+impl FromStr for DeviceIdentities {
+    type Err = anyhow::Error;
+
+    /// `KIND:SETTINGS` for one device, like "mouse:name=Couch Mouse"
+    fn from_str(text: &str) -> Result<Self> {
+        let Some((kind, settings)) = text.split_once(':') else {
+            bail!("'{}' is not KIND:SETTINGS, like keyboard:name=Couch Keyboard", text);
+        };
+        let settings = settings.parse()?;
+        let mut identities = Self::default();
+        match DeviceKind::from_name(kind.trim()) {
+            Some(DeviceKind::Keyboard) => identities.keyboard = settings,
+            Some(DeviceKind::Mouse) => identities.mouse = settings,
+            Some(DeviceKind::Gamepad) => identities.gamepad = settings,
+            None => bail!("unknown device '{}'; use keyboard, mouse or gamepad", kind.trim()),
+        }
+        Ok(identities)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::gamepad::GamepadType;
+
+    #[test]
+    fn test_parse_and_apply_identities() {
+        let flag: DeviceIdentities =
+            "keyboard: name=Couch Keyboard, vendor=1209:0x0001".parse().unwrap();
+        let profile: DeviceIdentities = toml::from_str(
+            "keyboard = { name = \"Profile Keyboard\", version = 2 }\n\
+             gamepad = { product_id = 0x0b13 }",
+        )
+        .unwrap();
+        let identities = flag.or(&profile);
+
+        assert_eq!(
+            identities.keyboard("BlazeRemap Virtual Keyboard"),
+            VirtualDeviceIdentity {
+                name: "Couch Keyboard".to_string(),
+                vendor_id: 0x1209,
+                product_id: 0x0001,
+                version: 2,
+            }
+        );
+        assert_eq!(
+            identities.mouse("BlazeRemap Virtual Mouse"),
+            VirtualDeviceIdentity::named("BlazeRemap Virtual Mouse")
+        );
+        let mut gamepad = VirtualGamepadIdentity::simulated(GamepadType::XboxSeries);
+        identities.gamepad.apply_to_gamepad(&mut gamepad);
+        assert_eq!((gamepad.vendor_id, gamepad.product_id), (0x045e, 0x0b13));
+    }
+
+    #[test]
+    fn test_bad_identities_fail() {
+        assert!("keyboard".parse::<DeviceIdentities>().is_err());
+        assert!("joystick:name=Pad".parse::<DeviceIdentities>().is_err());
+        assert!("mouse:vendor=wxyz".parse::<DeviceIdentities>().is_err());
+        assert!("mouse:serial=1".parse::<DeviceIdentities>().is_err());
+        let err = "gamepad:name= ".parse::<DeviceIdentities>().unwrap_err();
+        assert_eq!(err.to_string(), "name can't be empty");
+
+        let long = IdentitySettings { name: Some("x".repeat(80)), ..Default::default() };
+        let identities = DeviceIdentities { mouse: long, ..Default::default() };
+        assert!(identities.problem().unwrap().starts_with("mouse: name 'xxx"));
+    }
+
+    #[test]
+    fn test_custom_devices() {
+        let identities: DeviceIdentities = toml::from_str(
+            "custom.p2 = { kind = \"gamepad\", vendor_id = 0x045e }\n\
+             custom.gamepad = { kind = \"keyboard\" }",
+        )
+        .unwrap();
+        let p2 = &identities.custom["p2"];
+        assert_eq!(p2.kind, DeviceKind::Gamepad);
+        assert_eq!(p2.identity("p2").name, "BlazeRemap p2");
+        assert_eq!(p2.identity("p2").vendor_id, 0x045e);
+        assert_eq!(
+            identities.problem().unwrap(),
+            "custom.gamepad: 'gamepad' names the usual gamepad; call it something else"
+        );
+
+        // Flags keep the profile's custom devices
+        let flag: DeviceIdentities = "mouse:name=Couch Mouse".parse().unwrap();
+        assert_eq!(flag.or(&identities).custom.len(), 2);
+    }
+}
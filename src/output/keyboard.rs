@@ -1,6 +1,6 @@
 use anyhow::Result;
 
-use crate::event::KeyboardCode;
+use crate::event::{KeyboardCode, KeyboardEventType, OutputEvent};
 
 /// Domain trait: abstract virtual keyboard operations
 #[cfg_attr(test, mockall::automock)]
@@ -11,6 +11,28 @@ pub trait VirtualKeyboard {
     fn release_key(&mut self, code: KeyboardCode) -> Result<()>;
     /// Tap a key (press then release)
     fn tap_key(&mut self, code: KeyboardCode) -> Result<()>;
+    /// Emit everything produced by one input frame
+    ///
+    /// Backends that can commit several keys atomically (uinput: one
+    /// SYN_REPORT) override this; the default sends them one by one.
+    fn emit_frame(&mut self, events: &[OutputEvent]) -> Result<()> {
+        for event in events {
+            match event {
+                OutputEvent::Keyboard { code, event_type: KeyboardEventType::Press } => {
+                    self.press_key(*code)?
+                }
+                OutputEvent::Keyboard { code, event_type: KeyboardEventType::Release } => {
+                    self.release_key(*code)?
+                }
+                OutputEvent::Keyboard { event_type: KeyboardEventType::Hold, .. } => {}
+                // Not a keyboard's to send
+                OutputEvent::Mouse(_)
+                | OutputEvent::Gamepad { .. }
+                | OutputEvent::Routed { .. } => {}
+            }
+        }
+        Ok(())
+    }
     /// Get sysfs path (for debugging)
     fn sys_path(&mut self) -> Result<std::path::PathBuf>;
 }
@@ -1 +1,10 @@
+pub mod desktop;
+pub mod devices;
+pub mod feedback;
+pub mod gamepad;
+pub mod identity;
 pub mod keyboard;
+pub mod mouse;
+pub mod notify;
+pub mod players;
+pub mod split;
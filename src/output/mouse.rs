@@ -0,0 +1,93 @@
+use std::fmt;
+use std::str::FromStr;
+
+use anyhow::{Result, bail};
+
+use crate::input::keymouse::MouseButton;
+
+/// One change of a virtual mouse
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum MouseEvent {
+    /// Move the pointer by this many pixels; positive is right and down
+    Move {
+        dx: i32,
+        dy: i32,
+    },
+    /// Put the pointer at this pixel, from the screen's top left corner
+    ///
+    /// Only absolute mice take it; the desktop maps the device's range onto
+    /// the screen, like a touchscreen or a tablet's.
+    MoveTo {
+        x: i32,
+        y: i32,
+    },
+    /// Turn the wheels by this many notches; positive is up and right
+    Scroll {
+        vertical: i32,
+        horizontal: i32,
+    },
+    Button {
+        button: MouseButton,
+        pressed: bool,
+    },
+}
+
+/// Size of the screen an absolute mouse positions the pointer on, in pixels
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ScreenSize {
+    pub width: u32,
+    pub height: u32,
+}
+
+impl ScreenSize {
+    /// `x` and `y` moved onto the screen
+    pub fn clamp(&self, x: i32, y: i32) -> (i32, i32) {
+        (x.clamp(0, self.width as i32 - 1), y.clamp(0, self.height as i32 - 1))
+    }
+}
+
+impl FromStr for ScreenSize {
+    type Err = anyhow::Error;
+
+    /// `WIDTHxHEIGHT`, like 1920x1080
+    fn from_str(text: &str) -> Result<Self> {
+        let size = text.split_once(['x', 'X']).and_then(|(width, height)| {
+            Some(Self { width: width.trim().parse().ok()?, height: height.trim().parse().ok()? })
+        });
+        match size {
+            Some(size) if size.width > 0 && size.height > 0 => Ok(size),
+            _ => bail!("'{}' is not a screen size like 1920x1080", text),
+        }
+    }
+}
+
+impl fmt::Display for ScreenSize {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}x{}", self.width, self.height)
+    }
+}
+
+/// Domain trait: a mouse BlazeRemap makes up
+pub trait VirtualMouse: Send {
+    /// Emit one frame of pointer, wheel and button changes
+    ///
+    /// Fails on `MoveTo` unless the mouse is absolute.
+    fn emit_frame(&mut self, events: &[MouseEvent]) -> Result<()>;
+    /// Event node readers open, e.g. /dev/input/event8
+    fn dev_node(&mut self) -> Result<std::path::PathBuf>;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_screen_size() {
+        let screen: ScreenSize = "2560x1440".parse().unwrap();
+        assert_eq!(screen, ScreenSize { width: 2560, height: 1440 });
+        assert_eq!(screen.to_string(), "2560x1440");
+        assert_eq!(screen.clamp(-5, 2000), (0, 1439));
+        assert!("2560".parse::<ScreenSize>().is_err());
+        assert!("0x1440".parse::<ScreenSize>().is_err());
+    }
+}
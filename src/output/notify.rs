@@ -0,0 +1,215 @@
+// Desktop notifications for what happens while remapping
+//
+// The profile's `notify` setting picks what they're sent for:
+// - profile_switch: the profile hotkeys switched profiles
+// - connection:     the controller was connected, or went away
+// - battery_low:    its battery fell below LOW_BATTERY percent; checked
+//                   every minute on a thread of its own, and told again
+//                   only once it has charged past RECHARGED
+//
+// They go to the desktop's notification server, whichever implements
+// org.freedesktop.Notifications.
+
+use std::sync::mpsc::{self, RecvTimeoutError};
+use std::thread::JoinHandle;
+use std::time::Duration;
+
+use anyhow::Result;
+
+use crate::{
+    mapping::{profile::Profile, types::Notify},
+    platform,
+};
+
+/// Battery charge in percent below which it is low
+pub const LOW_BATTERY: u8 = 20;
+/// Charge at which a low battery counts as charged again
+const RECHARGED: u8 = LOW_BATTERY + 5;
+const BATTERY_INTERVAL: Duration = Duration::from_secs(60);
+
+/// How much a notification matters, as the freedesktop spec has it
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Urgency {
+    Low = 0,
+    Normal = 1,
+    Critical = 2,
+}
+
+/// Domain trait: the desktop's notification server
+#[cfg_attr(test, mockall::automock)]
+pub trait Notifier: Send {
+    /// Show `summary` with `body`; returns without waiting
+    fn notify(&mut self, summary: &str, body: &str, urgency: Urgency) -> Result<()>;
+}
+
+/// Sends the notifications a profile asks for, about one controller
+pub struct Notifications {
+    notifier: Option<Box<dyn Notifier>>,
+    on: Vec<Notify>,
+    controller: String,
+    _battery: Option<BatteryWatch>,
+}
+
+impl Notifications {
+    pub fn new(notifier: Box<dyn Notifier>, on: Vec<Notify>, controller: &str) -> Self {
+        Self { notifier: Some(notifier), on, controller: controller.to_string(), _battery: None }
+    }
+
+    /// The notifications `profile` asks for, about the controller called
+    /// `controller` at `device`
+    ///
+    /// None without `notify`, or without a notification server to send to.
+    pub fn for_profile(profile: &Profile, device: &str, controller: &str) -> Option<Self> {
+        let on = &profile.settings.notify;
+        if on.is_empty() {
+            return None;
+        }
+        let notifier = platform::new_notifier()
+            .map_err(|e| tracing::warn!("No desktop notifications: {:#}", e))
+            .ok()?;
+        let mut notifications = Self::new(notifier, on.clone(), controller);
+        if on.contains(&Notify::BatteryLow) {
+            notifications._battery = platform::new_notifier()
+                .and_then(|notifier| BatteryWatch::spawn(device, controller, notifier))
+                .map_err(|e| tracing::warn!("No low battery notifications: {:#}", e))
+                .ok();
+        }
+        Some(notifications)
+    }
+
+    pub fn connected(&mut self) {
+        if self.on.contains(&Notify::Connection) {
+            self.send("Controller connected", &self.controller.clone(), Urgency::Low);
+        }
+    }
+
+    pub fn disconnected(&mut self) {
+        if self.on.contains(&Notify::Connection) {
+            self.send("Controller disconnected", &self.controller.clone(), Urgency::Normal);
+        }
+    }
+
+    /// The hotkeys switched to the profile called `name`
+    pub fn profile_switched(&mut self, name: &str) {
+        if self.on.contains(&Notify::ProfileSwitch) {
+            let body = format!("{} now maps with '{}'", self.controller, name);
+            self.send("Profile switched", &body, Urgency::Low);
+        }
+    }
+
+    fn send(&mut self, summary: &str, body: &str, urgency: Urgency) {
+        if let Some(notifier) = &mut self.notifier
+            && let Err(e) = notifier.notify(summary, body, urgency)
+        {
+            tracing::warn!("Notification failed, going without them: {:#}", e);
+            self.notifier = None;
+        }
+    }
+}
+
+/// Checks the battery on its own thread; stops when dropped
+struct BatteryWatch {
+    stop: Option<mpsc::Sender<()>>,
+    thread: Option<JoinHandle<()>>,
+}
+
+impl BatteryWatch {
+    fn spawn(device: &str, controller: &str, mut notifier: Box<dyn Notifier>) -> Result<Self> {
+        let mut probe = platform::context_probe(device, false);
+        let controller = controller.to_string();
+        let (stop, stopped) = mpsc::channel::<()>();
+        let thread = std::thread::Builder::new().name("blazeremap-battery".to_string()).spawn(
+            move || {
+                let mut low = false;
+                loop {
+                    let level = probe().battery;
+                    if let Some(level) = level.filter(|_| battery_news(&mut low, level)) {
+                        let body = format!("{} is at {}%", controller, level);
+                        if let Err(e) = notifier.notify("Battery low", &body, Urgency::Critical) {
+                            tracing::warn!("Low battery notification failed: {:#}", e);
+                            break;
+                        }
+                    }
+                    if stopped.recv_timeout(BATTERY_INTERVAL) != Err(RecvTimeoutError::Timeout) {
+                        break;
+                    }
+                }
+            },
+        )?;
+        Ok(Self { stop: Some(stop), thread: Some(thread) })
+    }
+}
+
+impl Drop for BatteryWatch {
+    fn drop(&mut self) {
+        drop(self.stop.take());
+        if let Some(thread) = self.thread.take() {
+            let _ = thread.join();
+        }
+    }
+}
+
+/// Whether `level` is news: the battery just got low. `low` remembers that
+/// it is, until it charges past RECHARGED
+fn battery_news(low: &mut bool, level: Option<u8>) -> bool {
+    match level {
+        Some(level) if level < LOW_BATTERY => !std::mem::replace(low, true),
+        Some(level) if level >= RECHARGED => {
+            *low = false;
+            false
+        }
+        _ => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_only_what_the_profile_asks_for() {
+        let mut notifier = MockNotifier::new();
+        notifier
+            .expect_notify()
+            .withf(|summary, body, &urgency| {
+                summary == "Profile switched"
+                    && body == "Xbox Controller now maps with 'Racing'"
+                    && urgency == Urgency::Low
+            })
+            .times(1)
+            .returning(|_, _, _| Ok(()));
+        let mut notifications =
+            Notifications::new(Box::new(notifier), vec![Notify::ProfileSwitch], "Xbox Controller");
+
+        notifications.connected();
+        notifications.profile_switched("Racing");
+        notifications.disconnected();
+    }
+
+    #[test]
+    fn test_failed_notifier_is_dropped() {
+        let mut notifier = MockNotifier::new();
+        notifier.expect_notify().times(1).returning(|_, _, _| anyhow::bail!("no session bus"));
+        let mut notifications =
+            Notifications::new(Box::new(notifier), vec![Notify::Connection], "Pad");
+
+        notifications.connected();
+        notifications.disconnected();
+        assert!(notifications.notifier.is_none());
+    }
+
+    #[test]
+    fn test_battery_low_told_once_per_discharge() {
+        let mut low = false;
+        let levels = [Some(40), Some(19), Some(15), None, Some(22), Some(18), Some(30), Some(10)];
+        let news: Vec<bool> =
+            levels.into_iter().map(|level| battery_news(&mut low, level)).collect();
+        assert_eq!(news, [false, true, false, false, false, false, false, true]);
+    }
+
+    #[test]
+    fn test_for_profile_without_notify() {
+        let profile = Profile::default_profile();
+        assert!(Notifications::for_profile(&profile, "/dev/input/event3", "Pad").is_none());
+    }
+}
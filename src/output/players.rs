@@ -0,0 +1,169 @@
+// Player numbers of the controllers a daemon reads
+//
+// Controllers are numbered in the order they were opened, and each one
+// shows its number on whatever lights it has. The order can be changed
+// while running (`blazeremap players swap 1 2`), for when the controllers
+// were handed out differently.
+
+use anyhow::{Result, bail};
+use serde::{Deserialize, Serialize};
+
+use crate::platform;
+
+/// Domain trait: lights on the controller that tell players apart, like an
+/// Xbox 360 ring or a DualShock 4 lightbar
+#[cfg_attr(test, mockall::automock)]
+pub trait PlayerLight: Send {
+    /// Show that the controller is player `player`, counting from 1
+    fn show(&mut self, player: usize) -> Result<()>;
+}
+
+/// A controller's place in the player order
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct PlayerSlot {
+    /// Counting from 1
+    pub player: usize,
+    pub device: String,
+    /// Whether the controller shows its number
+    pub light: bool,
+}
+
+/// The controllers in player order, with their lights
+pub struct Players {
+    slots: Vec<(String, Option<Box<dyn PlayerLight>>)>,
+}
+
+impl Players {
+    /// Number `devices` in order and light them up; a controller without
+    /// lights is numbered all the same
+    pub fn new(devices: Vec<(String, Option<Box<dyn PlayerLight>>)>) -> Self {
+        let mut players = Self { slots: devices };
+        for index in 0..players.slots.len() {
+            players.show(index);
+        }
+        players
+    }
+
+    /// Number the controllers at `paths` in order, with the lights they have
+    pub fn open(paths: &[String]) -> Self {
+        let devices = paths
+            .iter()
+            .map(|path| {
+                let light = platform::new_player_light(path)
+                    .map_err(|e| tracing::debug!("No player light on {}: {:#}", path, e))
+                    .ok();
+                (path.clone(), light)
+            })
+            .collect();
+        Self::new(devices)
+    }
+
+    pub fn slots(&self) -> Vec<PlayerSlot> {
+        self.slots
+            .iter()
+            .enumerate()
+            .map(|(index, (device, light))| PlayerSlot {
+                player: index + 1,
+                device: device.clone(),
+                light: light.is_some(),
+            })
+            .collect()
+    }
+
+    /// Trade the places of players `a` and `b`, counting from 1
+    pub fn swap(&mut self, a: usize, b: usize) -> Result<()> {
+        for player in [a, b] {
+            if player == 0 || player > self.slots.len() {
+                bail!("There is no player {} ({} connected)", player, self.slots.len());
+            }
+        }
+        self.slots.swap(a - 1, b - 1);
+        self.show(a - 1);
+        self.show(b - 1);
+        Ok(())
+    }
+
+    /// Light up the controller at `index`; lights that fail are let go
+    fn show(&mut self, index: usize) {
+        let (device, light) = &mut self.slots[index];
+        if let Some(shown) = light.as_mut()
+            && let Err(e) = shown.show(index + 1)
+        {
+            tracing::warn!("Player light of {} failed: {:#}", device, e);
+            *light = None;
+        }
+    }
+}
+
+/// The arguments of a `players swap A B` request
+pub fn parse_swap(text: &str) -> Result<(usize, usize)> {
+    let players: Vec<_> = text.split_whitespace().collect();
+    let [a, b] = players[..] else {
+        bail!("Expected two player numbers, like 1 2");
+    };
+    let number = |text: &str| match text.parse::<usize>() {
+        Ok(player) if player > 0 => Ok(player),
+        _ => Err(anyhow::anyhow!("'{}' is not a player number", text)),
+    };
+    Ok((number(a)?, number(b)?))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::{Arc, Mutex};
+
+    /// Shares the numbers it was shown with the test
+    fn light(
+        shown: &Arc<Mutex<Vec<(&'static str, usize)>>>,
+        name: &'static str,
+    ) -> MockPlayerLight {
+        let shown = Arc::clone(shown);
+        let mut light = MockPlayerLight::new();
+        light.expect_show().returning(move |player| {
+            shown.lock().unwrap().push((name, player));
+            Ok(())
+        });
+        light
+    }
+
+    #[test]
+    fn test_players_are_numbered_and_swapped() {
+        let shown = Arc::new(Mutex::new(Vec::new()));
+        let mut players = Players::new(vec![
+            ("/dev/input/event3".to_string(), Some(Box::new(light(&shown, "a")) as _)),
+            ("/dev/input/event5".to_string(), None),
+            ("/dev/input/event7".to_string(), Some(Box::new(light(&shown, "c")) as _)),
+        ]);
+        assert_eq!(*shown.lock().unwrap(), [("a", 1), ("c", 3)]);
+
+        players.swap(1, 3).unwrap();
+        assert_eq!(shown.lock().unwrap()[2..], [("c", 1), ("a", 3)]);
+        let devices: Vec<_> = players.slots().into_iter().map(|slot| slot.device).collect();
+        assert_eq!(devices, ["/dev/input/event7", "/dev/input/event5", "/dev/input/event3"]);
+        assert!(!players.slots()[1].light);
+
+        assert!(players.swap(2, 4).is_err());
+        assert!(players.swap(0, 1).is_err());
+    }
+
+    #[test]
+    fn test_failing_light_is_dropped() {
+        let mut light = MockPlayerLight::new();
+        light.expect_show().times(1).returning(|_| bail!("Permission denied"));
+        let mut players = Players::new(vec![
+            ("/dev/input/event3".to_string(), Some(Box::new(light))),
+            ("/dev/input/event5".to_string(), None),
+        ]);
+        assert!(!players.slots()[0].light);
+        players.swap(1, 2).unwrap();
+    }
+
+    #[test]
+    fn test_parse_swap() {
+        assert_eq!(parse_swap("1 2").unwrap(), (1, 2));
+        assert!(parse_swap("1").is_err());
+        assert!(parse_swap("1 x").is_err());
+        assert!(parse_swap("0 2").is_err());
+    }
+}
@@ -0,0 +1,227 @@
+// Splitting one controller across several virtual devices
+//
+// Each virtual gamepad of a split is handed the controls listed for it, a
+// frame at a time, as the controller reports them. Whatever no gamepad takes
+// is read on as the controller's own, so the mapper turns it into keys as
+// usual: e.g. the D-pad and face buttons drive one virtual gamepad, the
+// sticks another, and the paddles type on the virtual keyboard.
+
+use std::str::FromStr;
+use std::time::Instant;
+
+use anyhow::{Result, bail};
+
+use crate::event::{AxisCode, ButtonCode, InputEvent};
+use crate::input::{Gamepad, GamepadInfo};
+use crate::output::gamepad::VirtualGamepad;
+
+const FACE: [ButtonCode; 4] =
+    [ButtonCode::South, ButtonCode::East, ButtonCode::North, ButtonCode::West];
+const PADDLES: [ButtonCode; 4] =
+    [ButtonCode::Paddle1, ButtonCode::Paddle2, ButtonCode::Paddle3, ButtonCode::Paddle4];
+
+/// Controls a virtual gamepad of a split takes
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ControlSet {
+    buttons: Vec<ButtonCode>,
+    axes: Vec<AxisCode>,
+}
+
+impl ControlSet {
+    pub fn contains(&self, event: &InputEvent) -> bool {
+        match event {
+            InputEvent::Button { code, .. } => self.buttons.contains(code),
+            InputEvent::Axis { code, .. } => self.axes.contains(code),
+            _ => false,
+        }
+    }
+}
+
+impl FromStr for ControlSet {
+    type Err = anyhow::Error;
+
+    /// Comma separated buttons and axes, or the groups DPad, Face and Paddles
+    ///
+    /// Names that are both a button and an axis, such as LeftTrigger, take
+    /// both.
+    fn from_str(text: &str) -> Result<Self> {
+        let mut set = ControlSet::default();
+        for name in text.split(',').map(str::trim).filter(|name| !name.is_empty()) {
+            match name {
+                "DPad" => set.axes.extend([AxisCode::DPadX, AxisCode::DPadY]),
+                "Face" => set.buttons.extend(FACE),
+                "Paddles" => set.buttons.extend(PADDLES),
+                name => {
+                    let button = ButtonCode::from(name);
+                    let axis = AxisCode::from(name);
+                    if button == ButtonCode::Unknown && axis == AxisCode::Unknown {
+                        bail!("'{}' is not a button, axis or group", name);
+                    }
+                    set.buttons.extend(Some(button).filter(|code| *code != ButtonCode::Unknown));
+                    set.axes.extend(Some(axis).filter(|code| *code != AxisCode::Unknown));
+                }
+            }
+        }
+        if set.buttons.is_empty() && set.axes.is_empty() {
+            bail!("No controls given");
+        }
+        Ok(set)
+    }
+}
+
+/// A controller whose listed controls go to virtual gamepads instead
+///
+/// Reads like the controller, minus the controls the gamepads take.
+pub struct SplitGamepad {
+    controller: Box<dyn Gamepad>,
+    outputs: Vec<(ControlSet, Box<dyn VirtualGamepad>)>,
+    // Each output's part of the frame being read
+    parts: Vec<Vec<InputEvent>>,
+}
+
+impl SplitGamepad {
+    /// Hand the controls of each `outputs` set to its gamepad; a control in
+    /// several sets goes to the first
+    pub fn new(
+        controller: Box<dyn Gamepad>,
+        outputs: Vec<(ControlSet, Box<dyn VirtualGamepad>)>,
+    ) -> Self {
+        let parts = vec![Vec::new(); outputs.len()];
+        Self { controller, outputs, parts }
+    }
+
+    /// Send each gamepad its part of the frame
+    fn emit(&mut self) -> Result<()> {
+        for ((_, gamepad), part) in self.outputs.iter_mut().zip(&mut self.parts) {
+            if !part.is_empty() {
+                gamepad.emit_frame(part)?;
+                part.clear();
+            }
+        }
+        Ok(())
+    }
+
+    /// The next event no gamepad takes, the frame's Sync, or None once the
+    /// controller is gone
+    fn next(&mut self, deadline: Option<Instant>) -> Result<Option<InputEvent>> {
+        loop {
+            let event = match deadline {
+                Some(deadline) => self.controller.read_event_until(deadline)?,
+                None => self.controller.read_event()?,
+            };
+            let Some(event) = event else {
+                // A frame cut short still reaches the gamepads
+                self.emit()?;
+                return Ok(None);
+            };
+            if let InputEvent::Sync { .. } = event {
+                self.emit()?;
+                return Ok(Some(event));
+            }
+            match self.outputs.iter().position(|(controls, _)| controls.contains(&event)) {
+                Some(output) => self.parts[output].push(event),
+                None => return Ok(Some(event)),
+            }
+        }
+    }
+}
+
+impl Gamepad for SplitGamepad {
+    fn get_info(&self) -> GamepadInfo {
+        self.controller.get_info()
+    }
+
+    fn read_event(&mut self) -> Result<Option<InputEvent>> {
+        self.next(None)
+    }
+
+    fn read_event_until(&mut self, deadline: Instant) -> Result<Option<InputEvent>> {
+        self.next(Some(deadline))
+    }
+
+    fn close(self) -> Result<()> {
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::gamepad::MockGamepad;
+    use std::path::PathBuf;
+    use std::sync::{Arc, Mutex};
+
+    /// Shares the frames it was sent with the test
+    struct FakeGamepad(Arc<Mutex<Vec<Vec<InputEvent>>>>);
+
+    impl VirtualGamepad for FakeGamepad {
+        fn emit_frame(&mut self, events: &[InputEvent]) -> Result<()> {
+            self.0.lock().unwrap().push(events.to_vec());
+            Ok(())
+        }
+
+        fn dev_node(&mut self) -> Result<PathBuf> {
+            Ok(PathBuf::from("/dev/input/event99"))
+        }
+    }
+
+    #[test]
+    fn test_parse_control_set() {
+        let set: ControlSet = "DPad, Face,LeftTrigger".parse().unwrap();
+        assert_eq!(
+            set.buttons,
+            [
+                ButtonCode::South,
+                ButtonCode::East,
+                ButtonCode::North,
+                ButtonCode::West,
+                ButtonCode::LeftTrigger
+            ]
+        );
+        assert_eq!(set.axes, [AxisCode::DPadX, AxisCode::DPadY, AxisCode::LeftTrigger]);
+
+        let paddles: ControlSet = "Paddles".parse().unwrap();
+        assert_eq!(paddles.buttons, PADDLES);
+
+        assert!("Jump".parse::<ControlSet>().is_err());
+        assert!(" , ".parse::<ControlSet>().is_err());
+    }
+
+    #[test]
+    fn test_split_routes_controls() {
+        let mut events = vec![
+            InputEvent::button_press(ButtonCode::South),
+            InputEvent::axis_move(AxisCode::LeftX, 9000),
+            InputEvent::button_press(ButtonCode::Paddle1),
+            InputEvent::sync(),
+            InputEvent::axis_move(AxisCode::LeftX, 0),
+            InputEvent::sync(),
+            InputEvent::button_press(ButtonCode::East),
+        ]
+        .into_iter();
+        let mut controller = MockGamepad::new();
+        controller.expect_read_event().returning(move || Ok(events.next()));
+
+        let (face, sticks) = (Arc::new(Mutex::new(Vec::new())), Arc::new(Mutex::new(Vec::new())));
+        let mut split = SplitGamepad::new(
+            Box::new(controller),
+            vec![
+                ("Face".parse().unwrap(), Box::new(FakeGamepad(Arc::clone(&face)))),
+                ("LeftX,LeftY".parse().unwrap(), Box::new(FakeGamepad(Arc::clone(&sticks)))),
+            ],
+        );
+
+        let mut left = Vec::new();
+        while let Some(event) = split.read_event().unwrap() {
+            left.push(event);
+        }
+        assert!(matches!(left[0], InputEvent::Button { code: ButtonCode::Paddle1, .. }));
+        assert!(matches!(left[1..], [InputEvent::Sync { .. }, InputEvent::Sync { .. }]));
+
+        let face = face.lock().unwrap();
+        assert_eq!(face.len(), 2);
+        assert!(matches!(face[1][..], [InputEvent::Button { code: ButtonCode::East, .. }]));
+        let sizes: Vec<_> = sticks.lock().unwrap().iter().map(Vec::len).collect();
+        assert_eq!(sizes, [1, 1]);
+    }
+}
@@ -0,0 +1,27 @@
+// Platform selection errors
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+pub enum PlatformError {
+    /// The current OS has no adapter for the requested feature
+    #[error("platform {platform} not yet supported ({feature})")]
+    Unsupported { platform: &'static str, feature: &'static str },
+}
+
+impl PlatformError {
+    /// Unsupported error for the OS this binary was built for
+    pub fn unsupported(feature: &'static str) -> Self {
+        Self::Unsupported { platform: std::env::consts::OS, feature }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_unsupported_message_names_platform_and_feature() {
+        let err = PlatformError::Unsupported { platform: "plan9", feature: "gamepad input" };
+        assert_eq!(err.to_string(), "platform plan9 not yet supported (gamepad input)");
+    }
+}
@@ -0,0 +1,56 @@
+// Ctrl+C (and SIGTERM) for daemons that want to say goodbye
+//
+// By default either signal ends the process on the spot. A command that
+// wants a last word calls `catch` before starting any threads, then
+// `on_interrupt` once it knows what to say; that runs on its own thread and
+// exits. Without `catch` (in tests, or where unsupported) `on_interrupt`
+// does nothing and the signals keep their default.
+
+use std::sync::atomic::{AtomicBool, Ordering};
+
+static CAUGHT: AtomicBool = AtomicBool::new(false);
+
+/// Exit status after an interrupt, as a shell reports SIGINT
+pub const INTERRUPTED_EXIT: i32 = 130;
+
+/// Hold SIGINT/SIGTERM for `on_interrupt`; call before spawning threads
+pub fn catch() {
+    #[cfg(target_os = "linux")]
+    match super::linux::signals::block_termination() {
+        Ok(()) => CAUGHT.store(true, Ordering::Relaxed),
+        Err(e) => tracing::warn!("Could not catch Ctrl+C: {}", e),
+    }
+}
+
+/// Run `handler` when interrupted, then exit with `INTERRUPTED_EXIT`
+///
+/// Only takes effect after `catch`; only the first handler is kept.
+pub fn on_interrupt<F>(handler: F)
+where
+    F: FnOnce() + Send + 'static,
+{
+    if !CAUGHT.swap(false, Ordering::Relaxed) {
+        return;
+    }
+
+    #[cfg(target_os = "linux")]
+    {
+        let spawned = std::thread::Builder::new().name("interrupt".to_string()).spawn(move || {
+            match super::linux::signals::wait_termination() {
+                Ok(signal) => tracing::info!("Interrupted by signal {}", signal),
+                Err(e) => {
+                    tracing::warn!("Waiting for Ctrl+C failed: {}", e);
+                    return;
+                }
+            }
+            handler();
+            std::process::exit(INTERRUPTED_EXIT);
+        });
+        if let Err(e) = spawned {
+            tracing::warn!("Could not start interrupt handler: {}", e);
+        }
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    drop(handler);
+}
@@ -0,0 +1,114 @@
+// Calibration written into the kernel's axis info
+//
+// Every absolute axis has an absinfo: its range, its `flat` (the deadzone
+// programs are told to leave alone) and its `fuzz`. Programs reading the
+// controller directly, SDL and joydev among them, take the middle of the
+// range as center. EVIOCSABS changes the absinfo until the controller is
+// unplugged: moving the range so its middle is where the stick rests, and
+// setting `flat` to the deadzone, corrects the controller for them too.
+
+use super::converter::{ControllerLayout, axis_code_with_layout};
+use crate::input::GamepadInfo;
+use crate::input::calibration::{AxisCalibration, Calibration, DeviceRange};
+use crate::input::range::AxisRange;
+use anyhow::{Context, Result, bail};
+use evdev::{AbsInfo, Device};
+use std::os::fd::AsRawFd;
+
+/// EVIOCSABS(code): _IOW('E', 0xc0 + code, struct input_absinfo)
+fn eviocsabs(code: u16) -> libc::c_ulong {
+    const IOC_WRITE: libc::c_ulong = 1;
+    let size = std::mem::size_of::<libc::input_absinfo>() as libc::c_ulong;
+    (IOC_WRITE << 30)
+        | (size << 16)
+        | ((b'E' as libc::c_ulong) << 8)
+        | (0xc0 + code as libc::c_ulong)
+}
+
+/// The absinfo correcting an axis the driver reports in `original` by
+/// `axis`, keeping `current`'s fuzz and resolution
+fn corrected(axis: &AxisCalibration, original: AxisRange, current: &AbsInfo) -> AbsInfo {
+    let canonical = AxisRange::canonical(axis.axis);
+    let middle = canonical.rescale(0, original);
+    let shift = canonical.rescale(axis.center, original) - middle;
+    let flat = (canonical.rescale(axis.deadzone, original) - middle).abs();
+    AbsInfo::new(
+        current.value(),
+        original.min.saturating_add(shift),
+        original.max.saturating_add(shift),
+        current.fuzz(),
+        flat,
+        current.resolution(),
+    )
+}
+
+/// Write `calibration` into the absinfo of the controller `info` describes
+///
+/// Returns the ranges the driver reported for the axes written, to keep with
+/// the calibration. Ranges already there are written from again, so writing
+/// twice doesn't correct twice.
+pub fn write_calibration(
+    info: &GamepadInfo,
+    calibration: &Calibration,
+) -> Result<Vec<DeviceRange>> {
+    let (path, layout) = (info.path.as_str(), ControllerLayout::from(info.gamepad_type));
+    let device =
+        Device::open(path).with_context(|| format!("Failed to open device at {}", path))?;
+    let axes = device.get_absinfo().context("Failed to read axis info")?.collect::<Vec<_>>();
+    let mut written = Vec::new();
+    for (code, current) in axes {
+        let axis_code = axis_code_with_layout(code, layout);
+        let Some(axis) = calibration.axis(axis_code) else {
+            continue;
+        };
+        let original = calibration
+            .device_range(axis_code)
+            .unwrap_or(AxisRange::new(current.minimum(), current.maximum()));
+        let info = corrected(axis, original, &current);
+        let absinfo = libc::input_absinfo {
+            value: info.value(),
+            minimum: info.minimum(),
+            maximum: info.maximum(),
+            fuzz: info.fuzz(),
+            flat: info.flat(),
+            resolution: info.resolution(),
+        };
+        // SAFETY: the fd is open for as long as `device`, and EVIOCSABS only
+        // reads the input_absinfo it's given
+        let ret = unsafe { libc::ioctl(device.as_raw_fd(), eviocsabs(code.0) as _, &absinfo) };
+        if ret < 0 {
+            return Err(std::io::Error::last_os_error())
+                .with_context(|| format!("Failed to write axis info of {}", axis_code));
+        }
+        written.push(DeviceRange { axis: axis_code, min: original.min, max: original.max });
+    }
+    if written.is_empty() {
+        bail!("None of the calibrated axes is on {}", path);
+    }
+    Ok(written)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::AxisCode;
+
+    #[test]
+    fn test_eviocsabs() {
+        // EVIOCSABS(ABS_X) from <linux/input.h>
+        assert_eq!(eviocsabs(0), 0x401845c0);
+        assert_eq!(eviocsabs(0x11), 0x401845d1);
+    }
+
+    #[test]
+    fn test_corrected() {
+        // hid-sony's 0-255 stick, resting at 131, i.e. 774 normalized
+        let axis = AxisCalibration { axis: AxisCode::LeftX, center: 774, deadzone: 2560 };
+        let current = AbsInfo::new(131, 0, 255, 0, 15, 0);
+        let info = corrected(&axis, AxisRange::new(0, 255), &current);
+
+        assert_eq!((info.minimum(), info.maximum()), (3, 258));
+        assert_eq!(info.flat(), 10);
+        assert_eq!(info.value(), 131);
+    }
+}
@@ -0,0 +1,604 @@
+// Raw evdev access behind an interface
+//
+// Detection and reading only see input devices through `InputBackend` and
+// `BackendDevice`, so the device manager, the readers and the remap loop
+// above them run against `fake::FakeBackend` in tests, without hardware.
+// `EvdevBackend` is the real thing.
+//
+// Inspection commands observe devices instead of opening them: the node is
+// opened read-only and wrapped in `Observed`, which refuses to grab it, so
+// watching a controller can't take it from a game or write to it.
+//
+// Enumerating opens every node, and a stuck driver can hold an open up for
+// good; with a probe timeout (see `EvdevBackend::with_probe`) such a node is
+// skipped and reported as timed out instead.
+
+use crate::input::manager::{ProbeOptions, ProbeStep};
+use crate::input::range::AxisRange;
+use evdev::{
+    AbsoluteAxisCode, Device, EventType, FFEffectCode, KeyCode, PropType, RelativeAxisCode,
+};
+use std::io;
+use std::os::fd::AsFd;
+use std::path::{Path, PathBuf};
+use std::sync::{Mutex, mpsc};
+use std::time::Duration;
+
+/// What a device reports it can do, read once when it's opened
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct DeviceCapabilities {
+    pub name: Option<String>,
+    pub vendor_id: u16,
+    pub product_id: u16,
+    /// EVIOCGUNIQ: often the Bluetooth address, empty over USB
+    pub uniq: Option<String>,
+    /// EVIOCGPHYS: the port or adapter it's attached to
+    pub phys: Option<String>,
+    pub keys: Vec<KeyCode>,
+    pub absolute_axes: Vec<AbsoluteAxisCode>,
+    /// Mouse movement and wheels
+    pub relative_axes: Vec<RelativeAxisCode>,
+    /// EVIOCGABS minimum and maximum of each absolute axis
+    pub axis_ranges: Vec<(AbsoluteAxisCode, AxisRange)>,
+    /// Force feedback effects; empty without EV_FF
+    pub ff_effects: Vec<FFEffectCode>,
+    /// INPUT_PROP_ACCELEROMETER: a motion sensor node rather than controls
+    pub accelerometer: bool,
+}
+
+/// One open input device
+pub trait BackendDevice: AsFd + Send {
+    fn capabilities(&self) -> DeviceCapabilities;
+
+    /// Append the events the kernel has for us to `out`
+    ///
+    /// Blocks unless the fd was made non-blocking. A disconnected device
+    /// fails with ENODEV.
+    fn fetch_events(&mut self, out: &mut Vec<evdev::InputEvent>) -> io::Result<()>;
+
+    /// Take the device for ourselves, so nothing else sees its events
+    fn grab(&mut self) -> io::Result<()>;
+
+    fn ungrab(&mut self) -> io::Result<()>;
+}
+
+/// A device node that couldn't be opened
+#[derive(Debug)]
+pub struct UnopenedDevice {
+    pub path: PathBuf,
+    /// As much as can be found out without opening it: the name, keys and
+    /// absolute axes
+    pub capabilities: DeviceCapabilities,
+    pub error: io::Error,
+}
+
+/// Finds and opens input devices
+pub trait InputBackend: Send + Sync {
+    /// Every input device we may open, with its node
+    fn enumerate(&self) -> Vec<(PathBuf, Box<dyn BackendDevice>)>;
+
+    /// The device nodes `enumerate` leaves out because they can't be opened
+    ///
+    /// The default knows of none.
+    fn unopened(&self) -> Vec<UnopenedDevice> {
+        Vec::new()
+    }
+
+    fn open(&self, path: &str) -> io::Result<Box<dyn BackendDevice>>;
+
+    /// Open the device at `path` only to watch it; see `Observed`
+    ///
+    /// The default wraps `open`.
+    fn observe(&self, path: &str) -> io::Result<Box<dyn BackendDevice>> {
+        Ok(Box::new(Observed(self.open(path)?)))
+    }
+
+    /// Fail, saying how to get access, unless the nodes at `paths` can be
+    /// opened; checked before opening any of them
+    ///
+    /// The default checks nothing.
+    fn check_access(&self, _paths: &[String]) -> anyhow::Result<()> {
+        Ok(())
+    }
+
+    /// What the device at `path` is, found without opening it; only its
+    /// name and IDs are sure to be known
+    fn describe(&self, path: &str) -> Option<DeviceCapabilities>;
+}
+
+/// A device opened only to watch it: grabbing it fails, so other programs
+/// keep receiving its events
+pub struct Observed(pub Box<dyn BackendDevice>);
+
+impl AsFd for Observed {
+    fn as_fd(&self) -> std::os::fd::BorrowedFd<'_> {
+        self.0.as_fd()
+    }
+}
+
+impl BackendDevice for Observed {
+    fn capabilities(&self) -> DeviceCapabilities {
+        self.0.capabilities()
+    }
+
+    fn fetch_events(&mut self, out: &mut Vec<evdev::InputEvent>) -> io::Result<()> {
+        self.0.fetch_events(out)
+    }
+
+    fn grab(&mut self) -> io::Result<()> {
+        Err(io::Error::new(
+            io::ErrorKind::PermissionDenied,
+            "the device is only being observed; grabbing it would take it from other programs",
+        ))
+    }
+
+    // Never grabbed, so there's nothing to release
+    fn ungrab(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Devices under /dev/input, through the kernel's evdev interface
+#[derive(Debug, Default)]
+pub struct EvdevBackend {
+    probe: ProbeOptions,
+    // Nodes `enumerate` gave up on, so `unopened` doesn't wait on them again
+    slow: Mutex<Vec<PathBuf>>,
+}
+
+impl EvdevBackend {
+    /// Try each node while enumerating as `probe` says
+    pub fn with_probe(probe: ProbeOptions) -> Self {
+        Self { probe, slow: Mutex::default() }
+    }
+
+    fn slow(&self) -> std::sync::MutexGuard<'_, Vec<PathBuf>> {
+        self.slow.lock().unwrap_or_else(|e| e.into_inner())
+    }
+}
+
+/// The event nodes under /dev/input, in directory order
+fn event_nodes() -> Vec<PathBuf> {
+    let Ok(entries) = std::fs::read_dir("/dev/input") else {
+        return Vec::new();
+    };
+    entries
+        .flatten()
+        .filter(|entry| entry.file_name().to_string_lossy().starts_with("event"))
+        .map(|entry| entry.path())
+        .collect()
+}
+
+/// `open` the node at `path`, failing with `TimedOut` if that takes longer
+/// than `timeout`
+///
+/// A driver that never answers would block the open forever, so it's done
+/// on a thread of its own, left behind if it's too slow; should the open
+/// finish after all, the device is closed.
+fn open_within<T: Send + 'static>(
+    path: &Path,
+    timeout: Option<Duration>,
+    open: fn(PathBuf) -> io::Result<T>,
+) -> io::Result<T> {
+    let Some(timeout) = timeout else {
+        return open(path.to_path_buf());
+    };
+    let (sender, receiver) = mpsc::channel();
+    let node = path.to_path_buf();
+    std::thread::Builder::new()
+        .name("blazeremap-probe".to_string())
+        .spawn(move || sender.send(open(node)))?;
+    receiver.recv_timeout(timeout).unwrap_or_else(|_| {
+        Err(io::Error::new(
+            io::ErrorKind::TimedOut,
+            format!("no answer within {:.1}s", timeout.as_secs_f64()),
+        ))
+    })
+}
+
+impl InputBackend for EvdevBackend {
+    fn enumerate(&self) -> Vec<(PathBuf, Box<dyn BackendDevice>)> {
+        let nodes = event_nodes();
+        let mut devices = Vec::new();
+        for (index, path) in nodes.iter().enumerate() {
+            if let Some(progress) = &self.probe.progress {
+                progress(ProbeStep { path, number: index + 1, total: nodes.len() });
+            }
+            match open_within(path, self.probe.timeout, Device::open) {
+                Ok(device) => {
+                    devices.push((path.clone(), Box::new(device) as Box<dyn BackendDevice>))
+                }
+                Err(e) if e.kind() == io::ErrorKind::TimedOut => {
+                    tracing::warn!("Skipping {}: {}", path.display(), e);
+                    self.slow().push(path.clone());
+                }
+                // Reported by `unopened`
+                Err(_) => {}
+            }
+        }
+        devices
+    }
+
+    fn unopened(&self) -> Vec<UnopenedDevice> {
+        let slow = self.slow().clone();
+        let mut unopened: Vec<_> = event_nodes()
+            .into_iter()
+            .filter_map(|path| {
+                let error = match slow.contains(&path) {
+                    true => io::Error::new(io::ErrorKind::TimedOut, "didn't open in time"),
+                    false => open_within(&path, self.probe.timeout, Device::open).err()?,
+                };
+                let capabilities = sysfs_capabilities(&path.file_name()?.to_string_lossy());
+                Some(UnopenedDevice { path, capabilities, error })
+            })
+            .collect();
+        unopened.sort_by(|a, b| a.path.cmp(&b.path));
+        unopened
+    }
+
+    fn open(&self, path: &str) -> io::Result<Box<dyn BackendDevice>> {
+        Ok(Box::new(Device::open(path)?))
+    }
+
+    // Device::open falls back to read-only; observing never asks for more
+    fn observe(&self, path: &str) -> io::Result<Box<dyn BackendDevice>> {
+        let node = std::fs::OpenOptions::new().read(true).open(path)?;
+        Ok(Box::new(Observed(Box::new(Device::from_fd(node.into())?))))
+    }
+
+    fn check_access(&self, paths: &[String]) -> anyhow::Result<()> {
+        Ok(super::preflight::check_input(paths)?)
+    }
+
+    fn describe(&self, path: &str) -> Option<DeviceCapabilities> {
+        let node = std::fs::canonicalize(path).ok()?;
+        let capabilities = sysfs_capabilities(&node.file_name()?.to_string_lossy());
+        capabilities.name.is_some().then_some(capabilities)
+    }
+}
+
+/// What sysfs tells anyone about the event node `node` (like "event3")
+fn sysfs_capabilities(node: &str) -> DeviceCapabilities {
+    let device = PathBuf::from("/sys/class/input").join(node).join("device");
+    let read = |name: &str| std::fs::read_to_string(device.join(name)).unwrap_or_default();
+    let text = |name: &str| Some(read(name).trim().to_string()).filter(|text| !text.is_empty());
+    let id = |name: &str| u16::from_str_radix(read(name).trim(), 16).unwrap_or_default();
+    DeviceCapabilities {
+        name: text("name"),
+        vendor_id: id("id/vendor"),
+        product_id: id("id/product"),
+        uniq: text("uniq"),
+        phys: text("phys"),
+        keys: bitmap_codes(&read("capabilities/key")).into_iter().map(KeyCode::new).collect(),
+        absolute_axes: bitmap_codes(&read("capabilities/abs"))
+            .into_iter()
+            .map(AbsoluteAxisCode)
+            .collect(),
+        ..Default::default()
+    }
+}
+
+/// The codes set in a sysfs capability bitmap: words of the kernel's long
+/// size in hex, the highest first
+fn bitmap_codes(bitmap: &str) -> Vec<u16> {
+    let bits = std::mem::size_of::<libc::c_long>() * 8;
+    let mut codes = Vec::new();
+    for (index, word) in bitmap.split_whitespace().rev().enumerate() {
+        let Ok(word) = u64::from_str_radix(word, 16) else {
+            return Vec::new();
+        };
+        for bit in (0..bits).filter(|&bit| word & (1 << bit) != 0) {
+            codes.push((index * bits + bit) as u16);
+        }
+    }
+    codes
+}
+
+impl BackendDevice for Device {
+    fn capabilities(&self) -> DeviceCapabilities {
+        let input_id = self.input_id();
+        let ff_effects = match self.supported_events().contains(EventType::FORCEFEEDBACK) {
+            true => self.supported_ff().map(|ff| ff.iter().collect()).unwrap_or_default(),
+            false => Vec::new(),
+        };
+        DeviceCapabilities {
+            name: self.name().map(str::to_string),
+            vendor_id: input_id.vendor(),
+            product_id: input_id.product(),
+            uniq: self.unique_name().filter(|uniq| !uniq.is_empty()).map(str::to_string),
+            phys: self.physical_path().filter(|phys| !phys.is_empty()).map(str::to_string),
+            keys: self.supported_keys().map(|keys| keys.iter().collect()).unwrap_or_default(),
+            absolute_axes: self
+                .supported_absolute_axes()
+                .map(|axes| axes.iter().collect())
+                .unwrap_or_default(),
+            relative_axes: self
+                .supported_relative_axes()
+                .map(|axes| axes.iter().collect())
+                .unwrap_or_default(),
+            axis_ranges: self
+                .get_absinfo()
+                .map(|axes| {
+                    axes.map(|(code, info)| (code, AxisRange::new(info.minimum(), info.maximum())))
+                        .collect()
+                })
+                .unwrap_or_default(),
+            ff_effects,
+            accelerometer: self.properties().contains(PropType::ACCELEROMETER),
+        }
+    }
+
+    fn fetch_events(&mut self, out: &mut Vec<evdev::InputEvent>) -> io::Result<()> {
+        out.extend(Device::fetch_events(self)?);
+        Ok(())
+    }
+
+    fn grab(&mut self) -> io::Result<()> {
+        Device::grab(self)
+    }
+
+    fn ungrab(&mut self) -> io::Result<()> {
+        Device::ungrab(self)
+    }
+}
+
+#[cfg(test)]
+pub(crate) mod fake {
+    //! Scripted devices for tests
+    //!
+    //! A fake device hands out its batches of events one per fetch, then
+    //! reports ENODEV as if unplugged. Its fd is an eventfd that is always
+    //! readable, so epoll and poll wake for it like for a real device with
+    //! events waiting.
+
+    use super::*;
+    use nix::sys::eventfd::{EfdFlags, EventFd};
+    use std::collections::VecDeque;
+    use std::os::fd::BorrowedFd;
+
+    const ENODEV: i32 = 19;
+
+    /// A device the fake backend can enumerate and open
+    #[derive(Debug, Clone)]
+    pub(crate) struct FakeDeviceSpec {
+        pub path: String,
+        pub capabilities: DeviceCapabilities,
+        /// Each fetch returns the next batch
+        pub batches: Vec<Vec<evdev::InputEvent>>,
+    }
+
+    impl FakeDeviceSpec {
+        /// A controller laid out like an Xbox One pad
+        pub fn gamepad(path: &str) -> Self {
+            Self {
+                path: path.to_string(),
+                capabilities: DeviceCapabilities {
+                    name: Some("Microsoft X-Box One pad".to_string()),
+                    vendor_id: 0x045e,
+                    product_id: 0x02ea,
+                    uniq: None,
+                    phys: None,
+                    keys: vec![
+                        KeyCode::BTN_SOUTH,
+                        KeyCode::BTN_EAST,
+                        KeyCode::BTN_NORTH,
+                        KeyCode::BTN_WEST,
+                        KeyCode::BTN_TL,
+                        KeyCode::BTN_TR,
+                        KeyCode::BTN_SELECT,
+                        KeyCode::BTN_START,
+                        KeyCode::BTN_MODE,
+                        KeyCode::BTN_THUMBL,
+                        KeyCode::BTN_THUMBR,
+                    ],
+                    absolute_axes: vec![
+                        AbsoluteAxisCode::ABS_X,
+                        AbsoluteAxisCode::ABS_Y,
+                        AbsoluteAxisCode::ABS_RX,
+                        AbsoluteAxisCode::ABS_RY,
+                        AbsoluteAxisCode::ABS_Z,
+                        AbsoluteAxisCode::ABS_RZ,
+                        AbsoluteAxisCode::ABS_HAT0X,
+                        AbsoluteAxisCode::ABS_HAT0Y,
+                    ],
+                    // xpad's, which need no normalizing
+                    axis_ranges: vec![
+                        (AbsoluteAxisCode::ABS_X, AxisRange::STICK),
+                        (AbsoluteAxisCode::ABS_Y, AxisRange::STICK),
+                        (AbsoluteAxisCode::ABS_RX, AxisRange::STICK),
+                        (AbsoluteAxisCode::ABS_RY, AxisRange::STICK),
+                        (AbsoluteAxisCode::ABS_Z, AxisRange::TRIGGER),
+                        (AbsoluteAxisCode::ABS_RZ, AxisRange::TRIGGER),
+                        (AbsoluteAxisCode::ABS_HAT0X, AxisRange::HAT),
+                        (AbsoluteAxisCode::ABS_HAT0Y, AxisRange::HAT),
+                    ],
+                    relative_axes: Vec::new(),
+                    ff_effects: vec![FFEffectCode::FF_RUMBLE],
+                    accelerometer: false,
+                },
+                batches: Vec::new(),
+            }
+        }
+
+        /// A keyboard, which detection must skip
+        pub fn keyboard(path: &str) -> Self {
+            Self {
+                path: path.to_string(),
+                capabilities: DeviceCapabilities {
+                    name: Some("AT Translated Set 2 keyboard".to_string()),
+                    keys: vec![KeyCode::KEY_A, KeyCode::KEY_Z, KeyCode::KEY_SPACE],
+                    ..Default::default()
+                },
+                batches: Vec::new(),
+            }
+        }
+
+        /// A mouse with three buttons and a wheel
+        pub fn mouse(path: &str) -> Self {
+            Self {
+                path: path.to_string(),
+                capabilities: DeviceCapabilities {
+                    name: Some("Logitech USB Optical Mouse".to_string()),
+                    keys: vec![KeyCode::BTN_LEFT, KeyCode::BTN_RIGHT, KeyCode::BTN_MIDDLE],
+                    relative_axes: vec![
+                        RelativeAxisCode::REL_X,
+                        RelativeAxisCode::REL_Y,
+                        RelativeAxisCode::REL_WHEEL,
+                    ],
+                    ..Default::default()
+                },
+                batches: Vec::new(),
+            }
+        }
+
+        /// Add a batch: these events, then SYN_REPORT
+        pub fn frame(mut self, events: &[(EventType, u16, i32)]) -> Self {
+            let mut batch: Vec<_> = events
+                .iter()
+                .map(|&(event_type, code, value)| evdev::InputEvent::new(event_type.0, code, value))
+                .collect();
+            batch.push(evdev::InputEvent::new(EventType::SYNCHRONIZATION.0, 0, 0));
+            self.batches.push(batch);
+            self
+        }
+    }
+
+    pub(crate) struct FakeDevice {
+        capabilities: DeviceCapabilities,
+        batches: VecDeque<Vec<evdev::InputEvent>>,
+        ready: EventFd,
+    }
+
+    impl AsFd for FakeDevice {
+        fn as_fd(&self) -> BorrowedFd<'_> {
+            self.ready.as_fd()
+        }
+    }
+
+    impl BackendDevice for FakeDevice {
+        fn capabilities(&self) -> DeviceCapabilities {
+            self.capabilities.clone()
+        }
+
+        fn fetch_events(&mut self, out: &mut Vec<evdev::InputEvent>) -> io::Result<()> {
+            match self.batches.pop_front() {
+                Some(batch) => {
+                    out.extend(batch);
+                    Ok(())
+                }
+                None => Err(io::Error::from_raw_os_error(ENODEV)),
+            }
+        }
+
+        fn grab(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+
+        fn ungrab(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+    }
+
+    /// Enumerates and opens the devices it was given
+    pub(crate) struct FakeBackend {
+        devices: Vec<FakeDeviceSpec>,
+        // Left out of `enumerate` as if permission was denied
+        denied: Vec<FakeDeviceSpec>,
+    }
+
+    impl FakeBackend {
+        pub fn new(devices: Vec<FakeDeviceSpec>) -> Self {
+            Self { devices, denied: Vec::new() }
+        }
+
+        /// Also have `spec`, which can't be opened for lack of permission
+        pub fn with_denied(mut self, spec: FakeDeviceSpec) -> Self {
+            self.denied.push(spec);
+            self
+        }
+
+        fn device(&self, spec: &FakeDeviceSpec) -> Box<dyn BackendDevice> {
+            let ready = EventFd::from_value_and_flags(1, EfdFlags::EFD_CLOEXEC).unwrap();
+            Box::new(FakeDevice {
+                capabilities: spec.capabilities.clone(),
+                batches: spec.batches.iter().cloned().collect(),
+                ready,
+            })
+        }
+    }
+
+    impl InputBackend for FakeBackend {
+        fn enumerate(&self) -> Vec<(PathBuf, Box<dyn BackendDevice>)> {
+            self.devices.iter().map(|spec| (PathBuf::from(&spec.path), self.device(spec))).collect()
+        }
+
+        fn unopened(&self) -> Vec<UnopenedDevice> {
+            self.denied
+                .iter()
+                .map(|spec| UnopenedDevice {
+                    path: PathBuf::from(&spec.path),
+                    capabilities: spec.capabilities.clone(),
+                    error: io::Error::from(io::ErrorKind::PermissionDenied),
+                })
+                .collect()
+        }
+
+        fn open(&self, path: &str) -> io::Result<Box<dyn BackendDevice>> {
+            self.devices
+                .iter()
+                .find(|spec| spec.path == path)
+                .map(|spec| self.device(spec))
+                .ok_or_else(|| io::Error::from(io::ErrorKind::NotFound))
+        }
+
+        fn describe(&self, path: &str) -> Option<DeviceCapabilities> {
+            let spec = self.devices.iter().chain(&self.denied).find(|spec| spec.path == path)?;
+            Some(spec.capabilities.clone())
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_bitmap_codes() {
+        // BTN_SOUTH (0x130) and BTN_EAST in the fifth 64-bit word, KEY_ESC in the first
+        let words = match std::mem::size_of::<libc::c_long>() {
+            8 => "3000000000000 0 0 0 2",
+            _ => "30000 0 0 0 0 0 0 0 0 2",
+        };
+        assert_eq!(bitmap_codes(words), [1, 0x130, 0x131]);
+        assert!(bitmap_codes("0\n").is_empty());
+        assert!(bitmap_codes("zz").is_empty());
+    }
+
+    #[test]
+    fn test_open_within_gives_up_on_slow_nodes() {
+        let path = Path::new("/dev/input/event7");
+        let stuck = |_| {
+            std::thread::sleep(Duration::from_secs(5));
+            Ok(())
+        };
+        let error = open_within(path, Some(Duration::from_millis(20)), stuck).unwrap_err();
+        assert_eq!(error.kind(), io::ErrorKind::TimedOut);
+
+        // Quick answers, failures included, come through as they are
+        let missing = |_| Err::<(), _>(io::Error::from(io::ErrorKind::NotFound));
+        let error = open_within(path, Some(Duration::from_secs(5)), missing).unwrap_err();
+        assert_eq!(error.kind(), io::ErrorKind::NotFound);
+        assert!(open_within(path, None, |node| Ok(node)).is_ok());
+    }
+
+    #[test]
+    fn test_observed_devices_refuse_grabs() {
+        let backend =
+            fake::FakeBackend::new(vec![fake::FakeDeviceSpec::gamepad("/dev/input/event3")]);
+        let mut device = backend.observe("/dev/input/event3").unwrap();
+        let error = device.grab().unwrap_err();
+        assert_eq!(error.kind(), io::ErrorKind::PermissionDenied);
+        assert!(device.ungrab().is_ok());
+        assert_eq!(device.capabilities().vendor_id, 0x045e);
+    }
+}
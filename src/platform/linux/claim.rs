@@ -0,0 +1,189 @@
+// Keeping two remap sessions off one controller
+//
+// Sessions don't grab controllers (games may read them too), so two of
+// them on one controller would both turn its input into keys. A session
+// holds an advisory lock on each device node instead: a second session,
+// in this process or another, fails to take it and is told who holds it,
+// from /proc/locks. Grabs that fail because another program grabbed the
+// device name the processes that have it open, from /proc/<pid>/fd.
+
+use anyhow::{Result, bail};
+use std::fs::File;
+use std::io;
+use std::os::fd::AsRawFd;
+use std::os::unix::fs::MetadataExt;
+use std::path::Path;
+
+/// Locks on the device nodes of one remap session, released when dropped
+#[derive(Debug)]
+pub struct DeviceClaim {
+    _nodes: Vec<File>,
+}
+
+impl DeviceClaim {
+    /// Lock the nodes at `paths`; fails naming the process that holds one
+    ///
+    /// Nodes that can't be opened are skipped, opening them to read reports
+    /// why.
+    pub fn new(paths: &[String]) -> Result<Self> {
+        let mut nodes = Vec::new();
+        for path in paths {
+            let node = match File::open(path) {
+                Ok(node) => node,
+                Err(e) => {
+                    tracing::debug!("Not claiming {}: {}", path, e);
+                    continue;
+                }
+            };
+            // SAFETY: flock only reads the fd, which `node` keeps open
+            if unsafe { libc::flock(node.as_raw_fd(), libc::LOCK_EX | libc::LOCK_NB) } != 0 {
+                let error = io::Error::last_os_error();
+                if error.raw_os_error() != Some(libc::EWOULDBLOCK) {
+                    tracing::debug!("Not claiming {}: {}", path, error);
+                    continue;
+                }
+                match lock_owner(&node) {
+                    Some(pid) if pid == std::process::id() => {
+                        bail!("{} is already remapped by another session of this process", path)
+                    }
+                    Some(pid) => bail!(
+                        "{} is already remapped by {}; stop it first",
+                        path,
+                        describe_process(pid)
+                    ),
+                    None => bail!("{} is already remapped by another session", path),
+                }
+            }
+            nodes.push(node);
+        }
+        Ok(Self { _nodes: nodes })
+    }
+}
+
+/// The error for a failed grab of the device at `path`, naming who else has
+/// it open when it's grabbed already
+pub(super) fn grab_error(path: &str, error: io::Error) -> anyhow::Error {
+    if error.raw_os_error() != Some(libc::EBUSY) {
+        return anyhow::Error::new(error).context(format!("Failed to grab {}", path));
+    }
+    let holders: Vec<String> = holders(path).into_iter().map(describe_process).collect();
+    match holders.as_slice() {
+        [] => anyhow::anyhow!("{} is already grabbed by another program", path),
+        holders => anyhow::anyhow!(
+            "{} is already grabbed by another program; it is open in {}",
+            path,
+            holders.join(", ")
+        ),
+    }
+}
+
+/// The process holding the flock on `node`
+fn lock_owner(node: &File) -> Option<u32> {
+    let metadata = node.metadata().ok()?;
+    let locks = std::fs::read_to_string("/proc/locks").ok()?;
+    find_lock_owner(
+        &locks,
+        libc::major(metadata.dev()),
+        libc::minor(metadata.dev()),
+        metadata.ino(),
+    )
+}
+
+/// The pid of the FLOCK line of /proc/locks for inode `inode` on device
+/// `major`:`minor`
+///
+/// Lines look like `3: FLOCK  ADVISORY  WRITE 4321 00:05:917 0 EOF`; the
+/// device numbers are hex, the inode decimal. Waiters (`->`) are skipped.
+fn find_lock_owner(locks: &str, major: u32, minor: u32, inode: u64) -> Option<u32> {
+    locks.lines().find_map(|line| {
+        let fields: Vec<&str> = line.split_whitespace().collect();
+        let [_, "FLOCK", _, _, pid, file, ..] = fields[..] else {
+            return None;
+        };
+        let mut parts = file.split(':');
+        let (Some(maj), Some(min), Some(ino)) = (parts.next(), parts.next(), parts.next()) else {
+            return None;
+        };
+        let matches = u32::from_str_radix(maj, 16).ok()? == major
+            && u32::from_str_radix(min, 16).ok()? == minor
+            && ino.parse::<u64>().ok()? == inode;
+        if matches { pid.parse().ok() } else { None }
+    })
+}
+
+/// Processes other than this one with the node at `path` open, as far as
+/// we may look into them
+fn holders(path: &str) -> Vec<u32> {
+    let Ok(node) = std::fs::canonicalize(path) else {
+        return Vec::new();
+    };
+    let Ok(processes) = std::fs::read_dir("/proc") else {
+        return Vec::new();
+    };
+    let mut pids: Vec<u32> = processes
+        .flatten()
+        .filter_map(|entry| entry.file_name().to_str()?.parse::<u32>().ok())
+        .filter(|&pid| pid != std::process::id())
+        .filter(|pid| has_open(&Path::new("/proc").join(pid.to_string()).join("fd"), &node))
+        .collect();
+    pids.sort();
+    pids
+}
+
+fn has_open(fds: &Path, node: &Path) -> bool {
+    let Ok(fds) = std::fs::read_dir(fds) else {
+        return false;
+    };
+    fds.flatten().any(|fd| std::fs::read_link(fd.path()).is_ok_and(|target| target == node))
+}
+
+/// `steam (pid 1200)`
+fn describe_process(pid: u32) -> String {
+    match std::fs::read_to_string(format!("/proc/{}/comm", pid)) {
+        Ok(name) => format!("{} (pid {})", name.trim(), pid),
+        Err(_) => format!("pid {}", pid),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_second_claim_fails() {
+        let path = std::env::temp_dir().join(format!("blazeremap-claim-{}", std::process::id()));
+        std::fs::write(&path, "").unwrap();
+        let paths = [path.to_string_lossy().into_owned()];
+
+        let claim = DeviceClaim::new(&paths).unwrap();
+        let err = DeviceClaim::new(&paths).unwrap_err();
+        assert!(err.to_string().contains("another session of this process"), "{}", err);
+        drop(claim);
+        assert!(DeviceClaim::new(&paths).is_ok());
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[test]
+    fn test_missing_nodes_are_not_claimed() {
+        assert!(DeviceClaim::new(&["/dev/input/does-not-exist".to_string()]).is_ok());
+    }
+
+    #[test]
+    fn test_find_lock_owner() {
+        let locks = "1: POSIX  ADVISORY  WRITE 800 00:19:917 0 EOF\n\
+                     2: FLOCK  ADVISORY  WRITE 4321 00:05:917 0 EOF\n\
+                     2: -> FLOCK  ADVISORY  WRITE 4400 00:05:917 0 EOF\n\
+                     3: FLOCK  ADVISORY  WRITE 99 00:1a:917 0 EOF\n";
+        assert_eq!(find_lock_owner(locks, 0, 5, 917), Some(4321));
+        assert_eq!(find_lock_owner(locks, 0, 0x1a, 917), Some(99));
+        assert_eq!(find_lock_owner(locks, 0, 5, 918), None);
+    }
+
+    #[test]
+    fn test_grab_error() {
+        let err = grab_error("/dev/input/event3", io::Error::from_raw_os_error(libc::EBUSY));
+        assert!(err.to_string().starts_with("/dev/input/event3 is already grabbed"));
+        let err = grab_error("/dev/input/event3", io::Error::from_raw_os_error(libc::ENODEV));
+        assert_eq!(err.to_string(), "Failed to grab /dev/input/event3");
+    }
+}
@@ -0,0 +1,256 @@
+// Confining the commands exec actions and plugins run
+//
+// Unless `--exec-unconfined` is given, every command starts with
+// no_new_privs set, so setuid programs like sudo can't raise it, and under a
+// seccomp filter that refuses, with EPERM, the system calls a hotkey command
+// has no business making:
+//
+// - deleting or renaming files, so a shared profile's `rm -rf ~` fails, and
+//   io_uring, whose requests would do both without those system calls
+// - mounting, rebooting, swapping, setting the clock or the hostname
+// - loading kernel modules or new kernels
+// - tracing or writing into other processes, entering namespaces, bpf
+//
+// Everything else is allowed, so volume, screenshot and media commands work
+// as before. That includes writing files: open(O_TRUNC), ftruncate and write
+// stay allowed because screenshot tools and Wayland clients (memfd buffers)
+// need them, so a command can still overwrite anything the user can. The
+// exec allowlist is what keeps such commands out.
+//
+// System calls made through another ABI would slip past the numbers below,
+// so 32-bit compat calls kill the command and x32 ones are refused too.
+//
+// The filter is built once when the profile loads; the child only installs
+// it between fork and exec.
+
+use std::os::unix::process::CommandExt;
+use std::process::Command;
+
+use anyhow::Result;
+use libc::sock_filter;
+
+// From linux/audit.h, which libc doesn't carry
+#[cfg(target_arch = "x86_64")]
+const AUDIT_ARCH: u32 = 0xC000_003E;
+#[cfg(target_arch = "aarch64")]
+const AUDIT_ARCH: u32 = 0xC000_00B7;
+
+/// x32 system calls have this bit set in their number on x86_64
+const X32_SYSCALL_BIT: u32 = 0x4000_0000;
+
+/// Offsets into struct seccomp_data
+const NR_OFFSET: u32 = 0;
+const ARCH_OFFSET: u32 = 4;
+
+/// What a command may not do, beyond the calls every architecture has
+#[cfg(target_arch = "x86_64")]
+const ARCH_DENIED: &[libc::c_long] =
+    &[libc::SYS_unlink, libc::SYS_rmdir, libc::SYS_rename, libc::SYS_renameat];
+#[cfg(target_arch = "aarch64")]
+const ARCH_DENIED: &[libc::c_long] = &[libc::SYS_renameat];
+
+#[cfg(any(target_arch = "x86_64", target_arch = "aarch64"))]
+const DENIED: &[libc::c_long] = &[
+    // Files
+    libc::SYS_unlinkat,
+    libc::SYS_renameat2,
+    libc::SYS_truncate,
+    libc::SYS_io_uring_setup,
+    libc::SYS_io_uring_enter,
+    libc::SYS_io_uring_register,
+    // The system
+    libc::SYS_mount,
+    libc::SYS_umount2,
+    libc::SYS_pivot_root,
+    libc::SYS_chroot,
+    libc::SYS_swapon,
+    libc::SYS_swapoff,
+    libc::SYS_reboot,
+    libc::SYS_settimeofday,
+    libc::SYS_clock_settime,
+    libc::SYS_sethostname,
+    libc::SYS_setdomainname,
+    // The kernel
+    libc::SYS_init_module,
+    libc::SYS_finit_module,
+    libc::SYS_delete_module,
+    libc::SYS_kexec_load,
+    libc::SYS_kexec_file_load,
+    libc::SYS_bpf,
+    libc::SYS_perf_event_open,
+    libc::SYS_add_key,
+    libc::SYS_request_key,
+    libc::SYS_keyctl,
+    // Other processes
+    libc::SYS_ptrace,
+    libc::SYS_process_vm_readv,
+    libc::SYS_process_vm_writev,
+    libc::SYS_setns,
+    libc::SYS_unshare,
+];
+
+/// Confines the commands it is applied to; see above
+pub struct Confinement {
+    filter: Vec<sock_filter>,
+}
+
+impl Confinement {
+    /// Fails on architectures the filter isn't written for
+    pub fn new() -> Result<Self> {
+        #[cfg(any(target_arch = "x86_64", target_arch = "aarch64"))]
+        return Ok(Self { filter: filter(AUDIT_ARCH, &denied()) });
+
+        #[cfg(not(any(target_arch = "x86_64", target_arch = "aarch64")))]
+        Err(crate::platform::PlatformError::unsupported("confining commands on this CPU").into())
+    }
+
+    /// Have `command` start confined
+    pub fn apply(&self, command: &mut Command) {
+        let filter = self.filter.clone();
+        // SAFETY: between fork and exec the closure only makes system calls,
+        // on memory allocated before the fork
+        unsafe {
+            command.pre_exec(move || {
+                if libc::prctl(libc::PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) != 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+                let program = libc::sock_fprog {
+                    len: filter.len() as u16,
+                    filter: filter.as_ptr() as *mut _,
+                };
+                let mode = libc::SECCOMP_MODE_FILTER as libc::c_ulong;
+                if libc::prctl(libc::PR_SET_SECCOMP, mode, &program as *const libc::sock_fprog) != 0
+                {
+                    return Err(std::io::Error::last_os_error());
+                }
+                Ok(())
+            });
+        }
+    }
+}
+
+#[cfg(any(target_arch = "x86_64", target_arch = "aarch64"))]
+fn denied() -> Vec<u32> {
+    let mut denied: Vec<u32> = DENIED.iter().chain(ARCH_DENIED).map(|&nr| nr as u32).collect();
+    #[cfg(target_arch = "x86_64")]
+    denied.push(X32_SYSCALL_BIT);
+    denied
+}
+
+fn statement(code: u32, k: u32) -> sock_filter {
+    sock_filter { code: code as u16, jt: 0, jf: 0, k }
+}
+
+fn jump(code: u32, k: u32, jt: u8, jf: u8) -> sock_filter {
+    sock_filter { code: code as u16, jt, jf, k }
+}
+
+/// A filter allowing all but the `denied` system calls of `arch`
+///
+/// X32_SYSCALL_BIT among them denies every call numbered at or above it.
+fn filter(arch: u32, denied: &[u32]) -> Vec<sock_filter> {
+    use libc::{BPF_ABS, BPF_JEQ, BPF_JGE, BPF_JMP, BPF_K, BPF_LD, BPF_RET, BPF_W};
+
+    let mut filter = vec![
+        statement(BPF_LD | BPF_W | BPF_ABS, ARCH_OFFSET),
+        jump(BPF_JMP | BPF_JEQ | BPF_K, arch, 1, 0),
+        statement(BPF_RET | BPF_K, libc::SECCOMP_RET_KILL_PROCESS),
+        statement(BPF_LD | BPF_W | BPF_ABS, NR_OFFSET),
+    ];
+    // Each check jumps past the ones after it and the allow, to the deny
+    for (i, &nr) in denied.iter().enumerate() {
+        let test = if nr == X32_SYSCALL_BIT { BPF_JGE } else { BPF_JEQ };
+        let past = u8::try_from(denied.len() - i).expect("at most 255 denied calls");
+        filter.push(jump(BPF_JMP | test | BPF_K, nr, past, 0));
+    }
+    filter.push(statement(BPF_RET | BPF_K, libc::SECCOMP_RET_ALLOW));
+    filter.push(statement(
+        BPF_RET | BPF_K,
+        libc::SECCOMP_RET_ERRNO | (libc::EPERM as u32 & libc::SECCOMP_RET_DATA),
+    ));
+    filter
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// What `filter` returns for system call `nr` of `arch`
+    fn run(filter: &[sock_filter], arch: u32, nr: u32) -> u32 {
+        let mut accumulator = 0;
+        let mut pc = 0;
+        loop {
+            let insn = filter[pc];
+            let code = insn.code as u32;
+            pc += 1;
+            match code & 0x07 {
+                libc::BPF_LD => {
+                    accumulator = if insn.k == ARCH_OFFSET { arch } else { nr };
+                }
+                libc::BPF_JMP => {
+                    let taken = match code & 0xf0 {
+                        libc::BPF_JEQ => accumulator == insn.k,
+                        libc::BPF_JGE => accumulator >= insn.k,
+                        other => panic!("unexpected jump {:#x}", other),
+                    };
+                    pc += if taken { insn.jt } else { insn.jf } as usize;
+                }
+                libc::BPF_RET => return insn.k,
+                other => panic!("unexpected instruction class {:#x}", other),
+            }
+        }
+    }
+
+    #[test]
+    fn test_filter() {
+        let filter = filter(0xC000_003E, &[87, 263, X32_SYSCALL_BIT]);
+        let eperm = libc::SECCOMP_RET_ERRNO | libc::EPERM as u32;
+        assert_eq!(run(&filter, 0xC000_003E, 87), eperm);
+        assert_eq!(run(&filter, 0xC000_003E, 263), eperm);
+        assert_eq!(run(&filter, 0xC000_003E, 0x4000_0001), eperm);
+        assert_eq!(run(&filter, 0xC000_003E, 0), libc::SECCOMP_RET_ALLOW);
+        assert_eq!(run(&filter, 0xC000_003E, 88), libc::SECCOMP_RET_ALLOW);
+        // i386 calls through int 0x80
+        assert_eq!(run(&filter, 0x4000_0003, 0), libc::SECCOMP_RET_KILL_PROCESS);
+    }
+
+    #[test]
+    #[cfg(any(target_arch = "x86_64", target_arch = "aarch64"))]
+    fn test_confined_command_cannot_delete() {
+        let file = std::env::temp_dir().join(format!("blazeremap-confine-{}", std::process::id()));
+        std::fs::write(&file, "keep").unwrap();
+        let confinement = Confinement::new().unwrap();
+
+        let mut rm = Command::new("rm");
+        rm.arg(&file).stderr(std::process::Stdio::null());
+        confinement.apply(&mut rm);
+        assert!(!rm.status().unwrap().success());
+        assert!(file.exists());
+
+        let mut cat = Command::new("cat");
+        cat.arg(&file).stdout(std::process::Stdio::null());
+        confinement.apply(&mut cat);
+        assert!(cat.status().unwrap().success());
+        std::fs::remove_file(file).unwrap();
+    }
+
+    #[test]
+    #[cfg(any(target_arch = "x86_64", target_arch = "aarch64"))]
+    fn test_confined_command_cannot_set_up_io_uring() {
+        let mut command = Command::new("true");
+        Confinement::new().unwrap().apply(&mut command);
+        // Runs after the filter is installed; spawning fails unless it refused
+        unsafe {
+            command.pre_exec(|| {
+                // struct io_uring_params, zeroed
+                let mut params = [0u8; 120];
+                match libc::syscall(libc::SYS_io_uring_setup, 1, params.as_mut_ptr()) {
+                    -1 if *libc::__errno_location() == libc::EPERM => Ok(()),
+                    -1 => Err(std::io::Error::last_os_error()),
+                    _ => Err(std::io::ErrorKind::Unsupported.into()),
+                }
+            });
+        }
+        assert!(command.status().unwrap().success());
+    }
+}
@@ -0,0 +1,99 @@
+// Context sampling for conditional mappings
+//
+// Connection and battery come from the controller's sysfs node. The focused
+// window comes from xdotool, so window conditions need X11 (or XWayland
+// windows); elsewhere the window stays unknown and those conditions never
+// match.
+
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+
+use crate::mapping::context::MappingContext;
+
+/// BUS_BLUETOOTH from linux/input.h
+const BUS_BLUETOOTH: u16 = 0x05;
+
+/// Samples the context of the controller at `device`
+pub struct ContextProbe {
+    sysfs: Option<PathBuf>,
+    window: bool,
+}
+
+impl ContextProbe {
+    /// `window` asks for the focused window too, which costs a process spawn
+    pub fn new(device: &str, window: bool) -> Self {
+        if window && std::env::var_os("DISPLAY").is_none() {
+            tracing::warn!("Window conditions need an X11 display and xdotool; they won't match");
+        }
+        Self { sysfs: sysfs_device(device), window }
+    }
+
+    pub fn sample(&self) -> MappingContext {
+        let sysfs = self.sysfs.as_deref();
+        MappingContext {
+            window: if self.window { active_window() } else { None },
+            bluetooth: sysfs.is_some_and(is_bluetooth),
+            battery: sysfs.and_then(battery_level),
+        }
+    }
+}
+
+/// /sys/class/input/eventN/device for a device node (or a symlink to one)
+pub(super) fn sysfs_device(device: &str) -> Option<PathBuf> {
+    let node = std::fs::canonicalize(device).ok()?;
+    Some(Path::new("/sys/class/input").join(node.file_name()?).join("device"))
+}
+
+fn is_bluetooth(sysfs: &Path) -> bool {
+    std::fs::read_to_string(sysfs.join("id/bustype"))
+        .ok()
+        .and_then(|bus| u16::from_str_radix(bus.trim(), 16).ok())
+        == Some(BUS_BLUETOOTH)
+}
+
+/// Capacity of the first battery of the HID device behind the input device
+fn battery_level(sysfs: &Path) -> Option<u8> {
+    std::fs::read_dir(sysfs.join("device/power_supply"))
+        .ok()?
+        .flatten()
+        .find_map(|supply| std::fs::read_to_string(supply.path().join("capacity")).ok())
+        .and_then(|capacity| capacity.trim().parse().ok())
+}
+
+fn active_window() -> Option<String> {
+    let output = Command::new("xdotool")
+        .args(["getactivewindow", "getwindowname"])
+        .stdin(Stdio::null())
+        .stderr(Stdio::null())
+        .output()
+        .ok()?;
+    let title = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    (output.status.success() && !title.is_empty()).then_some(title)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_reads_bus_and_battery_from_sysfs() {
+        let root = std::env::temp_dir().join(format!("blazeremap-sysfs-{}", std::process::id()));
+        let supply = root.join("device/power_supply/ps-controller-battery-aa:bb");
+        std::fs::create_dir_all(root.join("id")).unwrap();
+        std::fs::create_dir_all(&supply).unwrap();
+        std::fs::write(root.join("id/bustype"), "0005\n").unwrap();
+        std::fs::write(supply.join("capacity"), "35\n").unwrap();
+
+        let probe = ContextProbe { sysfs: Some(root.clone()), window: false };
+        let context = probe.sample();
+        std::fs::remove_dir_all(root).unwrap();
+
+        assert_eq!(context, MappingContext { window: None, bluetooth: true, battery: Some(35) });
+    }
+
+    #[test]
+    fn test_missing_device_is_unknown() {
+        let probe = ContextProbe::new("/dev/input/does-not-exist", false);
+        assert_eq!(probe.sample(), MappingContext::default());
+    }
+}
@@ -23,25 +23,74 @@ Conversion utilities for translating evdev events to domain events.
  when the event is converted. This timestamp represents when BlazeRemap's userspace
  code received the event, which is the starting point for latency measurement.
 
+ # Controller Layouts
+ A few controllers reuse generic codes for different controls. The Steam Deck
+ (hid-steam) reports its trackpads on `ABS_HAT0`/`ABS_HAT1`, trigger pressure
+ on `ABS_HAT2` and the D-pad as `BTN_DPAD_*` buttons, so it gets its own
+ [`ControllerLayout`].
+
  # Note
  Unsupported evdev event types (LED, SOUND, etc.) are filtered out and return
  `None`, as they are not relevant for gamepad input remapping.
 */
 
 use crate::event::{AxisCode, ButtonCode, InputEvent, KeyboardCode, system_time_to_instant};
+use crate::input::gamepad::GamepadType;
+
+// D-pad buttons (not in every evdev release's KeyCode constants)
+const BTN_DPAD_UP: u16 = 0x220;
+const BTN_DPAD_DOWN: u16 = 0x221;
+const BTN_DPAD_LEFT: u16 = 0x222;
+const BTN_DPAD_RIGHT: u16 = 0x223;
+// Steam Deck back grips on kernels that report them as BTN_GRIP*
+const BTN_GRIPL: u16 = 0x224;
+const BTN_GRIPR: u16 = 0x225;
+const BTN_GRIPL2: u16 = 0x226;
+const BTN_GRIPR2: u16 = 0x227;
+
+/// How a device's generic evdev codes should be interpreted
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ControllerLayout {
+    Standard,
+    SteamDeck,
+}
+
+impl From<GamepadType> for ControllerLayout {
+    fn from(gamepad_type: GamepadType) -> Self {
+        match gamepad_type {
+            GamepadType::SteamDeck => ControllerLayout::SteamDeck,
+            _ => ControllerLayout::Standard,
+        }
+    }
+}
 
 pub fn evdev_to_input(ev: evdev::InputEvent) -> Option<InputEvent> {
+    evdev_to_input_with_layout(ev, ControllerLayout::Standard)
+}
+
+pub fn evdev_to_input_with_layout(
+    ev: evdev::InputEvent,
+    layout: ControllerLayout,
+) -> Option<InputEvent> {
     //  Convert kernel's SystemTime to Instant (preserves timing)
     let timestamp = system_time_to_instant(ev.timestamp());
 
     match ev.destructure() {
         evdev::EventSummary::Key(_, key_code, _value) => {
-            let button_code = key_to_button_code(key_code);
             let pressed = _value > 0;
+            // D-pad buttons become DPad axis movements so mappings work the
+            // same as for hat-based D-pads
+            if let Some((code, value)) = dpad_button_to_axis(key_code, pressed) {
+                return Some(InputEvent::Axis { code, value, timestamp });
+            }
+            let button_code = match layout {
+                ControllerLayout::Standard => key_to_button_code(key_code),
+                ControllerLayout::SteamDeck => steam_deck_key_to_button_code(key_code),
+            };
             Some(InputEvent::Button { code: button_code, pressed, timestamp })
         }
         evdev::EventSummary::AbsoluteAxis(_, axis_code, value) => {
-            let axis_code = absolute_axis_to_axis_code(axis_code);
+            let axis_code = axis_code_with_layout(axis_code, layout);
             Some(InputEvent::Axis { code: axis_code, value, timestamp })
         }
         evdev::EventSummary::Switch(_, _switch_code, _value) => {
@@ -54,6 +103,14 @@ pub fn evdev_to_input(ev: evdev::InputEvent) -> Option<InputEvent> {
     }
 }
 
+/// The axis `axis` is on a controller laid out as `layout`
+pub fn axis_code_with_layout(axis: evdev::AbsoluteAxisCode, layout: ControllerLayout) -> AxisCode {
+    match layout {
+        ControllerLayout::Standard => absolute_axis_to_axis_code(axis),
+        ControllerLayout::SteamDeck => steam_deck_axis_to_axis_code(axis),
+    }
+}
+
 fn key_to_button_code(key: evdev::KeyCode) -> ButtonCode {
     match key {
         evdev::KeyCode::BTN_SOUTH => ButtonCode::South,
@@ -73,10 +130,71 @@ fn key_to_button_code(key: evdev::KeyCode) -> ButtonCode {
         evdev::KeyCode::BTN_TRIGGER_HAPPY2 => ButtonCode::Paddle2,
         evdev::KeyCode::BTN_TRIGGER_HAPPY3 => ButtonCode::Paddle3,
         evdev::KeyCode::BTN_TRIGGER_HAPPY4 => ButtonCode::Paddle4,
-        _ => ButtonCode::Unknown,
+        _ => match key.code() {
+            // Same order as hid-steam's BTN_TRIGGER_HAPPY1-4 (L5, R5, L4, R4)
+            BTN_GRIPL2 => ButtonCode::Paddle1,
+            BTN_GRIPR2 => ButtonCode::Paddle2,
+            BTN_GRIPL => ButtonCode::Paddle3,
+            BTN_GRIPR => ButtonCode::Paddle4,
+            _ => ButtonCode::Unknown,
+        },
+    }
+}
+
+/// Reverse of `key_to_button_code` for the standard layout
+pub fn button_code_to_evdev_key(code: ButtonCode) -> Option<evdev::KeyCode> {
+    let key = match code {
+        ButtonCode::South => evdev::KeyCode::BTN_SOUTH,
+        ButtonCode::East => evdev::KeyCode::BTN_EAST,
+        ButtonCode::North => evdev::KeyCode::BTN_NORTH,
+        ButtonCode::West => evdev::KeyCode::BTN_WEST,
+        ButtonCode::LeftShoulder => evdev::KeyCode::BTN_TL,
+        ButtonCode::RightShoulder => evdev::KeyCode::BTN_TR,
+        ButtonCode::LeftTrigger => evdev::KeyCode::BTN_TL2,
+        ButtonCode::RightTrigger => evdev::KeyCode::BTN_TR2,
+        ButtonCode::Select => evdev::KeyCode::BTN_SELECT,
+        ButtonCode::Start => evdev::KeyCode::BTN_START,
+        ButtonCode::Mode => evdev::KeyCode::BTN_MODE,
+        ButtonCode::LeftStick => evdev::KeyCode::BTN_THUMBL,
+        ButtonCode::RightStick => evdev::KeyCode::BTN_THUMBR,
+        ButtonCode::Paddle1 => evdev::KeyCode::BTN_TRIGGER_HAPPY1,
+        ButtonCode::Paddle2 => evdev::KeyCode::BTN_TRIGGER_HAPPY2,
+        ButtonCode::Paddle3 => evdev::KeyCode::BTN_TRIGGER_HAPPY3,
+        ButtonCode::Paddle4 => evdev::KeyCode::BTN_TRIGGER_HAPPY4,
+        _ => return None,
+    };
+    Some(key)
+}
+
+/// Steam Deck: trackpad clicks use the joystick BTN_THUMB codes
+fn steam_deck_key_to_button_code(key: evdev::KeyCode) -> ButtonCode {
+    match key {
+        evdev::KeyCode::BTN_THUMB => ButtonCode::LeftPad,
+        evdev::KeyCode::BTN_THUMB2 => ButtonCode::RightPad,
+        _ => key_to_button_code(key),
     }
 }
 
+/// Translate a BTN_DPAD_* press/release into a DPad axis value
+fn dpad_button_to_axis(key: evdev::KeyCode, pressed: bool) -> Option<(AxisCode, i32)> {
+    let (code, direction) = match key.code() {
+        BTN_DPAD_UP => (AxisCode::DPadY, -1),
+        BTN_DPAD_DOWN => (AxisCode::DPadY, 1),
+        BTN_DPAD_LEFT => (AxisCode::DPadX, -1),
+        BTN_DPAD_RIGHT => (AxisCode::DPadX, 1),
+        _ => return None,
+    };
+    Some((code, if pressed { direction } else { 0 }))
+}
+
+/// Reverse of `keyboard_code_to_evdev_key`; None for keys BlazeRemap has no code for
+pub fn evdev_key_to_keyboard_code(key: evdev::KeyCode) -> Option<KeyboardCode> {
+    KeyboardCode::ALL.into_iter().find(|&code| {
+        !matches!(code, KeyboardCode::Reserved | KeyboardCode::Unknown)
+            && keyboard_code_to_evdev_key(code) == key
+    })
+}
+
 pub fn keyboard_code_to_evdev_key(code: KeyboardCode) -> evdev::KeyCode {
     match code {
         KeyboardCode::Reserved => evdev::KeyCode::KEY_RESERVED,
@@ -163,6 +281,8 @@ pub fn keyboard_code_to_evdev_key(code: KeyboardCode) -> evdev::KeyCode {
         KeyboardCode::Kp3 => evdev::KeyCode::KEY_KP3,
         KeyboardCode::Kp0 => evdev::KeyCode::KEY_KP0,
         KeyboardCode::KpDot => evdev::KeyCode::KEY_KPDOT,
+        KeyboardCode::F11 => evdev::KeyCode::KEY_F11,
+        KeyboardCode::F12 => evdev::KeyCode::KEY_F12,
         KeyboardCode::KpEnter => evdev::KeyCode::KEY_KPENTER,
         KeyboardCode::RightControl => evdev::KeyCode::KEY_RIGHTCTRL,
         KeyboardCode::KpSlash => evdev::KeyCode::KEY_KPSLASH,
@@ -318,6 +438,35 @@ fn absolute_axis_to_axis_code(axis: evdev::AbsoluteAxisCode) -> AxisCode {
     }
 }
 
+/// Reverse of `absolute_axis_to_axis_code`
+pub fn axis_code_to_evdev_axis(code: AxisCode) -> Option<evdev::AbsoluteAxisCode> {
+    let axis = match code {
+        AxisCode::LeftX => evdev::AbsoluteAxisCode::ABS_X,
+        AxisCode::LeftY => evdev::AbsoluteAxisCode::ABS_Y,
+        AxisCode::RightX => evdev::AbsoluteAxisCode::ABS_RX,
+        AxisCode::RightY => evdev::AbsoluteAxisCode::ABS_RY,
+        AxisCode::LeftTrigger => evdev::AbsoluteAxisCode::ABS_Z,
+        AxisCode::RightTrigger => evdev::AbsoluteAxisCode::ABS_RZ,
+        AxisCode::DPadX => evdev::AbsoluteAxisCode::ABS_HAT0X,
+        AxisCode::DPadY => evdev::AbsoluteAxisCode::ABS_HAT0Y,
+        _ => return None,
+    };
+    Some(axis)
+}
+
+/// Steam Deck: hats carry trackpads and analog trigger pressure
+fn steam_deck_axis_to_axis_code(axis: evdev::AbsoluteAxisCode) -> AxisCode {
+    match axis {
+        evdev::AbsoluteAxisCode::ABS_HAT0X => AxisCode::LeftPadX,
+        evdev::AbsoluteAxisCode::ABS_HAT0Y => AxisCode::LeftPadY,
+        evdev::AbsoluteAxisCode::ABS_HAT1X => AxisCode::RightPadX,
+        evdev::AbsoluteAxisCode::ABS_HAT1Y => AxisCode::RightPadY,
+        evdev::AbsoluteAxisCode::ABS_HAT2Y => AxisCode::LeftTrigger,
+        evdev::AbsoluteAxisCode::ABS_HAT2X => AxisCode::RightTrigger,
+        _ => absolute_axis_to_axis_code(axis),
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -485,4 +634,96 @@ mod tests {
 
         let _result2 = absolute_axis_to_axis_code(evdev::AbsoluteAxisCode::ABS_X);
     }
+
+    #[test]
+    fn test_dpad_buttons_become_dpad_axis() {
+        let up = EvdevEvent::new(evdev::EventType::KEY.0, BTN_DPAD_UP, 1);
+        assert!(matches!(
+            evdev_to_input(up),
+            Some(InputEvent::Axis { code: AxisCode::DPadY, value: -1, .. })
+        ));
+
+        let released = EvdevEvent::new(evdev::EventType::KEY.0, BTN_DPAD_RIGHT, 0);
+        assert!(matches!(
+            evdev_to_input(released),
+            Some(InputEvent::Axis { code: AxisCode::DPadX, value: 0, .. })
+        ));
+    }
+
+    #[test]
+    fn test_steam_deck_layout() {
+        let layout = ControllerLayout::from(GamepadType::SteamDeck);
+
+        let pad = EvdevEvent::new(evdev::EventType::ABSOLUTE.0, 0x10, 1200);
+        assert!(matches!(
+            evdev_to_input_with_layout(pad, layout),
+            Some(InputEvent::Axis { code: AxisCode::LeftPadX, value: 1200, .. })
+        ));
+
+        let click = EvdevEvent::new(evdev::EventType::KEY.0, 0x122, 1);
+        assert!(matches!(
+            evdev_to_input_with_layout(click, layout),
+            Some(InputEvent::Button { code: ButtonCode::RightPad, pressed: true, .. })
+        ));
+
+        let grip = EvdevEvent::new(evdev::EventType::KEY.0, BTN_GRIPL, 1);
+        assert!(matches!(
+            evdev_to_input_with_layout(grip, layout),
+            Some(InputEvent::Button { code: ButtonCode::Paddle3, .. })
+        ));
+
+        // Standard layout keeps HAT0 as the D-pad
+        let hat = EvdevEvent::new(evdev::EventType::ABSOLUTE.0, 0x10, 1);
+        assert!(matches!(
+            evdev_to_input(hat),
+            Some(InputEvent::Axis { code: AxisCode::DPadX, .. })
+        ));
+    }
+
+    #[test]
+    fn test_keyboard_codes_map_to_distinct_keys() {
+        let mut seen = std::collections::HashMap::new();
+        for code in KeyboardCode::ALL {
+            let key = keyboard_code_to_evdev_key(code);
+            // Only the placeholders share KEY_RESERVED, and KEY_ROTATE_DISPLAY
+            // is a kernel alias of KEY_DIRECTION
+            if key == evdev::KeyCode::KEY_RESERVED || code == KeyboardCode::RotateDisplay {
+                continue;
+            }
+            if let Some(previous) = seen.insert(key.code(), code) {
+                panic!("{:?} and {:?} both map to {:?}", previous, code, key);
+            }
+        }
+    }
+
+    #[test]
+    fn test_button_code_to_evdev_key_round_trips() {
+        for code in ButtonCode::ALL {
+            if let Some(key) = button_code_to_evdev_key(code) {
+                assert_eq!(key_to_button_code(key), code);
+            }
+        }
+    }
+
+    #[test]
+    fn test_axis_code_to_evdev_axis_round_trips() {
+        for code in AxisCode::ALL {
+            if let Some(axis) = axis_code_to_evdev_axis(code) {
+                assert_eq!(absolute_axis_to_axis_code(axis), code);
+            }
+        }
+    }
+
+    #[test]
+    fn test_evdev_key_to_keyboard_code_round_trips() {
+        assert_eq!(
+            evdev_key_to_keyboard_code(evdev::KeyCode::KEY_SPACE),
+            Some(KeyboardCode::Space)
+        );
+        assert_eq!(evdev_key_to_keyboard_code(evdev::KeyCode::KEY_RESERVED), None);
+        assert_eq!(evdev_key_to_keyboard_code(evdev::KeyCode::BTN_SOUTH), None);
+        for code in [KeyboardCode::A, KeyboardCode::LeftShift, KeyboardCode::F12] {
+            assert_eq!(evdev_key_to_keyboard_code(keyboard_code_to_evdev_key(code)), Some(code));
+        }
+    }
 }
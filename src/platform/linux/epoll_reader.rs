@@ -0,0 +1,177 @@
+// Epoll-based reader servicing several controllers from one thread
+//
+// Every device fd is registered with a single epoll instance (level
+// triggered) together with an eventfd used for shutdown. One blocking
+// `epoll_wait` covers all devices, so there is no thread per controller and
+// stopping is a single write to the eventfd. Events are handed out one
+// complete SYN_REPORT frame at a time, so frames from different devices never
+// interleave. A frame a device's storm guard holds back is released by
+// waking up when it's due.
+
+use super::gamepad::LinuxGamepad;
+use crate::event::InputEvent;
+use crate::input::gamepad::{Gamepad, GamepadInfo};
+use anyhow::Context;
+use nix::sys::epoll::{Epoll, EpollCreateFlags, EpollEvent, EpollFlags, EpollTimeout};
+use nix::sys::eventfd::{EfdFlags, EventFd};
+use std::collections::VecDeque;
+use std::sync::Arc;
+use std::time::Instant;
+
+// Device tokens are slot indexes; the shutdown eventfd uses the top value
+const SHUTDOWN_TOKEN: u64 = u64::MAX;
+const MAX_READY: usize = 16;
+
+/// Wakes an `EpollReader` blocked in `read_event` and makes it return None
+#[derive(Clone)]
+pub struct ShutdownHandle {
+    eventfd: Arc<EventFd>,
+}
+
+impl ShutdownHandle {
+    pub fn trigger(&self) -> anyhow::Result<()> {
+        self.eventfd.write(1).context("Failed to signal epoll reader shutdown")?;
+        Ok(())
+    }
+}
+
+/// Multiplexes several Linux gamepads into a single event stream
+pub struct EpollReader {
+    epoll: Epoll,
+    shutdown: Arc<EventFd>,
+    gamepads: Vec<Option<LinuxGamepad>>,
+    pending: VecDeque<InputEvent>,
+    // Device to check first for a ready frame, so a chatty one can't starve the rest
+    next: usize,
+    info: GamepadInfo,
+}
+
+impl EpollReader {
+    pub fn new(gamepads: Vec<LinuxGamepad>) -> anyhow::Result<Self> {
+        anyhow::ensure!(!gamepads.is_empty(), "EpollReader needs at least one gamepad");
+
+        let epoll = Epoll::new(EpollCreateFlags::EPOLL_CLOEXEC)?;
+        let shutdown = Arc::new(EventFd::from_value_and_flags(
+            0,
+            EfdFlags::EFD_CLOEXEC | EfdFlags::EFD_NONBLOCK,
+        )?);
+        epoll.add(shutdown.as_ref(), EpollEvent::new(EpollFlags::EPOLLIN, SHUTDOWN_TOKEN))?;
+
+        for (token, gamepad) in gamepads.iter().enumerate() {
+            gamepad.set_nonblocking()?;
+            epoll.add(gamepad, EpollEvent::new(EpollFlags::EPOLLIN, token as u64))?;
+        }
+
+        let info = combined_info(&gamepads);
+        Ok(Self {
+            epoll,
+            shutdown,
+            gamepads: gamepads.into_iter().map(Some).collect(),
+            pending: VecDeque::new(),
+            next: 0,
+            info,
+        })
+    }
+
+    pub fn shutdown_handle(&self) -> ShutdownHandle {
+        ShutdownHandle { eventfd: Arc::clone(&self.shutdown) }
+    }
+
+    fn open_count(&self) -> usize {
+        self.gamepads.iter().filter(|g| g.is_some()).count()
+    }
+
+    /// Queue the next complete frame from any device, round-robin
+    fn take_frame(&mut self) -> bool {
+        let count = self.gamepads.len();
+        for offset in 0..count {
+            let index = (self.next + offset) % count;
+            if let Some(gamepad) = self.gamepads[index].as_mut()
+                && gamepad.pop_frame(&mut self.pending)
+            {
+                self.next = (index + 1) % count;
+                return true;
+            }
+        }
+        false
+    }
+
+    /// Queue the frames storm guards held back that may go now, and return
+    /// when the next of the rest may
+    fn release_held(&mut self) -> Option<Instant> {
+        let now = Instant::now();
+        self.gamepads.iter_mut().flatten().filter_map(|gamepad| gamepad.release_held(now)).min()
+    }
+
+    fn service(&mut self, token: usize) -> anyhow::Result<()> {
+        let Some(gamepad) = self.gamepads[token].as_mut() else {
+            return Ok(());
+        };
+
+        if !gamepad.fetch_available()? {
+            tracing::warn!("Controller disconnected: {}", gamepad.get_info().name);
+            let gamepad = self.gamepads[token].take().unwrap();
+            // The fd is closed on drop, which also removes it from the set;
+            // a half-received frame goes with it
+            let _ = self.epoll.delete(&gamepad);
+        }
+        Ok(())
+    }
+}
+
+impl Gamepad for EpollReader {
+    fn get_info(&self) -> GamepadInfo {
+        self.info.clone()
+    }
+
+    fn read_event(&mut self) -> anyhow::Result<Option<InputEvent>> {
+        let mut ready = [EpollEvent::empty(); MAX_READY];
+
+        loop {
+            if let Some(event) = self.pending.pop_front() {
+                return Ok(Some(event));
+            }
+            if self.take_frame() {
+                continue;
+            }
+            if self.open_count() == 0 {
+                return Ok(None);
+            }
+            let due = self.release_held();
+            if self.take_frame() {
+                continue;
+            }
+
+            let timeout = match due {
+                Some(due) => EpollTimeout::try_from(due.saturating_duration_since(Instant::now()))
+                    .unwrap_or(EpollTimeout::MAX),
+                None => EpollTimeout::NONE,
+            };
+            let count = match self.epoll.wait(&mut ready, timeout) {
+                Ok(count) => count,
+                Err(nix::errno::Errno::EINTR) => continue,
+                Err(e) => return Err(anyhow::anyhow!("epoll_wait failed: {}", e)),
+            };
+
+            for event in &ready[..count] {
+                match event.data() {
+                    SHUTDOWN_TOKEN => return Ok(None),
+                    token => self.service(token as usize)?,
+                }
+            }
+        }
+    }
+
+    fn close(self) -> anyhow::Result<()> {
+        Ok(())
+    }
+}
+
+/// Info reported for the merged stream: the first device, with all names
+fn combined_info(gamepads: &[LinuxGamepad]) -> GamepadInfo {
+    let mut info = gamepads[0].get_info();
+    if gamepads.len() > 1 {
+        info.name = gamepads.iter().map(|g| g.get_info().name).collect::<Vec<_>>().join(" + ");
+    }
+    info
+}
@@ -1,5 +1,6 @@
 // Linux-specific errors
 use crate::input::ErrorType;
+use std::io;
 use thiserror::Error;
 
 #[derive(Debug, Error)]
@@ -23,3 +24,13 @@ pub(super) fn classify_error(err: &anyhow::Error) -> ErrorType {
         None => ErrorType::Unknown,
     }
 }
+
+/// ErrorType of a failure to open a device node
+pub(super) fn classify_io_error(err: &io::Error) -> ErrorType {
+    match err.kind() {
+        io::ErrorKind::PermissionDenied => ErrorType::Permission,
+        io::ErrorKind::NotFound => ErrorType::NotFound,
+        io::ErrorKind::TimedOut => ErrorType::TimedOut,
+        _ => ErrorType::Unknown,
+    }
+}
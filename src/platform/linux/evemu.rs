@@ -0,0 +1,67 @@
+// evemu recordings converted into traces
+//
+// The raw events go through the same frame assembly as a live controller's,
+// so a converted trace holds what `blazeremap record` would have written.
+
+use super::converter::ControllerLayout;
+use super::frame::FrameBuilder;
+use crate::trace::evemu::EvemuRecording;
+use crate::trace::{TRACE_VERSION, Trace, TraceEvent, TraceHeader, TraceInput};
+use std::collections::VecDeque;
+
+/// The trace recording the controller in `recording` would have produced
+pub fn to_trace(recording: &EvemuRecording) -> Trace {
+    let layout = ControllerLayout::from(recording.gamepad_type());
+    let mut frame = FrameBuilder::default();
+    frame.set_ranges(recording.ranges.iter().copied());
+    let mut converted = VecDeque::new();
+    let mut events = Vec::with_capacity(recording.events.len());
+
+    for raw in &recording.events {
+        let event = evdev::InputEvent::new(raw.event_type, raw.code, raw.value);
+        frame.push(event, layout, &mut converted);
+        events.extend(
+            converted
+                .drain(..)
+                .map(|input| TraceEvent { t_us: raw.t_us, input: TraceInput::from(&input) }),
+        );
+    }
+
+    Trace { header: TraceHeader { trace: TRACE_VERSION, device: recording.device() }, events }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{AxisCode, ButtonCode};
+
+    #[test]
+    fn test_to_trace() {
+        let recording = EvemuRecording::parse(
+            "N: Microsoft X-Box One pad
+I: 0003 045e 02ea 0301
+E: 0.001000 0001 0130 0001
+E: 0.001000 0000 0000 0000
+E: 0.040000 0003 0011 -001
+E: 0.040000 0000 0000 0000
+E: 0.090000 0004 0004 589825
+E: 0.090000 0000 0000 0000
+",
+        )
+        .unwrap();
+        let trace = to_trace(&recording);
+        assert_eq!(trace.header.device.vendor_id, 0x045e);
+        let events: Vec<_> = trace.events.iter().map(|event| (event.t_us, event.input)).collect();
+        assert_eq!(
+            events,
+            [
+                // Timed from the first event
+                (0, TraceInput::Button { code: ButtonCode::South, pressed: true }),
+                (0, TraceInput::Sync),
+                (39000, TraceInput::Axis { code: AxisCode::DPadY, value: -1 }),
+                (39000, TraceInput::Sync),
+                // A frame of only MSC_SCAN is dropped whole
+            ]
+        );
+    }
+}
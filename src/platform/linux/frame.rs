@@ -0,0 +1,318 @@
+// Frame assembly keyed on SYN_REPORT
+//
+// The kernel groups the events of one hardware report (e.g. stick X and Y)
+// and terminates them with SYN_REPORT. We keep that grouping: converted
+// events are queued as they arrive and every frame that produced at least
+// one event is closed with `InputEvent::Sync`, so the event loop can map and
+// emit the whole frame at once. Axes are normalized from the ranges the
+// device reports, and its calibration applied, as events are converted.
+// Recenter requests are taken up as the next event arrives, from where each
+// stick was last. Controls renamed for a composite controller are renamed
+// last, so the deadzone is the one of the control they become.
+
+use super::converter::{ControllerLayout, evdev_to_input_with_layout};
+use crate::event::{AxisCode, InputEvent};
+use crate::input::calibration::{Calibration, Recenter, RecenterWatch};
+use crate::input::composite::ControlMap;
+use crate::input::range::{self, AxisRange};
+use evdev::{EventType, SynchronizationCode};
+use std::collections::VecDeque;
+
+#[derive(Debug, Default)]
+pub(super) struct FrameBuilder {
+    // Whether anything was queued since the last SYN_REPORT
+    open: bool,
+    // The device's range of each absolute axis, by evdev code
+    ranges: Vec<(u16, AxisRange)>,
+    calibration: Calibration,
+    // Keep axes inside the built-in deadzone too
+    unfiltered: bool,
+    recenter: Option<RecenterWatch>,
+    // Where each axis was last, normalized but not calibrated
+    last_axes: [Option<i32>; AxisCode::ALL.len()],
+    controls: ControlMap,
+}
+
+impl FrameBuilder {
+    /// Normalize absolute axes from `ranges`, the ones the device reports
+    ///
+    /// Axes without a range are taken to be in the canonical one already.
+    pub(super) fn set_ranges(&mut self, ranges: impl IntoIterator<Item = (u16, AxisRange)>) {
+        self.ranges = ranges.into_iter().filter(|(_, range)| range.is_valid()).collect();
+    }
+
+    /// The range `input_event`, from evdev axis `code`, is normalized from
+    fn range(&self, input_event: &InputEvent, code: u16) -> Option<AxisRange> {
+        // The kernel's may be a calibration written into it
+        if let InputEvent::Axis { code, .. } = input_event
+            && let Some(range) = self.calibration.device_range(*code)
+        {
+            return Some(range);
+        }
+        self.ranges.iter().find(|(axis, _)| *axis == code).map(|(_, range)| *range)
+    }
+
+    /// Pass axes on however close to center, for measuring them
+    pub(super) fn set_unfiltered(&mut self) {
+        self.unfiltered = true;
+    }
+
+    /// Correct axes by `calibration` from now on
+    pub(super) fn set_calibration(&mut self, calibration: Calibration) {
+        self.calibration = calibration;
+    }
+
+    /// Follow requests to recenter made through `recenter` from now on
+    pub(super) fn set_recenter(&mut self, recenter: &Recenter) {
+        self.recenter = Some(recenter.watch());
+    }
+
+    /// Rename controls by `controls` from now on
+    pub(super) fn set_controls(&mut self, controls: ControlMap) {
+        self.controls = controls;
+    }
+
+    /// Center the axes requested since the last event on where they are
+    fn follow_recenter(&mut self, out: &mut VecDeque<InputEvent>) {
+        let Some(watch) = &mut self.recenter else {
+            return;
+        };
+        for code in watch.take() {
+            let Some(value) = self.last_axes[code.index()] else {
+                tracing::info!("Not recentering {}: it hasn't reported yet", code);
+                continue;
+            };
+            self.calibration.recenter(code, value);
+            tracing::info!("Recentered {} at {}", code, value);
+            // Where it rests now is its center
+            out.push_back(InputEvent::axis_move(code, 0));
+            self.open = true;
+        }
+    }
+
+    /// Convert one raw event, appending the result (if any) to `out`
+    pub(super) fn push(
+        &mut self,
+        event: evdev::InputEvent,
+        layout: ControllerLayout,
+        out: &mut VecDeque<InputEvent>,
+    ) {
+        let ev_type = event.event_type();
+        self.follow_recenter(out);
+
+        if ev_type == EventType::SYNCHRONIZATION {
+            // Frames whose events were all filtered out are dropped entirely
+            if event.code() == SynchronizationCode::SYN_REPORT.0 && self.open {
+                if let Some(sync) = evdev_to_input_with_layout(event, layout) {
+                    out.push_back(sync);
+                }
+                self.open = false;
+            }
+            return;
+        }
+
+        // Only care about buttons and axes
+        if ev_type != EventType::KEY && ev_type != EventType::ABSOLUTE {
+            return;
+        }
+
+        let Some(mut input_event) = evdev_to_input_with_layout(event, layout) else {
+            return;
+        };
+        if ev_type == EventType::ABSOLUTE
+            && let Some(range) = self.range(&input_event, event.code())
+        {
+            range::normalize(&mut input_event, range);
+        }
+        if let InputEvent::Axis { code, value, .. } = input_event {
+            self.last_axes[code.index()] = Some(value);
+        }
+        // Calibrated axes bring their own deadzone
+        let calibrated = self.calibration.apply(&mut input_event);
+        if !self.controls.apply(&mut input_event) {
+            return;
+        }
+        if self.unfiltered || calibrated || !input_event.is_in_deadzone() {
+            out.push_back(input_event);
+            self.open = true;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{AxisCode, ButtonCode};
+    use evdev::{AbsoluteAxisCode, KeyCode};
+
+    fn syn() -> evdev::InputEvent {
+        evdev::InputEvent::new(EventType::SYNCHRONIZATION.0, SynchronizationCode::SYN_REPORT.0, 0)
+    }
+
+    fn abs(code: AbsoluteAxisCode, value: i32) -> evdev::InputEvent {
+        evdev::InputEvent::new(EventType::ABSOLUTE.0, code.0, value)
+    }
+
+    fn build(events: Vec<evdev::InputEvent>) -> Vec<InputEvent> {
+        let mut builder = FrameBuilder::default();
+        let mut out = VecDeque::new();
+        for event in events {
+            builder.push(event, ControllerLayout::Standard, &mut out);
+        }
+        out.into_iter().collect()
+    }
+
+    #[test]
+    fn test_stick_update_is_one_frame() {
+        let out = build(vec![
+            abs(AbsoluteAxisCode::ABS_X, 25000),
+            abs(AbsoluteAxisCode::ABS_Y, -30000),
+            syn(),
+        ]);
+
+        assert_eq!(out.len(), 3);
+        assert!(matches!(out[0], InputEvent::Axis { code: AxisCode::LeftX, value: 25000, .. }));
+        assert!(matches!(out[1], InputEvent::Axis { code: AxisCode::LeftY, value: -30000, .. }));
+        assert!(matches!(out[2], InputEvent::Sync { .. }));
+    }
+
+    #[test]
+    fn test_axes_are_normalized() {
+        // hid-sony: sticks and triggers 0-255
+        let mut builder = FrameBuilder::default();
+        builder.set_ranges([
+            (AbsoluteAxisCode::ABS_X.0, AxisRange::new(0, 255)),
+            (AbsoluteAxisCode::ABS_RZ.0, AxisRange::new(0, 255)),
+        ]);
+        let mut out = VecDeque::new();
+        for event in [
+            abs(AbsoluteAxisCode::ABS_X, 250),
+            abs(AbsoluteAxisCode::ABS_X, 130),
+            abs(AbsoluteAxisCode::ABS_RZ, 255),
+            syn(),
+        ] {
+            builder.push(event, ControllerLayout::Standard, &mut out);
+        }
+
+        // 130 is resting wobble, inside the deadzone once normalized
+        assert_eq!(out.len(), 3);
+        assert!(matches!(out[0], InputEvent::Axis { code: AxisCode::LeftX, value: 31477, .. }));
+        assert!(matches!(
+            out[1],
+            InputEvent::Axis { code: AxisCode::RightTrigger, value: 1023, .. }
+        ));
+    }
+
+    #[test]
+    fn test_filtered_frame_emits_nothing() {
+        // Both axes inside the deadzone, then an unrelated MSC_SCAN
+        let out = build(vec![
+            abs(AbsoluteAxisCode::ABS_X, 130),
+            abs(AbsoluteAxisCode::ABS_Y, 125),
+            evdev::InputEvent::new(EventType::MISC.0, 4, 0x90001),
+            syn(),
+        ]);
+
+        assert!(out.is_empty());
+    }
+
+    #[test]
+    fn test_kernel_ranges_written_by_calibration_are_ignored() {
+        use crate::input::calibration::{AxisCalibration, DeviceRange};
+
+        let mut builder = FrameBuilder::default();
+        // Moved by a calibration written into the kernel
+        builder.set_ranges([(AbsoluteAxisCode::ABS_X.0, AxisRange::new(3, 258))]);
+        let mut calibration = Calibration::default();
+        calibration.set(AxisCalibration { axis: AxisCode::LeftX, center: 774, deadzone: 0 });
+        calibration.set_device_range(DeviceRange { axis: AxisCode::LeftX, min: 0, max: 255 });
+        builder.set_calibration(calibration);
+        let mut out = VecDeque::new();
+        for event in [abs(AbsoluteAxisCode::ABS_X, 131), syn()] {
+            builder.push(event, ControllerLayout::Standard, &mut out);
+        }
+
+        // Corrected once, not twice
+        assert!(matches!(out[0], InputEvent::Axis { code: AxisCode::LeftX, value: 0, .. }));
+    }
+
+    #[test]
+    fn test_unfiltered_keeps_resting_axes() {
+        let mut builder = FrameBuilder::default();
+        builder.set_unfiltered();
+        let mut out = VecDeque::new();
+        for event in [abs(AbsoluteAxisCode::ABS_X, 130), syn()] {
+            builder.push(event, ControllerLayout::Standard, &mut out);
+        }
+
+        assert_eq!(out.len(), 2);
+        assert!(matches!(out[0], InputEvent::Axis { value: 130, .. }));
+    }
+
+    #[test]
+    fn test_recenter_on_where_sticks_rest() {
+        let recenter = Recenter::default();
+        let mut builder = FrameBuilder::default();
+        builder.set_recenter(&recenter);
+        let mut out = VecDeque::new();
+        // Drifted out of the deadzone
+        for event in [abs(AbsoluteAxisCode::ABS_X, 4000), abs(AbsoluteAxisCode::ABS_Y, 3000), syn()]
+        {
+            builder.push(event, ControllerLayout::Standard, &mut out);
+        }
+        assert_eq!(out.len(), 3);
+
+        out.clear();
+        recenter.request(&[AxisCode::LeftX]);
+        for event in [abs(AbsoluteAxisCode::ABS_X, 4100), syn(), abs(AbsoluteAxisCode::ABS_X, 9000)]
+        {
+            builder.push(event, ControllerLayout::Standard, &mut out);
+        }
+
+        // Back at center at once; wobble is inside the deadzone around 4000
+        assert_eq!(out.len(), 4);
+        assert!(matches!(out[0], InputEvent::Axis { code: AxisCode::LeftX, value: 0, .. }));
+        assert!(matches!(out[1], InputEvent::Axis { code: AxisCode::LeftX, value: 0, .. }));
+        assert!(matches!(out[2], InputEvent::Sync { .. }));
+        assert!(matches!(out[3], InputEvent::Axis { code: AxisCode::LeftX, value: 5000, .. }));
+        // LeftY wasn't asked for
+        out.clear();
+        builder.push(abs(AbsoluteAxisCode::ABS_Y, 3000), ControllerLayout::Standard, &mut out);
+        assert!(matches!(out[0], InputEvent::Axis { code: AxisCode::LeftY, value: 3000, .. }));
+    }
+
+    #[test]
+    fn test_incomplete_frame_has_no_sync() {
+        let out = build(vec![
+            evdev::InputEvent::new(EventType::KEY.0, KeyCode::BTN_SOUTH.code(), 1),
+            syn(),
+            evdev::InputEvent::new(EventType::KEY.0, KeyCode::BTN_SOUTH.code(), 0),
+        ]);
+
+        assert_eq!(out.len(), 3);
+        assert!(matches!(
+            out[0],
+            InputEvent::Button { code: ButtonCode::South, pressed: true, .. }
+        ));
+        assert!(matches!(out[1], InputEvent::Sync { .. }));
+        assert!(matches!(out[2], InputEvent::Button { pressed: false, .. }));
+    }
+
+    #[test]
+    fn test_calibration_replaces_the_deadzone() {
+        use crate::input::calibration::AxisCalibration;
+
+        let mut builder = FrameBuilder::default();
+        let mut calibration = Calibration::default();
+        calibration.set(AxisCalibration { axis: AxisCode::LeftX, center: 128, deadzone: 4 });
+        builder.set_calibration(calibration);
+        let mut out = VecDeque::new();
+        for event in [abs(AbsoluteAxisCode::ABS_X, 130), abs(AbsoluteAxisCode::ABS_Y, 130), syn()] {
+            builder.push(event, ControllerLayout::Standard, &mut out);
+        }
+
+        // LeftX comes back to center; LeftY still goes through the old deadzone
+        assert_eq!(out.len(), 2);
+        assert!(matches!(out[0], InputEvent::Axis { code: AxisCode::LeftX, value: 0, .. }));
+    }
+}
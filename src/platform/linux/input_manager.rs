@@ -1,15 +1,126 @@
 // Linux device manager implementation
-use super::errors::classify_error;
-use super::gamepad::{LinuxGamepad, extract_gamepad_info, is_gamepad};
-use crate::input::{InputDetectionResult, InputDeviceError, InputManager, gamepad::Gamepad};
+use super::backend::{EvdevBackend, InputBackend};
+use super::epoll_reader::EpollReader;
+use super::errors::{classify_error, classify_io_error};
+use super::gamepad::{LinuxGamepad, extract_gamepad_info, is_gamepad, is_motion_sensor_for};
+use super::keymouse::{KeyMouseReader, key_mouse_kind};
+use crate::input::alias::DeviceIdentity;
+use crate::input::calibration::{Calibration, CalibrationStore, Recenter};
+use crate::input::composite::{self, Source};
+use crate::input::keymouse::KeyMouseLayout;
+use crate::input::manager::ProbeOptions;
+use crate::input::policy::DevicePolicy;
+use crate::input::{
+    DeviceKind, ErrorType, InputDetectionResult, InputDeviceError, InputDeviceInfo, InputManager,
+    gamepad::{Gamepad, GamepadCapability, GamepadType},
+};
+use anyhow::Context;
 
 pub struct LinuxInputManager {
-    // Fields can be added later if needed
+    backend: Box<dyn InputBackend>,
+    // Where opened controllers find their calibration
+    calibrations: Option<CalibrationStore>,
+    // Followed by opened controllers, except raw ones
+    recenter: Recenter,
+    // Which devices may be opened at all
+    policy: DevicePolicy,
 }
 
 impl LinuxInputManager {
+    /// Reads evdev, calibrating controllers from the user's config directory
     pub fn new() -> Self {
-        Self {}
+        Self::probing(ProbeOptions::default())
+    }
+
+    /// Like `new`, trying each device node while detecting as `probe` says
+    pub fn probing(probe: ProbeOptions) -> Self {
+        let calibrations = CalibrationStore::user()
+            .map_err(|e| tracing::warn!("Controllers won't be calibrated: {:#}", e))
+            .ok();
+        Self {
+            calibrations,
+            recenter: Recenter::session(),
+            ..Self::with_backend(Box::new(EvdevBackend::with_probe(probe)))
+        }
+    }
+
+    /// A manager finding devices through `backend` instead of evdev
+    ///
+    /// Controllers aren't calibrated unless `with_calibrations` is used too,
+    /// and only recenter through `recenter`.
+    pub fn with_backend(backend: Box<dyn InputBackend>) -> Self {
+        Self {
+            backend,
+            calibrations: None,
+            recenter: Recenter::default(),
+            policy: DevicePolicy::default(),
+        }
+    }
+
+    /// What opened controllers follow to recenter their sticks
+    pub fn recenter(&self) -> &Recenter {
+        &self.recenter
+    }
+
+    /// Calibrate opened controllers from `store`
+    pub fn with_calibrations(mut self, store: CalibrationStore) -> Self {
+        self.calibrations = Some(store);
+        self
+    }
+
+    /// Only detect and open the devices `policy` allows
+    pub fn with_policy(mut self, policy: DevicePolicy) -> Self {
+        self.policy = policy;
+        self
+    }
+
+    /// Fail unless the policy allows every device at `paths`
+    fn check_policy(&self, paths: &[String]) -> anyhow::Result<()> {
+        if self.policy.is_empty() {
+            return Ok(());
+        }
+        for path in paths {
+            let identity = self.backend.describe(path).map(|capabilities| DeviceIdentity {
+                vendor_id: capabilities.vendor_id,
+                product_id: capabilities.product_id,
+                uniq: capabilities.uniq,
+                phys: capabilities.phys,
+            });
+            self.policy.check(path, identity.as_ref())?;
+        }
+        Ok(())
+    }
+
+    /// Open the gamepad at `path` with its calibration, if it has one
+    fn open_calibrated(&self, path: &str) -> anyhow::Result<LinuxGamepad> {
+        Ok(self.calibrate(LinuxGamepad::open(self.backend.as_ref(), path)?, false))
+    }
+
+    /// `gamepad` with its calibration, if it has one
+    ///
+    /// `raw` keeps only the driver's own ranges, for measuring the axes as
+    /// they are, and ignores recenter requests.
+    fn calibrate(&self, mut gamepad: LinuxGamepad, raw: bool) -> LinuxGamepad {
+        if let Some(store) = &self.calibrations {
+            let key = gamepad.device_key();
+            match store.load(&key) {
+                Ok(Some(calibration)) if raw => gamepad.set_calibration(Calibration {
+                    device_ranges: calibration.device_ranges,
+                    ..Calibration::default()
+                }),
+                Ok(Some(calibration)) => {
+                    tracing::info!("Calibrating {} from {}", key, store.path(&key).display());
+                    gamepad.set_calibration(calibration);
+                }
+                Ok(None) => {}
+                // A broken file shouldn't keep the controller from working
+                Err(e) => tracing::warn!("Ignoring calibration of {}: {:#}", key, e),
+            }
+        }
+        if !raw {
+            gamepad.set_recenter(&self.recenter);
+        }
+        gamepad
     }
 }
 
@@ -21,34 +132,67 @@ impl Default for LinuxInputManager {
 
 impl InputManager for LinuxInputManager {
     fn list_gamepads(&self) -> anyhow::Result<InputDetectionResult> {
-        use evdev::enumerate;
-
-        let devices: Vec<_> = enumerate().collect();
+        let devices: Vec<_> = self
+            .backend
+            .enumerate()
+            .into_iter()
+            .map(|(path, device)| (path, device.capabilities()))
+            .collect();
 
-        println!("Found {} input devices total", devices.len());
+        tracing::debug!("Found {} input devices total", devices.len());
 
         let mut result = InputDetectionResult { gamepad_info: Vec::new(), errors: Vec::new() };
 
-        for (path, device) in devices {
-            if is_gamepad(&device) {
+        for (path, device) in &devices {
+            if is_gamepad(device) {
                 let path_str = path.to_string_lossy().to_string();
-                match extract_gamepad_info(&device, &path_str) {
-                    Ok(info) => {
-                        println!(
-                            "✓ Detected: {} ({}) - {:?}",
-                            info.name, info.gamepad_type, info.capabilities
+                match extract_gamepad_info(device, &path_str) {
+                    Ok(mut info) => {
+                        // The Deck's IMU lives on its own "Motion Sensors" node
+                        if info.gamepad_type == GamepadType::SteamDeck
+                            && devices.iter().any(|(_, other)| {
+                                is_motion_sensor_for(other, info.vendor_id, info.product_id)
+                            })
+                        {
+                            info.capabilities.push(GamepadCapability::Gyro);
+                        }
+                        if let Err(err) = self.check_policy(std::slice::from_ref(&path_str)) {
+                            let device_err =
+                                InputDeviceError::new(path_str, ErrorType::NotAllowed, err);
+                            tracing::info!("{}", device_err);
+                            result.errors.push(device_err);
+                            continue;
+                        }
+                        tracing::info!(
+                            "Detected: {} ({}) - {:?}",
+                            info.name,
+                            info.gamepad_type,
+                            info.capabilities
                         );
                         result.gamepad_info.push(info);
                     }
                     Err(err) => {
                         let error_type = classify_error(&err);
                         let device_err = InputDeviceError::new(path_str, error_type, err);
-                        println!("✗ Error: {}", device_err);
+                        tracing::warn!("{}", device_err);
                         result.errors.push(device_err);
                     }
                 }
             }
         }
+        // Controllers by what sysfs says, since they couldn't be asked
+        for unopened in self.backend.unopened() {
+            if !is_gamepad(&unopened.capabilities) {
+                continue;
+            }
+            let name = unopened.capabilities.name.as_deref().unwrap_or("Unknown");
+            let error_type = classify_io_error(&unopened.error);
+            let err = anyhow::anyhow!("{}: {}", name, unopened.error);
+            let device_err =
+                InputDeviceError::new(unopened.path.to_string_lossy().to_string(), error_type, err);
+            tracing::warn!("{}", device_err);
+            result.errors.push(device_err);
+        }
 
         tracing::info!(
             "Found {} gamepads ({} errors)",
@@ -59,15 +203,305 @@ impl InputManager for LinuxInputManager {
         Ok(result)
     }
 
+    fn list_devices(&self) -> anyhow::Result<Vec<InputDeviceInfo>> {
+        let mut devices = Vec::new();
+        for (path, device) in self.backend.enumerate() {
+            let capabilities = device.capabilities();
+            let kind = match is_gamepad(&capabilities) {
+                true => DeviceKind::Gamepad,
+                false => match key_mouse_kind(&capabilities) {
+                    Some(kind) => kind,
+                    None => continue,
+                },
+            };
+            devices.push(InputDeviceInfo {
+                path: path.to_string_lossy().to_string(),
+                name: capabilities.name.unwrap_or_else(|| "Unknown".to_string()),
+                kind,
+            });
+        }
+        Ok(devices)
+    }
+
     fn open_gamepad(&self, path: &str) -> anyhow::Result<Box<dyn Gamepad>> {
-        let gamepad = LinuxGamepad::open(path)?;
+        self.check_policy(&[path.to_string()])?;
+        self.backend.check_access(&[path.to_string()])?;
+        let gamepad = self.open_calibrated(path)?;
+        Ok(Box::new(gamepad))
+    }
+
+    fn open_gamepad_observed(&self, path: &str) -> anyhow::Result<Box<dyn Gamepad>> {
+        self.check_policy(&[path.to_string()])?;
+        self.backend.check_access(&[path.to_string()])?;
+        let gamepad = LinuxGamepad::observe(self.backend.as_ref(), path)?;
+        Ok(Box::new(self.calibrate(gamepad, false)))
+    }
+
+    fn open_gamepad_raw(&self, path: &str) -> anyhow::Result<Box<dyn Gamepad>> {
+        self.check_policy(&[path.to_string()])?;
+        self.backend.check_access(&[path.to_string()])?;
+        let mut gamepad = self.calibrate(LinuxGamepad::observe(self.backend.as_ref(), path)?, true);
+        gamepad.set_unfiltered();
         Ok(Box::new(gamepad))
     }
+
+    fn open_gamepads(&self, paths: &[String]) -> anyhow::Result<Box<dyn Gamepad>> {
+        self.check_policy(paths)?;
+        self.backend.check_access(paths)?;
+        let gamepads = paths
+            .iter()
+            .map(|path| self.open_calibrated(path))
+            .collect::<anyhow::Result<Vec<_>>>()?;
+        Ok(Box::new(EpollReader::new(gamepads)?))
+    }
+
+    fn open_composite(&self, sources: &[Source], grab: bool) -> anyhow::Result<Box<dyn Gamepad>> {
+        let paths = composite::paths(sources);
+        self.check_policy(&paths)?;
+        self.backend.check_access(&paths)?;
+        let mut gamepads = Vec::new();
+        for source in sources {
+            let mut gamepad = self.open_calibrated(&source.path)?;
+            gamepad.set_controls(source.controls.clone());
+            if grab {
+                gamepad.grab()?;
+            }
+            gamepads.push(gamepad);
+        }
+        Ok(Box::new(EpollReader::new(gamepads)?))
+    }
+
+    fn open_key_mouse(
+        &self,
+        paths: &[String],
+        layout: KeyMouseLayout,
+        grab: bool,
+    ) -> anyhow::Result<Box<dyn Gamepad>> {
+        self.check_policy(paths)?;
+        let mut devices = Vec::new();
+        for path in paths {
+            let device = self
+                .backend
+                .open(path)
+                .with_context(|| format!("Failed to open device at {}", path))?;
+            if key_mouse_kind(&device.capabilities()).is_none() {
+                anyhow::bail!("{} is not a keyboard or mouse", path);
+            }
+            devices.push((path.clone(), device));
+        }
+        Ok(Box::new(KeyMouseReader::new(devices, layout, grab)?))
+    }
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::event::{ButtonCode, InputEvent, KeyboardCode, KeyboardEventType, OutputEvent};
+    use crate::output::keyboard::MockVirtualKeyboard;
+    use crate::platform::linux::backend::DeviceCapabilities;
+    use crate::platform::linux::backend::fake::{FakeBackend, FakeDeviceSpec};
+    use crate::session::{Session, SessionConfig};
+    use evdev::{EventType, KeyCode};
+    use std::sync::{Arc, Mutex};
+
+    fn press(key: KeyCode, value: i32) -> (EventType, u16, i32) {
+        (EventType::KEY, key.code(), value)
+    }
+
+    fn fake_manager(devices: Vec<FakeDeviceSpec>) -> LinuxInputManager {
+        LinuxInputManager::with_backend(Box::new(FakeBackend::new(devices)))
+    }
+
+    #[test]
+    fn test_list_gamepads_skips_other_devices() {
+        let mut deck = FakeDeviceSpec::gamepad("/dev/input/event5");
+        deck.capabilities.name = Some("Steam Deck".to_string());
+        (deck.capabilities.vendor_id, deck.capabilities.product_id) = (0x28de, 0x1205);
+        // Its IMU: accelerometer and gyro axes, no buttons
+        let mut imu = FakeDeviceSpec::keyboard("/dev/input/event6");
+        imu.capabilities = DeviceCapabilities {
+            name: Some("Steam Deck Motion Sensors".to_string()),
+            vendor_id: 0x28de,
+            product_id: 0x1205,
+            absolute_axes: deck.capabilities.absolute_axes[..6].to_vec(),
+            accelerometer: true,
+            ..Default::default()
+        };
+        let manager = fake_manager(vec![
+            FakeDeviceSpec::keyboard("/dev/input/event0"),
+            FakeDeviceSpec::gamepad("/dev/input/event3"),
+            deck,
+            imu,
+        ]);
+
+        let result = manager.list_gamepads().unwrap();
+        let found: Vec<_> = result.gamepad_info.iter().map(|info| info.path.as_str()).collect();
+        assert_eq!(found, ["/dev/input/event3", "/dev/input/event5"]);
+        assert!(result.gamepad_info[1].capabilities.contains(&GamepadCapability::Gyro));
+        assert!(!result.gamepad_info[0].capabilities.contains(&GamepadCapability::Gyro));
+    }
+
+    #[test]
+    fn test_list_gamepads_reports_controllers_it_cant_open() {
+        let backend = FakeBackend::new(vec![FakeDeviceSpec::gamepad("/dev/input/event3")])
+            .with_denied(FakeDeviceSpec::gamepad("/dev/input/event7"))
+            .with_denied(FakeDeviceSpec::keyboard("/dev/input/event0"));
+        let manager = LinuxInputManager::with_backend(Box::new(backend));
+
+        let result = manager.list_gamepads().unwrap();
+        assert_eq!(result.gamepad_info.len(), 1);
+        let [error] = result.errors.as_slice() else {
+            panic!("expected only the controller: {:?}", result.errors);
+        };
+        assert_eq!(error.path, "/dev/input/event7");
+        assert_eq!(error.error_type, crate::input::ErrorType::Permission);
+        assert!(error.source.to_string().starts_with("Microsoft X-Box One pad: "));
+    }
+
+    #[test]
+    fn test_policy_keeps_devices_out() {
+        let file =
+            std::env::temp_dir().join(format!("blazeremap-daemon-{}.toml", std::process::id()));
+        std::fs::write(&file, "[devices]\ndeny = [\"045e:02ea\"]\n").unwrap();
+        let policy = DevicePolicy::load_from(std::slice::from_ref(&file), || unreachable!());
+        std::fs::remove_file(&file).unwrap();
+        let manager = fake_manager(vec![FakeDeviceSpec::gamepad("/dev/input/event3")])
+            .with_policy(policy.unwrap());
+
+        let result = manager.list_gamepads().unwrap();
+        assert!(result.gamepad_info.is_empty());
+        assert_eq!(result.errors[0].error_type, ErrorType::NotAllowed);
+        let err = manager.open_gamepad("/dev/input/event3").err().unwrap();
+        assert!(
+            err.to_string().starts_with("/dev/input/event3 (045e:02ea) is denied by"),
+            "{}",
+            err
+        );
+        assert!(manager.open_gamepad_observed("/dev/input/event3").is_err());
+    }
+
+    #[test]
+    fn test_open_gamepads_merges_devices() {
+        let manager = fake_manager(vec![
+            FakeDeviceSpec::gamepad("/dev/input/event3").frame(&[press(KeyCode::BTN_SOUTH, 1)]),
+            FakeDeviceSpec::gamepad("/dev/input/event4").frame(&[press(KeyCode::BTN_EAST, 1)]),
+        ]);
+        let paths = ["/dev/input/event3".to_string(), "/dev/input/event4".to_string()];
+        let mut gamepad = manager.open_gamepads(&paths).unwrap();
+        assert_eq!(gamepad.get_info().name, "Microsoft X-Box One pad + Microsoft X-Box One pad");
+
+        let mut pressed = Vec::new();
+        while let Some(event) = gamepad.read_event().unwrap() {
+            if let InputEvent::Button { code, .. } = event {
+                pressed.push(code);
+            }
+        }
+        pressed.sort_by_key(|code| code.to_string());
+        assert_eq!(pressed, [ButtonCode::East, ButtonCode::South]);
+    }
+
+    #[test]
+    fn test_open_composite_renames_controls() {
+        let manager = fake_manager(vec![
+            FakeDeviceSpec::gamepad("/dev/input/event3").frame(&[press(KeyCode::BTN_SOUTH, 1)]),
+            FakeDeviceSpec::gamepad("/dev/input/event4")
+                .frame(&[press(KeyCode::BTN_SOUTH, 1), press(KeyCode::BTN_START, 1)]),
+        ]);
+        let sources = [
+            "/dev/input/event3".parse().unwrap(),
+            "/dev/input/event4:South=Paddle1,Start=none".parse().unwrap(),
+        ];
+        let mut gamepad = manager.open_composite(&sources, true).unwrap();
+
+        let mut pressed = Vec::new();
+        while let Some(event) = gamepad.read_event().unwrap() {
+            if let InputEvent::Button { code, .. } = event {
+                pressed.push(code);
+            }
+        }
+        pressed.sort_by_key(|code| code.to_string());
+        assert_eq!(pressed, [ButtonCode::Paddle1, ButtonCode::South]);
+    }
+
+    #[test]
+    fn test_list_devices_tells_kinds_apart() {
+        let manager = fake_manager(vec![
+            FakeDeviceSpec::keyboard("/dev/input/event0"),
+            FakeDeviceSpec::mouse("/dev/input/event1"),
+            FakeDeviceSpec::gamepad("/dev/input/event3"),
+        ]);
+        let kinds: Vec<_> =
+            manager.list_devices().unwrap().into_iter().map(|device| device.kind).collect();
+        assert_eq!(kinds, [DeviceKind::Keyboard, DeviceKind::Mouse, DeviceKind::Gamepad]);
+
+        let paths = ["/dev/input/event3".to_string()];
+        let error = manager.open_key_mouse(&paths, KeyMouseLayout::default(), false).err();
+        assert!(error.unwrap().to_string().contains("is not a keyboard or mouse"));
+    }
+
+    #[test]
+    fn test_open_gamepad_applies_its_calibration() {
+        use crate::event::AxisCode;
+        use crate::input::calibration::{AxisCalibration, Calibration, DeviceKey};
+
+        let mut spec = FakeDeviceSpec::gamepad("/dev/input/event3").frame(&[(
+            EventType::ABSOLUTE,
+            evdev::AbsoluteAxisCode::ABS_X.0,
+            900,
+        )]);
+        spec.capabilities.uniq = Some("7c:66:ef:00:00:01".to_string());
+        let dir = std::env::temp_dir()
+            .join(format!("blazeremap-manager-calibration-{}", std::process::id()));
+        let store = CalibrationStore::new(&dir);
+        let key = DeviceKey {
+            vendor_id: 0x045e,
+            product_id: 0x02ea,
+            uniq: Some("7c:66:ef:00:00:01".to_string()),
+        };
+        let mut calibration = Calibration::default();
+        calibration.set(AxisCalibration { axis: AxisCode::LeftX, center: 1000, deadzone: 0 });
+        store.save(&key, &calibration).unwrap();
+
+        let manager = fake_manager(vec![spec]).with_calibrations(store);
+        let mut gamepad = manager.open_gamepad("/dev/input/event3").unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert!(matches!(
+            gamepad.read_event().unwrap(),
+            Some(InputEvent::Axis { code: AxisCode::LeftX, value: -100, .. })
+        ));
+    }
+
+    #[test]
+    fn test_session_maps_raw_events_to_keys() {
+        let manager = fake_manager(vec![
+            FakeDeviceSpec::keyboard("/dev/input/event0"),
+            FakeDeviceSpec::gamepad("/dev/input/event3")
+                .frame(&[press(KeyCode::BTN_SOUTH, 1)])
+                .frame(&[press(KeyCode::BTN_SOUTH, 0)]),
+        ]);
+        let typed = Arc::new(Mutex::new(Vec::new()));
+        let mut keyboard = MockVirtualKeyboard::new();
+        let log = Arc::clone(&typed);
+        keyboard.expect_emit_frame().returning(move |events| {
+            log.lock().unwrap().extend_from_slice(events);
+            Ok(())
+        });
+
+        let session = Session::start_with(
+            SessionConfig::default(),
+            move || Ok(Box::new(manager) as Box<dyn InputManager>),
+            move |_| Ok(Box::new(keyboard)),
+        )
+        .unwrap();
+        assert_eq!(session.devices(), ["/dev/input/event3"]);
+        session.wait().unwrap();
+
+        let key = |event_type| OutputEvent::Keyboard { code: KeyboardCode::S, event_type };
+        assert_eq!(
+            *typed.lock().unwrap(),
+            [key(KeyboardEventType::Press), key(KeyboardEventType::Release)]
+        );
+    }
 
     #[test]
     fn test_list_devices() {
@@ -0,0 +1,112 @@
+// systemd journal, through its native protocol
+//
+// Each entry is one datagram to journald's socket: FIELD=value lines, or for
+// values with a newline the field name, a newline, the value's length as a
+// little-endian u64, the value and a newline. Field names are uppercase
+// letters, digits and underscores; a leading underscore is journald's own.
+
+use std::io;
+use std::os::unix::net::UnixDatagram;
+
+const SOCKET: &str = "/run/systemd/journal/socket";
+
+/// A connection to journald
+pub struct Journal {
+    socket: UnixDatagram,
+}
+
+impl Journal {
+    pub fn connect() -> io::Result<Self> {
+        let socket = UnixDatagram::unbound()?;
+        socket.connect(SOCKET)?;
+        Ok(Self { socket })
+    }
+
+    /// Send one entry of `(name, value)` fields; names are made valid
+    pub fn send<'a>(&self, fields: impl IntoIterator<Item = (&'a str, &'a str)>) -> io::Result<()> {
+        self.socket.send(&encode(fields)).map(drop)
+    }
+}
+
+/// Whether our output goes to the journal stream systemd handed us
+///
+/// systemd sets JOURNAL_STREAM to the device and inode of the stream it
+/// connects a service's output to; a program run from there by hand
+/// inherits the variable but not the stream.
+pub fn is_journal_stream() -> bool {
+    let Some(stream) = std::env::var_os("JOURNAL_STREAM") else {
+        return false;
+    };
+    let Some((dev, ino)) = stream.to_str().and_then(|stream| stream.split_once(':')) else {
+        return false;
+    };
+    let (Ok(dev), Ok(ino)) = (dev.parse::<libc::dev_t>(), ino.parse::<libc::ino_t>()) else {
+        return false;
+    };
+    [libc::STDOUT_FILENO, libc::STDERR_FILENO].into_iter().any(|fd| {
+        let mut stat = std::mem::MaybeUninit::<libc::stat>::uninit();
+        // SAFETY: fstat fills the buffer on success, which is all we read
+        if unsafe { libc::fstat(fd, stat.as_mut_ptr()) } != 0 {
+            return false;
+        }
+        // SAFETY: fstat succeeded
+        let stat = unsafe { stat.assume_init() };
+        stat.st_dev == dev && stat.st_ino == ino
+    })
+}
+
+/// `name` as a journal field name: uppercase, other characters as `_`, no
+/// leading underscores or digits
+pub fn field_name(name: &str) -> String {
+    let name: String = name
+        .chars()
+        .map(|c| match c.is_ascii_alphanumeric() {
+            true => c.to_ascii_uppercase(),
+            false => '_',
+        })
+        .collect();
+    let name = name.trim_start_matches(|c: char| c == '_' || c.is_ascii_digit());
+    match name.is_empty() {
+        true => "FIELD".to_string(),
+        false => name.to_string(),
+    }
+}
+
+fn encode<'a>(fields: impl IntoIterator<Item = (&'a str, &'a str)>) -> Vec<u8> {
+    let mut entry = Vec::new();
+    for (name, value) in fields {
+        entry.extend_from_slice(field_name(name).as_bytes());
+        if value.contains('\n') {
+            entry.push(b'\n');
+            entry.extend_from_slice(&(value.len() as u64).to_le_bytes());
+        } else {
+            entry.push(b'=');
+        }
+        entry.extend_from_slice(value.as_bytes());
+        entry.push(b'\n');
+    }
+    entry
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_field_names() {
+        assert_eq!(field_name("device"), "DEVICE");
+        assert_eq!(field_name("session.id"), "SESSION_ID");
+        assert_eq!(field_name("_hidden"), "HIDDEN");
+        assert_eq!(field_name("2nd"), "ND");
+        assert_eq!(field_name("_"), "FIELD");
+    }
+
+    #[test]
+    fn test_encode_entry() {
+        let entry = encode([("MESSAGE", "hi"), ("detail", "a\nb")]);
+        let mut expected = b"MESSAGE=hi\nDETAIL\n".to_vec();
+        expected.extend_from_slice(&3u64.to_le_bytes());
+        expected.extend_from_slice(b"a\nb\n");
+        assert_eq!(entry, expected);
+    }
+}
@@ -0,0 +1,143 @@
+// Physical keyboard listener
+//
+// Reads key presses from every keyboard without grabbing them, so typing
+// keeps working elsewhere. While listening, the terminal stops echoing and
+// whatever was typed into it is thrown away afterwards, so the keys pressed
+// don't turn up at the shell prompt.
+
+use crate::{
+    event::KeyboardCode,
+    input::keyboard::KeyListener,
+    platform::linux::{converter::evdev_key_to_keyboard_code, terminal::Terminal},
+};
+use anyhow::{Result, bail};
+use evdev::{AttributeSetRef, Device, EventSummary, KeyCode};
+use nix::poll::{PollFd, PollFlags, PollTimeout, poll};
+use std::collections::VecDeque;
+use std::os::fd::AsFd;
+use std::time::{Duration, Instant};
+
+// ENODEV: the device was unplugged
+const ENODEV: i32 = 19;
+
+/// Whether a device with this name and these keys is a keyboard to listen to
+///
+/// Our own virtual keyboards are left out; they only type what a controller
+/// pressed.
+fn is_keyboard(name: &str, keys: Option<&AttributeSetRef<KeyCode>>) -> bool {
+    !name.starts_with("BlazeRemap")
+        && keys.is_some_and(|keys| {
+            [KeyCode::KEY_A, KeyCode::KEY_Z, KeyCode::KEY_SPACE].iter().all(|&k| keys.contains(k))
+        })
+}
+
+/// Concrete key listener reading every keyboard through evdev
+pub struct LinuxKeyListener {
+    devices: Vec<Device>,
+    pending: VecDeque<KeyboardCode>,
+    _terminal: Option<Terminal>,
+}
+
+impl LinuxKeyListener {
+    /// Open every keyboard; fails if there are none we may read
+    pub fn new() -> Result<Self> {
+        let devices: Vec<Device> = evdev::enumerate()
+            .filter(|(_, device)| is_keyboard(device.name().unwrap_or(""), device.supported_keys()))
+            .map(|(path, device)| {
+                tracing::debug!("Listening to keyboard {}", path.display());
+                device
+            })
+            .collect();
+        if devices.is_empty() {
+            bail!("No keyboard found; reading keyboards needs access to /dev/input");
+        }
+        Ok(Self { devices, pending: VecDeque::new(), _terminal: Terminal::unbuffered() })
+    }
+
+    /// Queue the presses waiting on the device at `index`; drops it if it's gone
+    fn fetch(&mut self, index: usize) -> Result<()> {
+        match self.devices[index].fetch_events() {
+            Ok(events) => {
+                for event in events {
+                    // 1 is a press; 0 a release and 2 auto-repeat
+                    if let EventSummary::Key(_, key, 1) = event.destructure()
+                        && let Some(code) = evdev_key_to_keyboard_code(key)
+                    {
+                        self.pending.push_back(code);
+                    }
+                }
+            }
+            Err(e) if e.raw_os_error() == Some(ENODEV) => {
+                tracing::warn!("Keyboard disconnected");
+                self.devices.remove(index);
+            }
+            Err(e) => bail!("Failed to read keyboard: {}", e),
+        }
+        Ok(())
+    }
+}
+
+impl KeyListener for LinuxKeyListener {
+    fn next_key(&mut self, timeout: Duration) -> Result<Option<KeyboardCode>> {
+        let deadline = Instant::now() + timeout;
+        loop {
+            if let Some(code) = self.pending.pop_front() {
+                return Ok(Some(code));
+            }
+            if self.devices.is_empty() {
+                bail!("Every keyboard was disconnected");
+            }
+            let remaining = deadline.saturating_duration_since(Instant::now());
+            if remaining.is_zero() {
+                return Ok(None);
+            }
+
+            let mut fds: Vec<PollFd> = self
+                .devices
+                .iter()
+                .map(|device| PollFd::new(device.as_fd(), PollFlags::POLLIN))
+                .collect();
+            let poll_timeout = PollTimeout::try_from(remaining).unwrap_or(PollTimeout::MAX);
+            if poll(&mut fds, poll_timeout)? == 0 {
+                return Ok(None);
+            }
+            let ready: Vec<usize> = fds
+                .iter()
+                .enumerate()
+                .filter(|(_, fd)| fd.revents().is_some_and(|revents| !revents.is_empty()))
+                .map(|(index, _)| index)
+                .collect();
+            drop(fds);
+
+            // Backwards, so dropping a device doesn't shift the ones left
+            for index in ready.into_iter().rev() {
+                self.fetch(index)?;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use evdev::AttributeSet;
+
+    fn keys(codes: &[KeyCode]) -> AttributeSet<KeyCode> {
+        let mut keys = AttributeSet::new();
+        for &code in codes {
+            keys.insert(code);
+        }
+        keys
+    }
+
+    #[test]
+    fn test_is_keyboard() {
+        let full = keys(&[KeyCode::KEY_A, KeyCode::KEY_Z, KeyCode::KEY_SPACE, KeyCode::KEY_ESC]);
+        assert!(is_keyboard("AT Translated Set 2 keyboard", Some(&full)));
+        assert!(!is_keyboard("BlazeRemap Virtual Keyboard", Some(&full)));
+        // Media remotes and power buttons have keys, but no letters
+        let media = keys(&[KeyCode::KEY_VOLUMEUP, KeyCode::KEY_SPACE]);
+        assert!(!is_keyboard("Consumer Control", Some(&media)));
+        assert!(!is_keyboard("Power Button", None));
+    }
+}
@@ -1,11 +1,15 @@
 // Virtual Keyboard Module
 
 use crate::{
-    event::KeyboardCode, output::keyboard::VirtualKeyboard,
+    event::{KeyboardCode, KeyboardEventType, OutputEvent},
+    output::{identity::VirtualDeviceIdentity, keyboard::VirtualKeyboard},
     platform::linux::converter::keyboard_code_to_evdev_key,
 };
 use anyhow::{Context, Result};
-use evdev::{AttributeSet, EventType, InputEvent as EvdevEvent, KeyCode, uinput::VirtualDevice};
+use evdev::{
+    AttributeSet, BusType, EventType, InputEvent as EvdevEvent, InputId, KeyCode,
+    uinput::VirtualDevice,
+};
 use std::path::PathBuf;
 
 /// Concrete virtual keyboard backed by /dev/uinput
@@ -15,7 +19,7 @@ pub struct LinuxVirtualKeyboard {
 
 impl LinuxVirtualKeyboard {
     /// Create a new virtual keyboard device
-    pub fn new(name: &str) -> Result<Self> {
+    pub fn new(identity: &VirtualDeviceIdentity) -> Result<Self> {
         // Build a key set including all common keyboard keys
         let mut keys = AttributeSet::<KeyCode>::new();
         for code in KeyCode::KEY_ESC.code()..=KeyCode::KEY_MICMUTE.code() {
@@ -24,12 +28,18 @@ impl LinuxVirtualKeyboard {
 
         // Build virtual device
         let device = VirtualDevice::builder()?
-            .name(name)
+            .name(&identity.name)
+            .input_id(InputId::new(
+                BusType::BUS_USB,
+                identity.vendor_id,
+                identity.product_id,
+                identity.version,
+            ))
             .with_keys(&keys)?
             .build()
             .context("Failed to create virtual keyboard")?;
 
-        tracing::info!("Virtual keyboard created: {}", name);
+        tracing::info!("Virtual keyboard created: {}", identity.name);
 
         Ok(Self { device })
     }
@@ -53,6 +63,35 @@ impl LinuxVirtualKeyboard {
         Ok(())
     }
 
+    fn emit_frame_events(&mut self, events: &[OutputEvent]) -> Result<()> {
+        let mut batch = Vec::with_capacity(events.len() + 1);
+        for event in events {
+            // The other devices' events are theirs to send
+            let OutputEvent::Keyboard { code, event_type } = event else {
+                continue;
+            };
+            let value = match event_type {
+                KeyboardEventType::Press => 1,
+                KeyboardEventType::Release => 0,
+                // The kernel's own autorepeat value
+                KeyboardEventType::Hold => 2,
+            };
+            batch.push(EvdevEvent::new(
+                EventType::KEY.0,
+                keyboard_code_to_evdev_key(*code).code(),
+                value,
+            ));
+        }
+        if batch.is_empty() {
+            return Ok(());
+        }
+
+        // One SYN_REPORT so readers see the whole frame at once
+        batch.push(EvdevEvent::new(EventType::SYNCHRONIZATION.0, 0, 0));
+        self.device.emit(&batch)?;
+        Ok(())
+    }
+
     fn tap_key_code(&mut self, code: u16) -> Result<()> {
         self.press_key_code(code)?;
         std::thread::sleep(std::time::Duration::from_millis(10));
@@ -84,6 +123,10 @@ impl VirtualKeyboard for LinuxVirtualKeyboard {
     fn tap_key(&mut self, code: KeyboardCode) -> Result<()> {
         self.tap_key_code(keyboard_code_to_evdev_key(code).code())
     }
+
+    fn emit_frame(&mut self, events: &[OutputEvent]) -> Result<()> {
+        self.emit_frame_events(events)
+    }
     fn sys_path(&mut self) -> Result<std::path::PathBuf> {
         self.sys_path()
     }
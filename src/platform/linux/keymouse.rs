@@ -0,0 +1,306 @@
+// Keyboards and mice read as one controller
+//
+// Every device is polled together. Key and button changes are turned into
+// controller events by `KeyMouseState` as they arrive; mouse movement is
+// summed up to each SYN_REPORT and deflects the mouse stick by that much.
+// When the mouse has reported no movement for `MOUSE_REST`, its stick goes
+// back to center. Each device's SYN_REPORT closes the frame, like a
+// controller's.
+
+use super::backend::{BackendDevice, DeviceCapabilities};
+use super::converter::evdev_key_to_keyboard_code;
+use crate::audit::{self, AuditEvent};
+use crate::event::InputEvent;
+use crate::input::gamepad::{Gamepad, GamepadInfo, GamepadType};
+use crate::input::keymouse::{KeyMouseInput, KeyMouseLayout, KeyMouseState, MouseButton};
+use crate::input::manager::DeviceKind;
+use anyhow::Result;
+use evdev::{EventSummary, KeyCode, RelativeAxisCode, SynchronizationCode};
+use nix::poll::{PollFd, PollFlags, PollTimeout, poll};
+use std::collections::VecDeque;
+use std::os::fd::AsFd;
+use std::time::{Duration, Instant};
+
+// ENODEV: the device was unplugged
+const ENODEV: i32 = 19;
+
+/// A mouse quiet for this long has stopped
+const MOUSE_REST: Duration = Duration::from_millis(20);
+
+/// Whether a device is a keyboard or a mouse, if either
+///
+/// Our own virtual devices are left out; they only echo what was read.
+pub(super) fn key_mouse_kind(device: &DeviceCapabilities) -> Option<DeviceKind> {
+    if device.name.as_deref().unwrap_or("").starts_with("BlazeRemap") {
+        return None;
+    }
+    let has = |key| device.keys.contains(&key);
+    if [KeyCode::KEY_A, KeyCode::KEY_Z, KeyCode::KEY_SPACE].into_iter().all(has) {
+        return Some(DeviceKind::Keyboard);
+    }
+    let moves = [RelativeAxisCode::REL_X, RelativeAxisCode::REL_Y]
+        .iter()
+        .all(|axis| device.relative_axes.contains(axis));
+    (moves && has(KeyCode::BTN_LEFT)).then_some(DeviceKind::Mouse)
+}
+
+fn mouse_button(key: KeyCode) -> Option<MouseButton> {
+    match key {
+        KeyCode::BTN_LEFT => Some(MouseButton::Left),
+        KeyCode::BTN_RIGHT => Some(MouseButton::Right),
+        KeyCode::BTN_MIDDLE => Some(MouseButton::Middle),
+        KeyCode::BTN_SIDE => Some(MouseButton::Side),
+        KeyCode::BTN_EXTRA => Some(MouseButton::Extra),
+        _ => None,
+    }
+}
+
+/// Keyboards and mice as a controller
+pub struct KeyMouseReader {
+    devices: Vec<Box<dyn BackendDevice>>,
+    info: GamepadInfo,
+    state: KeyMouseState,
+    release_key: Option<KeyCode>,
+    // Events of the frame being read, and frames ready to hand out
+    frame: Vec<InputEvent>,
+    pending: VecDeque<InputEvent>,
+    // Mouse movement since the last SYN_REPORT
+    motion: (i32, i32),
+    // When the mouse last moved, while its stick is deflected
+    moved_at: Option<Instant>,
+    raw: Vec<evdev::InputEvent>,
+    released: bool,
+    // Paths of the devices grabbed, for the audit log
+    grabbed: Vec<String>,
+}
+
+impl KeyMouseReader {
+    /// Read `devices`, grabbing them first if `grab`
+    pub fn new(
+        mut devices: Vec<(String, Box<dyn BackendDevice>)>,
+        layout: KeyMouseLayout,
+        grab: bool,
+    ) -> Result<Self> {
+        anyhow::ensure!(!devices.is_empty(), "No keyboard or mouse to read");
+        let mut grabbed = Vec::new();
+        if grab {
+            for (path, device) in &mut devices {
+                if let Err(e) = device.grab() {
+                    // Those grabbed already are let go as `devices` closes
+                    for path in grabbed {
+                        audit::record(AuditEvent::Released { device: path });
+                    }
+                    return Err(super::claim::grab_error(path, e));
+                }
+                audit::record(AuditEvent::Grabbed { device: path.clone() });
+                grabbed.push(path.clone());
+            }
+        }
+        let info = GamepadInfo {
+            path: devices.iter().map(|(path, _)| path.as_str()).collect::<Vec<_>>().join(","),
+            name: "Keyboard and Mouse".to_string(),
+            gamepad_type: GamepadType::Generic,
+            vendor_id: 0,
+            vendor_name: String::new(),
+            product_id: 0,
+            uniq: None,
+            phys: None,
+            capabilities: Vec::new(),
+        };
+        let release_key = layout.release_key.map(super::converter::keyboard_code_to_evdev_key);
+        Ok(Self {
+            devices: devices.into_iter().map(|(_, device)| device).collect(),
+            info,
+            state: KeyMouseState::new(layout),
+            release_key,
+            frame: Vec::new(),
+            pending: VecDeque::new(),
+            motion: (0, 0),
+            moved_at: None,
+            raw: Vec::new(),
+            released: false,
+            grabbed,
+        })
+    }
+
+    /// Close the frame read so far, if anything changed
+    fn close_frame(&mut self) {
+        if !self.frame.is_empty() {
+            self.pending.extend(self.frame.drain(..));
+            self.pending.push_back(InputEvent::sync());
+        }
+    }
+
+    /// Turn one raw event into controller events
+    fn convert(&mut self, event: evdev::InputEvent) {
+        match event.destructure() {
+            EventSummary::Key(_, key, value @ (0 | 1)) => {
+                if Some(key) == self.release_key {
+                    self.released = true;
+                    return;
+                }
+                let input = match mouse_button(key) {
+                    Some(button) => KeyMouseInput::Mouse(button),
+                    None => match evdev_key_to_keyboard_code(key) {
+                        Some(code) => KeyMouseInput::Key(code),
+                        None => return,
+                    },
+                };
+                self.state.press(input, value == 1, &mut self.frame);
+            }
+            EventSummary::RelativeAxis(_, RelativeAxisCode::REL_X, value) => self.motion.0 += value,
+            EventSummary::RelativeAxis(_, RelativeAxisCode::REL_Y, value) => self.motion.1 += value,
+            EventSummary::Synchronization(_, SynchronizationCode::SYN_REPORT, _) => {
+                let (dx, dy) = std::mem::take(&mut self.motion);
+                if dx != 0 || dy != 0 {
+                    self.state.mouse_motion(dx, dy, &mut self.frame);
+                    self.moved_at = Some(Instant::now());
+                }
+                self.close_frame();
+            }
+            _ => {}
+        }
+    }
+
+    /// Fetch what the device at `index` has; drops it if it's gone
+    fn fetch(&mut self, index: usize) -> Result<()> {
+        self.raw.clear();
+        match self.devices[index].fetch_events(&mut self.raw) {
+            Ok(()) => {
+                for event in std::mem::take(&mut self.raw) {
+                    self.convert(event);
+                }
+            }
+            Err(e) if e.raw_os_error() == Some(ENODEV) => {
+                tracing::warn!("Keyboard or mouse disconnected");
+                self.devices.remove(index);
+            }
+            Err(e) => anyhow::bail!("Failed to read keyboard or mouse: {}", e),
+        }
+        Ok(())
+    }
+}
+
+// Closing the devices lets go of their grabs
+impl Drop for KeyMouseReader {
+    fn drop(&mut self) {
+        for path in self.grabbed.drain(..) {
+            audit::record(AuditEvent::Released { device: path });
+        }
+    }
+}
+
+impl Gamepad for KeyMouseReader {
+    fn get_info(&self) -> GamepadInfo {
+        self.info.clone()
+    }
+
+    fn read_event(&mut self) -> Result<Option<InputEvent>> {
+        loop {
+            if let Some(event) = self.pending.pop_front() {
+                return Ok(Some(event));
+            }
+            if self.released || self.devices.is_empty() {
+                return Ok(None);
+            }
+            let timeout = match self.moved_at {
+                Some(moved_at) => {
+                    let left = (moved_at + MOUSE_REST).saturating_duration_since(Instant::now());
+                    PollTimeout::try_from(left).unwrap_or(PollTimeout::MAX)
+                }
+                None => PollTimeout::NONE,
+            };
+            let mut fds: Vec<_> = self
+                .devices
+                .iter()
+                .map(|device| PollFd::new(device.as_fd(), PollFlags::POLLIN))
+                .collect();
+            match poll(&mut fds, timeout) {
+                Ok(_) => {}
+                Err(nix::errno::Errno::EINTR) => continue,
+                Err(e) => anyhow::bail!("poll failed: {}", e),
+            }
+            let ready: Vec<_> = fds
+                .iter()
+                .map(|fd| fd.revents().is_some_and(|revents| !revents.is_empty()))
+                .collect();
+            drop(fds);
+
+            if !ready.contains(&true) {
+                // The mouse stopped
+                self.moved_at = None;
+                self.state.mouse_rest(&mut self.frame);
+                self.close_frame();
+                continue;
+            }
+            // Backwards, so dropping a device doesn't shift the rest
+            for index in (0..ready.len()).rev().filter(|&index| ready[index]) {
+                self.fetch(index)?;
+            }
+        }
+    }
+
+    fn close(self) -> Result<()> {
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{AxisCode, ButtonCode};
+    use crate::platform::linux::backend::InputBackend;
+    use crate::platform::linux::backend::fake::{FakeBackend, FakeDeviceSpec};
+    use evdev::EventType;
+
+    #[test]
+    fn test_key_mouse_kind() {
+        let kind = |spec: FakeDeviceSpec| key_mouse_kind(&spec.capabilities);
+        assert_eq!(kind(FakeDeviceSpec::keyboard("")), Some(DeviceKind::Keyboard));
+        assert_eq!(kind(FakeDeviceSpec::mouse("")), Some(DeviceKind::Mouse));
+        assert_eq!(kind(FakeDeviceSpec::gamepad("")), None);
+        let mut ours = FakeDeviceSpec::keyboard("");
+        ours.capabilities.name = Some("BlazeRemap Virtual Keyboard".to_string());
+        assert_eq!(kind(ours), None);
+    }
+
+    #[test]
+    fn test_keys_and_mouse_become_a_controller() {
+        let key = |key: KeyCode, value| (EventType::KEY, key.code(), value);
+        let rel = |axis: RelativeAxisCode, value| (EventType::RELATIVE, axis.0, value);
+        let keyboard = FakeDeviceSpec::keyboard("/dev/input/event0")
+            .frame(&[key(KeyCode::KEY_W, 1), key(KeyCode::KEY_SPACE, 1)])
+            .frame(&[key(KeyCode::KEY_W, 2)])
+            .frame(&[key(KeyCode::KEY_SCROLLLOCK, 1)]);
+        let mouse = FakeDeviceSpec::mouse("/dev/input/event1")
+            .frame(&[rel(RelativeAxisCode::REL_X, 2), rel(RelativeAxisCode::REL_Y, 0)]);
+        let backend = FakeBackend::new(vec![keyboard, mouse]);
+        let devices = ["/dev/input/event0", "/dev/input/event1"]
+            .into_iter()
+            .map(|path| (path.to_string(), backend.open(path).unwrap()))
+            .collect();
+        let mut reader = KeyMouseReader::new(devices, KeyMouseLayout::default(), true).unwrap();
+
+        let mut events = Vec::new();
+        while let Some(event) = reader.read_event().unwrap() {
+            events.push(event);
+        }
+        let axis = |code, value| {
+            events.iter().any(|event| {
+                matches!(event, InputEvent::Axis { code: c, value: v, .. } if *c == code && *v == value)
+            })
+        };
+        assert!(axis(AxisCode::LeftY, -32767));
+        assert!(events.iter().any(|event| matches!(
+            event,
+            InputEvent::Button { code: ButtonCode::South, pressed: true, .. }
+        )));
+        assert!(axis(AxisCode::RightX, 800));
+        // Auto-repeat adds nothing; every frame is closed
+        assert_eq!(
+            events.iter().filter(|event| matches!(event, InputEvent::Sync { .. })).count(),
+            2
+        );
+        assert!(matches!(events.last(), Some(InputEvent::Sync { .. })));
+    }
+}
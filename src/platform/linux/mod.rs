@@ -1,11 +1,47 @@
+mod absinfo;
+pub mod backend;
+mod claim;
+pub mod confine;
+pub mod context;
 mod converter;
+mod epoll_reader;
 mod errors;
+pub mod evemu;
+mod frame;
 mod gamepad;
 mod input_manager;
+pub mod journal;
+mod key_listener;
 mod keyboard;
+mod keymouse;
+mod notifier;
+pub mod peer;
+mod player_light;
+pub mod preflight;
+pub mod probe;
+mod rumble;
+pub mod sandbox;
+pub mod sched;
+pub mod signals;
+mod sound;
+mod terminal;
+pub mod threads;
+mod virtual_gamepad;
+mod virtual_mouse;
 
-pub use converter::evdev_to_input;
+pub use absinfo::write_calibration;
+pub use claim::DeviceClaim;
+pub use converter::{button_code_to_evdev_key, evdev_to_input};
+pub use epoll_reader::{EpollReader, ShutdownHandle};
 pub use errors::LinuxError;
 pub use gamepad::LinuxGamepad;
 pub use input_manager::LinuxInputManager;
+pub use key_listener::LinuxKeyListener;
 pub use keyboard::LinuxVirtualKeyboard;
+pub use notifier::GdbusNotifier;
+pub use player_light::LinuxPlayerLight;
+pub use rumble::LinuxRumble;
+pub use sound::CanberraSound;
+pub use terminal::Terminal;
+pub use virtual_gamepad::LinuxVirtualGamepad;
+pub use virtual_mouse::LinuxVirtualMouse;
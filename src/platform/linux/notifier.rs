@@ -0,0 +1,122 @@
+// Desktop notifications over D-Bus, through gdbus
+//
+// `gdbus call` sends org.freedesktop.Notifications.Notify to whatever
+// notification server the session runs. Its arguments are GVariant text,
+// so strings go in single quotes. Like sounds, each notification is its
+// own short-lived process, so the mapper never waits on the desktop.
+
+use crate::output::notify::{Notifier, Urgency};
+use anyhow::{Context, Result, bail};
+use std::path::Path;
+use std::process::{Child, Command, Stdio};
+
+const GDBUS: &str = "gdbus";
+const APP_NAME: &str = "BlazeRemap";
+const ICON: &str = "input-gaming";
+
+/// Notifications sent by `gdbus`
+pub struct GdbusNotifier {
+    // Notifications still being sent, reaped as new ones go out
+    sending: Vec<Child>,
+}
+
+impl GdbusNotifier {
+    /// Fails if `gdbus` isn't installed
+    pub fn new() -> Result<Self> {
+        let path = std::env::var_os("PATH").unwrap_or_default();
+        if !std::env::split_paths(&path).any(|dir| Path::new(&dir).join(GDBUS).is_file()) {
+            bail!("{} not found; install libglib2.0-bin or similar", GDBUS);
+        }
+        Ok(Self { sending: Vec::new() })
+    }
+}
+
+impl Notifier for GdbusNotifier {
+    fn notify(&mut self, summary: &str, body: &str, urgency: Urgency) -> Result<()> {
+        self.sending.retain_mut(|child| matches!(child.try_wait(), Ok(None)));
+        let child = Command::new(GDBUS)
+            .args(notify_args(summary, body, urgency))
+            .stdin(Stdio::null())
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .spawn()
+            .with_context(|| format!("Failed to run {}", GDBUS))?;
+        self.sending.push(child);
+        Ok(())
+    }
+}
+
+fn notify_args(summary: &str, body: &str, urgency: Urgency) -> Vec<String> {
+    let mut args: Vec<String> = [
+        "call",
+        "--session",
+        "--dest",
+        "org.freedesktop.Notifications",
+        "--object-path",
+        "/org/freedesktop/Notifications",
+        "--method",
+        "org.freedesktop.Notifications.Notify",
+    ]
+    .map(String::from)
+    .into();
+    args.extend([
+        quote(APP_NAME),
+        // replaces_id: a new notification each time
+        "uint32 0".to_string(),
+        quote(ICON),
+        quote(summary),
+        quote(body),
+        "@as []".to_string(),
+        format!("{{'urgency': <byte {}>}}", urgency as u8),
+        // expire_timeout: the server's default
+        "int32 -1".to_string(),
+    ]);
+    args
+}
+
+/// `text` as a GVariant string literal
+fn quote(text: &str) -> String {
+    let mut quoted = String::with_capacity(text.len() + 2);
+    quoted.push('\'');
+    for c in text.chars() {
+        match c {
+            '\\' => quoted.push_str("\\\\"),
+            '\'' => quoted.push_str("\\'"),
+            '\n' => quoted.push_str("\\n"),
+            c => quoted.push(c),
+        }
+    }
+    quoted.push('\'');
+    quoted
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_quote() {
+        assert_eq!(quote("Racing"), "'Racing'");
+        assert_eq!(quote("Pad now maps with 'Racing'"), r"'Pad now maps with \'Racing\''");
+        assert_eq!(quote("a\\b\nc"), r"'a\\b\nc'");
+    }
+
+    #[test]
+    fn test_notify_args() {
+        let args = notify_args("Battery low", "Pad is at 15%", Urgency::Critical);
+        assert_eq!(args[..2], ["call", "--session"]);
+        assert_eq!(
+            args[8..],
+            [
+                "'BlazeRemap'",
+                "uint32 0",
+                "'input-gaming'",
+                "'Battery low'",
+                "'Pad is at 15%'",
+                "@as []",
+                "{'urgency': <byte 2>}",
+                "int32 -1",
+            ]
+        );
+    }
+}
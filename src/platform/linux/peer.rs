@@ -0,0 +1,106 @@
+// Who is at the other end of a TCP connection from this machine
+//
+// TCP carries no credentials the way SO_PEERCRED does on a Unix socket, but
+// when the client runs here the kernel shows both ends: its socket is the
+// line of /proc/net/tcp (tcp6) whose local address is the client's and
+// whose remote address is ours, with the uid that made it and its inode.
+// The process is the one with `socket:[inode]` among its fds; those of
+// other users can't be looked into, so their pid stays unknown.
+
+use std::net::{IpAddr, SocketAddr};
+use std::path::PathBuf;
+
+/// The uid and, where we may tell, pid of the process that connected from
+/// `peer` to us at `local`; None if it isn't on this machine
+pub fn tcp_peer(local: SocketAddr, peer: SocketAddr) -> Option<(u32, Option<u32>)> {
+    let (uid, inode) = ["/proc/net/tcp", "/proc/net/tcp6"].iter().find_map(|table| {
+        let table = std::fs::read_to_string(table).ok()?;
+        find_socket(&table, &proc_address(peer), &proc_address(local))
+    })?;
+    Some((uid, socket_owner(inode)))
+}
+
+/// `addr` as /proc/net/tcp prints it: the address' 32-bit words in hex, in
+/// host byte order, then the port
+///
+/// IPv4-mapped addresses are printed as IPv4, since a client connecting
+/// over IPv4 has an IPv4 socket whatever the listener's.
+fn proc_address(addr: SocketAddr) -> String {
+    let words: Vec<String> = match addr.ip().to_canonical() {
+        IpAddr::V4(ip) => vec![format!("{:08X}", u32::from_ne_bytes(ip.octets()))],
+        IpAddr::V6(ip) => ip
+            .octets()
+            .chunks(4)
+            .map(|word| format!("{:08X}", u32::from_ne_bytes(word.try_into().unwrap())))
+            .collect(),
+    };
+    format!("{}:{:04X}", words.concat(), addr.port())
+}
+
+/// The uid and inode of the socket from `local` to `remote` in a
+/// /proc/net/tcp table
+///
+/// Lines look like `0: 0100007F:D2F0 0100007F:21E8 01 00000000:00000000
+/// 00:00000000 00000000 1000 0 4812 1 ...`; the header line has no match.
+fn find_socket(table: &str, local: &str, remote: &str) -> Option<(u32, u64)> {
+    table.lines().find_map(|line| {
+        let fields: Vec<&str> = line.split_whitespace().collect();
+        let [_, from, to, _, _, _, _, uid, _, inode, ..] = fields[..] else {
+            return None;
+        };
+        if from != local || to != remote {
+            return None;
+        }
+        Some((uid.parse().ok()?, inode.parse().ok()?))
+    })
+}
+
+/// The process with the socket `inode` open, as far as we may look
+fn socket_owner(inode: u64) -> Option<u32> {
+    let target = PathBuf::from(format!("socket:[{}]", inode));
+    std::fs::read_dir("/proc").ok()?.flatten().find_map(|entry| {
+        let pid = entry.file_name().to_str()?.parse::<u32>().ok()?;
+        let fds = std::fs::read_dir(entry.path().join("fd")).ok()?;
+        let has_socket =
+            fds.flatten().any(|fd| std::fs::read_link(fd.path()).is_ok_and(|link| link == target));
+        has_socket.then_some(pid)
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::{TcpListener, TcpStream};
+
+    #[test]
+    #[cfg(target_endian = "little")]
+    fn test_proc_address() {
+        assert_eq!(proc_address("127.0.0.1:8680".parse().unwrap()), "0100007F:21E8");
+        assert_eq!(proc_address("[::ffff:127.0.0.1]:8680".parse().unwrap()), "0100007F:21E8");
+        assert_eq!(
+            proc_address("[::1]:8680".parse().unwrap()),
+            "00000000000000000000000001000000:21E8"
+        );
+    }
+
+    #[test]
+    fn test_find_socket() {
+        let table = "sl local_address rem_address st tx_queue rx_queue tr tm->when retrnsmt uid\n\
+                     0: 0100007F:21E8 00000000:0000 0A 0:0 0:0 0 1000 0 4700 1\n\
+                     1: 0100007F:21E8 0100007F:D2F0 01 0:0 0:0 0 1000 0 4811 1\n\
+                     2: 0100007F:D2F0 0100007F:21E8 01 0:0 0:0 0 1001 0 4812 1\n";
+        assert_eq!(find_socket(table, "0100007F:D2F0", "0100007F:21E8"), Some((1001, 4812)));
+        assert_eq!(find_socket(table, "0100007F:D2F1", "0100007F:21E8"), None);
+    }
+
+    #[test]
+    fn test_tcp_peer_finds_this_process() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let _client = TcpStream::connect(listener.local_addr().unwrap()).unwrap();
+        let (stream, peer) = listener.accept().unwrap();
+
+        let uid = nix::unistd::Uid::current().as_raw();
+        let found = tcp_peer(stream.local_addr().unwrap(), peer);
+        assert_eq!(found, Some((uid, Some(std::process::id()))));
+    }
+}
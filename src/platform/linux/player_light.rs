@@ -0,0 +1,229 @@
+// Player lights through the kernel's LED class
+//
+// Controller drivers register their lights under the controller's HID or
+// USB device, next to its input device:
+//
+//   xpad            xpad0            the Xbox 360 ring; 6-9 light one quarter
+//   hid-playstation <id>:player-1..5 DualSense player LEDs
+//                   <id>:rgb:indicator  lightbar, multi-color
+//   hid-sony        <id>:red/green/blue DualShock 4 lightbar
+//   hid-nintendo    <id>:player-1..4 Switch controller player LEDs
+//
+// Writing them needs write access to the LEDs' brightness files, which
+// distributions usually grant to the seat's user through udev.
+
+use super::context::sysfs_device;
+use crate::output::players::PlayerLight;
+use anyhow::{Context, Result, bail};
+use std::path::{Path, PathBuf};
+
+/// The lightbar colors PlayStation consoles give players 1-4
+const COLORS: [[u8; 3]; 4] = [[0, 0, 255], [255, 0, 0], [0, 255, 0], [255, 0, 255]];
+
+/// Which player LEDs of a row of five are lit, as on a PS5
+const FIVE_LEDS: [[bool; 5]; 5] = [
+    [false, false, true, false, false],
+    [false, true, false, true, false],
+    [true, false, true, false, true],
+    [true, true, false, true, true],
+    [true, true, true, true, true],
+];
+
+/// Concrete lights of an evdev controller
+#[derive(Debug)]
+pub struct LinuxPlayerLight {
+    leds: PathBuf,
+    ring: Option<String>,
+    // Player LEDs in order
+    row: Vec<String>,
+    // A multi-color LED, or one LED per color
+    lightbar: Option<Lightbar>,
+}
+
+#[derive(Debug, PartialEq, Eq)]
+enum Lightbar {
+    MultiColor(String),
+    Rgb([String; 3]),
+}
+
+impl LinuxPlayerLight {
+    /// Find the lights of the controller at `path`; fails if it has none
+    pub fn open(path: &str) -> Result<Self> {
+        let device = sysfs_device(path).with_context(|| format!("{} is not a device", path))?;
+        Self::open_at(&device.join("device/leds"))
+            .with_context(|| format!("{} has no player lights", path))
+    }
+
+    /// Find the lights in the LED directory `leds`
+    fn open_at(leds: &Path) -> Result<Self> {
+        let mut names: Vec<String> = std::fs::read_dir(leds)?
+            .flatten()
+            .map(|entry| entry.file_name().to_string_lossy().into_owned())
+            .collect();
+        names.sort();
+        let find = |suffix: &str| names.iter().find(|name| name.ends_with(suffix)).cloned();
+
+        let ring = names.iter().find(|name| name.starts_with("xpad")).cloned();
+        let mut row: Vec<(u32, String)> = names
+            .iter()
+            .filter_map(|name| {
+                let (_, number) = name.rsplit_once(":player-")?;
+                Some((number.parse().ok()?, name.clone()))
+            })
+            .collect();
+        row.sort();
+        let lightbar = match (find(":rgb:indicator"), find(":red"), find(":green"), find(":blue")) {
+            (Some(led), ..) => Some(Lightbar::MultiColor(led)),
+            (None, Some(red), Some(green), Some(blue)) => Some(Lightbar::Rgb([red, green, blue])),
+            _ => None,
+        };
+        if ring.is_none() && row.is_empty() && lightbar.is_none() {
+            bail!("No player LEDs in {}", leds.display());
+        }
+        Ok(Self {
+            leds: leds.to_path_buf(),
+            ring,
+            row: row.into_iter().map(|(_, name)| name).collect(),
+            lightbar,
+        })
+    }
+
+    fn write(&self, led: &str, file: &str, value: impl ToString) -> Result<()> {
+        let path = self.leds.join(led).join(file);
+        std::fs::write(&path, value.to_string())
+            .with_context(|| format!("Failed to write {}", path.display()))
+    }
+
+    /// Largest brightness `led` takes
+    fn max_brightness(&self, led: &str) -> u32 {
+        std::fs::read_to_string(self.leds.join(led).join("max_brightness"))
+            .ok()
+            .and_then(|max| max.trim().parse().ok())
+            .unwrap_or(255)
+    }
+}
+
+impl PlayerLight for LinuxPlayerLight {
+    fn show(&mut self, player: usize) -> Result<()> {
+        let slot = player.saturating_sub(1);
+        if let Some(ring) = &self.ring {
+            self.write(ring, "brightness", 6 + slot % 4)?;
+        }
+        if !self.row.is_empty() {
+            // Five LEDs count like a PS5, others like a Switch: one more each
+            let lit: Vec<bool> = match self.row.len() {
+                5 => FIVE_LEDS[slot % 5].to_vec(),
+                count => (0..count).map(|led| led <= slot % count).collect(),
+            };
+            for (led, on) in self.row.iter().zip(lit) {
+                self.write(led, "brightness", on as u8)?;
+            }
+        }
+        let color = COLORS[slot % COLORS.len()];
+        match &self.lightbar {
+            Some(Lightbar::MultiColor(led)) => {
+                let [red, green, blue] = color;
+                self.write(led, "multi_intensity", format!("{} {} {}", red, green, blue))?;
+                self.write(led, "brightness", self.max_brightness(led))?;
+            }
+            Some(Lightbar::Rgb(leds)) => {
+                for (led, value) in leds.iter().zip(color) {
+                    let brightness = value as u32 * self.max_brightness(led) / 255;
+                    self.write(led, "brightness", brightness)?;
+                }
+            }
+            None => {}
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// An LED directory holding `leds`, removed when dropped
+    struct Leds(PathBuf);
+
+    impl Leds {
+        fn new(name: &str, leds: &[&str]) -> Self {
+            let root = std::env::temp_dir().join(format!(
+                "blazeremap-leds-{}-{}",
+                std::process::id(),
+                name
+            ));
+            for led in leds {
+                std::fs::create_dir_all(root.join(led)).unwrap();
+                std::fs::write(root.join(led).join("max_brightness"), "255\n").unwrap();
+            }
+            Self(root)
+        }
+
+        fn read(&self, led: &str, file: &str) -> String {
+            std::fs::read_to_string(self.0.join(led).join(file)).unwrap()
+        }
+    }
+
+    impl Drop for Leds {
+        fn drop(&mut self) {
+            let _ = std::fs::remove_dir_all(&self.0);
+        }
+    }
+
+    #[test]
+    fn test_xbox_360_ring() {
+        let leds = Leds::new("xpad", &["xpad0"]);
+        let mut light = LinuxPlayerLight::open_at(&leds.0).unwrap();
+        light.show(2).unwrap();
+        assert_eq!(leds.read("xpad0", "brightness"), "7");
+        light.show(5).unwrap();
+        assert_eq!(leds.read("xpad0", "brightness"), "6");
+    }
+
+    #[test]
+    fn test_dualsense_leds_and_lightbar() {
+        let mut names: Vec<String> =
+            (1..=5).map(|number| format!("input9:white:player-{}", number)).collect();
+        names.push("input9:rgb:indicator".to_string());
+        let names: Vec<&str> = names.iter().map(String::as_str).collect();
+        let leds = Leds::new("dualsense", &names);
+        let mut light = LinuxPlayerLight::open_at(&leds.0).unwrap();
+        light.show(2).unwrap();
+
+        let lit: Vec<_> = names[..5].iter().map(|led| leds.read(led, "brightness")).collect();
+        assert_eq!(lit, ["0", "1", "0", "1", "0"]);
+        assert_eq!(leds.read("input9:rgb:indicator", "multi_intensity"), "255 0 0");
+        assert_eq!(leds.read("input9:rgb:indicator", "brightness"), "255");
+    }
+
+    #[test]
+    fn test_dualshock_4_lightbar() {
+        let names =
+            ["0005:054C:09CC.0004:blue", "0005:054C:09CC.0004:green", "0005:054C:09CC.0004:red"];
+        let leds = Leds::new("ds4", &names);
+        let mut light = LinuxPlayerLight::open_at(&leds.0).unwrap();
+        light.show(3).unwrap();
+        let color: Vec<_> =
+            [names[2], names[1], names[0]].iter().map(|led| leds.read(led, "brightness")).collect();
+        assert_eq!(color, ["0", "255", "0"]);
+    }
+
+    #[test]
+    fn test_switch_leds_count_up() {
+        let names: Vec<String> =
+            (1..=4).map(|number| format!("0005:057E:2009.0001:green:player-{}", number)).collect();
+        let names: Vec<&str> = names.iter().map(String::as_str).collect();
+        let leds = Leds::new("switch", &names);
+        let mut light = LinuxPlayerLight::open_at(&leds.0).unwrap();
+        light.show(3).unwrap();
+        let lit: Vec<_> = names.iter().map(|led| leds.read(led, "brightness")).collect();
+        assert_eq!(lit, ["1", "1", "1", "0"]);
+    }
+
+    #[test]
+    fn test_no_lights() {
+        let leds = Leds::new("none", &["input3::capslock"]);
+        assert!(LinuxPlayerLight::open_at(&leds.0).is_err());
+        assert!(LinuxPlayerLight::open("/dev/input/does-not-exist").is_err());
+    }
+}
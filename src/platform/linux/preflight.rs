@@ -0,0 +1,352 @@
+// Checking device access before remapping
+//
+// Without access, opening a controller or /dev/uinput fails deep inside
+// evdev with a bare "Permission denied". The nodes a session needs are
+// opened once beforehand, the way it will open them, and a failure says
+// what grants access:
+//
+// - the group owning the node, if it grants it: join it, or log in again
+//   when the user joined since this session started
+// - otherwise a udev rule giving the seat's user access (uaccess)
+// - loading the uinput module, when /dev/uinput is missing because it isn't
+//   loaded; a kernel without the module, or a node missing though it is
+//   loaded, is told apart
+//
+// Other failures, like a node gone, are left to the open to report.
+// `blazeremap setup access` and `blazeremap setup uinput` apply these
+// fixes, asking first.
+
+use std::fmt;
+use std::fs::OpenOptions;
+use std::io;
+use std::os::unix::fs::MetadataExt;
+use std::path::Path;
+
+use nix::unistd::{Gid, Group, Uid, User, getgroups};
+
+const UINPUT_PATH: &str = "/dev/uinput";
+
+const INPUT_RULE: &str = r#"SUBSYSTEM=="input", ENV{ID_INPUT_JOYSTICK}=="1", TAG+="uaccess""#;
+const UINPUT_RULE: &str =
+    r#"KERNEL=="uinput", SUBSYSTEM=="misc", TAG+="uaccess", OPTIONS+="static_node=uinput""#;
+/// Where the udev rules go
+pub const RULES_FILE: &str = "/etc/udev/rules.d/70-blazeremap.rules";
+/// Where uinput is asked to be loaded at boot
+pub const MODULES_LOAD_FILE: &str = "/etc/modules-load.d/uinput.conf";
+
+/// Points at the command applying the fixes
+const GUIDE: &str = "; 'blazeremap setup access' can do this for you";
+
+/// CAP_SYS_NICE, as numbered in /proc/self/status's capability masks
+const CAP_SYS_NICE: u32 = 23;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Access {
+    Read,
+    Write,
+}
+
+/// A device node this process can't use, and what to do about it
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct AccessProblem {
+    pub path: String,
+    pub problem: String,
+    pub fix: String,
+}
+
+impl fmt::Display for AccessProblem {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}\n  └─ {}", self.path, self.problem, self.fix)
+    }
+}
+
+impl std::error::Error for AccessProblem {}
+
+/// Fail, saying how to get access, unless the controllers at `paths` can be read
+pub fn check_input(paths: &[String]) -> Result<(), AccessProblem> {
+    for path in paths {
+        if let Err(e) = OpenOptions::new().read(true).open(path) {
+            check_open(path, Access::Read, e)?;
+        }
+    }
+    Ok(())
+}
+
+/// Fail, saying how to get access, unless virtual devices can be made
+pub fn check_uinput() -> Result<(), AccessProblem> {
+    match OpenOptions::new().write(true).open(UINPUT_PATH) {
+        Ok(_) => Ok(()),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Err(uinput_missing(uinput_module())),
+        Err(e) => check_open(UINPUT_PATH, Access::Write, e),
+    }
+}
+
+/// How the kernel stands with the uinput module
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum UinputModule {
+    /// Loaded, or built in
+    Loaded,
+    /// Can be loaded
+    NotLoaded,
+    /// Not in this kernel's modules
+    Unavailable,
+}
+
+/// Whether uinput is loaded, and if not whether it can be
+///
+/// Without a module list for the running kernel, as in many containers, it
+/// is taken to be loadable.
+pub fn uinput_module() -> UinputModule {
+    let release = std::fs::read_to_string("/proc/sys/kernel/osrelease").unwrap_or_default();
+    let modules = Path::new("/lib/modules").join(release.trim());
+    let listed =
+        |file: &str| std::fs::read_to_string(modules.join(file)).map(|list| lists_uinput(&list));
+    // Built-in modules without parameters have no /sys/module entry
+    if Path::new("/sys/module/uinput").exists() || listed("modules.builtin").unwrap_or(false) {
+        return UinputModule::Loaded;
+    }
+    match listed("modules.dep") {
+        Ok(false) => UinputModule::Unavailable,
+        _ => UinputModule::NotLoaded,
+    }
+}
+
+/// Whether a modules.dep or modules.builtin lists uinput, compressed or not
+fn lists_uinput(dep: &str) -> bool {
+    dep.lines()
+        .filter_map(|line| line.split(':').next())
+        .filter_map(|module| module.rsplit('/').next())
+        .any(|name| name.split('.').next() == Some("uinput"))
+}
+
+/// What to do about /dev/uinput missing, the module being as it is
+fn uinput_missing(module: UinputModule) -> AccessProblem {
+    let (problem, fix) = match module {
+        UinputModule::NotLoaded => (
+            "missing: the uinput module isn't loaded, so virtual devices can't be made",
+            format!(
+                "load it: sudo modprobe uinput; to load it at boot too: echo uinput | sudo tee \
+                 {}; 'blazeremap setup uinput' can do both for you",
+                MODULES_LOAD_FILE
+            ),
+        ),
+        UinputModule::Loaded => (
+            "missing, though the uinput module is loaded",
+            "have udev create it: sudo udevadm trigger; in a container, pass /dev/uinput in \
+             from the host"
+                .to_string(),
+        ),
+        UinputModule::Unavailable => (
+            "missing: this kernel has no uinput module",
+            "install your distribution's extra kernel modules (e.g. linux-modules-extra), or a \
+             kernel built with CONFIG_INPUT_UINPUT"
+                .to_string(),
+        ),
+    };
+    AccessProblem { path: UINPUT_PATH.to_string(), problem: problem.to_string(), fix }
+}
+
+/// Fail, saying how to allow it, unless threads can get real-time priority
+pub fn check_realtime() -> Result<(), AccessProblem> {
+    let status = std::fs::read_to_string("/proc/self/status").unwrap_or_default();
+    if has_capability(&status, CAP_SYS_NICE) {
+        return Ok(());
+    }
+    let mut limit = libc::rlimit { rlim_cur: 0, rlim_max: 0 };
+    // SAFETY: getrlimit only writes the struct it is given
+    if unsafe { libc::getrlimit(libc::RLIMIT_RTPRIO, &mut limit) } == 0 && limit.rlim_cur > 0 {
+        return Ok(());
+    }
+    let binary = std::env::current_exe()
+        .map(|exe| exe.display().to_string())
+        .unwrap_or_else(|_| "$(command -v blazeremap)".to_string());
+    Err(AccessProblem {
+        path: binary.clone(),
+        problem: "no CAP_SYS_NICE and an rtprio limit of 0, so --realtime only raises the nice \
+                  value"
+            .to_string(),
+        fix: format!(
+            "grant it to the binary: sudo setcap cap_sys_nice+ep {}, or raise rtprio in \
+             /etc/security/limits.conf",
+            binary
+        ),
+    })
+}
+
+/// Whether the effective capability mask in `status` has `capability`
+fn has_capability(status: &str, capability: u32) -> bool {
+    status
+        .lines()
+        .find_map(|line| line.strip_prefix("CapEff:"))
+        .and_then(|mask| u64::from_str_radix(mask.trim(), 16).ok())
+        .is_some_and(|mask| mask & (1 << capability) != 0)
+}
+
+/// The problem with opening `path` for `access`, if `error` is for want of it
+fn check_open(path: &str, access: Access, error: io::Error) -> Result<(), AccessProblem> {
+    if error.kind() != io::ErrorKind::PermissionDenied {
+        return Ok(());
+    }
+    let metadata = std::fs::metadata(path).ok();
+    let (gid, mode) = metadata.map(|m| (m.gid(), m.mode())).unwrap_or((0, 0));
+    let group = Group::from_gid(Gid::from_raw(gid)).ok().flatten();
+    let membership = membership_of(gid, group.as_ref());
+    let owner = Owner { gid, group: group.map(|group| group.name), mode };
+    Err(AccessProblem {
+        path: path.to_string(),
+        problem: match access {
+            Access::Read => "can't be read: permission denied".to_string(),
+            Access::Write => "can't be written: permission denied".to_string(),
+        },
+        fix: fix(path, &owner, access, membership) + GUIDE,
+    })
+}
+
+/// How this process stands with the group called `name`; None if there's
+/// no such group
+pub fn membership(name: &str) -> Option<Membership> {
+    let group = Group::from_name(name).ok().flatten()?;
+    Some(membership_of(group.gid.as_raw(), Some(&group)))
+}
+
+fn membership_of(gid: u32, group: Option<&Group>) -> Membership {
+    let user = User::from_uid(Uid::current()).ok().flatten();
+    let in_session = Gid::effective().as_raw() == gid
+        || getgroups().is_ok_and(|groups| groups.contains(&Gid::from_raw(gid)));
+    let listed = user.is_some_and(|user| {
+        user.gid.as_raw() == gid || group.is_some_and(|group| group.mem.contains(&user.name))
+    });
+    match (in_session, listed) {
+        (true, _) => Membership::Session,
+        (false, true) => Membership::Login,
+        (false, false) => Membership::None,
+    }
+}
+
+/// The rules giving the seat's user access to controllers and /dev/uinput,
+/// as RULES_FILE holds them
+pub fn udev_rules() -> String {
+    format!(
+        "# Installed by 'blazeremap setup access': controllers and virtual devices for the \
+         user at the seat\n{}\n{}\n",
+        INPUT_RULE, UINPUT_RULE
+    )
+}
+
+/// Who a device node belongs to
+#[derive(Debug)]
+struct Owner {
+    gid: u32,
+    group: Option<String>,
+    mode: u32,
+}
+
+/// How this process stands with a node's group
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Membership {
+    /// In it now
+    Session,
+    /// Listed in it, but not in this login session
+    Login,
+    None,
+}
+
+fn fix(path: &str, owner: &Owner, access: Access, membership: Membership) -> String {
+    let group_bit = match access {
+        Access::Read => 0o040,
+        Access::Write => 0o020,
+    };
+    // Root's group is no group to join
+    let granting =
+        (owner.gid != 0 && owner.mode & group_bit != 0).then_some(owner.group.as_deref()).flatten();
+    match (granting, membership) {
+        (Some(group), Membership::Login) => format!(
+            "you were added to the '{}' group after logging in; log out and back in, or run \
+             newgrp {}",
+            group, group
+        ),
+        (Some(group), Membership::None) => format!(
+            "add your user to the '{}' group: sudo usermod -aG {} $USER, then log out and back in",
+            group, group
+        ),
+        _ => {
+            let rule = if path == UINPUT_PATH { UINPUT_RULE } else { INPUT_RULE };
+            format!(
+                "install a udev rule giving your seat access: echo '{}' | sudo tee -a {} && sudo \
+                 udevadm control --reload && sudo udevadm trigger",
+                rule, RULES_FILE
+            )
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn input_group(mode: u32) -> Owner {
+        Owner { gid: 104, group: Some("input".to_string()), mode }
+    }
+
+    #[test]
+    fn test_fix_joins_the_granting_group() {
+        let advice =
+            fix("/dev/input/event3", &input_group(0o20660), Access::Read, Membership::None);
+        assert_eq!(
+            advice,
+            "add your user to the 'input' group: sudo usermod -aG input $USER, then log out and \
+             back in"
+        );
+        let advice =
+            fix("/dev/input/event3", &input_group(0o20660), Access::Read, Membership::Login);
+        assert!(advice.starts_with("you were added to the 'input' group after logging in"));
+    }
+
+    #[test]
+    fn test_fix_installs_a_rule_without_a_group() {
+        let root = Owner { gid: 0, group: Some("root".to_string()), mode: 0o20660 };
+        let advice = fix(UINPUT_PATH, &root, Access::Write, Membership::None);
+        assert!(advice.contains(UINPUT_RULE), "{}", advice);
+
+        // The group can't read it, so joining it wouldn't help
+        let advice =
+            fix("/dev/input/event3", &input_group(0o20600), Access::Read, Membership::None);
+        assert!(advice.contains(INPUT_RULE), "{}", advice);
+        // Already in the group, and still denied
+        let advice =
+            fix("/dev/input/event3", &input_group(0o20660), Access::Read, Membership::Session);
+        assert!(advice.contains(INPUT_RULE), "{}", advice);
+    }
+
+    #[test]
+    fn test_missing_nodes_are_left_to_the_open() {
+        assert_eq!(check_input(&["/dev/input/event-gone".to_string()]), Ok(()));
+    }
+
+    #[test]
+    fn test_uinput_missing_says_why() {
+        let problem = uinput_missing(UinputModule::NotLoaded);
+        assert!(problem.problem.contains("isn't loaded"), "{}", problem);
+        assert!(problem.fix.starts_with("load it: sudo modprobe uinput;"), "{}", problem);
+        assert!(problem.fix.contains("/etc/modules-load.d/uinput.conf"), "{}", problem);
+        assert!(uinput_missing(UinputModule::Loaded).fix.contains("udevadm trigger"));
+        assert!(uinput_missing(UinputModule::Unavailable).fix.contains("CONFIG_INPUT_UINPUT"));
+    }
+
+    #[test]
+    fn test_lists_uinput() {
+        let dep = "kernel/drivers/input/misc/uinput.ko.zst:\n\
+                   kernel/drivers/hid/hid-sony.ko.zst: kernel/drivers/input/ff-memless.ko.zst\n";
+        assert!(lists_uinput(dep));
+        assert!(!lists_uinput("kernel/drivers/input/misc/uinputx.ko:\n"));
+        assert!(!lists_uinput(""));
+    }
+
+    #[test]
+    fn test_has_capability() {
+        let status = "Name:\tblazeremap\nCapEff:\t0000000000800000\n";
+        assert!(has_capability(status, CAP_SYS_NICE));
+        assert!(!has_capability("CapEff:\t0000000000000000\n", CAP_SYS_NICE));
+        assert!(!has_capability("Name:\tblazeremap\n", CAP_SYS_NICE));
+    }
+}
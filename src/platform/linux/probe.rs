@@ -0,0 +1,93 @@
+// Latency probe - inject events into a device and read mapped keys back
+//
+// Writing an input_event to an evdev node makes the kernel deliver it to every
+// reader of that node as if the hardware had produced it. That lets us time
+// the whole path: kernel -> BlazeRemap -> uinput -> kernel -> reader.
+
+use crate::event::{ButtonCode, KeyboardCode};
+use crate::platform::linux::converter::{button_code_to_evdev_key, keyboard_code_to_evdev_key};
+use anyhow::{Context, Result, anyhow};
+use evdev::{Device, EventType, InputEvent as EvdevEvent};
+use nix::poll::{PollFd, PollFlags, PollTimeout, poll};
+use std::os::fd::AsFd;
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+/// Writes synthetic button events into an existing input device
+pub struct EventInjector {
+    device: Device,
+}
+
+impl EventInjector {
+    pub fn open(path: &str) -> Result<Self> {
+        let device = Device::open(path)
+            .with_context(|| format!("Failed to open {} for event injection", path))?;
+        Ok(Self { device })
+    }
+
+    /// Inject a button change followed by SYN_REPORT
+    pub fn inject_button(&mut self, code: ButtonCode, pressed: bool) -> Result<()> {
+        let key = button_code_to_evdev_key(code)
+            .ok_or_else(|| anyhow!("{} has no evdev key to inject", code))?;
+        self.device.send_events(&[
+            EvdevEvent::new(EventType::KEY.0, key.code(), pressed as i32),
+            EvdevEvent::new(EventType::SYNCHRONIZATION.0, 0, 0),
+        ])?;
+        Ok(())
+    }
+}
+
+/// Reads key events back from the virtual keyboard's evdev node
+pub struct KeyReadback {
+    device: Device,
+}
+
+impl KeyReadback {
+    /// Open the event node that belongs to a uinput device's sysfs directory
+    pub fn open_sys_path(sys_path: &Path) -> Result<Self> {
+        let node = std::fs::read_dir(sys_path)
+            .with_context(|| format!("Failed to read {}", sys_path.display()))?
+            .flatten()
+            .map(|entry| entry.file_name().to_string_lossy().into_owned())
+            .find(|name| name.starts_with("event"))
+            .ok_or_else(|| anyhow!("No event node under {}", sys_path.display()))?;
+
+        let path = Path::new("/dev/input").join(node);
+        let device = Device::open(&path)
+            .with_context(|| format!("Failed to open {} for readback", path.display()))?;
+        Ok(Self { device })
+    }
+
+    /// Wait for `code` to be pressed or released; returns when it was seen
+    pub fn wait_for(
+        &mut self,
+        code: KeyboardCode,
+        pressed: bool,
+        timeout: Duration,
+    ) -> Result<Option<Instant>> {
+        let key = keyboard_code_to_evdev_key(code);
+        let deadline = Instant::now() + timeout;
+
+        loop {
+            let remaining = deadline.saturating_duration_since(Instant::now());
+            if remaining.is_zero() {
+                return Ok(None);
+            }
+
+            let mut fds = [PollFd::new(self.device.as_fd(), PollFlags::POLLIN)];
+            let poll_timeout = PollTimeout::try_from(remaining).unwrap_or(PollTimeout::MAX);
+            if poll(&mut fds, poll_timeout)? == 0 {
+                return Ok(None);
+            }
+
+            for event in self.device.fetch_events()? {
+                if event.event_type() == EventType::KEY
+                    && event.code() == key.code()
+                    && (event.value() != 0) == pressed
+                {
+                    return Ok(Some(Instant::now()));
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,55 @@
+// Controller rumble through evdev force feedback
+//
+// Effects are uploaded to the controller's event node and played from there.
+// This opens the node a second time, so the reader keeps its own handle and
+// grab; the kernel plays effects from any open handle.
+
+use crate::output::feedback::Rumble;
+use anyhow::{Context, Result, bail};
+use evdev::{
+    Device, EventType, FFEffect, FFEffectCode, FFEffectData, FFEffectKind, FFReplay, FFTrigger,
+};
+use std::time::Duration;
+
+/// Concrete rumble motors of an evdev controller
+pub struct LinuxRumble {
+    device: Device,
+    // The effect playing or played last; it's removed when replaced
+    effect: Option<FFEffect>,
+}
+
+impl LinuxRumble {
+    /// Open the controller at `path`; fails if it can't rumble
+    pub fn open(path: &str) -> Result<Self> {
+        let device =
+            Device::open(path).with_context(|| format!("Failed to open device at {}", path))?;
+        let rumbles = device.supported_events().contains(EventType::FORCEFEEDBACK)
+            && device.supported_ff().is_some_and(|ff| ff.contains(FFEffectCode::FF_RUMBLE));
+        if !rumbles {
+            bail!("{} has no rumble motors", path);
+        }
+        Ok(Self { device, effect: None })
+    }
+}
+
+impl Rumble for LinuxRumble {
+    fn pulse(&mut self, strength: u8, duration: Duration) -> Result<()> {
+        let magnitude = (u16::MAX as u32 * strength.min(100) as u32 / 100) as u16;
+        let data = FFEffectData {
+            direction: 0,
+            trigger: FFTrigger::default(),
+            replay: FFReplay {
+                length: duration.as_millis().min(u16::MAX as u128) as u16,
+                delay: 0,
+            },
+            kind: FFEffectKind::Rumble { strong_magnitude: magnitude, weak_magnitude: magnitude },
+        };
+        // Controllers hold only a few effects; free the last one first
+        self.effect = None;
+        let mut effect =
+            self.device.upload_ff_effect(data).context("Failed to upload rumble effect")?;
+        effect.play(1).context("Failed to play rumble effect")?;
+        self.effect = Some(effect);
+        Ok(())
+    }
+}
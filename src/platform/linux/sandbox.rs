@@ -0,0 +1,260 @@
+// Sandbox detection and operation mode selection
+//
+// Inside Flatpak (or a similarly confined environment) /dev/input and
+// /dev/uinput are usually not exposed. Rather than failing with a bare
+// permission error, we figure out what is reachable and either run directly,
+// hand the command off to a BlazeRemap binary on the host via
+// `flatpak-spawn --host`, or report that nothing will work.
+
+use std::fs::{self, OpenOptions};
+use std::path::Path;
+use std::process::Command;
+
+/// Environment variable set on commands re-launched on the host, so the host
+/// side never tries to forward again
+pub const HOST_HELPER_ENV: &str = "BLAZEREMAP_HOST_HELPER";
+
+const FLATPAK_INFO_PATH: &str = "/.flatpak-info";
+const INPUT_DIR: &str = "/dev/input";
+const UINPUT_PATH: &str = "/dev/uinput";
+
+/// Kind of confinement the process is running under
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum SandboxKind {
+    None,
+    Flatpak { app_id: Option<String> },
+    Snap,
+    Container,
+}
+
+impl std::fmt::Display for SandboxKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            SandboxKind::None => write!(f, "none"),
+            SandboxKind::Flatpak { app_id: Some(id) } => write!(f, "Flatpak ({})", id),
+            SandboxKind::Flatpak { app_id: None } => write!(f, "Flatpak"),
+            SandboxKind::Snap => write!(f, "Snap"),
+            SandboxKind::Container => write!(f, "container"),
+        }
+    }
+}
+
+/// What the current process can reach under /dev
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct DeviceAccess {
+    /// At least one /dev/input/event* node can be opened for reading
+    pub input_readable: bool,
+    /// /dev/uinput can be opened for writing
+    pub uinput_writable: bool,
+}
+
+impl DeviceAccess {
+    pub fn is_complete(&self) -> bool {
+        self.input_readable && self.uinput_writable
+    }
+}
+
+/// How device-bound commands should be carried out
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum OperationMode {
+    /// Open devices from this process
+    Direct,
+    /// Re-run the command on the host through `flatpak-spawn --host`
+    HostHelper,
+    /// Devices are unreachable and there is no way around it
+    Unavailable,
+}
+
+/// Detect which sandbox (if any) the process runs in
+pub fn detect_sandbox() -> SandboxKind {
+    if Path::new(FLATPAK_INFO_PATH).exists() || std::env::var_os("FLATPAK_ID").is_some() {
+        return SandboxKind::Flatpak { app_id: std::env::var("FLATPAK_ID").ok() };
+    }
+    if std::env::var_os("SNAP").is_some() {
+        return SandboxKind::Snap;
+    }
+    if std::env::var_os("container").is_some() || Path::new("/run/.containerenv").exists() {
+        return SandboxKind::Container;
+    }
+    SandboxKind::None
+}
+
+/// Probe /dev/input and /dev/uinput without keeping anything open
+pub fn probe_device_access() -> DeviceAccess {
+    let input_readable = fs::read_dir(INPUT_DIR)
+        .map(|entries| {
+            entries.flatten().any(|entry| {
+                entry.file_name().to_string_lossy().starts_with("event")
+                    && OpenOptions::new().read(true).open(entry.path()).is_ok()
+            })
+        })
+        .unwrap_or(false);
+
+    let uinput_writable = OpenOptions::new().write(true).open(UINPUT_PATH).is_ok();
+
+    DeviceAccess { input_readable, uinput_writable }
+}
+
+/// Whether `flatpak-spawn --host` can be used from here
+pub fn host_helper_available(sandbox: &SandboxKind) -> bool {
+    if !matches!(sandbox, SandboxKind::Flatpak { .. }) {
+        return false;
+    }
+    Command::new("flatpak-spawn")
+        .arg("--help")
+        .output()
+        .map(|output| output.status.success())
+        .unwrap_or(false)
+}
+
+/// Pick an operation mode from the probed environment
+///
+/// Kept pure so the decision table can be tested without a sandbox.
+pub fn select_mode(
+    sandbox: &SandboxKind,
+    access: DeviceAccess,
+    helper_available: bool,
+    already_on_host: bool,
+) -> OperationMode {
+    if access.is_complete() || *sandbox == SandboxKind::None || already_on_host {
+        // Outside a sandbox missing access is a plain permission problem,
+        // which the normal error paths already explain.
+        return OperationMode::Direct;
+    }
+    if helper_available {
+        return OperationMode::HostHelper;
+    }
+    OperationMode::Unavailable
+}
+
+/// Probe the environment and pick an operation mode
+pub fn operation_mode() -> OperationMode {
+    let sandbox = detect_sandbox();
+    let access = probe_device_access();
+    let already_on_host = std::env::var_os(HOST_HELPER_ENV).is_some();
+    select_mode(&sandbox, access, host_helper_available(&sandbox), already_on_host)
+}
+
+/// Build the command that re-runs `args` with the host's `blazeremap`
+pub fn host_helper_command<I, S>(args: I) -> Command
+where
+    I: IntoIterator<Item = S>,
+    S: AsRef<std::ffi::OsStr>,
+{
+    let mut command = Command::new("flatpak-spawn");
+    command
+        .arg("--host")
+        .arg("--watch-bus")
+        .arg(format!("--env={}=1", HOST_HELPER_ENV))
+        .arg("blazeremap")
+        .args(args);
+    command
+}
+
+/// A desktop portal interface and the version it reports, if present
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PortalStatus {
+    pub interface: &'static str,
+    pub version: Option<u32>,
+}
+
+/// Portals relevant to input remapping
+///
+/// RemoteDesktop can inject keyboard events after the user consents;
+/// InputCapture can capture pointer/keyboard input but does not expose
+/// gamepads at all.
+pub const RELEVANT_PORTALS: [&str; 2] =
+    ["org.freedesktop.portal.RemoteDesktop", "org.freedesktop.portal.InputCapture"];
+
+/// Query the session bus for the relevant portals via `gdbus`
+pub fn probe_portals() -> Vec<PortalStatus> {
+    RELEVANT_PORTALS
+        .iter()
+        .map(|&interface| PortalStatus { interface, version: query_portal_version(interface) })
+        .collect()
+}
+
+fn query_portal_version(interface: &str) -> Option<u32> {
+    let output = Command::new("gdbus")
+        .args([
+            "call",
+            "--session",
+            "--dest",
+            "org.freedesktop.portal.Desktop",
+            "--object-path",
+            "/org/freedesktop/portal/desktop",
+            "--method",
+            "org.freedesktop.DBus.Properties.Get",
+            interface,
+            "version",
+        ])
+        .output()
+        .ok()?;
+
+    if !output.status.success() {
+        return None;
+    }
+    parse_gdbus_uint(&String::from_utf8_lossy(&output.stdout))
+}
+
+/// Parse gdbus' variant output, e.g. `(<uint32 2>,)`
+fn parse_gdbus_uint(text: &str) -> Option<u32> {
+    let start = text.find("uint32 ")? + "uint32 ".len();
+    let digits: String = text[start..].chars().take_while(|c| c.is_ascii_digit()).collect();
+    digits.parse().ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const NO_ACCESS: DeviceAccess = DeviceAccess { input_readable: false, uinput_writable: false };
+    const FULL_ACCESS: DeviceAccess = DeviceAccess { input_readable: true, uinput_writable: true };
+
+    fn flatpak() -> SandboxKind {
+        SandboxKind::Flatpak { app_id: Some("io.github.blazeremap".to_string()) }
+    }
+
+    #[test]
+    fn test_select_mode_direct_when_devices_reachable() {
+        assert_eq!(select_mode(&flatpak(), FULL_ACCESS, true, false), OperationMode::Direct);
+    }
+
+    #[test]
+    fn test_select_mode_direct_outside_sandbox() {
+        assert_eq!(select_mode(&SandboxKind::None, NO_ACCESS, false, false), OperationMode::Direct);
+    }
+
+    #[test]
+    fn test_select_mode_uses_host_helper_in_flatpak() {
+        assert_eq!(select_mode(&flatpak(), NO_ACCESS, true, false), OperationMode::HostHelper);
+    }
+
+    #[test]
+    fn test_select_mode_never_forwards_twice() {
+        assert_eq!(select_mode(&flatpak(), NO_ACCESS, true, true), OperationMode::Direct);
+    }
+
+    #[test]
+    fn test_select_mode_unavailable_without_helper() {
+        assert_eq!(
+            select_mode(&SandboxKind::Snap, NO_ACCESS, false, false),
+            OperationMode::Unavailable
+        );
+    }
+
+    #[test]
+    fn test_parse_gdbus_uint() {
+        assert_eq!(parse_gdbus_uint("(<uint32 2>,)\n"), Some(2));
+        assert_eq!(parse_gdbus_uint("(<'oops'>,)"), None);
+    }
+
+    #[test]
+    fn test_host_helper_command_marks_environment() {
+        let command = host_helper_command(["detect", "-v"]);
+        let args: Vec<_> = command.get_args().map(|a| a.to_string_lossy().into_owned()).collect();
+        assert_eq!(command.get_program(), "flatpak-spawn");
+        assert!(args.contains(&format!("--env={}=1", HOST_HELPER_ENV)));
+        assert_eq!(&args[args.len() - 3..], ["blazeremap", "detect", "-v"]);
+    }
+}
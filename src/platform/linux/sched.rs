@@ -0,0 +1,39 @@
+// Scheduling policy for latency-sensitive threads
+//
+// SCHED_FIFO needs CAP_SYS_NICE or a non-zero RLIMIT_RTPRIO; a negative nice
+// value needs CAP_SYS_NICE or RLIMIT_NICE. Both only affect the calling
+// thread, and SCHED_RESET_ON_FORK keeps anything we spawn at normal priority.
+
+use std::io;
+
+/// Real-time priority for the pipeline threads
+///
+/// Matches rtkit's default ceiling, well below kernel IRQ threads (50), so a
+/// misbehaving remapper can't starve the input drivers it depends on.
+pub const REALTIME_PRIORITY: i32 = 20;
+
+/// Nice value used when real-time scheduling is not permitted
+pub const ELEVATED_NICE: i32 = -10;
+
+/// Switch the calling thread to SCHED_FIFO at `priority`
+pub fn set_realtime(priority: i32) -> io::Result<()> {
+    let param = libc::sched_param { sched_priority: priority };
+    // SAFETY: plain syscall on the calling thread with a valid sched_param
+    let ret = unsafe {
+        libc::sched_setscheduler(0, libc::SCHED_FIFO | libc::SCHED_RESET_ON_FORK, &param)
+    };
+    if ret != 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+/// Set the nice value of the calling thread
+pub fn set_nice(nice: i32) -> io::Result<()> {
+    // SAFETY: gettid has no preconditions; setpriority on our own tid
+    let ret = unsafe { libc::setpriority(libc::PRIO_PROCESS, libc::gettid() as libc::id_t, nice) };
+    if ret != 0 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(())
+}
@@ -0,0 +1,42 @@
+// SIGINT/SIGTERM taken as a message instead of a kill
+//
+// Blocked signals stay pending until a thread waits for them. The mask is
+// per thread and inherited by threads spawned later, so blocking on the main
+// thread before anything else starts leaves `wait` the only way they arrive.
+
+use std::io;
+use std::mem::MaybeUninit;
+
+fn termination_set() -> libc::sigset_t {
+    let mut set = MaybeUninit::<libc::sigset_t>::uninit();
+    // SAFETY: sigemptyset initializes the set before sigaddset reads it
+    unsafe {
+        libc::sigemptyset(set.as_mut_ptr());
+        libc::sigaddset(set.as_mut_ptr(), libc::SIGINT);
+        libc::sigaddset(set.as_mut_ptr(), libc::SIGTERM);
+        set.assume_init()
+    }
+}
+
+/// Block SIGINT and SIGTERM on the calling thread and those it spawns
+pub fn block_termination() -> io::Result<()> {
+    let set = termination_set();
+    // SAFETY: valid set, old mask not wanted
+    let ret = unsafe { libc::pthread_sigmask(libc::SIG_BLOCK, &set, std::ptr::null_mut()) };
+    if ret != 0 {
+        return Err(io::Error::from_raw_os_error(ret));
+    }
+    Ok(())
+}
+
+/// Wait for a blocked SIGINT or SIGTERM and return which one came
+pub fn wait_termination() -> io::Result<i32> {
+    let set = termination_set();
+    let mut signal = 0;
+    // SAFETY: valid set and out pointer
+    let ret = unsafe { libc::sigwait(&set, &mut signal) };
+    if ret != 0 {
+        return Err(io::Error::from_raw_os_error(ret));
+    }
+    Ok(signal)
+}
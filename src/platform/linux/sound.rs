@@ -0,0 +1,48 @@
+// Desktop sounds through libcanberra
+//
+// `canberra-gtk-play` plays a sound by its id in the freedesktop sound theme,
+// through whatever sound server the session runs. Each sound is its own
+// short-lived process, so the mapper never waits on audio.
+
+use crate::output::feedback::Sound;
+use anyhow::{Context, Result, bail};
+use std::path::Path;
+use std::process::{Child, Command, Stdio};
+
+const PLAYER: &str = "canberra-gtk-play";
+
+/// Sounds played by `canberra-gtk-play`
+pub struct CanberraSound {
+    // The sound playing, if any; a new one isn't started over it
+    playing: Option<Child>,
+}
+
+impl CanberraSound {
+    /// Fails if `canberra-gtk-play` isn't installed
+    pub fn new() -> Result<Self> {
+        let path = std::env::var_os("PATH").unwrap_or_default();
+        if !std::env::split_paths(&path).any(|dir| Path::new(&dir).join(PLAYER).is_file()) {
+            bail!("{} not found; install libcanberra-gtk3 or similar", PLAYER);
+        }
+        Ok(Self { playing: None })
+    }
+}
+
+impl Sound for CanberraSound {
+    fn play(&mut self, id: &str) -> Result<()> {
+        if let Some(child) = &mut self.playing
+            && matches!(child.try_wait(), Ok(None))
+        {
+            return Ok(());
+        }
+        let child = Command::new(PLAYER)
+            .args(["--id", id])
+            .stdin(Stdio::null())
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .spawn()
+            .with_context(|| format!("Failed to run {}", PLAYER))?;
+        self.playing = Some(child);
+        Ok(())
+    }
+}
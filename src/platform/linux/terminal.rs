@@ -0,0 +1,42 @@
+// The terminal on stdin, unbuffered
+//
+// Reading keys as they're pressed, rather than lines once Enter is, takes
+// the terminal out of canonical mode; echo goes too, so they aren't shown.
+// The settings from before come back when the guard is dropped, and
+// whatever was typed and not read is thrown away.
+
+use std::io::IsTerminal;
+
+/// Stdin's terminal settings from before echo and line buffering were
+/// turned off
+pub struct Terminal {
+    saved: libc::termios,
+}
+
+impl Terminal {
+    /// Stop echoing and line buffering; None if stdin isn't a terminal
+    pub fn unbuffered() -> Option<Self> {
+        if !std::io::stdin().is_terminal() {
+            return None;
+        }
+        let mut saved = std::mem::MaybeUninit::<libc::termios>::uninit();
+        // SAFETY: tcgetattr fills `saved` when it succeeds
+        if unsafe { libc::tcgetattr(libc::STDIN_FILENO, saved.as_mut_ptr()) } != 0 {
+            return None;
+        }
+        let saved = unsafe { saved.assume_init() };
+        let mut unbuffered = saved;
+        unbuffered.c_lflag &= !(libc::ECHO | libc::ICANON);
+        unsafe { libc::tcsetattr(libc::STDIN_FILENO, libc::TCSANOW, &unbuffered) };
+        Some(Self { saved })
+    }
+}
+
+impl Drop for Terminal {
+    fn drop(&mut self) {
+        unsafe {
+            libc::tcflush(libc::STDIN_FILENO, libc::TCIFLUSH);
+            libc::tcsetattr(libc::STDIN_FILENO, libc::TCSANOW, &self.saved);
+        }
+    }
+}
@@ -0,0 +1,73 @@
+// CPU time of this process's threads, from /proc/self/task
+//
+// Each thread's stat file starts "tid (comm) state ..." and has its user
+// and system time, in clock ticks, as the 14th and 15th fields. The name
+// can hold spaces and parentheses, so fields are counted from the last ')'.
+
+use std::io;
+use std::time::Duration;
+
+use crate::platform::thread::ThreadTimes;
+
+pub fn cpu_times() -> io::Result<Vec<ThreadTimes>> {
+    // SAFETY: sysconf only reads a configuration value
+    let ticks = unsafe { libc::sysconf(libc::_SC_CLK_TCK) };
+    let ticks = if ticks > 0 { ticks as u64 } else { 100 };
+    let mut threads = Vec::new();
+    for entry in std::fs::read_dir("/proc/self/task")? {
+        let path = entry?.path().join("stat");
+        // A thread that ended since the listing has no stat left
+        let Ok(stat) = std::fs::read_to_string(&path) else {
+            continue;
+        };
+        match parse_stat(&stat, ticks) {
+            Some(times) => threads.push(times),
+            None => tracing::debug!("Unreadable {}", path.display()),
+        }
+    }
+    threads.sort_by_key(|thread| thread.tid);
+    Ok(threads)
+}
+
+fn parse_stat(stat: &str, ticks_per_sec: u64) -> Option<ThreadTimes> {
+    let (tid, rest) = stat.split_once(" (")?;
+    let (name, rest) = rest.rsplit_once(") ")?;
+    // Fields from the 3rd (state) on
+    let fields: Vec<&str> = rest.split_whitespace().collect();
+    let ticks = |field: usize| -> Option<Duration> {
+        let ticks: u64 = fields.get(field - 3)?.parse().ok()?;
+        Some(Duration::from_micros(ticks * 1_000_000 / ticks_per_sec))
+    };
+    Some(ThreadTimes {
+        tid: tid.parse().ok()?,
+        name: name.to_string(),
+        user: ticks(14)?,
+        system: ticks(15)?,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_stat() {
+        let stat = "4243 (blazeremap (r)) S 1 4242 4242 0 -1 4194624 120 0 0 0 250 30 0 0 \
+                    20 0 3 0 1000 0 0";
+        let times = parse_stat(stat, 100).unwrap();
+        assert_eq!((times.tid, times.name.as_str()), (4243, "blazeremap (r)"));
+        assert_eq!(
+            (times.user, times.system),
+            (Duration::from_millis(2500), Duration::from_millis(300))
+        );
+        assert!(parse_stat("4243 (cut", 100).is_none());
+    }
+
+    #[test]
+    fn test_lists_this_thread() {
+        let threads = cpu_times().unwrap();
+        // SAFETY: gettid has no preconditions
+        let tid = unsafe { libc::gettid() } as u32;
+        assert!(threads.iter().any(|thread| thread.tid == tid));
+    }
+}
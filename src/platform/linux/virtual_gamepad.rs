@@ -0,0 +1,195 @@
+// Virtual Gamepad Module
+
+use crate::{
+    event::{AxisCode, ButtonCode, InputEvent},
+    input::range::AxisRange,
+    output::gamepad::{VirtualGamepad, VirtualGamepadIdentity},
+    platform::linux::converter::{axis_code_to_evdev_axis, button_code_to_evdev_key},
+};
+use anyhow::{Context, Result, anyhow};
+use evdev::{
+    AbsInfo, AbsoluteAxisCode, AttributeSet, BusType, EventType, InputEvent as EvdevEvent, InputId,
+    KeyCode, UinputAbsSetup, uinput::VirtualDevice,
+};
+use std::path::PathBuf;
+
+/// Concrete virtual gamepad backed by /dev/uinput, laid out like xpad
+pub struct LinuxVirtualGamepad {
+    device: VirtualDevice,
+    keys: AttributeSet<KeyCode>,
+    // Trigger buttons become full pulls, as on a pad without them
+    analog_triggers: bool,
+    trigger_range: AxisRange,
+}
+
+impl LinuxVirtualGamepad {
+    /// Create a new virtual gamepad device
+    pub fn new(identity: &VirtualGamepadIdentity) -> Result<Self> {
+        let mut keys = AttributeSet::<KeyCode>::new();
+        for key in [
+            KeyCode::BTN_SOUTH,
+            KeyCode::BTN_EAST,
+            KeyCode::BTN_NORTH,
+            KeyCode::BTN_WEST,
+            KeyCode::BTN_TL,
+            KeyCode::BTN_TR,
+            KeyCode::BTN_SELECT,
+            KeyCode::BTN_START,
+            KeyCode::BTN_MODE,
+            KeyCode::BTN_THUMBL,
+            KeyCode::BTN_THUMBR,
+        ] {
+            keys.insert(key);
+        }
+        if !identity.analog_triggers {
+            keys.insert(KeyCode::BTN_TL2);
+            keys.insert(KeyCode::BTN_TR2);
+        }
+        if identity.paddles {
+            for key in [
+                KeyCode::BTN_TRIGGER_HAPPY1,
+                KeyCode::BTN_TRIGGER_HAPPY2,
+                KeyCode::BTN_TRIGGER_HAPPY3,
+                KeyCode::BTN_TRIGGER_HAPPY4,
+            ] {
+                keys.insert(key);
+            }
+        }
+
+        // The canonical ranges, so normalized events pass straight through
+        let range =
+            |range: AxisRange, fuzz, flat| AbsInfo::new(0, range.min, range.max, fuzz, flat, 0);
+        let stick = range(AxisRange::STICK, 16, 128);
+        let trigger = range(identity.trigger_range, 0, 0);
+        let hat = range(AxisRange::HAT, 0, 0);
+        let axes = [
+            (AbsoluteAxisCode::ABS_X, stick),
+            (AbsoluteAxisCode::ABS_Y, stick),
+            (AbsoluteAxisCode::ABS_RX, stick),
+            (AbsoluteAxisCode::ABS_RY, stick),
+            (AbsoluteAxisCode::ABS_Z, trigger),
+            (AbsoluteAxisCode::ABS_RZ, trigger),
+            (AbsoluteAxisCode::ABS_HAT0X, hat),
+            (AbsoluteAxisCode::ABS_HAT0Y, hat),
+        ];
+
+        let mut builder = VirtualDevice::builder()?
+            .name(&identity.name)
+            .input_id(InputId::new(
+                BusType::BUS_USB,
+                identity.vendor_id,
+                identity.product_id,
+                identity.version,
+            ))
+            .with_keys(&keys)?;
+        for (axis, info) in axes {
+            builder = builder.with_absolute_axis(&UinputAbsSetup::new(axis, info))?;
+        }
+        let device = builder.build().context("Failed to create virtual gamepad")?;
+
+        tracing::info!("Virtual gamepad created: {}", identity.name);
+
+        Ok(Self {
+            device,
+            keys,
+            analog_triggers: identity.analog_triggers,
+            trigger_range: identity.trigger_range,
+        })
+    }
+}
+
+impl VirtualGamepad for LinuxVirtualGamepad {
+    fn emit_frame(&mut self, events: &[InputEvent]) -> Result<()> {
+        let mut batch = Vec::with_capacity(events.len() + 1);
+        for event in events {
+            match translate(*event, self.analog_triggers, self.trigger_range) {
+                InputEvent::Button { code, pressed, .. } => {
+                    let key = button_code_to_evdev_key(code)
+                        .filter(|key| self.keys.contains(*key))
+                        .ok_or_else(|| anyhow!("This controller has no {} button", code))?;
+                    batch.push(EvdevEvent::new(EventType::KEY.0, key.code(), pressed as i32));
+                }
+                InputEvent::Axis { code, value, .. } => {
+                    let axis = axis_code_to_evdev_axis(code)
+                        .ok_or_else(|| anyhow!("This controller has no {} axis", code))?;
+                    batch.push(EvdevEvent::new(EventType::ABSOLUTE.0, axis.0, value));
+                }
+                InputEvent::Sync { .. } => {}
+            }
+        }
+        if batch.is_empty() {
+            return Ok(());
+        }
+
+        batch.push(EvdevEvent::new(EventType::SYNCHRONIZATION.0, 0, 0));
+        self.device.emit(&batch)?;
+        Ok(())
+    }
+
+    fn dev_node(&mut self) -> Result<PathBuf> {
+        // udev may take a moment to create the node; this waits for it
+        self.device
+            .enumerate_dev_nodes_blocking()?
+            .flatten()
+            .find(|path| {
+                path.file_name().is_some_and(|name| name.as_encoded_bytes().starts_with(b"event"))
+            })
+            .ok_or_else(|| anyhow!("Virtual gamepad has no event node"))
+    }
+}
+
+/// `event` as a controller with triggers in `trigger_range` reports it; with
+/// `analog_triggers`, trigger buttons pull their trigger all the way
+fn translate(event: InputEvent, analog_triggers: bool, trigger_range: AxisRange) -> InputEvent {
+    match event {
+        InputEvent::Button { code, pressed, timestamp } if analog_triggers => {
+            let code = match code {
+                ButtonCode::LeftTrigger => AxisCode::LeftTrigger,
+                ButtonCode::RightTrigger => AxisCode::RightTrigger,
+                _ => return event,
+            };
+            let value = if pressed { trigger_range.max } else { trigger_range.min };
+            InputEvent::Axis { code, value, timestamp }
+        }
+        InputEvent::Axis {
+            code: code @ (AxisCode::LeftTrigger | AxisCode::RightTrigger),
+            value,
+            timestamp,
+        } => InputEvent::Axis {
+            code,
+            value: AxisRange::TRIGGER.rescale(value, trigger_range),
+            timestamp,
+        },
+        event => event,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_xbox_360_triggers() {
+        let xbox360 = |event| translate(event, true, AxisRange::new(0, 255));
+        let value = |event| match event {
+            InputEvent::Axis { code: AxisCode::RightTrigger, value, .. } => value,
+            other => panic!("{:?} is not the right trigger", other),
+        };
+
+        assert_eq!(value(xbox360(InputEvent::axis_move(AxisCode::RightTrigger, 1023))), 255);
+        assert_eq!(value(xbox360(InputEvent::button_press(ButtonCode::RightTrigger))), 255);
+        assert_eq!(value(xbox360(InputEvent::button_release(ButtonCode::RightTrigger))), 0);
+        let south = xbox360(InputEvent::button_press(ButtonCode::South));
+        assert!(matches!(south, InputEvent::Button { code: ButtonCode::South, pressed: true, .. }));
+
+        // Other pads keep their trigger buttons and the canonical range
+        let pressed = translate(
+            InputEvent::button_press(ButtonCode::RightTrigger),
+            false,
+            AxisRange::TRIGGER,
+        );
+        assert!(matches!(pressed, InputEvent::Button { code: ButtonCode::RightTrigger, .. }));
+        let pulled = InputEvent::axis_move(AxisCode::RightTrigger, 700);
+        assert_eq!(value(translate(pulled, false, AxisRange::TRIGGER)), 700);
+    }
+}
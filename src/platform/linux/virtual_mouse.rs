@@ -0,0 +1,202 @@
+// Virtual Mouse Module
+//
+// A relative mouse moves the pointer by pixels, like any mouse. An absolute
+// one also has ABS_X/ABS_Y spanning the screen, for mappings that put the
+// pointer where a finger is on a touchpad; desktops scale the range onto
+// the screen as they do a tablet's.
+
+use crate::{
+    input::keymouse::MouseButton,
+    output::{
+        identity::VirtualDeviceIdentity,
+        mouse::{MouseEvent, ScreenSize, VirtualMouse},
+    },
+};
+use anyhow::{Context, Result, anyhow, bail};
+use evdev::{
+    AbsInfo, AbsoluteAxisCode, AttributeSet, BusType, EventType, InputEvent as EvdevEvent, InputId,
+    KeyCode, RelativeAxisCode, UinputAbsSetup, uinput::VirtualDevice,
+};
+use std::path::PathBuf;
+
+fn button_key(button: MouseButton) -> KeyCode {
+    match button {
+        MouseButton::Left => KeyCode::BTN_LEFT,
+        MouseButton::Right => KeyCode::BTN_RIGHT,
+        MouseButton::Middle => KeyCode::BTN_MIDDLE,
+        MouseButton::Side => KeyCode::BTN_SIDE,
+        MouseButton::Extra => KeyCode::BTN_EXTRA,
+    }
+}
+
+/// Concrete virtual mouse backed by /dev/uinput, with two wheels
+pub struct LinuxVirtualMouse {
+    device: VirtualDevice,
+    // The screen absolute positions span, for absolute mice
+    screen: Option<ScreenSize>,
+}
+
+impl LinuxVirtualMouse {
+    /// Create a new relative virtual mouse device
+    pub fn new(identity: &VirtualDeviceIdentity) -> Result<Self> {
+        Self::with_screen(identity, None)
+    }
+
+    /// Create a virtual mouse that also positions the pointer on `screen`
+    pub fn absolute(identity: &VirtualDeviceIdentity, screen: ScreenSize) -> Result<Self> {
+        Self::with_screen(identity, Some(screen))
+    }
+
+    fn with_screen(identity: &VirtualDeviceIdentity, screen: Option<ScreenSize>) -> Result<Self> {
+        let mut keys = AttributeSet::<KeyCode>::new();
+        for button in [
+            MouseButton::Left,
+            MouseButton::Right,
+            MouseButton::Middle,
+            MouseButton::Side,
+            MouseButton::Extra,
+        ] {
+            keys.insert(button_key(button));
+        }
+        let mut axes = AttributeSet::<RelativeAxisCode>::new();
+        for axis in [
+            RelativeAxisCode::REL_X,
+            RelativeAxisCode::REL_Y,
+            RelativeAxisCode::REL_WHEEL,
+            RelativeAxisCode::REL_HWHEEL,
+        ] {
+            axes.insert(axis);
+        }
+
+        let mut builder = VirtualDevice::builder()?
+            .name(&identity.name)
+            .input_id(InputId::new(
+                BusType::BUS_USB,
+                identity.vendor_id,
+                identity.product_id,
+                identity.version,
+            ))
+            .with_keys(&keys)?
+            .with_relative_axes(&axes)?;
+        if let Some(screen) = screen {
+            for (axis, size) in
+                [(AbsoluteAxisCode::ABS_X, screen.width), (AbsoluteAxisCode::ABS_Y, screen.height)]
+            {
+                let info = AbsInfo::new(0, 0, size as i32 - 1, 0, 0, 0);
+                builder = builder.with_absolute_axis(&UinputAbsSetup::new(axis, info))?;
+            }
+        }
+        let device = builder.build().context("Failed to create virtual mouse")?;
+
+        match screen {
+            Some(screen) => {
+                tracing::info!("Virtual mouse created: {} (absolute, {})", identity.name, screen)
+            }
+            None => tracing::info!("Virtual mouse created: {}", identity.name),
+        }
+
+        Ok(Self { device, screen })
+    }
+}
+
+/// The evdev events of one frame, ending in a sync; empty if nothing changed
+///
+/// `MoveTo` positions are kept on `screen`, and fail without one.
+fn frame_events(events: &[MouseEvent], screen: Option<ScreenSize>) -> Result<Vec<EvdevEvent>> {
+    let mut batch = Vec::with_capacity(events.len() * 2 + 1);
+    let relative = |axis: RelativeAxisCode, value| {
+        (value != 0).then(|| EvdevEvent::new(EventType::RELATIVE.0, axis.0, value))
+    };
+    for event in events {
+        match *event {
+            MouseEvent::Move { dx, dy } => {
+                batch.extend(relative(RelativeAxisCode::REL_X, dx));
+                batch.extend(relative(RelativeAxisCode::REL_Y, dy));
+            }
+            MouseEvent::MoveTo { x, y } => {
+                let Some(screen) = screen else {
+                    bail!("Virtual mouse is relative; it can't move the pointer to a position");
+                };
+                let (x, y) = screen.clamp(x, y);
+                let absolute = |axis: AbsoluteAxisCode, value| {
+                    EvdevEvent::new(EventType::ABSOLUTE.0, axis.0, value)
+                };
+                batch.push(absolute(AbsoluteAxisCode::ABS_X, x));
+                batch.push(absolute(AbsoluteAxisCode::ABS_Y, y));
+            }
+            MouseEvent::Scroll { vertical, horizontal } => {
+                batch.extend(relative(RelativeAxisCode::REL_WHEEL, vertical));
+                batch.extend(relative(RelativeAxisCode::REL_HWHEEL, horizontal));
+            }
+            MouseEvent::Button { button, pressed } => batch.push(EvdevEvent::new(
+                EventType::KEY.0,
+                button_key(button).code(),
+                pressed as i32,
+            )),
+        }
+    }
+    if !batch.is_empty() {
+        batch.push(EvdevEvent::new(EventType::SYNCHRONIZATION.0, 0, 0));
+    }
+    Ok(batch)
+}
+
+impl VirtualMouse for LinuxVirtualMouse {
+    fn emit_frame(&mut self, events: &[MouseEvent]) -> Result<()> {
+        let batch = frame_events(events, self.screen)?;
+        if batch.is_empty() {
+            return Ok(());
+        }
+        self.device.emit(&batch)?;
+        Ok(())
+    }
+
+    fn dev_node(&mut self) -> Result<PathBuf> {
+        // udev may take a moment to create the node; this waits for it
+        self.device
+            .enumerate_dev_nodes_blocking()?
+            .flatten()
+            .find(|path| {
+                path.file_name().is_some_and(|name| name.as_encoded_bytes().starts_with(b"event"))
+            })
+            .ok_or_else(|| anyhow!("Virtual mouse has no event node"))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn codes(batch: &[EvdevEvent]) -> Vec<(u16, u16, i32)> {
+        batch.iter().map(|event| (event.event_type().0, event.code(), event.value())).collect()
+    }
+
+    #[test]
+    fn test_frame_events() {
+        let screen = ScreenSize { width: 1920, height: 1080 };
+        let frame = [
+            MouseEvent::Move { dx: 4, dy: 0 },
+            MouseEvent::MoveTo { x: 2000, y: 540 },
+            MouseEvent::Button { button: MouseButton::Left, pressed: true },
+        ];
+        let (rel, abs, key, syn) = (
+            EventType::RELATIVE.0,
+            EventType::ABSOLUTE.0,
+            EventType::KEY.0,
+            EventType::SYNCHRONIZATION.0,
+        );
+        assert_eq!(
+            codes(&frame_events(&frame, Some(screen)).unwrap()),
+            [
+                (rel, RelativeAxisCode::REL_X.0, 4),
+                (abs, AbsoluteAxisCode::ABS_X.0, 1919),
+                (abs, AbsoluteAxisCode::ABS_Y.0, 540),
+                (key, KeyCode::BTN_LEFT.code(), 1),
+                (syn, 0, 0),
+            ]
+        );
+
+        assert!(frame_events(&frame, None).is_err());
+        assert!(frame_events(&[MouseEvent::Move { dx: 0, dy: 0 }], None).unwrap().is_empty());
+    }
+}
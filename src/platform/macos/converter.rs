@@ -0,0 +1,210 @@
+/*
+Conversion utilities for translating domain key codes to HID usages.
+
+ macOS works in terms of USB HID usages rather than scan codes. Keyboard keys
+ live on the Keyboard/Keypad usage page (0x07); media keys on the Consumer
+ page (0x0C). A virtual HID keyboard (DriverKit) will report these usages.
+
+ # Note
+ Keys with no HID equivalent return `None`.
+*/
+
+use crate::event::KeyboardCode;
+
+pub const HID_PAGE_KEYBOARD: u16 = 0x07;
+pub const HID_PAGE_CONSUMER: u16 = 0x0C;
+
+/// A HID usage page plus usage ID
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct HidUsage {
+    pub page: u16,
+    pub usage: u16,
+}
+
+const fn key(usage: u16) -> Option<HidUsage> {
+    Some(HidUsage { page: HID_PAGE_KEYBOARD, usage })
+}
+
+const fn consumer(usage: u16) -> Option<HidUsage> {
+    Some(HidUsage { page: HID_PAGE_CONSUMER, usage })
+}
+
+pub fn keyboard_code_to_hid_usage(code: KeyboardCode) -> Option<HidUsage> {
+    match code {
+        KeyboardCode::A => key(0x04),
+        KeyboardCode::B => key(0x05),
+        KeyboardCode::C => key(0x06),
+        KeyboardCode::D => key(0x07),
+        KeyboardCode::E => key(0x08),
+        KeyboardCode::F => key(0x09),
+        KeyboardCode::G => key(0x0A),
+        KeyboardCode::H => key(0x0B),
+        KeyboardCode::I => key(0x0C),
+        KeyboardCode::J => key(0x0D),
+        KeyboardCode::K => key(0x0E),
+        KeyboardCode::L => key(0x0F),
+        KeyboardCode::M => key(0x10),
+        KeyboardCode::N => key(0x11),
+        KeyboardCode::O => key(0x12),
+        KeyboardCode::P => key(0x13),
+        KeyboardCode::Q => key(0x14),
+        KeyboardCode::R => key(0x15),
+        KeyboardCode::S => key(0x16),
+        KeyboardCode::T => key(0x17),
+        KeyboardCode::U => key(0x18),
+        KeyboardCode::V => key(0x19),
+        KeyboardCode::W => key(0x1A),
+        KeyboardCode::X => key(0x1B),
+        KeyboardCode::Y => key(0x1C),
+        KeyboardCode::Z => key(0x1D),
+        KeyboardCode::Num1 => key(0x1E),
+        KeyboardCode::Num2 => key(0x1F),
+        KeyboardCode::Num3 => key(0x20),
+        KeyboardCode::Num4 => key(0x21),
+        KeyboardCode::Num5 => key(0x22),
+        KeyboardCode::Num6 => key(0x23),
+        KeyboardCode::Num7 => key(0x24),
+        KeyboardCode::Num8 => key(0x25),
+        KeyboardCode::Num9 => key(0x26),
+        KeyboardCode::Num0 => key(0x27),
+        KeyboardCode::Enter => key(0x28),
+        KeyboardCode::Escape => key(0x29),
+        KeyboardCode::Backspace => key(0x2A),
+        KeyboardCode::Tab => key(0x2B),
+        KeyboardCode::Space => key(0x2C),
+        KeyboardCode::Minus => key(0x2D),
+        KeyboardCode::Equal => key(0x2E),
+        KeyboardCode::LeftBrace => key(0x2F),
+        KeyboardCode::RightBrace => key(0x30),
+        KeyboardCode::Backslash => key(0x31),
+        KeyboardCode::Semicolon => key(0x33),
+        KeyboardCode::Apostrophe => key(0x34),
+        KeyboardCode::Grave => key(0x35),
+        KeyboardCode::Comma => key(0x36),
+        KeyboardCode::Dot => key(0x37),
+        KeyboardCode::Slash => key(0x38),
+        KeyboardCode::CapsLock => key(0x39),
+        KeyboardCode::F1 => key(0x3A),
+        KeyboardCode::F2 => key(0x3B),
+        KeyboardCode::F3 => key(0x3C),
+        KeyboardCode::F4 => key(0x3D),
+        KeyboardCode::F5 => key(0x3E),
+        KeyboardCode::F6 => key(0x3F),
+        KeyboardCode::F7 => key(0x40),
+        KeyboardCode::F8 => key(0x41),
+        KeyboardCode::F9 => key(0x42),
+        KeyboardCode::F10 => key(0x43),
+        KeyboardCode::F11 => key(0x44),
+        KeyboardCode::F12 => key(0x45),
+        KeyboardCode::SysRq => key(0x46),
+        KeyboardCode::ScrollLock => key(0x47),
+        KeyboardCode::Pause => key(0x48),
+        KeyboardCode::Insert => key(0x49),
+        KeyboardCode::Home => key(0x4A),
+        KeyboardCode::PageUp => key(0x4B),
+        KeyboardCode::Delete => key(0x4C),
+        KeyboardCode::End => key(0x4D),
+        KeyboardCode::PageDown => key(0x4E),
+        KeyboardCode::Right => key(0x4F),
+        KeyboardCode::Left => key(0x50),
+        KeyboardCode::Down => key(0x51),
+        KeyboardCode::Up => key(0x52),
+        KeyboardCode::NumLock => key(0x53),
+        KeyboardCode::KpSlash => key(0x54),
+        KeyboardCode::KpAsterisk => key(0x55),
+        KeyboardCode::KpMinus => key(0x56),
+        KeyboardCode::KpPlus => key(0x57),
+        KeyboardCode::KpEnter => key(0x58),
+        KeyboardCode::Kp1 => key(0x59),
+        KeyboardCode::Kp2 => key(0x5A),
+        KeyboardCode::Kp3 => key(0x5B),
+        KeyboardCode::Kp4 => key(0x5C),
+        KeyboardCode::Kp5 => key(0x5D),
+        KeyboardCode::Kp6 => key(0x5E),
+        KeyboardCode::Kp7 => key(0x5F),
+        KeyboardCode::Kp8 => key(0x60),
+        KeyboardCode::Kp9 => key(0x61),
+        KeyboardCode::Kp0 => key(0x62),
+        KeyboardCode::KpDot => key(0x63),
+        KeyboardCode::Iso => key(0x64),
+        KeyboardCode::Compose => key(0x65),
+        KeyboardCode::Power => key(0x66),
+        KeyboardCode::KpEqual => key(0x67),
+        KeyboardCode::F13 => key(0x68),
+        KeyboardCode::F14 => key(0x69),
+        KeyboardCode::F15 => key(0x6A),
+        KeyboardCode::F16 => key(0x6B),
+        KeyboardCode::F17 => key(0x6C),
+        KeyboardCode::F18 => key(0x6D),
+        KeyboardCode::F19 => key(0x6E),
+        KeyboardCode::F20 => key(0x6F),
+        KeyboardCode::F21 => key(0x70),
+        KeyboardCode::F22 => key(0x71),
+        KeyboardCode::F23 => key(0x72),
+        KeyboardCode::F24 => key(0x73),
+        KeyboardCode::Open => key(0x74),
+        KeyboardCode::Help => key(0x75),
+        KeyboardCode::Menu => key(0x76),
+        KeyboardCode::Front => key(0x77),
+        KeyboardCode::Stop => key(0x78),
+        KeyboardCode::Again => key(0x79),
+        KeyboardCode::Undo => key(0x7A),
+        KeyboardCode::Cut => key(0x7B),
+        KeyboardCode::Copy => key(0x7C),
+        KeyboardCode::Paste => key(0x7D),
+        KeyboardCode::Find => key(0x7E),
+        KeyboardCode::Mute => key(0x7F),
+        KeyboardCode::VolumeUp => key(0x80),
+        KeyboardCode::VolumeDown => key(0x81),
+        KeyboardCode::KpComma => key(0x85),
+        KeyboardCode::LeftControl => key(0xE0),
+        KeyboardCode::LeftShift => key(0xE1),
+        KeyboardCode::LeftAlt => key(0xE2),
+        KeyboardCode::LeftMeta => key(0xE3),
+        KeyboardCode::RightControl => key(0xE4),
+        KeyboardCode::RightShift => key(0xE5),
+        KeyboardCode::RightAlt => key(0xE6),
+        KeyboardCode::RightMeta => key(0xE7),
+        // Consumer page
+        KeyboardCode::PlayPause => consumer(0xCD),
+        KeyboardCode::NextSong => consumer(0xB5),
+        KeyboardCode::PreviousSong => consumer(0xB6),
+        KeyboardCode::StopCd => consumer(0xB7),
+        KeyboardCode::EjectCd => consumer(0xB8),
+        KeyboardCode::BrightnessUp => consumer(0x6F),
+        KeyboardCode::BrightnessDown => consumer(0x70),
+        KeyboardCode::Calc => consumer(0x192),
+        KeyboardCode::Mail => consumer(0x18A),
+        KeyboardCode::HomePage => consumer(0x223),
+        KeyboardCode::Search => consumer(0x221),
+        KeyboardCode::Back => consumer(0x224),
+        KeyboardCode::Forward => consumer(0x225),
+        KeyboardCode::Refresh => consumer(0x227),
+        KeyboardCode::Bookmarks => consumer(0x22A),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashSet;
+
+    #[test]
+    fn test_letters_and_modifiers() {
+        assert_eq!(keyboard_code_to_hid_usage(KeyboardCode::A), key(0x04));
+        assert_eq!(keyboard_code_to_hid_usage(KeyboardCode::LeftShift), key(0xE1));
+        assert_eq!(keyboard_code_to_hid_usage(KeyboardCode::PlayPause), consumer(0xCD));
+        assert_eq!(keyboard_code_to_hid_usage(KeyboardCode::Unknown), None);
+    }
+
+    #[test]
+    fn test_usages_are_unique() {
+        let mut seen = HashSet::new();
+        for code in KeyboardCode::ALL {
+            if let Some(usage) = keyboard_code_to_hid_usage(code) {
+                assert!(seen.insert((usage.page, usage.usage)), "duplicate usage for {:?}", code);
+            }
+        }
+    }
+}
@@ -0,0 +1,11 @@
+// macOS-specific errors
+use thiserror::Error;
+
+#[derive(Debug, Error)]
+pub enum MacError {
+    #[error("failed to create IOHIDManager")]
+    HidManagerUnavailable,
+
+    #[error("reading gamepad input is not supported on macOS yet")]
+    InputNotSupported,
+}
@@ -0,0 +1,67 @@
+// Minimal CoreFoundation / IOKit HID bindings
+//
+// Only what device enumeration needs. Every `Create`/`Copy` result is owned
+// by the caller and must be released with `CFRelease`; `Get` results are
+// borrowed from their container.
+
+use std::ffi::{c_char, c_void};
+
+pub type CFTypeRef = *const c_void;
+pub type CFAllocatorRef = *const c_void;
+pub type CFStringRef = *const c_void;
+pub type CFNumberRef = *const c_void;
+pub type CFSetRef = *const c_void;
+pub type CFDictionaryRef = *const c_void;
+pub type CFTypeID = usize;
+pub type CFIndex = isize;
+pub type IOHIDManagerRef = *mut c_void;
+pub type IOHIDDeviceRef = *mut c_void;
+pub type IOOptionBits = u32;
+
+pub const K_CF_NUMBER_SINT32_TYPE: CFIndex = 3;
+pub const K_CF_STRING_ENCODING_UTF8: u32 = 0x0800_0100;
+pub const K_IOHID_OPTIONS_TYPE_NONE: IOOptionBits = 0;
+
+// HID usage tables (Generic Desktop page)
+pub const K_HID_PAGE_GENERIC_DESKTOP: i32 = 0x01;
+pub const K_HID_USAGE_GD_JOYSTICK: i32 = 0x04;
+pub const K_HID_USAGE_GD_GAMEPAD: i32 = 0x05;
+pub const K_HID_USAGE_GD_MULTI_AXIS_CONTROLLER: i32 = 0x08;
+
+// IOHIDKeys.h property names
+pub const K_IOHID_PRODUCT_KEY: &str = "Product";
+pub const K_IOHID_VENDOR_ID_KEY: &str = "VendorID";
+pub const K_IOHID_PRODUCT_ID_KEY: &str = "ProductID";
+pub const K_IOHID_LOCATION_ID_KEY: &str = "LocationID";
+pub const K_IOHID_PRIMARY_USAGE_PAGE_KEY: &str = "PrimaryUsagePage";
+pub const K_IOHID_PRIMARY_USAGE_KEY: &str = "PrimaryUsage";
+
+#[link(name = "CoreFoundation", kind = "framework")]
+unsafe extern "C" {
+    pub fn CFRelease(cf: CFTypeRef);
+    pub fn CFGetTypeID(cf: CFTypeRef) -> CFTypeID;
+    pub fn CFNumberGetTypeID() -> CFTypeID;
+    pub fn CFNumberGetValue(number: CFNumberRef, the_type: CFIndex, value_ptr: *mut c_void) -> u8;
+    pub fn CFStringGetTypeID() -> CFTypeID;
+    pub fn CFStringCreateWithCString(
+        alloc: CFAllocatorRef,
+        c_str: *const c_char,
+        encoding: u32,
+    ) -> CFStringRef;
+    pub fn CFStringGetCString(
+        the_string: CFStringRef,
+        buffer: *mut c_char,
+        buffer_size: CFIndex,
+        encoding: u32,
+    ) -> u8;
+    pub fn CFSetGetCount(the_set: CFSetRef) -> CFIndex;
+    pub fn CFSetGetValues(the_set: CFSetRef, values: *mut *const c_void);
+}
+
+#[link(name = "IOKit", kind = "framework")]
+unsafe extern "C" {
+    pub fn IOHIDManagerCreate(allocator: CFAllocatorRef, options: IOOptionBits) -> IOHIDManagerRef;
+    pub fn IOHIDManagerSetDeviceMatching(manager: IOHIDManagerRef, matching: CFDictionaryRef);
+    pub fn IOHIDManagerCopyDevices(manager: IOHIDManagerRef) -> CFSetRef;
+    pub fn IOHIDDeviceGetProperty(device: IOHIDDeviceRef, key: CFStringRef) -> CFTypeRef;
+}
@@ -0,0 +1,251 @@
+// macOS device manager implementation
+//
+// Enumeration only: controllers are discovered and described through
+// IOHIDManager, but reading events (and remapping them through a virtual HID
+// driver) is not implemented yet, so `open_gamepad` always fails.
+
+use super::errors::MacError;
+use super::ffi::*;
+use crate::input::{
+    InputDetectionResult, InputManager,
+    gamepad::{Gamepad, GamepadInfo, get_known_vendor_database, identify_gamepad},
+};
+use std::ffi::{CStr, CString, c_char, c_void};
+use std::ptr;
+
+pub struct MacInputManager {
+    // Fields can be added later if needed
+}
+
+impl MacInputManager {
+    pub fn new() -> Self {
+        Self {}
+    }
+}
+
+impl Default for MacInputManager {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl InputManager for MacInputManager {
+    fn list_gamepads(&self) -> anyhow::Result<InputDetectionResult> {
+        let devices = HidDeviceSet::all()?;
+
+        println!("Found {} input devices total", devices.len());
+
+        let mut result = InputDetectionResult { gamepad_info: Vec::new(), errors: Vec::new() };
+
+        for device in devices.iter() {
+            if is_gamepad(device) {
+                let info = extract_gamepad_info(device);
+                println!(
+                    "✓ Detected: {} ({}) - {:?}",
+                    info.name, info.gamepad_type, info.capabilities
+                );
+                result.gamepad_info.push(info);
+            }
+        }
+
+        tracing::info!(
+            "Found {} gamepads ({} errors)",
+            result.gamepad_info.len(),
+            result.errors.len()
+        );
+
+        Ok(result)
+    }
+
+    fn open_gamepad(&self, _path: &str) -> anyhow::Result<Box<dyn Gamepad>> {
+        Err(MacError::InputNotSupported.into())
+    }
+}
+
+/// Snapshot of every HID device currently known to IOKit
+///
+/// Owns both the manager and the copied device set; device refs handed out by
+/// `iter` are only valid while this value is alive.
+struct HidDeviceSet {
+    manager: IOHIDManagerRef,
+    devices: Vec<IOHIDDeviceRef>,
+    set: CFSetRef,
+}
+
+impl HidDeviceSet {
+    fn all() -> anyhow::Result<Self> {
+        // SAFETY: plain CoreFoundation/IOKit calls; ownership of `manager` and
+        // `set` is tracked by Self and released in Drop.
+        unsafe {
+            let manager = IOHIDManagerCreate(ptr::null(), K_IOHID_OPTIONS_TYPE_NONE);
+            if manager.is_null() {
+                return Err(MacError::HidManagerUnavailable.into());
+            }
+
+            // NULL matching dictionary = every HID device; filtering by usage is
+            // done afterwards so "Found N input devices" matches Linux output.
+            IOHIDManagerSetDeviceMatching(manager, ptr::null());
+
+            let set = IOHIDManagerCopyDevices(manager);
+            let mut devices = Vec::new();
+            if !set.is_null() {
+                let count = CFSetGetCount(set).max(0) as usize;
+                let mut values: Vec<*const c_void> = vec![ptr::null(); count];
+                CFSetGetValues(set, values.as_mut_ptr());
+                devices = values.into_iter().map(|v| v as IOHIDDeviceRef).collect();
+            }
+
+            Ok(Self { manager, devices, set })
+        }
+    }
+
+    fn len(&self) -> usize {
+        self.devices.len()
+    }
+
+    fn iter(&self) -> impl Iterator<Item = IOHIDDeviceRef> + '_ {
+        self.devices.iter().copied()
+    }
+}
+
+impl Drop for HidDeviceSet {
+    fn drop(&mut self) {
+        // SAFETY: both refs were obtained from Create/Copy calls in `all`
+        unsafe {
+            if !self.set.is_null() {
+                CFRelease(self.set);
+            }
+            CFRelease(self.manager as CFTypeRef);
+        }
+    }
+}
+
+/// Check if a HID device is a gamepad based on its primary usage
+fn is_gamepad(device: IOHIDDeviceRef) -> bool {
+    let usage_page = number_property(device, K_IOHID_PRIMARY_USAGE_PAGE_KEY);
+    let usage = number_property(device, K_IOHID_PRIMARY_USAGE_KEY);
+
+    matches!(
+        (usage_page, usage),
+        (
+            Some(K_HID_PAGE_GENERIC_DESKTOP),
+            Some(
+                K_HID_USAGE_GD_JOYSTICK
+                    | K_HID_USAGE_GD_GAMEPAD
+                    | K_HID_USAGE_GD_MULTI_AXIS_CONTROLLER
+            )
+        )
+    )
+}
+
+fn extract_gamepad_info(device: IOHIDDeviceRef) -> GamepadInfo {
+    let name = string_property(device, K_IOHID_PRODUCT_KEY).unwrap_or_else(|| "Unknown".into());
+    let vendor_id = number_property(device, K_IOHID_VENDOR_ID_KEY).unwrap_or(0) as u16;
+    let product_id = number_property(device, K_IOHID_PRODUCT_ID_KEY).unwrap_or(0) as u16;
+    let location_id = number_property(device, K_IOHID_LOCATION_ID_KEY).unwrap_or(0) as u32;
+
+    let vendor_db = get_known_vendor_database();
+    let vendor_name = vendor_db
+        .get(&vendor_id)
+        .map(|&name| name.to_string())
+        .unwrap_or_else(|| format!("Unknown (0x{:04X})", vendor_id));
+
+    GamepadInfo {
+        // No device node on macOS; the location ID is stable for a given port
+        path: format_location_path(location_id),
+        name,
+        gamepad_type: identify_gamepad(vendor_id, product_id),
+        vendor_id,
+        vendor_name,
+        product_id,
+        uniq: None,
+        phys: None,
+        // Force feedback and paddle detection need the device to be opened
+        capabilities: Vec::new(),
+    }
+}
+
+fn format_location_path(location_id: u32) -> String {
+    format!("iohid:0x{:08x}", location_id)
+}
+
+/// Look up a device property, returning a borrowed CFTypeRef (or null)
+fn property(device: IOHIDDeviceRef, key: &str) -> CFTypeRef {
+    let Ok(c_key) = CString::new(key) else {
+        return ptr::null();
+    };
+
+    // SAFETY: the CFString is created, used and released within this scope;
+    // the returned property follows the Get rule and is not released.
+    unsafe {
+        let cf_key =
+            CFStringCreateWithCString(ptr::null(), c_key.as_ptr(), K_CF_STRING_ENCODING_UTF8);
+        if cf_key.is_null() {
+            return ptr::null();
+        }
+        let value = IOHIDDeviceGetProperty(device, cf_key);
+        CFRelease(cf_key);
+        value
+    }
+}
+
+fn number_property(device: IOHIDDeviceRef, key: &str) -> Option<i32> {
+    let value = property(device, key);
+    if value.is_null() {
+        return None;
+    }
+
+    // SAFETY: type is checked before CFNumberGetValue writes into `out`
+    unsafe {
+        if CFGetTypeID(value) != CFNumberGetTypeID() {
+            return None;
+        }
+        let mut out: i32 = 0;
+        let ok =
+            CFNumberGetValue(value, K_CF_NUMBER_SINT32_TYPE, &mut out as *mut i32 as *mut c_void);
+        (ok != 0).then_some(out)
+    }
+}
+
+fn string_property(device: IOHIDDeviceRef, key: &str) -> Option<String> {
+    let value = property(device, key);
+    if value.is_null() {
+        return None;
+    }
+
+    // SAFETY: type is checked first; CFStringGetCString NUL-terminates on success
+    unsafe {
+        if CFGetTypeID(value) != CFStringGetTypeID() {
+            return None;
+        }
+        let mut buf = [0 as c_char; 256];
+        if CFStringGetCString(
+            value,
+            buf.as_mut_ptr(),
+            buf.len() as CFIndex,
+            K_CF_STRING_ENCODING_UTF8,
+        ) == 0
+        {
+            return None;
+        }
+        Some(CStr::from_ptr(buf.as_ptr()).to_string_lossy().into_owned())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_format_location_path() {
+        assert_eq!(format_location_path(0x14200000), "iohid:0x14200000");
+        assert_eq!(format_location_path(0), "iohid:0x00000000");
+    }
+
+    #[test]
+    fn test_open_gamepad_not_supported() {
+        let manager = MacInputManager::new();
+        let err = manager.open_gamepad("iohid:0x14200000").err().unwrap();
+        assert!(matches!(err.downcast_ref::<MacError>(), Some(MacError::InputNotSupported)));
+    }
+}
@@ -0,0 +1,14 @@
+// macOS platform adapters
+//
+// Detection only: controllers can be enumerated and inspected through
+// IOHIDManager. Reading and remapping input will need a virtual HID driver
+// (DriverKit) and is left for later.
+
+mod converter;
+mod errors;
+mod ffi;
+mod input_manager;
+
+pub use converter::{HidUsage, keyboard_code_to_hid_usage};
+pub use errors::MacError;
+pub use input_manager::MacInputManager;
@@ -1,17 +1,328 @@
 // Platform abstraction module
+//
+// Factories return `PlatformError::Unsupported` instead of failing to build
+// when an OS has no adapter, so commands that don't touch devices keep working.
 
+mod errors;
+pub mod interrupt;
+pub mod privilege;
+pub mod thread;
+
+#[cfg(target_os = "linux")]
 pub mod linux;
+#[cfg(target_os = "macos")]
+pub mod macos;
+#[cfg(target_os = "windows")]
+pub mod windows;
+
+pub use errors::PlatformError;
+#[cfg(target_os = "linux")]
+pub use linux::DeviceClaim;
+#[cfg(target_os = "linux")]
+pub use linux::Terminal;
 
-use crate::input::InputManager;
+use crate::input::calibration::{Calibration, DeviceRange};
+use crate::input::keyboard::KeyListener;
+use crate::input::manager::ProbeOptions;
+use crate::input::{GamepadInfo, InputManager};
+use crate::mapping::context::MappingContext;
+use crate::output::devices::AnyDevice;
+use crate::output::feedback::{Rumble, Sound};
+use crate::output::gamepad::{VirtualGamepad, VirtualGamepadIdentity};
+use crate::output::identity::{CustomDevice, DeviceKind, VirtualDeviceIdentity};
 use crate::output::keyboard::VirtualKeyboard;
+use crate::output::mouse::{ScreenSize, VirtualMouse};
+use crate::output::notify::Notifier;
+use crate::output::players::PlayerLight;
+use crate::trace::{Trace, evemu::EvemuRecording};
 
 /// Create a device manager for the current platform
-/// For now, we only support Linux
-pub fn new_input_manager() -> Box<dyn InputManager> {
-    Box::new(linux::LinuxInputManager::new())
+pub fn new_input_manager() -> anyhow::Result<Box<dyn InputManager>> {
+    new_probing_input_manager(ProbeOptions::default())
+}
+
+/// Create a device manager trying each device node while detecting as
+/// `probe` says, where the platform opens them one by one
+pub fn new_probing_input_manager(probe: ProbeOptions) -> anyhow::Result<Box<dyn InputManager>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(
+        linux::LinuxInputManager::probing(probe)
+            .with_policy(crate::input::policy::DevicePolicy::load()?),
+    ));
+
+    // Enumeration only; opening a gamepad still fails
+    #[cfg(target_os = "macos")]
+    {
+        let _ = probe;
+        return Ok(Box::new(macos::MacInputManager::new()));
+    }
+
+    #[cfg(not(any(target_os = "linux", target_os = "macos")))]
+    {
+        let _ = probe;
+        Err(PlatformError::unsupported("gamepad input").into())
+    }
 }
 
 /// Create a virtual keyboard for the current platform
-pub fn new_virtual_keyboard(name: &str) -> anyhow::Result<Box<dyn VirtualKeyboard>> {
-    Ok(Box::new(linux::LinuxVirtualKeyboard::new(name)?))
+pub fn new_virtual_keyboard(
+    identity: &VirtualDeviceIdentity,
+) -> anyhow::Result<Box<dyn VirtualKeyboard>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::LinuxVirtualKeyboard::new(identity)?));
+
+    #[cfg(target_os = "windows")]
+    return Ok(Box::new(windows::WindowsVirtualKeyboard::new(identity)?));
+
+    #[cfg(not(any(target_os = "linux", target_os = "windows")))]
+    {
+        let _ = identity;
+        Err(PlatformError::unsupported("virtual keyboard output").into())
+    }
+}
+
+/// Create a virtual gamepad for the current platform
+pub fn new_virtual_gamepad(
+    identity: &VirtualGamepadIdentity,
+) -> anyhow::Result<Box<dyn VirtualGamepad>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::LinuxVirtualGamepad::new(identity)?));
+
+    #[cfg(target_os = "windows")]
+    return Ok(Box::new(windows::WindowsVirtualGamepad::new(identity)?));
+
+    #[cfg(not(any(target_os = "linux", target_os = "windows")))]
+    {
+        let _ = identity;
+        Err(PlatformError::unsupported("virtual gamepad output").into())
+    }
+}
+
+/// Create a virtual mouse for the current platform
+pub fn new_virtual_mouse(
+    identity: &VirtualDeviceIdentity,
+) -> anyhow::Result<Box<dyn VirtualMouse>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::LinuxVirtualMouse::new(identity)?));
+
+    #[cfg(target_os = "windows")]
+    return Ok(Box::new(windows::WindowsVirtualMouse::new(identity)?));
+
+    #[cfg(not(any(target_os = "linux", target_os = "windows")))]
+    {
+        let _ = identity;
+        Err(PlatformError::unsupported("virtual mouse output").into())
+    }
+}
+
+/// Create a virtual mouse that can also put the pointer anywhere on `screen`
+pub fn new_absolute_mouse(
+    identity: &VirtualDeviceIdentity,
+    screen: ScreenSize,
+) -> anyhow::Result<Box<dyn VirtualMouse>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::LinuxVirtualMouse::absolute(identity, screen)?));
+
+    #[cfg(target_os = "windows")]
+    return Ok(Box::new(windows::WindowsVirtualMouse::absolute(identity, screen)?));
+
+    #[cfg(not(any(target_os = "linux", target_os = "windows")))]
+    {
+        let _ = (identity, screen);
+        Err(PlatformError::unsupported("virtual mouse output").into())
+    }
+}
+
+/// Create the custom device a profile calls `name`
+pub fn new_custom_device(name: &str, device: &CustomDevice) -> anyhow::Result<AnyDevice> {
+    Ok(match device.kind {
+        DeviceKind::Keyboard => AnyDevice::Keyboard(new_virtual_keyboard(&device.identity(name))?),
+        DeviceKind::Mouse => AnyDevice::Mouse(new_virtual_mouse(&device.identity(name))?),
+        DeviceKind::Gamepad => {
+            AnyDevice::Gamepad(new_virtual_gamepad(&device.gamepad_identity(name))?)
+        }
+    })
+}
+
+/// Listen to the physical keyboards on the current platform
+pub fn new_key_listener() -> anyhow::Result<Box<dyn KeyListener>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::LinuxKeyListener::new()?));
+
+    #[cfg(not(target_os = "linux"))]
+    Err(PlatformError::unsupported("keyboard input").into())
+}
+
+/// Rumble the controller at `device` on the current platform
+pub fn new_rumble(device: &str) -> anyhow::Result<Box<dyn Rumble>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::LinuxRumble::open(device)?));
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = device;
+        Err(PlatformError::unsupported("rumble").into())
+    }
+}
+
+/// Show player numbers on the lights of the controller at `device` on the
+/// current platform
+pub fn new_player_light(device: &str) -> anyhow::Result<Box<dyn PlayerLight>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::LinuxPlayerLight::open(device)?));
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = device;
+        Err(PlatformError::unsupported("player lights").into())
+    }
+}
+
+/// Claims on the devices of a remap session; nothing to claim here
+#[cfg(not(target_os = "linux"))]
+#[derive(Debug)]
+pub struct DeviceClaim;
+
+/// Claim the devices at `paths` for one remap session, until the claim is
+/// dropped; fails naming the process that remaps one of them already
+///
+/// Platforms that can't tell claim nothing.
+pub fn claim_devices(paths: &[String]) -> anyhow::Result<DeviceClaim> {
+    #[cfg(target_os = "linux")]
+    return linux::DeviceClaim::new(paths);
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = paths;
+        Ok(DeviceClaim)
+    }
+}
+
+/// Stdin's terminal, unbuffered; nothing to restore here
+#[cfg(not(target_os = "linux"))]
+#[derive(Debug)]
+pub struct Terminal;
+
+/// Read keys from stdin as they're pressed, unechoed, until the terminal
+/// is dropped; None if stdin isn't a terminal
+///
+/// Platforms that can't tell have none.
+pub fn unbuffered_terminal() -> Option<Terminal> {
+    #[cfg(target_os = "linux")]
+    return linux::Terminal::unbuffered();
+
+    #[cfg(not(target_os = "linux"))]
+    None
+}
+
+/// Fail, saying how to get access, unless virtual devices can be made;
+/// checked before remapping starts
+///
+/// Platforms that can't tell check nothing.
+pub fn check_virtual_device_access() -> anyhow::Result<()> {
+    #[cfg(target_os = "linux")]
+    return Ok(linux::preflight::check_uinput()?);
+
+    #[cfg(not(target_os = "linux"))]
+    Ok(())
+}
+
+/// Applied to a command before it starts, to confine it
+pub type Confine = Box<dyn Fn(&mut std::process::Command) + Send>;
+
+/// What confines the commands exec actions run: see linux/confine.rs
+pub fn exec_confinement() -> anyhow::Result<Confine> {
+    #[cfg(target_os = "linux")]
+    {
+        let confinement = linux::confine::Confinement::new()?;
+        Ok(Box::new(move |command| confinement.apply(command)))
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    Err(PlatformError::unsupported("confining commands").into())
+}
+
+/// The uid and, where it can be told, pid of the process that connected
+/// from `peer` to us at `local`, when it runs on this machine
+///
+/// Platforms that can't tell know none.
+pub fn tcp_peer(
+    local: std::net::SocketAddr,
+    peer: std::net::SocketAddr,
+) -> Option<(u32, Option<u32>)> {
+    #[cfg(target_os = "linux")]
+    return linux::peer::tcp_peer(local, peer);
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = (local, peer);
+        None
+    }
+}
+
+/// Play sounds through the desktop on the current platform
+pub fn new_sound() -> anyhow::Result<Box<dyn Sound>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::CanberraSound::new()?));
+
+    #[cfg(not(target_os = "linux"))]
+    Err(PlatformError::unsupported("sound").into())
+}
+
+/// Send desktop notifications on the current platform
+pub fn new_notifier() -> anyhow::Result<Box<dyn Notifier>> {
+    #[cfg(target_os = "linux")]
+    return Ok(Box::new(linux::GdbusNotifier::new()?));
+
+    #[cfg(not(target_os = "linux"))]
+    Err(PlatformError::unsupported("notifications").into())
+}
+
+/// Write `calibration` into the kernel's info on the axes of the controller
+/// `info` describes, for other programs reading it
+///
+/// Returns the ranges the driver reported before, to keep with the
+/// calibration.
+pub fn write_calibration_to_kernel(
+    info: &GamepadInfo,
+    calibration: &Calibration,
+) -> anyhow::Result<Vec<DeviceRange>> {
+    #[cfg(target_os = "linux")]
+    return linux::write_calibration(info, calibration);
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = (info, calibration);
+        Err(PlatformError::unsupported("writing calibration to the kernel").into())
+    }
+}
+
+/// Convert an evemu recording into the trace recording its controller would give
+pub fn evemu_to_trace(recording: &EvemuRecording) -> anyhow::Result<Trace> {
+    #[cfg(target_os = "linux")]
+    return Ok(linux::evemu::to_trace(recording));
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = recording;
+        Err(PlatformError::unsupported("evemu conversion").into())
+    }
+}
+
+/// Sample what conditional mappings depend on for the controller at `device`
+///
+/// `window` also asks for the focused window. Where nothing can be found out
+/// the context stays empty, so only `bluetooth = false` conditions match.
+pub fn context_probe(device: &str, window: bool) -> Box<dyn FnMut() -> MappingContext + Send> {
+    #[cfg(target_os = "linux")]
+    {
+        let probe = linux::context::ContextProbe::new(device, window);
+        Box::new(move || probe.sample())
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = (device, window);
+        Box::new(MappingContext::default)
+    }
 }
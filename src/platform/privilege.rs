@@ -0,0 +1,225 @@
+// Dropping root once the devices are open
+//
+// Reading controllers and making virtual devices needs /dev/input and
+// /dev/uinput, which udev rules usually grant the seat's user. Without them
+// the daemon can be started with sudo; it then opens all it needs first, as
+// root, and becomes the user who ran sudo (or `--user`) for good before it
+// maps anything:
+//
+// 1. the controllers, their rumble and lights, and every virtual device its
+//    profiles can make are opened; only these file descriptors keep root's
+//    access
+// 2. `drop_to` sets the user's groups, then group and user ids, real,
+//    effective and saved alike, so root can't be taken back
+// 3. it checks that it can't, and stops setuid programs run from then on
+//    (exec actions, plugins) from gaining privileges
+//
+// Everything after runs as the user: mapping, actions, plugins, the context
+// and battery watchers, the control socket and profile switches. The daemon refuses to go on if any step fails.
+
+use std::path::{Path, PathBuf};
+
+use anyhow::Result;
+
+/// Who a daemon started as root becomes
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct User {
+    pub name: String,
+    pub uid: u32,
+    pub gid: u32,
+    pub home: PathBuf,
+}
+
+/// Whether this process runs as root
+pub fn is_root() -> bool {
+    #[cfg(unix)]
+    return nix::unistd::Uid::effective().is_root();
+
+    #[cfg(not(unix))]
+    false
+}
+
+/// Who to become once the devices are open: the user called `name`, else
+/// whoever ran sudo or pkexec. None when not root, or when that is root
+pub fn target(name: Option<&str>) -> Result<Option<User>> {
+    #[cfg(target_os = "linux")]
+    {
+        use anyhow::Context;
+        use nix::unistd::{Uid, User as Passwd};
+
+        if !is_root() {
+            if let Some(name) = name {
+                anyhow::bail!("Dropping to user '{}' needs the daemon started as root", name);
+            }
+            return Ok(None);
+        }
+        let passwd = match name {
+            Some(name) => Passwd::from_name(name)
+                .with_context(|| format!("Failed to look up user '{}'", name))?
+                .with_context(|| format!("No user '{}'", name))?,
+            None => match invoking_uid(|name| std::env::var(name).ok()) {
+                Some(uid) => Passwd::from_uid(Uid::from_raw(uid))
+                    .with_context(|| format!("Failed to look up user {}", uid))?
+                    .with_context(|| format!("No user {}", uid))?,
+                None => return Ok(None),
+            },
+        };
+        if passwd.uid.is_root() {
+            return Ok(None);
+        }
+        Ok(Some(User {
+            name: passwd.name,
+            uid: passwd.uid.as_raw(),
+            gid: passwd.gid.as_raw(),
+            home: passwd.dir,
+        }))
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    match name {
+        Some(_) => Err(super::PlatformError::unsupported("dropping privileges").into()),
+        None => Ok(None),
+    }
+}
+
+/// The user id sudo or pkexec was run by, from the environment they set
+fn invoking_uid(var: impl Fn(&str) -> Option<String>) -> Option<u32> {
+    ["SUDO_UID", "PKEXEC_UID"]
+        .into_iter()
+        .filter_map(|name| var(name)?.parse().ok())
+        .find(|&uid| uid != 0)
+}
+
+/// Give `path`, and what's directly in it, to `user`, if it is in their home
+///
+/// For files made as root before the drop, like the log file when sudo kept
+/// $HOME, which the user couldn't write to afterwards. Symlinks are given
+/// over themselves, never what they point to.
+pub fn hand_over(user: &User, path: &Path) -> Result<()> {
+    #[cfg(unix)]
+    {
+        use anyhow::Context;
+        use nix::fcntl::{AT_FDCWD, AtFlags};
+        use nix::unistd::{Gid, Uid, fchownat};
+
+        if !path.starts_with(&user.home) {
+            return Ok(());
+        }
+        let Ok(metadata) = path.symlink_metadata() else {
+            return Ok(());
+        };
+        let entries = match metadata.is_dir() {
+            true => {
+                std::fs::read_dir(path)?.map(|entry| Ok(entry?.path())).collect::<Result<_>>()?
+            }
+            false => Vec::new(),
+        };
+        for path in std::iter::once(path.to_path_buf()).chain(entries) {
+            let (uid, gid) = (Some(Uid::from_raw(user.uid)), Some(Gid::from_raw(user.gid)));
+            fchownat(AT_FDCWD, &path, uid, gid, AtFlags::AT_SYMLINK_NOFOLLOW)
+                .with_context(|| format!("Failed to give {} to {}", path.display(), user.name))?;
+        }
+        Ok(())
+    }
+
+    #[cfg(not(unix))]
+    {
+        let _ = (user, path);
+        Ok(())
+    }
+}
+
+/// Become `user` for good; open file descriptors stay usable
+///
+/// Applies to every thread of the process.
+pub fn drop_to(user: &User) -> Result<()> {
+    #[cfg(target_os = "linux")]
+    {
+        use anyhow::Context;
+        use nix::unistd::{Gid, Uid, initgroups, setresgid, setresuid};
+        use std::ffi::CString;
+
+        let (uid, gid) = (Uid::from_raw(user.uid), Gid::from_raw(user.gid));
+        // Groups first: only root can change them
+        let name = CString::new(user.name.as_str())?;
+        initgroups(&name, gid)
+            .with_context(|| format!("Failed to take the groups of {}", user.name))?;
+        setresgid(gid, gid, gid).with_context(|| format!("Failed to set group {}", gid))?;
+        setresuid(uid, uid, uid).with_context(|| format!("Failed to become {}", user.name))?;
+
+        let root = Uid::from_raw(0);
+        if setresuid(root, root, root).is_ok() || Uid::effective().is_root() {
+            anyhow::bail!("Still able to become root after dropping to {}", user.name);
+        }
+        // SAFETY: PR_SET_NO_NEW_PRIVS takes integer arguments only
+        if unsafe { libc::prctl(libc::PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) } != 0 {
+            return Err(std::io::Error::last_os_error())
+                .context("Failed to stop setuid programs gaining privileges");
+        }
+        tracing::info!("Dropped root privileges, now running as {}", user.name);
+        Ok(())
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = user;
+        Err(super::PlatformError::unsupported("dropping privileges").into())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_invoking_uid() {
+        let env = |vars: &'static [(&'static str, &'static str)]| {
+            move |name: &str| vars.iter().find(|(var, _)| *var == name).map(|(_, v)| v.to_string())
+        };
+        assert_eq!(invoking_uid(env(&[("SUDO_UID", "1000")])), Some(1000));
+        assert_eq!(invoking_uid(env(&[("PKEXEC_UID", "1001")])), Some(1001));
+        assert_eq!(invoking_uid(env(&[("SUDO_UID", "0"), ("PKEXEC_UID", "1001")])), Some(1001));
+        assert_eq!(invoking_uid(env(&[("SUDO_UID", "me")])), None);
+        assert_eq!(invoking_uid(env(&[])), None);
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn test_hand_over_leaves_other_homes_alone() {
+        use std::os::unix::fs::MetadataExt;
+
+        let user = User {
+            name: "nobody".to_string(),
+            uid: 65534,
+            gid: 65534,
+            home: PathBuf::from("/nonexistent"),
+        };
+        let path = Path::new(env!("CARGO_MANIFEST_DIR"));
+        let before = std::fs::metadata(path).unwrap().uid();
+        hand_over(&user, path).unwrap();
+        assert_eq!(std::fs::metadata(path).unwrap().uid(), before);
+    }
+
+    #[test]
+    #[cfg(unix)]
+    fn test_hand_over_leaves_symlinks_pointing_where_they_do() {
+        use std::os::unix::fs::MetadataExt;
+
+        let home = std::env::temp_dir().join(format!("blazeremap-home-{}", std::process::id()));
+        let state = home.join(".local/state/blazeremap");
+        std::fs::create_dir_all(&state).unwrap();
+        // Following it would fail: there's nothing at the other end
+        std::os::unix::fs::symlink("/nonexistent/blazeremap", state.join("link")).unwrap();
+        let metadata = std::fs::metadata(&state).unwrap();
+        let user = User {
+            name: "me".to_string(),
+            uid: metadata.uid(),
+            gid: metadata.gid(),
+            home: home.clone(),
+        };
+
+        let result = hand_over(&user, &state);
+        std::fs::remove_dir_all(&home).unwrap();
+        result.unwrap();
+    }
+}
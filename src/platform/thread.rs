@@ -0,0 +1,161 @@
+// Per-thread tuning for the event pipeline
+//
+// Called from the thread being tuned (reader or mapper). Failures are meant
+// to be logged, not fatal: remapping still works at normal priority and on
+// any CPU.
+
+use std::fmt::{Display, Formatter, Result as FmtResult};
+use std::time::Duration;
+
+/// Scheduling boost obtained by `raise_priority`
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ThreadPriority {
+    /// Real-time FIFO scheduling at this priority
+    Realtime(i32),
+    /// Normal scheduling with this (negative) nice value
+    Elevated(i32),
+}
+
+impl Display for ThreadPriority {
+    fn fmt(&self, f: &mut Formatter<'_>) -> FmtResult {
+        match self {
+            Self::Realtime(priority) => write!(f, "SCHED_FIFO priority {}", priority),
+            Self::Elevated(nice) => write!(f, "nice {}", nice),
+        }
+    }
+}
+
+/// Request real-time (or failing that, elevated) priority for this thread
+pub fn raise_priority() -> anyhow::Result<ThreadPriority> {
+    #[cfg(target_os = "linux")]
+    {
+        use super::linux::sched;
+
+        let realtime_err = match sched::set_realtime(sched::REALTIME_PRIORITY) {
+            Ok(()) => return Ok(ThreadPriority::Realtime(sched::REALTIME_PRIORITY)),
+            Err(e) => e,
+        };
+        tracing::debug!("SCHED_FIFO refused ({}), trying nice", realtime_err);
+
+        match sched::set_nice(sched::ELEVATED_NICE) {
+            Ok(()) => Ok(ThreadPriority::Elevated(sched::ELEVATED_NICE)),
+            Err(e) if e.kind() == std::io::ErrorKind::PermissionDenied => anyhow::bail!(
+                "not permitted (grant CAP_SYS_NICE: sudo setcap cap_sys_nice+ep $(command -v \
+                 blazeremap), or raise the rtprio limit in /etc/security/limits.conf)"
+            ),
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    Err(super::PlatformError::unsupported("real-time scheduling").into())
+}
+
+/// Restrict the calling thread to the given CPUs
+pub fn pin_to_cpus(cpus: &[usize]) -> anyhow::Result<()> {
+    #[cfg(target_os = "linux")]
+    {
+        use nix::sched::{CpuSet, sched_setaffinity};
+        use nix::unistd::Pid;
+
+        let mut set = CpuSet::new();
+        for &cpu in cpus {
+            set.set(cpu).map_err(|_| anyhow::anyhow!("CPU {} is out of range", cpu))?;
+        }
+        // pid 0 = calling thread
+        sched_setaffinity(Pid::from_raw(0), &set)?;
+        Ok(())
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    {
+        let _ = cpus;
+        Err(super::PlatformError::unsupported("CPU affinity").into())
+    }
+}
+
+/// Apply scheduling options to the calling thread
+///
+/// Best effort: without the needed privileges (or CPUs) we keep running with
+/// default scheduling and just log why.
+pub fn tune_current_thread(thread_name: &str, realtime: bool, cpus: Option<&[usize]>) {
+    if let Some(cpus) = cpus {
+        match pin_to_cpus(cpus) {
+            Ok(()) => tracing::info!("{} thread pinned to CPUs {:?}", thread_name, cpus),
+            Err(e) => tracing::warn!("Could not pin {} thread: {:#}", thread_name, e),
+        }
+    }
+    if realtime {
+        match raise_priority() {
+            Ok(priority) => tracing::info!("{} thread running with {}", thread_name, priority),
+            Err(e) => tracing::warn!("Could not raise {} thread priority: {:#}", thread_name, e),
+        }
+    }
+}
+
+/// CPU time one of our threads has used so far
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ThreadTimes {
+    pub tid: u32,
+    pub name: String,
+    pub user: Duration,
+    pub system: Duration,
+}
+
+/// Every thread of this process with its CPU time, by thread id
+pub fn cpu_times() -> anyhow::Result<Vec<ThreadTimes>> {
+    #[cfg(target_os = "linux")]
+    return Ok(super::linux::threads::cpu_times()?);
+
+    #[cfg(not(target_os = "linux"))]
+    Err(super::PlatformError::unsupported("thread CPU times").into())
+}
+
+/// Parse a CPU list in taskset/cpuset syntax, e.g. "3", "2,3" or "0-1,6"
+pub fn parse_cpu_list(list: &str) -> anyhow::Result<Vec<usize>> {
+    let mut cpus = Vec::new();
+
+    for part in list.split(',').map(str::trim) {
+        let parse = |s: &str| {
+            s.trim().parse::<usize>().map_err(|_| anyhow::anyhow!("invalid CPU number '{}'", s))
+        };
+        match part.split_once('-') {
+            Some((first, last)) => {
+                let (first, last) = (parse(first)?, parse(last)?);
+                anyhow::ensure!(first <= last, "invalid CPU range '{}'", part);
+                cpus.extend(first..=last);
+            }
+            None => cpus.push(parse(part)?),
+        }
+    }
+
+    cpus.sort_unstable();
+    cpus.dedup();
+    Ok(cpus)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_cpu_list() {
+        assert_eq!(parse_cpu_list("3").unwrap(), vec![3]);
+        assert_eq!(parse_cpu_list("2, 3").unwrap(), vec![2, 3]);
+        assert_eq!(parse_cpu_list("0-1,6,1").unwrap(), vec![0, 1, 6]);
+    }
+
+    #[test]
+    fn test_parse_cpu_list_rejects_garbage() {
+        assert!(parse_cpu_list("").is_err());
+        assert!(parse_cpu_list("a").is_err());
+        assert!(parse_cpu_list("3-1").is_err());
+        assert!(parse_cpu_list("1,,2").is_err());
+    }
+
+    #[test]
+    fn test_priority_display() {
+        assert_eq!(ThreadPriority::Realtime(20).to_string(), "SCHED_FIFO priority 20");
+        assert_eq!(ThreadPriority::Elevated(-10).to_string(), "nice -10");
+    }
+}
@@ -0,0 +1,221 @@
+/*
+Conversion utilities for translating domain key codes to Windows scan codes.
+
+ SendInput accepts either virtual-key codes or hardware scan codes. Scan codes
+ are used here because they are layout-independent and are what games reading
+ raw input (DirectInput, Raw Input) actually look at.
+
+ # Scan Code Set 1
+ For the main keyboard block, Linux evdev key codes are numerically identical
+ to PC/AT scan code set 1, so `KeyboardCode` maps onto the same values used by
+ the Linux converter. Navigation, right-hand modifiers and media keys live in
+ the extended (`0xE0`-prefixed) range and are flagged as such.
+
+ # Note
+ Keys without a sensible scan code (e.g., `Macro`, `Iso`) return `None` and
+ are skipped by the virtual keyboard with a warning.
+*/
+
+use crate::event::KeyboardCode;
+
+/// A set 1 scan code plus whether it needs the `0xE0` extended prefix
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub struct ScanCode {
+    pub code: u16,
+    pub extended: bool,
+}
+
+impl ScanCode {
+    const fn base(code: u16) -> Option<Self> {
+        Some(Self { code, extended: false })
+    }
+
+    const fn extended(code: u16) -> Option<Self> {
+        Some(Self { code, extended: true })
+    }
+}
+
+pub fn keyboard_code_to_scan_code(code: KeyboardCode) -> Option<ScanCode> {
+    match code {
+        KeyboardCode::Escape => ScanCode::base(0x01),
+        KeyboardCode::Num1 => ScanCode::base(0x02),
+        KeyboardCode::Num2 => ScanCode::base(0x03),
+        KeyboardCode::Num3 => ScanCode::base(0x04),
+        KeyboardCode::Num4 => ScanCode::base(0x05),
+        KeyboardCode::Num5 => ScanCode::base(0x06),
+        KeyboardCode::Num6 => ScanCode::base(0x07),
+        KeyboardCode::Num7 => ScanCode::base(0x08),
+        KeyboardCode::Num8 => ScanCode::base(0x09),
+        KeyboardCode::Num9 => ScanCode::base(0x0A),
+        KeyboardCode::Num0 => ScanCode::base(0x0B),
+        KeyboardCode::Minus => ScanCode::base(0x0C),
+        KeyboardCode::Equal => ScanCode::base(0x0D),
+        KeyboardCode::Backspace => ScanCode::base(0x0E),
+        KeyboardCode::Tab => ScanCode::base(0x0F),
+        KeyboardCode::Q => ScanCode::base(0x10),
+        KeyboardCode::W => ScanCode::base(0x11),
+        KeyboardCode::E => ScanCode::base(0x12),
+        KeyboardCode::R => ScanCode::base(0x13),
+        KeyboardCode::T => ScanCode::base(0x14),
+        KeyboardCode::Y => ScanCode::base(0x15),
+        KeyboardCode::U => ScanCode::base(0x16),
+        KeyboardCode::I => ScanCode::base(0x17),
+        KeyboardCode::O => ScanCode::base(0x18),
+        KeyboardCode::P => ScanCode::base(0x19),
+        KeyboardCode::LeftBrace => ScanCode::base(0x1A),
+        KeyboardCode::RightBrace => ScanCode::base(0x1B),
+        KeyboardCode::Enter => ScanCode::base(0x1C),
+        KeyboardCode::LeftControl => ScanCode::base(0x1D),
+        KeyboardCode::A => ScanCode::base(0x1E),
+        KeyboardCode::S => ScanCode::base(0x1F),
+        KeyboardCode::D => ScanCode::base(0x20),
+        KeyboardCode::F => ScanCode::base(0x21),
+        KeyboardCode::G => ScanCode::base(0x22),
+        KeyboardCode::H => ScanCode::base(0x23),
+        KeyboardCode::J => ScanCode::base(0x24),
+        KeyboardCode::K => ScanCode::base(0x25),
+        KeyboardCode::L => ScanCode::base(0x26),
+        KeyboardCode::Semicolon => ScanCode::base(0x27),
+        KeyboardCode::Apostrophe => ScanCode::base(0x28),
+        KeyboardCode::Grave => ScanCode::base(0x29),
+        KeyboardCode::LeftShift => ScanCode::base(0x2A),
+        KeyboardCode::Backslash => ScanCode::base(0x2B),
+        KeyboardCode::Z => ScanCode::base(0x2C),
+        KeyboardCode::X => ScanCode::base(0x2D),
+        KeyboardCode::C => ScanCode::base(0x2E),
+        KeyboardCode::V => ScanCode::base(0x2F),
+        KeyboardCode::B => ScanCode::base(0x30),
+        KeyboardCode::N => ScanCode::base(0x31),
+        KeyboardCode::M => ScanCode::base(0x32),
+        KeyboardCode::Comma => ScanCode::base(0x33),
+        KeyboardCode::Dot => ScanCode::base(0x34),
+        KeyboardCode::Slash => ScanCode::base(0x35),
+        KeyboardCode::RightShift => ScanCode::base(0x36),
+        KeyboardCode::KpAsterisk => ScanCode::base(0x37),
+        KeyboardCode::LeftAlt => ScanCode::base(0x38),
+        KeyboardCode::Space => ScanCode::base(0x39),
+        KeyboardCode::CapsLock => ScanCode::base(0x3A),
+        KeyboardCode::F1 => ScanCode::base(0x3B),
+        KeyboardCode::F2 => ScanCode::base(0x3C),
+        KeyboardCode::F3 => ScanCode::base(0x3D),
+        KeyboardCode::F4 => ScanCode::base(0x3E),
+        KeyboardCode::F5 => ScanCode::base(0x3F),
+        KeyboardCode::F6 => ScanCode::base(0x40),
+        KeyboardCode::F7 => ScanCode::base(0x41),
+        KeyboardCode::F8 => ScanCode::base(0x42),
+        KeyboardCode::F9 => ScanCode::base(0x43),
+        KeyboardCode::F10 => ScanCode::base(0x44),
+        KeyboardCode::NumLock => ScanCode::base(0x45),
+        KeyboardCode::ScrollLock => ScanCode::base(0x46),
+        KeyboardCode::Kp7 => ScanCode::base(0x47),
+        KeyboardCode::Kp8 => ScanCode::base(0x48),
+        KeyboardCode::Kp9 => ScanCode::base(0x49),
+        KeyboardCode::KpMinus => ScanCode::base(0x4A),
+        KeyboardCode::Kp4 => ScanCode::base(0x4B),
+        KeyboardCode::Kp5 => ScanCode::base(0x4C),
+        KeyboardCode::Kp6 => ScanCode::base(0x4D),
+        KeyboardCode::KpPlus => ScanCode::base(0x4E),
+        KeyboardCode::Kp1 => ScanCode::base(0x4F),
+        KeyboardCode::Kp2 => ScanCode::base(0x50),
+        KeyboardCode::Kp3 => ScanCode::base(0x51),
+        KeyboardCode::Kp0 => ScanCode::base(0x52),
+        KeyboardCode::KpDot => ScanCode::base(0x53),
+        KeyboardCode::F11 => ScanCode::base(0x57),
+        KeyboardCode::F12 => ScanCode::base(0x58),
+        KeyboardCode::F13 => ScanCode::base(0x64),
+        KeyboardCode::F14 => ScanCode::base(0x65),
+        KeyboardCode::F15 => ScanCode::base(0x66),
+        KeyboardCode::F16 => ScanCode::base(0x67),
+        KeyboardCode::F17 => ScanCode::base(0x68),
+        KeyboardCode::F18 => ScanCode::base(0x69),
+        KeyboardCode::F19 => ScanCode::base(0x6A),
+        KeyboardCode::F20 => ScanCode::base(0x6B),
+        KeyboardCode::F21 => ScanCode::base(0x6C),
+        KeyboardCode::F22 => ScanCode::base(0x6D),
+        KeyboardCode::F23 => ScanCode::base(0x6E),
+        KeyboardCode::F24 => ScanCode::base(0x76),
+        KeyboardCode::KpEqual => ScanCode::base(0x59),
+        KeyboardCode::KpComma => ScanCode::base(0x7E),
+        // Extended (0xE0-prefixed) keys
+        KeyboardCode::KpEnter => ScanCode::extended(0x1C),
+        KeyboardCode::RightControl => ScanCode::extended(0x1D),
+        KeyboardCode::KpSlash => ScanCode::extended(0x35),
+        KeyboardCode::SysRq => ScanCode::extended(0x37),
+        KeyboardCode::RightAlt => ScanCode::extended(0x38),
+        KeyboardCode::Home => ScanCode::extended(0x47),
+        KeyboardCode::Up => ScanCode::extended(0x48),
+        KeyboardCode::PageUp => ScanCode::extended(0x49),
+        KeyboardCode::Left => ScanCode::extended(0x4B),
+        KeyboardCode::Right => ScanCode::extended(0x4D),
+        KeyboardCode::End => ScanCode::extended(0x4F),
+        KeyboardCode::Down => ScanCode::extended(0x50),
+        KeyboardCode::PageDown => ScanCode::extended(0x51),
+        KeyboardCode::Insert => ScanCode::extended(0x52),
+        KeyboardCode::Delete => ScanCode::extended(0x53),
+        KeyboardCode::LeftMeta => ScanCode::extended(0x5B),
+        KeyboardCode::RightMeta => ScanCode::extended(0x5C),
+        KeyboardCode::Compose => ScanCode::extended(0x5D),
+        KeyboardCode::Power => ScanCode::extended(0x5E),
+        KeyboardCode::Sleep => ScanCode::extended(0x5F),
+        KeyboardCode::WakeUp => ScanCode::extended(0x63),
+        KeyboardCode::Mute => ScanCode::extended(0x20),
+        KeyboardCode::VolumeDown => ScanCode::extended(0x2E),
+        KeyboardCode::VolumeUp => ScanCode::extended(0x30),
+        KeyboardCode::NextSong => ScanCode::extended(0x19),
+        KeyboardCode::PreviousSong => ScanCode::extended(0x10),
+        KeyboardCode::PlayPause => ScanCode::extended(0x22),
+        KeyboardCode::StopCd => ScanCode::extended(0x24),
+        KeyboardCode::Calc => ScanCode::extended(0x21),
+        KeyboardCode::Mail => ScanCode::extended(0x6C),
+        KeyboardCode::HomePage => ScanCode::extended(0x32),
+        KeyboardCode::Search => ScanCode::extended(0x65),
+        KeyboardCode::Bookmarks => ScanCode::extended(0x66),
+        KeyboardCode::Refresh => ScanCode::extended(0x67),
+        KeyboardCode::Stop => ScanCode::extended(0x68),
+        KeyboardCode::Forward => ScanCode::extended(0x69),
+        KeyboardCode::Back => ScanCode::extended(0x6A),
+        KeyboardCode::Computer => ScanCode::extended(0x6B),
+        KeyboardCode::Media => ScanCode::extended(0x6D),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_main_block_matches_scan_code_set_1() {
+        assert_eq!(keyboard_code_to_scan_code(KeyboardCode::Escape), ScanCode::base(0x01));
+        assert_eq!(keyboard_code_to_scan_code(KeyboardCode::A), ScanCode::base(0x1E));
+        assert_eq!(keyboard_code_to_scan_code(KeyboardCode::Space), ScanCode::base(0x39));
+    }
+
+    #[test]
+    fn test_navigation_keys_are_extended() {
+        let up = keyboard_code_to_scan_code(KeyboardCode::Up).unwrap();
+        assert_eq!(up.code, 0x48);
+        assert!(up.extended);
+
+        // Same scan code as Kp8, but without the extended prefix
+        let kp8 = keyboard_code_to_scan_code(KeyboardCode::Kp8).unwrap();
+        assert_eq!(kp8.code, 0x48);
+        assert!(!kp8.extended);
+    }
+
+    #[test]
+    fn test_unmapped_keys_return_none() {
+        assert_eq!(keyboard_code_to_scan_code(KeyboardCode::Unknown), None);
+        assert_eq!(keyboard_code_to_scan_code(KeyboardCode::Macro), None);
+    }
+
+    #[test]
+    fn test_scan_codes_are_unique() {
+        let mut seen = std::collections::HashSet::new();
+        for code in KeyboardCode::ALL {
+            if let Some(scan) = keyboard_code_to_scan_code(code) {
+                assert!(seen.insert(scan), "duplicate scan code for {:?}", code);
+            }
+        }
+    }
+}
@@ -0,0 +1,342 @@
+// Virtual Gamepad Module (Windows)
+//
+// Virtual pads come from the ViGEmBus driver, through its client library,
+// ViGEmClient.dll. The library is loaded when the first pad is made, so
+// machines without ViGEm still run keyboard and mouse profiles and only fail,
+// naming what to install, when a profile needs a pad.
+//
+// Every pad is an Xbox 360 one, which is what XInput games look for, whatever
+// kind of controller the identity is: only its vendor and product IDs are
+// passed on. It has the 360 pad's controls alone, so paddles and the like fail
+// as they do on a Linux pad without them.
+
+use crate::{
+    event::{AxisCode, ButtonCode, InputEvent},
+    input::range::AxisRange,
+    output::gamepad::{VirtualGamepad, VirtualGamepadIdentity},
+};
+use anyhow::{Context, Result, anyhow, bail};
+use std::ffi::{CStr, c_char, c_void};
+use std::path::PathBuf;
+use std::sync::OnceLock;
+
+// Minimal ViGEmClient bindings (see ViGEm/Client.h and ViGEm/Common.h)
+type Client = *mut c_void;
+type Target = *mut c_void;
+
+const VIGEM_ERROR_NONE: u32 = 0x2000_0000;
+
+const XUSB_GAMEPAD_DPAD_UP: u16 = 0x0001;
+const XUSB_GAMEPAD_DPAD_DOWN: u16 = 0x0002;
+const XUSB_GAMEPAD_DPAD_LEFT: u16 = 0x0004;
+const XUSB_GAMEPAD_DPAD_RIGHT: u16 = 0x0008;
+const XUSB_GAMEPAD_START: u16 = 0x0010;
+const XUSB_GAMEPAD_BACK: u16 = 0x0020;
+const XUSB_GAMEPAD_LEFT_THUMB: u16 = 0x0040;
+const XUSB_GAMEPAD_RIGHT_THUMB: u16 = 0x0080;
+const XUSB_GAMEPAD_LEFT_SHOULDER: u16 = 0x0100;
+const XUSB_GAMEPAD_RIGHT_SHOULDER: u16 = 0x0200;
+const XUSB_GAMEPAD_GUIDE: u16 = 0x0400;
+const XUSB_GAMEPAD_A: u16 = 0x1000;
+const XUSB_GAMEPAD_B: u16 = 0x2000;
+const XUSB_GAMEPAD_X: u16 = 0x4000;
+const XUSB_GAMEPAD_Y: u16 = 0x8000;
+
+/// XUSB_REPORT: the whole state of a 360 pad, sent on every change
+#[repr(C)]
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+struct XusbReport {
+    buttons: u16,
+    left_trigger: u8,
+    right_trigger: u8,
+    thumb_lx: i16,
+    thumb_ly: i16,
+    thumb_rx: i16,
+    thumb_ry: i16,
+}
+
+/// Range of the 360 pad's triggers
+const TRIGGER_RANGE: AxisRange = AxisRange::new(0, 255);
+
+fn button_bit(code: ButtonCode) -> Option<u16> {
+    Some(match code {
+        ButtonCode::South => XUSB_GAMEPAD_A,
+        ButtonCode::East => XUSB_GAMEPAD_B,
+        ButtonCode::West => XUSB_GAMEPAD_X,
+        ButtonCode::North => XUSB_GAMEPAD_Y,
+        ButtonCode::LeftShoulder => XUSB_GAMEPAD_LEFT_SHOULDER,
+        ButtonCode::RightShoulder => XUSB_GAMEPAD_RIGHT_SHOULDER,
+        ButtonCode::Select => XUSB_GAMEPAD_BACK,
+        ButtonCode::Start => XUSB_GAMEPAD_START,
+        ButtonCode::LeftStick => XUSB_GAMEPAD_LEFT_THUMB,
+        ButtonCode::RightStick => XUSB_GAMEPAD_RIGHT_THUMB,
+        ButtonCode::Mode => XUSB_GAMEPAD_GUIDE,
+        _ => return None,
+    })
+}
+
+impl XusbReport {
+    /// Take `event` into the report; fails on controls a 360 pad doesn't have
+    fn apply(&mut self, event: &InputEvent) -> Result<()> {
+        // Sticks keep the canonical range, but XInput's Y points up
+        let stick = |value: i32| value.clamp(i16::MIN.into(), i16::MAX.into()) as i16;
+        let flipped = |value: i32| stick(-1 - value);
+        let trigger =
+            |value: i32| AxisRange::TRIGGER.rescale(value, TRIGGER_RANGE).clamp(0, 255) as u8;
+        match *event {
+            // The pad has no trigger buttons; they pull the trigger all the way
+            InputEvent::Button { code: ButtonCode::LeftTrigger, pressed, .. } => {
+                self.left_trigger = if pressed { u8::MAX } else { 0 };
+            }
+            InputEvent::Button { code: ButtonCode::RightTrigger, pressed, .. } => {
+                self.right_trigger = if pressed { u8::MAX } else { 0 };
+            }
+            InputEvent::Button { code, pressed, .. } => {
+                let bit = button_bit(code)
+                    .ok_or_else(|| anyhow!("This controller has no {} button", code))?;
+                self.set(bit, pressed);
+            }
+            InputEvent::Axis { code, value, .. } => match code {
+                AxisCode::LeftX => self.thumb_lx = stick(value),
+                AxisCode::LeftY => self.thumb_ly = flipped(value),
+                AxisCode::RightX => self.thumb_rx = stick(value),
+                AxisCode::RightY => self.thumb_ry = flipped(value),
+                AxisCode::LeftTrigger => self.left_trigger = trigger(value),
+                AxisCode::RightTrigger => self.right_trigger = trigger(value),
+                // The hat's -1 is left and up
+                AxisCode::DPadX => {
+                    self.set(XUSB_GAMEPAD_DPAD_LEFT, value < 0);
+                    self.set(XUSB_GAMEPAD_DPAD_RIGHT, value > 0);
+                }
+                AxisCode::DPadY => {
+                    self.set(XUSB_GAMEPAD_DPAD_UP, value < 0);
+                    self.set(XUSB_GAMEPAD_DPAD_DOWN, value > 0);
+                }
+                code => bail!("This controller has no {} axis", code),
+            },
+            InputEvent::Sync { .. } => {}
+        }
+        Ok(())
+    }
+
+    fn set(&mut self, bit: u16, on: bool) {
+        if on {
+            self.buttons |= bit;
+        } else {
+            self.buttons &= !bit;
+        }
+    }
+}
+
+#[link(name = "kernel32")]
+unsafe extern "system" {
+    fn LoadLibraryW(file_name: *const u16) -> *mut c_void;
+    fn GetProcAddress(module: *mut c_void, proc_name: *const c_char) -> *mut c_void;
+}
+
+/// The ViGEmClient functions pads use
+struct ViGEm {
+    alloc: unsafe extern "C" fn() -> Client,
+    free: unsafe extern "C" fn(Client),
+    connect: unsafe extern "C" fn(Client) -> u32,
+    disconnect: unsafe extern "C" fn(Client),
+    target_x360_alloc: unsafe extern "C" fn() -> Target,
+    target_free: unsafe extern "C" fn(Target),
+    target_set_vid: unsafe extern "C" fn(Target, u16),
+    target_set_pid: unsafe extern "C" fn(Target, u16),
+    target_add: unsafe extern "C" fn(Client, Target) -> u32,
+    target_remove: unsafe extern "C" fn(Client, Target) -> u32,
+    target_x360_update: unsafe extern "C" fn(Client, Target, XusbReport) -> u32,
+}
+
+impl ViGEm {
+    /// The client library, loaded on first use and kept for good
+    fn get() -> Result<&'static Self> {
+        static LIBRARY: OnceLock<std::result::Result<ViGEm, String>> = OnceLock::new();
+        LIBRARY
+            .get_or_init(|| Self::load().map_err(|e| format!("{:#}", e)))
+            .as_ref()
+            .map_err(|e| anyhow!("{}", e))
+    }
+
+    fn load() -> Result<Self> {
+        let file: Vec<u16> = "ViGEmClient.dll".encode_utf16().chain([0]).collect();
+        // SAFETY: `file` is a NUL-terminated UTF-16 string
+        let module = unsafe { LoadLibraryW(file.as_ptr()) };
+        if module.is_null() {
+            return Err(std::io::Error::last_os_error()).context(
+                "Failed to load ViGEmClient.dll; virtual gamepads need the ViGEmBus driver \
+                 and ViGEmClient.dll next to blazeremap.exe",
+            );
+        }
+        // SAFETY: each field's type is the C signature of the export it's
+        // loaded from, per ViGEm/Client.h
+        unsafe {
+            Ok(Self {
+                alloc: symbol(module, c"vigem_alloc")?,
+                free: symbol(module, c"vigem_free")?,
+                connect: symbol(module, c"vigem_connect")?,
+                disconnect: symbol(module, c"vigem_disconnect")?,
+                target_x360_alloc: symbol(module, c"vigem_target_x360_alloc")?,
+                target_free: symbol(module, c"vigem_target_free")?,
+                target_set_vid: symbol(module, c"vigem_target_set_vid")?,
+                target_set_pid: symbol(module, c"vigem_target_set_pid")?,
+                target_add: symbol(module, c"vigem_target_add")?,
+                target_remove: symbol(module, c"vigem_target_remove")?,
+                target_x360_update: symbol(module, c"vigem_target_x360_update")?,
+            })
+        }
+    }
+}
+
+/// The export `name` of `module`, as the function pointer type `F`
+///
+/// # Safety
+/// `F` must be a function pointer type matching the export's signature.
+unsafe fn symbol<F: Copy>(module: *mut c_void, name: &CStr) -> Result<F> {
+    // SAFETY: `module` is a loaded library and `name` is NUL-terminated
+    let address = unsafe { GetProcAddress(module, name.as_ptr()) };
+    if address.is_null() {
+        bail!("ViGEmClient.dll has no {}; is it too old?", name.to_string_lossy());
+    }
+    // SAFETY: function pointers are pointer-sized; the caller vouches for `F`
+    Ok(unsafe { std::mem::transmute_copy(&address) })
+}
+
+/// Concrete virtual gamepad backed by ViGEmBus, always an Xbox 360 pad
+pub struct WindowsVirtualGamepad {
+    vigem: &'static ViGEm,
+    client: Client,
+    target: Target,
+    report: XusbReport,
+    name: String,
+}
+
+// SAFETY: ViGEm handles aren't tied to the thread that made them, and the
+// pad only uses them through &mut self
+unsafe impl Send for WindowsVirtualGamepad {}
+
+impl WindowsVirtualGamepad {
+    /// Plug in a new virtual Xbox 360 pad with the identity's IDs
+    ///
+    /// The name is only kept for logs: ViGEm pads all have the 360 pad's.
+    pub fn new(identity: &VirtualGamepadIdentity) -> Result<Self> {
+        let vigem = ViGEm::get()?;
+        // SAFETY: the handles come from this library, are checked before use
+        // and freed once, here on failure or when the pad is dropped
+        unsafe {
+            let client = (vigem.alloc)();
+            if client.is_null() {
+                bail!("Failed to create virtual gamepad: out of memory");
+            }
+            let error = (vigem.connect)(client);
+            if error != VIGEM_ERROR_NONE {
+                (vigem.free)(client);
+                bail!(
+                    "Failed to connect to ViGEmBus (error {:#x}); is the driver installed?",
+                    error
+                );
+            }
+            let target = (vigem.target_x360_alloc)();
+            if target.is_null() {
+                (vigem.disconnect)(client);
+                (vigem.free)(client);
+                bail!("Failed to create virtual gamepad: out of memory");
+            }
+            (vigem.target_set_vid)(target, identity.vendor_id);
+            (vigem.target_set_pid)(target, identity.product_id);
+            let error = (vigem.target_add)(client, target);
+            if error != VIGEM_ERROR_NONE {
+                (vigem.target_free)(target);
+                (vigem.disconnect)(client);
+                (vigem.free)(client);
+                bail!("Failed to create virtual gamepad (ViGEm error {:#x})", error);
+            }
+
+            tracing::info!("Virtual gamepad created: {} (ViGEm Xbox 360)", identity.name);
+            Ok(Self {
+                vigem,
+                client,
+                target,
+                report: XusbReport::default(),
+                name: identity.name.clone(),
+            })
+        }
+    }
+}
+
+impl VirtualGamepad for WindowsVirtualGamepad {
+    fn emit_frame(&mut self, events: &[InputEvent]) -> Result<()> {
+        let mut report = self.report;
+        for event in events {
+            report.apply(event)?;
+        }
+        if report == self.report {
+            return Ok(());
+        }
+
+        // SAFETY: client and target are live until drop
+        let error = unsafe { (self.vigem.target_x360_update)(self.client, self.target, report) };
+        if error != VIGEM_ERROR_NONE {
+            bail!("ViGEm rejected the state of {} (error {:#x})", self.name, error);
+        }
+        self.report = report;
+        Ok(())
+    }
+
+    fn dev_node(&mut self) -> Result<PathBuf> {
+        bail!("ViGEm gamepads have no device path")
+    }
+}
+
+impl Drop for WindowsVirtualGamepad {
+    fn drop(&mut self) {
+        // SAFETY: both handles are live and freed only here
+        unsafe {
+            (self.vigem.target_remove)(self.client, self.target);
+            (self.vigem.target_free)(self.target);
+            (self.vigem.disconnect)(self.client);
+            (self.vigem.free)(self.client);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_report_follows_events() {
+        let mut report = XusbReport::default();
+        for event in [
+            InputEvent::button_press(ButtonCode::South),
+            InputEvent::button_press(ButtonCode::Mode),
+            InputEvent::button_press(ButtonCode::RightTrigger),
+            InputEvent::axis_move(AxisCode::LeftTrigger, 1023),
+            InputEvent::axis_move(AxisCode::LeftY, -32768),
+            InputEvent::axis_move(AxisCode::RightX, 1200),
+            InputEvent::axis_move(AxisCode::DPadY, -1),
+        ] {
+            report.apply(&event).unwrap();
+        }
+        assert_eq!(
+            report,
+            XusbReport {
+                buttons: XUSB_GAMEPAD_A | XUSB_GAMEPAD_GUIDE | XUSB_GAMEPAD_DPAD_UP,
+                left_trigger: 255,
+                right_trigger: 255,
+                thumb_lx: 0,
+                thumb_ly: 32767,
+                thumb_rx: 1200,
+                thumb_ry: 0,
+            }
+        );
+
+        report.apply(&InputEvent::button_release(ButtonCode::South)).unwrap();
+        report.apply(&InputEvent::axis_move(AxisCode::DPadY, 0)).unwrap();
+        assert_eq!(report.buttons, XUSB_GAMEPAD_GUIDE);
+
+        let err = report.apply(&InputEvent::button_press(ButtonCode::Paddle1)).unwrap_err();
+        assert_eq!(err.to_string(), "This controller has no Paddle 1 button");
+    }
+}
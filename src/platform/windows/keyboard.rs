@@ -0,0 +1,85 @@
+// Virtual Keyboard Module (Windows)
+
+use crate::{
+    event::KeyboardCode,
+    output::{identity::VirtualDeviceIdentity, keyboard::VirtualKeyboard},
+    platform::windows::{
+        converter::{ScanCode, keyboard_code_to_scan_code},
+        send_input::{Input, KeybdInput, send},
+    },
+};
+use anyhow::{Result, bail};
+use std::path::PathBuf;
+
+const KEYEVENTF_EXTENDEDKEY: u32 = 0x0001;
+const KEYEVENTF_KEYUP: u32 = 0x0002;
+const KEYEVENTF_SCANCODE: u32 = 0x0008;
+
+/// Concrete virtual keyboard backed by SendInput
+///
+/// Unlike uinput there is no device node: events are injected into the
+/// session's input stream and attributed to no particular keyboard.
+pub struct WindowsVirtualKeyboard {
+    name: String,
+}
+
+impl WindowsVirtualKeyboard {
+    /// Create a new virtual keyboard
+    ///
+    /// Only the identity's name is kept, for logs: SendInput has no device
+    /// to give IDs to.
+    pub fn new(identity: &VirtualDeviceIdentity) -> Result<Self> {
+        tracing::info!("Virtual keyboard created: {} (SendInput)", identity.name);
+        Ok(Self { name: identity.name.clone() })
+    }
+
+    fn send_scan_code(&mut self, scan: ScanCode, key_up: bool) -> Result<()> {
+        let mut flags = KEYEVENTF_SCANCODE;
+        if scan.extended {
+            flags |= KEYEVENTF_EXTENDEDKEY;
+        }
+        if key_up {
+            flags |= KEYEVENTF_KEYUP;
+        }
+
+        let input = Input::keyboard(KeybdInput {
+            w_vk: 0,
+            w_scan: scan.code,
+            dw_flags: flags,
+            time: 0,
+            dw_extra_info: 0,
+        });
+        send(&[input], &self.name)
+    }
+
+    fn send_key(&mut self, code: KeyboardCode, key_up: bool) -> Result<()> {
+        match keyboard_code_to_scan_code(code) {
+            Some(scan) => self.send_scan_code(scan, key_up),
+            None => {
+                tracing::warn!("No Windows scan code for {}, skipping", code);
+                Ok(())
+            }
+        }
+    }
+}
+
+// Implement the domain trait for this concrete type
+impl VirtualKeyboard for WindowsVirtualKeyboard {
+    fn press_key(&mut self, code: KeyboardCode) -> Result<()> {
+        self.send_key(code, false)
+    }
+
+    fn release_key(&mut self, code: KeyboardCode) -> Result<()> {
+        self.send_key(code, true)
+    }
+
+    fn tap_key(&mut self, code: KeyboardCode) -> Result<()> {
+        self.press_key(code)?;
+        std::thread::sleep(std::time::Duration::from_millis(10));
+        self.release_key(code)
+    }
+
+    fn sys_path(&mut self) -> Result<PathBuf> {
+        bail!("SendInput keyboards have no device path")
+    }
+}
@@ -0,0 +1,16 @@
+// Windows platform adapters
+//
+// Output only for now: keyboard and mouse events are injected through
+// SendInput, keys as scan codes, and virtual gamepads are Xbox 360 pads made
+// through ViGEmBus. There is no Windows input manager yet.
+
+mod converter;
+mod gamepad;
+mod keyboard;
+mod mouse;
+mod send_input;
+
+pub use converter::{ScanCode, keyboard_code_to_scan_code};
+pub use gamepad::WindowsVirtualGamepad;
+pub use keyboard::WindowsVirtualKeyboard;
+pub use mouse::WindowsVirtualMouse;
@@ -0,0 +1,172 @@
+// Virtual Mouse Module (Windows)
+//
+// Mouse events go through SendInput like the keyboard's. Relative moves pass
+// through the user's pointer speed and "Enhance pointer precision", as a real
+// mouse's do. An absolute mouse positions the pointer on the screen it was
+// made for, whose pixels are scaled onto the 0..65535 range SendInput spans
+// the primary monitor with.
+
+use crate::{
+    input::keymouse::MouseButton,
+    output::{
+        identity::VirtualDeviceIdentity,
+        mouse::{MouseEvent, ScreenSize, VirtualMouse},
+    },
+    platform::windows::send_input::{Input, MouseInput, send},
+};
+use anyhow::{Result, bail};
+use std::path::PathBuf;
+
+const MOUSEEVENTF_MOVE: u32 = 0x0001;
+const MOUSEEVENTF_LEFTDOWN: u32 = 0x0002;
+const MOUSEEVENTF_LEFTUP: u32 = 0x0004;
+const MOUSEEVENTF_RIGHTDOWN: u32 = 0x0008;
+const MOUSEEVENTF_RIGHTUP: u32 = 0x0010;
+const MOUSEEVENTF_MIDDLEDOWN: u32 = 0x0020;
+const MOUSEEVENTF_MIDDLEUP: u32 = 0x0040;
+const MOUSEEVENTF_XDOWN: u32 = 0x0080;
+const MOUSEEVENTF_XUP: u32 = 0x0100;
+const MOUSEEVENTF_WHEEL: u32 = 0x0800;
+const MOUSEEVENTF_HWHEEL: u32 = 0x1000;
+const MOUSEEVENTF_ABSOLUTE: u32 = 0x8000;
+const XBUTTON1: u32 = 0x0001;
+const XBUTTON2: u32 = 0x0002;
+/// One wheel notch
+const WHEEL_DELTA: i32 = 120;
+/// Far edge of the primary monitor in absolute coordinates
+const ABSOLUTE_MAX: i64 = 65535;
+
+/// SendInput flags and mouse data for `button` going down or up
+fn button_input(button: MouseButton, pressed: bool) -> (u32, u32) {
+    let (down, up, data) = match button {
+        MouseButton::Left => (MOUSEEVENTF_LEFTDOWN, MOUSEEVENTF_LEFTUP, 0),
+        MouseButton::Right => (MOUSEEVENTF_RIGHTDOWN, MOUSEEVENTF_RIGHTUP, 0),
+        MouseButton::Middle => (MOUSEEVENTF_MIDDLEDOWN, MOUSEEVENTF_MIDDLEUP, 0),
+        MouseButton::Side => (MOUSEEVENTF_XDOWN, MOUSEEVENTF_XUP, XBUTTON1),
+        MouseButton::Extra => (MOUSEEVENTF_XDOWN, MOUSEEVENTF_XUP, XBUTTON2),
+    };
+    (if pressed { down } else { up }, data)
+}
+
+/// Concrete virtual mouse backed by SendInput, with two wheels
+///
+/// Like the keyboard it has no device node, and its events are attributed
+/// to no particular mouse.
+pub struct WindowsVirtualMouse {
+    name: String,
+    // The screen absolute positions span, for absolute mice
+    screen: Option<ScreenSize>,
+}
+
+impl WindowsVirtualMouse {
+    /// Create a new relative virtual mouse
+    ///
+    /// Only the identity's name is kept, for logs: SendInput has no device
+    /// to give IDs to.
+    pub fn new(identity: &VirtualDeviceIdentity) -> Result<Self> {
+        tracing::info!("Virtual mouse created: {} (SendInput)", identity.name);
+        Ok(Self { name: identity.name.clone(), screen: None })
+    }
+
+    /// Create a virtual mouse that also positions the pointer on `screen`
+    pub fn absolute(identity: &VirtualDeviceIdentity, screen: ScreenSize) -> Result<Self> {
+        tracing::info!(
+            "Virtual mouse created: {} (SendInput, absolute, {})",
+            identity.name,
+            screen
+        );
+        Ok(Self { name: identity.name.clone(), screen: Some(screen) })
+    }
+}
+
+/// The SendInput events of one frame; empty if nothing changed
+///
+/// `MoveTo` positions are kept on `screen`, and fail without one.
+fn frame_inputs(events: &[MouseEvent], screen: Option<ScreenSize>) -> Result<Vec<MouseInput>> {
+    let input = |dx, dy, mouse_data, dw_flags| MouseInput {
+        dx,
+        dy,
+        mouse_data,
+        dw_flags,
+        time: 0,
+        dw_extra_info: 0,
+    };
+    let mut inputs = Vec::with_capacity(events.len());
+    for event in events {
+        match *event {
+            MouseEvent::Move { dx: 0, dy: 0 } => {}
+            MouseEvent::Move { dx, dy } => inputs.push(input(dx, dy, 0, MOUSEEVENTF_MOVE)),
+            MouseEvent::MoveTo { x, y } => {
+                let Some(screen) = screen else {
+                    bail!("Virtual mouse is relative; it can't move the pointer to a position");
+                };
+                let (x, y) = screen.clamp(x, y);
+                let scale = |pixel: i32, size: u32| {
+                    (pixel as i64 * ABSOLUTE_MAX / (size as i64 - 1).max(1)) as i32
+                };
+                let flags = MOUSEEVENTF_MOVE | MOUSEEVENTF_ABSOLUTE;
+                inputs.push(input(scale(x, screen.width), scale(y, screen.height), 0, flags));
+            }
+            MouseEvent::Scroll { vertical, horizontal } => {
+                // Negative notches go as the DWORD's two's complement
+                if vertical != 0 {
+                    let data = (vertical * WHEEL_DELTA) as u32;
+                    inputs.push(input(0, 0, data, MOUSEEVENTF_WHEEL));
+                }
+                if horizontal != 0 {
+                    let data = (horizontal * WHEEL_DELTA) as u32;
+                    inputs.push(input(0, 0, data, MOUSEEVENTF_HWHEEL));
+                }
+            }
+            MouseEvent::Button { button, pressed } => {
+                let (flags, data) = button_input(button, pressed);
+                inputs.push(input(0, 0, data, flags));
+            }
+        }
+    }
+    Ok(inputs)
+}
+
+impl VirtualMouse for WindowsVirtualMouse {
+    fn emit_frame(&mut self, events: &[MouseEvent]) -> Result<()> {
+        let inputs: Vec<Input> =
+            frame_inputs(events, self.screen)?.into_iter().map(Input::mouse).collect();
+        send(&inputs, &self.name)
+    }
+
+    fn dev_node(&mut self) -> Result<PathBuf> {
+        bail!("SendInput mice have no device path")
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn fields(inputs: &[MouseInput]) -> Vec<(i32, i32, u32, u32)> {
+        inputs.iter().map(|input| (input.dx, input.dy, input.mouse_data, input.dw_flags)).collect()
+    }
+
+    #[test]
+    fn test_frame_inputs() {
+        let screen = ScreenSize { width: 1920, height: 1080 };
+        let frame = [
+            MouseEvent::Move { dx: 4, dy: 0 },
+            MouseEvent::MoveTo { x: 2000, y: 0 },
+            MouseEvent::Scroll { vertical: -1, horizontal: 0 },
+            MouseEvent::Button { button: MouseButton::Extra, pressed: true },
+        ];
+        assert_eq!(
+            fields(&frame_inputs(&frame, Some(screen)).unwrap()),
+            [
+                (4, 0, 0, MOUSEEVENTF_MOVE),
+                (65535, 0, 0, MOUSEEVENTF_MOVE | MOUSEEVENTF_ABSOLUTE),
+                (0, 0, (-120i32) as u32, MOUSEEVENTF_WHEEL),
+                (0, 0, XBUTTON2, MOUSEEVENTF_XDOWN),
+            ]
+        );
+
+        assert!(frame_inputs(&frame, None).is_err());
+        assert!(frame_inputs(&[MouseEvent::Move { dx: 0, dy: 0 }], None).unwrap().is_empty());
+    }
+}
@@ -0,0 +1,85 @@
+// Minimal user32 bindings for SendInput (see winuser.h)
+//
+// Shared by the virtual keyboard and mouse. Neither has a device of its own:
+// their events are injected into the session's input stream.
+
+use anyhow::{Result, bail};
+
+const INPUT_MOUSE: u32 = 0;
+const INPUT_KEYBOARD: u32 = 1;
+
+#[repr(C)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct KeybdInput {
+    pub w_vk: u16,
+    pub w_scan: u16,
+    pub dw_flags: u32,
+    pub time: u32,
+    pub dw_extra_info: usize,
+}
+
+#[repr(C)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct MouseInput {
+    pub dx: i32,
+    pub dy: i32,
+    pub mouse_data: u32,
+    pub dw_flags: u32,
+    pub time: u32,
+    pub dw_extra_info: usize,
+}
+
+// MOUSEINPUT is the largest member, so the union has the size SendInput
+// expects for cbSize.
+#[repr(C)]
+#[derive(Clone, Copy)]
+union InputUnion {
+    ki: KeybdInput,
+    mi: MouseInput,
+}
+
+#[repr(C)]
+#[derive(Clone, Copy)]
+pub struct Input {
+    r#type: u32,
+    u: InputUnion,
+}
+
+impl Input {
+    pub fn keyboard(ki: KeybdInput) -> Self {
+        Self { r#type: INPUT_KEYBOARD, u: InputUnion { ki } }
+    }
+
+    pub fn mouse(mi: MouseInput) -> Self {
+        Self { r#type: INPUT_MOUSE, u: InputUnion { mi } }
+    }
+}
+
+#[link(name = "user32")]
+unsafe extern "system" {
+    fn SendInput(c_inputs: u32, p_inputs: *const Input, cb_size: i32) -> u32;
+}
+
+/// Inject `inputs` in one go, so no other input lands between them
+///
+/// `device` names the virtual device in errors.
+pub fn send(inputs: &[Input], device: &str) -> Result<()> {
+    if inputs.is_empty() {
+        return Ok(());
+    }
+    // SAFETY: `inputs` are fully initialised INPUT structs that live for the
+    // duration of the call, and cb_size matches their layout.
+    let sent = unsafe {
+        SendInput(inputs.len() as u32, inputs.as_ptr(), std::mem::size_of::<Input>() as i32)
+    };
+    if sent as usize != inputs.len() {
+        // SendInput is blocked by UIPI when the foreground window belongs to
+        // a process with a higher integrity level.
+        bail!(
+            "SendInput rejected input from {} (blocked by UIPI or another process?): {}",
+            device,
+            std::io::Error::last_os_error()
+        );
+    }
+    Ok(())
+}
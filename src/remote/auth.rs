@@ -0,0 +1,73 @@
+// Shared-token authentication (HMAC-SHA256 challenge/response)
+
+use sha2::{Digest, Sha256};
+
+const BLOCK_SIZE: usize = 64;
+
+/// Length of the server challenge in bytes
+pub(super) const NONCE_LEN: usize = 16;
+
+/// Length of a challenge response in bytes
+pub(super) const MAC_LEN: usize = 32;
+
+/// HMAC-SHA256 as defined in RFC 2104
+pub(super) fn hmac_sha256(key: &[u8], message: &[u8]) -> [u8; MAC_LEN] {
+    let mut block = [0u8; BLOCK_SIZE];
+    if key.len() > BLOCK_SIZE {
+        block[..MAC_LEN].copy_from_slice(&Sha256::digest(key));
+    } else {
+        block[..key.len()].copy_from_slice(key);
+    }
+
+    let mut inner = Sha256::new();
+    inner.update(block.map(|b| b ^ 0x36));
+    inner.update(message);
+
+    let mut outer = Sha256::new();
+    outer.update(block.map(|b| b ^ 0x5c));
+    outer.update(inner.finalize());
+    outer.finalize().into()
+}
+
+/// Response a client must send for the given challenge
+pub(super) fn challenge_response(token: &[u8], nonce: &[u8; NONCE_LEN]) -> [u8; MAC_LEN] {
+    let mut message = b"blazeremap-forward:".to_vec();
+    message.extend_from_slice(nonce);
+    hmac_sha256(token, &message)
+}
+
+/// Compare two MACs without leaking where they differ
+pub(super) fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    a.len() == b.len() && a.iter().zip(b).fold(0u8, |acc, (x, y)| acc | (x ^ y)) == 0
+}
+
+/// Fresh random challenge
+pub(super) fn new_nonce() -> anyhow::Result<[u8; NONCE_LEN]> {
+    let mut nonce = [0u8; NONCE_LEN];
+    getrandom::fill(&mut nonce)
+        .map_err(|e| anyhow::anyhow!("Failed to generate challenge: {}", e))?;
+    Ok(nonce)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_hmac_sha256_rfc4231_case_2() {
+        let mac = hmac_sha256(b"Jefe", b"what do ya want for nothing?");
+        assert_eq!(hex(&mac), "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843");
+    }
+
+    #[test]
+    fn test_challenge_response_depends_on_token() {
+        let nonce = [7u8; NONCE_LEN];
+        let good = challenge_response(b"secret", &nonce);
+        assert!(constant_time_eq(&good, &challenge_response(b"secret", &nonce)));
+        assert!(!constant_time_eq(&good, &challenge_response(b"other", &nonce)));
+    }
+
+    fn hex(bytes: &[u8]) -> String {
+        bytes.iter().map(|b| format!("{:02x}", b)).collect()
+    }
+}
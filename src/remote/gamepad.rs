@@ -0,0 +1,73 @@
+// Receiving end of a forwarded controller
+
+use super::protocol::{self, FRAME_LEN};
+use crate::event::InputEvent;
+use crate::input::gamepad::{Gamepad, GamepadInfo};
+use std::io::{BufReader, ErrorKind, Read};
+use std::net::TcpStream;
+use std::time::{Duration, Instant};
+
+/// A gamepad whose events arrive over an authenticated TCP connection
+pub struct RemoteGamepad {
+    info: GamepadInfo,
+    reader: BufReader<TcpStream>,
+}
+
+impl RemoteGamepad {
+    /// Run the server handshake on `stream` and wrap it
+    ///
+    /// A peer that hasn't finished the handshake within `timeout` is dropped;
+    /// once it has, events may be as far apart as the player likes.
+    pub fn from_stream(
+        mut stream: TcpStream,
+        token: &[u8],
+        timeout: Duration,
+    ) -> anyhow::Result<Self> {
+        let peer = stream.peer_addr().map(|a| a.to_string()).unwrap_or_else(|_| "?".into());
+        stream.set_read_timeout(Some(timeout))?;
+        stream.set_write_timeout(Some(timeout))?;
+        let info = protocol::server_handshake(&mut stream, token, &peer)?;
+        stream.set_read_timeout(None)?;
+        stream.set_write_timeout(None)?;
+        Ok(Self { info, reader: BufReader::new(stream) })
+    }
+}
+
+impl Gamepad for RemoteGamepad {
+    fn get_info(&self) -> GamepadInfo {
+        self.info.clone()
+    }
+
+    fn read_event(&mut self) -> anyhow::Result<Option<InputEvent>> {
+        let mut frame = [0u8; FRAME_LEN];
+        match self.reader.read_exact(&mut frame) {
+            Ok(()) => Ok(Some(protocol::decode_event(&frame, Instant::now())?)),
+            // Sender went away: same as a local device being unplugged
+            Err(e) if matches!(e.kind(), ErrorKind::UnexpectedEof | ErrorKind::ConnectionReset) => {
+                Ok(None)
+            }
+            Err(e) => Err(anyhow::anyhow!("Failed to read forwarded event: {}", e)),
+        }
+    }
+
+    fn close(self) -> anyhow::Result<()> {
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::TcpListener;
+
+    #[test]
+    fn test_silent_peer_is_dropped() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let _silent = TcpStream::connect(listener.local_addr().unwrap()).unwrap();
+        let (stream, _) = listener.accept().unwrap();
+
+        let started = Instant::now();
+        assert!(RemoteGamepad::from_stream(stream, b"token", Duration::from_millis(100)).is_err());
+        assert!(started.elapsed() < Duration::from_secs(2));
+    }
+}
@@ -0,0 +1,43 @@
+// Remote forwarding - stream controller input between machines
+//
+// A sender reads events from a local gamepad and writes them to a TCP
+// connection; the receiver exposes that connection as a regular `Gamepad`,
+// so the normal mapping engine and virtual keyboard run on the receiving
+// machine (netevent-style). Connections are authenticated with a shared
+// token but not encrypted; use a trusted network or an SSH tunnel.
+
+mod auth;
+mod gamepad;
+mod protocol;
+mod sender;
+
+pub use gamepad::RemoteGamepad;
+pub use protocol::{DEFAULT_PORT, ForwardError};
+pub use sender::forward_events;
+
+use std::net::TcpStream;
+use std::time::Duration;
+
+/// Environment variable holding the shared forwarding token
+pub const TOKEN_ENV: &str = "BLAZEREMAP_FORWARD_TOKEN";
+
+/// Time a connecting peer has to authenticate and announce its gamepad
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Connect to a receiver, authenticate and announce the gamepad
+pub fn connect(
+    addr: &str,
+    token: &str,
+    info: &crate::input::GamepadInfo,
+) -> anyhow::Result<TcpStream> {
+    let mut stream = TcpStream::connect(addr)?;
+    stream.set_nodelay(true)?;
+    protocol::client_handshake(&mut stream, token.as_bytes(), info)?;
+    Ok(stream)
+}
+
+/// Authenticate an incoming connection and wrap it as a gamepad
+pub fn accept(stream: TcpStream, token: &str) -> anyhow::Result<RemoteGamepad> {
+    stream.set_nodelay(true)?;
+    RemoteGamepad::from_stream(stream, token.as_bytes(), HANDSHAKE_TIMEOUT)
+}
@@ -0,0 +1,299 @@
+// Wire protocol for remote forwarding
+//
+// Handshake (all integers big-endian):
+//   server -> client: MAGIC, VERSION, nonce[16]
+//   client -> server: MAC[32], vendor_id u16, product_id u16, name_len u16, name
+//   server -> client: status u8 (0 = accepted)
+// Then the client streams fixed-size event frames until it disconnects:
+//   kind u8, code u8, reserved u16, value i32
+
+use super::auth::{self, MAC_LEN, NONCE_LEN};
+use crate::event::{AxisCode, ButtonCode, InputEvent};
+use crate::input::GamepadInfo;
+use std::io::{Read, Write};
+use std::time::Instant;
+use thiserror::Error;
+
+/// Port used when an address is given without one
+pub const DEFAULT_PORT: u16 = 7531;
+
+const MAGIC: &[u8; 4] = b"BZRF";
+const VERSION: u8 = 1;
+const STATUS_OK: u8 = 0;
+const STATUS_AUTH_FAILED: u8 = 1;
+const MAX_NAME_LEN: usize = 256;
+
+pub(super) const FRAME_LEN: usize = 8;
+
+const KIND_BUTTON: u8 = 0;
+const KIND_AXIS: u8 = 1;
+const KIND_SYNC: u8 = 2;
+
+// Wire codes are indexes into these tables. Append only: reordering breaks
+// compatibility with older peers.
+const BUTTONS: [ButtonCode; 22] = [
+    ButtonCode::South,
+    ButtonCode::East,
+    ButtonCode::North,
+    ButtonCode::West,
+    ButtonCode::LeftShoulder,
+    ButtonCode::RightShoulder,
+    ButtonCode::LeftTrigger,
+    ButtonCode::RightTrigger,
+    ButtonCode::Select,
+    ButtonCode::Start,
+    ButtonCode::LeftStick,
+    ButtonCode::RightStick,
+    ButtonCode::Mode,
+    ButtonCode::Misc1,
+    ButtonCode::Paddle1,
+    ButtonCode::Paddle2,
+    ButtonCode::Paddle3,
+    ButtonCode::Paddle4,
+    ButtonCode::Touchpad,
+    ButtonCode::LeftPad,
+    ButtonCode::RightPad,
+    ButtonCode::Unknown,
+];
+
+const AXES: [AxisCode; 13] = [
+    AxisCode::LeftX,
+    AxisCode::LeftY,
+    AxisCode::RightX,
+    AxisCode::RightY,
+    AxisCode::LeftTrigger,
+    AxisCode::RightTrigger,
+    AxisCode::DPadX,
+    AxisCode::DPadY,
+    AxisCode::LeftPadX,
+    AxisCode::LeftPadY,
+    AxisCode::RightPadX,
+    AxisCode::RightPadY,
+    AxisCode::Unknown,
+];
+
+#[derive(Debug, Error)]
+pub enum ForwardError {
+    #[error("peer is not a BlazeRemap forwarder")]
+    BadMagic,
+
+    #[error("unsupported protocol version {0}")]
+    UnsupportedVersion(u8),
+
+    #[error("authentication failed (check the forwarding token)")]
+    AuthenticationFailed,
+
+    #[error("malformed frame")]
+    MalformedFrame,
+}
+
+/// Server side of the handshake; returns the announced gamepad info
+pub(super) fn server_handshake<S: Read + Write>(
+    stream: &mut S,
+    token: &[u8],
+    peer: &str,
+) -> anyhow::Result<GamepadInfo> {
+    let nonce = auth::new_nonce()?;
+    let mut hello = Vec::with_capacity(MAGIC.len() + 1 + NONCE_LEN);
+    hello.extend_from_slice(MAGIC);
+    hello.push(VERSION);
+    hello.extend_from_slice(&nonce);
+    stream.write_all(&hello)?;
+
+    let mut mac = [0u8; MAC_LEN];
+    stream.read_exact(&mut mac)?;
+    if !auth::constant_time_eq(&mac, &auth::challenge_response(token, &nonce)) {
+        // Best effort: the client may already be gone
+        let _ = stream.write_all(&[STATUS_AUTH_FAILED]);
+        return Err(ForwardError::AuthenticationFailed.into());
+    }
+
+    let vendor_id = read_u16(stream)?;
+    let product_id = read_u16(stream)?;
+    let name_len = read_u16(stream)? as usize;
+    if name_len > MAX_NAME_LEN {
+        return Err(ForwardError::MalformedFrame.into());
+    }
+    let mut name = vec![0u8; name_len];
+    stream.read_exact(&mut name)?;
+
+    stream.write_all(&[STATUS_OK])?;
+
+    Ok(remote_info(peer, String::from_utf8_lossy(&name).into_owned(), vendor_id, product_id))
+}
+
+/// Client side of the handshake
+pub(super) fn client_handshake<S: Read + Write>(
+    stream: &mut S,
+    token: &[u8],
+    info: &GamepadInfo,
+) -> anyhow::Result<()> {
+    let mut magic = [0u8; 4];
+    stream.read_exact(&mut magic)?;
+    if &magic != MAGIC {
+        return Err(ForwardError::BadMagic.into());
+    }
+    let mut version = [0u8; 1];
+    stream.read_exact(&mut version)?;
+    if version[0] != VERSION {
+        return Err(ForwardError::UnsupportedVersion(version[0]).into());
+    }
+    let mut nonce = [0u8; NONCE_LEN];
+    stream.read_exact(&mut nonce)?;
+
+    let name = info.name.as_bytes();
+    let name = &name[..name.len().min(MAX_NAME_LEN)];
+
+    let mut reply = Vec::with_capacity(MAC_LEN + 6 + name.len());
+    reply.extend_from_slice(&auth::challenge_response(token, &nonce));
+    reply.extend_from_slice(&info.vendor_id.to_be_bytes());
+    reply.extend_from_slice(&info.product_id.to_be_bytes());
+    reply.extend_from_slice(&(name.len() as u16).to_be_bytes());
+    reply.extend_from_slice(name);
+    stream.write_all(&reply)?;
+
+    let mut status = [0u8; 1];
+    stream.read_exact(&mut status)?;
+    if status[0] != STATUS_OK {
+        return Err(ForwardError::AuthenticationFailed.into());
+    }
+    Ok(())
+}
+
+fn read_u16<R: Read>(reader: &mut R) -> std::io::Result<u16> {
+    let mut buf = [0u8; 2];
+    reader.read_exact(&mut buf)?;
+    Ok(u16::from_be_bytes(buf))
+}
+
+fn remote_info(peer: &str, name: String, vendor_id: u16, product_id: u16) -> GamepadInfo {
+    use crate::input::gamepad::{get_known_vendor_database, identify_gamepad};
+
+    let vendor_name = get_known_vendor_database()
+        .get(&vendor_id)
+        .map(|&name| name.to_string())
+        .unwrap_or_else(|| format!("Unknown (0x{:04X})", vendor_id));
+
+    GamepadInfo {
+        path: format!("tcp://{}", peer),
+        name,
+        gamepad_type: identify_gamepad(vendor_id, product_id),
+        vendor_id,
+        vendor_name,
+        product_id,
+        uniq: None,
+        phys: None,
+        capabilities: Vec::new(),
+    }
+}
+
+/// Encode an event; timestamps are not sent, the receiver restamps on arrival
+pub(super) fn encode_event(event: &InputEvent) -> [u8; FRAME_LEN] {
+    let (kind, code, value) = match *event {
+        InputEvent::Button { code, pressed, .. } => {
+            (KIND_BUTTON, index_of(&BUTTONS, code), pressed as i32)
+        }
+        InputEvent::Axis { code, value, .. } => (KIND_AXIS, index_of(&AXES, code), value),
+        InputEvent::Sync { .. } => (KIND_SYNC, 0, 0),
+    };
+
+    let mut frame = [0u8; FRAME_LEN];
+    frame[0] = kind;
+    frame[1] = code;
+    frame[4..].copy_from_slice(&value.to_be_bytes());
+    frame
+}
+
+/// Decode a frame received at `timestamp`
+pub(super) fn decode_event(
+    frame: &[u8; FRAME_LEN],
+    timestamp: Instant,
+) -> Result<InputEvent, ForwardError> {
+    let code = frame[1] as usize;
+    let value = i32::from_be_bytes([frame[4], frame[5], frame[6], frame[7]]);
+
+    match frame[0] {
+        KIND_BUTTON => {
+            let code = *BUTTONS.get(code).ok_or(ForwardError::MalformedFrame)?;
+            Ok(InputEvent::Button { code, pressed: value != 0, timestamp })
+        }
+        KIND_AXIS => {
+            let code = *AXES.get(code).ok_or(ForwardError::MalformedFrame)?;
+            Ok(InputEvent::Axis { code, value, timestamp })
+        }
+        KIND_SYNC => Ok(InputEvent::Sync { timestamp }),
+        _ => Err(ForwardError::MalformedFrame),
+    }
+}
+
+fn index_of<T: PartialEq>(table: &[T], item: T) -> u8 {
+    // Unknown is always last, so anything missing degrades to it
+    table.iter().position(|t| *t == item).unwrap_or(table.len() - 1) as u8
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::{TcpListener, TcpStream};
+    use std::thread;
+
+    fn test_info() -> GamepadInfo {
+        remote_info("local", "Test Pad".to_string(), 0x054c, 0x09cc)
+    }
+
+    #[test]
+    fn test_event_round_trip() {
+        let now = Instant::now();
+        let events = [
+            InputEvent::Button { code: ButtonCode::Paddle3, pressed: true, timestamp: now },
+            InputEvent::Axis { code: AxisCode::LeftPadY, value: -32768, timestamp: now },
+            InputEvent::Sync { timestamp: now },
+        ];
+
+        for event in events {
+            let frame = encode_event(&event);
+            let decoded = decode_event(&frame, now).unwrap();
+            assert_eq!(encode_event(&decoded), frame);
+            assert_eq!(decoded.timestamp(), now);
+        }
+    }
+
+    #[test]
+    fn test_decode_rejects_unknown_kind() {
+        let frame = [9u8, 0, 0, 0, 0, 0, 0, 0];
+        assert!(decode_event(&frame, Instant::now()).is_err());
+    }
+
+    fn handshake(server_token: &'static [u8], client_token: &'static [u8]) -> anyhow::Result<()> {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+
+        let server = thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            server_handshake(&mut stream, server_token, "peer")
+        });
+
+        let mut client = TcpStream::connect(addr).unwrap();
+        let client_result = client_handshake(&mut client, client_token, &test_info());
+        let server_result = server.join().unwrap();
+
+        let info = server_result?;
+        assert_eq!(info.name, "Test Pad");
+        assert_eq!(info.path, "tcp://peer");
+        client_result
+    }
+
+    #[test]
+    fn test_handshake_accepts_matching_token() {
+        assert!(handshake(b"secret", b"secret").is_ok());
+    }
+
+    #[test]
+    fn test_handshake_rejects_wrong_token() {
+        let err = handshake(b"secret", b"guess").unwrap_err();
+        assert!(matches!(
+            err.downcast_ref::<ForwardError>(),
+            Some(ForwardError::AuthenticationFailed)
+        ));
+    }
+}
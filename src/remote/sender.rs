@@ -0,0 +1,45 @@
+// Sending end: pump local gamepad events into a connection
+
+use super::protocol;
+use crate::input::gamepad::Gamepad;
+use std::io::Write;
+
+/// Forward events from `gamepad` to `writer` until the device disconnects
+///
+/// Returns the number of events sent.
+pub fn forward_events<W: Write>(gamepad: &mut dyn Gamepad, writer: &mut W) -> anyhow::Result<u64> {
+    let mut sent = 0;
+
+    while let Some(event) = gamepad.read_event()? {
+        writer.write_all(&protocol::encode_event(&event))?;
+        sent += 1;
+    }
+
+    writer.flush()?;
+    Ok(sent)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ButtonCode, InputEvent};
+    use crate::input::gamepad::MockGamepad;
+
+    #[test]
+    fn test_forward_events_until_disconnect() {
+        let mut gamepad = MockGamepad::new();
+        let mut events = vec![
+            Some(InputEvent::button_press(ButtonCode::South)),
+            Some(InputEvent::button_release(ButtonCode::South)),
+            None,
+        ]
+        .into_iter();
+        gamepad.expect_read_event().times(3).returning(move || Ok(events.next().unwrap()));
+
+        let mut buffer = Vec::new();
+        let sent = forward_events(&mut gamepad, &mut buffer).unwrap();
+
+        assert_eq!(sent, 2);
+        assert_eq!(buffer.len(), 2 * protocol::FRAME_LEN);
+    }
+}
@@ -0,0 +1,373 @@
+// Embeddable remapping sessions
+//
+// The supported way for other programs (launchers, kiosk shells) to run
+// BlazeRemap in-process instead of shelling out to `blazeremap run`: pick
+// devices and a profile, start a session, stop it when done. A session owns
+// the same pipeline as the CLI: reader thread → ring buffer → mapper thread
+// → virtual keyboard, mouse and gamepad, as the profile maps to them.
+
+use anyhow::{Context, Result};
+use std::sync::{Arc, mpsc};
+use std::thread::JoinHandle;
+
+use crate::{
+    action::{ActionDispatcher, ActionPolicy},
+    event::{EventLoop, EventTap, RingCloser, TapEvent},
+    input::{
+        InputDetectionResult, InputManager, alias,
+        gamepad::{BufferedGamepad, GamepadType, buffered::DEFAULT_RING_CAPACITY},
+        manager::NoControllers,
+    },
+    mapping::{MappingEngine, context::ContextWatcher, profile::Profile},
+    metrics::{MetricsSnapshot, PipelineMetrics},
+    output::{
+        devices::{DeviceKinds, VirtualDevices},
+        feedback::{StickyCue, SwitchCue},
+        gamepad::VirtualGamepadIdentity,
+        identity::VirtualDeviceIdentity,
+        keyboard::VirtualKeyboard,
+        notify::Notifications,
+    },
+    platform::{self, thread},
+};
+
+/// List connected controllers (same as `blazeremap detect`)
+pub fn list_gamepads() -> Result<InputDetectionResult> {
+    platform::new_input_manager()?.list_gamepads()
+}
+
+/// What a session reads, how it maps and how its threads are scheduled
+#[derive(Debug, Clone)]
+pub struct SessionConfig {
+    /// Device paths to read together; empty = first detected controller
+    pub devices: Vec<String>,
+    /// Mappings to apply; None = the built-in default profile
+    pub profile: Option<Profile>,
+    /// Name of the virtual keyboard as seen by the OS, unless the profile's
+    /// `virtual_devices` names it
+    pub keyboard_name: String,
+    /// Request real-time scheduling for the pipeline threads
+    pub realtime: bool,
+    /// Pin the reader thread to these CPUs
+    pub reader_cpus: Option<Vec<usize>>,
+    /// Pin the mapper thread to these CPUs
+    pub mapper_cpus: Option<Vec<usize>>,
+    /// Restrictions on the profile's actions
+    pub actions: ActionPolicy,
+}
+
+impl Default for SessionConfig {
+    fn default() -> Self {
+        Self {
+            devices: Vec::new(),
+            profile: None,
+            keyboard_name: "BlazeRemap Virtual Keyboard".to_string(),
+            realtime: false,
+            reader_cpus: None,
+            mapper_cpus: None,
+            actions: ActionPolicy::default(),
+        }
+    }
+}
+
+/// A running remap pipeline
+///
+/// Dropping a session without `stop` leaves it running until its controller
+/// disconnects.
+pub struct Session {
+    thread: JoinHandle<Result<()>>,
+    closer: RingCloser,
+    metrics: Arc<PipelineMetrics>,
+    tap: EventTap,
+    devices: Vec<String>,
+}
+
+// Handed from the mapper thread back to `start` once setup succeeded
+struct Started {
+    closer: RingCloser,
+    metrics: Arc<PipelineMetrics>,
+    tap: EventTap,
+    devices: Vec<String>,
+}
+
+impl Session {
+    /// Open the devices, create the virtual devices the profile maps to and
+    /// start remapping
+    ///
+    /// Returns once everything is set up, so device and permission errors
+    /// are reported here rather than from the background thread.
+    pub fn start(config: SessionConfig) -> Result<Self> {
+        platform::check_virtual_device_access()?;
+        Self::start_with(config, platform::new_input_manager, platform::new_virtual_keyboard)
+    }
+
+    /// `start` with injectable platform factories (for tests)
+    pub(crate) fn start_with<M, K>(
+        config: SessionConfig,
+        make_manager: M,
+        make_keyboard: K,
+    ) -> Result<Self>
+    where
+        M: FnOnce() -> Result<Box<dyn InputManager>> + Send + 'static,
+        K: FnOnce(&VirtualDeviceIdentity) -> Result<Box<dyn VirtualKeyboard>> + Send + 'static,
+    {
+        let (ready_tx, ready_rx) = mpsc::sync_channel(1);
+
+        let thread =
+            std::thread::Builder::new().name("blazeremap-mapper".to_string()).spawn(move || {
+                let (event_loop, started, _claim) = match build(config, make_manager, make_keyboard)
+                {
+                    Ok(built) => built,
+                    Err(e) => {
+                        let _ = ready_tx.send(Err(e));
+                        return Ok(());
+                    }
+                };
+                let _ = ready_tx.send(Ok(started));
+                event_loop.run()
+            })?;
+
+        match ready_rx.recv() {
+            Ok(Ok(Started { closer, metrics, tap, devices })) => {
+                Ok(Self { thread, closer, metrics, tap, devices })
+            }
+            Ok(Err(e)) => Err(e),
+            Err(_) => match thread.join() {
+                Ok(result) => result.and(Err(anyhow::anyhow!("session thread exited early"))),
+                Err(_) => anyhow::bail!("session thread panicked during setup"),
+            },
+        }
+    }
+
+    /// Device paths this session reads
+    pub fn devices(&self) -> &[String] {
+        &self.devices
+    }
+
+    /// Current pipeline counters and latency histograms
+    pub fn metrics(&self) -> MetricsSnapshot {
+        self.metrics.snapshot()
+    }
+
+    /// Live feed of controller input and the keyboard events it produced
+    ///
+    /// Drop the receiver to unsubscribe. Events are lost rather than
+    /// queued without bound if the receiver isn't drained.
+    pub fn subscribe(&self) -> mpsc::Receiver<TapEvent> {
+        self.tap.subscribe()
+    }
+
+    /// True once the session ended (controller gone, error or `stop`)
+    pub fn is_finished(&self) -> bool {
+        self.thread.is_finished()
+    }
+
+    /// Stop remapping and wait for the mapper thread
+    ///
+    /// Events already read are still mapped. The device itself is released
+    /// by the reader thread after its next event.
+    pub fn stop(self) -> Result<()> {
+        self.closer.close();
+        self.wait()
+    }
+
+    /// Block until the session ends on its own (e.g. controller unplugged)
+    pub fn wait(self) -> Result<()> {
+        self.thread.join().map_err(|_| anyhow::anyhow!("session thread panicked"))?
+    }
+}
+
+/// Set up the pipeline on the mapper thread
+///
+/// The claim on the devices is held by the mapper thread while it runs.
+fn build<M, K>(
+    config: SessionConfig,
+    make_manager: M,
+    make_keyboard: K,
+) -> Result<(EventLoop, Started, platform::DeviceClaim)>
+where
+    M: FnOnce() -> Result<Box<dyn InputManager>>,
+    K: FnOnce(&VirtualDeviceIdentity) -> Result<Box<dyn VirtualKeyboard>> + 'static,
+{
+    thread::tune_current_thread("mapper", config.realtime, config.mapper_cpus.as_deref());
+
+    let manager = make_manager()?;
+    let devices = if config.devices.is_empty() {
+        let gamepads = manager.list_gamepads()?;
+        match gamepads.gamepad_info.first() {
+            Some(info) => vec![info.path.clone()],
+            None => return Err(NoControllers::Connected.into()),
+        }
+    } else {
+        // Aliases name controllers whatever their node
+        config
+            .devices
+            .iter()
+            .map(|device| alias::resolve_user(manager.as_ref(), device))
+            .collect::<Result<_>>()?
+    };
+
+    let claim = platform::claim_devices(&devices)?;
+    let controller = match devices.as_slice() {
+        [path] => manager.open_gamepad(path),
+        paths => manager.open_gamepads(paths),
+    }
+    .context("Failed to open controller")?;
+
+    let profile = config.profile.unwrap_or_else(Profile::default_profile);
+    let identities = &profile.settings.virtual_devices;
+    if let Some(problem) = identities.problem() {
+        anyhow::bail!("Invalid virtual device settings: {}", problem);
+    }
+    let engine = MappingEngine::load_from_profile(&profile)?;
+    let actions = ActionDispatcher::for_profile(&profile, &config.actions)?;
+    let context = ContextWatcher::for_profile(&profile, &devices[0])?;
+    let sticky_cue = StickyCue::for_profile(&profile, &devices[0]);
+    let switch_cue = SwitchCue::for_profile(&profile, &devices[0]);
+    let notifications =
+        Notifications::for_profile(&profile, &devices[0], &controller.get_info().name);
+
+    let (realtime, reader_cpus) = (config.realtime, config.reader_cpus);
+    let controller = BufferedGamepad::spawn_with(controller, DEFAULT_RING_CAPACITY, move || {
+        thread::tune_current_thread("reader", realtime, reader_cpus.as_deref());
+    })
+    .context("Failed to start controller reader")?;
+    let closer = controller.closer();
+    let ring_counters = controller.counters();
+
+    let mut identity = VirtualGamepadIdentity::simulated(GamepadType::XboxOne);
+    identity.name = "BlazeRemap Virtual Gamepad".to_string();
+    identities.gamepad.apply_to_gamepad(&mut identity);
+    let keyboard = identities.keyboard(&config.keyboard_name);
+    let mouse = identities.mouse("BlazeRemap Virtual Mouse");
+    let mut outputs = VirtualDevices::new()
+        .with_lazy_keyboard(move || make_keyboard(&keyboard))
+        .with_lazy_mouse(move || platform::new_virtual_mouse(&mouse))
+        .with_lazy_gamepad(move || platform::new_virtual_gamepad(&identity));
+    for (name, device) in identities.custom.clone() {
+        let made_name = name.clone();
+        outputs = outputs
+            .with_lazy_custom(&name, move || platform::new_custom_device(&made_name, &device));
+    }
+    outputs.prepare(DeviceKinds::for_profile(&profile))?;
+
+    let tap = EventTap::new();
+    let mut event_loop = EventLoop::for_devices(Box::new(controller), engine, outputs)
+        .with_ring_counters(ring_counters)
+        .with_tap(tap.clone());
+    if let Some(actions) = actions {
+        event_loop = event_loop.with_actions(actions);
+    }
+    if let Some(context) = context {
+        event_loop = event_loop.with_context(context);
+    }
+    if let Some(cue) = sticky_cue {
+        event_loop = event_loop.with_sticky_cue(cue);
+    }
+    if let Some(cue) = switch_cue {
+        event_loop = event_loop.with_switch_cue(cue);
+    }
+    if let Some(mut notifications) = notifications {
+        notifications.connected();
+        event_loop = event_loop.with_notifications(notifications);
+    }
+    let metrics = event_loop.metrics();
+    Ok((event_loop, Started { closer, metrics, tap, devices }, claim))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{AxisCode, ButtonCode, InputEvent};
+    use crate::input::gamepad::{GamepadInfo, GamepadType, MockGamepad};
+    use crate::input::manager::MockInputManager;
+    use crate::output::keyboard::MockVirtualKeyboard;
+
+    fn test_info() -> GamepadInfo {
+        GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Test Gamepad".to_string(),
+            gamepad_type: GamepadType::XboxOne,
+            vendor_id: 0,
+            vendor_name: String::new(),
+            product_id: 0,
+            uniq: None,
+            phys: None,
+            capabilities: vec![],
+        }
+    }
+
+    fn manager_with(gamepad: MockGamepad) -> Box<dyn InputManager> {
+        let mut gamepad = Some(gamepad);
+        let mut manager = MockInputManager::new();
+        manager.expect_list_gamepads().returning(|| {
+            Ok(InputDetectionResult { gamepad_info: vec![test_info()], errors: vec![] })
+        });
+        manager.expect_open_gamepad().returning(move |_| Ok(Box::new(gamepad.take().unwrap())));
+        Box::new(manager)
+    }
+
+    #[test]
+    fn test_session_maps_until_disconnect() {
+        let mut events =
+            vec![InputEvent::button_press(ButtonCode::South), InputEvent::sync()].into_iter();
+        let mut gamepad = MockGamepad::new();
+        gamepad.expect_get_info().returning(test_info);
+        gamepad.expect_read_event().returning(move || Ok(events.next()));
+
+        let mut keyboard = MockVirtualKeyboard::new();
+        keyboard.expect_emit_frame().times(1).returning(|_| Ok(()));
+
+        let session = Session::start_with(
+            SessionConfig::default(),
+            move || Ok(manager_with(gamepad)),
+            move |_| Ok(Box::new(keyboard)),
+        )
+        .unwrap();
+
+        assert_eq!(session.devices(), ["/dev/input/event3"]);
+        let metrics = Arc::clone(&session.metrics);
+        session.wait().unwrap();
+        assert_eq!(metrics.snapshot().frames, 1);
+    }
+
+    #[test]
+    fn test_stop_ends_a_live_session() {
+        // A controller that keeps reporting stick noise forever
+        let mut gamepad = MockGamepad::new();
+        gamepad.expect_get_info().returning(test_info);
+        gamepad.expect_read_event().returning(|| {
+            std::thread::sleep(std::time::Duration::from_millis(5));
+            Ok(Some(InputEvent::axis_move(AxisCode::LeftX, 200)))
+        });
+
+        let session = Session::start_with(
+            SessionConfig::default(),
+            move || Ok(manager_with(gamepad)),
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+        )
+        .unwrap();
+
+        assert!(!session.is_finished());
+        session.stop().unwrap();
+    }
+
+    #[test]
+    fn test_start_reports_setup_errors() {
+        let mut manager = MockInputManager::new();
+        manager
+            .expect_list_gamepads()
+            .returning(|| Ok(InputDetectionResult { gamepad_info: vec![], errors: vec![] }));
+
+        let result = Session::start_with(
+            SessionConfig::default(),
+            move || Ok(Box::new(manager) as Box<dyn InputManager>),
+            |_| Ok(Box::new(MockVirtualKeyboard::new())),
+        );
+
+        assert_eq!(
+            result.err().unwrap().to_string(),
+            "No controllers detected. Please connect a controller."
+        );
+    }
+}
@@ -0,0 +1,111 @@
+// Git repository as a sync remote
+//
+// The repository is cloned into the user's cache directory once and pulled
+// on every sync. A profile's remote modification time is its last commit's;
+// pushed profiles go out as a single commit. Authentication is git's own:
+// SSH keys or a credential helper.
+
+use anyhow::{Context, Result};
+use sha2::{Digest, Sha256};
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use super::{RemoteFile, RemoteStore};
+
+pub struct GitStore {
+    /// The local clone
+    dir: PathBuf,
+    uploads: usize,
+}
+
+impl GitStore {
+    /// Clone `url`, or bring an earlier clone up to date
+    pub fn open(url: &str) -> Result<Self> {
+        let dir = clone_dir(url)?;
+        if dir.join(".git").is_dir() {
+            git(&dir, &["fetch", "--quiet", "origin"])?;
+            // A repository that was empty when cloned has no upstream until the first push
+            if git(&dir, &["rev-parse", "--verify", "--quiet", "@{upstream}"]).is_ok() {
+                git(&dir, &["merge", "--quiet", "--ff-only", "@{upstream}"])
+                    .context("The sync clone has diverged from the remote")?;
+            }
+        } else {
+            std::fs::create_dir_all(dir.parent().unwrap())?;
+            let path = dir.to_str().context("Cache path isn't valid UTF-8")?;
+            git(Path::new("."), &["clone", "--quiet", url, path])?;
+        }
+        Ok(Self { dir, uploads: 0 })
+    }
+}
+
+impl RemoteStore for GitStore {
+    fn list(&mut self) -> Result<Vec<RemoteFile>> {
+        let mut files = Vec::new();
+        for entry in std::fs::read_dir(&self.dir)? {
+            let entry = entry?;
+            let Some(name) = entry.file_name().to_str().map(str::to_string) else { continue };
+            if name.starts_with('.') || !entry.file_type()?.is_file() {
+                continue;
+            }
+            let committed = git(&self.dir, &["log", "-1", "--format=%ct", "--", &name])?;
+            // Not committed yet: the file itself is all there is
+            let modified = match committed.trim().parse() {
+                Ok(modified) => modified,
+                Err(_) => super::modified(&entry.path())?,
+            };
+            files.push(RemoteFile { name, modified });
+        }
+        Ok(files)
+    }
+
+    fn download(&mut self, name: &str) -> Result<Vec<u8>> {
+        Ok(std::fs::read(self.dir.join(name))?)
+    }
+
+    fn upload(&mut self, name: &str, path: &Path) -> Result<()> {
+        std::fs::copy(path, self.dir.join(name))?;
+        git(&self.dir, &["add", "--", name])?;
+        self.uploads += 1;
+        Ok(())
+    }
+
+    fn finish(&mut self) -> Result<()> {
+        // Nothing staged when every upload matched what was committed
+        if self.uploads == 0 || git(&self.dir, &["diff", "--cached", "--quiet"]).is_ok() {
+            return Ok(());
+        }
+        let message = match self.uploads {
+            1 => "Sync 1 profile".to_string(),
+            n => format!("Sync {} profiles", n),
+        };
+        git(&self.dir, &["commit", "--quiet", "--message", &message])?;
+        git(&self.dir, &["push", "--quiet", "--set-upstream", "origin", "HEAD"])?;
+        self.uploads = 0;
+        Ok(())
+    }
+}
+
+/// $XDG_CACHE_HOME/blazeremap/sync/<hash of the URL>
+fn clone_dir(url: &str) -> Result<PathBuf> {
+    let cache = match std::env::var_os("XDG_CACHE_HOME") {
+        Some(dir) if !dir.is_empty() => PathBuf::from(dir),
+        _ => PathBuf::from(std::env::var_os("HOME").context("No home directory")?).join(".cache"),
+    };
+    let hash = Sha256::digest(url.as_bytes());
+    let name: String = hash[..8].iter().map(|b| format!("{:02x}", b)).collect();
+    Ok(cache.join("blazeremap").join("sync").join(name))
+}
+
+fn git(dir: &Path, args: &[&str]) -> Result<String> {
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(dir)
+        .args(args)
+        .output()
+        .context("Failed to run git; is it installed?")?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        anyhow::bail!("git {} failed: {}", args[0], stderr.trim());
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+}
@@ -0,0 +1,519 @@
+// Profile sync with a remote store (`blazeremap profile sync`)
+//
+// Keeps a directory of profiles the same on every machine. The remote is a
+// WebDAV folder (http(s)://…), an S3 prefix (s3://bucket/prefix) or a Git
+// repository (git+<url>). WebDAV and S3 go through curl and Git through git,
+// so TLS, proxies and credentials work as they do for those tools.
+//
+// Both sides' modification times at the last sync are kept in the
+// directory's STATE_FILE. A profile changed on one side since then is copied
+// to the other; one changed on both is a conflict and left alone unless the
+// caller says which side wins. Sync only adds and updates: a profile deleted
+// on one machine comes back from the other.
+
+pub mod git;
+pub mod s3;
+pub mod webdav;
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::io::Write;
+use std::path::Path;
+use std::process::{Command, Stdio};
+use std::time::UNIX_EPOCH;
+
+use crate::mapping::format::ProfileFormat;
+
+/// File in the profile directory recording the last sync
+pub const STATE_FILE: &str = ".sync-state.toml";
+
+/// A profile in the remote store
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RemoteFile {
+    pub name: String,
+    /// Last modification, in Unix seconds
+    pub modified: u64,
+}
+
+/// Somewhere profiles are synced to
+pub trait RemoteStore {
+    /// Every file in the store; sync ignores the ones that aren't profiles
+    fn list(&mut self) -> Result<Vec<RemoteFile>>;
+
+    fn download(&mut self, name: &str) -> Result<Vec<u8>>;
+
+    /// Store the file at `path` as `name`
+    fn upload(&mut self, name: &str, path: &Path) -> Result<()>;
+
+    /// Publish the uploads, for stores that batch them
+    fn finish(&mut self) -> Result<()> {
+        Ok(())
+    }
+}
+
+/// The store a remote URL names
+pub fn open(remote: &str) -> Result<Box<dyn RemoteStore>> {
+    if let Some(location) = remote.strip_prefix("s3://") {
+        return Ok(Box::new(s3::S3Store::from_env(location)?));
+    }
+    if let Some(url) = remote.strip_prefix("git+") {
+        return Ok(Box::new(git::GitStore::open(url)?));
+    }
+    if remote.starts_with("http://") || remote.starts_with("https://") {
+        return Ok(Box::new(webdav::WebDavStore::from_env(remote)));
+    }
+    anyhow::bail!(
+        "Unknown remote '{}'; use an http(s):// WebDAV folder, s3://bucket/prefix or git+<repository>",
+        remote
+    )
+}
+
+/// Which side wins for profiles changed on both
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Prefer {
+    Local,
+    Remote,
+}
+
+/// What sync did with one profile
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Outcome {
+    Unchanged,
+    Pushed,
+    Pulled,
+    /// Changed on both sides since the last sync; left alone
+    Conflict,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct SyncState {
+    #[serde(default)]
+    profiles: BTreeMap<String, Synced>,
+}
+
+/// Both sides' modification times when a profile was last synced
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+struct Synced {
+    local: u64,
+    remote: u64,
+}
+
+/// Sync the profiles in `dir` with `store`; returns what happened to each
+pub fn sync(
+    dir: &Path,
+    store: &mut dyn RemoteStore,
+    prefer: Option<Prefer>,
+) -> Result<Vec<(String, Outcome)>> {
+    let state_path = dir.join(STATE_FILE);
+    let mut state: SyncState = match std::fs::read_to_string(&state_path) {
+        Ok(text) => toml::from_str(&text).context("Failed to parse sync state")?,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => SyncState::default(),
+        Err(e) => return Err(e).context("Failed to read sync state"),
+    };
+    let local = local_profiles(dir)?;
+    let remote: BTreeMap<String, u64> = store
+        .list()?
+        .into_iter()
+        .filter(|file| is_profile_name(&file.name))
+        .map(|file| (file.name, file.modified))
+        .collect();
+
+    let mut outcomes = Vec::new();
+    let mut pushed = Vec::new();
+    for name in local.keys().chain(remote.keys()).collect::<BTreeSet<_>>() {
+        let last = state.profiles.get(name);
+        let local_changed = local.get(name).map(|&t| last.is_none_or(|last| last.local != t));
+        let remote_changed = remote.get(name).map(|&t| last.is_none_or(|last| last.remote != t));
+        let path = dir.join(name);
+
+        let outcome = match (local_changed, remote_changed) {
+            (Some(false), Some(false)) => Outcome::Unchanged,
+            (Some(_), None) | (Some(true), Some(false)) => Outcome::Pushed,
+            (None, Some(_)) | (Some(false), Some(true)) => Outcome::Pulled,
+            (Some(true), Some(true)) => {
+                // Say both machines got the same edit some other way
+                let theirs = store.download(name)?;
+                if std::fs::read(&path).context("Failed to read profile")? == theirs {
+                    Outcome::Unchanged
+                } else {
+                    match prefer {
+                        Some(Prefer::Local) => Outcome::Pushed,
+                        Some(Prefer::Remote) => Outcome::Pulled,
+                        None => Outcome::Conflict,
+                    }
+                }
+            }
+            (None, None) => unreachable!("names come from either side"),
+        };
+
+        match outcome {
+            Outcome::Unchanged => {
+                state
+                    .profiles
+                    .insert(name.clone(), Synced { local: local[name], remote: remote[name] });
+            }
+            Outcome::Pushed => {
+                store.upload(name, &path).with_context(|| format!("Failed to push {}", name))?;
+                // The remote time is only known once the upload is published
+                state.profiles.insert(name.clone(), Synced { local: local[name], remote: 0 });
+                pushed.push(name.clone());
+            }
+            Outcome::Pulled => {
+                let contents =
+                    store.download(name).with_context(|| format!("Failed to pull {}", name))?;
+                std::fs::write(&path, contents)
+                    .with_context(|| format!("Failed to write {}", path.display()))?;
+                let synced = Synced { local: modified(&path)?, remote: remote[name] };
+                state.profiles.insert(name.clone(), synced);
+            }
+            Outcome::Conflict => {}
+        }
+        outcomes.push((name.clone(), outcome));
+    }
+
+    if !pushed.is_empty() {
+        store.finish()?;
+        let published: BTreeMap<_, _> =
+            store.list()?.into_iter().map(|file| (file.name, file.modified)).collect();
+        for name in &pushed {
+            if let (Some(synced), Some(&remote)) =
+                (state.profiles.get_mut(name), published.get(name))
+            {
+                synced.remote = remote;
+            }
+        }
+    }
+    std::fs::write(&state_path, toml::to_string(&state)?).context("Failed to write sync state")?;
+    Ok(outcomes)
+}
+
+/// Profiles in `dir` and when each last changed
+fn local_profiles(dir: &Path) -> Result<BTreeMap<String, u64>> {
+    let mut profiles = BTreeMap::new();
+    for entry in
+        std::fs::read_dir(dir).with_context(|| format!("Failed to read {}", dir.display()))?
+    {
+        let path = entry?.path();
+        if let Some(name) = path.file_name().and_then(|name| name.to_str())
+            && is_profile_name(name)
+            && path.is_file()
+        {
+            profiles.insert(name.to_string(), modified(&path)?);
+        }
+    }
+    Ok(profiles)
+}
+
+/// A plain file name with a profile extension; hidden files are sync's own
+fn is_profile_name(name: &str) -> bool {
+    !name.starts_with('.')
+        && !name.contains('/')
+        && Path::new(name)
+            .extension()
+            .and_then(|extension| extension.to_str())
+            .and_then(ProfileFormat::from_extension)
+            .is_some()
+}
+
+fn modified(path: &Path) -> Result<u64> {
+    let modified = std::fs::metadata(path)?.modified()?;
+    Ok(modified.duration_since(UNIX_EPOCH).unwrap_or_default().as_secs())
+}
+
+/// Run curl on `args`, reading further options (credentials) from `config`
+///
+/// Options on stdin stay out of the process list, unlike arguments.
+fn curl(config: &str, args: &[&str]) -> Result<Vec<u8>> {
+    let mut child = Command::new("curl")
+        .args(["--config", "-", "--silent", "--show-error", "--fail", "--location"])
+        .args(args)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .context("Failed to run curl; is it installed?")?;
+    child.stdin.take().unwrap().write_all(config.as_bytes())?;
+    let output = child.wait_with_output()?;
+    if !output.status.success() {
+        anyhow::bail!("curl failed: {}", String::from_utf8_lossy(&output.stderr).trim());
+    }
+    Ok(output.stdout)
+}
+
+/// One `name = "value"` line of a curl config file
+fn curl_option(name: &str, value: &str) -> String {
+    format!("{} = \"{}\"\n", name, value.replace('\\', "\\\\").replace('"', "\\\""))
+}
+
+/// Percent-encode a path segment
+fn encode_segment(segment: &str) -> String {
+    segment
+        .bytes()
+        .map(|b| match b {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'.' | b'_' | b'~' => {
+                (b as char).to_string()
+            }
+            _ => format!("%{:02X}", b),
+        })
+        .collect()
+}
+
+fn decode_segment(segment: &str) -> String {
+    let bytes = segment.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let hex = bytes.get(i + 1..i + 3).and_then(|hex| std::str::from_utf8(hex).ok());
+        match (bytes[i], hex.and_then(|hex| u8::from_str_radix(hex, 16).ok())) {
+            (b'%', Some(byte)) => {
+                out.push(byte);
+                i += 3;
+            }
+            (byte, _) => {
+                out.push(byte);
+                i += 1;
+            }
+        }
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+/// Text of every `name` element in `xml`, whatever its namespace prefix
+///
+/// Just enough XML for directory listings: no CDATA, comments or nesting
+/// of same-named elements.
+fn xml_elements<'a>(xml: &'a str, name: &str) -> Vec<&'a str> {
+    let mut found = Vec::new();
+    let mut rest = xml;
+    while let Some(start) = rest.find('<') {
+        rest = &rest[start + 1..];
+        let tag_end = rest.find(['>', ' ', '\t', '\r', '\n', '/']).unwrap_or(rest.len());
+        let tag = &rest[..tag_end];
+        let local = tag.rsplit(':').next().unwrap_or(tag);
+        if local != name || tag.starts_with(['/', '?', '!']) {
+            continue;
+        }
+        let Some(open_end) = rest.find('>') else { break };
+        if rest[..open_end].ends_with('/') {
+            found.push("");
+            continue;
+        }
+        let body = &rest[open_end + 1..];
+        let Some(close) = body.find(&format!("</{}>", tag)) else { break };
+        found.push(&body[..close]);
+        rest = &body[close..];
+    }
+    found
+}
+
+/// Character data with the predefined entities expanded
+fn xml_text(text: &str) -> String {
+    text.trim()
+        .replace("&lt;", "<")
+        .replace("&gt;", ">")
+        .replace("&quot;", "\"")
+        .replace("&apos;", "'")
+        .replace("&amp;", "&")
+}
+
+/// Unix seconds of an HTTP date, like `Tue, 15 Nov 1994 12:45:26 GMT`
+fn parse_http_date(date: &str) -> Option<u64> {
+    const MONTHS: [&str; 12] =
+        ["Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"];
+    let [_, day, month, year, time, "GMT"] = date.split_whitespace().collect::<Vec<_>>()[..] else {
+        return None;
+    };
+    let month = MONTHS.iter().position(|&m| m == month)? as u32 + 1;
+    unix_time(year.parse().ok()?, month, day.parse().ok()?, time)
+}
+
+/// Unix seconds of an ISO 8601 UTC time, like `2009-10-12T17:50:30.000Z`
+fn parse_iso8601(date: &str) -> Option<u64> {
+    let (day, time) = date.strip_suffix('Z')?.split_once('T')?;
+    let [year, month, day] = day.splitn(3, '-').collect::<Vec<_>>()[..] else {
+        return None;
+    };
+    let (month, day) = (month.parse().ok()?, day.parse().ok()?);
+    unix_time(year.parse().ok()?, month, day, time.split('.').next()?)
+}
+
+/// `time` is `hh:mm:ss`
+fn unix_time(year: i64, month: u32, day: u32, time: &str) -> Option<u64> {
+    let mut hms = time.splitn(3, ':').map(str::parse::<u64>);
+    let (h, m, s) = (hms.next()?.ok()?, hms.next()?.ok()?, hms.next()?.ok()?);
+    if !(1..=12).contains(&month) || !(1..=31).contains(&day) || h > 23 || m > 59 || s > 60 {
+        return None;
+    }
+    // Days since the epoch of a proleptic Gregorian date (Howard Hinnant's algorithm)
+    let year = if month <= 2 { year - 1 } else { year };
+    let era = year.div_euclid(400);
+    let year_of_era = year - era * 400;
+    let day_of_year = (153 * ((month + 9) % 12) + 2) / 5 + day - 1;
+    let day_of_era = year_of_era * 365 + year_of_era / 4 - year_of_era / 100 + day_of_year as i64;
+    let days = era * 146_097 + day_of_era - 719_468;
+    u64::try_from(days).ok().map(|days| days * 86_400 + h * 3600 + m * 60 + s)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashMap;
+    use std::time::{Duration, SystemTime};
+
+    /// Store in memory with a clock of its own
+    #[derive(Default)]
+    struct MemoryStore {
+        files: HashMap<String, (Vec<u8>, u64)>,
+        clock: u64,
+        finished: usize,
+    }
+
+    impl MemoryStore {
+        fn put(&mut self, name: &str, contents: &str) {
+            self.clock += 1;
+            self.files.insert(name.to_string(), (contents.as_bytes().to_vec(), self.clock));
+        }
+
+        fn get(&self, name: &str) -> &str {
+            std::str::from_utf8(&self.files[name].0).unwrap()
+        }
+    }
+
+    impl RemoteStore for MemoryStore {
+        fn list(&mut self) -> Result<Vec<RemoteFile>> {
+            let files = self.files.iter();
+            Ok(files
+                .map(|(name, &(_, modified))| RemoteFile { name: name.clone(), modified })
+                .collect())
+        }
+
+        fn download(&mut self, name: &str) -> Result<Vec<u8>> {
+            Ok(self.files[name].0.clone())
+        }
+
+        fn upload(&mut self, name: &str, path: &Path) -> Result<()> {
+            let contents = std::fs::read_to_string(path)?;
+            self.put(name, &contents);
+            Ok(())
+        }
+
+        fn finish(&mut self) -> Result<()> {
+            self.finished += 1;
+            Ok(())
+        }
+    }
+
+    /// Write a local profile with a modification time of `age` seconds ago
+    fn write(dir: &Path, name: &str, contents: &str, age: u64) {
+        let path = dir.join(name);
+        std::fs::write(&path, contents).unwrap();
+        let modified = SystemTime::now() - Duration::from_secs(age);
+        std::fs::File::options().write(true).open(&path).unwrap().set_modified(modified).unwrap();
+    }
+
+    fn read(dir: &Path, name: &str) -> String {
+        std::fs::read_to_string(dir.join(name)).unwrap()
+    }
+
+    fn outcomes(result: Vec<(String, Outcome)>) -> Vec<(&'static str, Outcome)> {
+        let names = ["deck.yaml", "laptop.toml", "racing.toml"];
+        let name = |n: &str| *names.iter().find(|&&known| known == n).unwrap();
+        result.iter().map(|(n, outcome)| (name(n), *outcome)).collect()
+    }
+
+    #[test]
+    fn test_sync_copies_changes_and_detects_conflicts() {
+        let dir = std::env::temp_dir().join(format!("blazeremap-sync-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        write(&dir, "laptop.toml", "name = 'laptop'", 100);
+        write(&dir, "racing.toml", "name = 'racing'", 100);
+        std::fs::write(dir.join("notes.txt"), "not a profile").unwrap();
+        let mut store = MemoryStore::default();
+        store.put("deck.yaml", "name: deck");
+        store.put("racing.toml", "name = 'racing'");
+
+        // First sync: each side gets the other's; the same profile on both is fine
+        let result = sync(&dir, &mut store, None).unwrap();
+        assert_eq!(
+            outcomes(result),
+            [
+                ("deck.yaml", Outcome::Pulled),
+                ("laptop.toml", Outcome::Pushed),
+                ("racing.toml", Outcome::Unchanged),
+            ]
+        );
+        assert_eq!(read(&dir, "deck.yaml"), "name: deck");
+        assert_eq!(store.get("laptop.toml"), "name = 'laptop'");
+        assert_eq!(store.finished, 1);
+        assert!(!store.files.contains_key("notes.txt"));
+
+        let result = sync(&dir, &mut store, None).unwrap();
+        assert!(result.iter().all(|(_, outcome)| *outcome == Outcome::Unchanged));
+
+        // One side changed
+        write(&dir, "laptop.toml", "name = 'laptop 2'", 50);
+        store.put("deck.yaml", "name: deck 2");
+        let result = sync(&dir, &mut store, None).unwrap();
+        assert_eq!(
+            outcomes(result),
+            [
+                ("deck.yaml", Outcome::Pulled),
+                ("laptop.toml", Outcome::Pushed),
+                ("racing.toml", Outcome::Unchanged),
+            ]
+        );
+        assert_eq!(read(&dir, "deck.yaml"), "name: deck 2");
+        assert_eq!(store.get("laptop.toml"), "name = 'laptop 2'");
+
+        // Both changed: left alone until a side is picked
+        write(&dir, "racing.toml", "name = 'racing here'", 10);
+        store.put("racing.toml", "name = 'racing there'");
+        let result = sync(&dir, &mut store, None).unwrap();
+        assert_eq!(result[2], ("racing.toml".to_string(), Outcome::Conflict));
+        assert_eq!(read(&dir, "racing.toml"), "name = 'racing here'");
+        assert_eq!(store.get("racing.toml"), "name = 'racing there'");
+        let result = sync(&dir, &mut store, Some(Prefer::Remote)).unwrap();
+        assert_eq!(result[2], ("racing.toml".to_string(), Outcome::Pulled));
+        assert_eq!(read(&dir, "racing.toml"), "name = 'racing there'");
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn test_open_rejects_unknown_remotes() {
+        let err = open("ftp://example.com/profiles").err().unwrap();
+        assert!(err.to_string().starts_with("Unknown remote 'ftp://example.com/profiles'"));
+    }
+
+    #[test]
+    fn test_xml_elements() {
+        let xml = r#"<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:"><d:response><d:href>/a%20b.toml</d:href>
+<d:propstat><d:prop><d:getlastmodified>Tue, 15 Nov 1994 12:45:26 GMT</d:getlastmodified></d:prop></d:propstat></d:response>
+<d:response><d:href>/x/</d:href><d:propstat><d:prop><d:getlastmodified/></d:prop></d:propstat></d:response></d:multistatus>"#;
+        let responses = xml_elements(xml, "response");
+        assert_eq!(responses.len(), 2);
+        assert_eq!(xml_elements(responses[0], "href"), ["/a%20b.toml"]);
+        assert_eq!(xml_elements(responses[1], "getlastmodified"), [""]);
+        assert_eq!(xml_text(" Tom &amp; Jerry&apos;s "), "Tom & Jerry's");
+    }
+
+    #[test]
+    fn test_dates() {
+        assert_eq!(parse_http_date("Tue, 15 Nov 1994 12:45:26 GMT"), Some(784903526));
+        assert_eq!(parse_iso8601("2009-10-12T17:50:30.000Z"), Some(1255369830));
+        assert_eq!(parse_iso8601("1970-01-01T00:00:00Z"), Some(0));
+        assert_eq!(parse_iso8601("2024-02-29T23:59:59Z"), Some(1709251199));
+        assert_eq!(parse_http_date("15 Nov 1994"), None);
+        assert_eq!(parse_iso8601("2009-13-12T17:50:30Z"), None);
+    }
+
+    #[test]
+    fn test_percent_encoding() {
+        assert_eq!(encode_segment("my racing.toml"), "my%20racing.toml");
+        assert_eq!(decode_segment("my%20racing.toml"), "my racing.toml");
+        assert_eq!(decode_segment("100%"), "100%");
+        assert_eq!(curl_option("user", r#"me:p"a\ss"#), "user = \"me:p\\\"a\\\\ss\"\n");
+    }
+}
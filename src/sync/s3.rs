@@ -0,0 +1,131 @@
+// S3 bucket as a sync remote, or anything speaking the S3 API (MinIO,
+// Backblaze B2, Cloudflare R2, ...)
+//
+// Uses the AWS CLI's environment: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// optionally AWS_SESSION_TOKEN, AWS_REGION (us-east-1 by default) and
+// AWS_ENDPOINT_URL for other providers. curl signs the requests.
+
+use anyhow::{Context, Result};
+use std::path::Path;
+
+use super::{RemoteFile, RemoteStore};
+
+pub struct S3Store {
+    /// Path-style bucket URL, which every provider supports
+    bucket_url: String,
+    /// Key prefix of the profiles: empty or ending in a slash
+    prefix: String,
+    config: String,
+}
+
+impl S3Store {
+    /// `location` is `bucket` or `bucket/prefix`
+    pub fn from_env(location: &str) -> Result<Self> {
+        let var = |name: &str| std::env::var(name).ok().filter(|value| !value.is_empty());
+        let (Some(key), Some(secret)) = (var("AWS_ACCESS_KEY_ID"), var("AWS_SECRET_ACCESS_KEY"))
+        else {
+            anyhow::bail!("S3 sync needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY");
+        };
+        let region = var("AWS_REGION").or_else(|| var("AWS_DEFAULT_REGION"));
+        let region = region.unwrap_or_else(|| "us-east-1".to_string());
+        let endpoint = var("AWS_ENDPOINT_URL_S3").or_else(|| var("AWS_ENDPOINT_URL"));
+        let endpoint = endpoint.unwrap_or_else(|| format!("https://s3.{}.amazonaws.com", region));
+
+        let mut config = super::curl_option("user", &format!("{}:{}", key, secret));
+        config += &super::curl_option("aws-sigv4", &format!("aws:amz:{}:s3", region));
+        if let Some(token) = var("AWS_SESSION_TOKEN") {
+            config += &super::curl_option("header", &format!("x-amz-security-token: {}", token));
+        }
+        Self::new(&endpoint, location, config)
+    }
+
+    fn new(endpoint: &str, location: &str, config: String) -> Result<Self> {
+        let (bucket, prefix) = location.split_once('/').unwrap_or((location, ""));
+        if bucket.is_empty() {
+            anyhow::bail!("No bucket in s3://{}", location);
+        }
+        let prefix = prefix.trim_matches('/');
+        Ok(Self {
+            bucket_url: format!("{}/{}", endpoint.trim_end_matches('/'), bucket),
+            prefix: if prefix.is_empty() { String::new() } else { format!("{}/", prefix) },
+            config,
+        })
+    }
+
+    fn object_url(&self, name: &str) -> String {
+        let key = self.prefix.split('/').chain([name]).filter(|segment| !segment.is_empty());
+        let key: Vec<_> = key.map(super::encode_segment).collect();
+        format!("{}/{}", self.bucket_url, key.join("/"))
+    }
+}
+
+impl RemoteStore for S3Store {
+    // One page of up to 1000 objects, plenty for a profile folder
+    fn list(&mut self) -> Result<Vec<RemoteFile>> {
+        let prefix: Vec<_> = self.prefix.split('/').map(super::encode_segment).collect();
+        let url = format!("{}?list-type=2&prefix={}", self.bucket_url, prefix.join("/"));
+        let response = super::curl(&self.config, &[&url])
+            .with_context(|| format!("Failed to list {}", self.bucket_url))?;
+        parse_list(&String::from_utf8_lossy(&response), &self.prefix)
+    }
+
+    fn download(&mut self, name: &str) -> Result<Vec<u8>> {
+        super::curl(&self.config, &[&self.object_url(name)])
+    }
+
+    fn upload(&mut self, name: &str, path: &Path) -> Result<()> {
+        let path = path.to_str().context("Profile path isn't valid UTF-8")?;
+        super::curl(&self.config, &["--upload-file", path, &self.object_url(name)])?;
+        Ok(())
+    }
+}
+
+/// Objects right under `prefix` in a ListObjectsV2 response
+fn parse_list(xml: &str, prefix: &str) -> Result<Vec<RemoteFile>> {
+    let mut files = Vec::new();
+    for object in super::xml_elements(xml, "Contents") {
+        let key = super::xml_elements(object, "Key").first().map(|key| super::xml_text(key));
+        let Some(name) = key.as_deref().and_then(|key| key.strip_prefix(prefix)) else {
+            continue;
+        };
+        if name.is_empty() || name.contains('/') {
+            continue;
+        }
+        let modified = super::xml_elements(object, "LastModified")
+            .first()
+            .and_then(|date| super::parse_iso8601(&super::xml_text(date)))
+            .with_context(|| format!("No modification time for {} in the listing", name))?;
+        files.push(RemoteFile { name: name.to_string(), modified });
+    }
+    Ok(files)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_list() {
+        let xml = r#"<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Name>pads</Name><Prefix>profiles/</Prefix><KeyCount>3</KeyCount>
+  <Contents><Key>profiles/racing.toml</Key><LastModified>2009-10-12T17:50:30.000Z</LastModified></Contents>
+  <Contents><Key>profiles/old/racing.toml</Key><LastModified>2009-10-12T17:50:30.000Z</LastModified></Contents>
+  <Contents><Key>profiles/</Key><LastModified>2009-10-12T17:50:30.000Z</LastModified></Contents>
+</ListBucketResult>"#;
+        let files = parse_list(xml, "profiles/").unwrap();
+        assert_eq!(files, [RemoteFile { name: "racing.toml".to_string(), modified: 1255369830 }]);
+    }
+
+    #[test]
+    fn test_object_urls() {
+        let store = S3Store::new("https://s3.example.com/", "pads/my profiles/", String::new());
+        let store = store.unwrap();
+        assert_eq!(store.prefix, "my profiles/");
+        assert_eq!(store.object_url("a.toml"), "https://s3.example.com/pads/my%20profiles/a.toml");
+
+        let store = S3Store::new("https://s3.example.com", "pads", String::new()).unwrap();
+        assert_eq!(store.object_url("a.toml"), "https://s3.example.com/pads/a.toml");
+        assert!(S3Store::new("https://s3.example.com", "/profiles", String::new()).is_err());
+    }
+}
@@ -0,0 +1,115 @@
+// WebDAV folder as a sync remote, e.g. a Nextcloud or Apache mod_dav share
+//
+// Credentials come from BLAZEREMAP_SYNC_USER and BLAZEREMAP_SYNC_PASSWORD;
+// without them curl falls back to ~/.netrc.
+
+use anyhow::{Context, Result};
+use std::path::Path;
+
+use super::{RemoteFile, RemoteStore};
+
+const PROPFIND: &str = r#"<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><getlastmodified/></prop></propfind>"#;
+
+pub struct WebDavStore {
+    /// The folder, ending in a slash
+    url: String,
+    /// curl options with the credentials
+    config: String,
+}
+
+impl WebDavStore {
+    pub fn from_env(url: &str) -> Self {
+        let user = std::env::var("BLAZEREMAP_SYNC_USER").ok();
+        let password = std::env::var("BLAZEREMAP_SYNC_PASSWORD").unwrap_or_default();
+        Self::new(url, user.map(|user| (user, password)))
+    }
+
+    pub fn new(url: &str, credentials: Option<(String, String)>) -> Self {
+        let config = match credentials {
+            Some((user, password)) => super::curl_option("user", &format!("{}:{}", user, password)),
+            None => "netrc-optional\n".to_string(),
+        };
+        Self { url: format!("{}/", url.trim_end_matches('/')), config }
+    }
+
+    fn file_url(&self, name: &str) -> String {
+        format!("{}{}", self.url, super::encode_segment(name))
+    }
+}
+
+impl RemoteStore for WebDavStore {
+    fn list(&mut self) -> Result<Vec<RemoteFile>> {
+        let args = [
+            "--request",
+            "PROPFIND",
+            "--header",
+            "Depth: 1",
+            "--header",
+            "Content-Type: application/xml",
+            "--data",
+            PROPFIND,
+            &self.url,
+        ];
+        let response = super::curl(&self.config, &args)
+            .with_context(|| format!("Failed to list {}", self.url))?;
+        parse_multistatus(&String::from_utf8_lossy(&response))
+    }
+
+    fn download(&mut self, name: &str) -> Result<Vec<u8>> {
+        super::curl(&self.config, &[&self.file_url(name)])
+    }
+
+    fn upload(&mut self, name: &str, path: &Path) -> Result<()> {
+        let path = path.to_str().context("Profile path isn't valid UTF-8")?;
+        super::curl(&self.config, &["--upload-file", path, &self.file_url(name)])?;
+        Ok(())
+    }
+}
+
+/// Files in a PROPFIND response; the folder itself and subfolders are left out
+fn parse_multistatus(xml: &str) -> Result<Vec<RemoteFile>> {
+    let mut files = Vec::new();
+    for response in super::xml_elements(xml, "response") {
+        let href = super::xml_elements(response, "href").first().map(|href| super::xml_text(href));
+        let Some(href) = href.filter(|href| !href.ends_with('/')) else {
+            continue;
+        };
+        let name = super::decode_segment(href.rsplit('/').next().unwrap_or(&href));
+        let modified = super::xml_elements(response, "getlastmodified")
+            .first()
+            .and_then(|date| super::parse_http_date(&super::xml_text(date)))
+            .with_context(|| format!("No modification time for {} in the listing", name))?;
+        files.push(RemoteFile { name, modified });
+    }
+    Ok(files)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_multistatus() {
+        let xml = r#"<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response><d:href>/remote.php/dav/files/me/profiles/</d:href>
+    <d:propstat><d:prop><d:getlastmodified>Mon, 05 Oct 2026 08:00:00 GMT</d:getlastmodified></d:prop></d:propstat>
+  </d:response>
+  <d:response><d:href>/remote.php/dav/files/me/profiles/my%20racing.toml</d:href>
+    <d:propstat><d:prop><d:getlastmodified>Tue, 15 Nov 1994 12:45:26 GMT</d:getlastmodified></d:prop></d:propstat>
+  </d:response>
+  <d:response><d:href>/remote.php/dav/files/me/profiles/old/</d:href></d:response>
+</d:multistatus>"#;
+        let files = parse_multistatus(xml).unwrap();
+        assert_eq!(files, [RemoteFile { name: "my racing.toml".to_string(), modified: 784903526 }]);
+    }
+
+    #[test]
+    fn test_folder_url() {
+        let store = WebDavStore::new("https://dav.example.com/profiles", None);
+        assert_eq!(store.file_url("a b.yaml"), "https://dav.example.com/profiles/a%20b.yaml");
+        let store = WebDavStore::new("https://dav.example.com/profiles/", None);
+        assert_eq!(store.url, "https://dav.example.com/profiles/");
+    }
+}
@@ -0,0 +1,168 @@
+// Debug traces: a trace of a live session, with what the mapper made of it
+//
+// `run --trace` writes one, gzip-compressed, for chasing mappings that
+// misfire now and then. It is an ordinary trace with optional fields on
+// each event line, so `replay` plays it back like any other:
+//
+//   {"t_us":1520,"type":"button","code":"South","pressed":true,"lag_us":41,
+//    "rules":["key S"],"output":["Keyboard: S (Press)"]}
+//
+// - lag_us: kernel timestamp → mapper picking the event up
+// - rules:  what the active mappings had for the control (see
+//           `MappingEngine::rules_for`)
+// - output: the events it was mapped to
+//
+// Lines go through a shared writer so whoever stops the session (the event
+// loop ending, or Ctrl+C) can finish the file.
+
+use std::fs::File;
+use std::io::{BufWriter, Write};
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+
+use anyhow::{Context, Result};
+use flate2::{Compression, write::GzEncoder};
+use serde::Serialize;
+
+use super::{TRACE_VERSION, TraceDevice, TraceEvent, TraceHeader, TraceInput};
+use crate::event::{InputEvent, OutputEvent};
+
+/// One event of a debug trace
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct DebugEvent {
+    #[serde(flatten)]
+    pub event: TraceEvent,
+    pub lag_us: u64,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub rules: Vec<String>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub output: Vec<String>,
+}
+
+type Encoder = GzEncoder<BufWriter<File>>;
+
+/// A debug trace being written; clones write to the same file
+#[derive(Clone)]
+pub struct DebugTrace {
+    out: Arc<Mutex<Option<Encoder>>>,
+    start: Instant,
+}
+
+impl DebugTrace {
+    /// Start a trace of `device` at `path`; events are timed from now
+    pub fn create(path: &Path, device: TraceDevice) -> Result<Self> {
+        let file =
+            File::create(path).with_context(|| format!("Failed to create {}", path.display()))?;
+        let mut out = GzEncoder::new(BufWriter::new(file), Compression::default());
+        let header = TraceHeader { trace: TRACE_VERSION, device };
+        writeln!(out, "{}", serde_json::to_string(&header)?)?;
+        Ok(Self { out: Arc::new(Mutex::new(Some(out))), start: Instant::now() })
+    }
+
+    /// Append `event`, picked up by the mapper at `picked_up`, with the
+    /// rules it matched and what it was mapped to
+    pub fn record(
+        &self,
+        event: &InputEvent,
+        picked_up: Instant,
+        rules: Vec<String>,
+        output: &[OutputEvent],
+    ) {
+        let lag = picked_up.saturating_duration_since(event.timestamp());
+        self.write(&DebugEvent {
+            event: TraceEvent::from_input(event, self.start),
+            lag_us: lag.as_micros() as u64,
+            rules,
+            output: output.iter().map(ToString::to_string).collect(),
+        });
+    }
+
+    /// End the frame whose last event came at `timestamp`
+    pub fn sync(&self, timestamp: Instant) {
+        let elapsed = timestamp.saturating_duration_since(self.start);
+        self.write(&TraceEvent { t_us: elapsed.as_micros() as u64, input: TraceInput::Sync });
+    }
+
+    /// Write the end of the file; later events are dropped
+    pub fn finish(&self) -> Result<()> {
+        let Some(out) = self.out.lock().ok().and_then(|mut out| out.take()) else {
+            return Ok(());
+        };
+        out.finish()?.flush().context("Failed to finish debug trace")
+    }
+
+    /// A trace that can't be written stops, rather than the session
+    fn write(&self, line: &impl Serialize) {
+        let Ok(mut guard) = self.out.lock() else {
+            return;
+        };
+        let Some(out) = guard.as_mut() else {
+            return;
+        };
+        let written = serde_json::to_string(line)
+            .map_err(anyhow::Error::from)
+            .and_then(|line| Ok(writeln!(out, "{}", line)?));
+        if let Err(e) = written {
+            tracing::warn!("Debug trace stopped: {:#}", e);
+            guard.take();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ButtonCode, KeyboardCode, KeyboardEventType};
+    use crate::trace::Trace;
+    use std::time::Duration;
+
+    #[test]
+    fn test_debug_trace_reads_back_as_a_trace() {
+        let path = std::env::temp_dir().join(format!("blazeremap-debug-{}.gz", std::process::id()));
+        let device = TraceDevice {
+            name: "Pad".to_string(),
+            gamepad_type: "Generic".to_string(),
+            vendor_id: 1,
+            product_id: 2,
+            capabilities: Vec::new(),
+        };
+        let trace = DebugTrace::create(&path, device.clone()).unwrap();
+        let pressed_at = trace.start + Duration::from_micros(1520);
+        let press = InputEvent::button_press_at(ButtonCode::South, pressed_at);
+        let output =
+            [OutputEvent::Keyboard { code: KeyboardCode::S, event_type: KeyboardEventType::Press }];
+        trace.clone().record(
+            &press,
+            pressed_at + Duration::from_micros(41),
+            vec!["key S".to_string()],
+            &output,
+        );
+        trace.sync(pressed_at);
+        trace.finish().unwrap();
+        trace.sync(pressed_at);
+
+        let file = std::fs::File::open(&path).unwrap();
+        let read = Trace::read(file).unwrap();
+        std::fs::remove_file(&path).unwrap();
+        assert_eq!(read.header.device, device);
+        assert_eq!(
+            read.events,
+            [
+                TraceEvent::from_input(&press, trace.start),
+                TraceEvent { t_us: 1520, input: TraceInput::Sync }
+            ]
+        );
+
+        let line = DebugEvent {
+            event: TraceEvent::from_input(&press, trace.start),
+            lag_us: 41,
+            rules: vec!["key S".to_string()],
+            output: vec![output[0].to_string()],
+        };
+        assert_eq!(
+            serde_json::to_string(&line).unwrap(),
+            r#"{"t_us":1520,"type":"button","code":"South","pressed":true,"lag_us":41,"rules":["key S"],"output":["Keyboard: S (Press)"]}"#
+        );
+    }
+}
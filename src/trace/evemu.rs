@@ -0,0 +1,203 @@
+// evemu recordings, as written by `evemu-record`
+//
+// A description of the device, then its raw kernel events:
+//
+//   # EVEMU 1.3
+//   N: Microsoft X-Box One pad
+//   I: 0003 045e 02ea 0301
+//   B: 00 0b 00 00 00 00 00 00 00
+//   E: 0.000000 0001 0130 0001	# EV_KEY / BTN_SOUTH 1
+//   E: 0.000000 0000 0000 0000	# ------------ SYN_REPORT (0) ----------
+//
+// Event times are seconds, type and code hex, value decimal. The name, IDs,
+// axis ranges (A: code, then min, max, fuzz, flat and resolution) and events
+// are read; the other capability lines (B:, P: ...) aren't needed to turn
+// the events into a trace. The evdev codes are converted by
+// `platform::evemu_to_trace`, the same way a live controller's are.
+
+use anyhow::{Context, Result, bail};
+
+use crate::input::gamepad::{GamepadType, identify_gamepad};
+use crate::input::range::AxisRange;
+use crate::trace::TraceDevice;
+
+/// One raw kernel event
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct EvemuEvent {
+    /// Microseconds since the first event
+    pub t_us: u64,
+    pub event_type: u16,
+    pub code: u16,
+    pub value: i32,
+}
+
+/// The parts of an evemu recording a trace needs
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct EvemuRecording {
+    pub name: String,
+    pub vendor_id: u16,
+    pub product_id: u16,
+    /// The range of each absolute axis, by evdev code
+    pub ranges: Vec<(u16, AxisRange)>,
+    pub events: Vec<EvemuEvent>,
+}
+
+impl EvemuRecording {
+    /// Parse `evemu-record` output
+    pub fn parse(text: &str) -> Result<Self> {
+        let mut name = None;
+        let mut ids = None;
+        let mut ranges = Vec::new();
+        let mut events = Vec::new();
+        let mut first_us = None;
+
+        for (index, line) in text.lines().enumerate() {
+            let at = || format!("evemu line {}", index + 1);
+            // Comments start lines, and follow events
+            let line = line.split('#').next().unwrap_or("").trim();
+            let Some((kind, rest)) = line.split_once(':') else {
+                continue;
+            };
+            let rest = rest.trim();
+            match kind {
+                "N" => name = Some(rest.to_string()),
+                "I" => {
+                    let fields = hex_fields(rest).with_context(at)?;
+                    let [_bus, vendor_id, product_id, ..] = fields[..] else {
+                        bail!("{}: expected bus, vendor, product and version", at());
+                    };
+                    ids = Some((vendor_id, product_id));
+                }
+                "A" => {
+                    let fields: Vec<&str> = rest.split_whitespace().collect();
+                    let [code, min, max, ..] = fields[..] else {
+                        bail!("{}: expected code, min and max", at());
+                    };
+                    let code = u16::from_str_radix(code, 16)
+                        .with_context(|| format!("{}: invalid code", at()))?;
+                    let [min, max] = [min, max].map(str::parse::<i32>);
+                    let (Ok(min), Ok(max)) = (min, max) else {
+                        bail!("{}: invalid range", at());
+                    };
+                    ranges.push((code, AxisRange::new(min, max)));
+                }
+                "E" => {
+                    let fields: Vec<&str> = rest.split_whitespace().collect();
+                    let [time, event_type, code, value] = fields[..] else {
+                        bail!("{}: expected time, type, code and value", at());
+                    };
+                    let time = parse_time(time).with_context(at)?;
+                    let first = *first_us.get_or_insert(time);
+                    events.push(EvemuEvent {
+                        t_us: time.saturating_sub(first),
+                        event_type: u16::from_str_radix(event_type, 16)
+                            .with_context(|| format!("{}: invalid type", at()))?,
+                        code: u16::from_str_radix(code, 16)
+                            .with_context(|| format!("{}: invalid code", at()))?,
+                        value: value
+                            .parse::<i32>()
+                            .with_context(|| format!("{}: invalid value", at()))?,
+                    });
+                }
+                // Capabilities, properties and the like
+                _ => {}
+            }
+        }
+
+        if name.is_none() && events.is_empty() {
+            bail!("Not an evemu recording: no device name or events");
+        }
+        let (vendor_id, product_id) = ids.unwrap_or((0, 0));
+        Ok(Self {
+            name: name.unwrap_or_else(|| "evemu recording".to_string()),
+            vendor_id,
+            product_id,
+            ranges,
+            events,
+        })
+    }
+
+    /// What the controller would be detected as
+    pub fn gamepad_type(&self) -> GamepadType {
+        identify_gamepad(self.vendor_id, self.product_id)
+    }
+
+    /// The recorded controller, as a trace header describes it
+    pub fn device(&self) -> TraceDevice {
+        TraceDevice {
+            name: self.name.clone(),
+            gamepad_type: self.gamepad_type().to_string(),
+            vendor_id: self.vendor_id,
+            product_id: self.product_id,
+            capabilities: Vec::new(),
+        }
+    }
+}
+
+fn hex_fields(text: &str) -> Result<Vec<u16>> {
+    text.split_whitespace()
+        .map(|field| u16::from_str_radix(field, 16).context("Invalid hex number"))
+        .collect()
+}
+
+/// "SECONDS.MICROSECONDS" as microseconds
+fn parse_time(text: &str) -> Result<u64> {
+    let (seconds, fraction) = text.split_once('.').unwrap_or((text, "0"));
+    if fraction.is_empty() || fraction.len() > 6 || !fraction.bytes().all(|b| b.is_ascii_digit()) {
+        bail!("Invalid time '{}'", text);
+    }
+    let seconds = seconds.parse::<u64>().with_context(|| format!("Invalid time '{}'", text))?;
+    let micros = format!("{:0<6}", fraction).parse::<u64>()?;
+    Ok(seconds * 1_000_000 + micros)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const RECORDING: &str = "# EVEMU 1.3
+# Kernel: 6.8.0
+N: Microsoft X-Box One pad
+I: 0003 045e 02ea 0301
+P: 00 00 00 00 00 00 00 00
+B: 00 0b 00 00 00 00 00 00 00
+A: 00 -32768 32767 16 128 0
+################################
+#      Waiting for events      #
+################################
+E: 1712.250000 0001 0130 0001\t# EV_KEY / BTN_SOUTH            1
+E: 1712.250000 0000 0000 0000\t# ------------ SYN_REPORT (0) ---------- +0ms
+E: 1712.3 0003 0000 -1200\t# EV_ABS / ABS_X                -1200
+";
+
+    #[test]
+    fn test_parse() {
+        let recording = EvemuRecording::parse(RECORDING).unwrap();
+        assert_eq!(recording.name, "Microsoft X-Box One pad");
+        assert_eq!((recording.vendor_id, recording.product_id), (0x045e, 0x02ea));
+        assert_eq!(recording.gamepad_type(), GamepadType::XboxOne);
+        assert_eq!(recording.ranges, [(0, AxisRange::STICK)]);
+        assert_eq!(
+            recording.events,
+            [
+                EvemuEvent { t_us: 0, event_type: 1, code: 0x130, value: 1 },
+                EvemuEvent { t_us: 0, event_type: 0, code: 0, value: 0 },
+                EvemuEvent { t_us: 50_000, event_type: 3, code: 0, value: -1200 },
+            ]
+        );
+        assert_eq!(recording.device().gamepad_type, "Xbox One");
+    }
+
+    #[test]
+    fn test_parse_errors() {
+        let error = |text| EvemuRecording::parse(text).unwrap_err().to_string();
+        assert_eq!(error("{\"trace\":1}"), "Not an evemu recording: no device name or events");
+        assert_eq!(
+            error("N: pad\nE: 0.5 0001 0130\n"),
+            "evemu line 2: expected time, type, code and value"
+        );
+        assert_eq!(error("N: pad\nE: 0.5x 0001 0130 1\n"), "evemu line 2");
+        assert_eq!(error("I: 0003 zz 02ea 0301\n"), "evemu line 1");
+        assert_eq!(error("N: pad\nA: 00 0 x 0 0 0\n"), "evemu line 2: invalid range");
+    }
+}
@@ -0,0 +1,327 @@
+// Event traces: controller input recorded as JSON lines
+//
+// A trace is a header describing the controller, then one line per input
+// event, timed in microseconds from the start of the recording:
+//
+//   {"trace":1,"device":{"name":"Xbox Wireless Controller","type":"Xbox One",...}}
+//   {"t_us":1520,"type":"button","code":"South","pressed":true}
+//   {"t_us":1520,"type":"sync"}
+//   {"t_us":9050,"type":"axis","code":"LeftX","value":-1200}
+//
+// Events are BlazeRemap's own rather than evdev codes, so a trace recorded
+// on one controller plays back through any profile on any machine.
+//
+// docs/trace-format.md is the specification, and docs/trace.schema.json
+// validates every line; both must change with the types below.
+
+pub mod debug;
+pub mod evemu;
+pub mod replay;
+pub mod script;
+
+use anyhow::{Context, Result};
+use flate2::read::GzDecoder;
+use serde::{Deserialize, Serialize};
+use std::io::{Read, Write};
+use std::time::{Duration, Instant};
+
+use crate::event::{AxisCode, ButtonCode, InputEvent};
+use crate::input::gamepad::{GamepadInfo, capabilities_to_strings};
+
+/// Version of the format above; readers refuse newer traces
+pub const TRACE_VERSION: u32 = 1;
+
+/// First bytes of a gzip file, like the debug traces `run --trace` writes
+const GZIP_MAGIC: [u8; 2] = [0x1f, 0x8b];
+
+/// First line of a trace
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct TraceHeader {
+    pub trace: u32,
+    pub device: TraceDevice,
+}
+
+/// The controller a trace was recorded from
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct TraceDevice {
+    pub name: String,
+    #[serde(rename = "type")]
+    pub gamepad_type: String,
+    pub vendor_id: u16,
+    pub product_id: u16,
+    #[serde(default)]
+    pub capabilities: Vec<String>,
+}
+
+impl From<&GamepadInfo> for TraceDevice {
+    fn from(info: &GamepadInfo) -> Self {
+        Self {
+            name: info.name.clone(),
+            gamepad_type: info.gamepad_type.to_string(),
+            vendor_id: info.vendor_id,
+            product_id: info.product_id,
+            capabilities: capabilities_to_strings(&info.capabilities),
+        }
+    }
+}
+
+/// One recorded event
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct TraceEvent {
+    /// Microseconds since the recording started
+    pub t_us: u64,
+    #[serde(flatten)]
+    pub input: TraceInput,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(tag = "type", rename_all = "lowercase")]
+pub enum TraceInput {
+    Button { code: ButtonCode, pressed: bool },
+    Axis { code: AxisCode, value: i32 },
+    Sync,
+}
+
+impl From<&InputEvent> for TraceInput {
+    fn from(event: &InputEvent) -> Self {
+        match *event {
+            InputEvent::Button { code, pressed, .. } => Self::Button { code, pressed },
+            InputEvent::Axis { code, value, .. } => Self::Axis { code, value },
+            InputEvent::Sync { .. } => Self::Sync,
+        }
+    }
+}
+
+impl TraceEvent {
+    /// `event` timed from `start`; events from before it are at 0
+    pub fn from_input(event: &InputEvent, start: Instant) -> Self {
+        let elapsed = event.timestamp().saturating_duration_since(start);
+        Self { t_us: elapsed.as_micros() as u64, input: TraceInput::from(event) }
+    }
+
+    /// The event as if the recording had started at `start`
+    pub fn to_input(&self, start: Instant) -> InputEvent {
+        let timestamp = start + self.offset();
+        match self.input {
+            TraceInput::Button { code, pressed } => InputEvent::Button { code, pressed, timestamp },
+            TraceInput::Axis { code, value } => InputEvent::Axis { code, value, timestamp },
+            TraceInput::Sync => InputEvent::Sync { timestamp },
+        }
+    }
+
+    pub fn offset(&self) -> Duration {
+        Duration::from_micros(self.t_us)
+    }
+}
+
+/// Writes a trace as events arrive
+pub struct TraceWriter<W: Write> {
+    out: W,
+    start: Instant,
+}
+
+impl<W: Write> TraceWriter<W> {
+    /// Write the header; events are timed from `start`
+    pub fn new(mut out: W, device: TraceDevice, start: Instant) -> Result<Self> {
+        let header = TraceHeader { trace: TRACE_VERSION, device };
+        writeln!(out, "{}", serde_json::to_string(&header)?)?;
+        Ok(Self { out, start })
+    }
+
+    /// Append one event
+    ///
+    /// Output is flushed at the end of each frame, so a recording that's
+    /// interrupted loses at most the frame in progress.
+    pub fn record(&mut self, event: &InputEvent) -> Result<()> {
+        let event = TraceEvent::from_input(event, self.start);
+        writeln!(self.out, "{}", serde_json::to_string(&event)?)?;
+        if event.input == TraceInput::Sync {
+            self.out.flush()?;
+        }
+        Ok(())
+    }
+
+    pub fn finish(mut self) -> Result<W> {
+        self.out.flush()?;
+        Ok(self.out)
+    }
+}
+
+/// A whole trace
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Trace {
+    pub header: TraceHeader,
+    pub events: Vec<TraceEvent>,
+}
+
+impl Trace {
+    /// Read a trace, gzip-compressed or not; a last line cut short by an
+    /// interrupted recording is ignored
+    pub fn read(mut input: impl Read) -> Result<Self> {
+        let mut bytes = Vec::new();
+        input.read_to_end(&mut bytes).context("Failed to read trace")?;
+        if bytes.starts_with(&GZIP_MAGIC) {
+            let mut decoded = Vec::new();
+            match GzDecoder::new(bytes.as_slice()).read_to_end(&mut decoded) {
+                // Cut short too; what was decoded is kept
+                Err(e) if e.kind() == std::io::ErrorKind::UnexpectedEof => {}
+                result => {
+                    result.context("Failed to decompress trace")?;
+                }
+            }
+            bytes = decoded;
+        }
+        let text = String::from_utf8(bytes).context("Trace is not UTF-8")?;
+        let cut_short = !text.ends_with('\n');
+        let lines: Vec<_> =
+            text.lines().enumerate().filter(|(_, line)| !line.trim().is_empty()).collect();
+
+        let (_, header) = lines.first().context("Trace is empty")?;
+        let header: TraceHeader =
+            serde_json::from_str(header).context("Trace line 1 is not a trace header")?;
+        if header.trace > TRACE_VERSION {
+            anyhow::bail!(
+                "Trace version {} is newer than this BlazeRemap supports ({})",
+                header.trace,
+                TRACE_VERSION
+            );
+        }
+
+        let mut events = Vec::with_capacity(lines.len());
+        for (i, (index, line)) in lines.iter().enumerate().skip(1) {
+            match serde_json::from_str(line) {
+                Ok(event) => events.push(event),
+                Err(_) if cut_short && i == lines.len() - 1 => break,
+                Err(e) => {
+                    return Err(e).with_context(|| format!("Trace line {} is invalid", index + 1));
+                }
+            }
+        }
+        Ok(Self { header, events })
+    }
+
+    /// Write the trace as `read` reads it
+    pub fn write(&self, mut out: impl Write) -> Result<()> {
+        writeln!(out, "{}", serde_json::to_string(&self.header)?)?;
+        for event in &self.events {
+            writeln!(out, "{}", serde_json::to_string(event)?)?;
+        }
+        out.flush()?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::input::gamepad::{GamepadCapability, GamepadType};
+
+    fn device() -> TraceDevice {
+        TraceDevice::from(&GamepadInfo {
+            path: "/dev/input/event3".to_string(),
+            name: "Xbox Wireless Controller".to_string(),
+            gamepad_type: GamepadType::XboxSeries,
+            vendor_id: 0x045e,
+            product_id: 0x0b13,
+            uniq: None,
+            phys: None,
+            vendor_name: "Microsoft".to_string(),
+            capabilities: vec![GamepadCapability::ForceFeedback],
+        })
+    }
+
+    #[test]
+    fn test_write_and_read() {
+        let start = Instant::now();
+        let events = [
+            InputEvent::button_press_at(ButtonCode::South, start + Duration::from_micros(1520)),
+            InputEvent::sync_at(start + Duration::from_micros(1520)),
+            InputEvent::axis_move_at(AxisCode::LeftX, -1200, start + Duration::from_micros(9050)),
+        ];
+        let mut writer = TraceWriter::new(Vec::new(), device(), start).unwrap();
+        for event in &events {
+            writer.record(event).unwrap();
+        }
+        let text = String::from_utf8(writer.finish().unwrap()).unwrap();
+        let lines: Vec<_> = text.lines().collect();
+        assert_eq!(
+            lines[0],
+            r#"{"trace":1,"device":{"name":"Xbox Wireless Controller","type":"Xbox Series X/S","vendor_id":1118,"product_id":2835,"capabilities":["Force Feedback"]}}"#
+        );
+        assert_eq!(lines[1], r#"{"t_us":1520,"type":"button","code":"South","pressed":true}"#);
+        assert_eq!(lines[2], r#"{"t_us":1520,"type":"sync"}"#);
+        assert_eq!(lines[3], r#"{"t_us":9050,"type":"axis","code":"LeftX","value":-1200}"#);
+
+        let trace = Trace::read(text.as_bytes()).unwrap();
+        assert_eq!(trace.header.device, device());
+        let mut rewritten = Vec::new();
+        trace.write(&mut rewritten).unwrap();
+        assert_eq!(String::from_utf8(rewritten).unwrap(), text);
+        let replayed = Instant::now();
+        let input = trace.events[2].to_input(replayed);
+        assert!(matches!(input, InputEvent::Axis { code: AxisCode::LeftX, value: -1200, .. }));
+        assert_eq!(input.timestamp() - replayed, Duration::from_micros(9050));
+    }
+
+    #[test]
+    fn test_read_tolerates_an_interrupted_recording() {
+        let text = concat!(
+            r#"{"trace":1,"device":{"name":"Pad","type":"Generic","vendor_id":1,"product_id":2}}"#,
+            "\n",
+            r#"{"t_us":5,"type":"sync"}"#,
+            "\n",
+            r#"{"t_us":9,"type":"butt"#
+        );
+        let trace = Trace::read(text.as_bytes()).unwrap();
+        assert_eq!(trace.events, [TraceEvent { t_us: 5, input: TraceInput::Sync }]);
+        assert!(trace.header.device.capabilities.is_empty());
+    }
+
+    #[test]
+    fn test_read_rejects_bad_traces() {
+        let header =
+            r#"{"trace":1,"device":{"name":"Pad","type":"Generic","vendor_id":1,"product_id":2}}"#;
+        let error = |text: &str| Trace::read(text.as_bytes()).unwrap_err().to_string();
+        assert_eq!(error(""), "Trace is empty");
+        assert_eq!(error(r#"{"t_us":5,"type":"sync"}"#), "Trace line 1 is not a trace header");
+        assert_eq!(
+            error(&header.replace(":1,", ":2,")),
+            "Trace version 2 is newer than this BlazeRemap supports (1)"
+        );
+        let bad_code = format!(
+            "{}\n{}\n{}\n",
+            header,
+            r#"{"t_us":5,"type":"button","code":"Nope","pressed":true}"#,
+            r#"{"t_us":6,"type":"sync"}"#
+        );
+        assert_eq!(error(&bad_code), "Trace line 2 is invalid");
+    }
+
+    #[test]
+    fn test_read_ignores_unknown_fields() {
+        let text = concat!(
+            r#"{"trace":1,"device":{"name":"Pad","type":"Generic","vendor_id":1,"product_id":2,"serial":"x"},"host":"h"}"#,
+            "\n",
+            r#"{"t_us":5,"type":"button","code":"South","pressed":true,"raw":304}"#,
+            "\n",
+        );
+        let trace = Trace::read(text.as_bytes()).unwrap();
+        assert_eq!(
+            trace.events,
+            [TraceEvent {
+                t_us: 5,
+                input: TraceInput::Button { code: ButtonCode::South, pressed: true }
+            }]
+        );
+    }
+
+    #[test]
+    fn test_schema_matches_the_format() {
+        let schema: serde_json::Value =
+            serde_json::from_str(include_str!("../../docs/trace.schema.json")).unwrap();
+        let defs = &schema["$defs"];
+        assert_eq!(defs["header"]["properties"]["trace"]["const"], TRACE_VERSION);
+        assert_eq!(defs["button"]["enum"], serde_json::to_value(ButtonCode::ALL).unwrap());
+        assert_eq!(defs["axis"]["enum"], serde_json::to_value(AxisCode::ALL).unwrap());
+    }
+}
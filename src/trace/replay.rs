@@ -0,0 +1,192 @@
+// Replaying traces through a mapping engine
+//
+// Frames are mapped the way the event loop maps them: everything up to a
+// sync, then the keys it produced. Each event keeps its recorded time
+// relative to the start of the replay, so debouncing and other timing
+// sensitive mappings behave as they did live, even when not paced. What
+// the engine has due between frames, like a slow key's press, is mapped at
+// the time it's due.
+
+use anyhow::Result;
+use std::time::Instant;
+
+use super::{Trace, TraceInput};
+use crate::{
+    event::{ActionEvent, InputEvent, KeyboardEventType, OutputEvent},
+    mapping::MappingEngine,
+    output::mouse::MouseEvent,
+};
+
+/// What one frame of a trace was mapped to
+#[derive(Debug, Clone, Copy)]
+pub struct ReplayFrame<'a> {
+    /// Time of the frame's sync, in microseconds into the trace
+    pub t_us: u64,
+    pub output: &'a [OutputEvent],
+    /// Actions the frame triggered; replay never runs them
+    pub actions: &'a [ActionEvent],
+}
+
+/// One line per key and action, stamped with the frame's time; what
+/// `blazeremap replay` prints
+impl std::fmt::Display for ReplayFrame<'_> {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let time = self.t_us as f64 / 1000.0;
+        let pressed = |pressed: bool| if pressed { "pressed" } else { "released" };
+        for event in self.output {
+            match event {
+                OutputEvent::Keyboard { code, event_type } => {
+                    let what = match event_type {
+                        KeyboardEventType::Press => "pressed",
+                        KeyboardEventType::Release => "released",
+                        KeyboardEventType::Hold => "held",
+                    };
+                    writeln!(f, "[{:>10.3}ms] {} {}", time, code, what)?;
+                }
+                OutputEvent::Mouse(MouseEvent::Button { button, pressed: down }) => {
+                    writeln!(f, "[{:>10.3}ms] mouse {:?} {}", time, button, pressed(*down))?;
+                }
+                OutputEvent::Mouse(event) => writeln!(f, "[{:>10.3}ms] mouse {:?}", time, event)?,
+                OutputEvent::Gamepad { control, pressed: down } => {
+                    writeln!(f, "[{:>10.3}ms] gamepad {} {}", time, control, pressed(*down))?;
+                }
+                OutputEvent::Routed { .. } => writeln!(f, "[{:>10.3}ms] {}", time, event)?,
+            }
+        }
+        for action in self.actions {
+            let what = if action.pressed { "triggered" } else { "released" };
+            let source = action.source.name();
+            writeln!(f, "[{:>10.3}ms] action {} ({}) {}", time, action.action, source, what)?;
+        }
+        Ok(())
+    }
+}
+
+/// Map `trace` with `engine`, handing `emit` every frame that produced
+/// something
+///
+/// With `paced`, frames are mapped at their recorded times rather than as
+/// fast as possible.
+pub fn replay(
+    trace: &Trace,
+    engine: &mut MappingEngine,
+    paced: bool,
+    mut emit: impl FnMut(ReplayFrame<'_>) -> Result<()>,
+) -> Result<()> {
+    let start = Instant::now();
+    let mut frame: Vec<InputEvent> = Vec::new();
+    let mut output = Vec::new();
+    let mut actions = Vec::new();
+    let mut events = trace.events.iter().peekable();
+
+    while let Some(event) = events.next() {
+        if event.input != TraceInput::Sync {
+            frame.push(event.to_input(start));
+            // A trace that ends mid-frame still has its last events mapped
+            if events.peek().is_some() {
+                continue;
+            }
+        }
+        if frame.is_empty() {
+            continue;
+        }
+        // What the engine had due while the controller was idle, at its time
+        while let Some(deadline) =
+            engine.next_deadline().filter(|&deadline| deadline <= frame[0].timestamp())
+        {
+            if paced {
+                std::thread::sleep(deadline.saturating_duration_since(Instant::now()));
+            }
+            output.clear();
+            engine.tick(deadline, &mut output);
+            actions.clear();
+            actions.extend(engine.drain_actions());
+            if !output.is_empty() || !actions.is_empty() {
+                let t_us = deadline.saturating_duration_since(start).as_micros() as u64;
+                emit(ReplayFrame { t_us, output: &output, actions: &actions })?;
+            }
+        }
+        if paced {
+            std::thread::sleep((start + event.offset()).saturating_duration_since(Instant::now()));
+        }
+
+        output.clear();
+        for input in frame.drain(..) {
+            engine.process_into(&input, &mut output)?;
+        }
+        actions.clear();
+        actions.extend(engine.drain_actions());
+        if !output.is_empty() || !actions.is_empty() {
+            emit(ReplayFrame { t_us: event.t_us, output: &output, actions: &actions })?;
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::event::{ActionSource, ButtonCode, KeyboardCode};
+    use crate::trace::{TRACE_VERSION, TraceDevice, TraceEvent, TraceHeader};
+
+    fn trace(events: &[(u64, TraceInput)]) -> Trace {
+        Trace {
+            header: TraceHeader {
+                trace: TRACE_VERSION,
+                device: TraceDevice {
+                    name: "Pad".to_string(),
+                    gamepad_type: "Generic".to_string(),
+                    vendor_id: 1,
+                    product_id: 2,
+                    capabilities: Vec::new(),
+                },
+            },
+            events: events.iter().map(|&(t_us, input)| TraceEvent { t_us, input }).collect(),
+        }
+    }
+
+    #[test]
+    fn test_replay_maps_frames() {
+        let press = TraceInput::Button { code: ButtonCode::South, pressed: true };
+        let release = TraceInput::Button { code: ButtonCode::South, pressed: false };
+        let trace = trace(&[
+            (100, press),
+            (100, TraceInput::Sync),
+            (200, TraceInput::Sync),
+            (50_000, release),
+        ]);
+
+        let mut frames = Vec::new();
+        replay(&trace, &mut MappingEngine::new_hardcoded(), false, |frame| {
+            frames.push((frame.t_us, frame.output.to_vec()));
+            Ok(())
+        })
+        .unwrap();
+
+        let key = |event_type| OutputEvent::Keyboard { code: KeyboardCode::S, event_type };
+        assert_eq!(
+            frames,
+            [
+                (100, vec![key(KeyboardEventType::Press)]),
+                (50_000, vec![key(KeyboardEventType::Release)])
+            ]
+        );
+    }
+
+    #[test]
+    fn test_frame_display() {
+        let output =
+            [OutputEvent::Keyboard { code: KeyboardCode::S, event_type: KeyboardEventType::Press }];
+        let actions = [ActionEvent {
+            action: 0,
+            source: ActionSource::Button(ButtonCode::Mode),
+            pressed: true,
+            value: 1,
+        }];
+        let frame = ReplayFrame { t_us: 1520, output: &output, actions: &actions };
+        assert_eq!(
+            frame.to_string(),
+            "[     1.520ms] S pressed\n[     1.520ms] action 0 (Mode) triggered\n"
+        );
+    }
+}
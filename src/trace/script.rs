@@ -0,0 +1,175 @@
+// Simulation scripts: controller input written by hand
+//
+// One command per line, compiled to the same events a recorded trace holds:
+//
+//   # hold A, then push the left stick right for a moment
+//   press South
+//   wait 100
+//   release South
+//   tap East 50
+//   axis LeftX 32767
+//   wait 200
+//   axis LeftX 0
+//
+// `press`, `release` and `tap` take one or more buttons, changed together in
+// one frame; `tap` holds them for 50ms unless a time is given. Names are the
+// ones profiles use (South, LeftShoulder, DPadX, ...). Times are milliseconds.
+
+use anyhow::{Context, Result, bail};
+use std::time::Duration;
+
+use super::{TraceEvent, TraceInput};
+use crate::event::{AxisCode, ButtonCode};
+
+/// How long `tap` holds buttons when no time is given
+pub const DEFAULT_TAP_MS: u64 = 50;
+
+/// A compiled script
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Script {
+    /// Events timed from 0
+    pub events: Vec<TraceEvent>,
+    /// How long the script runs, including a final wait
+    pub length: Duration,
+}
+
+/// Compile a script
+pub fn parse(text: &str) -> Result<Script> {
+    let mut events = Vec::new();
+    let mut t_us = 0;
+    for (index, line) in text.lines().enumerate() {
+        parse_line(line, &mut t_us, &mut events)
+            .with_context(|| format!("Script line {}", index + 1))?;
+    }
+    Ok(Script { events, length: Duration::from_micros(t_us) })
+}
+
+/// Compile one line, appending its events at `t_us` and moving it past waits
+pub fn parse_line(line: &str, t_us: &mut u64, events: &mut Vec<TraceEvent>) -> Result<()> {
+    let line = line.split('#').next().unwrap_or_default();
+    let mut words = line.split_whitespace();
+    let Some(command) = words.next() else {
+        return Ok(());
+    };
+    let args: Vec<&str> = words.collect();
+
+    match command {
+        "press" | "release" => {
+            let buttons = buttons(&args)?;
+            press(events, *t_us, &buttons, command == "press");
+        }
+        "tap" => {
+            let (hold, names) = match args.split_last().map(|(last, rest)| (last.parse(), rest)) {
+                Some((Ok(ms), rest)) => (ms, rest),
+                _ => (DEFAULT_TAP_MS, &args[..]),
+            };
+            let buttons = buttons(names)?;
+            press(events, *t_us, &buttons, true);
+            *t_us += hold * 1000;
+            press(events, *t_us, &buttons, false);
+        }
+        "axis" => {
+            let [name, value] = args[..] else {
+                bail!("Expected 'axis AXIS VALUE'");
+            };
+            let code = AxisCode::from(name);
+            if code == AxisCode::Unknown {
+                bail!("Unknown axis '{}'", name);
+            }
+            let value =
+                value.parse::<i32>().with_context(|| format!("Invalid axis value '{}'", value))?;
+            events.push(TraceEvent { t_us: *t_us, input: TraceInput::Axis { code, value } });
+            events.push(TraceEvent { t_us: *t_us, input: TraceInput::Sync });
+        }
+        "wait" => {
+            let [ms] = args[..] else {
+                bail!("Expected 'wait MILLISECONDS'");
+            };
+            let ms = ms.parse::<u64>().with_context(|| format!("Invalid wait time '{}'", ms))?;
+            *t_us += ms * 1000;
+        }
+        other => bail!("Unknown command '{}' (press, release, tap, axis or wait)", other),
+    }
+    Ok(())
+}
+
+/// One frame changing all of `buttons`
+fn press(events: &mut Vec<TraceEvent>, t_us: u64, buttons: &[ButtonCode], pressed: bool) {
+    let inputs = buttons.iter().map(|&code| TraceInput::Button { code, pressed });
+    events.extend(inputs.map(|input| TraceEvent { t_us, input }));
+    events.push(TraceEvent { t_us, input: TraceInput::Sync });
+}
+
+fn buttons(names: &[&str]) -> Result<Vec<ButtonCode>> {
+    if names.is_empty() {
+        bail!("Expected at least one button");
+    }
+    names
+        .iter()
+        .map(|&name| match ButtonCode::from(name) {
+            ButtonCode::Unknown => bail!("Unknown button '{}'", name),
+            code => Ok(code),
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn button(t_us: u64, code: ButtonCode, pressed: bool) -> TraceEvent {
+        TraceEvent { t_us, input: TraceInput::Button { code, pressed } }
+    }
+
+    fn sync(t_us: u64) -> TraceEvent {
+        TraceEvent { t_us, input: TraceInput::Sync }
+    }
+
+    #[test]
+    fn test_parse_script() {
+        let script = parse(
+            "# warm up\n\
+             press South LeftShoulder\n\
+             wait 100\n\
+             release South   # keep the shoulder held\n\
+             \n\
+             axis LeftX -32768\n\
+             wait 50\n",
+        )
+        .unwrap();
+        assert_eq!(script.length, Duration::from_millis(150));
+        let axis = TraceEvent {
+            t_us: 100_000,
+            input: TraceInput::Axis { code: AxisCode::LeftX, value: -32768 },
+        };
+        assert_eq!(
+            script.events,
+            [
+                button(0, ButtonCode::South, true),
+                button(0, ButtonCode::LeftShoulder, true),
+                sync(0),
+                button(100_000, ButtonCode::South, false),
+                sync(100_000),
+                axis,
+                sync(100_000),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_tap_holds_for_given_or_default_time() {
+        let events = parse("tap East\ntap North 20").unwrap().events;
+        let times: Vec<_> = events.iter().map(|e| e.t_us).collect();
+        assert_eq!(times, [0, 0, 50_000, 50_000, 50_000, 50_000, 70_000, 70_000]);
+        assert_eq!(events[6], button(70_000, ButtonCode::North, false));
+    }
+
+    #[test]
+    fn test_errors_name_the_line() {
+        let err = parse("press South\npress Jump").unwrap_err();
+        assert_eq!(format!("{:#}", err), "Script line 2: Unknown button 'Jump'");
+        for bad in ["axis LeftX", "axis Throttle 5", "wait soon", "tap", "jump South"] {
+            assert!(parse(bad).is_err(), "{}", bad);
+        }
+    }
+}
@@ -80,3 +80,50 @@ fn test_detect_short_verbose_flag() {
 
     cmd.assert().success().stdout(predicates::str::contains("Detecting gamepads"));
 }
+
+#[test]
+fn test_usage_errors_exit_64() {
+    let mut cmd = cargo_bin_cmd!("blazeremap");
+    cmd.arg("detect").arg("--no-such-flag");
+
+    cmd.assert().code(64).stderr(predicates::str::contains("unexpected argument"));
+}
+
+#[test]
+fn test_quiet_leaves_out_progress() {
+    let mut cmd = cargo_bin_cmd!("blazeremap");
+    cmd.arg("detect").arg("--quiet");
+
+    cmd.assert().success().stdout(predicates::str::contains("Detecting gamepads").not());
+}
+
+#[test]
+fn test_no_daemon_exits_5() {
+    let mut cmd = cargo_bin_cmd!("blazeremap");
+    cmd.arg("status").env("BLAZEREMAP_SOCKET", "/nonexistent/blazeremap.sock");
+
+    cmd.assert().code(5).stderr(predicates::str::contains("No running daemon found"));
+}
+
+#[test]
+fn test_command_aliases() {
+    let mut cmd = cargo_bin_cmd!("blazeremap");
+    cmd.arg("ls").arg("--help");
+
+    cmd.assert().success().stdout(predicates::str::contains("Detect gamepads"));
+
+    let mut cmd = cargo_bin_cmd!("blazeremap");
+    cmd.arg("remap").arg("--help");
+
+    cmd.assert().success().stdout(predicates::str::contains("Run the remapping daemon"));
+}
+
+#[test]
+fn test_misplaced_subcommand_tip() {
+    let mut cmd = cargo_bin_cmd!("blazeremap");
+    cmd.arg("lint").arg("game.toml");
+
+    cmd.assert().code(64).stderr(predicates::str::contains(
+        "tip: a similar command exists under another: 'blazeremap profile lint'",
+    ));
+}
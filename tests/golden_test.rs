@@ -0,0 +1,99 @@
+//! Golden-file tests for the mapping engine (no hardware)
+//!
+//! Every directory in tests/testdata/golden is a case: a profile
+//! (`profile.toml`, `.yaml` or `.json`), an input trace (`input.jsonl`, as
+//! written by `blazeremap record`, or `input.evemu`, as written by
+//! `evemu-record`) and the output expected from mapping one with the other
+//! (`expected.txt`, as printed by `blazeremap replay`).
+//!
+//! After an intended change in behavior, regenerate the expected files with
+//! `BLAZEREMAP_UPDATE_GOLDEN=1 cargo test --test golden_test` and review the diff.
+use blazeremap::{
+    Profile,
+    mapping::MappingEngine,
+    platform,
+    trace::{Trace, evemu::EvemuRecording, replay},
+};
+use std::path::{Path, PathBuf};
+
+const UPDATE_ENV: &str = "BLAZEREMAP_UPDATE_GOLDEN";
+
+fn cases() -> Vec<PathBuf> {
+    let root = Path::new(env!("CARGO_MANIFEST_DIR")).join("tests/testdata/golden");
+    let mut cases: Vec<_> = std::fs::read_dir(root)
+        .unwrap()
+        .map(|entry| entry.unwrap().path())
+        .filter(|path| path.is_dir())
+        .collect();
+    cases.sort();
+    cases
+}
+
+/// The case's profile, in whichever format it's written
+fn profile_path(case: &Path) -> PathBuf {
+    ["toml", "yaml", "yml", "json"]
+        .iter()
+        .map(|extension| case.join("profile").with_extension(extension))
+        .find(|path| path.exists())
+        .unwrap_or_else(|| panic!("{} has no profile", case.display()))
+}
+
+/// The case's input, converted if it's an evemu recording
+fn read_trace(case: &Path) -> Trace {
+    let evemu = case.join("input.evemu");
+    if evemu.exists() {
+        let recording = EvemuRecording::parse(&std::fs::read_to_string(evemu).unwrap()).unwrap();
+        return platform::evemu_to_trace(&recording).unwrap();
+    }
+    let trace = std::fs::File::open(case.join("input.jsonl")).unwrap();
+    Trace::read(std::io::BufReader::new(trace)).unwrap()
+}
+
+/// Replay the case's trace through its profile as fast as possible
+fn run_case(case: &Path) -> String {
+    let profile = Profile::load_from_file(&profile_path(case)).unwrap();
+    let mut engine = MappingEngine::load_from_profile(&profile).unwrap();
+    let trace = read_trace(case);
+
+    let mut output = String::new();
+    replay::replay(&trace, &mut engine, false, |frame| {
+        output.push_str(&frame.to_string());
+        Ok(())
+    })
+    .unwrap();
+    output
+}
+
+#[test]
+fn test_golden_traces() {
+    let update = std::env::var_os(UPDATE_ENV).is_some();
+    let cases = cases();
+    assert!(!cases.is_empty(), "no golden cases found");
+
+    let mut failures = Vec::new();
+    for case in &cases {
+        let actual = run_case(case);
+        let expected_path = case.join("expected.txt");
+        if update {
+            std::fs::write(&expected_path, &actual).unwrap();
+            continue;
+        }
+        let expected = std::fs::read_to_string(&expected_path).unwrap_or_default();
+        if actual != expected {
+            failures.push(format!(
+                "{}:\n--- expected\n{}--- actual\n{}",
+                case.file_name().unwrap().to_string_lossy(),
+                expected,
+                actual
+            ));
+        }
+    }
+    assert!(
+        failures.is_empty(),
+        "{} of {} golden cases differ (rerun with {}=1 to accept):\n\n{}",
+        failures.len(),
+        cases.len(),
+        UPDATE_ENV,
+        failures.join("\n")
+    );
+}
@@ -1,6 +1,7 @@
 use std::time::{Duration, Instant};
 
 use blazeremap::mapping::MappingEngine;
+use blazeremap::output::identity::VirtualDeviceIdentity;
 
 #[test]
 #[ignore]
@@ -9,15 +10,15 @@ fn test_real_hardware_latency() {
 
     wait_for_user("Connect your controller and prepare to rapidly press buttons");
 
-    let manager = blazeremap::platform::new_input_manager();
+    let manager = blazeremap::platform::new_input_manager().unwrap();
     let gamepads = manager.list_gamepads().unwrap();
     assert!(!gamepads.gamepad_info.is_empty());
 
     println!("\n📱 Using controller: {}", gamepads.gamepad_info[0].name);
 
     let mut controller = manager.open_gamepad(&gamepads.gamepad_info[0].path).unwrap();
-    let mut keyboard =
-        blazeremap::platform::new_virtual_keyboard("BlazeRemap Latency Test").unwrap();
+    let identity = VirtualDeviceIdentity::named("BlazeRemap Latency Test");
+    let mut keyboard = blazeremap::platform::new_virtual_keyboard(&identity).unwrap();
     let mut engine = MappingEngine::new_hardcoded();
 
     println!("\n👉 Rapidly press buttons for 10 seconds...");
@@ -50,6 +51,8 @@ fn test_real_hardware_latency() {
                                 _ => Some(()),
                             };
                         }
+                        // The default profile only maps to keys
+                        _ => {}
                     }
                 }
 
@@ -1,4 +1,8 @@
+// evdev and the uinput keyboard exist on Linux only
+#![cfg(target_os = "linux")]
+
 use blazeremap::event::KeyboardCode;
+use blazeremap::output::identity::VirtualDeviceIdentity;
 use blazeremap::output::keyboard::VirtualKeyboard;
 use blazeremap::platform::linux::LinuxVirtualKeyboard;
 use evdev::Device;
@@ -28,7 +32,8 @@ fn find_device_by_name(name: &str) -> Option<String> {
 #[ignore] // Only run with: cargo test -- --ignored --include-ignored
 fn test_virtual_keyboard_creation() {
     // This test requires root/uinput permissions
-    let result = LinuxVirtualKeyboard::new("BlazeRemap Integration Test");
+    let result =
+        LinuxVirtualKeyboard::new(&VirtualDeviceIdentity::named("BlazeRemap Integration Test"));
 
     assert!(result.is_ok(), "Failed to create virtual keyboard: {:?}", result.err());
 
@@ -45,8 +50,9 @@ fn test_virtual_keyboard_creation() {
 #[test]
 #[ignore]
 fn test_virtual_keyboard_key_press_release() {
-    let mut keyboard = LinuxVirtualKeyboard::new("BlazeRemap Key Test")
-        .expect("Failed to create virtual keyboard");
+    let mut keyboard =
+        LinuxVirtualKeyboard::new(&VirtualDeviceIdentity::named("BlazeRemap Key Test"))
+            .expect("Failed to create virtual keyboard");
 
     // Test press
     let result = keyboard.press_key(blazeremap::event::KeyboardCode::A);
@@ -64,8 +70,9 @@ fn test_virtual_keyboard_key_press_release() {
 #[test]
 #[ignore]
 fn test_virtual_keyboard_tap() {
-    let mut keyboard = LinuxVirtualKeyboard::new("BlazeRemap Tap Test")
-        .expect("Failed to create virtual keyboard");
+    let mut keyboard =
+        LinuxVirtualKeyboard::new(&VirtualDeviceIdentity::named("BlazeRemap Tap Test"))
+            .expect("Failed to create virtual keyboard");
 
     // Test tap (press + release)
     let result = keyboard.tap_key(blazeremap::event::KeyboardCode::Space);
@@ -77,8 +84,9 @@ fn test_virtual_keyboard_tap() {
 #[test]
 #[ignore]
 fn test_virtual_keyboard_multiple_keys() {
-    let mut keyboard = LinuxVirtualKeyboard::new("BlazeRemap Multi Key Test")
-        .expect("Failed to create virtual keyboard");
+    let mut keyboard =
+        LinuxVirtualKeyboard::new(&VirtualDeviceIdentity::named("BlazeRemap Multi Key Test"))
+            .expect("Failed to create virtual keyboard");
 
     let keys = [KeyboardCode::A, KeyboardCode::B, KeyboardCode::C, KeyboardCode::Space];
 
@@ -97,8 +105,8 @@ fn test_virtual_keyboard_cleanup() {
     let device_name = "BlazeRemap Cleanup Test";
 
     // Create keyboard
-    let keyboard =
-        LinuxVirtualKeyboard::new(device_name).expect("Failed to create virtual keyboard");
+    let keyboard = LinuxVirtualKeyboard::new(&VirtualDeviceIdentity::named(device_name))
+        .expect("Failed to create virtual keyboard");
 
     thread::sleep(Duration::from_millis(100));
 
@@ -122,8 +130,9 @@ fn test_virtual_keyboard_cleanup() {
 #[test]
 #[ignore]
 fn test_virtual_keyboard_sys_path() {
-    let mut keyboard = LinuxVirtualKeyboard::new("BlazeRemap SysPath Test")
-        .expect("Failed to create virtual keyboard");
+    let mut keyboard =
+        LinuxVirtualKeyboard::new(&VirtualDeviceIdentity::named("BlazeRemap SysPath Test"))
+            .expect("Failed to create virtual keyboard");
 
     let sys_path = keyboard.sys_path();
     assert!(sys_path.is_ok(), "Failed to get sys_path: {:?}", sys_path.err());
@@ -137,8 +146,9 @@ fn test_virtual_keyboard_sys_path() {
 #[test]
 #[ignore]
 fn test_virtual_keyboard_rapid_events() {
-    let mut keyboard = LinuxVirtualKeyboard::new("BlazeRemap Rapid Test")
-        .expect("Failed to create virtual keyboard");
+    let mut keyboard =
+        LinuxVirtualKeyboard::new(&VirtualDeviceIdentity::named("BlazeRemap Rapid Test"))
+            .expect("Failed to create virtual keyboard");
 
     // Simulate rapid button mashing (100 taps)
     for _ in 0..100 {